@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/internal/cache"
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/logger"
+	"github.com/thepenn/devsys/internal/utils"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+func main() {
+	// 读取配置
+	cfg, err := config.Environ()
+	if err != nil {
+		log.Fatal().Err(err).Msg("get config error")
+	}
+
+	// 配置程序ctx
+	ctx := utils.WithContext(context.Background())
+
+	// 初始化日志
+	if err := logger.InitLogging(cfg.Logging.Level, cfg.Logging.Pretty, true); err != nil {
+		log.Fatal().Err(err).Msg("init logger error")
+	}
+
+	if strings.TrimSpace(cfg.Pipeline.AgentToken) == "" {
+		log.Fatal().Msg("PIPELINE_AGENT_TOKEN is required")
+	}
+	name := strings.TrimSpace(cfg.Agent.Name)
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			log.Fatal().Err(err).Msg("AGENT_NAME is required")
+		}
+	}
+	labels := make(map[string]string, len(cfg.Agent.Labels))
+	for _, label := range cfg.Agent.Labels {
+		key, value, ok := strings.Cut(strings.TrimSpace(label), "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			log.Fatal().Str("label", label).Msg("AGENT_LABELS entries must be key=value")
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	stepCeiling, err := pipelineService.ParseStepResources(cfg.Pipeline.StepResources.MaxCPU, cfg.Pipeline.StepResources.MaxMemory)
+	if err != nil {
+		log.Fatal().Err(err).Msg("pipeline step resource ceiling error")
+	}
+	c := cache.New(5 * time.Minute)
+	defer c.Close()
+
+	// the agent has no database: runs are read and written through the server
+	client := pipelineService.NewAgentClient(cfg.Agent.Server, cfg.Pipeline.AgentToken)
+	pipeline := pipelineService.NewService(nil, nil, c,
+		pipelineService.WithAgentServer(client),
+		pipelineService.WithMaxParallelSteps(cfg.Pipeline.MaxParallelSteps),
+		pipelineService.WithStepResourceCeiling(stepCeiling),
+		pipelineService.WithWorkspaceCacheLimit(cfg.Pipeline.CacheMaxSize),
+		pipelineService.WithLogLimits(pipelineService.LogLimits{
+			MaxLines:  cfg.Pipeline.Logs.MaxLines,
+			TailLines: cfg.Pipeline.Logs.TailLines,
+		}),
+		pipelineService.WithHostEnv(cfg.Pipeline.InheritHostEnv, cfg.Pipeline.HostEnv),
+	)
+
+	registration := pipelineService.AgentRegistration{Name: name, Version: version, Labels: labels}
+	log.Info().Str("server", cfg.Agent.Server).Str("name", name).Interface("labels", labels).Msg("Starting pipeline agent")
+	if err := pipeline.RunAgent(ctx, registration); err != nil && ctx.Err() == nil {
+		log.Error().Err(err).Msg("agent stop error")
+	}
+}
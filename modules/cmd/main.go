@@ -5,7 +5,6 @@ import (
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/errgroup"
 
 	"github.com/thepenn/devsys/cmd/wire"
 	"github.com/thepenn/devsys/internal/config"
@@ -39,19 +38,10 @@ func main() {
 		}
 	}()
 
-	if err := app.Start(ctx); err != nil {
-		log.Fatal().Err(err).Msg("failed to start services")
-	}
-
-	g := errgroup.Group{}
-
-	// 启动 HTTP Server
-	g.Go(func() error {
-		log.Info().Str("addr", cfg.Server.Host).Msg("Starting HTTP server")
-		return app.HttpServer.ListenAndServe(ctx)
-	})
-
-	if err := g.Wait(); err != nil {
+	// SIGINT and SIGTERM cancel ctx: Run returns once the HTTP server finished its in-flight
+	// requests, then the deferred app.Close drains the pipeline workers, flushes the audit
+	// events and closes the database
+	if err := app.Run(ctx); err != nil {
 		log.Error().Err(err).Msg("Server stop error")
 	}
 }
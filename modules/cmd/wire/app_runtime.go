@@ -3,22 +3,63 @@ package wire
 import (
 	"context"
 	"errors"
+
+	"github.com/rs/zerolog/log"
 )
 
 // Start initialises background services.
 func (a *App) Start(ctx context.Context) error {
-	if a.Services != nil && a.Services.Pipeline != nil {
+	if a.Services != nil {
+		capabilities := a.Services.Capabilities()
+		if len(capabilities.Disabled) > 0 {
+			log.Warn().Interface("disabled", capabilities.Disabled).Interface("enabled", capabilities.Enabled).Msg("some capabilities are disabled")
+		} else {
+			log.Info().Interface("enabled", capabilities.Enabled).Msg("all capabilities enabled")
+		}
+	}
+	if a.Services != nil {
+		// stopped by Close after the pipeline workers, so the events of runs that finish while
+		// the pipeline queue drains are still written
+		a.Services.Audit.Start(context.WithoutCancel(ctx))
+	}
+	if a.Services != nil && a.Services.K8s != nil {
+		a.Services.K8s.StartDriftChecks(ctx)
+	}
+	if a.Services != nil && a.Services.Pipeline.Available() {
 		return a.Services.Pipeline.Start(ctx)
 	}
 	return nil
 }
 
-// Close releases resources.
+// Run starts the background services and serves HTTP until ctx is done. It returns once the
+// HTTP server finished its in-flight requests; Close then stops the rest. The background
+// services run on a context of their own, so pipelines and drift checks keep going while the
+// last requests are answered.
+func (a *App) Run(ctx context.Context) error {
+	background, stop := context.WithCancel(context.WithoutCancel(ctx))
+	a.stopBackground = stop
+	if err := a.Start(background); err != nil {
+		return err
+	}
+	log.Info().Str("addr", a.HttpServer.Addr).Msg("Starting HTTP server")
+	return a.HttpServer.ListenAndServe(ctx)
+}
+
+// Close releases resources once the HTTP server stopped accepting requests: it drains the
+// pipeline workers within their grace period, stops the other background services, flushes
+// the audit events and closes the database last.
 func (a *App) Close() error {
 	var errs []error
 	if a.Services != nil && a.Services.Pipeline != nil {
 		a.Services.Pipeline.Shutdown()
 	}
+	if a.stopBackground != nil {
+		a.stopBackground()
+	}
+	if a.Services != nil {
+		// after the pipeline service, so the events of the last runs are written
+		a.Services.Audit.Shutdown()
+	}
 	if a.Cache != nil {
 		a.Cache.Close()
 	}
@@ -0,0 +1,294 @@
+package wire
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/thepenn/devsys/internal/server"
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/internal/utils"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
+	"github.com/thepenn/devsys/service/migrate"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// openSQLite opens the SQLite database at path; the test reopens it after the app closed it.
+func openSQLite(t *testing.T, path string) *store.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open("file:"+path+"?_pragma=busy_timeout(10000)&_txlock=immediate"), &gorm.Config{
+		SkipDefaultTransaction: true,
+		TranslateError:         true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db := store.New(conn)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSIGTERMShutsDownInOrder sends SIGTERM to the test process while a request is in flight
+// and a pipeline step is running, and checks main's shutdown order: the HTTP server answers
+// the request and stops, the pipeline service lets the run finish and records it, then the
+// database is closed.
+func TestSIGTERMShutsDownInOrder(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "devsys.db")
+	db := openSQLite(t, dbPath)
+	if err := migrate.AutoMigrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo := &model.Repo{ID: 1, ForgeRemoteID: "1", Owner: "team", Name: "app", FullName: "team/app", Branch: "main", IsActive: true}
+	if err := db.GetDB().Create(repo).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	pipelines := pipelineService.NewService(db, queue.New(8), nil, pipelineService.WithShutdownGracePeriod(30*time.Second))
+	// the step waits for the release file, so it is still running when the signal arrives
+	release := filepath.Join(dir, "release")
+	config := fmt.Sprintf(`name: app
+workspace: %s
+steps:
+  build:
+    runtime: host
+    commands:
+      - while [ ! -f %s ]; do sleep 0.05; done
+`, filepath.Join(dir, "workspace"), release)
+	if _, err := pipelines.UpsertPipelineConfig(context.Background(), repo.ID, config, "alice", ""); err != nil {
+		t.Fatalf("UpsertPipelineConfig: %v", err)
+	}
+	// without a Dockerfile a step leaving its workspace behind fails
+	if _, err := pipelines.UpsertPipelineSettings(context.Background(), repo.ID, model.RepoPipelineConfig{Dockerfile: "FROM scratch\n"}); err != nil {
+		t.Fatalf("UpsertPipelineSettings: %v", err)
+	}
+
+	started := make(chan struct{})
+	answer := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-answer
+		}
+		_, _ = io.WriteString(w, "done")
+	})
+	addr := freeAddr(t)
+	app := &App{
+		HttpServer: server.NewHttpServer(addr, handler, 5*time.Second),
+		Services:   &service.Services{Pipeline: pipelines},
+		DB:         db,
+	}
+
+	signalled := make(chan struct{})
+	ctx := utils.WithContextFunc(context.Background(), func() { close(signalled) })
+	stopped := make(chan error, 1)
+	go func() { stopped <- app.Run(ctx) }()
+	waitFor(t, "the HTTP server", func() bool {
+		resp, err := http.Get("http://" + addr + "/ready")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	})
+
+	settings, err := pipelines.GetPipelineSettings(context.Background(), repo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := pipelines.TriggerManualPipeline(context.Background(), repo, "alice", model.PipelineOptions{Branch: "main"}, settings)
+	if err != nil {
+		t.Fatalf("TriggerManualPipeline: %v", err)
+	}
+	status := func() model.StatusValue {
+		var stored model.Pipeline
+		if err := db.GetDB().First(&stored, run.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored.Status
+	}
+	waitFor(t, "the pipeline to run", func() bool { return status() == model.StatusRunning })
+
+	answered := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			answered <- 0
+			return
+		}
+		resp.Body.Close()
+		answered <- resp.StatusCode
+	}()
+	<-started
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-signalled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SIGTERM did not cancel the app context")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("Run returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 1. the HTTP server answers the request in flight and stops
+	close(answer)
+	if code := <-answered; code != http.StatusOK {
+		t.Fatalf("in-flight request = %d, want 200", code)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the last request finished")
+	}
+	if got := status(); got != model.StatusRunning {
+		t.Fatalf("pipeline = %s once the HTTP server stopped, want it still running", got)
+	}
+
+	// 2. Close waits for the run, which records its result while the database is open
+	const stepLeft = 300 * time.Millisecond
+	go func() {
+		time.Sleep(stepLeft)
+		_ = os.WriteFile(release, nil, 0o644)
+	}()
+	closing := time.Now()
+	if err := app.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if waited := time.Since(closing); waited < stepLeft {
+		t.Fatalf("Close returned after %s, before the running step finished", waited)
+	}
+
+	// 3. the database is closed last
+	if err := db.GetDB().Exec("SELECT 1").Error; err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("query after Close = %v, want the database closed", err)
+	}
+	var stored model.Pipeline
+	if err := openSQLite(t, dbPath).GetDB().First(&stored, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	var logs []model.LogEntry
+	_ = openSQLite(t, dbPath).GetDB().Find(&logs).Error
+	if stored.Status != model.StatusSuccess || stored.Finished == 0 {
+		t.Fatalf("pipeline = %s finished %d after shutdown, want its success recorded", stored.Status, stored.Finished)
+	}
+}
+
+func TestRunFinishesInFlightRequestOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		_, _ = io.WriteString(w, "done")
+	})
+	addr := freeAddr(t)
+	app := &App{HttpServer: server.NewHttpServer(addr, handler, 5*time.Second)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- app.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{status: resp.StatusCode, body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Run returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+
+	res := <-done
+	if res.err != nil || res.status != http.StatusOK || res.body != "done" {
+		t.Fatalf("in-flight request = %d %q, %v; want 200 done", res.status, res.body, res.err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the last request finished")
+	}
+	if _, err := http.Get("http://" + addr + "/ready"); err == nil {
+		t.Errorf("server still accepts requests after shutdown")
+	}
+	if err := app.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -4,13 +4,17 @@
 package wire
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"github.com/google/wire"
+	"github.com/rs/zerolog/log"
 
 	"github.com/thepenn/devsys/internal/cache"
 	"github.com/thepenn/devsys/internal/config"
 	"github.com/thepenn/devsys/internal/handler"
+	appmetrics "github.com/thepenn/devsys/internal/metrics"
 	"github.com/thepenn/devsys/internal/server"
 	"github.com/thepenn/devsys/internal/store"
 	"github.com/thepenn/devsys/routers"
@@ -27,11 +31,15 @@ type App struct {
 	HttpServer *server.HttpServer
 	Services   *service.Services
 	DB         *store.DB
-	Cache      *cache.Cache
+	Cache      cache.Store
+
+	// stopBackground cancels the context of the background services once Close drained the
+	// pipeline workers.
+	stopBackground context.CancelFunc
 }
 
 // NewApp 创建应用实例
-func NewApp(httpServer *server.HttpServer, services *service.Services, db *store.DB, cache *cache.Cache) *App {
+func NewApp(httpServer *server.HttpServer, services *service.Services, db *store.DB, cache cache.Store) *App {
 	return &App{
 		HttpServer: httpServer,
 		Services:   services,
@@ -47,6 +55,7 @@ var appSet = wire.NewSet(
 	InjectedDatabase,
 	InjectedCache,
 	InjectedQueue,
+	InjectedMetrics,
 	InjectedServices,
 	InjectedMetricsMiddleware,
 	InjectedCorsMiddleware,
@@ -70,7 +79,7 @@ func InjectedHandler(cfg *config.Config, routers *routers.Routers, authMiddlewar
 }
 
 func InjectedHttpServer(cfg *config.Config, corsMiddleware *corsmw.Middleware, h *handler.Handler) *server.HttpServer {
-	return server.NewHttpServer(cfg.Server.Host, corsMiddleware.WrapHTTP(h.Handler()))
+	return server.NewHttpServer(cfg.Server.Host, corsMiddleware.WrapHTTP(h.Handler()), cfg.Server.ShutdownGracePeriod)
 }
 
 func InjectedDatabase(cfg *config.Config) (*store.DB, error) {
@@ -84,7 +93,26 @@ func InjectedDatabase(cfg *config.Config) (*store.DB, error) {
 	return db, nil
 }
 
-func InjectedCache() *cache.Cache {
+// InjectedCache opens the cache selected by CACHE_DRIVER. An unreachable redis leaves the
+// server without a cache rather than failing startup.
+func InjectedCache(cfg *config.Config) cache.Store {
+	switch driver := strings.ToLower(strings.TrimSpace(cfg.Cache.Driver)); driver {
+	case "", "memory":
+	case "redis":
+		redis, err := cache.NewRedis(cache.RedisOptions{
+			Addr:      cfg.Cache.RedisAddr,
+			Password:  cfg.Cache.RedisPassword,
+			DB:        cfg.Cache.RedisDB,
+			KeyPrefix: cfg.Cache.RedisKeyPrefix,
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("addr", cfg.Cache.RedisAddr).Msg("redis cache unreachable, running without a cache")
+			return cache.Noop{}
+		}
+		return redis
+	default:
+		log.Warn().Str("driver", driver).Msg("unknown cache driver, using the memory cache")
+	}
 	return cache.New(5 * time.Minute)
 }
 
@@ -92,8 +120,12 @@ func InjectedQueue(cfg *config.Config) *queue.PipelineQueue {
 	return queue.New(cfg.Pipeline.QueueCapacity)
 }
 
-func InjectedServices(db *store.DB, q *queue.PipelineQueue, cache *cache.Cache, cfg *config.Config) (*service.Services, error) {
-	return service.NewServices(db, q, cache, cfg)
+func InjectedMetrics() *appmetrics.Registry {
+	return appmetrics.New()
+}
+
+func InjectedServices(db *store.DB, q *queue.PipelineQueue, cache cache.Store, cfg *config.Config, registry *appmetrics.Registry) (*service.Services, error) {
+	return service.NewServices(db, q, cache, cfg, registry)
 }
 
 func InjectedMetricsMiddleware() *metrics.Middleware {
@@ -7,10 +7,13 @@
 package wire
 
 import (
+	"context"
 	"github.com/google/wire"
+	"github.com/rs/zerolog/log"
 	"github.com/thepenn/devsys/internal/cache"
 	"github.com/thepenn/devsys/internal/config"
 	"github.com/thepenn/devsys/internal/handler"
+	appmetrics "github.com/thepenn/devsys/internal/metrics"
 	"github.com/thepenn/devsys/internal/server"
 	"github.com/thepenn/devsys/internal/store"
 	"github.com/thepenn/devsys/routers"
@@ -21,6 +24,7 @@ import (
 	"github.com/thepenn/devsys/service"
 	"github.com/thepenn/devsys/service/migrate"
 	"github.com/thepenn/devsys/service/pipeline/queue"
+	"strings"
 	"time"
 )
 
@@ -33,8 +37,9 @@ func WireApp(cfg *config.Config) (*App, error) {
 		return nil, err
 	}
 	pipelineQueue := InjectedQueue(cfg)
-	cache := InjectedCache()
-	services, err := InjectedServices(db, pipelineQueue, cache, cfg)
+	cache := InjectedCache(cfg)
+	registry := InjectedMetrics()
+	services, err := InjectedServices(db, pipelineQueue, cache, cfg, registry)
 	if err != nil {
 		return nil, err
 	}
@@ -54,11 +59,15 @@ type App struct {
 	HttpServer *server.HttpServer
 	Services   *service.Services
 	DB         *store.DB
-	Cache      *cache.Cache
+	Cache      cache.Store
+
+	// stopBackground cancels the context of the background services once Close drained the
+	// pipeline workers.
+	stopBackground context.CancelFunc
 }
 
 // NewApp 创建应用实例
-func NewApp(httpServer *server.HttpServer, services *service.Services, db *store.DB, cache2 *cache.Cache) *App {
+func NewApp(httpServer *server.HttpServer, services *service.Services, db *store.DB, cache2 cache.Store) *App {
 	return &App{
 		HttpServer: httpServer,
 		Services:   services,
@@ -74,6 +83,7 @@ var appSet = wire.NewSet(
 	InjectedDatabase,
 	InjectedCache,
 	InjectedQueue,
+	InjectedMetrics,
 	InjectedServices,
 	InjectedMetricsMiddleware,
 	InjectedCorsMiddleware,
@@ -91,7 +101,7 @@ func InjectedHandler(cfg *config.Config, routers2 *routers.Routers, authMiddlewa
 }
 
 func InjectedHttpServer(cfg *config.Config, corsMiddleware *cors.Middleware, h *handler.Handler) *server.HttpServer {
-	return server.NewHttpServer(cfg.Server.Host, corsMiddleware.WrapHTTP(h.Handler()))
+	return server.NewHttpServer(cfg.Server.Host, corsMiddleware.WrapHTTP(h.Handler()), cfg.Server.ShutdownGracePeriod)
 }
 
 func InjectedDatabase(cfg *config.Config) (*store.DB, error) {
@@ -105,7 +115,26 @@ func InjectedDatabase(cfg *config.Config) (*store.DB, error) {
 	return db, nil
 }
 
-func InjectedCache() *cache.Cache {
+// InjectedCache opens the cache selected by CACHE_DRIVER. An unreachable redis leaves the
+// server without a cache rather than failing startup.
+func InjectedCache(cfg *config.Config) cache.Store {
+	switch driver := strings.ToLower(strings.TrimSpace(cfg.Cache.Driver)); driver {
+	case "", "memory":
+	case "redis":
+		redis, err := cache.NewRedis(cache.RedisOptions{
+			Addr:      cfg.Cache.RedisAddr,
+			Password:  cfg.Cache.RedisPassword,
+			DB:        cfg.Cache.RedisDB,
+			KeyPrefix: cfg.Cache.RedisKeyPrefix,
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("addr", cfg.Cache.RedisAddr).Msg("redis cache unreachable, running without a cache")
+			return cache.Noop{}
+		}
+		return redis
+	default:
+		log.Warn().Str("driver", driver).Msg("unknown cache driver, using the memory cache")
+	}
 	return cache.New(5 * time.Minute)
 }
 
@@ -113,8 +142,12 @@ func InjectedQueue(cfg *config.Config) *queue.PipelineQueue {
 	return queue.New(cfg.Pipeline.QueueCapacity)
 }
 
-func InjectedServices(db *store.DB, q *queue.PipelineQueue, cache2 *cache.Cache, cfg *config.Config) (*service.Services, error) {
-	return service.NewServices(db, q, cache2, cfg)
+func InjectedMetrics() *appmetrics.Registry {
+	return appmetrics.New()
+}
+
+func InjectedServices(db *store.DB, q *queue.PipelineQueue, cache2 cache.Store, cfg *config.Config, registry *appmetrics.Registry) (*service.Services, error) {
+	return service.NewServices(db, q, cache2, cfg, registry)
 }
 
 func InjectedMetricsMiddleware() *metrics.Middleware {
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,7 +12,8 @@ type item struct {
 	expiration int64
 }
 
-// Cache provides a lightweight in-memory cache with TTL support.
+// Cache provides a lightweight in-memory cache with TTL support. Values are kept as they
+// were set, so readers share them with the writer.
 type Cache struct {
 	mu              sync.RWMutex
 	items           map[string]item
@@ -51,21 +53,73 @@ func (c *Cache) Set(key string, value any, ttl time.Duration) {
 	}
 }
 
-// Get returns the stored value for the key if it exists and has not expired.
-func (c *Cache) Get(key string) (any, bool) {
+// Get stores the value of the key in dest if it exists, has not expired and is assignable
+// to what dest points to.
+func (c *Cache) Get(key string, dest any) bool {
+	it, ok := c.lookup(key)
+	if !ok {
+		return false
+	}
+
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return false
+	}
+	value := reflect.ValueOf(it.value)
+	if !value.IsValid() || !value.Type().AssignableTo(target.Elem().Type()) {
+		return false
+	}
+	target.Elem().Set(value)
+	return true
+}
+
+// TTL returns how long the key remains, 0 for an entry kept indefinitely.
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	it, ok := c.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	if it.expiration == 0 {
+		return 0, true
+	}
+	return max(time.Duration(it.expiration-time.Now().UnixNano()), 0), true
+}
+
+// Incr adds one to the counter under key. An entry that has expired or holds something other
+// than a counter starts over at one.
+func (c *Cache) Incr(key string, ttl time.Duration) (int64, bool) {
+	now := time.Now().UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.items[key]
+	count, isCounter := it.value.(int64)
+	if !ok || !isCounter || (it.expiration > 0 && now > it.expiration) {
+		it = item{}
+		count = 0
+		if ttl > 0 {
+			it.expiration = now + int64(ttl)
+		}
+	}
+	count++
+	it.value = count
+	c.items[key] = it
+	return count, true
+}
+
+func (c *Cache) lookup(key string) (item, bool) {
 	c.mu.RLock()
 	it, ok := c.items[key]
 	c.mu.RUnlock()
 	if !ok {
-		return nil, false
+		return item{}, false
 	}
 
 	if it.expiration > 0 && time.Now().UnixNano() > it.expiration {
 		c.Delete(key)
-		return nil, false
+		return item{}, false
 	}
 
-	return it.value, true
+	return it, true
 }
 
 // Delete removes the key from the cache.
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 3 * time.Second
+	redisIdleConns   = 8
+)
+
+// RedisOptions address a redis server. KeyPrefix is put before every key so several
+// deployments can share a database.
+type RedisOptions struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+}
+
+// Redis is a Store kept in redis, shared by every server replica using the same database
+// and prefix. Values are stored as JSON, so Get decodes into dest rather than returning the
+// value that was set. Failures are logged and treated as cache misses.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis connects to redis and fails when the server cannot be reached or refuses the
+// credentials.
+func NewRedis(opts RedisOptions) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:         opts.Addr,
+		Password:     opts.Password,
+		DB:           opts.DB,
+		DialTimeout:  redisDialTimeout,
+		ReadTimeout:  redisIOTimeout,
+		WriteTimeout: redisIOTimeout,
+		MaxIdleConns: redisIdleConns,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), redisDialTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("connect redis %s: %w", opts.Addr, err)
+	}
+	return &Redis{client: client, prefix: opts.KeyPrefix}, nil
+}
+
+// Get decodes the JSON value of key into dest.
+func (r *Redis) Get(key string, dest any) bool {
+	data, err := r.client.Get(context.Background(), r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("redis cache get failed")
+		return false
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("failed to decode redis cache entry")
+		return false
+	}
+	return true
+}
+
+// Set stores value as JSON.
+func (r *Redis) Set(key string, value any, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("failed to encode redis cache entry")
+		return
+	}
+	// go-redis reads a negative expiration as KEEPTTL and rounds below a millisecond
+	switch {
+	case ttl <= 0:
+		ttl = 0
+	case ttl < time.Millisecond:
+		ttl = time.Millisecond
+	}
+	if err := r.client.Set(context.Background(), r.prefix+key, data, ttl).Err(); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("redis cache set failed")
+	}
+}
+
+// Delete removes key.
+func (r *Redis) Delete(key string) {
+	if err := r.client.Del(context.Background(), r.prefix+key).Err(); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("redis cache delete failed")
+	}
+}
+
+// TTL returns how long key remains.
+func (r *Redis) TTL(key string) (time.Duration, bool) {
+	ttl, err := r.client.PTTL(context.Background(), r.prefix+key).Result()
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("redis cache ttl failed")
+		return 0, false
+	}
+	switch {
+	case ttl == -2:
+		// the key does not exist
+		return 0, false
+	case ttl < 0:
+		// -1: the key has no expiry
+		return 0, true
+	}
+	return ttl, true
+}
+
+// Incr counts with INCR and sets the expiry with EXPIRE NX in the same transaction, so
+// replicas counting concurrently neither lose increments nor extend the window. Redis keeps
+// the expiry in whole seconds here, at least one.
+func (r *Redis) Incr(key string, ttl time.Duration) (int64, bool) {
+	ctx := context.Background()
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, r.prefix+key)
+		if ttl > 0 {
+			pipe.ExpireNX(ctx, r.prefix+key, max(ttl, time.Second))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("redis cache incr failed")
+		return 0, false
+	}
+	return incr.Val(), true
+}
+
+// Close closes the connections; entries stay in redis.
+func (r *Redis) Close() {
+	if err := r.client.Close(); err != nil {
+		log.Warn().Err(err).Msg("failed to close redis cache")
+	}
+}
@@ -0,0 +1,39 @@
+package cache
+
+import "time"
+
+// Store is a key value cache with expiring entries. Cache keeps entries in the process;
+// Redis shares them between server replicas.
+type Store interface {
+	// Get decodes the value of key into dest, a non-nil pointer, and reports whether the
+	// key was found and fits dest.
+	Get(key string, dest any) bool
+	// Set stores value for key until ttl expires. A non-positive ttl keeps it indefinitely.
+	Set(key string, value any, ttl time.Duration)
+	Delete(key string)
+	// TTL returns how long key remains, 0 for an entry kept indefinitely, and false when the
+	// key does not exist.
+	TTL(key string) (time.Duration, bool)
+	// Incr adds one to the counter under key and returns the new count. A counter created by
+	// Incr expires after ttl; later increments keep its expiry. It reports false when the
+	// store could not count.
+	Incr(key string, ttl time.Duration) (int64, bool)
+	Close()
+}
+
+var (
+	_ Store = (*Cache)(nil)
+	_ Store = (*Redis)(nil)
+	_ Store = Noop{}
+)
+
+// Noop caches nothing. It stands in when the configured cache cannot be reached, so every
+// lookup falls through to the source.
+type Noop struct{}
+
+func (Noop) Get(string, any) bool                     { return false }
+func (Noop) Set(string, any, time.Duration)           {}
+func (Noop) Delete(string)                            {}
+func (Noop) TTL(string) (time.Duration, bool)         { return 0, false }
+func (Noop) Incr(string, time.Duration) (int64, bool) { return 0, false }
+func (Noop) Close()                                   {}
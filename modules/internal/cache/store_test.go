@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type entry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// storeContract checks the behavior every Store shares. Stores that keep entries must return
+// what was set; those that do not must miss every lookup.
+func storeContract(t *testing.T, newStore func(t *testing.T) Store, keeps bool) {
+	t.Run("get set delete", func(t *testing.T) {
+		s := newStore(t)
+		var got entry
+		if s.Get("missing", &got) {
+			t.Fatalf("Get(missing) found an entry")
+		}
+		want := entry{Name: "build", Count: 3}
+		s.Set("key", want, time.Minute)
+		if found := s.Get("key", &got); found != keeps {
+			t.Fatalf("Get(key) found = %v, want %v", found, keeps)
+		}
+		if keeps && got != want {
+			t.Fatalf("Get(key) = %+v, want %+v", got, want)
+		}
+		s.Delete("key")
+		if s.Get("key", &got) {
+			t.Fatalf("Get(key) found an entry after Delete")
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		s := newStore(t)
+		if _, ok := s.TTL("missing"); ok {
+			t.Fatalf("TTL(missing) reported an entry")
+		}
+		s.Set("expiring", "v", time.Minute)
+		ttl, ok := s.TTL("expiring")
+		if ok != keeps {
+			t.Fatalf("TTL(expiring) ok = %v, want %v", ok, keeps)
+		}
+		if keeps && (ttl <= 0 || ttl > time.Minute) {
+			t.Fatalf("TTL(expiring) = %v, want within a minute", ttl)
+		}
+		s.Set("kept", "v", 0)
+		ttl, ok = s.TTL("kept")
+		if ok != keeps || ttl != 0 {
+			t.Fatalf("TTL(kept) = %v, %v, want 0, %v", ttl, ok, keeps)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		s := newStore(t)
+		s.Set("key", "first", time.Minute)
+		s.Set("key", "second", 0)
+		var got string
+		if found := s.Get("key", &got); found != keeps || (keeps && got != "second") {
+			t.Fatalf("Get(key) = %q, %v, want second", got, found)
+		}
+		if ttl, _ := s.TTL("key"); ttl != 0 {
+			t.Fatalf("TTL(key) = %v after setting without a ttl, want 0", ttl)
+		}
+	})
+
+	t.Run("incr", func(t *testing.T) {
+		s := newStore(t)
+		for want := int64(1); want <= 3; want++ {
+			got, ok := s.Incr("counter", time.Minute)
+			if ok != keeps || (keeps && got != want) {
+				t.Fatalf("Incr(counter) = %d, %v, want %d", got, ok, want)
+			}
+		}
+		if !keeps {
+			return
+		}
+		ttl, ok := s.TTL("counter")
+		if !ok || ttl <= 0 || ttl > time.Minute {
+			t.Fatalf("TTL(counter) = %v, %v, want the window of the first Incr", ttl, ok)
+		}
+		// later increments keep the expiry of the first
+		s.Incr("counter", time.Hour)
+		if ttl, _ := s.TTL("counter"); ttl > time.Minute {
+			t.Fatalf("TTL(counter) = %v after another Incr, want the first window kept", ttl)
+		}
+		var count int64
+		if !s.Get("counter", &count) || count != 4 {
+			t.Fatalf("Get(counter) = %d, want 4", count)
+		}
+	})
+
+	t.Run("concurrent incr", func(t *testing.T) {
+		if !keeps {
+			t.Skip("store does not count")
+		}
+		s := newStore(t)
+		const workers, each = 8, 25
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range each {
+					s.Incr("concurrent", time.Minute)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, _ := s.Incr("concurrent", time.Minute); got != workers*each+1 {
+			t.Fatalf("Incr(concurrent) = %d after %d increments, want %d", got, workers*each, workers*each+1)
+		}
+	})
+}
+
+func TestCacheStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) Store {
+		c := New(0)
+		t.Cleanup(c.Close)
+		return c
+	}, true)
+}
+
+func TestRedisStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) Store {
+		server := miniredis.RunT(t)
+		r, err := NewRedis(RedisOptions{Addr: server.Addr(), KeyPrefix: "devsys:"})
+		if err != nil {
+			t.Fatalf("NewRedis: %v", err)
+		}
+		t.Cleanup(r.Close)
+		return r
+	}, true)
+}
+
+func TestNoopStore(t *testing.T) {
+	storeContract(t, func(*testing.T) Store { return Noop{} }, false)
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	server := miniredis.RunT(t)
+	r, err := NewRedis(RedisOptions{Addr: server.Addr(), KeyPrefix: "devsys:"})
+	if err != nil {
+		t.Fatalf("NewRedis: %v", err)
+	}
+	defer r.Close()
+	r.Set("key", 1, 0)
+	if !server.Exists("devsys:key") {
+		t.Fatalf("key was not stored under the prefix; keys: %v", server.Keys())
+	}
+}
+
+func TestNewRedisWrongPassword(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	if _, err := NewRedis(RedisOptions{Addr: server.Addr(), Password: "wrong"}); err == nil {
+		t.Fatalf("NewRedis accepted a wrong password")
+	}
+}
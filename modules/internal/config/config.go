@@ -20,6 +20,33 @@ type Config struct {
 	Pipeline Pipeline
 	Git      Git
 	Auth     Auth
+	Agent    Agent
+	Cache    Cache
+}
+
+// Cache selects where the server caches pipelines and forge lookups. The memory cache is
+// per process; replicas behind a load balancer share a redis cache. When redis cannot be
+// reached at startup the server runs without a cache.
+type Cache struct {
+	// Driver is memory or redis.
+	Driver        string `envconfig:"CACHE_DRIVER"         default:"memory"`
+	RedisAddr     string `envconfig:"CACHE_REDIS_ADDR"     default:"localhost:6379"`
+	RedisPassword string `envconfig:"CACHE_REDIS_PASSWORD"`
+	RedisDB       int    `envconfig:"CACHE_REDIS_DB"       default:"0"`
+	// RedisKeyPrefix is put before every key so deployments can share a database.
+	RedisKeyPrefix string `envconfig:"CACHE_REDIS_KEY_PREFIX" default:"devsys:"`
+}
+
+// Agent configures the agent binary, which runs pipeline tasks for a server. It reads the
+// database and pipeline settings of the server as well and authenticates with
+// PIPELINE_AGENT_TOKEN.
+type Agent struct {
+	// Server is the API base URL of the server, root path included.
+	Server string `envconfig:"AGENT_SERVER" default:"http://localhost:8080/api/v1"`
+	// Name identifies the agent; defaults to the host name.
+	Name string `envconfig:"AGENT_NAME"`
+	// Labels lists key=value labels tasks are matched against.
+	Labels []string `envconfig:"AGENT_LABELS"`
 }
 
 type Database struct {
@@ -36,11 +63,137 @@ type Logging struct {
 type Server struct {
 	Host     string `envconfig:"SERVER_HOST" default:"localhost:8080"`
 	RootPath string `envconfig:"SERVER_ROOT_PATH" default:"/api/v1"`
+	// PublicURL is the externally reachable base URL used when registering forge webhooks.
+	PublicURL string `envconfig:"SERVER_PUBLIC_URL"`
+	Websocket Websocket
+	Proxy     Proxy
+	// MetricsAdminOnly requires an administrator session to read /metrics.
+	MetricsAdminOnly bool `envconfig:"SERVER_METRICS_ADMIN_ONLY" default:"false"`
+	// ShutdownGracePeriod is how long shutdown waits for in-flight requests before closing
+	// their connections.
+	ShutdownGracePeriod time.Duration `envconfig:"SERVER_SHUTDOWN_GRACE_PERIOD" default:"15s"`
+	// TrustedProxies lists the IPs and CIDRs of the reverse proxies in front of the server,
+	// whose X-Forwarded-For tells the client address. Without them the remote address is used.
+	TrustedProxies []string `envconfig:"SERVER_TRUSTED_PROXIES"`
+	Tenancy        Tenancy
+	Audit          Audit
+	ExecRecording  ExecRecording
+}
+
+// ExecRecording configures the recordings of interactive pod exec sessions.
+type ExecRecording struct {
+	// Dir stores recordings; defaults to a directory under the system temp dir.
+	Dir string `envconfig:"SERVER_EXEC_RECORDING_DIR"`
+	// InlineMaxSize is the largest recording kept in the database rather than in Dir, in bytes.
+	InlineMaxSize int64 `envconfig:"SERVER_EXEC_RECORDING_INLINE_MAX_SIZE" default:"65536"`
+}
+
+// Audit configures the audit trail of user actions.
+type Audit struct {
+	// Retention is how long audit events are kept; 0 keeps them forever.
+	Retention       time.Duration `envconfig:"SERVER_AUDIT_RETENTION"        default:"2160h"`
+	CleanupInterval time.Duration `envconfig:"SERVER_AUDIT_CLEANUP_INTERVAL" default:"1h"`
+	// BufferSize is how many events may wait to be written before new ones are dropped.
+	BufferSize int `envconfig:"SERVER_AUDIT_BUFFER_SIZE" default:"1024"`
+}
+
+// Tenancy scopes certificates, Kubernetes clusters and approver groups by organization.
+// Users see the organizations they belong to through forge membership or admin assignment.
+type Tenancy struct {
+	Enabled bool `envconfig:"SERVER_MULTI_TENANCY" default:"false"`
+	// SuperAdmins lists logins that bypass organization scoping.
+	SuperAdmins []string `envconfig:"SERVER_SUPER_ADMINS"`
+}
+
+// Proxy configures outbound HTTP traffic to forges and notification targets. When URL is
+// empty the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment applies.
+type Proxy struct {
+	URL string `envconfig:"SERVER_PROXY_URL"`
+	// NoProxy lists destinations reached directly: hosts, .suffixes, IPs, CIDRs and host:port.
+	NoProxy []string `envconfig:"SERVER_NO_PROXY"`
+}
+
+type Websocket struct {
+	// AllowedOrigins lists the browser origins allowed to open websockets besides the server itself.
+	AllowedOrigins []string      `envconfig:"SERVER_WS_ALLOWED_ORIGINS"`
+	MaxMessageSize int64         `envconfig:"SERVER_WS_MAX_MESSAGE_SIZE" default:"65536"`
+	PongWait       time.Duration `envconfig:"SERVER_WS_PONG_WAIT"        default:"60s"`
+	WriteWait      time.Duration `envconfig:"SERVER_WS_WRITE_WAIT"       default:"10s"`
 }
 
 type Pipeline struct {
-	WorkerCount   int `envconfig:"PIPELINE_WORKER_COUNT"   default:"2"`
-	QueueCapacity int `envconfig:"PIPELINE_QUEUE_CAPACITY" default:"128"`
+	WorkerCount      int `envconfig:"PIPELINE_WORKER_COUNT"       default:"2"`
+	QueueCapacity    int `envconfig:"PIPELINE_QUEUE_CAPACITY"     default:"128"`
+	MaxParallelSteps int `envconfig:"PIPELINE_MAX_PARALLEL_STEPS" default:"4"`
+	// NamespaceLockTimeout bounds how long a deploy step waits for another deploy to the same namespace.
+	NamespaceLockTimeout time.Duration `envconfig:"PIPELINE_NAMESPACE_LOCK_TIMEOUT" default:"10m"`
+	// ApprovalSweepInterval is how often approvals past their timeout are expired.
+	ApprovalSweepInterval time.Duration `envconfig:"PIPELINE_APPROVAL_SWEEP_INTERVAL" default:"30s"`
+	// ApprovalReminderRatio is the part of an approval timeout after which the approvers are reminded; 0 disables reminders.
+	ApprovalReminderRatio float64 `envconfig:"PIPELINE_APPROVAL_REMINDER_RATIO" default:"0.5"`
+	// DriftCheckInterval is how often deploy targets are compared with their live objects; 0 disables it.
+	DriftCheckInterval time.Duration `envconfig:"PIPELINE_DRIFT_CHECK_INTERVAL" default:"10m"`
+	// CacheMaxSize bounds the workspace caches under a workspace root, in bytes.
+	CacheMaxSize int64 `envconfig:"PIPELINE_CACHE_MAX_SIZE" default:"2147483648"`
+	// WorkspaceSoftLimit makes a pipeline remove expired workspaces before its clone while all workspaces use more bytes; 0 disables it.
+	WorkspaceSoftLimit int64 `envconfig:"PIPELINE_WORKSPACE_SOFT_LIMIT" default:"0"`
+	// WorkspaceHardLimit fails pipelines before their clone while all workspaces use more bytes; 0 disables it.
+	WorkspaceHardLimit int64 `envconfig:"PIPELINE_WORKSPACE_HARD_LIMIT" default:"0"`
+	// ShutdownGracePeriod is how long shutdown waits for running pipeline tasks; 0 stops them right away.
+	ShutdownGracePeriod time.Duration `envconfig:"PIPELINE_SHUTDOWN_GRACE_PERIOD" default:"5m"`
+	Provenance          Provenance
+	Artifacts           Artifacts
+	Logs                Logs
+	StepResources       StepResources
+	// HostEnv lists server environment variables passed to steps besides PATH, HOME, LANG and TZ.
+	HostEnv []string `envconfig:"PIPELINE_HOST_ENV"`
+	// InheritHostEnv passes the whole server environment to steps, secrets of the server included.
+	InheritHostEnv bool `envconfig:"PIPELINE_INHERIT_HOST_ENV" default:"false"`
+	// AgentToken is shared with remote agents; the agent endpoints are disabled while it is empty.
+	// Tasks handed to agents hold a worker while they run, so WorkerCount bounds them as well.
+	AgentToken string `envconfig:"PIPELINE_AGENT_TOKEN"`
+}
+
+// StepResources is the ceiling of the CPU and memory limits of step containers: repository
+// settings cannot exceed it and steps asking for more, or for nothing, run with it. Empty
+// values are unlimited.
+type StepResources struct {
+	// MaxCPU is a number of cores such as "4"; MaxMemory a size such as "8g".
+	MaxCPU    string `envconfig:"PIPELINE_STEP_MAX_CPU"`
+	MaxMemory string `envconfig:"PIPELINE_STEP_MAX_MEMORY"`
+}
+
+// Logs bounds how many log lines a step keeps and how many the run detail returns, and sets
+// how often logs past their retention are deleted.
+type Logs struct {
+	// MaxLines caps the lines stored per step; later output is dropped. 0 disables the cap.
+	MaxLines int `envconfig:"PIPELINE_LOGS_MAX_LINES"  default:"50000"`
+	// TailLines is how many of the last lines of each step the run detail includes.
+	TailLines int `envconfig:"PIPELINE_LOGS_TAIL_LINES" default:"200"`
+	// RetentionInterval is how often logs past the log retention of their repository are
+	// deleted; 0 disables the cleanup.
+	RetentionInterval time.Duration `envconfig:"PIPELINE_LOGS_RETENTION_INTERVAL" default:"1h"`
+}
+
+// Artifacts configures where step artifacts are stored and how much a step may collect.
+type Artifacts struct {
+	// Root is the directory artifacts are copied to; defaults to a directory under the system temp dir.
+	Root         string `envconfig:"PIPELINE_ARTIFACTS_ROOT"`
+	MaxFiles     int    `envconfig:"PIPELINE_ARTIFACTS_MAX_FILES"      default:"100"`
+	MaxFileSize  int64  `envconfig:"PIPELINE_ARTIFACTS_MAX_FILE_SIZE"  default:"104857600"`
+	MaxTotalSize int64  `envconfig:"PIPELINE_ARTIFACTS_MAX_TOTAL_SIZE" default:"524288000"`
+}
+
+// Provenance configures signed build provenance for successful pipelines. It is disabled
+// while Key is empty.
+type Provenance struct {
+	// Key is the base64 encoded ed25519 private key (32 byte seed or 64 byte key).
+	Key   string `envconfig:"PIPELINE_PROVENANCE_KEY"`
+	KeyID string `envconfig:"PIPELINE_PROVENANCE_KEY_ID" default:"default"`
+	// VerifyKeys lists retired public keys kept for verification as key_id=base64.
+	VerifyKeys []string `envconfig:"PIPELINE_PROVENANCE_VERIFY_KEYS"`
+	// BuilderID identifies this server in the provenance; defaults to SERVER_PUBLIC_URL.
+	BuilderID string `envconfig:"PIPELINE_PROVENANCE_BUILDER_ID"`
 }
 
 type Git struct {
@@ -48,6 +201,7 @@ type Git struct {
 	GitLab GitLab
 	Gitee  Gitee
 	Gitea  Gitea
+	OIDC   OIDC
 }
 
 type GitHub struct {
@@ -96,9 +250,28 @@ type Gitea struct {
 	Organizations string `envconfig:"SERVER_GITEA_ORGS"`
 }
 
+// OIDC configures login through a generic OpenID Connect provider such as Keycloak. Its users
+// have no forge, so repository sync does nothing.
+type OIDC struct {
+	Enabled bool `envconfig:"SERVER_OIDC" default:"false"`
+	// Issuer is the issuer URL; endpoints are discovered from its openid-configuration.
+	Issuer       string `envconfig:"SERVER_OIDC_ISSUER"`
+	ClientID     string `envconfig:"SERVER_OIDC_CLIENT"`
+	ClientSecret string `envconfig:"SERVER_OIDC_SECRET"`
+	RedirectURL  string `envconfig:"SERVER_OIDC_REDIRECT"`
+	Scopes       string `envconfig:"SERVER_OIDC_SCOPES" default:"openid profile email"`
+	// GroupsClaim names the userinfo claim listing the groups of the user.
+	GroupsClaim string `envconfig:"SERVER_OIDC_GROUPS_CLAIM" default:"groups"`
+	// AdminGroup grants administrator rights to its members; empty grants them to nobody.
+	AdminGroup string `envconfig:"SERVER_OIDC_ADMIN_GROUP"`
+	SkipVerify bool   `envconfig:"SERVER_OIDC_SKIP_VERIFY" default:"false"`
+}
+
 type Auth struct {
 	Provider      string        `envconfig:"SERVER_AUTH_PROVIDER" default:"gitlab"`
 	SessionSecret string        `envconfig:"SERVER_AUTH_SESSION_SECRET" default:""`
 	TokenTTL      time.Duration `envconfig:"SERVER_AUTH_TOKEN_TTL"      default:"24h"`
 	StateTTL      time.Duration `envconfig:"SERVER_AUTH_STATE_TTL"      default:"10m"`
+	// RefreshGrace is how long after expiry a session token may still be refreshed.
+	RefreshGrace time.Duration `envconfig:"SERVER_AUTH_REFRESH_GRACE" default:"1h"`
 }
@@ -0,0 +1,214 @@
+// Package metrics owns the Prometheus registry of the server. A nil *Registry is valid and
+// records nothing, so services work unchanged when metrics are not wired in.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "devsys"
+
+// Pipeline results used as the result label of pipeline metrics.
+const (
+	ResultStarted   = "started"
+	ResultSucceeded = "succeeded"
+	ResultFailed    = "failed"
+	ResultCancelled = "cancelled"
+)
+
+// Registry holds the collectors of the server.
+type Registry struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	healthStatus        prometheus.Gauge
+
+	pipelines        *prometheus.CounterVec
+	pipelineDuration *prometheus.HistogramVec
+	stepDuration     *prometheus.HistogramVec
+	cronTriggers     *prometheus.CounterVec
+	logsPurged       prometheus.Counter
+
+	k8sRequestDuration *prometheus.HistogramVec
+}
+
+// New creates a registry with the Go runtime, process and application collectors.
+func New() *Registry {
+	durationBuckets := []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+	r := &Registry{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests",
+		}, []string{"method", "endpoint", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests in seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "endpoint"}),
+		healthStatus: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "app_health_status",
+			Help: "Application health status (1 = healthy, 0 = unhealthy)",
+		}),
+		pipelines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipelines_total",
+			Help:      "Pipelines started and finished, by result (started, succeeded, failed, cancelled)",
+		}, []string{"repo", "event", "result"}),
+		pipelineDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pipeline_duration_seconds",
+			Help:      "Duration of finished pipelines in seconds",
+			Buckets:   durationBuckets,
+		}, []string{"repo", "result"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "step_duration_seconds",
+			Help:      "Duration of finished pipeline steps in seconds",
+			Buckets:   durationBuckets,
+		}, []string{"repo", "status"}),
+		cronTriggers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cron_triggers_total",
+			Help:      "Pipelines triggered by cron schedules",
+		}, []string{"repo"}),
+		logsPurged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "log_entries_purged_total",
+			Help:      "Log lines of finished pipelines deleted by the log retention",
+		}),
+		k8sRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "k8s_request_duration_seconds",
+			Help:      "Latency of Kubernetes API requests in seconds",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"cluster", "method", "code"}),
+	}
+	r.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		r.httpRequests,
+		r.httpRequestDuration,
+		r.healthStatus,
+		r.pipelines,
+		r.pipelineDuration,
+		r.stepDuration,
+		r.cronTriggers,
+		r.logsPurged,
+		r.k8sRequestDuration,
+	)
+	return r
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func (r *Registry) Handler() http.Handler {
+	if r == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterQueue exposes the pending and in-flight task counts reported by stats.
+func (r *Registry) RegisterQueue(stats func() (pending, inFlight int)) {
+	if r == nil || stats == nil {
+		return
+	}
+	r.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_pending_tasks",
+			Help:      "Pipeline tasks waiting in the queue",
+		}, func() float64 {
+			pending, _ := stats()
+			return float64(pending)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_inflight_tasks",
+			Help:      "Pipeline tasks being executed",
+		}, func() float64 {
+			_, inFlight := stats()
+			return float64(inFlight)
+		}),
+	)
+}
+
+// ObserveHTTPRequest records a served HTTP request.
+func (r *Registry) ObserveHTTPRequest(method, endpoint, status string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.httpRequests.WithLabelValues(method, endpoint, status).Inc()
+	if duration > 0 {
+		r.httpRequestDuration.WithLabelValues(method, endpoint).Observe(duration.Seconds())
+	}
+}
+
+// SetHealthy records the health check result.
+func (r *Registry) SetHealthy(healthy bool) {
+	if r == nil {
+		return
+	}
+	if healthy {
+		r.healthStatus.Set(1)
+		return
+	}
+	r.healthStatus.Set(0)
+}
+
+// PipelineStarted counts a pipeline that began executing.
+func (r *Registry) PipelineStarted(repo, event string) {
+	if r == nil {
+		return
+	}
+	r.pipelines.WithLabelValues(repo, event, ResultStarted).Inc()
+}
+
+// PipelineFinished counts a finished pipeline and records its duration when known.
+func (r *Registry) PipelineFinished(repo, event, result string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.pipelines.WithLabelValues(repo, event, result).Inc()
+	if duration > 0 {
+		r.pipelineDuration.WithLabelValues(repo, result).Observe(duration.Seconds())
+	}
+}
+
+// StepFinished records the duration of a finished step.
+func (r *Registry) StepFinished(repo, status string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.stepDuration.WithLabelValues(repo, status).Observe(duration.Seconds())
+}
+
+// CronTriggered counts a pipeline triggered by a cron schedule.
+func (r *Registry) CronTriggered(repo string) {
+	if r == nil {
+		return
+	}
+	r.cronTriggers.WithLabelValues(repo).Inc()
+}
+
+// LogsPurged counts log lines deleted by the log retention.
+func (r *Registry) LogsPurged(count int64) {
+	if r == nil || count <= 0 {
+		return
+	}
+	r.logsPurged.Add(float64(count))
+}
+
+// ObserveK8sRequest records the latency of a Kubernetes API call.
+func (r *Registry) ObserveK8sRequest(cluster, method, code string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.k8sRequestDuration.WithLabelValues(cluster, method, code).Observe(duration.Seconds())
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape = %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestNilRegistryRecordsNothing(t *testing.T) {
+	var r *Registry
+	r.PipelineStarted("team/app", "push")
+	r.PipelineFinished("team/app", "push", ResultSucceeded, time.Minute)
+	r.StepFinished("team/app", "success", time.Second)
+	r.CronTriggered("team/app")
+	r.LogsPurged(3)
+	r.ObserveK8sRequest("prod", "GET", "200", time.Millisecond)
+	r.ObserveHTTPRequest("GET", "/health", "200", time.Millisecond)
+	r.SetHealthy(true)
+	r.RegisterQueue(func() (int, int) { return 1, 1 })
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("nil registry served %d, want 404", rec.Code)
+	}
+}
+
+func TestRegistryExposesRecordedMetrics(t *testing.T) {
+	r := New()
+	r.PipelineStarted("team/app", "push")
+	r.PipelineStarted("team/app", "push")
+	r.PipelineFinished("team/app", "push", ResultFailed, 90*time.Second)
+	// a pipeline cancelled before it started has no duration
+	r.PipelineFinished("team/app", "cron", ResultCancelled, 0)
+	r.StepFinished("team/app", "success", 12*time.Second)
+	r.CronTriggered("team/app")
+	r.LogsPurged(5)
+	r.LogsPurged(-1)
+	r.ObserveK8sRequest("prod", "GET", "200", 20*time.Millisecond)
+	r.SetHealthy(true)
+	r.RegisterQueue(func() (int, int) { return 4, 2 })
+
+	body := scrape(t, r)
+	for _, want := range []string{
+		`devsys_pipelines_total{event="push",repo="team/app",result="started"} 2`,
+		`devsys_pipelines_total{event="push",repo="team/app",result="failed"} 1`,
+		`devsys_pipelines_total{event="cron",repo="team/app",result="cancelled"} 1`,
+		`devsys_pipeline_duration_seconds_sum{repo="team/app",result="failed"} 90`,
+		`devsys_pipeline_duration_seconds_bucket{repo="team/app",result="failed",le="120"} 1`,
+		`devsys_step_duration_seconds_count{repo="team/app",status="success"} 1`,
+		`devsys_cron_triggers_total{repo="team/app"} 1`,
+		`devsys_log_entries_purged_total 5`,
+		`devsys_k8s_request_duration_seconds_count{cluster="prod",code="200",method="GET"} 1`,
+		`devsys_queue_pending_tasks 4`,
+		`devsys_queue_inflight_tasks 2`,
+		`app_health_status 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape misses %s", want)
+		}
+	}
+	if strings.Contains(body, `devsys_pipeline_duration_seconds_count{repo="team/app",result="cancelled"}`) {
+		t.Errorf("pipeline without a duration was observed")
+	}
+}
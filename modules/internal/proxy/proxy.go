@@ -0,0 +1,205 @@
+// Package proxy decides how outbound HTTP traffic reaches its destination. Internal services
+// such as a self-hosted GitLab or Harbor are listed as no-proxy destinations and contacted
+// directly, everything else goes through the configured proxy.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Rules routes requests through a proxy unless the destination matches a no-proxy entry.
+// Without a proxy URL the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment applies, as it
+// did before proxies were configurable. A nil *Rules behaves the same way.
+type Rules struct {
+	proxy   *url.URL
+	noProxy []matcher
+}
+
+// Decision describes how a request to URL is sent.
+type Decision struct {
+	URL    string `json:"url"`
+	Direct bool   `json:"direct"`
+	Proxy  string `json:"proxy,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type matcher struct {
+	raw  string
+	host string
+	// subdomainsOnly is set for ".example.com" and "*.example.com".
+	subdomainsOnly bool
+	port           string
+	ip             net.IP
+	network        *net.IPNet
+	all            bool
+}
+
+// New parses the proxy URL and the no-proxy entries. Entries are host names (matching the
+// host and its subdomains), .suffixes or *.suffixes (subdomains only), IP addresses, CIDRs,
+// any of the former with a :port, or * to bypass the proxy for every destination.
+func New(proxyURL string, noProxy []string) (*Rules, error) {
+	rules := &Rules{}
+	if trimmed := strings.TrimSpace(proxyURL); trimmed != "" {
+		parsed, err := url.Parse(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy url: %w", err)
+		}
+		switch parsed.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", parsed.Scheme)
+		}
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("proxy url %q has no host", trimmed)
+		}
+		rules.proxy = parsed
+	}
+	for _, entry := range noProxy {
+		for _, part := range strings.Split(entry, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			m, err := parseMatcher(part)
+			if err != nil {
+				return nil, err
+			}
+			rules.noProxy = append(rules.noProxy, m)
+		}
+	}
+	return rules, nil
+}
+
+func parseMatcher(raw string) (matcher, error) {
+	m := matcher{raw: raw}
+	if raw == "*" {
+		m.all = true
+		return m, nil
+	}
+	value := strings.ToLower(raw)
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		m.network = network
+		return m, nil
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		value, m.port = host, port
+	}
+	value = strings.Trim(value, "[]")
+	if ip := net.ParseIP(value); ip != nil {
+		m.ip = ip
+		return m, nil
+	}
+	if strings.HasPrefix(value, "*.") {
+		value = value[1:]
+	}
+	if strings.HasPrefix(value, ".") {
+		m.subdomainsOnly = true
+		value = value[1:]
+	}
+	if value == "" || strings.ContainsAny(value, "/*") {
+		return m, fmt.Errorf("invalid no-proxy entry %q", raw)
+	}
+	m.host = value
+	return m, nil
+}
+
+func (m matcher) match(host, port string) bool {
+	if m.all {
+		return true
+	}
+	if m.port != "" && m.port != port {
+		return false
+	}
+	if m.network != nil || m.ip != nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		if m.network != nil {
+			return m.network.Contains(ip)
+		}
+		return m.ip.Equal(ip)
+	}
+	if host == m.host {
+		return !m.subdomainsOnly
+	}
+	return strings.HasSuffix(host, "."+m.host)
+}
+
+// Proxy is an http.Transport Proxy function applying the rules.
+func (r *Rules) Proxy(req *http.Request) (*url.URL, error) {
+	if r == nil || r.proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if _, ok := r.bypass(req.URL); ok {
+		return nil, nil
+	}
+	return r.proxy, nil
+}
+
+func (r *Rules) bypass(target *url.URL) (string, bool) {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		switch target.Scheme {
+		case "https", "wss":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	for _, m := range r.noProxy {
+		if m.match(host, port) {
+			return m.raw, true
+		}
+	}
+	return "", false
+}
+
+// Decide reports how a request to target would be sent.
+func (r *Rules) Decide(target *url.URL) Decision {
+	decision := Decision{URL: target.String()}
+	if r == nil || r.proxy == nil {
+		proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+		switch {
+		case err != nil:
+			decision.Direct = true
+			decision.Reason = fmt.Sprintf("invalid proxy environment: %v", err)
+		case proxyURL == nil:
+			decision.Direct = true
+			decision.Reason = "no proxy configured or excluded by NO_PROXY environment"
+		default:
+			decision.Proxy = redact(proxyURL)
+			decision.Reason = "proxy from environment"
+		}
+		return decision
+	}
+	if rule, ok := r.bypass(target); ok {
+		decision.Direct = true
+		decision.Reason = fmt.Sprintf("matched no-proxy rule %q", rule)
+		return decision
+	}
+	decision.Proxy = redact(r.proxy)
+	decision.Reason = "configured proxy"
+	return decision
+}
+
+// Transport returns a clone of the default transport that routes through the rules.
+func (r *Rules) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = r.Proxy
+	return transport
+}
+
+func redact(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	clone := *u
+	clone.User = url.User(u.User.Username())
+	return clone.String()
+}
@@ -12,18 +12,31 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// defaultShutdownGracePeriod is how long in-flight requests may take after ctx is done when
+// no grace period is set.
+const defaultShutdownGracePeriod = 5 * time.Second
+
 type HttpServer struct {
 	Addr    string
 	Handler http.Handler
+	// ShutdownGracePeriod bounds how long ListenAndServe waits for in-flight requests once
+	// its context is done.
+	ShutdownGracePeriod time.Duration
 }
 
-func NewHttpServer(addr string, handler http.Handler) *HttpServer {
+func NewHttpServer(addr string, handler http.Handler, shutdownGracePeriod time.Duration) *HttpServer {
+	if shutdownGracePeriod <= 0 {
+		shutdownGracePeriod = defaultShutdownGracePeriod
+	}
 	return &HttpServer{
-		Addr:    addr,
-		Handler: handler,
+		Addr:                addr,
+		Handler:             handler,
+		ShutdownGracePeriod: shutdownGracePeriod,
 	}
 }
 
+// ListenAndServe serves until ctx is done, then stops accepting connections and waits for
+// in-flight requests for up to the shutdown grace period before closing them.
 func (s *HttpServer) ListenAndServe(ctx context.Context) error {
 	err := s.listenAndServe(ctx)
 	if errors.Is(err, http.ErrServerClosed) {
@@ -51,12 +64,16 @@ func (s *HttpServer) listenAndServe(ctx context.Context) error {
 
 	g.Go(func() error {
 		<-ctx.Done()
-		log.Info().Msg("shutting down http server")
+		log.Info().Dur("grace_period", s.ShutdownGracePeriod).Msg("shutting down http server")
 
-		ctxShutdown, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+		ctxShutdown, cancelFunc := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
 		defer cancelFunc()
 
-		return httpServer.Shutdown(ctxShutdown)
+		if err := httpServer.Shutdown(ctxShutdown); err != nil {
+			log.Warn().Err(err).Msg("requests still in flight after the shutdown grace period, closing them")
+			return httpServer.Close()
+		}
+		return nil
 	})
 	g.Go(func() error {
 		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -2,8 +2,11 @@ package store
 
 import (
 	"context"
+	"errors"
 	"runtime/debug"
+	"strings"
 
+	"github.com/go-sql-driver/mysql"
 	"gorm.io/gorm"
 )
 
@@ -16,6 +19,11 @@ type Scanner interface {
 	Scan(dest ...interface{}) error
 }
 
+// New 包装已打开的GORM连接，用于测试等不经 Connect 建立连接的场景
+func New(conn *gorm.DB) *DB {
+	return &DB{conn: conn}
+}
+
 // GetDB 获取原始的GORM数据库连接
 func (db *DB) GetDB() *gorm.DB {
 	return db.conn
@@ -52,3 +60,22 @@ func (db *DB) Close() error {
 	}
 	return sqlDB.Close()
 }
+
+// mysqlDuplicateEntry 是 MySQL 唯一索引冲突的错误码
+const mysqlDuplicateEntry = 1062
+
+// IsDuplicateKey 判断错误是否由唯一索引冲突引起，兼容 MySQL 错误码与其他数据库的错误信息
+func IsDuplicateKey(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlDuplicateEntry
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") || strings.Contains(msg, "duplicate key")
+}
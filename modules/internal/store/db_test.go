@@ -0,0 +1,32 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestIsDuplicateKey(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"mysql duplicate entry", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1-3' for key 'uq_pipeline_repo_number'"}, true},
+		{"wrapped mysql duplicate entry", fmt.Errorf("create pipeline: %w", &mysql.MySQLError{Number: 1062}), true},
+		{"other mysql error", &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, false},
+		{"translated duplicate", gorm.ErrDuplicatedKey, true},
+		{"wrapped translated duplicate", fmt.Errorf("create pipeline: %w", gorm.ErrDuplicatedKey), true},
+		{"sqlite unique constraint", errors.New("UNIQUE constraint failed: pipelines.repo_id, pipelines.number"), true},
+		{"record not found", gorm.ErrRecordNotFound, false},
+	}
+	for _, tc := range cases {
+		if got := IsDuplicateKey(tc.err); got != tc.want {
+			t.Errorf("%s: IsDuplicateKey(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Package storetest opens throwaway SQLite databases for package tests, so services can be
+// exercised without a MySQL server.
+package storetest
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/thepenn/devsys/internal/store"
+)
+
+// Open returns an empty database holding the tables of models, removed when t ends. Write
+// transactions take the database lock up front, so concurrent writers wait for each other
+// instead of failing.
+func Open(t testing.TB, models ...interface{}) *store.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		filepath.Join(t.TempDir(), "devsys.db"))
+	conn, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		SkipDefaultTransaction: true,
+		TranslateError:         true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := conn.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	db := store.New(conn)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
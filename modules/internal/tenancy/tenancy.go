@@ -0,0 +1,120 @@
+// Package tenancy carries the organization scope of a caller through service calls.
+//
+// A context without a scope is unrestricted: it belongs to single-tenant installations and to
+// internal callers. With multi-tenancy enabled, the admin middleware attaches the scope of
+// every authenticated request and pipeline runs attach the organization of their repository,
+// so services can filter by it without knowing how it was derived.
+package tenancy
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+type ctxKey struct{}
+
+// Scope lists the organizations a caller may see. All bypasses scoping.
+type Scope struct {
+	All    bool
+	OrgIDs []int64
+}
+
+// Unrestricted returns a scope that sees every organization.
+func Unrestricted() Scope {
+	return Scope{All: true}
+}
+
+// Orgs returns a scope limited to ids. Without ids the scope sees nothing.
+func Orgs(ids ...int64) Scope {
+	return Scope{OrgIDs: ids}
+}
+
+// WithScope attaches scope to ctx.
+func WithScope(ctx context.Context, scope Scope) context.Context {
+	return context.WithValue(ctx, ctxKey{}, scope)
+}
+
+// FromContext returns the scope of ctx, unrestricted when none is attached.
+func FromContext(ctx context.Context) Scope {
+	if scope, ok := ctx.Value(ctxKey{}).(Scope); ok {
+		return scope
+	}
+	return Unrestricted()
+}
+
+// Allows reports whether the scope sees orgID.
+func (s Scope) Allows(orgID int64) bool {
+	if s.All {
+		return true
+	}
+	for _, id := range s.OrgIDs {
+		if id == orgID {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply restricts query to rows whose column is one of the scoped organizations.
+func (s Scope) Apply(query *gorm.DB, column string) *gorm.DB {
+	if s.All {
+		return query
+	}
+	if len(s.OrgIDs) == 0 {
+		return query.Where("1 = 0")
+	}
+	return query.Where(column+" IN ?", s.OrgIDs)
+}
+
+// Filter restricts query by the scope of ctx.
+func Filter(ctx context.Context, query *gorm.DB, column string) *gorm.DB {
+	return FromContext(ctx).Apply(query, column)
+}
+
+// ErrOrganizationNotFound is returned when a caller names an organization outside its scope.
+// It reads as "not found" so that callers cannot probe other organizations.
+var ErrOrganizationNotFound = errors.New("organization not found")
+
+// ResolveOrg returns the organization new data of ctx belongs to. requested 0 picks the first
+// organization of the scope, or the default organization for unrestricted callers.
+func ResolveOrg(ctx context.Context, tx *gorm.DB, requested int64) (int64, error) {
+	scope := FromContext(ctx)
+	if requested != 0 {
+		if !scope.Allows(requested) {
+			return 0, ErrOrganizationNotFound
+		}
+		var org model.Organization
+		err := tx.WithContext(ctx).Select("id").First(&org, requested).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrOrganizationNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		return org.ID, nil
+	}
+	if !scope.All {
+		if len(scope.OrgIDs) == 0 {
+			return 0, ErrOrganizationNotFound
+		}
+		return scope.OrgIDs[0], nil
+	}
+	return DefaultOrgID(ctx, tx)
+}
+
+// DefaultOrgID returns the id of the default organization, or 0 before it is created.
+func DefaultOrgID(ctx context.Context, tx *gorm.DB) (int64, error) {
+	var org model.Organization
+	err := tx.WithContext(ctx).Where("name = ?", model.DefaultOrganizationName).Take(&org).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return org.ID, nil
+}
@@ -2,7 +2,6 @@ package utils
 
 import (
 	"context"
-	"os"
 	"os/signal"
 	"syscall"
 )
@@ -13,20 +12,17 @@ func WithContext(ctx context.Context) context.Context {
 	})
 }
 
-func WithContextFunc(ctx context.Context, f func()) context.Context {
-	ctx, cancel := context.WithCancel(ctx)
+// WithContextFunc returns a context cancelled on SIGINT or SIGTERM and calls f when a signal
+// cancelled it. Once it is cancelled the default signal handling is restored, so a second
+// signal ends the process at once.
+func WithContextFunc(parent context.Context, f func()) context.Context {
+	ctx, stop := signal.NotifyContext(parent, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		defer signal.Stop(c)
-
-		select {
-		case <-ctx.Done():
-		case <-c:
+		<-ctx.Done()
+		stop()
+		if parent.Err() == nil {
 			f()
-			cancel()
 		}
 	}()
-
 	return ctx
 }
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithContextFuncCancelsOnSignal(t *testing.T) {
+	called := make(chan struct{})
+	ctx := WithContextFunc(context.Background(), func() { close(called) })
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled by SIGTERM")
+	}
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("callback not called")
+	}
+}
+
+func TestWithContextFuncParentCancel(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	called := make(chan struct{}, 1)
+	ctx := WithContextFunc(parent, func() { called <- struct{}{} })
+	cancel()
+	<-ctx.Done()
+	select {
+	case <-called:
+		t.Fatalf("callback called without a signal")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
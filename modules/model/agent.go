@@ -0,0 +1,46 @@
+package model
+
+// Agent is a remote runner executing pipeline tasks for the server. LastSeen is refreshed by
+// its polls and heartbeats; TaskID names the task it runs, empty while idle.
+type Agent struct {
+	ID         int64             `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	Name       string            `json:"name"        gorm:"column:name;size:191;uniqueIndex"`
+	Labels     map[string]string `json:"labels"      gorm:"column:labels;serializer:json"`
+	Version    string            `json:"version"     gorm:"column:version;size:64"`
+	TaskID     string            `json:"task_id"     gorm:"column:task_id;size:191"`
+	PipelineID int64             `json:"pipeline_id" gorm:"column:pipeline_id"`
+	LastSeen   int64             `json:"last_seen"   gorm:"column:last_seen"`
+	Created    int64             `json:"created"     gorm:"column:created"`
+}
+
+func (Agent) TableName() string {
+	return "agents"
+}
+
+// AgentInfo is an agent with whether it was seen recently enough to count as connected.
+type AgentInfo struct {
+	Agent
+	Online bool `json:"online"`
+}
+
+// AgentLabelAny as the value of an agent label accepts any value of the task label.
+const AgentLabelAny = "*"
+
+// Accepts reports whether the agent may run task. Every task label must be matched by the
+// agent label of the same key, or by AgentLabelAny. The repository and organization labels
+// every task carries only restrict agents declaring them.
+func (a *Agent) Accepts(task *Task) bool {
+	for key, value := range task.Labels {
+		label, ok := a.Labels[key]
+		if !ok {
+			if key == taskLabelRepo || key == taskLabelOrg {
+				continue
+			}
+			return false
+		}
+		if label != AgentLabelAny && label != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package model
+
+const (
+	// APITokenScopeRepoRead allows reading repositories, pipeline runs and logs.
+	APITokenScopeRepoRead = "repo:read"
+	// APITokenScopeRepoSync allows synchronizing repositories from the forge.
+	APITokenScopeRepoSync = "repo:sync"
+	// APITokenScopePipelineTrigger allows triggering and cancelling pipelines.
+	APITokenScopePipelineTrigger = "pipeline:trigger"
+)
+
+// APITokenScopes lists the scopes a token may be granted.
+var APITokenScopes = []string{APITokenScopeRepoRead, APITokenScopeRepoSync, APITokenScopePipelineTrigger}
+
+// APIToken is a personal access token acting as its user within its scopes. Only the SHA-256
+// of the token is stored; Prefix keeps its first characters so users can tell tokens apart.
+type APIToken struct {
+	ID        int64    `json:"id"           gorm:"column:id;primaryKey;autoIncrement"`
+	UserID    int64    `json:"user_id"      gorm:"column:user_id;index"`
+	Name      string   `json:"name"         gorm:"column:name;size:191"`
+	Prefix    string   `json:"prefix"       gorm:"column:prefix;size:32"`
+	TokenHash string   `json:"-"            gorm:"column:token_hash;size:64;uniqueIndex"`
+	Scopes    []string `json:"scopes"       gorm:"column:scopes;serializer:json"`
+	// ExpiresAt is a unix timestamp; 0 never expires.
+	ExpiresAt int64 `json:"expires_at"   gorm:"column:expires_at"`
+	LastUsed  int64 `json:"last_used"    gorm:"column:last_used"`
+	Created   int64 `json:"created"      gorm:"column:created"`
+}
+
+func (APIToken) TableName() string {
+	return "api_tokens"
+}
@@ -0,0 +1,18 @@
+package model
+
+// ApproverGroup is a named roster of logins that approval steps reference as "@name".
+// RepoID 0 marks a global group of organization OrgID; a repository group shadows a global group
+// of the same name.
+type ApproverGroup struct {
+	ID      int64    `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	OrgID   int64    `json:"org_id"  gorm:"column:org_id;uniqueIndex:idx_approver_groups_org_repo_name"`
+	RepoID  int64    `json:"repo_id" gorm:"column:repo_id;uniqueIndex:idx_approver_groups_org_repo_name"`
+	Name    string   `json:"name"    gorm:"column:name;size:191;uniqueIndex:idx_approver_groups_org_repo_name"`
+	Members []string `json:"members" gorm:"column:members;serializer:json"`
+	Created int64    `json:"created" gorm:"column:created"`
+	Updated int64    `json:"updated" gorm:"column:updated"`
+}
+
+func (ApproverGroup) TableName() string {
+	return "approver_groups"
+}
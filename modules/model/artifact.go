@@ -0,0 +1,17 @@
+package model
+
+// Artifact is a file collected from the workspace after a step succeeded. Path is relative
+// to the workspace and to the artifact directory of the step.
+type Artifact struct {
+	ID         int64  `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	PipelineID int64  `json:"pipeline_id" gorm:"column:pipeline_id;index"`
+	StepID     int64  `json:"step_id"     gorm:"column:step_id;index"`
+	Path       string `json:"path"        gorm:"column:path;size:1024"`
+	Size       int64  `json:"size"        gorm:"column:size"`
+	Checksum   string `json:"checksum"    gorm:"column:checksum;size:64"`
+	Created    int64  `json:"created"     gorm:"column:created"`
+}
+
+func (Artifact) TableName() string {
+	return "artifacts"
+}
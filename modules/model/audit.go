@@ -0,0 +1,63 @@
+package model
+
+const (
+	AuditActionPipelineTrigger = "pipeline.trigger"
+	AuditActionPipelineCancel  = "pipeline.cancel"
+	AuditActionStepApproval    = "pipeline.approval"
+	AuditActionConfigUpdate    = "pipeline.config.update"
+	AuditActionSettingsUpdate  = "pipeline.settings.update"
+	AuditActionPipelineImport  = "pipeline.import"
+	AuditActionEnvUpdate       = "pipeline.env.update"
+	AuditActionEnvDelete       = "pipeline.env.delete"
+	AuditActionLogin           = "auth.login"
+	AuditActionLogout          = "auth.logout"
+	AuditActionRepoSync        = "repo.sync"
+	AuditActionRepoDeactivate  = "repo.deactivate"
+	AuditActionRepoDelete      = "repo.delete"
+	AuditActionRepoImport      = "repo.import"
+	AuditActionK8sApply        = "k8s.apply"
+	AuditActionK8sDelete       = "k8s.delete"
+	AuditActionK8sExec         = "k8s.exec"
+	AuditActionK8sRollback     = "k8s.rollback"
+	AuditActionK8sDataPatch    = "k8s.data.patch"
+	AuditActionK8sNodeCordon   = "k8s.node.cordon"
+	AuditActionK8sNodeUncordon = "k8s.node.uncordon"
+	AuditActionK8sNodeDrain    = "k8s.node.drain"
+)
+
+const (
+	AuditResourcePipeline = "pipeline"
+	AuditResourceStep     = "step"
+	AuditResourceConfig   = "pipeline_config"
+	AuditResourceUser     = "user"
+	AuditResourceRepo     = "repo"
+	AuditResourceK8s      = "k8s_object"
+	AuditResourceEnv      = "env_template"
+)
+
+// AuditEvent records who did what to which resource. Actor is the login of the caller, or
+// "system" for actions without one. RepoID is 0 for actions outside a repository.
+type AuditEvent struct {
+	ID           int64                  `json:"id"            gorm:"column:id;primaryKey;autoIncrement"`
+	Actor        string                 `json:"actor"         gorm:"column:actor;size:191;index"`
+	Action       string                 `json:"action"        gorm:"column:action;size:64;index"`
+	ResourceType string                 `json:"resource_type" gorm:"column:resource_type;size:64"`
+	ResourceID   string                 `json:"resource_id"   gorm:"column:resource_id;size:255"`
+	RepoID       int64                  `json:"repo_id"       gorm:"column:repo_id;index"`
+	Metadata     map[string]interface{} `json:"metadata"      gorm:"column:metadata;serializer:json"`
+	Created      int64                  `json:"created"       gorm:"column:created;index"`
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+// AuditEventFilter narrows audit event lists. Since and Until are unix seconds; 0 leaves the
+// bound open.
+type AuditEventFilter struct {
+	Actor  string
+	Action string
+	RepoID int64
+	Since  int64
+	Until  int64
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Capability identifies an optional subsystem that may be disabled or unconfigured.
+type Capability string
+
+const (
+	CapabilityPipeline      Capability = "pipeline"
+	CapabilityKubernetes    Capability = "k8s"
+	CapabilityGitHub        Capability = "github"
+	CapabilityGitLab        Capability = "gitlab"
+	CapabilityGitee         Capability = "gitee"
+	CapabilityGitea         Capability = "gitea"
+	CapabilityOIDC          Capability = "oidc"
+	CapabilityNotifications Capability = "notifications"
+	CapabilityArchival      Capability = "archival"
+)
+
+// ErrFeatureUnavailable is matched by every FeatureUnavailableError via errors.Is.
+var ErrFeatureUnavailable = errors.New("feature unavailable")
+
+// FeatureUnavailableError reports that an operation requires a subsystem that is not available.
+// Disabled marks subsystems turned off by configuration, as opposed to a missing runtime dependency.
+type FeatureUnavailableError struct {
+	Subsystem Capability
+	Reason    string
+	Disabled  bool
+}
+
+func (e *FeatureUnavailableError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s unavailable", e.Subsystem)
+	}
+	return fmt.Sprintf("%s unavailable: %s", e.Subsystem, e.Reason)
+}
+
+func (e *FeatureUnavailableError) Is(target error) bool {
+	return target == ErrFeatureUnavailable
+}
+
+// NewFeatureUnavailableError returns an error for a subsystem whose runtime dependency is missing.
+func NewFeatureUnavailableError(subsystem Capability, reason string) error {
+	return &FeatureUnavailableError{Subsystem: subsystem, Reason: reason}
+}
+
+// NewFeatureDisabledError returns an error for a subsystem disabled by configuration.
+func NewFeatureDisabledError(subsystem Capability, reason string) error {
+	return &FeatureUnavailableError{Subsystem: subsystem, Reason: reason, Disabled: true}
+}
+
+// Capabilities lists which optional subsystems are enabled on this server.
+type Capabilities struct {
+	Features map[Capability]bool `json:"features"`
+	Enabled  []Capability        `json:"enabled"`
+	Disabled []Capability        `json:"disabled"`
+}
+
+// CapabilityOrder is the stable order used when listing capabilities.
+var CapabilityOrder = []Capability{
+	CapabilityPipeline,
+	CapabilityKubernetes,
+	CapabilityGitHub,
+	CapabilityGitLab,
+	CapabilityGitee,
+	CapabilityGitea,
+	CapabilityNotifications,
+	CapabilityArchival,
+}
+
+// NewCapabilities builds a Capabilities value from the feature flags, keeping a stable order.
+func NewCapabilities(features map[Capability]bool) Capabilities {
+	result := Capabilities{
+		Features: make(map[Capability]bool, len(CapabilityOrder)),
+		Enabled:  make([]Capability, 0, len(CapabilityOrder)),
+		Disabled: make([]Capability, 0, len(CapabilityOrder)),
+	}
+	for _, capability := range CapabilityOrder {
+		enabled := features[capability]
+		result.Features[capability] = enabled
+		if enabled {
+			result.Enabled = append(result.Enabled, capability)
+		} else {
+			result.Disabled = append(result.Disabled, capability)
+		}
+	}
+	return result
+}
@@ -12,21 +12,36 @@ type Certificate struct {
 	Name    string                 `json:"name"      gorm:"column:name;size:191;index"`
 	Type    string                 `json:"type"      gorm:"column:type;size:64;index"`
 	Config  map[string]interface{} `json:"config"    gorm:"column:config;serializer:json"`
+	OrgID   int64                  `json:"org_id"    gorm:"column:org_id;index"`
 	Created int64                  `json:"created"   gorm:"column:created"`
 	Updated int64                  `json:"updated"   gorm:"column:updated"`
+	// Version is bumped by every update, so runs can tell the credentials changed after
+	// they were triggered.
+	Version int `json:"version" gorm:"column:version"`
 }
 
 func (Certificate) TableName() string {
 	return "certificates"
 }
 
-// GitCertificate captures the canonical fields we expect for Git authentication.
+// GitCertificate captures the canonical fields we expect for Git authentication. Host is the
+// forge host the credentials belong to; they are only sent to clone URLs on that host.
 type GitCertificate struct {
 	Type     string `json:"type"`
+	Host     string `json:"host"`
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+// SSHCertificate holds a deploy key for cloning over SSH. KnownHosts pins the host keys of
+// the forge; Passphrase is empty for unencrypted keys.
+type SSHCertificate struct {
+	Type       string `json:"type"`
+	PrivateKey string `json:"private_key" mapstructure:"private_key"`
+	Passphrase string `json:"passphrase"  mapstructure:"passphrase"`
+	KnownHosts string `json:"known_hosts" mapstructure:"known_hosts"`
+}
+
 // DockerCertificate captures docker registry credentials.
 type DockerCertificate struct {
 	Type     string `json:"type"`
@@ -88,6 +103,21 @@ func (c *Certificate) AsGitCertificate() (*GitCertificate, error) {
 	return &git, nil
 }
 
+// AsSSHCertificate decodes the certificate config into SSHCertificate.
+func (c *Certificate) AsSSHCertificate() (*SSHCertificate, error) {
+	if c.Type != CertificateTypeSSH {
+		return nil, fmt.Errorf("certificate type %s is not ssh", c.Type)
+	}
+	var key SSHCertificate
+	if err := c.decode(&key); err != nil {
+		return nil, err
+	}
+	if key.Type == "" {
+		key.Type = c.Type
+	}
+	return &key, nil
+}
+
 func (c *Certificate) AsDockerCertificate() (*DockerCertificate, error) {
 	if c.Type != "docker" {
 		return nil, fmt.Errorf("certificate type %s is not docker", c.Type)
@@ -150,8 +180,9 @@ func (c *Certificate) AsKubernetesCertificate() (*KubernetesCertificate, error)
 
 // CertificateFilter captures optional filters for listing certificates.
 type CertificateFilter struct {
-	Type string
-	Name string
+	Type  string
+	Name  string
+	OrgID int64
 }
 
 // CertificatePatch contains mutable fields for certificate update.
@@ -159,13 +190,51 @@ type CertificatePatch struct {
 	Name   *string                `json:"name,omitempty"`
 	Type   *string                `json:"type,omitempty"`
 	Config map[string]interface{} `json:"config,omitempty"`
+	// OrgID moves the certificate to another organization of the caller.
+	OrgID *int64 `json:"org_id,omitempty"`
 }
 
+// CertificateUsage lists the repositories referencing a certificate, so admins know what a
+// rotation or deletion affects.
+type CertificateUsage struct {
+	CertificateID int64                  `json:"certificate_id"`
+	Name          string                 `json:"name"`
+	Type          string                 `json:"type"`
+	Repos         []CertificateRepoUsage `json:"repos"`
+}
+
+// CertificateRepoUsage is one repository referencing a certificate.
+type CertificateRepoUsage struct {
+	RepoID     int64                  `json:"repo_id"`
+	FullName   string                 `json:"full_name"`
+	References []CertificateReference `json:"references"`
+}
+
+// CertificateReference describes one way a repository uses a certificate. Step is set for
+// references made by a step of the pipeline config.
+type CertificateReference struct {
+	Kind string `json:"kind"`
+	Step string `json:"step,omitempty"`
+}
+
+const (
+	// CertificateRefBinding is a certificate bound to the pipeline settings of a repository.
+	CertificateRefBinding = "binding"
+	// CertificateRefSecret is a step secret alias resolving to the certificate by name.
+	CertificateRefSecret = "secret"
+	// CertificateRefDeploy is a deploy step targeting the kubernetes certificate.
+	CertificateRefDeploy = "deploy"
+	// CertificateRefTarget is a kubernetes object managed by the repository in the cluster.
+	CertificateRefTarget = "k8s_target"
+)
+
 const (
 	// DefaultSecretMask specifies the value used when hiding secrets.
 	DefaultSecretMask = "******"
 	// CertificateTypeKubernetes denotes a kubernetes cluster credential.
 	CertificateTypeKubernetes = "kubernetes"
+	// CertificateTypeSSH denotes an SSH deploy key used to clone repositories.
+	CertificateTypeSSH = "ssh"
 )
 
 var sensitiveConfigKeys = map[string]struct{}{
@@ -177,6 +246,7 @@ var sensitiveConfigKeys = map[string]struct{}{
 	"client_secret":  {},
 	"private_key":    {},
 	"ssh_key":        {},
+	"passphrase":     {},
 	"api_key":        {},
 	"auth_token":     {},
 	"bearer_token":   {},
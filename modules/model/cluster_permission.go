@@ -0,0 +1,71 @@
+package model
+
+// ClusterAccess is the access level of a user on a Kubernetes cluster. Each level includes
+// the ones below.
+type ClusterAccess string
+
+const (
+	// ClusterAccessView lists and reads resources and events.
+	ClusterAccessView ClusterAccess = "view"
+	// ClusterAccessEdit also applies, deletes, rolls back, restarts and scales.
+	ClusterAccessEdit ClusterAccess = "edit"
+	// ClusterAccessExec also reads container logs and executes commands in pods.
+	ClusterAccessExec ClusterAccess = "exec"
+)
+
+var clusterAccessRanks = map[ClusterAccess]int{
+	ClusterAccessView: 1,
+	ClusterAccessEdit: 2,
+	ClusterAccessExec: 3,
+}
+
+// Valid reports whether a can be granted.
+func (a ClusterAccess) Valid() bool {
+	_, ok := clusterAccessRanks[a]
+	return ok
+}
+
+// Includes reports whether a grants everything required grants. The empty level grants nothing.
+func (a ClusterAccess) Includes(required ClusterAccess) bool {
+	rank, ok := clusterAccessRanks[a]
+	return ok && rank >= clusterAccessRanks[required]
+}
+
+// ClusterPermission grants a user other than an administrator access to a Kubernetes
+// cluster. An empty Namespaces list grants every namespace and cluster-scoped resources.
+type ClusterPermission struct {
+	ID         int64         `json:"id"         gorm:"column:id;primaryKey;autoIncrement"`
+	UserID     int64         `json:"user_id"    gorm:"column:user_id;uniqueIndex:idx_cluster_permissions_user_cluster"`
+	ClusterID  int64         `json:"cluster_id" gorm:"column:cluster_id;uniqueIndex:idx_cluster_permissions_user_cluster;index"`
+	Access     ClusterAccess `json:"access"     gorm:"column:access;size:16"`
+	Namespaces []string      `json:"namespaces" gorm:"column:namespaces;serializer:json"`
+	Created    int64         `json:"created"    gorm:"column:created"`
+	Updated    int64         `json:"updated"    gorm:"column:updated"`
+}
+
+func (ClusterPermission) TableName() string {
+	return "cluster_permissions"
+}
+
+// AllowsNamespace reports whether the permission covers namespace. The empty namespace stands
+// for cluster-scoped resources and listings across namespaces.
+func (p *ClusterPermission) AllowsNamespace(namespace string) bool {
+	if len(p.Namespaces) == 0 {
+		return true
+	}
+	if namespace == "" {
+		return false
+	}
+	for _, allowed := range p.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterPermissionInfo is a permission joined with the login of its user.
+type ClusterPermissionInfo struct {
+	ClusterPermission
+	Login string `json:"login"`
+}
@@ -0,0 +1,21 @@
+package model
+
+// CommitState is the state of a pipeline as reported to the forge on its commit.
+type CommitState string
+
+const (
+	CommitStatePending CommitState = "pending"
+	CommitStateRunning CommitState = "running"
+	CommitStateSuccess CommitState = "success"
+	CommitStateFailure CommitState = "failure"
+)
+
+// CommitStatus is a build state shown next to a commit and its merge requests on the forge.
+// Context tells the statuses of different systems apart, like "devsys/pipeline".
+type CommitStatus struct {
+	Commit      string
+	State       CommitState
+	Context     string
+	Description string
+	TargetURL   string
+}
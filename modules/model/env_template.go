@@ -0,0 +1,36 @@
+package model
+
+// EnvTemplateScope is where an EnvTemplate applies.
+type EnvTemplateScope string
+
+const (
+	EnvTemplateScopeGlobal EnvTemplateScope = "global"
+	EnvTemplateScopeRepo   EnvTemplateScope = "repo"
+)
+
+// EnvTemplate is an environment variable administrators inject into pipelines, either of
+// every repository or of one. Repository templates override global ones; step env and
+// trigger variables override both. Masked values are hidden in step logs and never
+// returned by the API.
+type EnvTemplate struct {
+	ID      int64            `json:"id"                gorm:"column:id;primaryKey;autoIncrement"`
+	Scope   EnvTemplateScope `json:"scope"             gorm:"column:scope;size:16;uniqueIndex:idx_env_templates_scope_key"`
+	RepoID  int64            `json:"repo_id,omitempty" gorm:"column:repo_id;uniqueIndex:idx_env_templates_scope_key"`
+	Key     string           `json:"key"               gorm:"column:env_key;size:191;uniqueIndex:idx_env_templates_scope_key"`
+	Value   string           `json:"value,omitempty"   gorm:"column:value;type:text"`
+	Masked  bool             `json:"masked"            gorm:"column:masked"`
+	Created int64            `json:"created"           gorm:"column:created"`
+	Updated int64            `json:"updated"           gorm:"column:updated"`
+}
+
+func (EnvTemplate) TableName() string {
+	return "env_templates"
+}
+
+// Redacted returns the template without its value when it is masked.
+func (t EnvTemplate) Redacted() EnvTemplate {
+	if t.Masked {
+		t.Value = ""
+	}
+	return t
+}
@@ -0,0 +1,45 @@
+package model
+
+const (
+	// ExecRecordingInline keeps the recording in the session row.
+	ExecRecordingInline = "db"
+	// ExecRecordingFile keeps the recording in a file under the recording directory.
+	ExecRecordingFile = "file"
+)
+
+// ExecSession records an interactive exec into a pod container. Its recording is an
+// asciinema v2 cast with input, output and resize events. Ended is 0 while the session is
+// open; Dropped counts chunks left out of the recording because it fell behind the stream.
+type ExecSession struct {
+	ID          int64  `json:"id"           gorm:"column:id;primaryKey;autoIncrement"`
+	ClusterID   int64  `json:"cluster_id"   gorm:"column:cluster_id;index"`
+	Namespace   string `json:"namespace"    gorm:"column:namespace;size:253"`
+	Pod         string `json:"pod"          gorm:"column:pod;size:253"`
+	Container   string `json:"container"    gorm:"column:container;size:253"`
+	Command     string `json:"command"      gorm:"column:command;size:1024"`
+	User        string `json:"user"         gorm:"column:login;size:191;index"`
+	Started     int64  `json:"started"      gorm:"column:started;index"`
+	Ended       int64  `json:"ended"        gorm:"column:ended"`
+	InputBytes  int64  `json:"input_bytes"  gorm:"column:input_bytes"`
+	OutputBytes int64  `json:"output_bytes" gorm:"column:output_bytes"`
+	Dropped     int64  `json:"dropped"      gorm:"column:dropped"`
+	Storage     string `json:"storage"      gorm:"column:storage;size:16"`
+	Path        string `json:"-"            gorm:"column:path;size:1024"`
+	Size        int64  `json:"size"         gorm:"column:size"`
+	Recording   []byte `json:"-"            gorm:"column:recording;type:longblob"`
+}
+
+func (ExecSession) TableName() string {
+	return "exec_sessions"
+}
+
+// ExecSessionFilter narrows exec session lists; zero fields match everything. Since and Until
+// bound the start time in unix seconds.
+type ExecSessionFilter struct {
+	ClusterID int64
+	Namespace string
+	Pod       string
+	User      string
+	Since     int64
+	Until     int64
+}
@@ -11,6 +11,8 @@ const (
 	ForgeTypeBitbucket           ForgeType = "bitbucket"
 	ForgeTypeBitbucketDatacenter ForgeType = "bitbucket-dc"
 	ForgeTypeAddon               ForgeType = "addon"
+	// ForgeTypeOIDC is the identity provider of users logged in through OpenID Connect.
+	ForgeTypeOIDC ForgeType = "oidc"
 )
 
 type Forge struct {
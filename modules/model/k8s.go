@@ -2,10 +2,21 @@ package model
 
 // KubernetesClusterSummary describes a registered cluster.
 type KubernetesClusterSummary struct {
-	ID      int64  `json:"id"`
-	Name    string `json:"name"`
-	Server  string `json:"server"`
-	Updated int64  `json:"updated"`
+	ID      int64                    `json:"id"`
+	Name    string                   `json:"name"`
+	Server  string                   `json:"server"`
+	Updated int64                    `json:"updated"`
+	Health  *KubernetesClusterHealth `json:"health,omitempty"`
+}
+
+// KubernetesClusterHealth reports the result of a connectivity check against a cluster.
+type KubernetesClusterHealth struct {
+	ClusterID int64  `json:"cluster_id"`
+	Reachable bool   `json:"reachable"`
+	Version   string `json:"version,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt int64  `json:"checked_at"`
 }
 
 // KubernetesNamespace describes a namespace entry.
@@ -14,24 +25,98 @@ type KubernetesNamespace struct {
 	Labels map[string]string `json:"labels"`
 }
 
-// KubernetesResourceQuery captures resource query parameters.
+// KubernetesResourceQuery captures resource query parameters. Kind may stand in for Resource;
+// it is resolved through the discovery data of the cluster, in the preferred version of its
+// group unless Version is set.
 type KubernetesResourceQuery struct {
 	Group         string `json:"group"`
 	Version       string `json:"version"`
 	Resource      string `json:"resource"`
+	Kind          string `json:"kind"`
 	Namespace     string `json:"namespace"`
 	Name          string `json:"name"`
 	LabelSelector string `json:"label_selector"`
 	FieldSelector string `json:"field_selector"`
 }
 
-// KubernetesManifestRequest carries manifest payload for apply operations.
+// KubernetesAPIResourceCatalog lists the resources a cluster serves, grouped by API group.
+type KubernetesAPIResourceCatalog struct {
+	Groups []KubernetesAPIGroup `json:"groups"`
+	// FailedGroups lists the group versions whose discovery failed, typically aggregated APIs
+	// whose backing service is down; their resources are missing from Groups.
+	FailedGroups []string `json:"failed_groups,omitempty"`
+	// Refreshed is when the discovery data was last read from the cluster.
+	Refreshed int64 `json:"refreshed"`
+}
+
+// KubernetesAPIGroup is an API group and the resources it serves. The core group has an
+// empty name.
+type KubernetesAPIGroup struct {
+	Name             string                  `json:"name"`
+	PreferredVersion string                  `json:"preferred_version"`
+	Versions         []string                `json:"versions"`
+	Resources        []KubernetesAPIResource `json:"resources"`
+}
+
+// KubernetesAPIResource is a resource of an API group, in the preferred version serving it.
+type KubernetesAPIResource struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"`
+	Version    string   `json:"version"`
+	Namespaced bool     `json:"namespaced"`
+	Verbs      []string `json:"verbs"`
+	ShortNames []string `json:"short_names,omitempty"`
+}
+
+// KubernetesManifestRequest carries manifest payload for apply operations. Group, Version and
+// Resource are optional; without them each document is resolved from its apiVersion and kind.
 type KubernetesManifestRequest struct {
 	Group     string `json:"group"`
 	Version   string `json:"version"`
 	Resource  string `json:"resource"`
 	Namespace string `json:"namespace"`
 	Manifest  string `json:"manifest"`
+	// DryRun previews the apply on the server without persisting anything.
+	DryRun bool `json:"dry_run"`
+}
+
+// Apply actions reported per document.
+const (
+	KubernetesApplyCreated = "created"
+	KubernetesApplyUpdated = "updated"
+)
+
+// KubernetesApplyResult lists the outcome of each document of an applied manifest.
+type KubernetesApplyResult struct {
+	DryRun    bool                        `json:"dry_run"`
+	Documents []KubernetesAppliedDocument `json:"documents"`
+}
+
+// KubernetesAppliedDocument describes one document of an applied manifest. Index starts at 1.
+type KubernetesAppliedDocument struct {
+	Index     int                    `json:"index"`
+	Group     string                 `json:"group"`
+	Version   string                 `json:"version"`
+	Resource  string                 `json:"resource"`
+	Kind      string                 `json:"kind"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Name      string                 `json:"name"`
+	Action    string                 `json:"action,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Object    map[string]interface{} `json:"object,omitempty"`
+	YAML      string                 `json:"yaml,omitempty"`
+}
+
+// KubernetesWatchSnapshot is the type of the watch event carrying the full list of objects.
+const KubernetesWatchSnapshot = "SNAPSHOT"
+
+// KubernetesWatchEvent is pushed by resource watches. SNAPSHOT events carry every matching
+// object in Objects; ADDED, MODIFIED and DELETED events carry one Object.
+type KubernetesWatchEvent struct {
+	Type            string                   `json:"type"`
+	ResourceVersion string                   `json:"resource_version"`
+	Object          map[string]interface{}   `json:"object,omitempty"`
+	Objects         []map[string]interface{} `json:"objects,omitempty"`
 }
 
 // KubernetesResourceDeleteRequest describes delete parameters.
@@ -56,6 +141,8 @@ type KubernetesAggregateResponse struct {
 
 // KubernetesEvent describes a single event entry.
 type KubernetesEvent struct {
+	// Object is the kind/name of the object the event is about.
+	Object         string `json:"object,omitempty"`
 	Type           string `json:"type"`
 	Reason         string `json:"reason"`
 	Message        string `json:"message"`
@@ -112,6 +199,8 @@ type KubernetesWorkloadOverview struct {
 	Containers        []KubernetesContainerSummary `json:"containers"`
 	CreationTimestamp int64                        `json:"creation_timestamp"`
 	UpdateTimestamp   int64                        `json:"update_timestamp"`
+	// Usage sums the usage of the pods; it is omitted without metrics-server.
+	Usage *KubernetesResourceUsage `json:"usage,omitempty"`
 }
 
 // KubernetesReplicaStatus describes desired/ready replicas.
@@ -165,6 +254,27 @@ type KubernetesWorkloadRollbackRequest struct {
 	Revision int64 `json:"revision"`
 }
 
+// KubernetesWorkloadImageRequest points one container of a workload at another image.
+type KubernetesWorkloadImageRequest struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	// RecordPrevious keeps the replaced image in the devsys.dev/previous-image annotation.
+	RecordPrevious bool `json:"record_previous"`
+}
+
+// KubernetesWorkloadImageUpdate reports an image change and the updated workload.
+type KubernetesWorkloadImageUpdate struct {
+	Container     string                     `json:"container"`
+	Image         string                     `json:"image"`
+	PreviousImage string                     `json:"previous_image"`
+	Overview      KubernetesWorkloadOverview `json:"overview"`
+}
+
+// KubernetesWorkloadScaleRequest sets the replica count of a workload.
+type KubernetesWorkloadScaleRequest struct {
+	Replicas *int32 `json:"replicas"`
+}
+
 // KubernetesNamedResource provides minimal metadata for a resource.
 type KubernetesNamedResource struct {
 	Name       string            `json:"name"`
@@ -195,6 +305,42 @@ type KubernetesPodRow struct {
 	Node       string   `json:"node"`
 	CreatedAt  int64    `json:"created_at"`
 	Containers []string `json:"containers"`
+	// Usage and ContainerUsage are omitted without metrics-server.
+	Usage          *KubernetesResourceUsage   `json:"usage,omitempty"`
+	ContainerUsage []KubernetesContainerUsage `json:"container_usage,omitempty"`
+}
+
+// KubernetesResourceUsage is the CPU and memory usage reported by metrics-server.
+type KubernetesResourceUsage struct {
+	CPUMillicores int64 `json:"cpu_millicores"`
+	MemoryBytes   int64 `json:"memory_bytes"`
+}
+
+// KubernetesContainerUsage is the usage of one container of a pod.
+type KubernetesContainerUsage struct {
+	Name string `json:"name"`
+	KubernetesResourceUsage
+}
+
+// KubernetesPodMetrics is a metrics-server sample of one pod.
+type KubernetesPodMetrics struct {
+	Name       string                     `json:"name"`
+	Timestamp  int64                      `json:"timestamp"`
+	Window     string                     `json:"window"`
+	Usage      KubernetesResourceUsage    `json:"usage"`
+	Containers []KubernetesContainerUsage `json:"containers"`
+}
+
+// KubernetesWorkloadMetrics is a point-in-time usage snapshot of the pods of a workload.
+// Available is false when the cluster does not serve the metrics.k8s.io API.
+type KubernetesWorkloadMetrics struct {
+	Kind      string                   `json:"kind"`
+	Namespace string                   `json:"namespace"`
+	Name      string                   `json:"name"`
+	Available bool                     `json:"available"`
+	Timestamp int64                    `json:"timestamp,omitempty"`
+	Usage     *KubernetesResourceUsage `json:"usage,omitempty"`
+	Pods      []KubernetesPodMetrics   `json:"pods"`
 }
 
 // KubernetesPodExecRequest represents a remote exec invocation.
@@ -211,3 +357,165 @@ type KubernetesPodExecResult struct {
 	Stdout string `json:"stdout"`
 	Stderr string `json:"stderr"`
 }
+
+// KubernetesRolloutStatus is the progress of a deployment, statefulset or daemonset towards
+// its current spec. Failed is set when the controller gave up, e.g. on a progress deadline.
+type KubernetesRolloutStatus struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Desired   int32  `json:"desired"`
+	Updated   int32  `json:"updated"`
+	Ready     int32  `json:"ready"`
+	Available int32  `json:"available"`
+	Done      bool   `json:"done"`
+	Failed    bool   `json:"failed,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// KubernetesHelmRelease summarises one revision of a Helm release. Updated is the unix time
+// of its last deployment.
+type KubernetesHelmRelease struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	Revision     int    `json:"revision"`
+	Status       string `json:"status"`
+	Chart        string `json:"chart"`
+	ChartVersion string `json:"chart_version"`
+	AppVersion   string `json:"app_version"`
+	Description  string `json:"description,omitempty"`
+	Updated      int64  `json:"updated"`
+}
+
+// KubernetesHelmReleaseValues holds the values of a release revision: the user supplied
+// ones, or with All set those merged over the chart defaults.
+type KubernetesHelmReleaseValues struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	Revision  int                    `json:"revision"`
+	All       bool                   `json:"all"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+// KubernetesHelmReleaseManifest holds the rendered manifest of a release revision.
+type KubernetesHelmReleaseManifest struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Revision  int    `json:"revision"`
+	Manifest  string `json:"manifest"`
+}
+
+// KubernetesDataPatchRequest changes keys of a ConfigMap or Secret; a null value deletes the
+// key. Secret values are plain text unless Base64 is set. DryRun only returns the diff.
+type KubernetesDataPatchRequest struct {
+	Data   map[string]*string `json:"data"`
+	Base64 bool               `json:"base64,omitempty"`
+	DryRun bool               `json:"dry_run"`
+}
+
+// KubernetesDataChange is one key of a data diff. Old is unset for added keys and New for
+// removed ones; both hold the redaction mask on secrets.
+type KubernetesDataChange struct {
+	Key string  `json:"key"`
+	Old *string `json:"old,omitempty"`
+	New *string `json:"new,omitempty"`
+}
+
+// KubernetesDataDiff lists the keys a data patch adds, changes and removes, taken against the
+// object as it was before the update. Keys the patch leaves as they were are not listed.
+type KubernetesDataDiff struct {
+	Kind      string                 `json:"kind"`
+	Namespace string                 `json:"namespace"`
+	Name      string                 `json:"name"`
+	DryRun    bool                   `json:"dry_run"`
+	Added     []KubernetesDataChange `json:"added"`
+	Changed   []KubernetesDataChange `json:"changed"`
+	Removed   []KubernetesDataChange `json:"removed"`
+}
+
+// KubernetesNodeResources is an amount of node resources, as capacity or as allocatable.
+type KubernetesNodeResources struct {
+	CPUMillicores int64 `json:"cpu_millicores"`
+	MemoryBytes   int64 `json:"memory_bytes"`
+	Pods          int64 `json:"pods"`
+}
+
+// KubernetesNodeTaint is a taint of a node.
+type KubernetesNodeTaint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// KubernetesNode summarises a node. Roles come from the node-role.kubernetes.io/ labels and
+// PodCount counts the pods on the node that have not finished.
+type KubernetesNode struct {
+	Name           string                  `json:"name"`
+	Roles          []string                `json:"roles"`
+	KubeletVersion string                  `json:"kubelet_version"`
+	InternalIP     string                  `json:"internal_ip,omitempty"`
+	Ready          bool                    `json:"ready"`
+	ReadyMessage   string                  `json:"ready_message,omitempty"`
+	Unschedulable  bool                    `json:"unschedulable"`
+	Capacity       KubernetesNodeResources `json:"capacity"`
+	Allocatable    KubernetesNodeResources `json:"allocatable"`
+	PodCount       int                     `json:"pod_count"`
+	Taints         []KubernetesNodeTaint   `json:"taints"`
+	Created        int64                   `json:"created"`
+}
+
+// KubernetesNodeDetails adds the system information, conditions, pods and latest events to a
+// node summary.
+type KubernetesNodeDetails struct {
+	KubernetesNode
+	Labels           map[string]string     `json:"labels"`
+	OSImage          string                `json:"os_image"`
+	KernelVersion    string                `json:"kernel_version"`
+	ContainerRuntime string                `json:"container_runtime"`
+	Architecture     string                `json:"architecture"`
+	Conditions       []KubernetesCondition `json:"conditions"`
+	Pods             []KubernetesPodRow    `json:"pods"`
+	Events           []KubernetesEvent     `json:"events"`
+}
+
+// Node drain event types.
+const (
+	KubernetesDrainCordoned = "CORDONED"
+	KubernetesDrainSkipped  = "SKIPPED"
+	KubernetesDrainEvicting = "EVICTING"
+	// KubernetesDrainBlocked is sent when a PodDisruptionBudget refuses an eviction; the
+	// eviction is retried until the drain times out.
+	KubernetesDrainBlocked = "BLOCKED"
+	KubernetesDrainEvicted = "EVICTED"
+	KubernetesDrainFailed  = "FAILED"
+	KubernetesDrainDone    = "DONE"
+)
+
+// KubernetesNodeDrainRequest configures a drain. Confirm must be set. GracePeriodSeconds
+// overrides the termination grace period of the evicted pods and TimeoutSeconds bounds the
+// whole drain.
+type KubernetesNodeDrainRequest struct {
+	Confirm            bool   `json:"confirm"`
+	GracePeriodSeconds *int64 `json:"grace_period_seconds,omitempty"`
+	TimeoutSeconds     int    `json:"timeout_seconds,omitempty"`
+}
+
+// KubernetesNodeDrainEvent reports the progress of a drain. Pod events carry the namespace
+// and name of the pod; the final DONE event carries the result.
+type KubernetesNodeDrainEvent struct {
+	Type      string                     `json:"type"`
+	Node      string                     `json:"node"`
+	Namespace string                     `json:"namespace,omitempty"`
+	Pod       string                     `json:"pod,omitempty"`
+	Message   string                     `json:"message,omitempty"`
+	Result    *KubernetesNodeDrainResult `json:"result,omitempty"`
+}
+
+// KubernetesNodeDrainResult lists the pods a drain evicted, skipped and failed to evict as
+// namespace/name.
+type KubernetesNodeDrainResult struct {
+	Node    string   `json:"node"`
+	Evicted []string `json:"evicted"`
+	Skipped []string `json:"skipped"`
+	Failed  []string `json:"failed"`
+}
@@ -0,0 +1,64 @@
+package model
+
+const (
+	// KubernetesTargetApplied targets were last written by a pipeline deploy step.
+	KubernetesTargetApplied = "applied"
+	// KubernetesTargetAdopted targets existed before devsys and were adopted as they were.
+	KubernetesTargetAdopted = "adopted"
+)
+
+const (
+	KubernetesDriftUnknown = "unknown"
+	KubernetesDriftInSync  = "in_sync"
+	KubernetesDriftDrifted = "drifted"
+	// KubernetesDriftMissing means the live object no longer exists.
+	KubernetesDriftMissing = "missing"
+)
+
+// KubernetesTarget is a cluster object managed by a repository. Baseline is the normalized
+// object as last applied or adopted; drift checks compare the live object against it.
+type KubernetesTarget struct {
+	ID         int64                    `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID     int64                    `json:"repo_id"     gorm:"column:repo_id;uniqueIndex:idx_k8s_targets_object"`
+	ClusterID  int64                    `json:"cluster_id"  gorm:"column:cluster_id;uniqueIndex:idx_k8s_targets_object;index"`
+	Namespace  string                   `json:"namespace"   gorm:"column:namespace;size:191;uniqueIndex:idx_k8s_targets_object"`
+	Group      string                   `json:"group"       gorm:"column:api_group;size:191;uniqueIndex:idx_k8s_targets_object"`
+	Version    string                   `json:"version"     gorm:"column:version;size:64"`
+	Kind       string                   `json:"kind"        gorm:"column:kind;size:128;uniqueIndex:idx_k8s_targets_object"`
+	Resource   string                   `json:"resource"    gorm:"column:resource;size:128"`
+	Name       string                   `json:"name"        gorm:"column:name;size:191;uniqueIndex:idx_k8s_targets_object"`
+	Source     string                   `json:"source"      gorm:"column:source;size:32"`
+	PipelineID int64                    `json:"pipeline_id" gorm:"column:pipeline_id"`
+	Baseline   map[string]interface{}   `json:"baseline"    gorm:"column:baseline;serializer:json;type:text"`
+	DriftState string                   `json:"drift_state" gorm:"column:drift_state;size:32"`
+	Findings   []KubernetesDriftFinding `json:"findings"    gorm:"column:findings;serializer:json;type:text"`
+	CheckError string                   `json:"check_error,omitempty" gorm:"column:check_error;type:text"`
+	CheckedAt  int64                    `json:"checked_at"  gorm:"column:checked_at"`
+	Created    int64                    `json:"created"     gorm:"column:created"`
+	Updated    int64                    `json:"updated"     gorm:"column:updated"`
+}
+
+func (KubernetesTarget) TableName() string {
+	return "k8s_targets"
+}
+
+// KubernetesDriftFinding is one field whose live value differs from the baseline. Path uses
+// dots for fields and [key=value] for list entries matched by key, e.g.
+// spec.template.spec.containers[name=app].image. Managers lists the field managers owning the
+// field when the object carries server-side apply data.
+type KubernetesDriftFinding struct {
+	Path     string      `json:"path"`
+	Baseline interface{} `json:"baseline,omitempty"`
+	Live     interface{} `json:"live,omitempty"`
+	Managers []string    `json:"managers,omitempty"`
+}
+
+// KubernetesTargetRef identifies a live object to adopt.
+type KubernetesTargetRef struct {
+	ClusterID int64  `json:"cluster_id"`
+	Group     string `json:"group"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
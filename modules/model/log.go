@@ -1,5 +1,7 @@
 package model
 
+import "encoding/json"
+
 type LogEntryType int
 
 const (
@@ -23,3 +25,36 @@ type LogEntry struct {
 func (LogEntry) TableName() string {
 	return "log_entries"
 }
+
+const (
+	LogCommandStart = "command_start"
+	LogCommandEnd   = "command_end"
+)
+
+// LogCommandMarker is the JSON payload of the metadata log lines that frame each command of
+// a step: Marker is LogCommandStart before the command runs and LogCommandEnd after it.
+// Started is in unix milliseconds; ExitCode and DurationMs are set on end markers.
+type LogCommandMarker struct {
+	Marker     string `json:"marker"`
+	Index      int    `json:"index"`
+	Command    string `json:"command,omitempty"`
+	Started    int64  `json:"started"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+}
+
+// ParseLogCommandMarker decodes the command marker stored in a metadata log line; ok is false
+// for other lines.
+func ParseLogCommandMarker(entry *LogEntry) (*LogCommandMarker, bool) {
+	if entry == nil || entry.Type != LogEntryMetadata {
+		return nil, false
+	}
+	var marker LogCommandMarker
+	if err := json.Unmarshal(entry.Data, &marker); err != nil {
+		return nil, false
+	}
+	if marker.Marker != LogCommandStart && marker.Marker != LogCommandEnd {
+		return nil, false
+	}
+	return &marker, true
+}
@@ -0,0 +1,20 @@
+package model
+
+// NamespaceLock records the pipeline step currently deploying into a cluster namespace.
+// The unique index on (cluster, namespace) makes the insert the acquisition.
+type NamespaceLock struct {
+	ID             int64  `json:"id"              gorm:"column:id;primaryKey;autoIncrement"`
+	Cluster        string `json:"cluster"         gorm:"column:cluster;size:191;uniqueIndex:idx_namespace_locks_target"`
+	Namespace      string `json:"namespace"       gorm:"column:namespace;size:191;uniqueIndex:idx_namespace_locks_target"`
+	RepoID         int64  `json:"repo_id"         gorm:"column:repo_id"`
+	RepoName       string `json:"repo_name"       gorm:"column:repo_name;size:500"`
+	PipelineID     int64  `json:"pipeline_id"     gorm:"column:pipeline_id;index"`
+	PipelineNumber int64  `json:"pipeline_number" gorm:"column:pipeline_number"`
+	StepID         int64  `json:"step_id"         gorm:"column:step_id"`
+	StepName       string `json:"step_name"       gorm:"column:step_name;size:191"`
+	Acquired       int64  `json:"acquired"        gorm:"column:acquired"`
+}
+
+func (NamespaceLock) TableName() string {
+	return "namespace_locks"
+}
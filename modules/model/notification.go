@@ -0,0 +1,91 @@
+package model
+
+const (
+	// NotificationTypeWebhook posts the event as JSON to a generic HTTP endpoint.
+	NotificationTypeWebhook = "webhook"
+	// NotificationTypeSlack posts a message to a Slack incoming webhook.
+	NotificationTypeSlack = "slack"
+	// NotificationTypeDingTalk posts a markdown message to a DingTalk robot.
+	NotificationTypeDingTalk = "dingtalk"
+)
+
+const (
+	NotificationEventSuccess = "success"
+	NotificationEventFailure = "failure"
+	NotificationEventBlocked = "blocked"
+	// NotificationEventDrift is sent when a deploy target drifts from its baseline.
+	NotificationEventDrift = "drift"
+	// NotificationEventApproval is sent to the approvers of an approval step when it starts
+	// waiting for them.
+	NotificationEventApproval = "approval"
+	// NotificationEventApprovalReminder is sent once when an approval is still pending after
+	// part of its timeout.
+	NotificationEventApprovalReminder = "approval_reminder"
+)
+
+const (
+	NotificationDelivered = "delivered"
+	NotificationFailed    = "failed"
+)
+
+// NotificationTarget is an endpoint of a repository that is notified when its pipelines
+// finish or wait for approval. An empty Events list subscribes to every event. Secret signs
+// webhook payloads and DingTalk requests; it is never returned by the API.
+type NotificationTarget struct {
+	ID      int64    `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID  int64    `json:"repo_id" gorm:"column:repo_id;index"`
+	Name    string   `json:"name"    gorm:"column:name;size:191"`
+	Type    string   `json:"type"    gorm:"column:type;size:32"`
+	URL     string   `json:"url"     gorm:"column:url;size:1024"`
+	Secret  string   `json:"-"       gorm:"column:secret;size:512"`
+	Events  []string `json:"events"  gorm:"column:events;serializer:json"`
+	Enabled bool     `json:"enabled" gorm:"column:enabled"`
+	Created int64    `json:"created" gorm:"column:created"`
+	Updated int64    `json:"updated" gorm:"column:updated"`
+}
+
+func (NotificationTarget) TableName() string {
+	return "notification_targets"
+}
+
+// Subscribed reports whether the target wants event.
+func (t *NotificationTarget) Subscribed(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, candidate := range t.Events {
+		if candidate == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationAttempt records the delivery of one event to one target.
+type NotificationAttempt struct {
+	ID         int64  `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID     int64  `json:"repo_id"     gorm:"column:repo_id;index"`
+	TargetID   int64  `json:"target_id"   gorm:"column:target_id;index"`
+	TargetName string `json:"target_name" gorm:"column:target_name;size:191"`
+	PipelineID int64  `json:"pipeline_id" gorm:"column:pipeline_id;index"`
+	Event      string `json:"event"       gorm:"column:event;size:32"`
+	Status     string `json:"status"      gorm:"column:status;size:32"`
+	Attempts   int    `json:"attempts"    gorm:"column:attempts"`
+	Error      string `json:"error"       gorm:"column:error;type:text"`
+	Created    int64  `json:"created"     gorm:"column:created"`
+}
+
+func (NotificationAttempt) TableName() string {
+	return "notification_attempts"
+}
+
+// NotificationTargetPatch contains mutable fields of a notification target. An empty or
+// masked Secret keeps the stored one.
+type NotificationTargetPatch struct {
+	Name    *string   `json:"name,omitempty"`
+	Type    *string   `json:"type,omitempty"`
+	URL     *string   `json:"url,omitempty"`
+	Secret  *string   `json:"secret,omitempty"`
+	Events  *[]string `json:"events,omitempty"`
+	Enabled *bool     `json:"enabled,omitempty"`
+}
@@ -0,0 +1,45 @@
+package model
+
+// DefaultOrganizationName names the organization that owns data created before multi-tenancy
+// was enabled.
+const DefaultOrganizationName = "default"
+
+const (
+	// OrgMemberSourceForge marks memberships derived from forge organizations at login.
+	OrgMemberSourceForge = "forge"
+	// OrgMemberSourceManual marks memberships assigned by an administrator.
+	OrgMemberSourceManual = "manual"
+)
+
+// Organization isolates certificates, Kubernetes clusters and approver groups of one business
+// unit from the others. Forge organizations with the same name map their members into it.
+type Organization struct {
+	ID      int64  `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	Name    string `json:"name"    gorm:"column:name;size:191;uniqueIndex"`
+	Created int64  `json:"created" gorm:"column:created"`
+	Updated int64  `json:"updated" gorm:"column:updated"`
+}
+
+func (Organization) TableName() string {
+	return "organizations"
+}
+
+// OrgMember grants a user access to an organization.
+type OrgMember struct {
+	ID      int64  `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	OrgID   int64  `json:"org_id"  gorm:"column:org_id;uniqueIndex:idx_org_members_org_user"`
+	UserID  int64  `json:"user_id" gorm:"column:user_id;uniqueIndex:idx_org_members_org_user;index"`
+	Source  string `json:"source"  gorm:"column:source;size:32"`
+	Created int64  `json:"created" gorm:"column:created"`
+}
+
+func (OrgMember) TableName() string {
+	return "org_members"
+}
+
+// OrgMemberInfo is a membership joined with the login of its user.
+type OrgMemberInfo struct {
+	UserID int64  `json:"user_id"`
+	Login  string `json:"login"`
+	Source string `json:"source"`
+}
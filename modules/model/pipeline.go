@@ -2,22 +2,22 @@ package model
 
 type Pipeline struct {
 	ID                   int64             `json:"id"                      gorm:"column:id;primaryKey;autoIncrement"`
-	RepoID               int64             `json:"-"                       gorm:"column:repo_id;index;uniqueIndex:uq_pipeline_repo_number"`
+	RepoID               int64             `json:"-"                       gorm:"column:repo_id;index;uniqueIndex:uq_pipeline_repo_number;index:idx_pipelines_repo_created,priority:1;index:idx_pipelines_repo_branch,priority:1;index:idx_pipelines_repo_status,priority:1;index:idx_pipelines_repo_event,priority:1"`
 	Number               int64             `json:"number"                  gorm:"column:number;uniqueIndex:uq_pipeline_repo_number"`
 	Author               string            `json:"author"                  gorm:"column:author;index"`
 	Parent               int64             `json:"parent"                  gorm:"column:parent"`
-	Event                WebhookEvent      `json:"event"                   gorm:"column:event"`
+	Event                WebhookEvent      `json:"event"                   gorm:"column:event;size:32;index:idx_pipelines_repo_event,priority:2"`
 	EventReason          []string          `json:"event_reason"            gorm:"column:event_reason;serializer:json"`
-	Status               StatusValue       `json:"status"                  gorm:"column:status;index"`
+	Status               StatusValue       `json:"status"                  gorm:"column:status;index;index:idx_pipelines_repo_status,priority:2"`
 	Errors               []*PipelineError  `json:"errors"                  gorm:"column:errors;serializer:json"`
-	Created              int64             `json:"created"                 gorm:"column:created;not null;default:0"`
+	Created              int64             `json:"created"                 gorm:"column:created;not null;default:0;index:idx_pipelines_repo_created,priority:2;index:idx_pipelines_repo_branch,priority:3;index:idx_pipelines_repo_status,priority:3;index:idx_pipelines_repo_event,priority:3"`
 	Updated              int64             `json:"updated"                 gorm:"column:updated;not null;default:0"`
 	Started              int64             `json:"started"                 gorm:"column:started"`
 	Finished             int64             `json:"finished"                gorm:"column:finished"`
 	DeployTo             string            `json:"deploy_to"               gorm:"column:deploy"`
 	DeployTask           string            `json:"deploy_task"             gorm:"column:deploy_task"`
 	Commit               string            `json:"commit"                  gorm:"column:commit"`
-	Branch               string            `json:"branch"                  gorm:"column:branch"`
+	Branch               string            `json:"branch"                  gorm:"column:branch;size:191;index:idx_pipelines_repo_branch,priority:2"`
 	Ref                  string            `json:"ref"                     gorm:"column:ref"`
 	Refspec              string            `json:"refspec"                 gorm:"column:refspec"`
 	Title                string            `json:"title"                   gorm:"column:title"`
@@ -36,19 +36,31 @@ type Pipeline struct {
 	PullRequestMilestone string            `json:"pr_milestone,omitempty"  gorm:"column:pr_milestone"`
 	IsPrerelease         bool              `json:"is_prerelease,omitempty" gorm:"column:is_prerelease"`
 	FromFork             bool              `json:"from_fork,omitempty"     gorm:"column:from_fork"`
+	WorkspaceSize        int64             `json:"workspace_size"          gorm:"column:workspace_size"`
+	ConfigHash           string            `json:"config_hash,omitempty"   gorm:"column:config_hash;size:64"`
+	ConfigVersion        int               `json:"config_version,omitempty" gorm:"column:config_version"`
+	// ConfigContent snapshots the definition of runs read from a repository file, whose
+	// content may change or disappear later.
+	ConfigContent string `json:"config_content,omitempty" gorm:"column:config_content;type:longtext"`
+	// Outputs collects the Step.Outputs of the run by step name.
+	Outputs map[string]map[string]string `json:"outputs,omitempty" gorm:"column:outputs;serializer:json"`
 }
 
 func (Pipeline) TableName() string {
 	return "pipelines"
 }
 
+// PipelineFilter narrows pipeline run lists; empty fields match every run. Before and After
+// bound the creation time in unix seconds, 0 leaving the bound open. Search matches the message
+// or a commit prefix.
 type PipelineFilter struct {
-	Before      int64
-	After       int64
-	Branch      string
-	Events      []WebhookEvent
-	RefContains string
-	Status      StatusValue
+	Before   int64
+	After    int64
+	Branch   string
+	Events   []WebhookEvent
+	Statuses []StatusValue
+	Author   string
+	Search   string
 }
 
 func (p Pipeline) IsMultiPipeline() bool {
@@ -63,4 +75,13 @@ type PipelineOptions struct {
 	Branch    string            `json:"branch"`
 	Variables map[string]string `json:"variables"`
 	Commit    string            `json:"commit"`
+	// Ref is the git ref to run for, like refs/tags/v1.2.3; a name without the refs/ prefix
+	// is a tag. Empty runs Branch.
+	Ref string `json:"ref,omitempty"`
+	// Priority orders the run in the queue; RunAfter holds it back until that unix time.
+	Priority int   `json:"priority,omitempty"`
+	RunAfter int64 `json:"run_after,omitempty"`
+	// ChangedFiles are the files a webhook reported as changed; nil leaves them to be
+	// computed from the workspace.
+	ChangedFiles []string `json:"-"`
 }
@@ -0,0 +1,27 @@
+package model
+
+// PipelineEventType names an event pushed to the clients of the event stream.
+type PipelineEventType string
+
+const (
+	PipelineEventCreated       PipelineEventType = "pipeline.created"
+	PipelineEventStatusChanged PipelineEventType = "pipeline.status_changed"
+	StepEventStatusChanged     PipelineEventType = "step.status_changed"
+	ApprovalEventRequested     PipelineEventType = "approval.requested"
+)
+
+// PipelineEvent is a change of a pipeline run. ID increases with every event of the server
+// process, so a reconnecting client resumes after the last one it saw. The step fields are
+// set for step and approval events.
+type PipelineEvent struct {
+	ID         int64             `json:"id"`
+	Type       PipelineEventType `json:"type"`
+	RepoID     int64             `json:"repo_id"`
+	PipelineID int64             `json:"pipeline_id"`
+	Number     int64             `json:"number"`
+	StepID     int64             `json:"step_id,omitempty"`
+	StepName   string            `json:"step_name,omitempty"`
+	OldStatus  StatusValue       `json:"old_status,omitempty"`
+	Status     StatusValue       `json:"status"`
+	Created    int64             `json:"created"`
+}
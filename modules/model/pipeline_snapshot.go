@@ -0,0 +1,23 @@
+package model
+
+// PipelineSnapshot records what a pipeline was triggered with: the normalized definition, the
+// resolved revision, the non-secret variables and where the definition came from. Values
+// under secret-looking keys are masked before they are stored.
+type PipelineSnapshot struct {
+	ID            int64             `json:"id"                     gorm:"column:id;primaryKey;autoIncrement"`
+	PipelineID    int64             `json:"pipeline_id"            gorm:"column:pipeline_id;uniqueIndex"`
+	Spec          string            `json:"spec"                   gorm:"column:spec;type:longtext"`
+	Branch        string            `json:"branch"                 gorm:"column:branch;size:255"`
+	Ref           string            `json:"ref"                    gorm:"column:ref;size:255"`
+	Commit        string            `json:"commit"                 gorm:"column:commit;size:64"`
+	Variables     map[string]string `json:"variables"              gorm:"column:variables;serializer:json"`
+	ConfigSource  string            `json:"config_source"          gorm:"column:config_source;size:16"`
+	ConfigFile    string            `json:"config_file,omitempty"  gorm:"column:config_file;size:500"`
+	ConfigVersion int               `json:"config_version,omitempty" gorm:"column:config_version"`
+	ConfigHash    string            `json:"config_hash"            gorm:"column:config_hash;size:64"`
+	Created       int64             `json:"created"                gorm:"column:created"`
+}
+
+func (PipelineSnapshot) TableName() string {
+	return "pipeline_snapshots"
+}
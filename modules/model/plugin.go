@@ -0,0 +1,63 @@
+package model
+
+import "strings"
+
+// PluginSettingType is the value type a plugin setting accepts.
+type PluginSettingType string
+
+const (
+	PluginSettingString  PluginSettingType = "string"
+	PluginSettingNumber  PluginSettingType = "number"
+	PluginSettingBoolean PluginSettingType = "boolean"
+	// PluginSettingList accepts a list or a single value; the values reach the plugin joined
+	// by newlines like any other setting.
+	PluginSettingList PluginSettingType = "list"
+)
+
+// PluginSetting describes one setting a plugin reads from its PLUGIN_* env. A required
+// setting without Default must be set by the step; Enum restricts the allowed values.
+type PluginSetting struct {
+	Name        string            `json:"name"`
+	Type        PluginSettingType `json:"type"`
+	Required    bool              `json:"required,omitempty"`
+	Default     any               `json:"default,omitempty"`
+	Enum        []string          `json:"enum,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// PluginDefinition is a step plugin administrators register, which steps reference with
+// `plugin: <name>` instead of an image. The settings of those steps are checked against
+// Settings when the config is saved and when a pipeline is triggered.
+type PluginDefinition struct {
+	ID          int64           `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	Name        string          `json:"name"        gorm:"column:name;size:191;uniqueIndex:idx_plugin_definitions_name"`
+	Version     string          `json:"version"     gorm:"column:version;size:64"`
+	Image       string          `json:"image"       gorm:"column:image;size:500"`
+	Description string          `json:"description" gorm:"column:description;type:text"`
+	Settings    []PluginSetting `json:"settings"    gorm:"column:settings;serializer:json"`
+	Created     int64           `json:"created"     gorm:"column:created"`
+	Updated     int64           `json:"updated"     gorm:"column:updated"`
+}
+
+func (PluginDefinition) TableName() string {
+	return "plugin_definitions"
+}
+
+// Setting returns the schema of the setting called name, ignoring case as the PLUGIN_* env
+// does; nil when the plugin has none.
+func (p *PluginDefinition) Setting(name string) *PluginSetting {
+	for i := range p.Settings {
+		if strings.EqualFold(p.Settings[i].Name, name) {
+			return &p.Settings[i]
+		}
+	}
+	return nil
+}
+
+// Ref names the definition as recorded on the steps that ran it, e.g. "docker-publish@1.2.0".
+func (p *PluginDefinition) Ref() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + "@" + p.Version
+}
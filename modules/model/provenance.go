@@ -0,0 +1,16 @@
+package model
+
+// PipelineProvenance is the signed build provenance of a successful pipeline. Document holds
+// the exact bytes that were signed; Signature is the base64 ed25519 signature over them.
+type PipelineProvenance struct {
+	ID         int64  `json:"id"          gorm:"column:id;primaryKey;autoIncrement"`
+	PipelineID int64  `json:"pipeline_id" gorm:"column:pipeline_id;uniqueIndex"`
+	KeyID      string `json:"key_id"      gorm:"column:key_id;size:191"`
+	Document   []byte `json:"-"           gorm:"column:document;type:longblob"`
+	Signature  string `json:"signature"   gorm:"column:signature;type:text"`
+	Created    int64  `json:"created"     gorm:"column:created"`
+}
+
+func (PipelineProvenance) TableName() string {
+	return "pipeline_provenances"
+}
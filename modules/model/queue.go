@@ -4,6 +4,8 @@ type QueueTask struct {
 	Task
 	PipelineNumber int64  `json:"pipeline_number"`
 	AgentName      string `json:"agent_name"`
+	// BlockedBy is the pipeline a waiting task waits for.
+	BlockedBy int64 `json:"blocked_by,omitempty"`
 }
 
 type QueueInfo struct {
@@ -13,8 +15,10 @@ type QueueInfo struct {
 	Stats         struct {
 		WorkerCount        int `json:"worker_count"`
 		PendingCount       int `json:"pending_count"`
+		DelayedCount       int `json:"delayed_count"`
 		WaitingOnDepsCount int `json:"waiting_on_deps_count"`
 		RunningCount       int `json:"running_count"`
+		ParkedCount        int `json:"parked_count"`
 	} `json:"stats"`
 	Paused bool `json:"paused"`
 }
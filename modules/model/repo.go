@@ -56,12 +56,31 @@ type Repo struct {
 	CancelPreviousPipelineEvents []WebhookEvent       `json:"cancel_previous_pipeline_events" gorm:"column:cancel_previous_pipeline_events;serializer:json"`
 	NetrcTrustedPlugins          []string             `json:"netrc_trusted"                   gorm:"column:netrc_trusted;serializer:json"`
 	ConfigExtensionEndpoint      string               `json:"config_extension_endpoint"       gorm:"column:config_extension_endpoint;size:500"`
+	WebhookID                    string               `json:"webhook_id,omitempty"            gorm:"column:webhook_id;size:191"`
+	// CertificateID is the git or ssh certificate an imported repository is cloned with, as
+	// it has no forge user whose token could be used.
+	CertificateID int64 `json:"certificate_id,omitempty"        gorm:"column:certificate_id"`
 }
 
 func (Repo) TableName() string {
 	return "repos"
 }
 
+// IsManual reports whether the repository was imported by clone URL rather than synced from a
+// forge. Such repositories have no forge to sync from, read files from or register webhooks on.
+func (r *Repo) IsManual() bool {
+	return r != nil && r.ForgeID == 0
+}
+
+// RepoImport registers a repository by clone URL. Name is the owner/name it is listed under;
+// without it the name is taken from the URL. Branch defaults to the HEAD of the remote.
+type RepoImport struct {
+	CloneURL      string `json:"clone_url"`
+	Name          string `json:"name"`
+	Branch        string `json:"default_branch"`
+	CertificateID int64  `json:"certificate_id,omitempty"`
+}
+
 type RepoFilter struct {
 	Name string
 }
@@ -127,10 +146,18 @@ type RepoPatch struct {
 
 type ForgeRemoteID string
 
+// ManualRemoteIDPrefix starts the remote id of imported repositories, which no forge knows.
+const ManualRemoteIDPrefix = "manual-"
+
 func (r ForgeRemoteID) IsValid() bool {
 	return r != "" && r != "0"
 }
 
+// IsManual reports whether the id was generated for an imported repository.
+func (r ForgeRemoteID) IsManual() bool {
+	return strings.HasPrefix(string(r), ManualRemoteIDPrefix)
+}
+
 type TrustedConfiguration struct {
 	Network  bool `json:"network"`
 	Volumes  bool `json:"volumes"`
@@ -0,0 +1,57 @@
+package model
+
+// RepoRole is the access level of a user on a repository. Each role includes the ones below.
+type RepoRole string
+
+const (
+	// RepoRoleViewer reads runs, logs and the pipeline config.
+	RepoRoleViewer RepoRole = "viewer"
+	// RepoRoleDeveloper also triggers and cancels pipelines.
+	RepoRoleDeveloper RepoRole = "developer"
+	// RepoRoleMaintainer also edits config, settings, secrets and members.
+	RepoRoleMaintainer RepoRole = "maintainer"
+	// RepoRoleOwner is held by the syncing user and administrators; it cannot be assigned.
+	RepoRoleOwner RepoRole = "owner"
+)
+
+var repoRoleRanks = map[RepoRole]int{
+	RepoRoleViewer:     1,
+	RepoRoleDeveloper:  2,
+	RepoRoleMaintainer: 3,
+	RepoRoleOwner:      4,
+}
+
+// Valid reports whether r can be assigned to a member.
+func (r RepoRole) Valid() bool {
+	return r == RepoRoleViewer || r == RepoRoleDeveloper || r == RepoRoleMaintainer
+}
+
+// Includes reports whether r grants everything required grants. The empty role grants nothing.
+func (r RepoRole) Includes(required RepoRole) bool {
+	rank, ok := repoRoleRanks[r]
+	return ok && rank >= repoRoleRanks[required]
+}
+
+// RepoMember grants a user other than the repository owner access to the repository.
+type RepoMember struct {
+	ID      int64    `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID  int64    `json:"repo_id" gorm:"column:repo_id;uniqueIndex:idx_repo_members_repo_user"`
+	UserID  int64    `json:"user_id" gorm:"column:user_id;uniqueIndex:idx_repo_members_repo_user;index"`
+	Role    RepoRole `json:"role"    gorm:"column:role;size:32"`
+	Created int64    `json:"created" gorm:"column:created"`
+	Updated int64    `json:"updated" gorm:"column:updated"`
+}
+
+func (RepoMember) TableName() string {
+	return "repo_members"
+}
+
+// RepoMemberInfo is a membership joined with the login of its user.
+type RepoMemberInfo struct {
+	UserID  int64    `json:"user_id"`
+	Login   string   `json:"login"`
+	Avatar  string   `json:"avatar_url"`
+	Role    RepoRole `json:"role"`
+	Created int64    `json:"created"`
+	Updated int64    `json:"updated"`
+}
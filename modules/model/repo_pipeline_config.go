@@ -18,6 +18,31 @@ type RepoPipelineConfig struct {
 	Created          int64    `json:"created"           gorm:"column:created"`
 	Updated          int64    `json:"updated"           gorm:"column:updated"`
 
+	// CronLastTriggered maps a cron expression to the unix time it last started a pipeline.
+	CronLastTriggered map[string]int64 `json:"cron_last_triggered,omitempty" gorm:"column:cron_last_triggered;serializer:json"`
+	// Version is the RepoPipelineConfigRevision version of Content; 0 until the content is
+	// first saved with revisions.
+	Version int `json:"version" gorm:"column:version"`
+	// ConfigSource is where runs read their definition: PipelineConfigSourceDB, the default,
+	// uses Content; PipelineConfigSourceRepo reads ConfigFile from the repository.
+	ConfigSource string `json:"config_source" gorm:"column:config_source;size:16"`
+	// ConfigFile is the path read for PipelineConfigSourceRepo; empty falls back to the
+	// config path synced from the forge, then DefaultPipelineConfigFile.
+	ConfigFile string `json:"config_file" gorm:"column:config_file;size:500"`
+	// StepCPU and StepMemory limit the containers of steps without resources of their own,
+	// like "2" and "4g"; empty is unlimited.
+	StepCPU    string `json:"step_cpu"    gorm:"column:step_cpu;size:32"`
+	StepMemory string `json:"step_memory" gorm:"column:step_memory;size:32"`
+	// ReportCommitStatus reports the state of runs back to the forge as a commit status.
+	ReportCommitStatus bool `json:"report_commit_status" gorm:"column:report_commit_status"`
+	// LogRetentionDays drops the log lines of finished runs after that many days while the
+	// runs themselves are kept; 0 keeps logs as long as their run.
+	LogRetentionDays int `json:"log_retention_days" gorm:"column:log_retention_days"`
+	// PublicStatus serves the status of the runs without authentication on the public API;
+	// PublicMessages adds their commit messages, which are left out otherwise.
+	PublicStatus   bool `json:"public_status"   gorm:"column:public_status"`
+	PublicMessages bool `json:"public_messages" gorm:"column:public_messages"`
+
 	// legacy columns retained for backward-compatibility with existing databases.
 	LegacyVariables    map[string]string            `json:"-" gorm:"column:variables;serializer:json"`
 	LegacyCertificates []PipelineCertificateBinding `json:"-" gorm:"column:certificates;serializer:json"`
@@ -25,6 +50,14 @@ type RepoPipelineConfig struct {
 	LegacyCronSpec     string                       `json:"-" gorm:"column:cron_spec;size:255"`
 }
 
+const (
+	PipelineConfigSourceDB   = "db"
+	PipelineConfigSourceRepo = "repo"
+	// DefaultPipelineConfigFile is read when a repository sources its config from a file
+	// without naming one.
+	DefaultPipelineConfigFile = ".devsys.yml"
+)
+
 func (RepoPipelineConfig) TableName() string {
 	return "repo_pipeline_configs"
 }
@@ -0,0 +1,20 @@
+package model
+
+// RepoPipelineConfigRevision is a saved version of the pipeline config of a repository.
+// Version counts up per repository from 1; a revert is saved as a new revision whose
+// RevertedFrom is the version it restored.
+type RepoPipelineConfigRevision struct {
+	ID           int64  `json:"id"                      gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID       int64  `json:"repo_id"                 gorm:"column:repo_id;uniqueIndex:idx_config_revision_version"`
+	Version      int    `json:"version"                 gorm:"column:version;uniqueIndex:idx_config_revision_version"`
+	Content      string `json:"content"                 gorm:"column:content;type:longtext"`
+	ContentHash  string `json:"content_hash"            gorm:"column:content_hash;size:64"`
+	Author       string `json:"author"                  gorm:"column:author;size:191"`
+	Message      string `json:"message,omitempty"       gorm:"column:message;type:text"`
+	RevertedFrom int    `json:"reverted_from,omitempty" gorm:"column:reverted_from"`
+	Created      int64  `json:"created"                 gorm:"column:created"`
+}
+
+func (RepoPipelineConfigRevision) TableName() string {
+	return "repo_pipeline_config_revisions"
+}
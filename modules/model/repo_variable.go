@@ -0,0 +1,26 @@
+package model
+
+// RepoVariable is an environment variable set for every pipeline of a repository. Variables
+// passed when triggering a run override it. Secret values are masked in step logs and never
+// returned by the API.
+type RepoVariable struct {
+	ID      int64  `json:"id"              gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID  int64  `json:"repo_id"         gorm:"column:repo_id;uniqueIndex:idx_repo_variables_repo_key"`
+	Key     string `json:"key"             gorm:"column:var_key;size:191;uniqueIndex:idx_repo_variables_repo_key"`
+	Value   string `json:"value,omitempty" gorm:"column:value;type:text"`
+	Secret  bool   `json:"secret"          gorm:"column:secret"`
+	Created int64  `json:"created"         gorm:"column:created"`
+	Updated int64  `json:"updated"         gorm:"column:updated"`
+}
+
+func (RepoVariable) TableName() string {
+	return "repo_variables"
+}
+
+// Redacted returns the variable without its value when it is secret.
+func (v RepoVariable) Redacted() RepoVariable {
+	if v.Secret {
+		v.Value = ""
+	}
+	return v
+}
@@ -0,0 +1,15 @@
+package model
+
+// RevokedToken denies a session token before it expires, e.g. after logout. Rows are kept until
+// ExpiresAt, after which the token is rejected anyway.
+type RevokedToken struct {
+	ID  int64  `json:"id"         gorm:"column:id;primaryKey;autoIncrement"`
+	JTI string `json:"jti"        gorm:"column:jti;size:64;uniqueIndex"`
+	// ExpiresAt is the unix expiry of the revoked token.
+	ExpiresAt int64 `json:"expires_at" gorm:"column:expires_at;index"`
+	Created   int64 `json:"created"    gorm:"column:created"`
+}
+
+func (RevokedToken) TableName() string {
+	return "revoked_tokens"
+}
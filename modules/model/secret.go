@@ -0,0 +1,67 @@
+package model
+
+import "sort"
+
+const (
+	// SecretScopeGlobal marks a secret visible to every repository.
+	SecretScopeGlobal = "global"
+	// SecretScopeRepo marks a secret owned by one repository.
+	SecretScopeRepo = "repo"
+)
+
+// Secret is a named set of key/value credentials that pipeline steps reference through
+// `secrets:`. RepoID 0 marks a global secret; a repository secret shadows a global secret
+// of the same name. Values are stored encrypted.
+type Secret struct {
+	ID      int64             `json:"id"      gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID  int64             `json:"repo_id" gorm:"column:repo_id;uniqueIndex:idx_secrets_repo_name"`
+	Name    string            `json:"name"    gorm:"column:name;size:191;uniqueIndex:idx_secrets_repo_name"`
+	Values  map[string]string `json:"-"       gorm:"column:data;serializer:json"`
+	Created int64             `json:"created" gorm:"column:created"`
+	Updated int64             `json:"updated" gorm:"column:updated"`
+}
+
+func (Secret) TableName() string {
+	return "secrets"
+}
+
+// Scope reports whether the secret is global or repository scoped.
+func (s *Secret) Scope() string {
+	if s.RepoID == 0 {
+		return SecretScopeGlobal
+	}
+	return SecretScopeRepo
+}
+
+// Keys returns the sorted value keys of the secret.
+func (s *Secret) Keys() []string {
+	keys := make([]string, 0, len(s.Values))
+	for key := range s.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MaskValues returns the values with every non-empty entry replaced by mask.
+func (s *Secret) MaskValues(mask string) map[string]string {
+	if mask == "" {
+		mask = DefaultSecretMask
+	}
+	masked := make(map[string]string, len(s.Values))
+	for key, value := range s.Values {
+		if value == "" {
+			masked[key] = ""
+			continue
+		}
+		masked[key] = mask
+	}
+	return masked
+}
+
+// SecretPatch contains mutable fields for a secret update. A nil value removes the key and
+// an empty or masked value keeps the stored one.
+type SecretPatch struct {
+	Name   *string            `json:"name,omitempty"`
+	Values map[string]*string `json:"values,omitempty"`
+}
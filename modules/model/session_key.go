@@ -0,0 +1,10 @@
+package model
+
+// SessionKeys holds the keys that sign and verify sessions and OAuth states. Primary signs
+// everything; Secondary is the previous primary, still accepted until SecondaryExpires.
+type SessionKeys struct {
+	Primary          string `json:"primary"`
+	Secondary        string `json:"secondary,omitempty"`
+	SecondaryExpires int64  `json:"secondary_expires,omitempty"`
+	Rotated          int64  `json:"rotated,omitempty"`
+}
@@ -26,6 +26,14 @@ type Step struct {
 	Finished   int64         `json:"finished,omitempty" gorm:"column:finished"`
 	Type       StepType      `json:"type,omitempty"     gorm:"column:type"`
 	Approval   *StepApproval `json:"approval,omitempty" gorm:"column:approval;serializer:json"`
+	// Outputs are the values of the step env computed with $(command) after the step ran,
+	// without those derived from secrets; build steps report their image and digest.
+	Outputs map[string]string `json:"outputs,omitempty" gorm:"column:outputs;serializer:json"`
+	// Plugin is the plugin definition and version a plugin step ran, e.g. "docker-publish@1.2.0".
+	Plugin string `json:"plugin,omitempty" gorm:"column:plugin;size:255"`
+	// FailureReason classifies why the step failed; Failure holds whether that failure fails
+	// the pipeline.
+	FailureReason StepFailureReason `json:"failure_reason,omitempty" gorm:"column:failure_reason;size:32"`
 }
 
 func (Step) TableName() string {
@@ -40,6 +48,29 @@ func (p *Step) Failing() bool {
 	return p.Failure == FailureFail && (p.State == StatusError || p.State == StatusKilled || p.State == StatusFailure)
 }
 
+// SoftFailed reports whether the step failed with ignore_failure set, which left the
+// pipeline running.
+func (p *Step) SoftFailed() bool {
+	return p.Failure == FailureIgnore && (p.State == StatusError || p.State == StatusKilled || p.State == StatusFailure)
+}
+
+// StepFailureReason classifies the failure of a step.
+type StepFailureReason string
+
+const (
+	// StepFailureCommand is a command of the step exiting non-zero.
+	StepFailureCommand StepFailureReason = "command"
+	// StepFailureInfrastructure is a failure outside the commands of the step, such as an
+	// unavailable docker daemon, an image pull or the workspace clone.
+	StepFailureInfrastructure StepFailureReason = "infrastructure"
+	// StepFailureTimeout is the step, the pipeline or an approval running out of time.
+	StepFailureTimeout StepFailureReason = "timeout"
+	// StepFailureCanceled is the pipeline being canceled while the step ran or waited.
+	StepFailureCanceled StepFailureReason = "canceled"
+	// StepFailureApprovalRejected is an approval step an approver rejected.
+	StepFailureApprovalRejected StepFailureReason = "approval_rejected"
+)
+
 type StepType string
 
 const (
@@ -49,6 +80,10 @@ const (
 	StepTypeCommands StepType = "commands"
 	StepTypeCache    StepType = "cache"
 	StepTypeApproval StepType = "approval"
+	// StepTypeDeploy applies a kubernetes manifest from the server instead of running commands.
+	StepTypeDeploy StepType = "deploy"
+	// StepTypeBuild builds, and optionally pushes, an image through the docker API.
+	StepTypeBuild StepType = "build"
 )
 
 type StepApprovalStrategy string
@@ -72,6 +107,14 @@ type StepApprovalDecision struct {
 	Action    string `json:"action"`
 	Comment   string `json:"comment"`
 	Timestamp int64  `json:"timestamp"`
+	// Groups records the approver groups the user satisfied and their roster when deciding.
+	Groups []StepApprovalGroupSnapshot `json:"groups,omitempty"`
+}
+
+// StepApprovalGroupSnapshot is the membership of an approver group at decision time.
+type StepApprovalGroupSnapshot struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
 }
 
 type StepApproval struct {
@@ -86,9 +129,12 @@ type StepApproval struct {
 	Decisions        []StepApprovalDecision `json:"decisions"`
 	FinalizedBy      string                 `json:"finalized_by"`
 	FinalizedAt      int64                  `json:"finalized_at"`
+	NotifiedAt       int64                  `json:"notified_at,omitempty"`
+	RemindedAt       int64                  `json:"reminded_at,omitempty"`
 	CanApprove       bool                   `json:"can_approve" gorm:"-"`
 	CanReject        bool                   `json:"can_reject" gorm:"-"`
 	PendingApprovers []string               `json:"pending_approvers,omitempty" gorm:"-"`
+	GroupMembers     map[string][]string    `json:"group_members,omitempty" gorm:"-"`
 }
 
 // Value implements driver.Valuer to persist the approval definition as JSON.
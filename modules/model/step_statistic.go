@@ -0,0 +1,19 @@
+package model
+
+// StepStatistic keeps the rolling duration baseline of the steps named StepName in a
+// repository. Samples holds the durations in seconds of the most recent successful runs,
+// oldest first; P50 and P90 are derived from it on every update.
+type StepStatistic struct {
+	ID       int64   `json:"id"        gorm:"column:id;primaryKey;autoIncrement"`
+	RepoID   int64   `json:"repo_id"   gorm:"column:repo_id;uniqueIndex:uq_step_statistics_repo_name"`
+	StepName string  `json:"step_name" gorm:"column:step_name;size:191;uniqueIndex:uq_step_statistics_repo_name"`
+	Count    int64   `json:"count"     gorm:"column:count"`
+	P50      int64   `json:"p50"       gorm:"column:p50"`
+	P90      int64   `json:"p90"       gorm:"column:p90"`
+	Samples  []int64 `json:"-"         gorm:"column:samples;serializer:json"`
+	Updated  int64   `json:"updated"   gorm:"column:updated"`
+}
+
+func (StepStatistic) TableName() string {
+	return "step_statistics"
+}
@@ -18,12 +18,26 @@ type Task struct {
 	AgentID      int64                  `json:"agent_id"     gorm:"column:agent_id"`
 	PipelineID   int64                  `json:"pipeline_id"  gorm:"column:pipeline_id"`
 	RepoID       int64                  `json:"repo_id"      gorm:"column:repo_id"`
+	// Priority orders queued tasks, highest first; RunAfter holds a task back until that unix
+	// time. Tasks stored before either existed run with normal priority right away.
+	Priority int   `json:"priority"  gorm:"column:priority;not null;default:0"`
+	RunAfter int64 `json:"run_after" gorm:"column:run_after;not null;default:0"`
 }
 
 func (Task) TableName() string {
 	return "tasks"
 }
 
+const (
+	// TaskPriorityNormal is the priority of tasks that ask for none.
+	TaskPriorityNormal = 0
+	// TaskPriorityUserMax is the highest priority anyone may give a manual run; higher ones,
+	// up to TaskPriorityMax, are reserved to admins.
+	TaskPriorityUserMax = 10
+	TaskPriorityMax     = 100
+	TaskPriorityMin     = -100
+)
+
 const (
 	taskLabelRepo = "repo"
 	taskLabelOrg  = "org-id"
@@ -24,6 +24,11 @@ type User struct {
 	Admin         bool          `json:"admin,omitempty" gorm:"column:admin"`
 	Hash          string        `json:"-"              gorm:"column:hash;size:191;uniqueIndex"`
 	OrgID         int64         `json:"org_id"         gorm:"column:org_id"`
+	// SyncNotice describes the last sync of the user's repositories when the rate limit of the
+	// forge cut it short, e.g. "partial sync, retry after ..."; empty after a complete sync.
+	SyncNotice string `json:"sync_notice,omitempty" gorm:"column:sync_notice;size:500"`
+	// SyncRetryAt is when the forge accepts requests again, in unix seconds.
+	SyncRetryAt int64 `json:"sync_retry_at,omitempty" gorm:"column:sync_retry_at"`
 }
 
 func (User) TableName() string {
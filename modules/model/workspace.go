@@ -0,0 +1,23 @@
+package model
+
+// WorkspaceUsage reports the disk usage of the build workspaces. Entries are the directories
+// directly below each workspace root: one per repository name and the shared cache.
+type WorkspaceUsage struct {
+	Total int64 `json:"total"`
+	// SoftLimit and HardLimit are the configured quota in bytes; 0 is unlimited.
+	SoftLimit int64                 `json:"soft_limit"`
+	HardLimit int64                 `json:"hard_limit"`
+	ScannedAt int64                 `json:"scanned_at"`
+	Roots     []string              `json:"roots"`
+	Entries   []WorkspaceUsageEntry `json:"entries"`
+}
+
+// WorkspaceUsageEntry is the usage of one directory below a workspace root. Repos lists the
+// repositories whose workspaces live there; repositories with the same name share it.
+type WorkspaceUsageEntry struct {
+	Root     string   `json:"root"`
+	Dir      string   `json:"dir"`
+	Repos    []string `json:"repos,omitempty"`
+	Size     int64    `json:"size"`
+	Modified int64    `json:"modified"`
+}
@@ -0,0 +1,220 @@
+package routers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+)
+
+// agentStoreBodyLimit bounds a store call of an agent; log lines are the largest.
+const agentStoreBodyLimit = 4 << 20
+
+type agentRouter struct {
+	services *service.Services
+	authMW   *authmw.Middleware
+}
+
+func newAgentRouter(services *service.Services, authMW *authmw.Middleware) *agentRouter {
+	return &agentRouter{services: services, authMW: authMW}
+}
+
+func (r *agentRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	admin := register("/admin/agents")
+	admin.Filter(requireCapability(r.services, model.CapabilityPipeline))
+
+	admin.Route(admin.GET("").To(r.listAgents).
+		Doc("List pipeline agents with whether they are online and the task they run").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]*model.AgentInfo{}).
+		Returns(http.StatusOK, "agents", []*model.AgentInfo{}))
+
+	// the agent endpoints exist only while an agent token is configured
+	if !r.services.Pipeline.AgentsEnabled() {
+		return []*restful.WebService{admin}
+	}
+
+	ws := register("/internal/agents")
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+	ws.Filter(r.requireAgentToken)
+
+	ws.Route(ws.POST("/register").To(r.register).
+		Doc("Register an agent under its name").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Reads(pipelineService.AgentRegistration{}).
+		Writes(model.Agent{}).
+		Returns(http.StatusOK, "agent", model.Agent{}).
+		Returns(http.StatusBadRequest, "invalid registration", errorResponse{}).
+		Returns(http.StatusUnauthorized, "invalid agent token", errorResponse{}))
+
+	ws.Route(ws.POST("/{agent_id}/next").To(r.next).
+		Doc("Wait for the next task the agent accepts").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("agent_id", "agent id").DataType("integer")).
+		Writes(pipelineService.AgentTask{}).
+		Returns(http.StatusOK, "task", pipelineService.AgentTask{}).
+		Returns(http.StatusNoContent, "no task in time", nil).
+		Returns(http.StatusNotFound, "agent not found", errorResponse{}))
+
+	ws.Route(ws.POST("/{agent_id}/heartbeat").To(r.heartbeat).
+		Doc("Report that the agent is alive and the task it runs").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("agent_id", "agent id").DataType("integer")).
+		Reads(pipelineService.AgentHeartbeatRequest{}).
+		Writes(pipelineService.AgentHeartbeatResponse{}).
+		Returns(http.StatusOK, "whether to cancel the task", pipelineService.AgentHeartbeatResponse{}))
+
+	ws.Route(ws.POST("/{agent_id}/tasks/{task_id}/done").To(r.complete).
+		Doc("Report that the agent finished a task").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("agent_id", "agent id").DataType("integer")).
+		Param(ws.PathParameter("task_id", "task id").DataType("string")).
+		Reads(pipelineService.AgentTaskResult{}).
+		Returns(http.StatusNoContent, "recorded", nil).
+		Returns(http.StatusNotFound, "task not handed to the agent", errorResponse{}))
+
+	ws.Route(ws.POST("/{agent_id}/tasks/{task_id}/store/{op}").To(r.store).
+		Doc("Read or write a record of the run of a task the agent was handed").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("agent_id", "agent id").DataType("integer")).
+		Param(ws.PathParameter("task_id", "task id").DataType("string")).
+		Param(ws.PathParameter("op", "store call").DataType("string")).
+		Writes(pipelineService.AgentStoreResult{}).
+		Returns(http.StatusOK, "result or store error", pipelineService.AgentStoreResult{}).
+		Returns(http.StatusForbidden, "call outside the task", errorResponse{}).
+		Returns(http.StatusNotFound, "task not handed to the agent", errorResponse{}))
+
+	return []*restful.WebService{admin, ws}
+}
+
+func (r *agentRouter) requireAgentToken(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if !r.services.Pipeline.AuthenticateAgent(authmw.TokenFromRequest(req.Request)) {
+		writeError(resp, http.StatusUnauthorized, errors.New("invalid agent token"))
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+func (r *agentRouter) listAgents(req *restful.Request, resp *restful.Response) {
+	agents, err := r.services.Pipeline.ListAgents(req.Request.Context())
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(agents)
+}
+
+func (r *agentRouter) register(req *restful.Request, resp *restful.Response) {
+	var body pipelineService.AgentRegistration
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	agent, err := r.services.Pipeline.RegisterAgent(req.Request.Context(), body.Name, body.Version, body.Labels)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	_ = resp.WriteEntity(agent)
+}
+
+func (r *agentRouter) next(req *restful.Request, resp *restful.Response) {
+	agentID, ok := parseAgentID(req, resp)
+	if !ok {
+		return
+	}
+	task, err := r.services.Pipeline.NextAgentTask(req.Request.Context(), agentID)
+	if err != nil {
+		writeError(resp, agentErrorStatus(err), err)
+		return
+	}
+	if task == nil {
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_ = resp.WriteEntity(pipelineService.AgentTask{Task: *task, Data: task.Data})
+}
+
+func (r *agentRouter) heartbeat(req *restful.Request, resp *restful.Response) {
+	agentID, ok := parseAgentID(req, resp)
+	if !ok {
+		return
+	}
+	var body pipelineService.AgentHeartbeatRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	cancel, err := r.services.Pipeline.AgentHeartbeat(req.Request.Context(), agentID, body.TaskID)
+	if err != nil {
+		writeError(resp, agentErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(pipelineService.AgentHeartbeatResponse{Cancel: cancel})
+}
+
+func (r *agentRouter) complete(req *restful.Request, resp *restful.Response) {
+	agentID, ok := parseAgentID(req, resp)
+	if !ok {
+		return
+	}
+	var body pipelineService.AgentTaskResult
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if err := r.services.Pipeline.CompleteAgentTask(req.Request.Context(), agentID, req.PathParameter("task_id"), body.Error); err != nil {
+		writeError(resp, agentErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *agentRouter) store(req *restful.Request, resp *restful.Response) {
+	agentID, ok := parseAgentID(req, resp)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Request.Body, agentStoreBodyLimit))
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	result, err := r.services.Pipeline.AgentStoreCall(req.Request.Context(), agentID, req.PathParameter("task_id"), req.PathParameter("op"), body)
+	if err != nil {
+		writeError(resp, agentErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(result)
+}
+
+func parseAgentID(req *restful.Request, resp *restful.Response) (int64, bool) {
+	id, err := strconv.ParseInt(req.PathParameter("agent_id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("agent_id is invalid"))
+		return 0, false
+	}
+	return id, true
+}
+
+func agentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pipelineService.ErrAgentNotFound), errors.Is(err, pipelineService.ErrAgentTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, pipelineService.ErrAgentStoreDenied):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
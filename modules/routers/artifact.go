@@ -0,0 +1,114 @@
+package routers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+func (r *repoRouter) registerArtifactRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/artifacts").To(r.listPipelineArtifacts).
+		Doc("List the artifacts collected by a pipeline run").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]*model.Artifact{}).
+		Returns(http.StatusOK, "artifacts", []*model.Artifact{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/artifacts/{artifact_id}").To(r.downloadPipelineArtifact).
+		Doc("Download an artifact of a pipeline run").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces("application/octet-stream").
+		Returns(http.StatusOK, "artifact content", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) listPipelineArtifacts(req *restful.Request, resp *restful.Response) {
+	repo, pipelineID, ok := r.artifactPipeline(req, resp)
+	if !ok {
+		return
+	}
+	artifacts, err := r.services.Pipeline.ListPipelineArtifacts(req.Request.Context(), repo.ID, pipelineID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if artifacts == nil {
+		artifacts = []*model.Artifact{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, artifacts)
+}
+
+func (r *repoRouter) downloadPipelineArtifact(req *restful.Request, resp *restful.Response) {
+	repo, pipelineID, ok := r.artifactPipeline(req, resp)
+	if !ok {
+		return
+	}
+	artifactID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("artifact_id")), 10, 64)
+	if err != nil || artifactID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid artifact id"))
+		return
+	}
+
+	artifact, file, err := r.services.Pipeline.OpenArtifact(req.Request.Context(), repo.ID, pipelineID, artifactID)
+	if errors.Is(err, pipelinesvc.ErrArtifactFileMissing) {
+		writeError(resp, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if artifact == nil {
+		writeError(resp, http.StatusNotFound, errors.New("artifact not found"))
+		return
+	}
+	defer file.Close()
+
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+	resp.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(artifact.Path)))
+	resp.Header().Set("X-Checksum-Sha256", artifact.Checksum)
+	resp.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(resp, file)
+}
+
+// artifactPipeline resolves the repository and pipeline id of an artifact route and writes
+// the error response when they are invalid.
+func (r *repoRouter) artifactPipeline(req *restful.Request, resp *restful.Response) (*model.Repo, int64, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, 0, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return nil, 0, false
+	}
+	pipelineID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("pipeline_id")), 10, 64)
+	if err != nil || pipelineID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid pipeline id"))
+		return nil, 0, false
+	}
+	return repo, pipelineID, true
+}
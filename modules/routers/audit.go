@@ -0,0 +1,114 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+)
+
+type auditEventListResponse struct {
+	Items   []*model.AuditEvent `json:"items"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Total   int64               `json:"total"`
+}
+
+type auditRouter struct {
+	services *service.Services
+	authMW   *authmw.Middleware
+}
+
+func newAuditRouter(services *service.Services, authMW *authmw.Middleware) *auditRouter {
+	return &auditRouter{services: services, authMW: authMW}
+}
+
+func (r *auditRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	if r.services == nil || r.services.Audit == nil {
+		return nil
+	}
+
+	ws := register("/admin/audit")
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(r.authMW.Authenticate)
+
+	ws.Route(ws.GET("").To(r.listAuditEvents).
+		Doc("List audit events, newest first").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("actor", "only events of this login").DataType("string")).
+		Param(ws.QueryParameter("action", "only events of this action, e.g. pipeline.trigger").DataType("string")).
+		Param(ws.QueryParameter("repo_id", "only events of this repository").DataType("integer")).
+		Param(ws.QueryParameter("since", "window start as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("until", "window end as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("page", "page number").DataType("integer")).
+		Param(ws.QueryParameter("per_page", "page size, at most 100").DataType("integer")).
+		Writes(auditEventListResponse{}).
+		Returns(http.StatusOK, "events", auditEventListResponse{}).
+		Returns(http.StatusBadRequest, "invalid filter", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	return []*restful.WebService{ws}
+}
+
+func (r *auditRouter) listAuditEvents(req *restful.Request, resp *restful.Response) {
+	page, _ := strconv.Atoi(req.QueryParameter("page"))
+	perPage, _ := strconv.Atoi(req.QueryParameter("per_page"))
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+
+	filter := model.AuditEventFilter{
+		Actor:  strings.TrimSpace(req.QueryParameter("actor")),
+		Action: strings.TrimSpace(req.QueryParameter("action")),
+	}
+	if raw := strings.TrimSpace(req.QueryParameter("repo_id")); raw != "" {
+		repoID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || repoID <= 0 {
+			writeError(resp, http.StatusBadRequest, errors.New("repo_id is invalid"))
+			return
+		}
+		filter.RepoID = repoID
+	}
+	var err error
+	if filter.Since, err = parseStatsTime(req.QueryParameter("since")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+		return
+	}
+	if filter.Until, err = parseStatsTime(req.QueryParameter("until")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid until: %w", err))
+		return
+	}
+
+	events, total, err := r.services.Audit.List(req.Request.Context(), model.ListOptions{Page: page, PerPage: perPage}, filter)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if events == nil {
+		events = []*model.AuditEvent{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, auditEventListResponse{
+		Items:   events,
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	})
+}
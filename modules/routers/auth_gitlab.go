@@ -51,7 +51,7 @@ func (r *authRouter) router(register func(path string) *restful.WebService, tags
 		Returns(http.StatusOK, "user info", authsvc.UserInfo{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}))
 
-	return []*restful.WebService{ws}
+	return []*restful.WebService{ws, r.registerSessionRoutes(register, tags), r.registerTokenRoutes(register, tags)}
 }
 
 type loginResponse struct {
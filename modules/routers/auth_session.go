@@ -0,0 +1,68 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	authsvc "github.com/thepenn/devsys/service/auth"
+)
+
+func (r *authRouter) registerSessionRoutes(register func(path string) *restful.WebService, tags []string) *restful.WebService {
+	ws := register("/auth")
+
+	// refresh accepts tokens that expired within the grace window, so it verifies the token
+	// itself instead of going through RequireAuth
+	ws.Route(ws.POST("/refresh").To(r.refreshSession).
+		Doc("Exchange the current session token for one with a new expiry; the old token is revoked").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Produces(restful.MIME_JSON).
+		Writes(authsvc.AuthResponse{}).
+		Returns(http.StatusOK, "auth response", authsvc.AuthResponse{}).
+		Returns(http.StatusUnauthorized, "token expired beyond the grace window, revoked or malformed", errorResponse{}).
+		Returns(http.StatusInternalServerError, "internal error", errorResponse{}))
+
+	ws.Route(ws.POST("/logout").To(r.logout).
+		Doc("Revoke the current session token").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "logged out", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusInternalServerError, "internal error", errorResponse{}))
+
+	return ws
+}
+
+func (r *authRouter) refreshSession(req *restful.Request, resp *restful.Response) {
+	token := authmw.TokenFromRequest(req.Request)
+	if token == "" {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	result, err := r.services.Auth.RefreshToken(req.Request.Context(), token)
+	if err != nil {
+		if errors.Is(err, authsvc.ErrTokenExpired) || errors.Is(err, authsvc.ErrTokenRevoked) || errors.Is(err, authsvc.ErrTokenMalformed) {
+			_ = resp.WriteHeaderAndEntity(http.StatusUnauthorized, errorResponse{Error: err.Error(), Code: authmw.ErrorCode(err)})
+			return
+		}
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+func (r *authRouter) logout(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	if err := r.services.Auth.Logout(req.Request.Context(), claims); err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
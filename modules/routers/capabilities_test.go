@@ -0,0 +1,122 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/cache"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+// newCapabilityContainer serves /meta and a /k8s and /pipelines route guarded by the
+// capability they need.
+func newCapabilityContainer(services *service.Services) *restful.Container {
+	container := restful.NewContainer()
+	register := func(path string) *restful.WebService {
+		ws := new(restful.WebService)
+		ws.Path(path).Produces(restful.MIME_JSON)
+		return ws
+	}
+	for _, ws := range newMetaRouter(services).router(register, nil) {
+		container.Add(ws)
+	}
+	ok := func(req *restful.Request, resp *restful.Response) { resp.WriteHeader(http.StatusOK) }
+	for path, capability := range map[string]model.Capability{
+		"/k8s":       model.CapabilityKubernetes,
+		"/pipelines": model.CapabilityPipeline,
+	} {
+		ws := register(path)
+		ws.Route(ws.GET("").To(ok).Filter(requireCapability(services, capability)))
+		container.Add(ws)
+	}
+	return container
+}
+
+func serve(container *restful.Container, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestUnconfiguredSubsystemsAnswerUnavailable(t *testing.T) {
+	// no optional dependency is wired
+	container := newCapabilityContainer(&service.Services{})
+
+	for path, subsystem := range map[string]model.Capability{
+		"/k8s":       model.CapabilityKubernetes,
+		"/pipelines": model.CapabilityPipeline,
+	} {
+		rec := serve(container, http.MethodGet, path)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET %s = %d, want 503", path, rec.Code)
+			continue
+		}
+		var body errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != errorCodeFeatureUnavailable || body.Subsystem != subsystem {
+			t.Errorf("GET %s = %+v, want code %s for %s", path, body, errorCodeFeatureUnavailable, subsystem)
+		}
+	}
+
+	rec := serve(container, http.MethodGet, "/meta/capabilities")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /meta/capabilities = %d", rec.Code)
+	}
+	var capabilities model.Capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	if len(capabilities.Enabled) != 0 || len(capabilities.Disabled) != len(model.CapabilityOrder) {
+		t.Errorf("capabilities = %+v, want every subsystem disabled", capabilities)
+	}
+}
+
+func TestConfiguredPipelineIsServed(t *testing.T) {
+	db := storetest.Open(t, &model.Pipeline{})
+	store := cache.New(0)
+	t.Cleanup(store.Close)
+	container := newCapabilityContainer(&service.Services{Pipeline: pipelineService.NewService(db, queue.New(1), store)})
+
+	if rec := serve(container, http.MethodGet, "/pipelines"); rec.Code != http.StatusOK {
+		t.Errorf("GET /pipelines = %d, want 200", rec.Code)
+	}
+	if rec := serve(container, http.MethodGet, "/k8s"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /k8s = %d, want 503", rec.Code)
+	}
+	var capabilities model.Capabilities
+	_ = json.Unmarshal(serve(container, http.MethodGet, "/meta/capabilities").Body.Bytes(), &capabilities)
+	if !capabilities.Features[model.CapabilityPipeline] || capabilities.Features[model.CapabilityKubernetes] {
+		t.Errorf("features = %v, want only the pipeline enabled", capabilities.Features)
+	}
+}
+
+func TestWriteErrorFeatureStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{model.NewFeatureDisabledError(model.CapabilityArchival, "archival disabled"), http.StatusNotImplemented},
+		{model.NewFeatureUnavailableError(model.CapabilityPipeline, "pipeline queue not configured"), http.StatusServiceUnavailable},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		resp := restful.NewResponse(rec)
+		resp.SetRequestAccepts(restful.MIME_JSON)
+		writeError(resp, http.StatusInternalServerError, tc.err)
+		if rec.Code != tc.want {
+			t.Errorf("writeError(%v) = %d, want %d", tc.err, rec.Code, tc.want)
+		}
+	}
+}
@@ -14,19 +14,33 @@ type Routers struct {
 	auth     *authRouter
 	repos    *repoRouter
 	system   *systemRouter
+	meta     *metaRouter
 	k8s      *k8sRouter
+	pipeline *pipelineAdminRouter
+	agents   *agentRouter
+	webhooks *webhookRouter
+	audit    *auditRouter
+	events   *eventsRouter
+	public   *publicStatusRouter
 	services *service.Services
 	cfg      *config.Config
 }
 
 func NewRouters(cfg *config.Config, services *service.Services, authMW *authmw.Middleware) *Routers {
 	return &Routers{
-		health:   &health{},
+		health:   newHealth(cfg, services, authMW),
 		web:      &webHandler{},
 		auth:     newAuthRouter(services, authMW),
 		repos:    newRepoRouter(services, authMW),
-		k8s:      newK8sRouter(services, authMW),
+		k8s:      newK8sRouter(services, authMW, newWebsocketHub(cfg)),
+		pipeline: newPipelineAdminRouter(services, authMW),
+		agents:   newAgentRouter(services, authMW),
+		webhooks: newWebhookRouter(services),
+		audit:    newAuditRouter(services, authMW),
+		events:   newEventsRouter(services, authMW, newWebsocketHub(cfg)),
+		public:   newPublicStatusRouter(cfg, services),
 		system:   newSystemRouter(services, authMW),
+		meta:     newMetaRouter(services),
 		services: services,
 		cfg:      cfg,
 	}
@@ -40,6 +54,8 @@ func (r *Routers) Router(register func(string) *restful.WebService) []*restful.W
 		ws = append(ws, r.health.router(register, sysTags)...)
 		ws = append(ws, r.web.router(register, sysTags)...)
 		ws = append(ws, r.system.router(register, sysTags)...)
+		ws = append(ws, r.meta.router(register, sysTags)...)
+		ws = append(ws, r.audit.router(register, sysTags)...)
 	}
 
 	{
@@ -50,6 +66,13 @@ func (r *Routers) Router(register func(string) *restful.WebService) []*restful.W
 	{
 		repoTags := []string{"仓库"}
 		ws = append(ws, r.repos.router(register, repoTags)...)
+		ws = append(ws, r.events.router(register, repoTags)...)
+		ws = append(ws, r.public.router(register, repoTags)...)
+	}
+
+	{
+		hookTags := []string{"Webhook"}
+		ws = append(ws, r.webhooks.router(register, hookTags)...)
 	}
 
 	{
@@ -57,5 +80,11 @@ func (r *Routers) Router(register func(string) *restful.WebService) []*restful.W
 		ws = append(ws, r.k8s.router(register, adminTags)...)
 	}
 
+	{
+		pipelineTags := []string{"流水线管理"}
+		ws = append(ws, r.pipeline.router(register, pipelineTags)...)
+		ws = append(ws, r.agents.router(register, pipelineTags)...)
+	}
+
 	return ws
 }
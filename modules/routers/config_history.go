@@ -0,0 +1,128 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+type pipelineConfigHistoryResponse struct {
+	Items   []pipelinesvc.PipelineConfigRevision `json:"items"`
+	Page    int                                  `json:"page"`
+	PerPage int                                  `json:"per_page"`
+	Total   int64                                `json:"total"`
+}
+
+func (r *repoRouter) registerConfigHistoryRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/config/history").To(r.listPipelineConfigHistory).
+		Doc("List saved pipeline config revisions, newest first, each with the content of the revision before it").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.QueryParameter("page", "page number").DataType("integer")).
+		Param(ws.QueryParameter("per_page", "page size, at most 100").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Writes(pipelineConfigHistoryResponse{}).
+		Returns(http.StatusOK, "revisions", pipelineConfigHistoryResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/config/revert/{revision_id}").To(r.revertPipelineConfig).
+		Doc("Restore the content of a config revision, saved as a new revision").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.PathParameter("revision_id", "revision id").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "config", pipelineConfigResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "revision not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) listPipelineConfigHistory(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	page, _ := strconv.Atoi(req.QueryParameter("page"))
+	perPage, _ := strconv.Atoi(req.QueryParameter("per_page"))
+
+	items, total, err := r.services.Pipeline.ListPipelineConfigRevisions(req.Request.Context(), repo.ID, page, perPage)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineConfigHistoryResponse{
+		Items:   items,
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	})
+}
+
+func (r *repoRouter) revertPipelineConfig(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+	revisionID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("revision_id")), 10, 64)
+	if err != nil || revisionID <= 0 {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid revision id"))
+		return
+	}
+
+	cfg, err := r.services.Pipeline.RevertPipelineConfig(req.Request.Context(), repo.ID, revisionID, claims.Login)
+	if err != nil {
+		if errors.Is(err, pipelinesvc.ErrConfigRevisionNotFound) {
+			writeError(resp, http.StatusNotFound, err)
+			return
+		}
+		writePipelineConfigError(resp, err)
+		return
+	}
+
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineConfigResponse{
+		Content:   cfg.Content,
+		UpdatedAt: cfg.Updated,
+		Warnings:  pipelinesvc.PipelineConfigWarnings(cfg.Content, nil),
+		Version:   cfg.Version,
+	})
+}
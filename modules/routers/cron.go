@@ -0,0 +1,119 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+type pipelineCronRunRequest struct {
+	Expression string `json:"expression"`
+}
+
+func (r *repoRouter) registerCronRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/cron").To(r.listPipelineCron).
+		Doc("List the repository's cron expressions with their validity or parse error, last trigger and next run (unix seconds)").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]pipelinesvc.CronSchedule{}).
+		Returns(http.StatusOK, "schedules", []pipelinesvc.CronSchedule{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/cron/run").To(r.runPipelineCron).
+		Doc("Fire the pipeline of a configured cron expression now").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(authmw.TokenScope, model.APITokenScopePipelineTrigger).
+		Metadata(repoRoleMetadata, model.RepoRoleDeveloper).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(pipelineCronRunRequest{}).
+		Returns(http.StatusOK, "pipeline", pipelineRunResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "cron expression not configured", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) listPipelineCron(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	schedules, err := r.services.Pipeline.ListCronSchedules(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, schedules)
+}
+
+func (r *repoRouter) runPipelineCron(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	var body pipelineCronRunRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(body.Expression) == "" {
+		writeError(resp, http.StatusBadRequest, errors.New("expression is required"))
+		return
+	}
+
+	pipeline, err := r.services.Pipeline.TriggerCronSchedule(req.Request.Context(), repo, body.Expression, claims.Login)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, pipelinesvc.ErrCronScheduleNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(resp, status, err)
+		return
+	}
+
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineRunResponse{
+		ID:       pipeline.ID,
+		Number:   pipeline.Number,
+		Status:   pipeline.Status,
+		Branch:   pipeline.Branch,
+		Ref:      pipeline.Ref,
+		Created:  pipeline.Created,
+		Finished: pipeline.Finished,
+		Message:  pipeline.Message,
+		Author:   pipeline.Author,
+		Commit:   pipeline.Commit,
+
+		ConfigHash:    pipeline.ConfigHash,
+		ConfigVersion: pipeline.ConfigVersion,
+	})
+}
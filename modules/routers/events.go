@@ -0,0 +1,184 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+)
+
+// eventAccessTTL is how long the repository access of a connection is trusted before it is
+// checked again, so removed members stop receiving events.
+const eventAccessTTL = time.Minute
+
+type eventsRouter struct {
+	services   *service.Services
+	authMW     *authmw.Middleware
+	websockets *websocketHub
+}
+
+func newEventsRouter(services *service.Services, authMW *authmw.Middleware, websockets *websocketHub) *eventsRouter {
+	return &eventsRouter{services: services, authMW: authMW, websockets: websockets}
+}
+
+func (r *eventsRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	if r.services == nil || r.services.Pipeline == nil {
+		return nil
+	}
+
+	ws := register("/ws")
+	ws.Filter(r.authMW.Authenticate)
+
+	ws.Route(ws.GET("/events").To(r.streamEvents).
+		Doc("Stream pipeline, step and approval events of the accessible repositories via websocket").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Param(ws.QueryParameter("after", "id of the last event received; missed events are sent first").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusSwitchingProtocols, "stream", model.PipelineEvent{}).
+		Returns(http.StatusBadRequest, "invalid cursor", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}))
+
+	return []*restful.WebService{ws}
+}
+
+// streamEvents sends every event as a JSON message. When the missed events of the cursor are
+// no longer kept a {"type":"resync"} message comes first and the client should reload. A
+// client that falls too far behind is disconnected with CloseTryAgainLater.
+func (r *eventsRouter) streamEvents(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	var after int64
+	if raw := strings.TrimSpace(req.QueryParameter("after")); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid after"))
+			return
+		}
+		after = parsed
+	}
+	user, err := r.services.User.FindByID(req.Request.Context(), claims.UserID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	conn, err := r.websockets.Upgrade(resp.ResponseWriter, req.Request)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Request.Context())
+	defer cancel()
+	// clients only listen; reading notices when they go away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sub, missed, complete := r.services.Pipeline.SubscribeEvents(after)
+	defer sub.Close()
+
+	access := newRepoEventAccess(r.services, user)
+	send := func(event model.PipelineEvent) error {
+		if !access.allowed(ctx, event.RepoID) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	if !complete {
+		data, _ := json.Marshal(map[string]string{"type": "resync"})
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return
+		}
+	}
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				if sub.Slow() {
+					conn.CloseWith(websocket.CloseTryAgainLater, "client too slow, reconnect with after")
+				}
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// repoEventAccess remembers which repositories the user of a connection may see.
+type repoEventAccess struct {
+	services *service.Services
+	user     *model.User
+	repos    map[int64]repoEventAccessEntry
+}
+
+type repoEventAccessEntry struct {
+	allowed bool
+	checked time.Time
+}
+
+func newRepoEventAccess(services *service.Services, user *model.User) *repoEventAccess {
+	return &repoEventAccess{services: services, user: user, repos: make(map[int64]repoEventAccessEntry)}
+}
+
+// allowed reports whether the user holds any role on the repository. Lookup failures deny
+// until the next check.
+func (a *repoEventAccess) allowed(ctx context.Context, repoID int64) bool {
+	if a.user.Admin {
+		return true
+	}
+	if entry, ok := a.repos[repoID]; ok && time.Since(entry.checked) < eventAccessTTL {
+		return entry.allowed
+	}
+	allowed := false
+	repo, err := a.services.Repo.FindByID(ctx, repoID)
+	if err == nil && repo != nil {
+		var role model.RepoRole
+		role, err = a.services.Repo.Role(ctx, repo, a.user)
+		allowed = err == nil && role != ""
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Warn().Err(err).Int64("repo_id", repoID).Msg("failed to check repository access for events")
+	}
+	a.repos[repoID] = repoEventAccessEntry{allowed: allowed, checked: time.Now()}
+	return allowed
+}
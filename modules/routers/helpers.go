@@ -1,13 +1,56 @@
 package routers
 
 import (
+	"errors"
+	"net/http"
+
 	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
 )
 
+const errorCodeFeatureUnavailable = "feature_unavailable"
+
 type errorResponse struct {
-	Error string `json:"error"`
+	Error     string           `json:"error"`
+	Code      string           `json:"code,omitempty"`
+	Subsystem model.Capability `json:"subsystem,omitempty"`
 }
 
 func writeError(resp *restful.Response, status int, err error) {
+	var unavailable *model.FeatureUnavailableError
+	if errors.As(err, &unavailable) {
+		writeFeatureUnavailable(resp, unavailable)
+		return
+	}
 	_ = resp.WriteHeaderAndEntity(status, errorResponse{Error: err.Error()})
 }
+
+// writeFeatureUnavailable answers 501 for subsystems disabled by configuration and
+// 503 for subsystems whose runtime dependencies are missing.
+func writeFeatureUnavailable(resp *restful.Response, err *model.FeatureUnavailableError) {
+	status := http.StatusServiceUnavailable
+	if err.Disabled {
+		status = http.StatusNotImplemented
+	}
+	_ = resp.WriteHeaderAndEntity(status, errorResponse{
+		Error:     err.Error(),
+		Code:      errorCodeFeatureUnavailable,
+		Subsystem: err.Subsystem,
+	})
+}
+
+// requireCapability returns a filter rejecting requests while the given subsystem is unavailable.
+func requireCapability(services *service.Services, capability model.Capability) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if !services.Capabilities().Features[capability] {
+			writeFeatureUnavailable(resp, &model.FeatureUnavailableError{
+				Subsystem: capability,
+				Reason:    "subsystem not configured",
+			})
+			return
+		}
+		chain.ProcessFilter(req, resp)
+	}
+}
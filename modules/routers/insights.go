@@ -0,0 +1,131 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+func (r *repoRouter) registerInsightRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/insights/step-durations").To(r.listStepDurationBaselines).
+		Doc("List the duration baselines (p50/p90 in seconds over recent successful runs) of the repository's steps").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]*pipelinesvc.StepDurationBaseline{}).
+		Returns(http.StatusOK, "baselines", []*pipelinesvc.StepDurationBaseline{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/stats").To(r.pipelineStats).
+		Doc("Aggregate the repository's runs over a time window: per-step success rate, durations and failure streaks, outcomes by branch and event, and a daily trend").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("since", "window start as unix seconds, RFC 3339 or YYYY-MM-DD; defaults to 30 days before until").DataType("string")).
+		Param(ws.QueryParameter("until", "window end as unix seconds, RFC 3339 or YYYY-MM-DD; defaults to now").DataType("string")).
+		Param(ws.QueryParameter("branch", "only count runs of this branch").DataType("string")).
+		Param(ws.QueryParameter("step", "count the outcomes of this step in the groups and the trend").DataType("string")).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes(pipelinesvc.PipelineStats{}).
+		Returns(http.StatusOK, "stats", pipelinesvc.PipelineStats{}).
+		Returns(http.StatusBadRequest, "invalid window", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) listStepDurationBaselines(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	baselines, err := r.services.Pipeline.StepDurationBaselines(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	items := make([]*pipelinesvc.StepDurationBaseline, 0, len(baselines))
+	for _, baseline := range baselines {
+		items = append(items, baseline)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].StepName < items[j].StepName })
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, items)
+}
+
+func (r *repoRouter) pipelineStats(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	query := pipelinesvc.PipelineStatsQuery{
+		Branch: strings.TrimSpace(req.QueryParameter("branch")),
+		Step:   strings.TrimSpace(req.QueryParameter("step")),
+	}
+	if query.Since, err = parseStatsTime(req.QueryParameter("since")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+		return
+	}
+	if query.Until, err = parseStatsTime(req.QueryParameter("until")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid until: %w", err))
+		return
+	}
+
+	stats, err := r.services.Pipeline.PipelineStats(req.Request.Context(), repo.ID, query)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, pipelinesvc.ErrInvalidStatsQuery) {
+			status = http.StatusBadRequest
+		}
+		writeError(resp, status, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, stats)
+}
+
+// parseStatsTime reads unix seconds, an RFC 3339 time or a UTC date; empty is 0.
+func parseStatsTime(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, errors.New("expected unix seconds, RFC 3339 or YYYY-MM-DD")
+	}
+	return t.Unix(), nil
+}
@@ -3,13 +3,12 @@ package routers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 
 	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
@@ -18,77 +17,97 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 
 	"github.com/thepenn/devsys/model"
-	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
 	authmw "github.com/thepenn/devsys/routers/middleware/auth"
 	"github.com/thepenn/devsys/service"
+	k8ssvc "github.com/thepenn/devsys/service/k8s"
 )
 
-var wsUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
 type k8sRouter struct {
-	services *service.Services
-	authMW   *authmw.Middleware
+	services   *service.Services
+	authMW     *authmw.Middleware
+	websockets *websocketHub
 }
 
-func newK8sRouter(services *service.Services, authMW *authmw.Middleware) *k8sRouter {
-	return &k8sRouter{services: services, authMW: authMW}
+func newK8sRouter(services *service.Services, authMW *authmw.Middleware, websockets *websocketHub) *k8sRouter {
+	return &k8sRouter{services: services, authMW: authMW, websockets: websockets}
 }
 
 func (r *k8sRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
 	ws := register("/admin/k8s")
 	ws.Filter(r.authMW.Authenticate)
+	ws.Filter(requireCapability(r.services, model.CapabilityKubernetes))
 
 	ws.Route(ws.GET("/clusters").To(r.listClusters).
 		Doc("List kubernetes clusters").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("with_health", "include the last known health of each cluster").DataType("boolean")).
 		Writes([]model.KubernetesClusterSummary{}).
 		Returns(http.StatusOK, "clusters", []model.KubernetesClusterSummary{}))
 
+	ws.Route(ws.GET("/clusters/{cluster_id}/health").To(r.clusterHealth).
+		Doc("Check connectivity to a cluster").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes(model.KubernetesClusterHealth{}).
+		Returns(http.StatusOK, "health", model.KubernetesClusterHealth{}).
+		Returns(http.StatusNotFound, "cluster not found", errorResponse{}))
+
 	ws.Route(ws.GET("/clusters/{cluster_id}/namespaces").To(r.listNamespaces).
 		Doc("List namespaces for a cluster").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes([]model.KubernetesNamespace{}).
 		Returns(http.StatusOK, "namespaces", []model.KubernetesNamespace{}))
 
+	ws.Route(ws.GET("/clusters/{cluster_id}/api-resources").To(r.listAPIResources).
+		Doc("List the resources a cluster serves, CRDs included, grouped by API group").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes(model.KubernetesAPIResourceCatalog{}).
+		Returns(http.StatusOK, "api resources", model.KubernetesAPIResourceCatalog{}).
+		Returns(http.StatusNotFound, "cluster not found", errorResponse{}))
+
 	ws.Route(ws.GET("/clusters/{cluster_id}/resources").To(r.listResources).
 		Doc("List resources for a cluster").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("kind", "kind to list when resource is not set, resolved through discovery").DataType("string")).
 		Writes([]map[string]interface{}{}).
 		Returns(http.StatusOK, "resources", []map[string]interface{}{}))
 
+	ws.Route(ws.GET("/clusters/{cluster_id}/resources/watch").To(r.watchResources).
+		Doc("Stream a resource list and its changes via websocket").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusSwitchingProtocols, "stream", model.KubernetesWatchEvent{}))
+
 	ws.Route(ws.GET("/clusters/{cluster_id}/resources/object").To(r.getResource).
 		Doc("Get single resource").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes(model.KubernetesObjectResponse{}).
 		Returns(http.StatusOK, "resource", model.KubernetesObjectResponse{}))
 
 	ws.Route(ws.POST("/clusters/{cluster_id}/resources/apply").To(r.applyManifest).
-		Doc("Apply manifest").
+		Doc("Apply a single or multi-document manifest, optionally as a server-side dry run").
 		Filter(r.authMW.RequireAuth).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
 		Reads(model.KubernetesManifestRequest{}).
-		Writes(model.KubernetesObjectResponse{}).
-		Returns(http.StatusOK, "resource", model.KubernetesObjectResponse{}))
+		Writes(model.KubernetesApplyResult{}).
+		Returns(http.StatusOK, "applied documents", model.KubernetesApplyResult{}).
+		Returns(http.StatusBadRequest, "invalid manifest", applyManifestErrorResponse{}))
 
 	ws.Route(ws.DELETE("/clusters/{cluster_id}/resources/object").To(r.deleteResource).
 		Doc("Delete resource").
 		Filter(r.authMW.RequireAuth).
 		Consumes(restful.MIME_JSON).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
 		Reads(model.KubernetesResourceDeleteRequest{}).
 		Returns(http.StatusNoContent, "deleted", nil))
 
@@ -96,7 +115,6 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Aggregate deployment with related resources").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes([]model.KubernetesObjectResponse{}).
 		Returns(http.StatusOK, "aggregate", []model.KubernetesObjectResponse{}))
 
@@ -104,7 +122,6 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("List pods for deployment").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes([]model.KubernetesPodSummary{}).
 		Returns(http.StatusOK, "pods", []model.KubernetesPodSummary{}))
 
@@ -112,7 +129,6 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("List pods for a workload").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes([]model.KubernetesPodRow{}).
 		Returns(http.StatusOK, "pods", []model.KubernetesPodRow{}))
 
@@ -120,7 +136,6 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Get workload related resources").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes(model.KubernetesWorkloadDetails{}).
 		Returns(http.StatusOK, "details", model.KubernetesWorkloadDetails{}))
 
@@ -128,24 +143,61 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Get workload history").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes([]model.KubernetesWorkloadHistoryEntry{}).
 		Returns(http.StatusOK, "history", []model.KubernetesWorkloadHistoryEntry{}))
 
+	ws.Route(ws.GET("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/metrics").To(r.workloadMetrics).
+		Doc("Get the current CPU and memory usage of the pods of a workload").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes(model.KubernetesWorkloadMetrics{}).
+		Returns(http.StatusOK, "metrics", model.KubernetesWorkloadMetrics{}))
+
 	ws.Route(ws.POST("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/rollback").To(r.workloadRollback).
 		Doc("Rollback workload to revision").
 		Filter(r.authMW.RequireAuth).
 		Consumes(restful.MIME_JSON).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
 		Reads(model.KubernetesWorkloadRollbackRequest{}).
 		Returns(http.StatusNoContent, "rolled back", nil))
 
+	ws.Route(ws.POST("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/restart").To(r.workloadRestart).
+		Doc("Restart the pods of a workload with a rolling update").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Writes(model.KubernetesWorkloadOverview{}).
+		Returns(http.StatusOK, "overview", model.KubernetesWorkloadOverview{}).
+		Returns(http.StatusBadRequest, "unsupported kind", errorResponse{}))
+
+	ws.Route(ws.POST("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/scale").To(r.workloadScale).
+		Doc("Set the replica count of a deployment or statefulset").
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Reads(model.KubernetesWorkloadScaleRequest{}).
+		Writes(model.KubernetesWorkloadOverview{}).
+		Returns(http.StatusOK, "overview", model.KubernetesWorkloadOverview{}).
+		Returns(http.StatusBadRequest, "invalid replicas or unsupported kind", errorResponse{}))
+
+	ws.Route(ws.POST("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/image").To(r.workloadImage).
+		Doc("Point one container of a workload at another image").
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Reads(model.KubernetesWorkloadImageRequest{}).
+		Writes(model.KubernetesWorkloadImageUpdate{}).
+		Returns(http.StatusOK, "updated", model.KubernetesWorkloadImageUpdate{}).
+		Returns(http.StatusBadRequest, "invalid image, unknown container or unsupported kind", errorResponse{}))
+
 	ws.Route(ws.GET("/clusters/{cluster_id}/workloads/{kind}/{namespace}/{name}/logs").To(r.workloadLogs).
 		Doc("Aggregate logs for workload").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessExec).
 		Writes(model.KubernetesLogResponse{}).
 		Returns(http.StatusOK, "logs", model.KubernetesLogResponse{}))
 
@@ -153,7 +205,6 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("List events for resource").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
 		Writes(model.KubernetesEventPage{}).
 		Returns(http.StatusOK, "events", model.KubernetesEventPage{}))
 
@@ -161,7 +212,7 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Fetch pod logs").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessExec).
 		Writes(model.KubernetesLogResponse{}).
 		Returns(http.StatusOK, "logs", model.KubernetesLogResponse{}))
 
@@ -171,7 +222,7 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessExec).
 		Reads(model.KubernetesPodExecRequest{}).
 		Writes(model.KubernetesPodExecResult{}).
 		Returns(http.StatusOK, "output", model.KubernetesPodExecResult{}))
@@ -180,7 +231,7 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Websocket interactive exec").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessExec).
 		Produces(restful.MIME_OCTET).
 		Returns(http.StatusSwitchingProtocols, "stream", nil))
 
@@ -188,35 +239,113 @@ func (r *k8sRouter) router(register func(string) *restful.WebService, tags []str
 		Doc("Stream pod logs via websocket").
 		Filter(r.authMW.RequireAuth).
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Metadata(adminmw.AdminEnable, true).
+		Metadata(clusterAccessMetadata, model.ClusterAccessExec).
 		Produces(restful.MIME_OCTET).
 		Returns(http.StatusSwitchingProtocols, "stream", nil))
 
+	r.registerPermissionRoutes(ws, tags)
+	r.registerHelmRoutes(ws, tags)
+	r.registerExecSessionRoutes(ws, tags)
+	r.registerDataRoutes(ws, tags)
+	r.registerNodeRoutes(ws, tags)
+
 	return []*restful.WebService{ws}
 }
 
 func (r *k8sRouter) listClusters(req *restful.Request, resp *restful.Response) {
+	user, ok := r.k8sCaller(req, resp)
+	if !ok {
+		return
+	}
 	list, err := r.services.K8s.ListClusters(req.Request.Context())
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
+	if !r.isClusterAdmin(user) {
+		perms, err := r.services.K8s.ListPermissions(req.Request.Context(), k8ssvc.ClusterPermissionFilter{UserID: user.ID})
+		if err != nil {
+			writeError(resp, k8sErrorStatus(err), err)
+			return
+		}
+		granted := make(map[int64]bool, len(perms))
+		for _, perm := range perms {
+			granted[perm.ClusterID] = true
+		}
+		visible := list[:0]
+		for _, cluster := range list {
+			if granted[cluster.ID] {
+				visible = append(visible, cluster)
+			}
+		}
+		list = visible
+	}
+	if withHealth, _ := strconv.ParseBool(req.QueryParameter("with_health")); withHealth {
+		for i := range list {
+			list[i].Health = r.services.K8s.LastHealth(list[i].ID)
+		}
+	}
 	_ = resp.WriteEntity(list)
 }
 
+func (r *k8sRouter) clusterHealth(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if _, ok := r.clusterPermission(req, resp, clusterID); !ok {
+		return
+	}
+	health, err := r.services.K8s.TestCluster(req.Request.Context(), clusterID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(health)
+}
+
 func (r *k8sRouter) listNamespaces(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
 		return
 	}
+	perm, ok := r.clusterPermission(req, resp, clusterID)
+	if !ok {
+		return
+	}
 	list, err := r.services.K8s.ListNamespaces(req.Request.Context(), clusterID)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
+	if perm != nil && len(perm.Namespaces) > 0 {
+		permitted := list[:0]
+		for _, ns := range list {
+			if perm.AllowsNamespace(ns.Name) {
+				permitted = append(permitted, ns)
+			}
+		}
+		list = permitted
+	}
 	_ = resp.WriteEntity(list)
 }
 
+func (r *k8sRouter) listAPIResources(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if _, ok := r.clusterPermission(req, resp, clusterID); !ok {
+		return
+	}
+	catalog, err := r.services.K8s.ListAPIResources(req.Request.Context(), clusterID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(catalog)
+}
+
 func (r *k8sRouter) listResources(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
@@ -226,22 +355,78 @@ func (r *k8sRouter) listResources(req *restful.Request, resp *restful.Response)
 		Group:         req.QueryParameter("group"),
 		Version:       req.QueryParameter("version"),
 		Resource:      req.QueryParameter("resource"),
+		Kind:          req.QueryParameter("kind"),
 		Namespace:     req.QueryParameter("namespace"),
 		LabelSelector: req.QueryParameter("labelSelector"),
 		FieldSelector: req.QueryParameter("fieldSelector"),
 	}
-	if strings.TrimSpace(query.Resource) == "" {
-		writeError(resp, http.StatusBadRequest, fmt.Errorf("resource is required"))
+	if strings.TrimSpace(query.Resource) == "" && strings.TrimSpace(query.Kind) == "" {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("resource or kind is required"))
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, query.Namespace) {
 		return
 	}
 	list, err := r.services.K8s.ListResources(req.Request.Context(), clusterID, query)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(list)
 }
 
+func (r *k8sRouter) watchResources(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	query := model.KubernetesResourceQuery{
+		Group:         req.QueryParameter("group"),
+		Version:       req.QueryParameter("version"),
+		Resource:      req.QueryParameter("resource"),
+		Kind:          req.QueryParameter("kind"),
+		Namespace:     req.QueryParameter("namespace"),
+		LabelSelector: req.QueryParameter("labelSelector"),
+		FieldSelector: req.QueryParameter("fieldSelector"),
+	}
+	if strings.TrimSpace(query.Resource) == "" && strings.TrimSpace(query.Kind) == "" {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("resource or kind is required"))
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, query.Namespace) {
+		return
+	}
+	conn, err := r.websockets.Upgrade(resp.ResponseWriter, req.Request)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Request.Context())
+	defer cancel()
+	// clients only listen; reading notices when they go away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = r.services.K8s.WatchResources(ctx, clusterID, query, func(event model.KubernetesWatchEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	})
+	if err != nil && ctx.Err() == nil {
+		data, _ := json.Marshal(map[string]string{"type": "ERROR", "error": err.Error()})
+		_ = conn.WriteMessage(websocket.TextMessage, data)
+	}
+}
+
 func (r *k8sRouter) getResource(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
@@ -251,16 +436,20 @@ func (r *k8sRouter) getResource(req *restful.Request, resp *restful.Response) {
 		Group:     req.QueryParameter("group"),
 		Version:   req.QueryParameter("version"),
 		Resource:  req.QueryParameter("resource"),
+		Kind:      req.QueryParameter("kind"),
 		Namespace: req.QueryParameter("namespace"),
 		Name:      req.QueryParameter("name"),
 	}
+	if !r.authorizeCluster(req, resp, clusterID, query.Namespace) {
+		return
+	}
 	result, err := r.services.K8s.GetResource(req.Request.Context(), clusterID, query)
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			writeError(resp, http.StatusNotFound, err)
 			return
 		}
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(result)
@@ -271,19 +460,46 @@ func (r *k8sRouter) applyManifest(req *restful.Request, resp *restful.Response)
 	if !ok {
 		return
 	}
+	perm, ok := r.clusterPermission(req, resp, clusterID)
+	if !ok {
+		return
+	}
 	var body model.KubernetesManifestRequest
 	if err := req.ReadEntity(&body); err != nil {
 		writeError(resp, http.StatusBadRequest, err)
 		return
 	}
-	result, err := r.services.K8s.ApplyManifest(req.Request.Context(), clusterID, body)
+	ctx := req.Request.Context()
+	if perm != nil {
+		ctx = k8ssvc.WithNamespaceGuard(ctx, func(namespace string) error {
+			if !perm.AllowsNamespace(namespace) {
+				return namespaceForbidden(namespace)
+			}
+			return nil
+		})
+	}
+	result, err := r.services.K8s.ApplyManifest(ctx, clusterID, body)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		if result != nil {
+			_ = resp.WriteHeaderAndEntity(k8sErrorStatus(err), applyManifestErrorResponse{
+				errorResponse: errorResponse{Error: err.Error()},
+				Documents:     result.Documents,
+			})
+			return
+		}
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(result)
 }
 
+// applyManifestErrorResponse lists the documents handled before a manifest apply failed; the
+// last entry is the failed document.
+type applyManifestErrorResponse struct {
+	errorResponse
+	Documents []model.KubernetesAppliedDocument `json:"documents"`
+}
+
 func (r *k8sRouter) deleteResource(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
@@ -294,8 +510,11 @@ func (r *k8sRouter) deleteResource(req *restful.Request, resp *restful.Response)
 		writeError(resp, http.StatusBadRequest, err)
 		return
 	}
+	if !r.authorizeCluster(req, resp, clusterID, body.Namespace) {
+		return
+	}
 	if err := r.services.K8s.DeleteResource(req.Request.Context(), clusterID, body); err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	resp.WriteHeader(http.StatusNoContent)
@@ -308,9 +527,12 @@ func (r *k8sRouter) aggregateDeployment(req *restful.Request, resp *restful.Resp
 	}
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	result, err := r.services.K8s.AggregateDeployment(req.Request.Context(), clusterID, namespace, name)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(result)
@@ -323,9 +545,12 @@ func (r *k8sRouter) listDeploymentPods(req *restful.Request, resp *restful.Respo
 	}
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	list, err := r.services.K8s.ListDeploymentPods(req.Request.Context(), clusterID, namespace, name)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(list)
@@ -339,13 +564,16 @@ func (r *k8sRouter) listWorkloadPods(req *restful.Request, resp *restful.Respons
 	kind := req.PathParameter("kind")
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	if strings.TrimSpace(kind) == "" {
 		writeError(resp, http.StatusBadRequest, fmt.Errorf("kind is required"))
 		return
 	}
 	list, err := r.services.K8s.ListWorkloadPods(req.Request.Context(), clusterID, kind, namespace, name)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(list)
@@ -359,13 +587,16 @@ func (r *k8sRouter) workloadDetails(req *restful.Request, resp *restful.Response
 	kind := req.PathParameter("kind")
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	if strings.TrimSpace(kind) == "" {
 		writeError(resp, http.StatusBadRequest, fmt.Errorf("kind is required"))
 		return
 	}
 	details, err := r.services.K8s.WorkloadDetails(req.Request.Context(), clusterID, kind, namespace, name)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(details)
@@ -379,14 +610,36 @@ func (r *k8sRouter) workloadHistory(req *restful.Request, resp *restful.Response
 	kind := req.PathParameter("kind")
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	history, err := r.services.K8s.WorkloadHistory(req.Request.Context(), clusterID, kind, namespace, name)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(history)
 }
 
+func (r *k8sRouter) workloadMetrics(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	kind := req.PathParameter("kind")
+	namespace := req.PathParameter("namespace")
+	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	result, err := r.services.K8s.WorkloadMetrics(req.Request.Context(), clusterID, kind, namespace, name)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(result)
+}
+
 func (r *k8sRouter) workloadRollback(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
@@ -395,6 +648,9 @@ func (r *k8sRouter) workloadRollback(req *restful.Request, resp *restful.Respons
 	kind := req.PathParameter("kind")
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	var body model.KubernetesWorkloadRollbackRequest
 	if err := req.ReadEntity(&body); err != nil {
 		writeError(resp, http.StatusBadRequest, err)
@@ -405,12 +661,87 @@ func (r *k8sRouter) workloadRollback(req *restful.Request, resp *restful.Respons
 		return
 	}
 	if err := r.services.K8s.RollbackWorkload(req.Request.Context(), clusterID, kind, namespace, name, body.Revision); err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	resp.WriteHeader(http.StatusNoContent)
 }
 
+func (r *k8sRouter) workloadRestart(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	kind := req.PathParameter("kind")
+	namespace := req.PathParameter("namespace")
+	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	overview, err := r.services.K8s.RestartWorkload(req.Request.Context(), clusterID, kind, namespace, name)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(overview)
+}
+
+func (r *k8sRouter) workloadScale(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	kind := req.PathParameter("kind")
+	namespace := req.PathParameter("namespace")
+	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	var body model.KubernetesWorkloadScaleRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if body.Replicas == nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("replicas is required"))
+		return
+	}
+	if *body.Replicas < 0 || *body.Replicas > k8ssvc.MaxWorkloadReplicas {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("replicas must be between 0 and %d", k8ssvc.MaxWorkloadReplicas))
+		return
+	}
+	overview, err := r.services.K8s.ScaleWorkload(req.Request.Context(), clusterID, kind, namespace, name, *body.Replicas)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(overview)
+}
+
+func (r *k8sRouter) workloadImage(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	kind := req.PathParameter("kind")
+	namespace := req.PathParameter("namespace")
+	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	var body model.KubernetesWorkloadImageRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	result, err := r.services.K8s.SetWorkloadImage(req.Request.Context(), clusterID, kind, namespace, name, body.Container, body.Image, body.RecordPrevious)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(result)
+}
+
 func (r *k8sRouter) workloadLogs(req *restful.Request, resp *restful.Response) {
 	clusterID, ok := parseClusterID(req, resp)
 	if !ok {
@@ -419,6 +750,9 @@ func (r *k8sRouter) workloadLogs(req *restful.Request, resp *restful.Response) {
 	kind := req.PathParameter("kind")
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	labelSelector := req.QueryParameter("labelSelector")
 	allContainers := parseBoolQuery(req.QueryParameter("allContainers"))
 	var tailLines int64
@@ -438,7 +772,7 @@ func (r *k8sRouter) workloadLogs(req *restful.Request, resp *restful.Response) {
 	}
 	content, err := r.services.K8s.AggregateWorkloadLogs(req.Request.Context(), clusterID, kind, namespace, name, labelSelector, containerList, allContainers, tailLines)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(model.KubernetesLogResponse{Content: content})
@@ -463,12 +797,15 @@ func (r *k8sRouter) listEvents(req *restful.Request, resp *restful.Response) {
 	name := req.QueryParameter("name")
 	page, _ := strconv.Atoi(req.QueryParameter("page"))
 	perPage, _ := strconv.Atoi(req.QueryParameter("perPage"))
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	items, total, err := r.services.K8s.ListEvents(req.Request.Context(), clusterID, namespace, kind, name, model.ListOptions{
 		Page:    page,
 		PerPage: perPage,
 	})
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	response := model.KubernetesEventPage{
@@ -494,9 +831,12 @@ func (r *k8sRouter) podLogs(req *restful.Request, resp *restful.Response) {
 			tailLines = parsed
 		}
 	}
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	logs, err := r.services.K8s.PodLogs(req.Request.Context(), clusterID, namespace, pod, container, tailLines)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(model.KubernetesLogResponse{Content: logs})
@@ -520,9 +860,12 @@ func (r *k8sRouter) execPod(req *restful.Request, resp *restful.Response) {
 	if body.Name == "" {
 		body.Name = name
 	}
+	if !r.authorizeCluster(req, resp, clusterID, body.Namespace) {
+		return
+	}
 	result, err := r.services.K8s.ExecPod(req.Request.Context(), clusterID, body)
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		writeError(resp, k8sErrorStatus(err), err)
 		return
 	}
 	_ = resp.WriteEntity(result)
@@ -535,11 +878,14 @@ func (r *k8sRouter) execPodStream(req *restful.Request, resp *restful.Response)
 	}
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	shell := req.QueryParameter("shell")
 	if shell == "" {
 		shell = "/bin/bash"
 	}
-	conn, err := wsUpgrader.Upgrade(resp.ResponseWriter, req.Request, nil)
+	conn, err := r.websockets.Upgrade(resp.ResponseWriter, req.Request)
 	if err != nil {
 		return
 	}
@@ -565,7 +911,7 @@ func (r *k8sRouter) execPodStream(req *restful.Request, resp *restful.Response)
 	}
 }
 
-func (r *k8sRouter) handleExecInput(conn *websocket.Conn, stdin io.WriteCloser, queue *terminalSizeQueue, cancel context.CancelFunc) {
+func (r *k8sRouter) handleExecInput(conn *websocketSession, stdin io.WriteCloser, queue *terminalSizeQueue, cancel context.CancelFunc) {
 	defer func() {
 		stdin.Close()
 		queue.Close()
@@ -605,6 +951,9 @@ func (r *k8sRouter) podLogsStream(req *restful.Request, resp *restful.Response)
 	}
 	namespace := req.PathParameter("namespace")
 	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
 	container := req.QueryParameter("container")
 	var tailLines int64
 	if tail := strings.TrimSpace(req.QueryParameter("tail")); tail != "" {
@@ -612,7 +961,7 @@ func (r *k8sRouter) podLogsStream(req *restful.Request, resp *restful.Response)
 			tailLines = parsed
 		}
 	}
-	conn, err := wsUpgrader.Upgrade(resp.ResponseWriter, req.Request, nil)
+	conn, err := r.websockets.Upgrade(resp.ResponseWriter, req.Request)
 	if err != nil {
 		return
 	}
@@ -620,6 +969,15 @@ func (r *k8sRouter) podLogsStream(req *restful.Request, resp *restful.Response)
 
 	ctx, cancel := context.WithCancel(req.Request.Context())
 	defer cancel()
+	// the log stream is one-way; reading keeps pong handling alive and notices client closes
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
 
 	stream, err := r.services.K8s.StreamPodLogs(ctx, clusterID, namespace, name, container, tailLines)
 	if err != nil {
@@ -646,8 +1004,7 @@ func (r *k8sRouter) podLogsStream(req *restful.Request, resp *restful.Response)
 }
 
 type websocketJSONWriter struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
+	conn *websocketSession
 	op   string
 }
 
@@ -666,8 +1023,7 @@ type shellFrame struct {
 	Rows uint16 `json:"rows,omitempty"`
 }
 
-func writeShellFrame(conn *websocket.Conn, frame shellFrame) error {
-	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+func writeShellFrame(conn *websocketSession, frame shellFrame) error {
 	data, err := json.Marshal(frame)
 	if err != nil {
 		return err
@@ -719,3 +1075,26 @@ func parseClusterID(req *restful.Request, resp *restful.Response) (int64, bool)
 	}
 	return id, true
 }
+
+// k8sErrorStatus maps clusters outside the organization scope of the caller to 404 like
+// missing ones.
+func k8sErrorStatus(err error) int {
+	if errors.Is(err, k8ssvc.ErrNamespaceForbidden) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, k8ssvc.ErrTargetInvalid) || errors.Is(err, k8ssvc.ErrWorkloadActionInvalid) ||
+		errors.Is(err, k8ssvc.ErrManifestInvalid) || errors.Is(err, k8ssvc.ErrPermissionInvalid) ||
+		errors.Is(err, k8ssvc.ErrDataPatchInvalid) || errors.Is(err, k8ssvc.ErrNodeDrainInvalid) ||
+		errors.Is(err, k8ssvc.ErrKindInvalid) || k8serrors.IsInvalid(err) || k8serrors.IsBadRequest(err) {
+		return http.StatusBadRequest
+	}
+	if k8serrors.IsConflict(err) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, k8ssvc.ErrClusterNotFound) || errors.Is(err, k8ssvc.ErrTargetNotFound) ||
+		errors.Is(err, k8ssvc.ErrPermissionNotFound) || errors.Is(err, k8ssvc.ErrHelmReleaseNotFound) ||
+		errors.Is(err, k8ssvc.ErrExecSessionNotFound) || k8serrors.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
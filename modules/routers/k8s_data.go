@@ -0,0 +1,82 @@
+package routers
+
+import (
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (r *k8sRouter) registerDataRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.PUT("/clusters/{cluster_id}/configmaps/{namespace}/{name}/data").To(r.patchConfigMapData).
+		Doc("Set or delete ConfigMap keys and return the diff; a null value deletes the key").
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Reads(model.KubernetesDataPatchRequest{}).
+		Writes(model.KubernetesDataDiff{}).
+		Returns(http.StatusOK, "diff", model.KubernetesDataDiff{}).
+		Returns(http.StatusBadRequest, "invalid key or value", errorResponse{}).
+		Returns(http.StatusNotFound, "configmap not found", errorResponse{}).
+		Returns(http.StatusConflict, "changed concurrently", errorResponse{}))
+
+	ws.Route(ws.PUT("/clusters/{cluster_id}/secrets/{namespace}/{name}/data").To(r.patchSecretData).
+		Doc("Set or delete Secret keys and return the diff with values redacted; a null value deletes the key").
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Reads(model.KubernetesDataPatchRequest{}).
+		Writes(model.KubernetesDataDiff{}).
+		Returns(http.StatusOK, "diff", model.KubernetesDataDiff{}).
+		Returns(http.StatusBadRequest, "invalid key or value", errorResponse{}).
+		Returns(http.StatusNotFound, "secret not found", errorResponse{}).
+		Returns(http.StatusConflict, "changed concurrently", errorResponse{}))
+}
+
+func (r *k8sRouter) patchConfigMapData(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.PathParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	var body model.KubernetesDataPatchRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	diff, err := r.services.K8s.PatchConfigMapData(req.Request.Context(), clusterID, namespace, req.PathParameter("name"), body.Data, body.DryRun)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(diff)
+}
+
+func (r *k8sRouter) patchSecretData(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.PathParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	var body model.KubernetesDataPatchRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	diff, err := r.services.K8s.PatchSecretData(req.Request.Context(), clusterID, namespace, req.PathParameter("name"), body.Data, body.Base64, body.DryRun)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(diff)
+}
@@ -0,0 +1,125 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+)
+
+const asciicastMime = "application/x-asciicast"
+
+type execSessionListResponse struct {
+	Items   []*model.ExecSession `json:"items"`
+	Page    int                  `json:"page"`
+	PerPage int                  `json:"per_page"`
+	Total   int64                `json:"total"`
+}
+
+func (r *k8sRouter) registerExecSessionRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/exec-sessions").To(r.listExecSessions).
+		Doc("List recorded pod exec sessions, newest first").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("cluster_id", "only sessions on this cluster").DataType("integer")).
+		Param(ws.QueryParameter("namespace", "only sessions in this namespace").DataType("string")).
+		Param(ws.QueryParameter("pod", "only sessions into this pod").DataType("string")).
+		Param(ws.QueryParameter("user", "only sessions of this login").DataType("string")).
+		Param(ws.QueryParameter("since", "window start as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("until", "window end as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("page", "page number").DataType("integer")).
+		Param(ws.QueryParameter("per_page", "page size, at most 100").DataType("integer")).
+		Writes(execSessionListResponse{}).
+		Returns(http.StatusOK, "sessions", execSessionListResponse{}).
+		Returns(http.StatusBadRequest, "invalid filter", errorResponse{}))
+
+	ws.Route(ws.GET("/exec-sessions/{session_id}/recording").To(r.downloadExecRecording).
+		Doc("Download the asciinema recording of a pod exec session").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.PathParameter("session_id", "exec session id").DataType("integer")).
+		Produces(asciicastMime, restful.MIME_JSON).
+		Returns(http.StatusOK, "recording", nil).
+		Returns(http.StatusNotFound, "session or recording not found", errorResponse{}))
+}
+
+func (r *k8sRouter) listExecSessions(req *restful.Request, resp *restful.Response) {
+	page, _ := strconv.Atoi(req.QueryParameter("page"))
+	perPage, _ := strconv.Atoi(req.QueryParameter("per_page"))
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+
+	filter := model.ExecSessionFilter{
+		Namespace: strings.TrimSpace(req.QueryParameter("namespace")),
+		Pod:       strings.TrimSpace(req.QueryParameter("pod")),
+		User:      strings.TrimSpace(req.QueryParameter("user")),
+	}
+	if raw := strings.TrimSpace(req.QueryParameter("cluster_id")); raw != "" {
+		clusterID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || clusterID <= 0 {
+			writeError(resp, http.StatusBadRequest, errors.New("cluster_id is invalid"))
+			return
+		}
+		filter.ClusterID = clusterID
+	}
+	var err error
+	if filter.Since, err = parseStatsTime(req.QueryParameter("since")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+		return
+	}
+	if filter.Until, err = parseStatsTime(req.QueryParameter("until")); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid until: %w", err))
+		return
+	}
+
+	sessions, total, err := r.services.K8s.ListExecSessions(req.Request.Context(), model.ListOptions{Page: page, PerPage: perPage}, filter)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	if sessions == nil {
+		sessions = []*model.ExecSession{}
+	}
+	_ = resp.WriteEntity(execSessionListResponse{
+		Items:   sessions,
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	})
+}
+
+func (r *k8sRouter) downloadExecRecording(req *restful.Request, resp *restful.Response) {
+	id, err := strconv.ParseInt(req.PathParameter("session_id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("session_id is invalid"))
+		return
+	}
+	session, recording, err := r.services.K8s.OpenExecRecording(req.Request.Context(), id)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	defer recording.Close()
+
+	resp.Header().Set("Content-Type", asciicastMime)
+	resp.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(fmt.Sprintf("exec-%d.cast", session.ID)))
+	resp.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(resp, recording)
+}
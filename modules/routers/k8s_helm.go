@@ -0,0 +1,145 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (r *k8sRouter) registerHelmRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/clusters/{cluster_id}/helm/releases").To(r.listHelmReleases).
+		Doc("List the newest revision of every Helm release").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("namespace", "only releases in this namespace; all namespaces when empty")).
+		Writes([]model.KubernetesHelmRelease{}).
+		Returns(http.StatusOK, "releases", []model.KubernetesHelmRelease{}))
+
+	ws.Route(ws.GET("/clusters/{cluster_id}/helm/releases/{namespace}/{name}/history").To(r.helmReleaseHistory).
+		Doc("List the stored revisions of a Helm release").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes([]model.KubernetesHelmRelease{}).
+		Returns(http.StatusOK, "history", []model.KubernetesHelmRelease{}).
+		Returns(http.StatusNotFound, "release not found", errorResponse{}))
+
+	// values commonly carry credentials, so reading them takes the access that could change them
+	ws.Route(ws.GET("/clusters/{cluster_id}/helm/releases/{namespace}/{name}/values").To(r.helmReleaseValues).
+		Doc("Get the values of a Helm release revision").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Param(ws.QueryParameter("revision", "release revision; the newest when omitted").DataType("integer")).
+		Param(ws.QueryParameter("all", "include the chart default values").DataType("boolean")).
+		Writes(model.KubernetesHelmReleaseValues{}).
+		Returns(http.StatusOK, "values", model.KubernetesHelmReleaseValues{}).
+		Returns(http.StatusBadRequest, "invalid revision", errorResponse{}).
+		Returns(http.StatusNotFound, "release not found", errorResponse{}))
+
+	ws.Route(ws.GET("/clusters/{cluster_id}/helm/releases/{namespace}/{name}/manifest").To(r.helmReleaseManifest).
+		Doc("Get the rendered manifest of a Helm release revision").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter("revision", "release revision; the newest when omitted").DataType("integer")).
+		Writes(model.KubernetesHelmReleaseManifest{}).
+		Returns(http.StatusOK, "manifest", model.KubernetesHelmReleaseManifest{}).
+		Returns(http.StatusBadRequest, "invalid revision", errorResponse{}).
+		Returns(http.StatusNotFound, "release not found", errorResponse{}))
+}
+
+func (r *k8sRouter) listHelmReleases(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.QueryParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	releases, err := r.services.K8s.ListReleases(req.Request.Context(), clusterID, namespace)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(releases)
+}
+
+func (r *k8sRouter) helmReleaseHistory(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.PathParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	history, err := r.services.K8s.ReleaseHistory(req.Request.Context(), clusterID, namespace, req.PathParameter("name"))
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(history)
+}
+
+func (r *k8sRouter) helmReleaseValues(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	revision, ok := parseHelmRevision(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.PathParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	all, _ := strconv.ParseBool(req.QueryParameter("all"))
+	values, err := r.services.K8s.GetReleaseValues(req.Request.Context(), clusterID, namespace, req.PathParameter("name"), revision, all)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(values)
+}
+
+func (r *k8sRouter) helmReleaseManifest(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	revision, ok := parseHelmRevision(req, resp)
+	if !ok {
+		return
+	}
+	namespace := req.PathParameter("namespace")
+	if !r.authorizeCluster(req, resp, clusterID, namespace) {
+		return
+	}
+	manifest, err := r.services.K8s.GetReleaseManifest(req.Request.Context(), clusterID, namespace, req.PathParameter("name"), revision)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(manifest)
+}
+
+// parseHelmRevision reads the optional revision query parameter; 0 selects the newest.
+func parseHelmRevision(req *restful.Request, resp *restful.Response) (int, bool) {
+	raw := strings.TrimSpace(req.QueryParameter("revision"))
+	if raw == "" {
+		return 0, true
+	}
+	revision, err := strconv.Atoi(raw)
+	if err != nil || revision <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid revision"))
+		return 0, false
+	}
+	return revision, true
+}
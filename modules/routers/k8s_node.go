@@ -0,0 +1,193 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/gorilla/websocket"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// registerNodeRoutes adds the node routes. Nodes are cluster-scoped, so every route needs a
+// grant covering all namespaces.
+func (r *k8sRouter) registerNodeRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/clusters/{cluster_id}/nodes").To(r.listNodes).
+		Doc("List the nodes of a cluster with capacity, readiness and taints").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes([]model.KubernetesNode{}).
+		Returns(http.StatusOK, "nodes", []model.KubernetesNode{}))
+
+	ws.Route(ws.GET("/clusters/{cluster_id}/nodes/{name}").To(r.getNode).
+		Doc("Get a node with its conditions, pods and latest events").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Writes(model.KubernetesNodeDetails{}).
+		Returns(http.StatusOK, "node", model.KubernetesNodeDetails{}).
+		Returns(http.StatusNotFound, "node not found", errorResponse{}))
+
+	ws.Route(ws.POST("/clusters/{cluster_id}/nodes/{name}/cordon").To(r.cordonNode).
+		Doc("Mark a node unschedulable").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Writes(model.KubernetesNode{}).
+		Returns(http.StatusOK, "node", model.KubernetesNode{}).
+		Returns(http.StatusNotFound, "node not found", errorResponse{}))
+
+	ws.Route(ws.POST("/clusters/{cluster_id}/nodes/{name}/uncordon").To(r.uncordonNode).
+		Doc("Mark a node schedulable again").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Writes(model.KubernetesNode{}).
+		Returns(http.StatusOK, "node", model.KubernetesNode{}).
+		Returns(http.StatusNotFound, "node not found", errorResponse{}))
+
+	ws.Route(ws.GET("/clusters/{cluster_id}/nodes/{name}/drain").To(r.drainNode).
+		Doc("Cordon a node and evict its pods, streaming progress via websocket; requires confirm=true").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(clusterAccessMetadata, model.ClusterAccessEdit).
+		Param(ws.QueryParameter("confirm", "must be true").DataType("boolean").Required(true)).
+		Param(ws.QueryParameter("grace_period_seconds", "termination grace period of the evicted pods").DataType("integer")).
+		Param(ws.QueryParameter("timeout_seconds", "time limit of the drain, 300 by default").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusSwitchingProtocols, "stream", nil).
+		Returns(http.StatusBadRequest, "not confirmed or invalid options", errorResponse{}))
+}
+
+func (r *k8sRouter) listNodes(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, "") {
+		return
+	}
+	nodes, err := r.services.K8s.ListNodes(req.Request.Context(), clusterID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(nodes)
+}
+
+func (r *k8sRouter) getNode(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, "") {
+		return
+	}
+	node, err := r.services.K8s.GetNode(req.Request.Context(), clusterID, req.PathParameter("name"))
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(node)
+}
+
+func (r *k8sRouter) cordonNode(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, "") {
+		return
+	}
+	node, err := r.services.K8s.CordonNode(req.Request.Context(), clusterID, req.PathParameter("name"))
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(node)
+}
+
+func (r *k8sRouter) uncordonNode(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	if !r.authorizeCluster(req, resp, clusterID, "") {
+		return
+	}
+	node, err := r.services.K8s.UncordonNode(req.Request.Context(), clusterID, req.PathParameter("name"))
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(node)
+}
+
+// drainNode checks the options before upgrading, so a missing confirmation is a plain 400.
+// Progress events follow as JSON messages; a drain cut short ends with an ERROR message.
+func (r *k8sRouter) drainNode(req *restful.Request, resp *restful.Response) {
+	clusterID, ok := parseClusterID(req, resp)
+	if !ok {
+		return
+	}
+	name := req.PathParameter("name")
+	if !r.authorizeCluster(req, resp, clusterID, "") {
+		return
+	}
+	confirm, _ := strconv.ParseBool(req.QueryParameter("confirm"))
+	if !confirm {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("draining node %s evicts its pods; pass confirm=true", name))
+		return
+	}
+	opts := model.KubernetesNodeDrainRequest{Confirm: true}
+	if raw := strings.TrimSpace(req.QueryParameter("grace_period_seconds")); raw != "" {
+		grace, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || grace < 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid grace_period_seconds"))
+			return
+		}
+		opts.GracePeriodSeconds = &grace
+	}
+	if raw := strings.TrimSpace(req.QueryParameter("timeout_seconds")); raw != "" {
+		timeout, err := strconv.Atoi(raw)
+		if err != nil || timeout <= 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid timeout_seconds"))
+			return
+		}
+		opts.TimeoutSeconds = timeout
+	}
+	conn, err := r.websockets.Upgrade(resp.ResponseWriter, req.Request)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Request.Context())
+	defer cancel()
+	// clients only listen; reading notices when they go away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err = r.services.K8s.DrainNode(ctx, clusterID, name, opts, func(event model.KubernetesNodeDrainEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	})
+	if err != nil && ctx.Err() == nil {
+		data, _ := json.Marshal(map[string]string{"type": "ERROR", "node": name, "error": err.Error()})
+		_ = conn.WriteMessage(websocket.TextMessage, data)
+	}
+}
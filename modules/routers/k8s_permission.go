@@ -0,0 +1,205 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	k8ssvc "github.com/thepenn/devsys/service/k8s"
+)
+
+// clusterAccessMetadata sets the access level a cluster route requires of users holding a
+// cluster permission; routes without it require view access. Administrators have full access.
+const clusterAccessMetadata = "cluster_access"
+
+var errClusterForbidden = errors.New("insufficient cluster access")
+
+type clusterPermissionRequest struct {
+	ClusterID  int64               `json:"cluster_id"`
+	Login      string              `json:"login"`
+	Access     model.ClusterAccess `json:"access"`
+	Namespaces []string            `json:"namespaces"`
+}
+
+func (r *k8sRouter) registerPermissionRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/permissions").To(r.listPermissions).
+		Doc("List the cluster permissions of users other than administrators").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("user_id", "only permissions of this user").DataType("integer")).
+		Param(ws.QueryParameter("cluster_id", "only permissions on this cluster").DataType("integer")).
+		Writes([]model.ClusterPermissionInfo{}).
+		Returns(http.StatusOK, "permissions", []model.ClusterPermissionInfo{}))
+
+	ws.Route(ws.PUT("/permissions").To(r.setPermission).
+		Doc("Grant a user access to a cluster, replacing an earlier grant").
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(clusterPermissionRequest{}).
+		Writes(model.ClusterPermission{}).
+		Returns(http.StatusOK, "permission", model.ClusterPermission{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusNotFound, "cluster or user not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/permissions/{permission_id}").To(r.deletePermission).
+		Doc("Revoke a cluster permission").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "revoked", nil).
+		Returns(http.StatusNotFound, "permission not found", errorResponse{}))
+}
+
+func (r *k8sRouter) listPermissions(req *restful.Request, resp *restful.Response) {
+	var filter k8ssvc.ClusterPermissionFilter
+	if raw := strings.TrimSpace(req.QueryParameter("user_id")); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid user_id"))
+			return
+		}
+		filter.UserID = id
+	}
+	if raw := strings.TrimSpace(req.QueryParameter("cluster_id")); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid cluster_id"))
+			return
+		}
+		filter.ClusterID = id
+	}
+	list, err := r.services.K8s.ListPermissions(req.Request.Context(), filter)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(list)
+}
+
+func (r *k8sRouter) setPermission(req *restful.Request, resp *restful.Response) {
+	var body clusterPermissionRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if body.ClusterID <= 0 {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("cluster_id is required"))
+		return
+	}
+	perm, err := r.services.K8s.SetPermission(req.Request.Context(), body.ClusterID, body.Login, body.Access, body.Namespaces)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteEntity(perm)
+}
+
+func (r *k8sRouter) deletePermission(req *restful.Request, resp *restful.Response) {
+	id, ok := pathID(req, resp, "permission_id")
+	if !ok {
+		return
+	}
+	if err := r.services.K8s.DeletePermission(req.Request.Context(), id); err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// k8sCaller loads the user behind a request to the cluster routes. Like admin routes they are
+// closed to API tokens.
+func (r *k8sRouter) k8sCaller(req *restful.Request, resp *restful.Response) (*model.User, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok || claims == nil {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	if claims.APIToken() {
+		writeError(resp, http.StatusForbidden, errors.New("API tokens cannot access kubernetes routes"))
+		return nil, false
+	}
+	user, err := r.services.User.FindByID(req.Request.Context(), claims.UserID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if user == nil {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	return user, true
+}
+
+func (r *k8sRouter) isClusterAdmin(user *model.User) bool {
+	return user.Admin || r.services.User.IsSuperAdmin(user)
+}
+
+// clusterPermission checks the caller holds the access level of the selected route on the
+// cluster. The permission is nil for administrators.
+func (r *k8sRouter) clusterPermission(req *restful.Request, resp *restful.Response, clusterID int64) (*model.ClusterPermission, bool) {
+	user, ok := r.k8sCaller(req, resp)
+	if !ok {
+		return nil, false
+	}
+	if r.isClusterAdmin(user) {
+		return nil, true
+	}
+	perm, err := r.services.K8s.Permission(req.Request.Context(), user.ID, clusterID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return nil, false
+	}
+	if perm == nil {
+		// clusters without a grant look missing, like clusters of other organizations
+		writeError(resp, http.StatusNotFound, fmt.Errorf("%w: %d", k8ssvc.ErrClusterNotFound, clusterID))
+		return nil, false
+	}
+	if required := requiredClusterAccess(req); !perm.Access.Includes(required) {
+		writeError(resp, http.StatusForbidden, fmt.Errorf("%w: requires %s access", errClusterForbidden, required))
+		return nil, false
+	}
+	return perm, true
+}
+
+// authorizeCluster checks the caller may use namespace of the cluster with the access level
+// of the selected route. The empty namespace stands for cluster-scoped resources and listings
+// across namespaces, which need a permission without a namespace list.
+func (r *k8sRouter) authorizeCluster(req *restful.Request, resp *restful.Response, clusterID int64, namespace string) bool {
+	perm, ok := r.clusterPermission(req, resp, clusterID)
+	if !ok {
+		return false
+	}
+	if perm != nil && !perm.AllowsNamespace(strings.TrimSpace(namespace)) {
+		writeError(resp, http.StatusForbidden, namespaceForbidden(namespace))
+		return false
+	}
+	return true
+}
+
+func namespaceForbidden(namespace string) error {
+	if strings.TrimSpace(namespace) == "" {
+		return fmt.Errorf("%w: access across namespaces requires a grant on every namespace", k8ssvc.ErrNamespaceForbidden)
+	}
+	return fmt.Errorf("%w: %s", k8ssvc.ErrNamespaceForbidden, namespace)
+}
+
+// requiredClusterAccess returns the access level the selected route requires.
+func requiredClusterAccess(req *restful.Request) model.ClusterAccess {
+	if route := req.SelectedRoute(); route != nil {
+		if access, ok := route.Metadata()[clusterAccessMetadata].(model.ClusterAccess); ok {
+			return access
+		}
+	}
+	return model.ClusterAccessView
+}
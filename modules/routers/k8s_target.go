@@ -0,0 +1,160 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+)
+
+func (r *repoRouter) registerK8sTargetRoutes(ws *restful.WebService, tags []string) {
+	requireK8s := requireCapability(r.services, model.CapabilityKubernetes)
+
+	ws.Route(ws.GET("/{repo_id}/k8s-targets").To(r.listK8sTargets).
+		Doc("List the Kubernetes objects the repository deploys, with their last drift check").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requireK8s).
+		Produces(restful.MIME_JSON).
+		Writes([]*model.KubernetesTarget{}).
+		Returns(http.StatusOK, "targets", []*model.KubernetesTarget{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/k8s-targets/adopt").To(r.adoptK8sTarget).
+		Doc("Adopt an existing object: its live state becomes the baseline and nothing is applied").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Metadata(clusterAccessMetadata, model.ClusterAccessView).
+		Filter(r.authMW.RequireAuth).
+		Filter(requireK8s).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(model.KubernetesTargetRef{}).
+		Returns(http.StatusOK, "target", model.KubernetesTarget{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository, cluster or object not found", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/k8s-targets/{target_id}/drift-check").To(r.checkK8sTargetDrift).
+		Doc("Compare the live object with its baseline and record the drift findings").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleDeveloper).
+		Filter(r.authMW.RequireAuth).
+		Filter(requireK8s).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "target", model.KubernetesTarget{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "target not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/k8s-targets/{target_id}").To(r.deleteK8sTarget).
+		Doc("Stop tracking a target; the live object is left alone").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requireK8s).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "target not found", errorResponse{}))
+}
+
+func (r *repoRouter) listK8sTargets(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.k8sTargetRepo(req, resp)
+	if !ok {
+		return
+	}
+	targets, err := r.services.K8s.ListTargets(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	if targets == nil {
+		targets = []*model.KubernetesTarget{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, targets)
+}
+
+func (r *repoRouter) adoptK8sTarget(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.k8sTargetRepo(req, resp)
+	if !ok {
+		return
+	}
+	var body model.KubernetesTargetRef
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if body.ClusterID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("cluster_id is required"))
+		return
+	}
+	// the repository role does not reach into clusters: adopting reads the live object, so
+	// the caller needs view access to its namespace like on the cluster routes
+	clusters := &k8sRouter{services: r.services, authMW: r.authMW}
+	if !clusters.authorizeCluster(req, resp, body.ClusterID, body.Namespace) {
+		return
+	}
+	target, err := r.services.K8s.AdoptTarget(req.Request.Context(), repo.ID, body)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, target)
+}
+
+func (r *repoRouter) checkK8sTargetDrift(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.k8sTargetRepo(req, resp)
+	if !ok {
+		return
+	}
+	targetID, ok := pathID(req, resp, "target_id")
+	if !ok {
+		return
+	}
+	target, err := r.services.K8s.CheckDrift(req.Request.Context(), repo.ID, targetID)
+	if err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, target)
+}
+
+func (r *repoRouter) deleteK8sTarget(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.k8sTargetRepo(req, resp)
+	if !ok {
+		return
+	}
+	targetID, ok := pathID(req, resp, "target_id")
+	if !ok {
+		return
+	}
+	if err := r.services.K8s.DeleteTarget(req.Request.Context(), repo.ID, targetID); err != nil {
+		writeError(resp, k8sErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// k8sTargetRepo resolves the repository of a target route and writes the error response when
+// the caller lacks the role the route requires.
+func (r *repoRouter) k8sTargetRepo(req *restful.Request, resp *restful.Response) (*model.Repo, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return nil, false
+	}
+	return repo, true
+}
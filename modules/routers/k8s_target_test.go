@@ -0,0 +1,117 @@
+package routers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+	authsvc "github.com/thepenn/devsys/service/auth"
+	k8ssvc "github.com/thepenn/devsys/service/k8s"
+	reposvc "github.com/thepenn/devsys/service/repo"
+	systemsvc "github.com/thepenn/devsys/service/system"
+	usersvc "github.com/thepenn/devsys/service/user"
+)
+
+// newTargetContainer serves the target routes of repository 1, owned by alice (user 1), with
+// grants stored for cluster 1.
+func newTargetContainer(t *testing.T, grants ...*model.ClusterPermission) *restful.Container {
+	t.Helper()
+	db := storetest.Open(t, &model.User{}, &model.Repo{}, &model.RepoMember{}, &model.APIToken{}, &model.RevokedToken{},
+		&model.ClusterPermission{}, &model.KubernetesTarget{})
+	records := []any{
+		&model.User{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", Hash: "alice-hash"},
+		&model.Repo{ID: 1, UserID: 1, ForgeRemoteID: "manual-1", Owner: "alice", Name: "app", FullName: "alice/app"},
+	}
+	for _, grant := range grants {
+		records = append(records, grant)
+	}
+	for _, record := range records {
+		if err := db.GetDB().Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{}
+	cfg.Auth.Provider = "github"
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Git.GitHub = config.GitHub{Enabled: true, URL: "https://github.example", APIURL: "https://github.example", ClientID: "client", ClientSecret: "secret"}
+	users, repos := usersvc.New(db), reposvc.New(db)
+	auth, err := authsvc.New(cfg, db, users, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	system := &systemsvc.Service{}
+	services := &service.Services{
+		Auth:   auth,
+		User:   users,
+		Repo:   repos,
+		System: system,
+		K8s:    k8ssvc.New(system, nil, k8ssvc.WithStore(db)),
+	}
+	router := newRepoRouter(services, authmw.New(auth))
+	ws := new(restful.WebService)
+	ws.Path("/repos").Produces(restful.MIME_JSON)
+	ws.Filter(router.authMW.Authenticate)
+	router.registerK8sTargetRoutes(ws, nil)
+	container := restful.NewContainer()
+	container.Add(ws)
+	return container
+}
+
+// sessionToken signs a session of alice with the configured session secret.
+func sessionToken(t *testing.T) string {
+	t.Helper()
+	claims := &authsvc.SessionClaims{
+		UserID: 1,
+		Login:  "alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "session-1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("session-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func adopt(t *testing.T, container *restful.Container, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/repos/1/k8s-targets/adopt", strings.NewReader(body))
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	req.Header.Set("Authorization", "Bearer "+sessionToken(t))
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdoptTargetRequiresClusterAccess(t *testing.T) {
+	body := `{"cluster_id":1,"namespace":"payments","resource":"secrets","name":"db"}`
+
+	// the repository owner holds no grant on the cluster, which looks missing
+	container := newTargetContainer(t)
+	if rec := adopt(t, container, body); rec.Code != http.StatusNotFound {
+		t.Errorf("adopt without a cluster grant = %d %s, want 404", rec.Code, rec.Body)
+	}
+
+	// a grant on another namespace does not reach payments
+	container = newTargetContainer(t, &model.ClusterPermission{UserID: 1, ClusterID: 1, Access: model.ClusterAccessView, Namespaces: []string{"apps"}})
+	if rec := adopt(t, container, body); rec.Code != http.StatusForbidden {
+		t.Errorf("adopt outside the granted namespaces = %d %s, want 403", rec.Code, rec.Body)
+	}
+	// nor does it reach cluster-scoped objects
+	if rec := adopt(t, container, `{"cluster_id":1,"resource":"clusterroles","group":"rbac.authorization.k8s.io","name":"admin"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("adopt of a cluster-scoped object = %d %s, want 403", rec.Code, rec.Body)
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/emicklei/go-restful/v3"
 
+	"github.com/thepenn/devsys/internal/tenancy"
 	authmw "github.com/thepenn/devsys/routers/middleware/auth"
 	userService "github.com/thepenn/devsys/service/user"
 )
@@ -29,8 +30,15 @@ func (m *Middleware) Middleware() []restful.FilterFunction {
 	return []restful.FilterFunction{m.Filter}
 }
 
-// Filter ensures requests hitting routes tagged with AdminEnable have admin privileges.
+// Filter ensures requests hitting routes tagged with AdminEnable have admin privileges. With
+// multi-tenancy enabled it also attaches the organization scope of authenticated callers.
 func (m *Middleware) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if m.users != nil && m.users.TenancyEnabled() {
+		if !m.attachScope(req, resp) {
+			return
+		}
+	}
+
 	route := req.SelectedRoute()
 	if route != nil && requiresAdmin(route.Metadata()) {
 		claims, ok := authmw.FromContext(req.Request.Context())
@@ -38,6 +46,11 @@ func (m *Middleware) Filter(req *restful.Request, resp *restful.Response, chain
 			writeJSON(resp, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
 			return
 		}
+		if claims.APIToken() {
+			// personal access tokens never carry administrator rights
+			writeJSON(resp, http.StatusForbidden, map[string]string{"error": "API tokens cannot access admin routes"})
+			return
+		}
 		if m.users == nil {
 			writeJSON(resp, http.StatusInternalServerError, map[string]string{"error": "user service unavailable"})
 			return
@@ -52,7 +65,7 @@ func (m *Middleware) Filter(req *restful.Request, resp *restful.Response, chain
 			writeJSON(resp, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
 			return
 		}
-		if !user.Admin {
+		if !user.Admin && !m.users.IsSuperAdmin(user) {
 			writeJSON(resp, http.StatusForbidden, map[string]string{"error": "forbidden"})
 			return
 		}
@@ -61,6 +74,29 @@ func (m *Middleware) Filter(req *restful.Request, resp *restful.Response, chain
 	chain.ProcessFilter(req, resp)
 }
 
+// attachScope stores the organization scope of the caller in the request context. Anonymous
+// requests see no organization.
+func (m *Middleware) attachScope(req *restful.Request, resp *restful.Response) bool {
+	ctx := req.Request.Context()
+	claims, ok := authmw.FromContext(ctx)
+	if !ok || claims == nil {
+		req.Request = req.Request.WithContext(tenancy.WithScope(ctx, tenancy.Orgs()))
+		return true
+	}
+	user, err := m.users.FindByID(ctx, claims.UserID)
+	if err != nil {
+		writeJSON(resp, http.StatusInternalServerError, map[string]string{"error": "failed to load user"})
+		return false
+	}
+	scope, err := m.users.Scope(ctx, user)
+	if err != nil {
+		writeJSON(resp, http.StatusInternalServerError, map[string]string{"error": "failed to load organizations"})
+		return false
+	}
+	req.Request = req.Request.WithContext(tenancy.WithScope(ctx, scope))
+	return true
+}
+
 func requiresAdmin(meta map[string]interface{}) bool {
 	if len(meta) == 0 {
 		return false
@@ -2,11 +2,14 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/emicklei/go-restful/v3"
 
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
 	"github.com/thepenn/devsys/service/auth"
 )
 
@@ -14,6 +17,10 @@ type ctxKey string
 
 const userContextKey ctxKey = "auth:user"
 
+// TokenScope is route metadata naming the scope a personal access token needs for the route.
+// Tokens may use routes without it only for reads, which need model.APITokenScopeRepoRead.
+const TokenScope = "auth:token_scope"
+
 type Middleware struct {
 	service *auth.Service
 }
@@ -26,36 +33,102 @@ func (m *Middleware) Middleware() []restful.FilterFunction {
 	return []restful.FilterFunction{m.Authenticate}
 }
 
+// Authenticate attaches the caller when the request carries valid credentials; tokens
+// lacking the scope of the route are ignored.
 func (m *Middleware) Authenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	ctx, _ := m.parseAndAttach(req.Request)
+	ctx, _, _, _ := m.parseAndAttach(req)
 	req.Request = req.Request.WithContext(ctx)
 	chain.ProcessFilter(req, resp)
 }
 
 func (m *Middleware) RequireAuth(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	ctx, user := m.parseAndAttach(req.Request)
+	ctx, user, scope, err := m.parseAndAttach(req)
+	if scope != "" {
+		resp.WriteHeaderAndEntity(http.StatusForbidden, map[string]string{"error": "token scope required: " + scope})
+		return
+	}
 	if user == nil {
-		resp.WriteHeaderAndEntity(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		body := map[string]string{"error": "unauthorized"}
+		if err != nil {
+			body["error"] = err.Error()
+			body["code"] = ErrorCode(err)
+		}
+		resp.WriteHeaderAndEntity(http.StatusUnauthorized, body)
 		return
 	}
 	req.Request = req.Request.WithContext(ctx)
 	chain.ProcessFilter(req, resp)
 }
 
-func (m *Middleware) parseAndAttach(r *http.Request) (context.Context, *auth.SessionClaims) {
-	token := extractTokenFromRequest(r)
+// parseAndAttach returns the context carrying the caller. When a personal access token lacks
+// the scope the route needs it returns no caller and the missing scope; rejected credentials
+// are returned as the error.
+func (m *Middleware) parseAndAttach(req *restful.Request) (context.Context, *auth.SessionClaims, string, error) {
+	r := req.Request
+	token := TokenFromRequest(r)
 	if token == "" {
-		return r.Context(), nil
+		return r.Context(), nil, "", nil
+	}
+	var (
+		claims *auth.SessionClaims
+		err    error
+	)
+	if strings.HasPrefix(token, auth.APITokenPrefix) {
+		claims, err = m.service.ParseAPIToken(r.Context(), token)
+	} else {
+		claims, err = m.service.ParseToken(r.Context(), token)
 	}
-	claims, err := m.service.ParseToken(token)
 	if err != nil {
-		return r.Context(), nil
+		return r.Context(), nil, "", err
+	}
+	if scope := requiredTokenScope(req); !claims.HasScope(scope) {
+		return r.Context(), nil, scope, nil
 	}
 	ctx := context.WithValue(r.Context(), userContextKey, claims)
-	return ctx, claims
+	ctx = audit.WithActor(ctx, claims.Login)
+	return ctx, claims, "", nil
+}
+
+// Error codes of rejected credentials. Clients refresh the session on CodeTokenExpired and log
+// in again on the others.
+const (
+	CodeTokenExpired = "token_expired"
+	CodeTokenRevoked = "token_revoked"
+	CodeTokenInvalid = "token_invalid"
+)
+
+// ErrorCode classifies an error returned for rejected credentials.
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		return CodeTokenExpired
+	case errors.Is(err, auth.ErrTokenRevoked):
+		return CodeTokenRevoked
+	default:
+		return CodeTokenInvalid
+	}
+}
+
+// sessionOnlyScope is reported for writes without a declared scope, which tokens never hold.
+const sessionOnlyScope = "session"
+
+// requiredTokenScope returns the scope a token needs for the selected route.
+func requiredTokenScope(req *restful.Request) string {
+	if route := req.SelectedRoute(); route != nil {
+		if scope, ok := route.Metadata()[TokenScope].(string); ok && scope != "" {
+			return scope
+		}
+	}
+	switch req.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return model.APITokenScopeRepoRead
+	default:
+		return sessionOnlyScope
+	}
 }
 
-func extractTokenFromRequest(r *http.Request) string {
+// TokenFromRequest returns the bearer token of r, falling back to the token query parameter.
+func TokenFromRequest(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" {
 		parts := strings.SplitN(authHeader, " ", 2)
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/auth"
+	"github.com/thepenn/devsys/service/repo"
+	"github.com/thepenn/devsys/service/user"
+)
+
+// newTokenContainer serves a read route, a pipeline trigger route and an undeclared write
+// behind RequireAuth, answering with the login of the caller.
+func newTokenContainer(t *testing.T) (*restful.Container, *auth.Service) {
+	t.Helper()
+	db := storetest.Open(t, &model.User{}, &model.Repo{}, &model.APIToken{})
+	if err := db.GetDB().Create(&model.User{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", Hash: "alice-hash"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Auth.Provider = "github"
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Git.GitHub = config.GitHub{Enabled: true, URL: "https://github.example", APIURL: "https://github.example", ClientID: "client", ClientSecret: "secret"}
+	svc, err := auth.New(cfg, db, user.New(db), repo.New(db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mw := New(svc)
+	whoami := func(req *restful.Request, resp *restful.Response) {
+		claims, _ := FromContext(req.Request.Context())
+		_, _ = resp.Write([]byte(claims.Login))
+	}
+	ws := new(restful.WebService)
+	ws.Path("/repos").Produces(restful.MIME_JSON)
+	ws.Route(ws.GET("/1").To(whoami).Filter(mw.RequireAuth))
+	ws.Route(ws.POST("/1/pipeline/run").To(whoami).Filter(mw.RequireAuth).
+		Metadata(TokenScope, model.APITokenScopePipelineTrigger))
+	ws.Route(ws.DELETE("/1").To(whoami).Filter(mw.RequireAuth))
+	container := restful.NewContainer()
+	container.Add(ws)
+	return container, svc
+}
+
+func request(container *restful.Container, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireAuthEnforcesTokenScopes(t *testing.T) {
+	container, svc := newTokenContainer(t)
+	ctx := context.Background()
+	_, trigger, err := svc.CreateAPIToken(ctx, 1, "ci", []string{model.APITokenScopePipelineTrigger}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reader, err := svc.CreateAPIToken(ctx, 1, "dashboard", []string{model.APITokenScopeRepoRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"trigger with the trigger scope", http.MethodPost, "/repos/1/pipeline/run", trigger, http.StatusOK},
+		{"trigger without the trigger scope", http.MethodPost, "/repos/1/pipeline/run", reader, http.StatusForbidden},
+		{"read with the read scope", http.MethodGet, "/repos/1", reader, http.StatusOK},
+		{"read without the read scope", http.MethodGet, "/repos/1", trigger, http.StatusForbidden},
+		{"write without a declared scope", http.MethodDelete, "/repos/1", trigger, http.StatusForbidden},
+		{"unknown token", http.MethodGet, "/repos/1", auth.APITokenPrefix + "forged", http.StatusUnauthorized},
+		{"no credentials", http.MethodGet, "/repos/1", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		rec := request(container, c.method, c.path, c.token)
+		if rec.Code != c.want {
+			t.Errorf("%s: %s %s = %d, want %d: %s", c.name, c.method, c.path, rec.Code, c.want, rec.Body)
+			continue
+		}
+		if c.want == http.StatusOK && rec.Body.String() != "alice" {
+			t.Errorf("%s: caller = %q, want the owner of the token", c.name, rec.Body)
+		}
+	}
+}
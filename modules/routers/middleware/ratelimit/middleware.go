@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/internal/cache"
+)
+
+// Middleware limits each client IP to a number of requests per window. The counts live in
+// the cache store and are incremented atomically, so replicas sharing Redis share the limit.
+type Middleware struct {
+	store   cache.Store
+	prefix  string
+	limit   int
+	window  time.Duration
+	proxies []netip.Prefix
+}
+
+// Option configures the middleware.
+type Option func(*Middleware)
+
+// WithTrustedProxies lists the IPs and CIDRs of the reverse proxies in front of the server.
+// Only requests from them have their client read from X-Forwarded-For; invalid entries are
+// logged and skipped.
+func WithTrustedProxies(entries []string) Option {
+	return func(m *Middleware) {
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(entry)
+				if addrErr != nil {
+					log.Warn().Err(err).Str("proxy", entry).Msg("ignored invalid trusted proxy")
+					continue
+				}
+				prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+			}
+			m.proxies = append(m.proxies, prefix.Masked())
+		}
+	}
+}
+
+// New limits the routes it filters to limit requests per window and client IP, counted under
+// keys starting with prefix. A nil store or a non-positive limit lets every request through.
+func New(store cache.Store, prefix string, limit int, window time.Duration, opts ...Option) *Middleware {
+	m := &Middleware{store: store, prefix: prefix, limit: limit, window: window}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Filter answers 429 with Retry-After once the client IP used up the current window. When
+// the store cannot count, requests are let through.
+func (m *Middleware) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if m.store == nil || m.limit <= 0 || m.window <= 0 {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	now := time.Now()
+	windowStart := now.Truncate(m.window)
+	key := fmt.Sprintf("%s:%s:%d", m.prefix, m.ClientIP(req.Request), windowStart.Unix())
+
+	count, ok := m.store.Incr(key, m.window)
+	if ok && count > int64(m.limit) {
+		retry := windowStart.Add(m.window).Sub(now)
+		resp.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		_ = resp.WriteErrorString(http.StatusTooManyRequests, "too many requests")
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// ClientIP returns the address of the client. It is the remote address of the connection
+// unless that is a trusted proxy; then X-Forwarded-For is read from the right, skipping the
+// trusted proxies that appended to it, and the first other address is the client. Entries
+// left of it were sent by the client and are not believed.
+func (m *Middleware) ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if !m.trusted(peer) {
+		return peer
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !m.trusted(ip) {
+			return ip
+		}
+		peer = ip
+	}
+	return peer
+}
+
+func (m *Middleware) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range m.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
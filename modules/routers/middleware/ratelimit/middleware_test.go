@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	m := New(nil, "test", 1, time.Minute, WithTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10", "not-an-ip"}))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "198.51.100.1:5000", want: "198.51.100.1"},
+		{name: "untrusted peer forging the header", remoteAddr: "198.51.100.1:5000", forwarded: []string{"203.0.113.9"}, want: "198.51.100.1"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:5000", forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "client forging entries before the proxy", remoteAddr: "10.1.2.3:5000", forwarded: []string{"1.1.1.1, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "chain of trusted proxies", remoteAddr: "192.0.2.10:5000", forwarded: []string{"203.0.113.9, 10.0.0.7"}, want: "203.0.113.9"},
+		{name: "several headers", remoteAddr: "10.1.2.3:5000", forwarded: []string{"1.1.1.1", "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "trusted proxy without header", remoteAddr: "10.1.2.3:5000", want: "10.1.2.3"},
+		{name: "only trusted entries", remoteAddr: "10.1.2.3:5000", forwarded: []string{"10.0.0.8"}, want: "10.0.0.8"},
+		{name: "mapped ipv4 peer", remoteAddr: "[::ffff:10.1.2.3]:5000", forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := m.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+var errInvalidNotificationTargetID = errors.New("invalid notification target id")
+
+type notificationTargetRequest struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+type notificationTargetResponse struct {
+	*model.NotificationTarget
+	// Secret is masked when set so clients can tell whether signing is enabled.
+	Secret string `json:"secret"`
+}
+
+func newNotificationTargetResponse(target *model.NotificationTarget) notificationTargetResponse {
+	result := notificationTargetResponse{NotificationTarget: target}
+	if target.Secret != "" {
+		result.Secret = model.DefaultSecretMask
+	}
+	if result.Events == nil {
+		result.Events = []string{}
+	}
+	return result
+}
+
+func (r *repoRouter) registerNotificationRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/notifications/targets").To(r.listNotificationTargets).
+		Doc("List the notification targets of a repository").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]notificationTargetResponse{}).
+		Returns(http.StatusOK, "targets", []notificationTargetResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/notifications/targets").To(r.createNotificationTarget).
+		Doc("Create a notification target (webhook, slack or dingtalk)").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(notificationTargetRequest{}).
+		Returns(http.StatusCreated, "target", notificationTargetResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.PUT("/{repo_id}/notifications/targets/{target_id}").To(r.updateNotificationTarget).
+		Doc("Update a notification target; an empty or masked secret is kept").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(model.NotificationTargetPatch{}).
+		Returns(http.StatusOK, "target", notificationTargetResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "target not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/notifications/targets/{target_id}").To(r.deleteNotificationTarget).
+		Doc("Delete a notification target").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "target not found", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/notifications/attempts").To(r.listNotificationAttempts).
+		Doc("List recent notification deliveries of a repository, newest first").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.QueryParameter("limit", "maximum number of attempts, default 50, at most 200").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Writes([]*model.NotificationAttempt{}).
+		Returns(http.StatusOK, "attempts", []*model.NotificationAttempt{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+}
+
+func (r *repoRouter) listNotificationTargets(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.notificationRepo(req, resp)
+	if !ok {
+		return
+	}
+	targets, err := r.services.Pipeline.ListNotificationTargets(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	items := make([]notificationTargetResponse, 0, len(targets))
+	for _, target := range targets {
+		items = append(items, newNotificationTargetResponse(target))
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, items)
+}
+
+func (r *repoRouter) createNotificationTarget(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.notificationRepo(req, resp)
+	if !ok {
+		return
+	}
+	var body notificationTargetRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	enabled := true
+	if body.Enabled != nil {
+		enabled = *body.Enabled
+	}
+	created, err := r.services.Pipeline.CreateNotificationTarget(req.Request.Context(), &model.NotificationTarget{
+		RepoID:  repo.ID,
+		Name:    body.Name,
+		Type:    body.Type,
+		URL:     body.URL,
+		Secret:  body.Secret,
+		Events:  body.Events,
+		Enabled: enabled,
+	})
+	if err != nil {
+		writeError(resp, notificationErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, newNotificationTargetResponse(created))
+}
+
+func (r *repoRouter) updateNotificationTarget(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.notificationRepo(req, resp)
+	if !ok {
+		return
+	}
+	id, ok := notificationTargetID(req, resp)
+	if !ok {
+		return
+	}
+	var patch model.NotificationTargetPatch
+	if err := req.ReadEntity(&patch); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	updated, err := r.services.Pipeline.UpdateNotificationTarget(req.Request.Context(), repo.ID, id, patch)
+	if err != nil {
+		writeError(resp, notificationErrorStatus(err), err)
+		return
+	}
+	if updated == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, newNotificationTargetResponse(updated))
+}
+
+func (r *repoRouter) deleteNotificationTarget(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.notificationRepo(req, resp)
+	if !ok {
+		return
+	}
+	id, ok := notificationTargetID(req, resp)
+	if !ok {
+		return
+	}
+	if err := r.services.Pipeline.DeleteNotificationTarget(req.Request.Context(), repo.ID, id); err != nil {
+		writeError(resp, notificationErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *repoRouter) listNotificationAttempts(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.notificationRepo(req, resp)
+	if !ok {
+		return
+	}
+	limit := 0
+	if raw := strings.TrimSpace(req.QueryParameter("limit")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			writeError(resp, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+		limit = parsed
+	}
+	attempts, err := r.services.Pipeline.ListNotificationAttempts(req.Request.Context(), repo.ID, limit)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if attempts == nil {
+		attempts = []*model.NotificationAttempt{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, attempts)
+}
+
+// notificationRepo resolves the repository of a notification route and writes the error
+// response when the caller cannot access it.
+func (r *repoRouter) notificationRepo(req *restful.Request, resp *restful.Response) (*model.Repo, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return nil, false
+	}
+	return repo, true
+}
+
+func notificationTargetID(req *restful.Request, resp *restful.Response) (int64, bool) {
+	id, err := strconv.ParseInt(req.PathParameter("target_id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(resp, http.StatusBadRequest, errInvalidNotificationTargetID)
+		return 0, false
+	}
+	return id, true
+}
+
+func notificationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pipelinesvc.ErrNotificationTargetInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,194 @@
+package routers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+)
+
+const (
+	defaultQueueDrainTimeout = time.Minute
+	maxQueueDrainTimeout     = 10 * time.Minute
+)
+
+// queueDrainResponse reports whether the running tasks finished within the drain timeout.
+type queueDrainResponse struct {
+	Drained bool            `json:"drained"`
+	Queue   model.QueueInfo `json:"queue"`
+}
+
+type pipelineAdminRouter struct {
+	services *service.Services
+	authMW   *authmw.Middleware
+}
+
+func newPipelineAdminRouter(services *service.Services, authMW *authmw.Middleware) *pipelineAdminRouter {
+	return &pipelineAdminRouter{services: services, authMW: authMW}
+}
+
+func (r *pipelineAdminRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	ws := register("/admin/pipeline")
+	ws.Filter(r.authMW.Authenticate)
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+
+	ws.Route(ws.GET("/namespace-locks").To(r.listNamespaceLocks).
+		Doc("List namespace locks held by deploy steps").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]*model.NamespaceLock{}).
+		Returns(http.StatusOK, "locks", []*model.NamespaceLock{}))
+
+	ws.Route(ws.DELETE("/namespace-locks/{lock_id}").To(r.releaseNamespaceLock).
+		Doc("Force-release a namespace lock").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "released", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	ws.Route(ws.GET("/queue").To(r.queueInfo).
+		Doc("Show the pipeline queue and whether it is paused").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(model.QueueInfo{}).
+		Returns(http.StatusOK, "queue", model.QueueInfo{}))
+
+	ws.Route(ws.POST("/queue/pause").To(r.pauseQueue).
+		Doc("Stop workers from starting queued tasks; running tasks finish").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(model.QueueInfo{}).
+		Returns(http.StatusOK, "queue", model.QueueInfo{}))
+
+	ws.Route(ws.POST("/queue/resume").To(r.resumeQueue).
+		Doc("Let workers start queued tasks again").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(model.QueueInfo{}).
+		Returns(http.StatusOK, "queue", model.QueueInfo{}))
+
+	ws.Route(ws.POST("/queue/drain").To(r.drainQueue).
+		Doc("Wait until no pipeline task is running; pause the queue first to keep it idle").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("timeout", "how long to wait, e.g. 90s; defaults to 1m, at most 10m").DataType("string")).
+		Writes(queueDrainResponse{}).
+		Returns(http.StatusOK, "drain result", queueDrainResponse{}).
+		Returns(http.StatusBadRequest, "invalid timeout", errorResponse{}))
+
+	ws.Route(ws.GET("/workspaces").To(r.workspaceUsage).
+		Doc("Report the disk usage of the build workspaces and the workspace quota").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("refresh", "rescan instead of using the scan of the last minute").DataType("boolean")).
+		Writes(model.WorkspaceUsage{}).
+		Returns(http.StatusOK, "usage", model.WorkspaceUsage{}))
+
+	r.registerEnvTemplateRoutes(ws, tags)
+
+	webServices := []*restful.WebService{ws}
+	if secrets := r.registerSecretRoutes(register, tags); secrets != nil {
+		webServices = append(webServices, secrets)
+	}
+	if plugins := r.registerPluginRoutes(register, tags); plugins != nil {
+		webServices = append(webServices, plugins)
+	}
+	return webServices
+}
+
+func (r *pipelineAdminRouter) listNamespaceLocks(req *restful.Request, resp *restful.Response) {
+	locks, err := r.services.Pipeline.ListNamespaceLocks(req.Request.Context())
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(locks)
+}
+
+func (r *pipelineAdminRouter) releaseNamespaceLock(req *restful.Request, resp *restful.Response) {
+	lockID, err := strconv.ParseInt(req.PathParameter("lock_id"), 10, 64)
+	if err != nil || lockID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("lock id is invalid"))
+		return
+	}
+	if err := r.services.Pipeline.ReleaseNamespaceLock(req.Request.Context(), lockID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(resp, status, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *pipelineAdminRouter) queueInfo(req *restful.Request, resp *restful.Response) {
+	_ = resp.WriteEntity(r.services.Pipeline.QueueInfo(req.Request.Context()))
+}
+
+func (r *pipelineAdminRouter) pauseQueue(req *restful.Request, resp *restful.Response) {
+	if err := r.services.Pipeline.PauseQueue(); err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(r.services.Pipeline.QueueInfo(req.Request.Context()))
+}
+
+func (r *pipelineAdminRouter) resumeQueue(req *restful.Request, resp *restful.Response) {
+	if err := r.services.Pipeline.ResumeQueue(); err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(r.services.Pipeline.QueueInfo(req.Request.Context()))
+}
+
+func (r *pipelineAdminRouter) drainQueue(req *restful.Request, resp *restful.Response) {
+	timeout := defaultQueueDrainTimeout
+	if raw := req.QueryParameter("timeout"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", raw))
+			return
+		}
+		timeout = parsed
+		if timeout > maxQueueDrainTimeout {
+			timeout = maxQueueDrainTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Request.Context(), timeout)
+	defer cancel()
+	err := r.services.Pipeline.DrainQueue(ctx)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(queueDrainResponse{Drained: err == nil, Queue: r.services.Pipeline.QueueInfo(req.Request.Context())})
+}
+
+func (r *pipelineAdminRouter) workspaceUsage(req *restful.Request, resp *restful.Response) {
+	refresh, _ := strconv.ParseBool(req.QueryParameter("refresh"))
+	usage, err := r.services.Pipeline.WorkspaceUsage(req.Request.Context(), refresh)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(usage)
+}
@@ -0,0 +1,197 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+func (r *repoRouter) registerBundleRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/export").To(r.exportPipelineBundle).
+		Doc("Export config content, settings, cron schedules and variables as one bundle; secret variable values are omitted").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.QueryParameter("format", "json (default) or yaml")).
+		Produces(restful.MIME_JSON, pipelineConfigYAMLMime).
+		Writes(pipelinesvc.PipelineBundle{}).
+		Returns(http.StatusOK, "bundle", pipelinesvc.PipelineBundle{}).
+		Returns(http.StatusBadRequest, "invalid format", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/import").To(r.importPipelineBundle).
+		Doc("Apply a bundle written by the export endpoint in one transaction; dry_run only reports the changes").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.QueryParameter("dry_run", "report the changes without applying them").DataType("boolean")).
+		Consumes(restful.MIME_JSON, pipelineConfigYAMLMime, "text/plain").
+		Produces(restful.MIME_JSON).
+		Reads(pipelinesvc.PipelineBundle{}).
+		Returns(http.StatusOK, "changes", pipelinesvc.PipelineBundleResult{}).
+		Returns(http.StatusBadRequest, "invalid bundle", pipelineConfigValidationResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/copy-from/{source_repo_id}").To(r.copyPipelineBundle).
+		Doc("Copy the pipeline setup of another repository, secret variables included; requires maintainer on both").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.PathParameter("source_repo_id", "repository to copy from").DataType("integer")).
+		Param(ws.QueryParameter("dry_run", "report the changes without applying them").DataType("boolean")).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "changes", pipelinesvc.PipelineBundleResult{}).
+		Returns(http.StatusBadRequest, "invalid bundle", pipelineConfigValidationResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) exportPipelineBundle(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return
+	}
+	format := strings.ToLower(strings.TrimSpace(req.QueryParameter("format")))
+	if format != "" && format != "json" && format != "yaml" {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	bundle, err := r.services.Pipeline.ExportPipelineBundle(req.Request.Context(), repo, false)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if format != "yaml" {
+		_ = resp.WriteHeaderAndEntity(http.StatusOK, bundle)
+		return
+	}
+
+	content, err := yaml.Marshal(bundle)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	resp.Header().Set("Content-Type", pipelineConfigYAMLMime+"; charset=utf-8")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sanitizeExportFilename(repo.FullName)+".bundle.yaml"))
+	resp.WriteHeader(http.StatusOK)
+	_, _ = resp.Write(content)
+}
+
+// importPipelineBundle reads a JSON or YAML bundle; YAML decoding covers both.
+func (r *repoRouter) importPipelineBundle(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Request.Body, pipelineConfigImportMaxLen+1))
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > pipelineConfigImportMaxLen {
+		writeError(resp, http.StatusBadRequest, errors.New("导入文件过大"))
+		return
+	}
+	var bundle pipelinesvc.PipelineBundle
+	if err := yaml.Unmarshal(body, &bundle); err != nil {
+		writePipelineConfigError(resp, &pipelinesvc.PipelineConfigError{Diagnostics: []spec.Diagnostic{{
+			Severity: spec.SeverityError,
+			Message:  fmt.Sprintf("解析配置包失败: %v", err),
+		}}})
+		return
+	}
+
+	result, err := r.services.Pipeline.ImportPipelineBundle(req.Request.Context(), repo.ID, &bundle, claims.Login, dryRunParam(req))
+	if err != nil {
+		writePipelineBundleError(resp, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+func (r *repoRouter) copyPipelineBundle(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return
+	}
+	source, err := r.repoFromPath(req, claims, "source_repo_id", model.RepoRoleMaintainer)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return
+	}
+	if source.ID == repo.ID {
+		writeError(resp, http.StatusBadRequest, errors.New("不能从仓库自身复制流水线配置"))
+		return
+	}
+
+	bundle, err := r.services.Pipeline.ExportPipelineBundle(req.Request.Context(), source, true)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	result, err := r.services.Pipeline.ImportPipelineBundle(req.Request.Context(), repo.ID, bundle, claims.Login, dryRunParam(req))
+	if err != nil {
+		writePipelineBundleError(resp, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+func dryRunParam(req *restful.Request) bool {
+	switch strings.ToLower(strings.TrimSpace(req.QueryParameter("dry_run"))) {
+	case "true", "1", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// writePipelineBundleError answers validation failures with their per-field diagnostics.
+func writePipelineBundleError(resp *restful.Response, err error) {
+	var cfgErr *pipelinesvc.PipelineConfigError
+	if errors.As(err, &cfgErr) {
+		writePipelineConfigError(resp, err)
+		return
+	}
+	writeError(resp, http.StatusInternalServerError, err)
+}
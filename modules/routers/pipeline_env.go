@@ -0,0 +1,174 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+// envTemplateRequest sets an env template; omitting value keeps the stored one.
+type envTemplateRequest struct {
+	Value  *string `json:"value"`
+	Masked bool    `json:"masked"`
+}
+
+func (r *pipelineAdminRouter) registerEnvTemplateRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/env").To(r.listEnvTemplates).
+		Doc("List env templates injected into every pipeline; masked values are omitted").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]model.EnvTemplate{}).
+		Returns(http.StatusOK, "templates", []model.EnvTemplate{}))
+
+	ws.Route(ws.PUT("/env/{key}").To(r.setEnvTemplate).
+		Doc("Create or update an env template injected into every pipeline").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Consumes(restful.MIME_JSON).
+		Reads(envTemplateRequest{}).
+		Writes(model.EnvTemplate{}).
+		Returns(http.StatusOK, "template", model.EnvTemplate{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}))
+
+	ws.Route(ws.DELETE("/env/{key}").To(r.deleteEnvTemplate).
+		Doc("Delete a global env template").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+}
+
+func (r *pipelineAdminRouter) listEnvTemplates(req *restful.Request, resp *restful.Response) {
+	writeEnvTemplates(req, resp, r.services.Pipeline, 0)
+}
+
+func (r *pipelineAdminRouter) setEnvTemplate(req *restful.Request, resp *restful.Response) {
+	setEnvTemplate(req, resp, r.services.Pipeline, 0)
+}
+
+func (r *pipelineAdminRouter) deleteEnvTemplate(req *restful.Request, resp *restful.Response) {
+	deleteEnvTemplate(req, resp, r.services.Pipeline, 0)
+}
+
+func (r *repoRouter) registerEnvTemplateRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/env").To(r.listEnvTemplates).
+		Doc("List env templates of the repository; masked values are omitted").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]model.EnvTemplate{}).
+		Returns(http.StatusOK, "templates", []model.EnvTemplate{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.PUT("/{repo_id}/pipeline/env/{key}").To(r.setEnvTemplate).
+		Doc("Create or update an env template injected into every pipeline of the repository").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(envTemplateRequest{}).
+		Returns(http.StatusOK, "template", model.EnvTemplate{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/pipeline/env/{key}").To(r.deleteEnvTemplate).
+		Doc("Delete an env template of the repository").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "template not found", errorResponse{}))
+}
+
+func (r *repoRouter) listEnvTemplates(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	writeEnvTemplates(req, resp, r.services.Pipeline, repo.ID)
+}
+
+func (r *repoRouter) setEnvTemplate(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	setEnvTemplate(req, resp, r.services.Pipeline, repo.ID)
+}
+
+func (r *repoRouter) deleteEnvTemplate(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	deleteEnvTemplate(req, resp, r.services.Pipeline, repo.ID)
+}
+
+// writeEnvTemplates, setEnvTemplate and deleteEnvTemplate serve the global templates for
+// repoID 0 and the templates of the repository otherwise.
+func writeEnvTemplates(req *restful.Request, resp *restful.Response, svc *pipelinesvc.Service, repoID int64) {
+	templates, err := svc.ListEnvTemplates(req.Request.Context(), repoID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	items := make([]model.EnvTemplate, 0, len(templates))
+	for _, template := range templates {
+		items = append(items, template.Redacted())
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, items)
+}
+
+func setEnvTemplate(req *restful.Request, resp *restful.Response, svc *pipelinesvc.Service, repoID int64) {
+	var body envTemplateRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	template, err := svc.SetEnvTemplate(req.Request.Context(), repoID, req.PathParameter("key"), body.Value, body.Masked)
+	if err != nil {
+		writeError(resp, envTemplateErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, template.Redacted())
+}
+
+func deleteEnvTemplate(req *restful.Request, resp *restful.Response, svc *pipelinesvc.Service, repoID int64) {
+	if err := svc.DeleteEnvTemplate(req.Request.Context(), repoID, req.PathParameter("key")); err != nil {
+		writeError(resp, envTemplateErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func envTemplateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pipelinesvc.ErrEnvTemplateInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,119 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+// pipelineFilterParams documents the query parameters read by parsePipelineFilter.
+func pipelineFilterParams(ws *restful.WebService, route *restful.RouteBuilder) *restful.RouteBuilder {
+	return route.
+		Param(ws.QueryParameter("status", "only runs with one of these statuses; repeat or separate with commas").DataType("string").AllowMultiple(true)).
+		Param(ws.QueryParameter("branch", "only runs of this branch").DataType("string")).
+		Param(ws.QueryParameter("event", "only runs triggered by one of these events, e.g. push or cron; repeat or separate with commas").DataType("string").AllowMultiple(true)).
+		Param(ws.QueryParameter("author", "only runs of this author").DataType("string")).
+		Param(ws.QueryParameter("created_after", "window start as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("created_before", "window end as unix seconds, RFC 3339 or YYYY-MM-DD").DataType("string")).
+		Param(ws.QueryParameter("q", "text searched in the message, or a commit prefix").DataType("string"))
+}
+
+func parsePipelineFilter(req *restful.Request) (model.PipelineFilter, error) {
+	filter := model.PipelineFilter{
+		Branch: strings.TrimSpace(req.QueryParameter("branch")),
+		Author: strings.TrimSpace(req.QueryParameter("author")),
+		Search: strings.TrimSpace(req.QueryParameter("q")),
+	}
+	for _, value := range queryValues(req, "status") {
+		status := model.StatusValue(value)
+		if err := status.Validate(); err != nil {
+			return filter, err
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+	for _, value := range queryValues(req, "event") {
+		event := model.WebhookEvent(value)
+		if err := event.Validate(); err != nil {
+			return filter, err
+		}
+		filter.Events = append(filter.Events, event)
+	}
+	var err error
+	if filter.After, err = parseStatsTime(req.QueryParameter("created_after")); err != nil {
+		return filter, fmt.Errorf("invalid created_after: %w", err)
+	}
+	if filter.Before, err = parseStatsTime(req.QueryParameter("created_before")); err != nil {
+		return filter, fmt.Errorf("invalid created_before: %w", err)
+	}
+	return filter, nil
+}
+
+// queryValues returns the values of a query parameter that may be repeated or comma separated.
+func queryValues(req *restful.Request, name string) []string {
+	var values []string
+	for _, raw := range req.QueryParameters(name) {
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func (r *repoRouter) latestPipelineRun(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return
+	}
+	filter, err := parsePipelineFilter(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	item, err := r.services.Pipeline.LatestPipeline(req.Request.Context(), repo.ID, filter)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if item == nil {
+		writeError(resp, http.StatusNotFound, errors.New("pipeline run not found"))
+		return
+	}
+	currentConfigHash, err := r.services.Pipeline.CurrentConfigHash(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineRunResponse{
+		ID:       item.ID,
+		Number:   item.Number,
+		Status:   item.Status,
+		Branch:   item.Branch,
+		Ref:      item.Ref,
+		Created:  item.Created,
+		Finished: item.Finished,
+		Message:  item.Message,
+		Author:   item.Author,
+		Commit:   item.Commit,
+
+		ConfigHash:         item.ConfigHash,
+		ConfigVersion:      item.ConfigVersion,
+		ConfigChangedSince: pipelinesvc.ConfigChangedSince(item, currentConfigHash),
+	})
+}
@@ -0,0 +1,195 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+var errInvalidPluginID = errors.New("plugin id is invalid")
+
+type pluginRequest struct {
+	Name        string                `json:"name"`
+	Version     string                `json:"version"`
+	Image       string                `json:"image"`
+	Description string                `json:"description"`
+	Settings    []model.PluginSetting `json:"settings"`
+}
+
+func (b pluginRequest) definition() *model.PluginDefinition {
+	return &model.PluginDefinition{
+		Name:        b.Name,
+		Version:     b.Version,
+		Image:       b.Image,
+		Description: b.Description,
+		Settings:    b.Settings,
+	}
+}
+
+func (r *pipelineAdminRouter) registerPluginRoutes(register func(string) *restful.WebService, tags []string) *restful.WebService {
+	if r.services == nil || r.services.Pipeline == nil {
+		return nil
+	}
+
+	ws := register("/admin/plugins")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(r.authMW.Authenticate)
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+
+	ws.Route(ws.GET("").To(r.listPlugins).
+		Doc("列出步骤插件").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]*model.PluginDefinition{}).
+		Returns(http.StatusOK, "OK", []*model.PluginDefinition{}))
+
+	ws.Route(ws.GET("/{plugin_id}").To(r.getPlugin).
+		Doc("查看步骤插件及其参数").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(model.PluginDefinition{}).
+		Returns(http.StatusOK, "OK", model.PluginDefinition{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	ws.Route(ws.POST("").To(r.createPlugin).
+		Doc("注册步骤插件，步骤通过 plugin 字段引用").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(pluginRequest{}).
+		Writes(model.PluginDefinition{}).
+		Returns(http.StatusCreated, "created", model.PluginDefinition{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}))
+
+	ws.Route(ws.PUT("/{plugin_id}").To(r.updatePlugin).
+		Doc("更新步骤插件，引用它的配置在下次保存或触发时按新参数校验").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(pluginRequest{}).
+		Writes(model.PluginDefinition{}).
+		Returns(http.StatusOK, "OK", model.PluginDefinition{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{plugin_id}").To(r.deletePlugin).
+		Doc("删除步骤插件").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	return ws
+}
+
+func (r *pipelineAdminRouter) listPlugins(req *restful.Request, resp *restful.Response) {
+	plugins, err := r.services.Pipeline.ListPlugins(req.Request.Context())
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteEntity(plugins)
+}
+
+func (r *pipelineAdminRouter) getPlugin(req *restful.Request, resp *restful.Response) {
+	id, err := pluginID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	plugin, err := r.services.Pipeline.GetPlugin(req.Request.Context(), id)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if plugin == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+	_ = resp.WriteEntity(plugin)
+}
+
+func (r *pipelineAdminRouter) createPlugin(req *restful.Request, resp *restful.Response) {
+	var body pluginRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	created, err := r.services.Pipeline.CreatePlugin(req.Request.Context(), body.definition())
+	if err != nil {
+		writeError(resp, pluginErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, created)
+}
+
+func (r *pipelineAdminRouter) updatePlugin(req *restful.Request, resp *restful.Response) {
+	id, err := pluginID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	var body pluginRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	updated, err := r.services.Pipeline.UpdatePlugin(req.Request.Context(), id, body.definition())
+	if err != nil {
+		writeError(resp, pluginErrorStatus(err), err)
+		return
+	}
+	if updated == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+	_ = resp.WriteEntity(updated)
+}
+
+func (r *pipelineAdminRouter) deletePlugin(req *restful.Request, resp *restful.Response) {
+	id, err := pluginID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if err := r.services.Pipeline.DeletePlugin(req.Request.Context(), id); err != nil {
+		writeError(resp, pluginErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func pluginID(req *restful.Request) (int64, error) {
+	id, err := strconv.ParseInt(req.PathParameter("plugin_id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidPluginID
+	}
+	return id, nil
+}
+
+func pluginErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pipelinesvc.ErrPluginInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, pipelinesvc.ErrPluginExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,34 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authsvc "github.com/thepenn/devsys/service/auth"
+)
+
+// checkRunPriority lets anyone run with a priority up to model.TaskPriorityUserMax and only
+// admins above it; like admin routes, API tokens never count as admin. It returns the
+// status to answer with when the priority is refused.
+func (r *repoRouter) checkRunPriority(req *restful.Request, claims *authsvc.SessionClaims, priority int) (int, error) {
+	if priority < model.TaskPriorityMin || priority > model.TaskPriorityMax {
+		return http.StatusBadRequest, fmt.Errorf("priority must be between %d and %d", model.TaskPriorityMin, model.TaskPriorityMax)
+	}
+	if priority <= model.TaskPriorityUserMax {
+		return 0, nil
+	}
+	if claims.APIToken() {
+		return http.StatusForbidden, fmt.Errorf("API tokens cannot use priorities above %d", model.TaskPriorityUserMax)
+	}
+	user, err := r.services.User.FindByID(req.Request.Context(), claims.UserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if user == nil || (!user.Admin && !r.services.User.IsSuperAdmin(user)) {
+		return http.StatusForbidden, fmt.Errorf("only administrators can use priorities above %d", model.TaskPriorityUserMax)
+	}
+	return 0, nil
+}
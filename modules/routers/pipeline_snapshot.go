@@ -0,0 +1,62 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+)
+
+func (r *repoRouter) registerSnapshotRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/snapshot").To(r.getPipelineSnapshot).
+		Doc("Get the definition, revision and variables a pipeline run was triggered with; secret-looking values are masked").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.PathParameter("pipeline_id", "pipeline id").DataType("integer")).
+		Produces(restful.MIME_JSON).
+		Writes(model.PipelineSnapshot{}).
+		Returns(http.StatusOK, "snapshot", model.PipelineSnapshot{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "snapshot not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) getPipelineSnapshot(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	pipelineID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("pipeline_id")), 10, 64)
+	if err != nil || pipelineID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid pipeline id"))
+		return
+	}
+
+	snapshot, err := r.services.Pipeline.GetPipelineSnapshot(req.Request.Context(), repo.ID, pipelineID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if snapshot == nil {
+		writeError(resp, http.StatusNotFound, errors.New("snapshot not found"))
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, snapshot)
+}
@@ -0,0 +1,199 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+const (
+	provenanceAlgorithm       = "ed25519"
+	headerProvenanceKeyID     = "X-Provenance-Key-Id"
+	headerProvenanceSignature = "X-Provenance-Signature"
+)
+
+type provenanceSignatureResponse struct {
+	PipelineID int64  `json:"pipeline_id"`
+	KeyID      string `json:"key_id"`
+	Algorithm  string `json:"algorithm"`
+	Signature  string `json:"signature"`
+	Created    int64  `json:"created"`
+}
+
+type provenanceVerifyRequest struct {
+	Document  json.RawMessage `json:"document"`
+	KeyID     string          `json:"key_id"`
+	Signature string          `json:"signature"`
+}
+
+type provenanceVerifyResponse struct {
+	Valid bool   `json:"valid"`
+	KeyID string `json:"key_id"`
+	Error string `json:"error,omitempty"`
+}
+
+type provenanceKeysResponse struct {
+	Algorithm string            `json:"algorithm"`
+	Keys      map[string]string `json:"keys"`
+}
+
+func (r *repoRouter) registerProvenanceRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/provenance").To(r.getPipelineProvenance).
+		Doc("Download the signed build provenance of a successful pipeline run; the detached signature is returned in the X-Provenance-* headers").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "in-toto statement", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/provenance.sig").To(r.getPipelineProvenanceSignature).
+		Doc("Get the detached signature of a pipeline run provenance").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes(provenanceSignatureResponse{}).
+		Returns(http.StatusOK, "signature", provenanceSignatureResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/provenance/verify").To(r.verifyPipelineProvenance).
+		Doc("Verify a provenance document against its detached signature").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(provenanceVerifyRequest{}).
+		Writes(provenanceVerifyResponse{}).
+		Returns(http.StatusOK, "verification result", provenanceVerifyResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusServiceUnavailable, "provenance disabled", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/provenance/keys").To(r.listProvenanceKeys).
+		Doc("List the public keys accepted for provenance verification").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes(provenanceKeysResponse{}).
+		Returns(http.StatusOK, "keys", provenanceKeysResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusServiceUnavailable, "provenance disabled", errorResponse{}))
+}
+
+func (r *repoRouter) getPipelineProvenance(req *restful.Request, resp *restful.Response) {
+	record, ok := r.provenanceFromRequest(req, resp)
+	if !ok {
+		return
+	}
+	resp.Header().Set(headerProvenanceKeyID, record.KeyID)
+	resp.Header().Set(headerProvenanceSignature, record.Signature)
+	resp.Header().Set("Content-Type", restful.MIME_JSON)
+	resp.Header().Set("Content-Disposition", "attachment; filename=provenance-"+strconv.FormatInt(record.PipelineID, 10)+".json")
+	resp.WriteHeader(http.StatusOK)
+	_, _ = resp.Write(record.Document)
+}
+
+func (r *repoRouter) getPipelineProvenanceSignature(req *restful.Request, resp *restful.Response) {
+	record, ok := r.provenanceFromRequest(req, resp)
+	if !ok {
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, provenanceSignatureResponse{
+		PipelineID: record.PipelineID,
+		KeyID:      record.KeyID,
+		Algorithm:  provenanceAlgorithm,
+		Signature:  record.Signature,
+		Created:    record.Created,
+	})
+}
+
+func (r *repoRouter) verifyPipelineProvenance(req *restful.Request, resp *restful.Response) {
+	if _, ok := authmw.FromContext(req.Request.Context()); !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	var body provenanceVerifyRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if len(body.Document) == 0 || strings.TrimSpace(body.Signature) == "" {
+		writeError(resp, http.StatusBadRequest, errors.New("document and signature are required"))
+		return
+	}
+
+	err := r.services.Pipeline.VerifyProvenance(body.Document, strings.TrimSpace(body.KeyID), strings.TrimSpace(body.Signature))
+	if errors.Is(err, pipelinesvc.ErrProvenanceDisabled) {
+		writeError(resp, http.StatusServiceUnavailable, err)
+		return
+	}
+	result := provenanceVerifyResponse{Valid: err == nil, KeyID: strings.TrimSpace(body.KeyID)}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+func (r *repoRouter) listProvenanceKeys(req *restful.Request, resp *restful.Response) {
+	if _, ok := authmw.FromContext(req.Request.Context()); !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	keys := r.services.Pipeline.ProvenancePublicKeys()
+	if keys == nil {
+		writeError(resp, http.StatusServiceUnavailable, pipelinesvc.ErrProvenanceDisabled)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, provenanceKeysResponse{Algorithm: provenanceAlgorithm, Keys: keys})
+}
+
+// provenanceFromRequest loads the provenance addressed by the route and writes the error
+// response when it cannot be served.
+func (r *repoRouter) provenanceFromRequest(req *restful.Request, resp *restful.Response) (*model.PipelineProvenance, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return nil, false
+	}
+
+	pipelineID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("pipeline_id")), 10, 64)
+	if err != nil || pipelineID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid pipeline id"))
+		return nil, false
+	}
+
+	record, err := r.services.Pipeline.GetPipelineProvenance(req.Request.Context(), repo.ID, pipelineID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if record == nil {
+		writeError(resp, http.StatusNotFound, errors.New("provenance not found"))
+		return nil, false
+	}
+	return record, true
+}
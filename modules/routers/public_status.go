@@ -0,0 +1,218 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/model"
+	ratelimitmw "github.com/thepenn/devsys/routers/middleware/ratelimit"
+	"github.com/thepenn/devsys/service"
+)
+
+const (
+	// publicStatusRateLimit is how many public status requests a client IP may make per
+	// publicStatusRateWindow.
+	publicStatusRateLimit  = 60
+	publicStatusRateWindow = time.Minute
+)
+
+var errPublicStatusNotFound = errors.New("repository not found")
+
+// publicPipelineRun is the status of a run as served without authentication: no logs,
+// variables, env or authors, and the commit message only when the repository allows it.
+type publicPipelineRun struct {
+	ID       int64              `json:"id"`
+	Number   int64              `json:"number"`
+	Status   model.StatusValue  `json:"status"`
+	Event    model.WebhookEvent `json:"event"`
+	Branch   string             `json:"branch"`
+	Commit   string             `json:"commit"`
+	Message  string             `json:"message,omitempty"`
+	Created  int64              `json:"created"`
+	Started  int64              `json:"started,omitempty"`
+	Finished int64              `json:"finished,omitempty"`
+}
+
+type publicPipelineRunList struct {
+	Items   []publicPipelineRun `json:"items"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Total   int64               `json:"total"`
+}
+
+type publicPipelineStep struct {
+	Name     string            `json:"name"`
+	State    model.StatusValue `json:"state"`
+	Started  int64             `json:"started,omitempty"`
+	Finished int64             `json:"finished,omitempty"`
+}
+
+type publicPipelineRunDetail struct {
+	publicPipelineRun
+	Steps []publicPipelineStep `json:"steps"`
+}
+
+// publicStatusRouter serves the run status of repositories with public_status set. Its
+// routes skip the auth filter and the repository role checks; everything else stays behind
+// them.
+type publicStatusRouter struct {
+	services       *service.Services
+	trustedProxies []string
+}
+
+func newPublicStatusRouter(cfg *config.Config, services *service.Services) *publicStatusRouter {
+	r := &publicStatusRouter{services: services}
+	if cfg != nil {
+		r.trustedProxies = cfg.Server.TrustedProxies
+	}
+	return r
+}
+
+func (r *publicStatusRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	if r.services == nil || r.services.Pipeline == nil {
+		return nil
+	}
+
+	limiter := ratelimitmw.New(r.services.Cache, "public-status", publicStatusRateLimit, publicStatusRateWindow,
+		ratelimitmw.WithTrustedProxies(r.trustedProxies))
+	ws := register("/public/repos")
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+	ws.Filter(limiter.Filter)
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs").To(r.listRuns).
+		Doc("免登录列出公开状态仓库的运行记录，不含日志与变量").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("repo_id", "repository id").DataType("integer")).
+		Param(ws.QueryParameter("branch", "only runs of this branch").DataType("string")).
+		Param(ws.QueryParameter("page", "page number, from 1").DataType("integer")).
+		Param(ws.QueryParameter("per_page", "runs per page, at most 100").DataType("integer")).
+		Writes(publicPipelineRunList{}).
+		Returns(http.StatusOK, "runs", publicPipelineRunList{}).
+		Returns(http.StatusNotFound, "repository not found or status not public", errorResponse{}).
+		Returns(http.StatusTooManyRequests, "rate limited", nil))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}").To(r.getRun).
+		Doc("免登录查看公开状态仓库的运行状态及步骤").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Param(ws.PathParameter("repo_id", "repository id").DataType("integer")).
+		Param(ws.PathParameter("pipeline_id", "pipeline id").DataType("integer")).
+		Writes(publicPipelineRunDetail{}).
+		Returns(http.StatusOK, "run", publicPipelineRunDetail{}).
+		Returns(http.StatusNotFound, "run not found or status not public", errorResponse{}).
+		Returns(http.StatusTooManyRequests, "rate limited", nil))
+
+	return []*restful.WebService{ws}
+}
+
+func (r *publicStatusRouter) listRuns(req *restful.Request, resp *restful.Response) {
+	repoID, cfg, ok := r.publicRepo(req, resp)
+	if !ok {
+		return
+	}
+	page, _ := strconv.Atoi(req.QueryParameter("page"))
+	perPage, _ := strconv.Atoi(req.QueryParameter("per_page"))
+	page = max(page, 1)
+	if perPage <= 0 {
+		perPage = 20
+	}
+	perPage = min(perPage, 100)
+	filter := model.PipelineFilter{Branch: req.QueryParameter("branch")}
+
+	items, total, err := r.services.Pipeline.ListPipelinesByRepo(req.Request.Context(), repoID, page, perPage, filter)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	body := publicPipelineRunList{
+		Items:   make([]publicPipelineRun, 0, len(items)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for _, item := range items {
+		if item != nil {
+			body.Items = append(body.Items, newPublicPipelineRun(item, cfg.PublicMessages))
+		}
+	}
+	_ = resp.WriteEntity(body)
+}
+
+func (r *publicStatusRouter) getRun(req *restful.Request, resp *restful.Response) {
+	repoID, cfg, ok := r.publicRepo(req, resp)
+	if !ok {
+		return
+	}
+	pipelineID, err := strconv.ParseInt(req.PathParameter("pipeline_id"), 10, 64)
+	if err != nil || pipelineID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("pipeline id is invalid"))
+		return
+	}
+	detail, err := r.services.Pipeline.GetPipelineRunDetail(req.Request.Context(), repoID, pipelineID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if detail == nil || detail.Pipeline == nil {
+		writeError(resp, http.StatusNotFound, errors.New("pipeline not found"))
+		return
+	}
+	body := publicPipelineRunDetail{
+		publicPipelineRun: newPublicPipelineRun(detail.Pipeline, cfg.PublicMessages),
+		Steps:             make([]publicPipelineStep, 0, len(detail.Steps)),
+	}
+	for _, step := range detail.Steps {
+		body.Steps = append(body.Steps, publicPipelineStep{
+			Name:     step.Name,
+			State:    step.State,
+			Started:  step.Started,
+			Finished: step.Finished,
+		})
+	}
+	_ = resp.WriteEntity(body)
+}
+
+// publicRepo resolves the repository of the request and its settings. Repositories that do
+// not exist and those with a private status both answer 404, so the API does not reveal
+// which repositories exist.
+func (r *publicStatusRouter) publicRepo(req *restful.Request, resp *restful.Response) (int64, *model.RepoPipelineConfig, bool) {
+	repoID, err := strconv.ParseInt(req.PathParameter("repo_id"), 10, 64)
+	if err != nil || repoID <= 0 {
+		writeError(resp, http.StatusNotFound, errPublicStatusNotFound)
+		return 0, nil, false
+	}
+	cfg, err := r.services.Pipeline.PublicStatusSettings(req.Request.Context(), repoID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return 0, nil, false
+	}
+	if cfg == nil {
+		writeError(resp, http.StatusNotFound, errPublicStatusNotFound)
+		return 0, nil, false
+	}
+	return repoID, cfg, true
+}
+
+func newPublicPipelineRun(pipeline *model.Pipeline, withMessage bool) publicPipelineRun {
+	run := publicPipelineRun{
+		ID:       pipeline.ID,
+		Number:   pipeline.Number,
+		Status:   pipeline.Status,
+		Event:    pipeline.Event,
+		Branch:   pipeline.Branch,
+		Commit:   pipeline.Commit,
+		Created:  pipeline.Created,
+		Started:  pipeline.Started,
+		Finished: pipeline.Finished,
+	}
+	if withMessage {
+		run.Message = pipeline.Message
+	}
+	return run
+}
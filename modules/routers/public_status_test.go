@@ -0,0 +1,141 @@
+package routers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/cache"
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+// newPublicStatusContainer serves the public status routes over a database holding a
+// repository with a public status (1), one with a private status (2) and a run of each.
+func newPublicStatusContainer(t *testing.T, cfg *config.Config) *restful.Container {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.RepoPipelineConfig{}, &model.Pipeline{})
+	for _, repo := range []*model.Repo{
+		{ID: 1, ForgeRemoteID: "manual-1", Owner: "team", Name: "public", FullName: "team/public"},
+		{ID: 2, ForgeRemoteID: "manual-2", Owner: "team", Name: "private", FullName: "team/private"},
+	} {
+		if err := db.GetDB().Create(repo).Error; err != nil {
+			t.Fatal(err)
+		}
+		settings := &model.RepoPipelineConfig{RepoID: repo.ID, PublicStatus: repo.ID == 1}
+		if err := db.GetDB().Create(settings).Error; err != nil {
+			t.Fatal(err)
+		}
+		run := &model.Pipeline{RepoID: repo.ID, Number: 1, Status: model.StatusSuccess, Branch: "main", Message: "secret message"}
+		if err := db.GetDB().Create(run).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := cache.New(0)
+	t.Cleanup(store.Close)
+	services := &service.Services{
+		Pipeline: pipelineService.NewService(db, queue.New(1), store),
+		Cache:    store,
+	}
+	container := restful.NewContainer()
+	register := func(path string) *restful.WebService {
+		ws := new(restful.WebService)
+		ws.Path(path)
+		return ws
+	}
+	for _, ws := range newPublicStatusRouter(cfg, services).router(register, nil) {
+		container.Add(ws)
+	}
+	return container
+}
+
+func publicStatusRequest(container *restful.Container, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPublicStatusHidesPrivateRepositories(t *testing.T) {
+	container := newPublicStatusContainer(t, nil)
+
+	rec := publicStatusRequest(container, "/public/repos/1/pipeline/runs", "192.0.2.1:4000", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("public repository: status %d, body %s", rec.Code, rec.Body)
+	}
+	var list publicPipelineRunList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || len(list.Items) != 1 || list.Items[0].Message != "" {
+		t.Fatalf("public repository runs = %+v, want one run without its message", list)
+	}
+
+	for _, path := range []string{
+		"/public/repos/2/pipeline/runs",
+		"/public/repos/2/pipeline/runs/2",
+		"/public/repos/3/pipeline/runs",
+		"/public/repos/x/pipeline/runs",
+	} {
+		rec := publicStatusRequest(container, path, "192.0.2.1:4000", "")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestPublicStatusRateLimit(t *testing.T) {
+	container := newPublicStatusContainer(t, nil)
+	path := "/public/repos/1/pipeline/runs"
+
+	for i := 0; i < publicStatusRateLimit; i++ {
+		// a client cannot reset its count by forging X-Forwarded-For
+		forged := fmt.Sprintf("198.51.100.%d", i)
+		if rec := publicStatusRequest(container, path, "192.0.2.1:4000", forged); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, rec.Code)
+		}
+	}
+	rec := publicStatusRequest(container, path, "192.0.2.1:4000", "198.51.100.200")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("429 without Retry-After")
+	}
+	if rec := publicStatusRequest(container, path, "192.0.2.2:4000", ""); rec.Code != http.StatusOK {
+		t.Errorf("other client: status %d, want 200", rec.Code)
+	}
+}
+
+func TestPublicStatusRateLimitBehindTrustedProxy(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	container := newPublicStatusContainer(t, cfg)
+	path := "/public/repos/1/pipeline/runs"
+
+	for i := 0; i < publicStatusRateLimit; i++ {
+		if rec := publicStatusRequest(container, path, "10.0.0.5:4000", "203.0.113.7"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, rec.Code)
+		}
+	}
+	if rec := publicStatusRequest(container, path, "10.0.0.5:4000", "203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: status %d, want 429", rec.Code)
+	}
+	// other clients behind the same proxy keep their own count
+	if rec := publicStatusRequest(container, path, "10.0.0.5:4000", "203.0.113.8"); rec.Code != http.StatusOK {
+		t.Fatalf("other client behind the proxy: status %d, want 200", rec.Code)
+	}
+}
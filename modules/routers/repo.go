@@ -3,12 +3,15 @@ package routers
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 
 	"github.com/thepenn/devsys/model"
@@ -16,6 +19,8 @@ import (
 	"github.com/thepenn/devsys/service"
 	authsvc "github.com/thepenn/devsys/service/auth"
 	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+	reposvc "github.com/thepenn/devsys/service/repo"
 )
 
 type repoRouter struct {
@@ -31,18 +36,52 @@ type repoListResponse struct {
 }
 
 type pipelineConfigResponse struct {
-	Content   string `json:"content"`
-	UpdatedAt int64  `json:"updated_at"`
+	Content   string   `json:"content"`
+	UpdatedAt int64    `json:"updated_at"`
+	Warnings  []string `json:"warnings,omitempty"`
+	// Version is the revision of Content, 0 for configs not saved since revisions exist.
+	Version int `json:"version"`
 }
 
 type pipelineConfigRequest struct {
 	Content string `json:"content"`
+	// Message describes the change in the config history.
+	Message string `json:"message,omitempty"`
+}
+
+type pipelineConfigImportResponse struct {
+	pipelineConfigResponse
+	SettingsImported bool                      `json:"settings_imported"`
+	Settings         *pipelineSettingsResponse `json:"settings,omitempty"`
+}
+
+type pipelineConfigValidationResponse struct {
+	Valid       bool              `json:"valid"`
+	Diagnostics []spec.Diagnostic `json:"diagnostics"`
+	// Error summarises the first error for clients that only read errorResponse.
+	Error string `json:"error,omitempty"`
+}
+
+type pipelineBootstrapResponse struct {
+	Stack   string   `json:"stack"`
+	Module  string   `json:"module,omitempty"`
+	Content string   `json:"content"`
+	Files   []string `json:"files"`
 }
 
 type pipelineRunRequest struct {
 	Branch    string            `json:"branch"`
 	Variables map[string]string `json:"variables"`
 	Commit    string            `json:"commit"`
+	// Ref runs a tag or another ref instead of Branch: refs/tags/v1.2.3 or the bare tag name.
+	Ref string `json:"ref,omitempty"`
+	// Priority orders the run in the queue, 0 by default; values above 10 need an admin.
+	Priority int `json:"priority,omitempty"`
+	// RunAfter holds the run back until this unix time.
+	RunAfter int64 `json:"run_after,omitempty"`
+	// ValidateBranch checks Branch against the forge first and rejects unknown branches
+	// with the closest names.
+	ValidateBranch bool `json:"validate_branch,omitempty"`
 }
 
 type pipelineRunResponse struct {
@@ -50,12 +89,22 @@ type pipelineRunResponse struct {
 	Number   int64             `json:"number"`
 	Status   model.StatusValue `json:"status"`
 	Branch   string            `json:"branch"`
+	Ref      string            `json:"ref"`
 	Created  int64             `json:"created"`
 	Finished int64             `json:"finished"`
 	Message  string            `json:"message"`
 	Author   string            `json:"author"`
 	Commit   string            `json:"commit"`
 	PrevCommit string          `json:"prev_commit"`
+	Warnings []string          `json:"warnings,omitempty"`
+	// ConfigHash identifies the config revision the run used; ConfigChangedSince is set
+	// when the repository config differs from it now.
+	ConfigHash         string `json:"config_hash,omitempty"`
+	ConfigVersion      int    `json:"config_version,omitempty"`
+	ConfigChangedSince bool   `json:"config_changed_since"`
+	// Progress is estimated from step duration baselines for running and blocked runs; it is
+	// null for other runs and when no step has a baseline yet.
+	Progress *pipelinesvc.PipelineProgress `json:"progress"`
 }
 
 type pipelineRunListResponse struct {
@@ -75,12 +124,24 @@ type pipelineRunDetailPipeline struct {
 	Number   int64             `json:"number"`
 	Status   model.StatusValue `json:"status"`
 	Branch   string            `json:"branch"`
+	Ref      string            `json:"ref"`
 	Commit   string            `json:"commit"`
 	Message  string            `json:"message"`
 	Author   string            `json:"author"`
 	Created  int64             `json:"created"`
 	Started  int64             `json:"started"`
 	Finished int64             `json:"finished"`
+
+	ConfigHash         string `json:"config_hash,omitempty"`
+	ConfigVersion      int    `json:"config_version,omitempty"`
+	ConfigChangedSince bool   `json:"config_changed_since"`
+	ConfigContent      string `json:"config_content,omitempty"`
+
+	// Outputs are the step outputs of the run by step name.
+	Outputs  map[string]map[string]string  `json:"outputs,omitempty"`
+	Progress *pipelinesvc.PipelineProgress `json:"progress"`
+	// SoftFailures counts the steps that failed with ignore_failure set.
+	SoftFailures int `json:"soft_failures,omitempty"`
 }
 
 type pipelineWorkflowResponse struct {
@@ -105,6 +166,21 @@ type pipelineStepResponse struct {
 	Finished int64               `json:"finished"`
 	Logs     []pipelineStepLog   `json:"logs"`
 	Approval *model.StepApproval `json:"approval,omitempty"`
+	Outputs  map[string]string   `json:"outputs,omitempty"`
+	// Error is why the step failed; Failure classifies it as a command, infrastructure,
+	// timeout, canceled or approval_rejected failure.
+	Error   string                  `json:"error,omitempty"`
+	Failure model.StepFailureReason `json:"failure,omitempty"`
+	// SoftFailure marks a failed step with ignore_failure set, which did not fail the run.
+	SoftFailure bool `json:"soft_failure,omitempty"`
+	// LogTotal counts every line of the step; LogTruncated is set when Logs only holds the
+	// last of them and the rest has to be fetched from the step log endpoint.
+	LogTotal     int64 `json:"log_total"`
+	LogTruncated bool  `json:"log_truncated"`
+	// Baseline is the usual duration of steps with this name; DurationRatio compares this
+	// run with its median. Both are only set for successful steps with enough history.
+	Baseline      *pipelinesvc.StepDurationBaseline `json:"baseline,omitempty"`
+	DurationRatio float64                           `json:"duration_ratio,omitempty"`
 }
 
 type pipelineStepLog struct {
@@ -112,6 +188,24 @@ type pipelineStepLog struct {
 	Type    string `json:"type"`
 	Time    int64  `json:"time"`
 	Content string `json:"content"`
+	// Marker is the parsed command marker of a metadata line; DurationMs repeats the duration
+	// of an end marker.
+	Marker     *model.LogCommandMarker `json:"marker,omitempty"`
+	DurationMs int64                   `json:"duration_ms,omitempty"`
+}
+
+func newPipelineStepLog(entry *model.LogEntry) pipelineStepLog {
+	item := pipelineStepLog{
+		Line:    entry.Line,
+		Type:    logTypeString(entry.Type),
+		Time:    entry.Time,
+		Content: string(entry.Data),
+	}
+	if marker, ok := model.ParseLogCommandMarker(entry); ok {
+		item.Marker = marker
+		item.DurationMs = marker.DurationMs
+	}
+	return item
 }
 
 type approvalActionRequest struct {
@@ -120,24 +214,59 @@ type approvalActionRequest struct {
 }
 
 type pipelineSettingsResponse struct {
+	ConfigSource     string   `json:"config_source"`
+	ConfigFile       string   `json:"config_file"`
 	CleanupEnabled   bool     `json:"cleanup_enabled"`
 	RetentionDays    int      `json:"retention_days"`
 	MaxRecords       int      `json:"max_records"`
 	Dockerfile       string   `json:"dockerfile"`
 	DisallowParallel bool     `json:"disallow_parallel"`
 	CronSchedules    []string `json:"cron_schedules"`
+	StepCPU          string   `json:"step_cpu"`
+	StepMemory       string   `json:"step_memory"`
+	// ReportCommitStatus reports run states back to the forge as commit statuses.
+	ReportCommitStatus bool `json:"report_commit_status"`
+	// LogRetentionDays drops the logs of finished runs after that many days; 0 keeps them.
+	LogRetentionDays int `json:"log_retention_days"`
+	// PublicStatus serves the run status without authentication under /public;
+	// PublicMessages adds the commit messages to it.
+	PublicStatus   bool `json:"public_status"`
+	PublicMessages bool `json:"public_messages"`
 }
 
 type pipelineSettingsRequest struct {
+	ConfigSource     string   `json:"config_source"`
+	ConfigFile       string   `json:"config_file"`
 	CleanupEnabled   bool     `json:"cleanup_enabled"`
 	RetentionDays    int      `json:"retention_days"`
 	MaxRecords       int      `json:"max_records"`
 	Dockerfile       string   `json:"dockerfile"`
 	DisallowParallel bool     `json:"disallow_parallel"`
 	CronSchedules    []string `json:"cron_schedules"`
+	StepCPU          string   `json:"step_cpu"`
+	StepMemory       string   `json:"step_memory"`
+	// ReportCommitStatus reports run states back to the forge as commit statuses.
+	ReportCommitStatus bool `json:"report_commit_status"`
+	// LogRetentionDays drops the logs of finished runs after that many days; 0 keeps them.
+	LogRetentionDays int `json:"log_retention_days"`
+	// PublicStatus serves the run status without authentication under /public;
+	// PublicMessages adds the commit messages to it.
+	PublicStatus   bool `json:"public_status"`
+	PublicMessages bool `json:"public_messages"`
 }
 
-var errRepoNotFound = errors.New("repository not found")
+var (
+	errRepoNotFound  = errors.New("repository not found")
+	errRepoForbidden = errors.New("insufficient repository role")
+)
+
+// repoRoleMetadata overrides the repository role a route requires.
+const repoRoleMetadata = "repo_role"
+
+const (
+	pipelineConfigYAMLMime     = "application/x-yaml"
+	pipelineConfigImportMaxLen = 1 << 20
+)
 
 func newRepoRouter(services *service.Services, authMW *authmw.Middleware) *repoRouter {
 	return &repoRouter{services: services, authMW: authMW}
@@ -146,6 +275,7 @@ func newRepoRouter(services *service.Services, authMW *authmw.Middleware) *repoR
 func (r *repoRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
 	ws := register("/repos")
 	ws.Filter(r.authMW.Authenticate)
+	requirePipeline := requireCapability(r.services, model.CapabilityPipeline)
 
 	ws.Route(ws.GET("").To(r.list).
 		Doc("List repositories accessible to the current user").
@@ -156,34 +286,54 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}))
 
 	ws.Route(ws.POST("/sync").To(r.sync).
-		Doc("Trigger synchronization of Git repositories for the current user").
+		Doc("Synchronize the Git repositories of the current user and report per-repository results").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(authmw.TokenScope, model.APITokenScopeRepoSync).
+		Writes(reposvc.SyncReport{}).
 		Filter(r.authMW.RequireAuth).
-		Returns(http.StatusNoContent, "sync triggered", nil).
+		Returns(http.StatusOK, "sync report", reposvc.SyncReport{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
 		Returns(http.StatusInternalServerError, "sync failed", errorResponse{}))
 
 	ws.Route(ws.POST("/{repo_id}/sync").To(r.syncOne).
 		Doc("Synchronize a single repository by forge remote id").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(authmw.TokenScope, model.APITokenScopeRepoSync).
+		Writes(reposvc.SyncReport{}).
 		Filter(r.authMW.RequireAuth).
-		Returns(http.StatusNoContent, "sync triggered", nil).
+		Returns(http.StatusOK, "sync report", reposvc.SyncReport{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
 		Returns(http.StatusBadRequest, "invalid id", errorResponse{}).
 		Returns(http.StatusInternalServerError, "sync failed", errorResponse{}))
 
-	ws.Route(ws.GET("/{repo_id}/pipeline/runs").To(r.listPipelineRuns).
+	ws.Route(pipelineFilterParams(ws, ws.GET("/{repo_id}/pipeline/runs").To(r.listPipelineRuns).
 		Doc("List pipelines for repository").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline)).
+		Param(ws.QueryParameter("page", "page number").DataType("integer")).
+		Param(ws.QueryParameter("per_page", "page size, at most 100").DataType("integer")).
 		Returns(http.StatusOK, "pipeline runs", pipelineRunListResponse{}).
+		Returns(http.StatusBadRequest, "invalid filter", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(pipelineFilterParams(ws, ws.GET("/{repo_id}/pipeline/runs/latest").To(r.latestPipelineRun).
+		Doc("Get the newest pipeline run matching the filter, e.g. the last successful run of a branch").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline)).
+		Returns(http.StatusOK, "pipeline run", pipelineRunResponse{}).
+		Returns(http.StatusBadRequest, "invalid filter", errorResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "no matching run", errorResponse{}).
 		Returns(http.StatusInternalServerError, "error", errorResponse{}))
 
 	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}").To(r.getPipelineRun).
 		Doc("Get detailed information for a pipeline run").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Returns(http.StatusOK, "pipeline run", pipelineRunDetailResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
 		Returns(http.StatusNotFound, "not found", errorResponse{}).
@@ -192,7 +342,9 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 	ws.Route(ws.POST("/{repo_id}/pipeline/runs/{pipeline_id}/steps/{step_id}/approval").To(r.submitPipelineApproval).
 		Doc("Submit an approval decision for a pipeline step").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Reads(approvalActionRequest{}).
@@ -208,6 +360,7 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Doc("Get pipeline configuration for repository").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Returns(http.StatusOK, "config", pipelineConfigResponse{}).
 		Returns(http.StatusNotFound, "not found", errorResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
@@ -217,6 +370,7 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Doc("Create or update pipeline configuration for repository").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Reads(pipelineConfigRequest{}).
@@ -225,10 +379,61 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
 		Returns(http.StatusInternalServerError, "error", errorResponse{}))
 
+	ws.Route(ws.POST("/{repo_id}/pipeline/config/validate").To(r.validatePipelineConfig).
+		Doc("Validate pipeline configuration and report diagnostics without saving it").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(pipelineConfigRequest{}).
+		Returns(http.StatusOK, "diagnostics", pipelineConfigValidationResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/config/bootstrap").To(r.bootstrapPipelineConfig).
+		Doc("Propose a starter pipeline configuration detected from repository files").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "proposed config", pipelineBootstrapResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusBadGateway, "forge request failed", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/pipeline/config/export.yaml").To(r.exportPipelineConfig).
+		Doc("Download pipeline configuration with settings encoded as a commented footer").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(pipelineConfigYAMLMime, restful.MIME_JSON).
+		Returns(http.StatusOK, "config yaml", "").
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/pipeline/config/import.yaml").To(r.importPipelineConfig).
+		Doc("Import a pipeline configuration exported by export.yaml; files without the settings footer import as config only").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(pipelineConfigYAMLMime, "text/plain", restful.MIME_OCTET).
+		Produces(restful.MIME_JSON).
+		Returns(http.StatusOK, "imported", pipelineConfigImportResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
 	ws.Route(ws.GET("/{repo_id}/pipeline/settings").To(r.getPipelineSettings).
 		Doc("Get pipeline settings for repository").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Returns(http.StatusOK, "settings", pipelineSettingsResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
 		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
@@ -238,6 +443,7 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Doc("Update pipeline settings for repository").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Reads(pipelineSettingsRequest{}).
@@ -249,19 +455,27 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 	ws.Route(ws.POST("/{repo_id}/pipeline/run").To(r.triggerPipeline).
 		Doc("Trigger a manual pipeline run").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(authmw.TokenScope, model.APITokenScopePipelineTrigger).
+		Metadata(repoRoleMetadata, model.RepoRoleDeveloper).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON).
 		Reads(pipelineRunRequest{}).
 		Returns(http.StatusOK, "pipeline", pipelineRunResponse{}).
-		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusBadRequest, "invalid request, or a validated branch that does not exist with its close matches", branchNotFoundResponse{}).
+		Returns(http.StatusConflict, "repository deactivated", errorResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusBadGateway, "forge request failed while validating the branch", errorResponse{}).
 		Returns(http.StatusInternalServerError, "error", errorResponse{}))
 
 	ws.Route(ws.POST("/{repo_id}/pipeline/runs/{pipeline_id}/cancel").To(r.cancelPipelineRun).
 		Doc("Cancel a running pipeline").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(authmw.TokenScope, model.APITokenScopePipelineTrigger).
+		Metadata(repoRoleMetadata, model.RepoRoleDeveloper).
 		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
 		Returns(http.StatusNoContent, "cancelled", nil).
 		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
 		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
@@ -269,6 +483,34 @@ func (r *repoRouter) router(register func(string) *restful.WebService, tags []st
 		Returns(http.StatusConflict, "cannot cancel", errorResponse{}).
 		Returns(http.StatusInternalServerError, "error", errorResponse{}))
 
+	ws.Route(ws.POST("/{repo_id}/pipeline/deactivate").To(r.deactivatePipeline).
+		Doc("Disable pipelines for repository and remove its forge webhook").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Returns(http.StatusNoContent, "deactivated", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	r.registerSecretRoutes(ws, tags, requirePipeline)
+	r.registerProvenanceRoutes(ws, tags, requirePipeline)
+	r.registerSnapshotRoutes(ws, tags, requirePipeline)
+	r.registerArtifactRoutes(ws, tags, requirePipeline)
+	r.registerStepLogRoutes(ws, tags, requirePipeline)
+	r.registerNotificationRoutes(ws, tags, requirePipeline)
+	r.registerInsightRoutes(ws, tags, requirePipeline)
+	r.registerCronRoutes(ws, tags, requirePipeline)
+	r.registerConfigHistoryRoutes(ws, tags, requirePipeline)
+	r.registerBundleRoutes(ws, tags, requirePipeline)
+	r.registerMemberRoutes(ws, tags)
+	r.registerVariableRoutes(ws, tags)
+	r.registerRefRoutes(ws, tags)
+	r.registerEnvTemplateRoutes(ws, tags, requirePipeline)
+	r.registerK8sTargetRoutes(ws, tags)
+	r.registerLifecycleRoutes(ws, tags)
+	r.registerImportRoutes(ws, tags)
+
 	return []*restful.WebService{ws}
 }
 
@@ -327,18 +569,20 @@ func (r *repoRouter) listPipelineRuns(req *restful.Request, resp *restful.Respon
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
 
+	filter, err := parsePipelineFilter(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
 	page, _ := strconv.Atoi(req.QueryParameter("page"))
 	perPage, _ := strconv.Atoi(req.QueryParameter("per_page"))
 
-	items, total, err := r.services.Pipeline.ListPipelinesByRepo(req.Request.Context(), repo.ID, page, perPage)
+	items, total, err := r.services.Pipeline.ListPipelinesByRepo(req.Request.Context(), repo.ID, page, perPage, filter)
 	if err != nil {
 		writeError(resp, http.StatusInternalServerError, err)
 		return
@@ -363,6 +607,17 @@ func (r *repoRouter) listPipelineRuns(req *restful.Request, resp *restful.Respon
 		lastBranchCommit[branchKey] = item.Commit
 	}
 
+	currentConfigHash, err := r.services.Pipeline.CurrentConfigHash(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	progress, err := r.services.Pipeline.PipelinesProgress(req.Request.Context(), repo.ID, items)
+	if err != nil {
+		log.Warn().Err(err).Int64("repo_id", repo.ID).Msg("failed to estimate pipeline progress")
+	}
+
 	response := pipelineRunListResponse{
 		Items:   make([]pipelineRunResponse, 0, len(items)),
 		Page:    page,
@@ -375,12 +630,18 @@ func (r *repoRouter) listPipelineRuns(req *restful.Request, resp *restful.Respon
 			Number:   item.Number,
 			Status:   item.Status,
 			Branch:   item.Branch,
+			Ref:      item.Ref,
 			Created:  item.Created,
 			Finished: item.Finished,
 			Message:  item.Message,
 			Author:   item.Author,
 			Commit:   item.Commit,
 			PrevCommit: prevCommitMap[item.ID],
+
+			ConfigHash:         item.ConfigHash,
+			ConfigVersion:      item.ConfigVersion,
+			ConfigChangedSince: pipelinesvc.ConfigChangedSince(item, currentConfigHash),
+			Progress:           progress[item.ID],
 		})
 	}
 
@@ -393,11 +654,12 @@ func (r *repoRouter) sync(req *restful.Request, resp *restful.Response) {
 		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
 		return
 	}
-	if err := r.services.Auth.SyncRepositories(req.Request.Context(), claims.UserID); err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+	report, err := r.services.Auth.SyncRepositories(req.Request.Context(), claims.UserID)
+	if err != nil {
+		writeError(resp, syncErrorStatus(err), err)
 		return
 	}
-	resp.WriteHeader(http.StatusNoContent)
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, report)
 }
 
 func (r *repoRouter) syncOne(req *restful.Request, resp *restful.Response) {
@@ -411,11 +673,21 @@ func (r *repoRouter) syncOne(req *restful.Request, resp *restful.Response) {
 		writeError(resp, http.StatusBadRequest, errors.New("missing repository id"))
 		return
 	}
-	if err := r.services.Auth.SyncRepository(req.Request.Context(), claims.UserID, repoID); err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+	report, err := r.services.Auth.SyncRepository(req.Request.Context(), claims.UserID, repoID)
+	if err != nil {
+		writeError(resp, syncErrorStatus(err), err)
 		return
 	}
-	resp.WriteHeader(http.StatusNoContent)
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, report)
+}
+
+// syncErrorStatus answers 401 when the forge token can no longer be refreshed, so clients
+// ask the user to log in again.
+func syncErrorStatus(err error) int {
+	if errors.Is(err, authsvc.ErrReauthRequired) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
 }
 
 func (r *repoRouter) getPipelineRun(req *restful.Request, resp *restful.Response) {
@@ -426,10 +698,7 @@ func (r *repoRouter) getPipelineRun(req *restful.Request, resp *restful.Response
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -454,21 +723,19 @@ func (r *repoRouter) getPipelineRun(req *restful.Request, resp *restful.Response
 		writeError(resp, http.StatusNotFound, errors.New("pipeline run not found"))
 		return
 	}
-	decorateApprovalPermissions(detail, claims.Login)
+	groups := r.approverGroups(req, repo.ID)
+	decorateApprovalPermissions(detail, claims.Login, groups)
+	baselines, err := r.services.Pipeline.StepDurationBaselines(req.Request.Context(), repo.ID)
+	if err != nil {
+		log.Warn().Err(err).Int64("repo_id", repo.ID).Msg("failed to load step duration baselines")
+	}
 
-	stepMap := make(map[int][]pipelineStepResponse)
-	for _, step := range detail.Steps {
-		decorateApprovalForUser(step, claims.Login)
+	stepResponse := func(step *model.Step) pipelineStepResponse {
 		logs := make([]pipelineStepLog, 0, len(detail.Logs[step.ID]))
 		for _, entry := range detail.Logs[step.ID] {
-			logs = append(logs, pipelineStepLog{
-				Line:    entry.Line,
-				Type:    logTypeString(entry.Type),
-				Time:    entry.Time,
-				Content: string(entry.Data),
-			})
+			logs = append(logs, newPipelineStepLog(&entry))
 		}
-		stepMap[step.PPID] = append(stepMap[step.PPID], pipelineStepResponse{
+		stepResp := pipelineStepResponse{
 			ID:       step.ID,
 			PID:      step.PID,
 			PPID:     step.PPID,
@@ -480,12 +747,28 @@ func (r *repoRouter) getPipelineRun(req *restful.Request, resp *restful.Response
 			Finished: step.Finished,
 			Logs:     logs,
 			Approval: step.Approval,
-		})
+			Outputs:  step.Outputs,
+			Error:    step.Error,
+			Failure:  step.FailureReason,
+
+			SoftFailure:  step.SoftFailed(),
+			LogTotal:     detail.LogTotals[step.ID],
+			LogTruncated: detail.LogTotals[step.ID] > int64(len(logs)),
+		}
+		if baseline := baselines[step.Name]; baseline != nil && step.State == model.StatusSuccess &&
+			step.Type != model.StepTypeApproval && step.Started > 0 && step.Finished >= step.Started {
+			stepResp.Baseline = baseline
+			stepResp.DurationRatio = baseline.DurationRatio(step.Finished - step.Started)
+		}
+		return stepResp
 	}
 
 	workflows := make([]pipelineWorkflowResponse, 0, len(detail.Workflows))
 	for _, wf := range detail.Workflows {
-		respSteps := stepMap[wf.PID]
+		var respSteps []pipelineStepResponse
+		for _, step := range wf.Children {
+			respSteps = append(respSteps, stepResponse(step))
+		}
 		workflows = append(workflows, pipelineWorkflowResponse{
 			ID:       wf.ID,
 			PID:      wf.PID,
@@ -502,12 +785,27 @@ func (r *repoRouter) getPipelineRun(req *restful.Request, resp *restful.Response
 		Number:   detail.Pipeline.Number,
 		Status:   detail.Pipeline.Status,
 		Branch:   detail.Pipeline.Branch,
+		Ref:      detail.Pipeline.Ref,
 		Commit:   detail.Pipeline.Commit,
 		Message:  detail.Pipeline.Message,
 		Author:   detail.Pipeline.Author,
 		Created:  detail.Pipeline.Created,
 		Started:  detail.Pipeline.Started,
 		Finished: detail.Pipeline.Finished,
+
+		ConfigHash:    detail.Pipeline.ConfigHash,
+		ConfigVersion: detail.Pipeline.ConfigVersion,
+		ConfigContent: detail.Pipeline.ConfigContent,
+		Outputs:       detail.Pipeline.Outputs,
+		Progress:      pipelinesvc.EstimateProgress(detail.Pipeline.Status, detail.Steps, baselines, time.Now().Unix()),
+	}
+	if currentConfigHash, err := r.services.Pipeline.CurrentConfigHash(req.Request.Context(), repo.ID); err == nil {
+		runResp.ConfigChangedSince = pipelinesvc.ConfigChangedSince(detail.Pipeline, currentConfigHash)
+	}
+	for _, step := range detail.Steps {
+		if step.SoftFailed() {
+			runResp.SoftFailures++
+		}
 	}
 
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineRunDetailResponse{
@@ -524,10 +822,7 @@ func (r *repoRouter) submitPipelineApproval(req *restful.Request, resp *restful.
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -551,6 +846,8 @@ func (r *repoRouter) submitPipelineApproval(req *restful.Request, resp *restful.
 		status := http.StatusInternalServerError
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			status = http.StatusNotFound
+		} else if errors.Is(err, pipelinesvc.ErrIllegalTransition) {
+			status = http.StatusConflict
 		} else {
 			errMsg := err.Error()
 			lowerMsg := strings.ToLower(errMsg)
@@ -576,7 +873,7 @@ func (r *repoRouter) submitPipelineApproval(req *restful.Request, resp *restful.
 		writeError(resp, http.StatusNotFound, fmt.Errorf("step not found"))
 		return
 	}
-	decorateApprovalForUser(step, claims.Login)
+	decorateApprovalForUser(step, claims.Login, r.approverGroups(req, repo.ID))
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, step)
 }
 
@@ -588,10 +885,7 @@ func (r *repoRouter) cancelPipelineRun(req *restful.Request, resp *restful.Respo
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -624,6 +918,27 @@ func (r *repoRouter) cancelPipelineRun(req *restful.Request, resp *restful.Respo
 	resp.WriteHeader(http.StatusNoContent)
 }
 
+func (r *repoRouter) deactivatePipeline(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	if err := r.services.Pipeline.DeactivateRepository(req.Request.Context(), repo); err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
 func (r *repoRouter) getPipelineConfig(req *restful.Request, resp *restful.Response) {
 	claims, ok := authmw.FromContext(req.Request.Context())
 	if !ok {
@@ -632,10 +947,7 @@ func (r *repoRouter) getPipelineConfig(req *restful.Request, resp *restful.Respo
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -649,6 +961,8 @@ func (r *repoRouter) getPipelineConfig(req *restful.Request, resp *restful.Respo
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineConfigResponse{
 		Content:   cfg.Content,
 		UpdatedAt: cfg.Updated,
+		Warnings:  pipelinesvc.PipelineConfigWarnings(cfg.Content, nil),
+		Version:   cfg.Version,
 	})
 }
 
@@ -660,10 +974,7 @@ func (r *repoRouter) updatePipelineConfig(req *restful.Request, resp *restful.Re
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -674,19 +985,21 @@ func (r *repoRouter) updatePipelineConfig(req *restful.Request, resp *restful.Re
 		return
 	}
 
-	cfg, err := r.services.Pipeline.UpsertPipelineConfig(req.Request.Context(), repo.ID, body.Content)
+	cfg, err := r.services.Pipeline.UpsertPipelineConfig(req.Request.Context(), repo.ID, body.Content, claims.Login, body.Message)
 	if err != nil {
-		writeError(resp, http.StatusBadRequest, err)
+		writePipelineConfigError(resp, err)
 		return
 	}
 
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineConfigResponse{
 		Content:   cfg.Content,
 		UpdatedAt: cfg.Updated,
+		Warnings:  pipelinesvc.PipelineConfigWarnings(cfg.Content, nil),
+		Version:   cfg.Version,
 	})
 }
 
-func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Response) {
+func (r *repoRouter) validatePipelineConfig(req *restful.Request, resp *restful.Response) {
 	claims, ok := authmw.FromContext(req.Request.Context())
 	if !ok {
 		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
@@ -694,10 +1007,87 @@ func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Respons
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	var body pipelineConfigRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	diagnostics, err := r.services.Pipeline.ValidatePipelineConfig(req.Request.Context(), repo.ID, body.Content)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, newPipelineConfigValidationResponse(diagnostics))
+}
+
+// writePipelineConfigError answers a rejected config with its diagnostics.
+func writePipelineConfigError(resp *restful.Response, err error) {
+	var cfgErr *pipelinesvc.PipelineConfigError
+	if errors.As(err, &cfgErr) {
+		body := newPipelineConfigValidationResponse(cfgErr.Diagnostics)
+		body.Error = cfgErr.Error()
+		_ = resp.WriteHeaderAndEntity(http.StatusBadRequest, body)
+		return
+	}
+	writeError(resp, http.StatusBadRequest, err)
+}
+
+func newPipelineConfigValidationResponse(diagnostics []spec.Diagnostic) pipelineConfigValidationResponse {
+	valid := true
+	for _, d := range diagnostics {
+		if d.Severity == spec.SeverityError {
+			valid = false
+			break
 		}
+	}
+	if diagnostics == nil {
+		diagnostics = []spec.Diagnostic{}
+	}
+	return pipelineConfigValidationResponse{Valid: valid, Diagnostics: diagnostics}
+}
+
+func (r *repoRouter) bootstrapPipelineConfig(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	proposal, err := r.services.Pipeline.BootstrapPipelineConfig(req.Request.Context(), repo, claims.UserID)
+	if err != nil {
+		writeError(resp, http.StatusBadGateway, err)
+		return
+	}
+
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, pipelineBootstrapResponse{
+		Stack:   string(proposal.Stack),
+		Module:  proposal.Module,
+		Content: proposal.Content,
+		Files:   proposal.Files,
+	})
+}
+
+func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -707,6 +1097,15 @@ func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Respons
 		writeError(resp, http.StatusBadRequest, err)
 		return
 	}
+	if status, err := r.checkRunPriority(req, claims, body.Priority); err != nil {
+		writeError(resp, status, err)
+		return
+	}
+	if branch := strings.TrimSpace(body.Branch); body.ValidateBranch && branch != "" && strings.TrimSpace(body.Ref) == "" {
+		if !r.validateRunBranch(req, resp, claims, repo, branch) {
+			return
+		}
+	}
 
 	cfg, err := r.services.Pipeline.EnsurePipelineConfig(req.Request.Context(), repo)
 	if err != nil {
@@ -718,14 +1117,26 @@ func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Respons
 		Branch:    strings.TrimSpace(body.Branch),
 		Variables: body.Variables,
 		Commit:    strings.TrimSpace(body.Commit),
+		Ref:       strings.TrimSpace(body.Ref),
+		Priority:  body.Priority,
+		RunAfter:  body.RunAfter,
 	}
 	if options.Variables == nil {
 		options.Variables = make(map[string]string)
 	}
 
 	pipeline, err := r.services.Pipeline.TriggerManualPipeline(req.Request.Context(), repo, claims.Login, options, cfg)
+	var cfgErr *pipelinesvc.PipelineConfigError
+	if errors.As(err, &cfgErr) {
+		writePipelineConfigError(resp, err)
+		return
+	}
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, pipelinesvc.ErrRepoInactive) {
+			status = http.StatusConflict
+		}
+		writeError(resp, status, err)
 		return
 	}
 
@@ -734,15 +1145,20 @@ func (r *repoRouter) triggerPipeline(req *restful.Request, resp *restful.Respons
 		Number:   pipeline.Number,
 		Status:   pipeline.Status,
 		Branch:   pipeline.Branch,
+		Ref:      pipeline.Ref,
 		Created:  pipeline.Created,
 		Finished: pipeline.Finished,
 		Message:  pipeline.Message,
 		Author:   pipeline.Author,
 		Commit:   pipeline.Commit,
+		Warnings: pipelinesvc.PipelineConfigWarnings(cfg.Content, options.Variables),
+
+		ConfigHash:    pipeline.ConfigHash,
+		ConfigVersion: pipeline.ConfigVersion,
 	})
 }
 
-func (r *repoRouter) getPipelineSettings(req *restful.Request, resp *restful.Response) {
+func (r *repoRouter) exportPipelineConfig(req *restful.Request, resp *restful.Response) {
 	claims, ok := authmw.FromContext(req.Request.Context())
 	if !ok {
 		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
@@ -750,10 +1166,114 @@ func (r *repoRouter) getPipelineSettings(req *restful.Request, resp *restful.Res
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	content, err := r.services.Pipeline.ExportPipelineConfig(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", pipelineConfigYAMLMime+"; charset=utf-8")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sanitizeExportFilename(repo.FullName)+".devsys.yaml"))
+	resp.WriteHeader(http.StatusOK)
+	_, _ = resp.Write([]byte(content))
+}
+
+// importPipelineConfig accepts the export.yaml format. Settings in the footer are applied
+// with the same repository permission required by PUT /pipeline/settings.
+func (r *repoRouter) importPipelineConfig(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Request.Body, pipelineConfigImportMaxLen+1))
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > pipelineConfigImportMaxLen {
+		writeError(resp, http.StatusBadRequest, errors.New("导入文件过大"))
+		return
+	}
+
+	parsed, err := pipelinesvc.ParsePipelineConfigExport(string(body))
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	cfg, err := r.services.Pipeline.ImportPipelineConfig(req.Request.Context(), repo.ID, parsed, claims.Login)
+	if err != nil {
+		writePipelineConfigError(resp, err)
+		return
+	}
+
+	result := pipelineConfigImportResponse{
+		pipelineConfigResponse: pipelineConfigResponse{
+			Content:   cfg.Content,
+			UpdatedAt: cfg.Updated,
+			Warnings:  pipelinesvc.PipelineConfigWarnings(cfg.Content, nil),
+			Version:   cfg.Version,
+		},
+		SettingsImported: parsed.Settings != nil,
+	}
+	if parsed.Settings != nil {
+		result.Settings = &pipelineSettingsResponse{
+			ConfigSource:       cfg.ConfigSource,
+			ConfigFile:         cfg.ConfigFile,
+			CleanupEnabled:     cfg.CleanupEnabled,
+			RetentionDays:      cfg.RetentionDays,
+			MaxRecords:         cfg.MaxRecords,
+			Dockerfile:         cfg.Dockerfile,
+			DisallowParallel:   cfg.DisallowParallel,
+			CronSchedules:      cfg.CronSchedules,
+			StepCPU:            cfg.StepCPU,
+			StepMemory:         cfg.StepMemory,
+			ReportCommitStatus: cfg.ReportCommitStatus,
+			LogRetentionDays:   cfg.LogRetentionDays,
+			PublicStatus:       cfg.PublicStatus,
+			PublicMessages:     cfg.PublicMessages,
 		}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+func sanitizeExportFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	if strings.Trim(name, "-.") == "" {
+		return "pipeline"
+	}
+	return name
+}
+
+func (r *repoRouter) getPipelineSettings(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -764,12 +1284,20 @@ func (r *repoRouter) getPipelineSettings(req *restful.Request, resp *restful.Res
 		return
 	}
 	respBody := pipelineSettingsResponse{
-		CleanupEnabled:   settings.CleanupEnabled,
-		RetentionDays:    settings.RetentionDays,
-		MaxRecords:       settings.MaxRecords,
-		Dockerfile:       settings.Dockerfile,
-		DisallowParallel: settings.DisallowParallel,
-		CronSchedules:    append([]string{}, settings.CronSchedules...),
+		ConfigSource:       settings.ConfigSource,
+		ConfigFile:         settings.ConfigFile,
+		CleanupEnabled:     settings.CleanupEnabled,
+		RetentionDays:      settings.RetentionDays,
+		MaxRecords:         settings.MaxRecords,
+		Dockerfile:         settings.Dockerfile,
+		DisallowParallel:   settings.DisallowParallel,
+		CronSchedules:      append([]string{}, settings.CronSchedules...),
+		StepCPU:            settings.StepCPU,
+		StepMemory:         settings.StepMemory,
+		ReportCommitStatus: settings.ReportCommitStatus,
+		LogRetentionDays:   settings.LogRetentionDays,
+		PublicStatus:       settings.PublicStatus,
+		PublicMessages:     settings.PublicMessages,
 	}
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, respBody)
 }
@@ -782,10 +1310,7 @@ func (r *repoRouter) updatePipelineSettings(req *restful.Request, resp *restful.
 	}
 	repo, err := r.repoFromRequest(req, claims)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if errors.Is(err, errRepoNotFound) {
-			status = http.StatusNotFound
-		}
+		status := repoErrorStatus(err)
 		writeError(resp, status, err)
 		return
 	}
@@ -799,6 +1324,9 @@ func (r *repoRouter) updatePipelineSettings(req *restful.Request, resp *restful.
 	if body.RetentionDays < 0 {
 		body.RetentionDays = 0
 	}
+	if body.LogRetentionDays < 0 {
+		body.LogRetentionDays = 0
+	}
 	if body.MaxRecords <= 0 {
 		body.MaxRecords = 10
 	}
@@ -806,54 +1334,87 @@ func (r *repoRouter) updatePipelineSettings(req *restful.Request, resp *restful.
 		body.CronSchedules = []string{}
 	}
 	saved, err := r.services.Pipeline.UpsertPipelineSettings(req.Request.Context(), repo.ID, model.RepoPipelineConfig{
-		CleanupEnabled:   body.CleanupEnabled,
-		RetentionDays:    body.RetentionDays,
-		MaxRecords:       body.MaxRecords,
-		Dockerfile:       body.Dockerfile,
-		DisallowParallel: body.DisallowParallel,
-		CronSchedules:    body.CronSchedules,
+		ConfigSource:       body.ConfigSource,
+		ConfigFile:         body.ConfigFile,
+		CleanupEnabled:     body.CleanupEnabled,
+		RetentionDays:      body.RetentionDays,
+		MaxRecords:         body.MaxRecords,
+		Dockerfile:         body.Dockerfile,
+		DisallowParallel:   body.DisallowParallel,
+		CronSchedules:      body.CronSchedules,
+		StepCPU:            body.StepCPU,
+		StepMemory:         body.StepMemory,
+		ReportCommitStatus: body.ReportCommitStatus,
+		LogRetentionDays:   body.LogRetentionDays,
+		PublicStatus:       body.PublicStatus,
+		PublicMessages:     body.PublicMessages,
 	})
 	if err != nil {
-		writeError(resp, http.StatusInternalServerError, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, pipelinesvc.ErrInvalidConfigSource) || errors.Is(err, pipelinesvc.ErrInvalidStepResources) {
+			status = http.StatusBadRequest
+		}
+		writeError(resp, status, err)
 		return
 	}
 
 	respBody := pipelineSettingsResponse{
-		CleanupEnabled:   saved.CleanupEnabled,
-		RetentionDays:    saved.RetentionDays,
-		MaxRecords:       saved.MaxRecords,
-		Dockerfile:       saved.Dockerfile,
-		DisallowParallel: saved.DisallowParallel,
-		CronSchedules:    append([]string{}, saved.CronSchedules...),
+		ConfigSource:       saved.ConfigSource,
+		ConfigFile:         saved.ConfigFile,
+		CleanupEnabled:     saved.CleanupEnabled,
+		RetentionDays:      saved.RetentionDays,
+		MaxRecords:         saved.MaxRecords,
+		Dockerfile:         saved.Dockerfile,
+		DisallowParallel:   saved.DisallowParallel,
+		CronSchedules:      append([]string{}, saved.CronSchedules...),
+		StepCPU:            saved.StepCPU,
+		StepMemory:         saved.StepMemory,
+		ReportCommitStatus: saved.ReportCommitStatus,
+		LogRetentionDays:   saved.LogRetentionDays,
+		PublicStatus:       saved.PublicStatus,
+		PublicMessages:     saved.PublicMessages,
 	}
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, respBody)
 }
 
-func decorateApprovalPermissions(detail *pipelinesvc.PipelineRunDetail, login string) {
+// approverGroups loads the current group rosters for a repository; failures degrade to no groups.
+func (r *repoRouter) approverGroups(req *restful.Request, repoID int64) map[string][]string {
+	groups, err := r.services.Pipeline.ApproverGroupMembers(req.Request.Context(), repoID)
+	if err != nil {
+		log.Warn().Err(err).Int64("repo_id", repoID).Msg("failed to load approver groups")
+		return nil
+	}
+	return groups
+}
+
+func decorateApprovalPermissions(detail *pipelinesvc.PipelineRunDetail, login string, groups map[string][]string) {
 	if detail == nil {
 		return
 	}
+	// the workflow children are the same records
 	for _, step := range detail.Steps {
-		decorateApprovalForUser(step, login)
-	}
-	for _, wf := range detail.Workflows {
-		for _, step := range wf.Children {
-			decorateApprovalForUser(step, login)
-		}
+		decorateApprovalForUser(step, login, groups)
 	}
 }
 
-func decorateApprovalForUser(step *model.Step, login string) {
+func decorateApprovalForUser(step *model.Step, login string, groups map[string][]string) {
 	if step == nil || step.Approval == nil {
 		return
 	}
 	approval := step.Approval
 	approval.CanApprove = false
 	approval.CanReject = false
-	if pending := pendingApprovers(approval); len(pending) > 0 {
-		approval.PendingApprovers = pending
-	} else {
-		approval.PendingApprovers = nil
+	requirements := pipelinesvc.ResolveApprovers(approval.Approvers, groups)
+	approval.PendingApprovers = nil
+	approval.GroupMembers = nil
+	for _, pending := range pipelinesvc.PendingApprovers(requirements, approval.Decisions) {
+		approval.PendingApprovers = append(approval.PendingApprovers, pending.Ref)
+		if pending.Group != "" {
+			if approval.GroupMembers == nil {
+				approval.GroupMembers = make(map[string][]string)
+			}
+			approval.GroupMembers[pending.Group] = pending.Members
+		}
 	}
 	if strings.TrimSpace(login) == "" {
 		return
@@ -861,8 +1422,7 @@ func decorateApprovalForUser(step *model.Step, login string) {
 	if approval.State != model.StepApprovalStatePending {
 		return
 	}
-	allowed := len(approval.Approvers) == 0 || containsIgnoreCaseSlice(approval.Approvers, login)
-	if !allowed {
+	if !pipelinesvc.ApproverAllowed(requirements, login) {
 		return
 	}
 	for _, decision := range approval.Decisions {
@@ -872,37 +1432,6 @@ func decorateApprovalForUser(step *model.Step, login string) {
 	}
 	approval.CanApprove = true
 	approval.CanReject = true
-	if len(approval.Approvers) > 0 {
-		approval.PendingApprovers = pendingApprovers(approval)
-	}
-}
-
-func containsIgnoreCaseSlice(list []string, target string) bool {
-	for _, item := range list {
-		if strings.EqualFold(strings.TrimSpace(item), strings.TrimSpace(target)) {
-			return true
-		}
-	}
-	return false
-}
-
-func pendingApprovers(approval *model.StepApproval) []string {
-	if approval == nil || len(approval.Approvers) == 0 {
-		return nil
-	}
-	approved := make(map[string]struct{})
-	for _, decision := range approval.Decisions {
-		if strings.EqualFold(strings.TrimSpace(decision.Action), "approve") {
-			approved[strings.ToLower(strings.TrimSpace(decision.User))] = struct{}{}
-		}
-	}
-	result := make([]string, 0)
-	for _, approver := range approval.Approvers {
-		if _, ok := approved[strings.ToLower(strings.TrimSpace(approver))]; !ok {
-			result = append(result, approver)
-		}
-	}
-	return result
 }
 
 func logTypeString(t model.LogEntryType) string {
@@ -922,8 +1451,17 @@ func logTypeString(t model.LogEntryType) string {
 	}
 }
 
+// repoFromRequest loads the repository of the request and checks that the caller holds the
+// role the route requires: the repoRoleMetadata of the route, otherwise viewer for reads and
+// maintainer for writes.
 func (r *repoRouter) repoFromRequest(req *restful.Request, claims *authsvc.SessionClaims) (*model.Repo, error) {
-	repoIDParam := strings.TrimSpace(req.PathParameter("repo_id"))
+	return r.repoFromPath(req, claims, "repo_id", requiredRepoRole(req))
+}
+
+// repoFromPath loads the repository whose id is the path parameter param and checks that the
+// caller holds the required role on it.
+func (r *repoRouter) repoFromPath(req *restful.Request, claims *authsvc.SessionClaims, param string, required model.RepoRole) (*model.Repo, error) {
+	repoIDParam := strings.TrimSpace(req.PathParameter(param))
 	if repoIDParam == "" {
 		return nil, errRepoNotFound
 	}
@@ -948,8 +1486,40 @@ func (r *repoRouter) repoFromRequest(req *restful.Request, claims *authsvc.Sessi
 	if err != nil {
 		return nil, err
 	}
-	if user == nil || !user.Admin {
+	role, err := r.services.Repo.Role(req.Request.Context(), repo, user)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
 		return nil, errRepoNotFound
 	}
+	if !role.Includes(required) {
+		return nil, fmt.Errorf("%w: requires %s role", errRepoForbidden, required)
+	}
 	return repo, nil
 }
+
+// requiredRepoRole returns the role the selected route requires.
+func requiredRepoRole(req *restful.Request) model.RepoRole {
+	if route := req.SelectedRoute(); route != nil {
+		if role, ok := route.Metadata()[repoRoleMetadata].(model.RepoRole); ok {
+			return role
+		}
+	}
+	if req.Request.Method == http.MethodGet || req.Request.Method == http.MethodHead {
+		return model.RepoRoleViewer
+	}
+	return model.RepoRoleMaintainer
+}
+
+// repoErrorStatus maps repoFromRequest errors to response codes.
+func repoErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRepoNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errRepoForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
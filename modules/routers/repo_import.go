@@ -0,0 +1,73 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	reposvc "github.com/thepenn/devsys/service/repo"
+)
+
+func (r *repoRouter) registerImportRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.POST("/import").To(r.importRepo).
+		Doc("Register a repository by clone URL without a forge; the remote is checked with git ls-remote using the bound certificate").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Reads(model.RepoImport{}).
+		Writes(model.Repo{}).
+		Returns(http.StatusCreated, "imported", model.Repo{}).
+		Returns(http.StatusBadRequest, "invalid clone URL, name, branch or unreachable remote", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "certificate not permitted to the caller", errorResponse{}).
+		Returns(http.StatusConflict, "repository already exists", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) importRepo(req *restful.Request, resp *restful.Response) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	var body model.RepoImport
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	user, err := r.services.User.FindByID(req.Request.Context(), claims.UserID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	admin := user.Admin || r.services.User.IsSuperAdmin(user)
+	repo, err := r.services.Repo.Import(req.Request.Context(), claims.UserID, admin, body)
+	if err != nil {
+		writeError(resp, repoImportErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, repo)
+}
+
+func repoImportErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, reposvc.ErrImportInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, reposvc.ErrCertificateForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, reposvc.ErrRepoExists):
+		return http.StatusConflict
+	case errors.Is(err, tenancy.ErrOrganizationNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
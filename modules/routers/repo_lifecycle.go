@@ -0,0 +1,71 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (r *repoRouter) registerLifecycleRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.POST("/{repo_id}/deactivate").To(r.deactivateRepo).
+		Doc("Cancel unfinished pipelines of the repository and stop new ones; records are kept").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleOwner).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "deactivated", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}").To(r.deleteRepo).
+		Doc("Delete the repository with its pipelines, logs, configuration and workspaces").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleOwner).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) deactivateRepo(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	if err := r.services.Repo.Deactivate(req.Request.Context(), repo); err != nil {
+		writeError(resp, repoLifecycleErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *repoRouter) deleteRepo(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	if err := r.services.Repo.Delete(req.Request.Context(), repo); err != nil {
+		writeError(resp, repoLifecycleErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func repoLifecycleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrFeatureUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
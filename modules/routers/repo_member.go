@@ -0,0 +1,133 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	reposvc "github.com/thepenn/devsys/service/repo"
+)
+
+type repoMemberRequest struct {
+	Login string         `json:"login"`
+	Role  model.RepoRole `json:"role"`
+}
+
+func (r *repoRouter) registerMemberRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/{repo_id}/members").To(r.listRepoMembers).
+		Doc("List repository members and their roles").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Produces(restful.MIME_JSON).
+		Writes([]model.RepoMemberInfo{}).
+		Returns(http.StatusOK, "members", []model.RepoMemberInfo{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.PUT("/{repo_id}/members").To(r.setRepoMember).
+		Doc("Grant a user a role on the repository, replacing an existing role").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(repoMemberRequest{}).
+		Returns(http.StatusOK, "member", model.RepoMember{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository or user not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/members/{user_id}").To(r.removeRepoMember).
+		Doc("Revoke the membership of a user").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "removed", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "member not found", errorResponse{}))
+}
+
+func (r *repoRouter) listRepoMembers(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	members, err := r.services.Repo.ListMembers(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if members == nil {
+		members = []model.RepoMemberInfo{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, members)
+}
+
+func (r *repoRouter) setRepoMember(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	var body repoMemberRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	member, err := r.services.Repo.SetMember(req.Request.Context(), repo.ID, body.Login, body.Role)
+	if err != nil {
+		writeError(resp, repoMemberErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, member)
+}
+
+func (r *repoRouter) removeRepoMember(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	userID, ok := pathID(req, resp, "user_id")
+	if !ok {
+		return
+	}
+	if err := r.services.Repo.RemoveMember(req.Request.Context(), repo.ID, userID); err != nil {
+		writeError(resp, repoMemberErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// memberRepo resolves the repository of a member route and writes the error response when
+// the caller lacks the role the route requires.
+func (r *repoRouter) memberRepo(req *restful.Request, resp *restful.Response) (*model.Repo, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		writeError(resp, repoErrorStatus(err), err)
+		return nil, false
+	}
+	return repo, true
+}
+
+func repoMemberErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, reposvc.ErrMemberInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, reposvc.ErrUserNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
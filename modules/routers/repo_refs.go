@@ -0,0 +1,184 @@
+package routers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	authsvc "github.com/thepenn/devsys/service/auth"
+)
+
+// branchSuggestionLimit caps the close matches offered for a mistyped branch.
+const branchSuggestionLimit = 5
+
+type gitRefListResponse struct {
+	Items []authsvc.GitRef `json:"items"`
+}
+
+// branchNotFoundResponse answers a trigger of a branch the forge does not know.
+type branchNotFoundResponse struct {
+	Error       string   `json:"error"`
+	Suggestions []string `json:"suggestions"`
+}
+
+func (r *repoRouter) registerRefRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/{repo_id}/branches").To(r.listBranches).
+		Doc("List the branches of a repository from the forge; cached for a minute").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Produces(restful.MIME_JSON).
+		Writes(gitRefListResponse{}).
+		Returns(http.StatusOK, "branches", gitRefListResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusBadGateway, "forge request failed", errorResponse{}))
+
+	ws.Route(ws.GET("/{repo_id}/tags").To(r.listTags).
+		Doc("List the tags of a repository from the forge; cached for a minute").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Produces(restful.MIME_JSON).
+		Writes(gitRefListResponse{}).
+		Returns(http.StatusOK, "tags", gitRefListResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusBadGateway, "forge request failed", errorResponse{}))
+}
+
+func (r *repoRouter) listBranches(req *restful.Request, resp *restful.Response) {
+	r.listRefs(req, resp, r.services.Auth.ListBranches)
+}
+
+func (r *repoRouter) listTags(req *restful.Request, resp *restful.Response) {
+	r.listRefs(req, resp, r.services.Auth.ListTags)
+}
+
+func (r *repoRouter) listRefs(req *restful.Request, resp *restful.Response, list func(ctx context.Context, userID, repoID int64) ([]authsvc.GitRef, error)) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return
+	}
+
+	refs, err := list(req.Request.Context(), claims.UserID, repo.ID)
+	if err != nil {
+		writeError(resp, refErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, gitRefListResponse{Items: refs})
+}
+
+// validateRunBranch checks a manually triggered branch against the forge and answers 400
+// with the closest branch names when it does not exist.
+func (r *repoRouter) validateRunBranch(req *restful.Request, resp *restful.Response, claims *authsvc.SessionClaims, repo *model.Repo, branch string) bool {
+	var names []string
+	if repo.IsManual() {
+		// imported repositories are asked directly, there is no forge to list them
+		remote, _, err := r.services.Pipeline.ListRemoteBranches(req.Request.Context(), repo)
+		if err != nil {
+			writeError(resp, http.StatusBadGateway, err)
+			return false
+		}
+		names = remote
+	} else {
+		branches, err := r.services.Auth.ListBranches(req.Request.Context(), claims.UserID, repo.ID)
+		if err != nil {
+			writeError(resp, refErrorStatus(err), err)
+			return false
+		}
+		names = make([]string, 0, len(branches))
+		for _, ref := range branches {
+			names = append(names, ref.Name)
+		}
+	}
+	if slices.Contains(names, branch) {
+		return true
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusBadRequest, branchNotFoundResponse{
+		Error:       fmt.Sprintf("branch %q does not exist", branch),
+		Suggestions: closeMatches(branch, names, branchSuggestionLimit),
+	})
+	return false
+}
+
+// refErrorStatus answers 401 when the forge token can no longer be refreshed and 502 for
+// other forge failures.
+func refErrorStatus(err error) int {
+	if errors.Is(err, authsvc.ErrReauthRequired) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadGateway
+}
+
+// closeMatches returns up to limit candidates nearest to name: those containing it or within
+// a third of its length in edits, closest first.
+func closeMatches(name string, candidates []string, limit int) []string {
+	type match struct {
+		name     string
+		distance int
+	}
+	lower := strings.ToLower(name)
+	maxDistance := max(len([]rune(lower))/3, 1)
+	var matches []match
+	for _, candidate := range candidates {
+		candidateLower := strings.ToLower(candidate)
+		distance := editDistance(lower, candidateLower)
+		if distance > maxDistance && !strings.Contains(candidateLower, lower) && !strings.Contains(lower, candidateLower) {
+			continue
+		}
+		matches = append(matches, match{name: candidate, distance: distance})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	result := make([]string, 0, min(len(matches), limit))
+	for _, m := range matches {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, m.name)
+	}
+	return result
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
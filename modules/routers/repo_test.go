@@ -0,0 +1,47 @@
+package routers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	pipelineService "github.com/thepenn/devsys/service/pipeline"
+)
+
+func TestDecorateApprovalPermissionsReachesNestedSteps(t *testing.T) {
+	db := storetest.Open(t, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.LogEntry{})
+	approval := &model.StepApproval{Approvers: []string{"alice"}, State: model.StepApprovalStatePending}
+	for _, record := range []any{
+		&model.Pipeline{ID: 1, RepoID: 1, Number: 1, Status: model.StatusBlocked},
+		&model.Workflow{ID: 1, PipelineID: 1, PID: 1, Name: "build", State: model.StatusSuccess},
+		&model.Workflow{ID: 2, PipelineID: 1, PID: 3, Name: "release", State: model.StatusBlocked},
+		&model.Step{ID: 1, PipelineID: 1, PID: 2, PPID: 1, Name: "compile", State: model.StatusSuccess},
+		&model.Step{ID: 2, PipelineID: 1, PID: 4, PPID: 3, Name: "sign-off", Type: model.StepTypeApproval, State: model.StatusBlocked, Approval: approval},
+	} {
+		if err := db.GetDB().Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc := pipelineService.NewService(db, nil, nil)
+
+	for login, want := range map[string]bool{"alice": true, "bob": false} {
+		detail, err := svc.GetPipelineRunDetail(context.Background(), 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decorateApprovalPermissions(detail, login, nil)
+
+		release := detail.Workflows[1]
+		if len(release.Children) != 1 || release.Children[0].Approval == nil {
+			t.Fatalf("release children = %+v, want the approval step", release.Children)
+		}
+		got := release.Children[0].Approval
+		if got.CanApprove != want || got.CanReject != want {
+			t.Errorf("%s: nested approval can approve %v reject %v, want %v", login, got.CanApprove, got.CanReject, want)
+		}
+		if len(got.PendingApprovers) != 1 || got.PendingApprovers[0] != "alice" {
+			t.Errorf("%s: pending approvers = %v, want alice", login, got.PendingApprovers)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	reposvc "github.com/thepenn/devsys/service/repo"
+)
+
+// repoVariableRequest sets a variable; omitting value keeps the stored one.
+type repoVariableRequest struct {
+	Value  *string `json:"value"`
+	Secret bool    `json:"secret"`
+}
+
+func (r *repoRouter) registerVariableRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/{repo_id}/variables").To(r.listRepoVariables).
+		Doc("List repository variables; secret values are omitted").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleViewer).
+		Filter(r.authMW.RequireAuth).
+		Produces(restful.MIME_JSON).
+		Writes([]model.RepoVariable{}).
+		Returns(http.StatusOK, "variables", []model.RepoVariable{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.PUT("/{repo_id}/variables/{key}").To(r.setRepoVariable).
+		Doc("Create or update a variable injected into every pipeline of the repository").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(repoVariableRequest{}).
+		Returns(http.StatusOK, "variable", model.RepoVariable{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/variables/{key}").To(r.deleteRepoVariable).
+		Doc("Delete a repository variable").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "variable not found", errorResponse{}))
+}
+
+func (r *repoRouter) listRepoVariables(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	variables, err := r.services.Repo.ListVariables(req.Request.Context(), repo.ID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	items := make([]model.RepoVariable, 0, len(variables))
+	for _, variable := range variables {
+		items = append(items, variable.Redacted())
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, items)
+}
+
+func (r *repoRouter) setRepoVariable(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	var body repoVariableRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	variable, err := r.services.Repo.SetVariable(req.Request.Context(), repo.ID, req.PathParameter("key"), body.Value, body.Secret)
+	if err != nil {
+		writeError(resp, repoVariableErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, variable.Redacted())
+}
+
+func (r *repoRouter) deleteRepoVariable(req *restful.Request, resp *restful.Response) {
+	repo, ok := r.memberRepo(req, resp)
+	if !ok {
+		return
+	}
+	if err := r.services.Repo.DeleteVariable(req.Request.Context(), repo.ID, req.PathParameter("key")); err != nil {
+		writeError(resp, repoVariableErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func repoVariableErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, reposvc.ErrVariableInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
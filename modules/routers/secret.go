@@ -0,0 +1,320 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+	systemsvc "github.com/thepenn/devsys/service/system"
+)
+
+var errInvalidSecretID = errors.New("secret id is invalid")
+
+type secretCreateRequest struct {
+	Name   string            `json:"name"`
+	Values map[string]string `json:"values"`
+}
+
+type secretUpdateRequest struct {
+	Name   *string            `json:"name,omitempty"`
+	Values map[string]*string `json:"values,omitempty"`
+}
+
+// secretResponse never carries secret values; every stored value is replaced by the mask.
+type secretResponse struct {
+	ID      int64             `json:"id"`
+	RepoID  int64             `json:"repo_id"`
+	Scope   string            `json:"scope"`
+	Name    string            `json:"name"`
+	Keys    []string          `json:"keys"`
+	Values  map[string]string `json:"values"`
+	Created int64             `json:"created"`
+	Updated int64             `json:"updated"`
+}
+
+func newSecretResponse(secret *model.Secret) secretResponse {
+	return secretResponse{
+		ID:      secret.ID,
+		RepoID:  secret.RepoID,
+		Scope:   secret.Scope(),
+		Name:    secret.Name,
+		Keys:    secret.Keys(),
+		Values:  secret.MaskValues(model.DefaultSecretMask),
+		Created: secret.Created,
+		Updated: secret.Updated,
+	}
+}
+
+func (r *pipelineAdminRouter) registerSecretRoutes(register func(string) *restful.WebService, tags []string) *restful.WebService {
+	if r.services == nil || r.services.System == nil {
+		return nil
+	}
+
+	ws := register("/admin/secrets")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(r.authMW.Authenticate)
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+
+	ws.Route(ws.GET("").To(r.listSecrets).
+		Doc("列出全局密钥").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]secretResponse{}).
+		Returns(http.StatusOK, "OK", []secretResponse{}))
+
+	ws.Route(ws.POST("").To(r.createSecret).
+		Doc("创建全局密钥").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(secretCreateRequest{}).
+		Writes(secretResponse{}).
+		Returns(http.StatusCreated, "created", secretResponse{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}))
+
+	ws.Route(ws.PUT("/{secret_id}").To(r.updateSecret).
+		Doc("更新全局密钥，留空或掩码值保持不变，null 删除该键").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(secretUpdateRequest{}).
+		Writes(secretResponse{}).
+		Returns(http.StatusOK, "OK", secretResponse{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{secret_id}").To(r.deleteSecret).
+		Doc("删除全局密钥").
+		Filter(r.authMW.RequireAuth).
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	return ws
+}
+
+func (r *pipelineAdminRouter) listSecrets(req *restful.Request, resp *restful.Response) {
+	listScopedSecrets(r.services, req, resp, 0)
+}
+
+func (r *pipelineAdminRouter) createSecret(req *restful.Request, resp *restful.Response) {
+	createScopedSecret(r.services, req, resp, 0)
+}
+
+func (r *pipelineAdminRouter) updateSecret(req *restful.Request, resp *restful.Response) {
+	updateScopedSecret(r.services, req, resp, 0)
+}
+
+func (r *pipelineAdminRouter) deleteSecret(req *restful.Request, resp *restful.Response) {
+	deleteScopedSecret(r.services, req, resp, 0)
+}
+
+func (r *repoRouter) registerSecretRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/secrets").To(r.listSecrets).
+		Doc("List repository secrets; values are always masked").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(repoRoleMetadata, model.RepoRoleMaintainer).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Produces(restful.MIME_JSON).
+		Writes([]secretResponse{}).
+		Returns(http.StatusOK, "secrets", []secretResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}))
+
+	ws.Route(ws.POST("/{repo_id}/secrets").To(r.createSecret).
+		Doc("Create a repository secret").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(secretCreateRequest{}).
+		Returns(http.StatusCreated, "secret", secretResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusConflict, "name taken", errorResponse{}))
+
+	ws.Route(ws.PUT("/{repo_id}/secrets/{secret_id}").To(r.updateSecret).
+		Doc("Update a repository secret; empty or masked values are kept and null removes a key").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(secretUpdateRequest{}).
+		Returns(http.StatusOK, "secret", secretResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "secret not found", errorResponse{}).
+		Returns(http.StatusConflict, "name taken", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{repo_id}/secrets/{secret_id}").To(r.deleteSecret).
+		Doc("Delete a repository secret").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "secret not found", errorResponse{}))
+}
+
+func (r *repoRouter) listSecrets(req *restful.Request, resp *restful.Response) {
+	if repo, ok := r.secretRepo(req, resp); ok {
+		listScopedSecrets(r.services, req, resp, repo.ID)
+	}
+}
+
+func (r *repoRouter) createSecret(req *restful.Request, resp *restful.Response) {
+	if repo, ok := r.secretRepo(req, resp); ok {
+		createScopedSecret(r.services, req, resp, repo.ID)
+	}
+}
+
+func (r *repoRouter) updateSecret(req *restful.Request, resp *restful.Response) {
+	if repo, ok := r.secretRepo(req, resp); ok {
+		updateScopedSecret(r.services, req, resp, repo.ID)
+	}
+}
+
+func (r *repoRouter) deleteSecret(req *restful.Request, resp *restful.Response) {
+	if repo, ok := r.secretRepo(req, resp); ok {
+		deleteScopedSecret(r.services, req, resp, repo.ID)
+	}
+}
+
+// secretRepo resolves the repository of a secret route and writes the error response when
+// the caller may not manage it.
+func (r *repoRouter) secretRepo(req *restful.Request, resp *restful.Response) (*model.Repo, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	repo, err := r.repoFromRequest(req, claims)
+	if err != nil {
+		status := repoErrorStatus(err)
+		writeError(resp, status, err)
+		return nil, false
+	}
+	if r.services == nil || r.services.System == nil {
+		writeError(resp, http.StatusInternalServerError, errSystemServiceUnavailable)
+		return nil, false
+	}
+	return repo, true
+}
+
+func listScopedSecrets(services *service.Services, req *restful.Request, resp *restful.Response, repoID int64) {
+	secrets, err := services.System.ListSecrets(req.Request.Context(), repoID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	items := make([]secretResponse, 0, len(secrets))
+	for _, secret := range secrets {
+		items = append(items, newSecretResponse(secret))
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, items)
+}
+
+func createScopedSecret(services *service.Services, req *restful.Request, resp *restful.Response, repoID int64) {
+	var body secretCreateRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	created, err := services.System.CreateSecret(req.Request.Context(), &model.Secret{
+		RepoID: repoID,
+		Name:   body.Name,
+		Values: body.Values,
+	})
+	if err != nil {
+		writeError(resp, secretErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, newSecretResponse(created))
+}
+
+func updateScopedSecret(services *service.Services, req *restful.Request, resp *restful.Response, repoID int64) {
+	id, ok := scopedSecretID(services, req, resp, repoID)
+	if !ok {
+		return
+	}
+	var body secretUpdateRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	updated, err := services.System.UpdateSecret(req.Request.Context(), id, model.SecretPatch{
+		Name:   body.Name,
+		Values: body.Values,
+	})
+	if err != nil {
+		writeError(resp, secretErrorStatus(err), err)
+		return
+	}
+	if updated == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, newSecretResponse(updated))
+}
+
+func deleteScopedSecret(services *service.Services, req *restful.Request, resp *restful.Response, repoID int64) {
+	id, ok := scopedSecretID(services, req, resp, repoID)
+	if !ok {
+		return
+	}
+	if err := services.System.DeleteSecret(req.Request.Context(), id); err != nil {
+		writeError(resp, secretErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// scopedSecretID parses the secret id and checks that the secret belongs to repoID, so a
+// repository route cannot reach global or foreign secrets.
+func scopedSecretID(services *service.Services, req *restful.Request, resp *restful.Response, repoID int64) (int64, bool) {
+	id, err := strconv.ParseInt(req.PathParameter("secret_id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(resp, http.StatusBadRequest, errInvalidSecretID)
+		return 0, false
+	}
+	secret, err := services.System.GetSecret(req.Request.Context(), id)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return 0, false
+	}
+	if secret == nil || secret.RepoID != repoID {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func secretErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, systemsvc.ErrSecretInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, systemsvc.ErrSecretExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,115 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/rs/zerolog/log"
+
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+type pipelineStepLogPage struct {
+	Items  []pipelineStepLog `json:"items"`
+	Offset int               `json:"offset"`
+	Total  int64             `json:"total"`
+}
+
+func (r *repoRouter) registerStepLogRoutes(ws *restful.WebService, tags []string, requirePipeline restful.FilterFunction) {
+	ws.Route(ws.GET("/{repo_id}/pipeline/runs/{pipeline_id}/steps/{step_id}/logs").To(r.stepLogs).
+		Doc("Page through the log of a step, or download it whole with format=raw").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Filter(requirePipeline).
+		Param(ws.QueryParameter("offset", "index of the first line, from 0").DataType("integer")).
+		Param(ws.QueryParameter("limit", "number of lines, at most 5000").DataType("integer")).
+		Param(ws.QueryParameter("format", "raw downloads the log as text/plain").DataType("string")).
+		Produces(restful.MIME_JSON, "text/plain").
+		Returns(http.StatusOK, "log lines", pipelineStepLogPage{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *repoRouter) stepLogs(req *restful.Request, resp *restful.Response) {
+	repo, pipelineID, ok := r.artifactPipeline(req, resp)
+	if !ok {
+		return
+	}
+	stepID, err := strconv.ParseInt(strings.TrimSpace(req.PathParameter("step_id")), 10, 64)
+	if err != nil || stepID <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New("invalid step id"))
+		return
+	}
+	ctx := req.Request.Context()
+
+	if strings.EqualFold(strings.TrimSpace(req.QueryParameter("format")), "raw") {
+		download := &logDownload{
+			resp:     resp,
+			filename: "pipeline-" + strconv.FormatInt(pipelineID, 10) + "-step-" + strconv.FormatInt(stepID, 10) + ".log",
+		}
+		err := r.services.Pipeline.StreamStepLog(ctx, repo.ID, pipelineID, stepID, download)
+		switch {
+		case err != nil && !download.started:
+			writeError(resp, stepLogErrorStatus(err), err)
+		case err != nil:
+			// the status is already sent; the client sees a short download
+			log.Warn().Err(err).Int64("step_id", stepID).Msg("failed to stream step log")
+		default:
+			download.start()
+		}
+		return
+	}
+
+	offset, _ := strconv.Atoi(req.QueryParameter("offset"))
+	limit, _ := strconv.Atoi(req.QueryParameter("limit"))
+	page, err := r.services.Pipeline.ListStepLog(ctx, repo.ID, pipelineID, stepID, offset, limit)
+	if err != nil {
+		writeError(resp, stepLogErrorStatus(err), err)
+		return
+	}
+	result := pipelineStepLogPage{
+		Items:  make([]pipelineStepLog, 0, len(page.Entries)),
+		Offset: page.Offset,
+		Total:  page.Total,
+	}
+	for _, entry := range page.Entries {
+		result.Items = append(result.Items, newPipelineStepLog(&entry))
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+// logDownload sends the download headers with the first log line, so that errors found before
+// any output can still be answered with a status.
+type logDownload struct {
+	resp     *restful.Response
+	filename string
+	started  bool
+}
+
+func (d *logDownload) start() {
+	if d.started {
+		return
+	}
+	d.started = true
+	d.resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	d.resp.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(d.filename))
+	d.resp.WriteHeader(http.StatusOK)
+}
+
+func (d *logDownload) Write(p []byte) (int, error) {
+	d.start()
+	return d.resp.Write(p)
+}
+
+func stepLogErrorStatus(err error) int {
+	if errors.Is(err, pipelinesvc.ErrStepNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,208 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+var errInvalidApproverGroupID = errors.New("approver group id is invalid")
+
+type approverGroupRequest struct {
+	OrgID   int64    `json:"org_id,omitempty"`
+	RepoID  int64    `json:"repo_id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func (r *systemRouter) registerApproverGroupRoutes(register func(path string) *restful.WebService, tags []string) *restful.WebService {
+	if r.services == nil || r.services.Pipeline == nil || r.services.User == nil || r.authMW == nil {
+		return nil
+	}
+
+	ws := register("/sys/approver-groups")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(r.authMW.RequireAuth)
+
+	ws.Route(ws.GET("").To(r.listApproverGroups).
+		Doc("列出审批组").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("repo_id", "仓库 ID，0 或留空表示全局审批组").DataType("integer")).
+		Writes([]*model.ApproverGroup{}).
+		Returns(http.StatusOK, "OK", []*model.ApproverGroup{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.POST("").To(r.createApproverGroup).
+		Doc("创建审批组").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(approverGroupRequest{}).
+		Writes(model.ApproverGroup{}).
+		Returns(http.StatusCreated, "created", model.ApproverGroup{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.PUT("/{id}").To(r.updateApproverGroup).
+		Doc("更新审批组，待审批步骤在下一次审批时使用新成员").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(approverGroupRequest{}).
+		Writes(model.ApproverGroup{}).
+		Returns(http.StatusOK, "OK", model.ApproverGroup{}).
+		Returns(http.StatusBadRequest, "bad request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusConflict, "conflict", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.DELETE("/{id}").To(r.deleteApproverGroup).
+		Doc("删除审批组").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	return ws
+}
+
+func (r *systemRouter) listApproverGroups(req *restful.Request, resp *restful.Response) {
+	if err := r.ensureAdmin(req); err != nil {
+		r.writeAuthError(resp, err)
+		return
+	}
+
+	var repoID int64
+	if raw := req.QueryParameter("repo_id"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 0 {
+			writeError(resp, http.StatusBadRequest, errors.New("repo_id is invalid"))
+			return
+		}
+		repoID = parsed
+	}
+
+	groups, err := r.services.Pipeline.ListApproverGroups(req.Request.Context(), repoID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, groups)
+}
+
+func (r *systemRouter) createApproverGroup(req *restful.Request, resp *restful.Response) {
+	if err := r.ensureAdmin(req); err != nil {
+		r.writeAuthError(resp, err)
+		return
+	}
+
+	var body approverGroupRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	created, err := r.services.Pipeline.CreateApproverGroup(req.Request.Context(), &model.ApproverGroup{
+		OrgID:   body.OrgID,
+		RepoID:  body.RepoID,
+		Name:    body.Name,
+		Members: body.Members,
+	})
+	if err != nil {
+		writeError(resp, approverGroupErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, created)
+}
+
+func (r *systemRouter) updateApproverGroup(req *restful.Request, resp *restful.Response) {
+	if err := r.ensureAdmin(req); err != nil {
+		r.writeAuthError(resp, err)
+		return
+	}
+
+	id, err := r.approverGroupID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	var body approverGroupRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	updated, err := r.services.Pipeline.UpdateApproverGroup(req.Request.Context(), id, &model.ApproverGroup{
+		Name:    body.Name,
+		Members: body.Members,
+	})
+	if err != nil {
+		writeError(resp, approverGroupErrorStatus(err), err)
+		return
+	}
+	if updated == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, updated)
+}
+
+func (r *systemRouter) deleteApproverGroup(req *restful.Request, resp *restful.Response) {
+	if err := r.ensureAdmin(req); err != nil {
+		r.writeAuthError(resp, err)
+		return
+	}
+
+	id, err := r.approverGroupID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := r.services.Pipeline.DeleteApproverGroup(req.Request.Context(), id); err != nil {
+		writeError(resp, approverGroupErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *systemRouter) approverGroupID(req *restful.Request) (int64, error) {
+	id, err := strconv.ParseInt(req.PathParameter("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidApproverGroupID
+	}
+	return id, nil
+}
+
+func approverGroupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pipelinesvc.ErrApproverGroupInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, pipelinesvc.ErrApproverGroupExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, tenancy.ErrOrganizationNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"github.com/emicklei/go-restful/v3"
 	"gorm.io/gorm"
 
+	"github.com/thepenn/devsys/internal/tenancy"
 	"github.com/thepenn/devsys/model"
 	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
 	authmw "github.com/thepenn/devsys/routers/middleware/auth"
 	"github.com/thepenn/devsys/service"
+	systemsvc "github.com/thepenn/devsys/service/system"
 )
 
 var (
@@ -21,6 +23,7 @@ var (
 	errUserServiceUnavailable   = errors.New("user service unavailable")
 	errAdminOnly                = errors.New("admin privileges required")
 	errInvalidCertificateID     = errors.New("certificate id is invalid")
+	errInvalidOrganizationID    = errors.New("organization id is invalid")
 )
 
 type systemRouter struct {
@@ -44,9 +47,38 @@ func (r *systemRouter) router(register func(path string) *restful.WebService, ta
 		webServices = append(webServices, ws)
 	}
 
+	if ws := r.registerApproverGroupRoutes(register, tags); ws != nil {
+		webServices = append(webServices, ws)
+	}
+
+	if ws := r.registerAdminSystemRoutes(register, tags); ws != nil {
+		webServices = append(webServices, ws)
+	}
+
 	return webServices
 }
 
+// registerAdminSystemRoutes registers the admin-only maintenance routes under /admin/system.
+func (r *systemRouter) registerAdminSystemRoutes(register func(path string) *restful.WebService, tags []string) *restful.WebService {
+	if r.services == nil || r.authMW == nil {
+		return nil
+	}
+
+	ws := register("/admin/system")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(r.authMW.RequireAuth)
+
+	if r.services.Auth != nil {
+		r.registerSessionKeyRoutes(ws, tags)
+	}
+	r.registerProxyRoutes(ws, tags)
+	if r.services.User != nil && r.services.Repo != nil {
+		r.registerOrganizationRoutes(ws, tags)
+	}
+	return ws
+}
+
 func (r *systemRouter) registerRSA(register func(path string) *restful.WebService, tags []string) *restful.WebService {
 	ws := register("/sys/rsa")
 	ws.Route(ws.GET("/public-key").To(r.getPublicKey).
@@ -114,6 +146,20 @@ func (r *systemRouter) registerCertificateRoutes(register func(path string) *res
 		Returns(http.StatusNotFound, "not found", errorResponse{}).
 		Returns(http.StatusInternalServerError, "error", errorResponse{}))
 
+	// usage is derived from the pipeline configs, so it needs the pipeline service
+	if r.services.Pipeline != nil {
+		ws.Route(ws.GET("/{id}/usage").To(r.certificateUsage).
+			Doc("查看凭证引用情况").
+			Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+			Metadata(adminmw.AdminEnable, true).
+			Writes(model.CertificateUsage{}).
+			Returns(http.StatusOK, "OK", model.CertificateUsage{}).
+			Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+			Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+			Returns(http.StatusNotFound, "not found", errorResponse{}).
+			Returns(http.StatusInternalServerError, "error", errorResponse{}))
+	}
+
 	ws.Route(ws.DELETE("/{id}").To(r.deleteCertificate).
 		Doc("删除凭证").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
@@ -164,6 +210,14 @@ func (r *systemRouter) listCertificates(req *restful.Request, resp *restful.Resp
 		Type: req.QueryParameter("type"),
 		Name: req.QueryParameter("name"),
 	}
+	if raw := strings.TrimSpace(req.QueryParameter("org_id")); raw != "" {
+		orgID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeError(resp, http.StatusBadRequest, errInvalidOrganizationID)
+			return
+		}
+		filter.OrgID = orgID
+	}
 
 	certs, total, err := r.services.System.ListCertificates(req.Request.Context(), opts, filter)
 	if err != nil {
@@ -202,14 +256,18 @@ func (r *systemRouter) createCertificate(req *restful.Request, resp *restful.Res
 		Name:   strings.TrimSpace(body.Name),
 		Type:   strings.TrimSpace(body.Type),
 		Config: body.Config,
+		OrgID:  body.OrgID,
 	}
 
 	created, err := r.services.System.CreateCertificate(req.Request.Context(), cert)
 	if err != nil {
 		status := http.StatusInternalServerError
-		if strings.Contains(strings.ToLower(err.Error()), "required") {
+		if strings.Contains(strings.ToLower(err.Error()), "required") || errors.Is(err, systemsvc.ErrCertificateInvalid) {
 			status = http.StatusBadRequest
 		}
+		if errors.Is(err, tenancy.ErrOrganizationNotFound) {
+			status = http.StatusNotFound
+		}
 		writeError(resp, status, err)
 		return
 	}
@@ -270,6 +328,7 @@ func (r *systemRouter) updateCertificate(req *restful.Request, resp *restful.Res
 
 	patch := model.CertificatePatch{
 		Config: body.Config,
+		OrgID:  body.OrgID,
 	}
 	if body.Name != nil {
 		name := strings.TrimSpace(*body.Name)
@@ -281,13 +340,13 @@ func (r *systemRouter) updateCertificate(req *restful.Request, resp *restful.Res
 	}
 
 	updated, err := r.services.System.UpdateCertificate(req.Request.Context(), id, patch)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, tenancy.ErrOrganizationNotFound) {
 		writeError(resp, http.StatusNotFound, err)
 		return
 	}
 	if err != nil {
 		status := http.StatusInternalServerError
-		if strings.Contains(strings.ToLower(err.Error()), "required") {
+		if strings.Contains(strings.ToLower(err.Error()), "required") || errors.Is(err, systemsvc.ErrCertificateInvalid) {
 			status = http.StatusBadRequest
 		}
 		writeError(resp, status, err)
@@ -326,6 +385,32 @@ func (r *systemRouter) deleteCertificate(req *restful.Request, resp *restful.Res
 	resp.WriteHeader(http.StatusNoContent)
 }
 
+// certificateUsage lists the repositories referencing a certificate, so admins can check the
+// impact before rotating or deleting it.
+func (r *systemRouter) certificateUsage(req *restful.Request, resp *restful.Response) {
+	if err := r.ensureAdmin(req); err != nil {
+		r.writeAuthError(resp, err)
+		return
+	}
+	id, err := r.certificateID(req)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	usage, err := r.services.Pipeline.CertificateUsage(req.Request.Context(), id)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if usage == nil {
+		writeError(resp, http.StatusNotFound, gorm.ErrRecordNotFound)
+		return
+	}
+
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, usage)
+}
+
 func (r *systemRouter) ensureAdmin(req *restful.Request) error {
 	if r.services == nil || r.services.User == nil {
 		return errUserServiceUnavailable
@@ -378,12 +463,14 @@ type certificateCreateRequest struct {
 	Name   string                 `json:"name"`
 	Type   string                 `json:"type"`
 	Config map[string]interface{} `json:"config"`
+	OrgID  int64                  `json:"org_id,omitempty"`
 }
 
 type certificateUpdateRequest struct {
 	Name   *string                `json:"name,omitempty"`
 	Type   *string                `json:"type,omitempty"`
 	Config map[string]interface{} `json:"config,omitempty"`
+	OrgID  *int64                 `json:"org_id,omitempty"`
 }
 
 type certificateResponse struct {
@@ -392,8 +479,10 @@ type certificateResponse struct {
 	Type         string                 `json:"type"`
 	Config       map[string]interface{} `json:"config"`
 	MaskedFields []string               `json:"masked_fields"`
+	OrgID        int64                  `json:"org_id"`
 	Created      int64                  `json:"created"`
 	Updated      int64                  `json:"updated"`
+	Version      int                    `json:"version"`
 }
 
 type certificateListResponse struct {
@@ -411,7 +500,9 @@ func newCertificateResponse(cert *model.Certificate) certificateResponse {
 		Type:         cert.Type,
 		Config:       maskedConfig,
 		MaskedFields: maskedKeys,
+		OrgID:        cert.OrgID,
 		Created:      cert.Created,
 		Updated:      cert.Updated,
+		Version:      cert.Version,
 	}
 }
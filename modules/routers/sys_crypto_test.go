@@ -0,0 +1,129 @@
+package routers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+	authsvc "github.com/thepenn/devsys/service/auth"
+	reposvc "github.com/thepenn/devsys/service/repo"
+	systemsvc "github.com/thepenn/devsys/service/system"
+	usersvc "github.com/thepenn/devsys/service/user"
+)
+
+// newCertificateContainer serves the certificate routes with multi-tenancy enabled to alice
+// (user 1), an administrator of organization payments (1). Payments and logistics (2) both own
+// a certificate named "registry"; their ids are returned by organization.
+func newCertificateContainer(t *testing.T) (*restful.Container, map[int64]int64) {
+	t.Helper()
+	db := storetest.Open(t, &model.User{}, &model.Repo{}, &model.APIToken{}, &model.RevokedToken{},
+		&model.ServerConfig{}, &model.Organization{}, &model.OrgMember{}, &model.Certificate{})
+	records := []any{
+		&model.User{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", Hash: "alice-hash", Admin: true},
+		&model.Organization{ID: 1, Name: "payments"},
+		&model.Organization{ID: 2, Name: "logistics"},
+		&model.OrgMember{OrgID: 1, UserID: 1, Source: model.OrgMemberSourceManual},
+	}
+	for _, record := range records {
+		if err := db.GetDB().Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{}
+	cfg.Auth.Provider = "github"
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Git.GitHub = config.GitHub{Enabled: true, URL: "https://github.example", APIURL: "https://github.example", ClientID: "client", ClientSecret: "secret"}
+	users, repos := usersvc.New(db, usersvc.WithTenancy(true, nil)), reposvc.New(db)
+	auth, err := authsvc.New(cfg, db, users, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	system, err := systemsvc.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]int64)
+	for orgID, name := range map[int64]string{1: "payments", 2: "logistics"} {
+		cert, err := system.CreateCertificate(tenancy.WithScope(context.Background(), tenancy.Orgs(orgID)), &model.Certificate{
+			Name:   "registry",
+			Type:   "docker",
+			Config: map[string]interface{}{"username": name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[orgID] = cert.ID
+	}
+
+	services := &service.Services{Auth: auth, User: users, Repo: repos, System: system}
+	authMW := authmw.New(auth)
+	container := restful.NewContainer()
+	container.Filter(authMW.Authenticate)
+	container.Filter(adminmw.New(users).Filter)
+	register := func(path string) *restful.WebService {
+		ws := new(restful.WebService)
+		ws.Path(path)
+		return ws
+	}
+	container.Add(newSystemRouter(services, authMW).registerCertificateRoutes(register, nil))
+	return container, ids
+}
+
+func certificateRequest(t *testing.T, container *restful.Container, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	req.Header.Set("Authorization", "Bearer "+sessionToken(t))
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCertificateOfAnotherOrganizationIsNotFound(t *testing.T) {
+	container, ids := newCertificateContainer(t)
+
+	own := fmt.Sprintf("/sys/certificates/%d", ids[1])
+	if rec := certificateRequest(t, container, http.MethodGet, own, ""); rec.Code != http.StatusOK {
+		t.Fatalf("GET own certificate = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	// the equally named certificate of logistics answers like an id that never existed
+	other := fmt.Sprintf("/sys/certificates/%d", ids[2])
+	missing := "/sys/certificates/999"
+	for _, tc := range []struct {
+		method string
+		body   string
+	}{
+		{http.MethodGet, ""},
+		{http.MethodPut, `{"name":"taken"}`},
+		{http.MethodDelete, ""},
+	} {
+		otherRec := certificateRequest(t, container, tc.method, other, tc.body)
+		missingRec := certificateRequest(t, container, tc.method, missing, tc.body)
+		if otherRec.Code != http.StatusNotFound || otherRec.Body.String() != missingRec.Body.String() {
+			t.Errorf("%s of another organization's certificate = %d %s, want the 404 of a missing one (%d %s)",
+				tc.method, otherRec.Code, otherRec.Body, missingRec.Code, missingRec.Body)
+		}
+	}
+	if rec := certificateRequest(t, container, http.MethodGet, other+"?reveal=true", ""); rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "logistics") {
+		t.Errorf("revealing another organization's certificate = %d %s, want 404", rec.Code, rec.Body)
+	}
+
+	rec := certificateRequest(t, container, http.MethodGet, "/sys/certificates?name=registry", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "logistics") || !strings.Contains(rec.Body.String(), fmt.Sprintf(`"id": %d`, ids[1])) {
+		t.Errorf("list = %d %s, want only the payments certificate", rec.Code, rec.Body)
+	}
+}
@@ -6,41 +6,32 @@ import (
 
 	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/thepenn/devsys/internal/config"
+	appmetrics "github.com/thepenn/devsys/internal/metrics"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
 	"github.com/thepenn/devsys/routers/middleware/metrics"
-)
-
-var (
-	httpRequestsTotal = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests",
-		},
-		[]string{"method", "endpoint", "status"},
-	)
-
-	httpRequestDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "Duration of HTTP requests in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"method", "endpoint"},
-	)
-
-	healthStatus = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "app_health_status",
-			Help: "Application health status (1 = healthy, 0 = unhealthy)",
-		},
-	)
+	"github.com/thepenn/devsys/service"
 )
 
 type health struct {
 	startTime time.Time
+	registry  *appmetrics.Registry
+	authMW    *authmw.Middleware
+	// adminOnlyMetrics restricts /metrics to administrators.
+	adminOnlyMetrics bool
+}
+
+func newHealth(cfg *config.Config, services *service.Services, authMW *authmw.Middleware) *health {
+	h := &health{startTime: time.Now(), authMW: authMW}
+	if services != nil {
+		h.registry = services.Metrics
+	}
+	if cfg != nil {
+		h.adminOnlyMetrics = cfg.Server.MetricsAdminOnly
+	}
+	return h
 }
 
 func (h *health) router(register func(path string) *restful.WebService, tags []string) []*restful.WebService {
@@ -57,9 +48,16 @@ func (h *health) router(register func(path string) *restful.WebService, tags []s
 		Returns(503, "Service Unavailable", nil))
 
 	metricsWs := register("").Path("/metrics")
-	metricsWs.Route(metricsWs.GET("").To(h.metrics).Doc("metrics").
+	metricsRoute := metricsWs.GET("").To(h.metrics).Doc("metrics").
 		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
-		Returns(200, "OK", nil))
+		Returns(200, "OK", nil)
+	if h.adminOnlyMetrics && h.authMW != nil {
+		metricsRoute.Filter(h.authMW.RequireAuth).
+			Metadata(adminmw.AdminEnable, true).
+			Returns(401, "Unauthorized", nil).
+			Returns(403, "Forbidden", nil)
+	}
+	metricsWs.Route(metricsRoute)
 
 	return []*restful.WebService{
 		pingWs,
@@ -73,7 +71,7 @@ func (h *health) ping(req *restful.Request, resp *restful.Response) {
 }
 
 func (h *health) healthy(req *restful.Request, resp *restful.Response) {
-	healthStatus.Set(1)
+	h.registry.SetHealthy(true)
 
 	data := map[string]interface{}{
 		"status":    "healthy",
@@ -81,21 +79,20 @@ func (h *health) healthy(req *restful.Request, resp *restful.Response) {
 		"timestamp": time.Now().Format(time.RFC3339),
 	}
 
-	httpRequestsTotal.WithLabelValues("GET", "/health", "200").Inc()
-	startTime, ok := metrics.StartTimeFromContext(req.Request.Context())
-	if ok {
-		httpRequestDuration.WithLabelValues("GET", "/health").Observe(time.Since(startTime).Seconds())
-	}
+	h.observe(req, "/health")
 
 	_ = resp.WriteHeaderAndEntity(http.StatusOK, data)
 }
 
 func (h *health) metrics(req *restful.Request, resp *restful.Response) {
-	httpRequestsTotal.WithLabelValues("GET", "/metrics", "200").Inc()
-	startTime, ok := metrics.StartTimeFromContext(req.Request.Context())
-	if ok {
-		httpRequestDuration.WithLabelValues("GET", "/metrics").Observe(time.Since(startTime).Seconds())
-	}
+	h.observe(req, "/metrics")
+	h.registry.Handler().ServeHTTP(resp.ResponseWriter, req.Request)
+}
 
-	promhttp.Handler().ServeHTTP(resp.ResponseWriter, req.Request)
+func (h *health) observe(req *restful.Request, endpoint string) {
+	var duration time.Duration
+	if startTime, ok := metrics.StartTimeFromContext(req.Request.Context()); ok {
+		duration = time.Since(startTime)
+	}
+	h.registry.ObserveHTTPRequest("GET", endpoint, "200", duration)
 }
@@ -0,0 +1,67 @@
+package routers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/metrics"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	"github.com/thepenn/devsys/service"
+)
+
+func newHealthContainer(cfg *config.Config, services *service.Services) *restful.Container {
+	container := restful.NewContainer()
+	register := func(path string) *restful.WebService {
+		ws := new(restful.WebService)
+		ws.Path(path).Produces(restful.MIME_JSON)
+		return ws
+	}
+	for _, ws := range newHealth(cfg, services, authmw.New(nil)).router(register, nil) {
+		container.Add(ws)
+	}
+	container.Filter(adminmw.New(nil).Filter)
+	return container
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	registry := metrics.New()
+	registry.PipelineStarted("team/app", "push")
+	container := newHealthContainer(&config.Config{}, &service.Services{Metrics: registry})
+
+	if rec := serve(container, http.MethodGet, "/health"); rec.Code != http.StatusOK {
+		t.Fatalf("GET /health = %d", rec.Code)
+	}
+	rec := serve(container, http.MethodGet, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`devsys_pipelines_total{event="push",repo="team/app",result="started"} 1`,
+		`app_health_status 1`,
+		`http_requests_total{endpoint="/health",method="GET",status="200"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics misses %s", want)
+		}
+	}
+}
+
+func TestMetricsEndpointAdminOnly(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.MetricsAdminOnly = true
+	container := newHealthContainer(cfg, &service.Services{Metrics: metrics.New()})
+
+	if rec := serve(container, http.MethodGet, "/metrics"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET /metrics = %d, want 401", rec.Code)
+	}
+	// the other health routes stay public
+	if rec := serve(container, http.MethodGet, "/health"); rec.Code != http.StatusOK {
+		t.Errorf("anonymous GET /health = %d, want 200", rec.Code)
+	}
+}
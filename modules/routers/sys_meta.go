@@ -0,0 +1,34 @@
+package routers
+
+import (
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
+)
+
+type metaRouter struct {
+	services *service.Services
+}
+
+func newMetaRouter(services *service.Services) *metaRouter {
+	return &metaRouter{services: services}
+}
+
+func (r *metaRouter) router(register func(path string) *restful.WebService, tags []string) []*restful.WebService {
+	ws := register("/meta")
+	ws.Route(ws.GET("/capabilities").To(r.capabilities).
+		Doc("获取已启用的子系统").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Produces(restful.MIME_JSON).
+		Writes(model.Capabilities{}).
+		Returns(http.StatusOK, "OK", model.Capabilities{}))
+	return []*restful.WebService{ws}
+}
+
+func (r *metaRouter) capabilities(req *restful.Request, resp *restful.Response) {
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, r.services.Capabilities())
+}
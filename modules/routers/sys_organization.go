@@ -0,0 +1,221 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	userService "github.com/thepenn/devsys/service/user"
+)
+
+var errSuperAdminOnly = errors.New("super admin privileges required")
+
+type organizationRequest struct {
+	Name string `json:"name"`
+}
+
+type orgMemberRequest struct {
+	Login string `json:"login"`
+}
+
+func (r *systemRouter) registerOrganizationRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/organizations").To(r.listOrganizations).
+		Doc("列出当前用户可见的组织").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]*model.Organization{}).
+		Returns(http.StatusOK, "OK", []*model.Organization{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}))
+
+	ws.Route(ws.POST("/organizations").To(r.createOrganization).
+		Doc("创建组织，仅超级管理员可用；与代码托管平台组织同名时其成员登录后自动加入").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(organizationRequest{}).
+		Returns(http.StatusCreated, "created", model.Organization{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusConflict, "exists", errorResponse{}))
+
+	ws.Route(ws.DELETE("/organizations/{org_id}").To(r.deleteOrganization).
+		Doc("删除不再拥有凭证、审批组和仓库的组织，仅超级管理员可用").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "deleted", nil).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}).
+		Returns(http.StatusConflict, "in use", errorResponse{}))
+
+	ws.Route(ws.GET("/organizations/{org_id}/members").To(r.listOrgMembers).
+		Doc("列出组织成员").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes([]model.OrgMemberInfo{}).
+		Returns(http.StatusOK, "OK", []model.OrgMemberInfo{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	ws.Route(ws.POST("/organizations/{org_id}/members").To(r.addOrgMember).
+		Doc("手动将用户加入组织").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Reads(orgMemberRequest{}).
+		Returns(http.StatusNoContent, "added", nil).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	ws.Route(ws.DELETE("/organizations/{org_id}/members/{user_id}").To(r.removeOrgMember).
+		Doc("将用户移出组织").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "removed", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	ws.Route(ws.PUT("/organizations/{org_id}/repos/{repo_id}").To(r.assignRepoOrganization).
+		Doc("将仓库划入组织，之后其流水线只能解析该组织的凭证和审批组").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Returns(http.StatusNoContent, "assigned", nil).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+}
+
+func (r *systemRouter) listOrganizations(req *restful.Request, resp *restful.Response) {
+	orgs, err := r.services.User.ListOrganizations(req.Request.Context())
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if orgs == nil {
+		orgs = []*model.Organization{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, orgs)
+}
+
+func (r *systemRouter) createOrganization(req *restful.Request, resp *restful.Response) {
+	if !tenancy.FromContext(req.Request.Context()).All {
+		writeError(resp, http.StatusForbidden, errSuperAdminOnly)
+		return
+	}
+	var body organizationRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	org, err := r.services.User.CreateOrganization(req.Request.Context(), body.Name)
+	if err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, org)
+}
+
+func (r *systemRouter) deleteOrganization(req *restful.Request, resp *restful.Response) {
+	if !tenancy.FromContext(req.Request.Context()).All {
+		writeError(resp, http.StatusForbidden, errSuperAdminOnly)
+		return
+	}
+	orgID, ok := pathID(req, resp, "org_id")
+	if !ok {
+		return
+	}
+	if err := r.services.User.DeleteOrganization(req.Request.Context(), orgID); err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *systemRouter) listOrgMembers(req *restful.Request, resp *restful.Response) {
+	orgID, ok := pathID(req, resp, "org_id")
+	if !ok {
+		return
+	}
+	members, err := r.services.User.ListOrgMembers(req.Request.Context(), orgID)
+	if err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	if members == nil {
+		members = []model.OrgMemberInfo{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, members)
+}
+
+func (r *systemRouter) addOrgMember(req *restful.Request, resp *restful.Response) {
+	orgID, ok := pathID(req, resp, "org_id")
+	if !ok {
+		return
+	}
+	var body orgMemberRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	if err := r.services.User.AddOrgMember(req.Request.Context(), orgID, body.Login); err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *systemRouter) removeOrgMember(req *restful.Request, resp *restful.Response) {
+	orgID, ok := pathID(req, resp, "org_id")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(req, resp, "user_id")
+	if !ok {
+		return
+	}
+	if err := r.services.User.RemoveOrgMember(req.Request.Context(), orgID, userID); err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (r *systemRouter) assignRepoOrganization(req *restful.Request, resp *restful.Response) {
+	orgID, ok := pathID(req, resp, "org_id")
+	if !ok {
+		return
+	}
+	repoID, ok := pathID(req, resp, "repo_id")
+	if !ok {
+		return
+	}
+	if err := r.services.Repo.SetOrganization(req.Request.Context(), repoID, orgID); err != nil {
+		writeError(resp, organizationErrorStatus(err), err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// pathID parses a positive id path parameter and writes a 400 response when it is invalid.
+func pathID(req *restful.Request, resp *restful.Response, name string) (int64, bool) {
+	id, err := strconv.ParseInt(req.PathParameter(name), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(resp, http.StatusBadRequest, errors.New(name+" is invalid"))
+		return 0, false
+	}
+	return id, true
+}
+
+func organizationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, userService.ErrOrganizationInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, userService.ErrOrganizationExists), errors.Is(err, userService.ErrOrganizationInUse):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, tenancy.ErrOrganizationNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
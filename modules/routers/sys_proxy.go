@@ -0,0 +1,37 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	"github.com/thepenn/devsys/internal/proxy"
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+)
+
+func (r *systemRouter) registerProxyRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/proxy-check").To(r.checkProxy).
+		Doc("查看访问指定地址时是否经过出站代理").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Param(ws.QueryParameter("url", "要检查的目标地址").Required(true)).
+		Writes(proxy.Decision{}).
+		Returns(http.StatusOK, "OK", proxy.Decision{}).
+		Returns(http.StatusBadRequest, "invalid url", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}))
+}
+
+func (r *systemRouter) checkProxy(req *restful.Request, resp *restful.Response) {
+	raw := strings.TrimSpace(req.QueryParameter("url"))
+	target, err := url.Parse(raw)
+	if raw == "" || err != nil || target.Scheme == "" || target.Host == "" {
+		writeError(resp, http.StatusBadRequest, errors.New("url must be an absolute http(s) url"))
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, r.services.Proxy.Decide(target))
+}
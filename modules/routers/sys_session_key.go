@@ -0,0 +1,70 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+
+	adminmw "github.com/thepenn/devsys/routers/middleware/admin"
+	authsvc "github.com/thepenn/devsys/service/auth"
+)
+
+func (r *systemRouter) registerSessionKeyRoutes(ws *restful.WebService, tags []string) {
+	ws.Route(ws.GET("/session-key").To(r.getSessionKeyStatus).
+		Doc("查看会话签名密钥的轮换状态").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(authsvc.SessionKeyStatus{}).
+		Returns(http.StatusOK, "OK", authsvc.SessionKeyStatus{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}))
+
+	ws.Route(ws.POST("/rotate-session-key").To(r.rotateSessionKey).
+		Doc("生成新的会话签名密钥，旧密钥在一个令牌有效期内仍可用于校验").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(authsvc.SessionKeyStatus{}).
+		Returns(http.StatusOK, "OK", authsvc.SessionKeyStatus{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	ws.Route(ws.DELETE("/session-key/secondary").To(r.dropSecondarySessionKey).
+		Doc("立即停用上一次轮换前的会话签名密钥").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Metadata(adminmw.AdminEnable, true).
+		Writes(authsvc.SessionKeyStatus{}).
+		Returns(http.StatusOK, "OK", authsvc.SessionKeyStatus{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusForbidden, "forbidden", errorResponse{}).
+		Returns(http.StatusConflict, "no secondary key", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+}
+
+func (r *systemRouter) getSessionKeyStatus(req *restful.Request, resp *restful.Response) {
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, r.services.Auth.SessionKeyStatus())
+}
+
+func (r *systemRouter) rotateSessionKey(req *restful.Request, resp *restful.Response) {
+	status, err := r.services.Auth.RotateSessionKey(req.Request.Context())
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, status)
+}
+
+func (r *systemRouter) dropSecondarySessionKey(req *restful.Request, resp *restful.Response) {
+	status, err := r.services.Auth.DropSecondarySessionKey(req.Request.Context())
+	if errors.Is(err, authsvc.ErrNoSecondarySessionKey) {
+		writeError(resp, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, status)
+}
@@ -0,0 +1,138 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	authmw "github.com/thepenn/devsys/routers/middleware/auth"
+	authsvc "github.com/thepenn/devsys/service/auth"
+)
+
+var errTokenSessionOnly = errors.New("API tokens cannot manage API tokens")
+
+type apiTokenCreateRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays of 0 creates a token that never expires.
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// apiTokenCreateResponse is the only response carrying the plain token.
+type apiTokenCreateResponse struct {
+	*model.APIToken
+	Token string `json:"token"`
+}
+
+func (r *authRouter) registerTokenRoutes(register func(path string) *restful.WebService, tags []string) *restful.WebService {
+	ws := register("/user")
+	ws.Filter(r.authMW.Authenticate)
+
+	ws.Route(ws.GET("/tokens").To(r.listAPITokens).
+		Doc("List the personal access tokens of the current user; token values are never returned").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Produces(restful.MIME_JSON).
+		Writes([]*model.APIToken{}).
+		Returns(http.StatusOK, "tokens", []*model.APIToken{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}))
+
+	ws.Route(ws.POST("/tokens").To(r.createAPIToken).
+		Doc("Create a personal access token; the token is only shown in this response").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Reads(apiTokenCreateRequest{}).
+		Returns(http.StatusCreated, "token", apiTokenCreateResponse{}).
+		Returns(http.StatusBadRequest, "invalid request", errorResponse{}).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}))
+
+	ws.Route(ws.DELETE("/tokens/{token_id}").To(r.deleteAPIToken).
+		Doc("Revoke a personal access token").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Filter(r.authMW.RequireAuth).
+		Returns(http.StatusNoContent, "revoked", nil).
+		Returns(http.StatusUnauthorized, "unauthorized", errorResponse{}).
+		Returns(http.StatusNotFound, "not found", errorResponse{}))
+
+	return ws
+}
+
+func (r *authRouter) listAPITokens(req *restful.Request, resp *restful.Response) {
+	claims, ok := sessionClaims(req, resp)
+	if !ok {
+		return
+	}
+	tokens, err := r.services.Auth.ListAPITokens(req.Request.Context(), claims.UserID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if tokens == nil {
+		tokens = []*model.APIToken{}
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusOK, tokens)
+}
+
+func (r *authRouter) createAPIToken(req *restful.Request, resp *restful.Response) {
+	claims, ok := sessionClaims(req, resp)
+	if !ok {
+		return
+	}
+	var body apiTokenCreateRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	ttl := time.Duration(body.ExpiresInDays) * 24 * time.Hour
+	token, plain, err := r.services.Auth.CreateAPIToken(req.Request.Context(), claims.UserID, body.Name, body.Scopes, ttl)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, authsvc.ErrAPITokenInvalid) {
+			status = http.StatusBadRequest
+		}
+		writeError(resp, status, err)
+		return
+	}
+	_ = resp.WriteHeaderAndEntity(http.StatusCreated, apiTokenCreateResponse{APIToken: token, Token: plain})
+}
+
+func (r *authRouter) deleteAPIToken(req *restful.Request, resp *restful.Response) {
+	claims, ok := sessionClaims(req, resp)
+	if !ok {
+		return
+	}
+	id, ok := pathID(req, resp, "token_id")
+	if !ok {
+		return
+	}
+	if err := r.services.Auth.DeleteAPIToken(req.Request.Context(), claims.UserID, id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(resp, status, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// sessionClaims returns the caller of a route only browser sessions may use.
+func sessionClaims(req *restful.Request, resp *restful.Response) (*authsvc.SessionClaims, bool) {
+	claims, ok := authmw.FromContext(req.Request.Context())
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+	if claims.APIToken() {
+		writeError(resp, http.StatusForbidden, errTokenSessionOnly)
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,350 @@
+package routers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	restfulOpenapi "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service"
+	pipelinesvc "github.com/thepenn/devsys/service/pipeline"
+)
+
+// webhookMaxBodySize bounds the payload read from forges.
+const webhookMaxBodySize = 5 << 20
+
+var (
+	errWebhookSignature   = errors.New("webhook signature mismatch")
+	errWebhookSecret      = errors.New("webhook secret not configured for repository")
+	errWebhookUnsupported = errors.New("unsupported forge type")
+	errWebhookIgnored     = errors.New("webhook event ignored")
+)
+
+type webhookRouter struct {
+	services *service.Services
+}
+
+type webhookResponse struct {
+	PipelineID int64              `json:"pipeline_id"`
+	Number     int64              `json:"number"`
+	Event      model.WebhookEvent `json:"event"`
+	Branch     string             `json:"branch"`
+	Commit     string             `json:"commit"`
+	// Status is skipped, with the reason in Message, when the trigger created no run.
+	Status  model.StatusValue `json:"status"`
+	Message string            `json:"message,omitempty"`
+}
+
+// webhookPushPayload covers the push payload fields shared by GitHub, GitLab, Gitea and Gitee.
+type webhookPushPayload struct {
+	Ref          string          `json:"ref"`
+	Before       string          `json:"before"`
+	After        string          `json:"after"`
+	Forced       bool            `json:"forced"`
+	CheckoutSHA  string          `json:"checkout_sha"`
+	UserName     string          `json:"user_name"`
+	UserUsername string          `json:"user_username"`
+	HeadCommit   *webhookCommit  `json:"head_commit"`
+	Commits      []webhookCommit `json:"commits"`
+	// TotalCommitsCount is sent by GitLab, which lists at most 20 commits.
+	TotalCommitsCount int         `json:"total_commits_count"`
+	Pusher            webhookUser `json:"pusher"`
+	Sender            webhookUser `json:"sender"`
+}
+
+type webhookCommit struct {
+	ID       string      `json:"id"`
+	Message  string      `json:"message"`
+	Author   webhookUser `json:"author"`
+	Added    []string    `json:"added"`
+	Modified []string    `json:"modified"`
+	Removed  []string    `json:"removed"`
+}
+
+type webhookUser struct {
+	Name     string `json:"name"`
+	Login    string `json:"login"`
+	Username string `json:"username"`
+}
+
+func newWebhookRouter(services *service.Services) *webhookRouter {
+	return &webhookRouter{services: services}
+}
+
+func (r *webhookRouter) router(register func(string) *restful.WebService, tags []string) []*restful.WebService {
+	ws := register("/hooks")
+	ws.Filter(requireCapability(r.services, model.CapabilityPipeline))
+
+	ws.Route(ws.POST("/{forge_type}/{repo_remote_id}").To(r.receive).
+		Doc("Receive a forge push webhook and trigger the repository pipeline").
+		Metadata(restfulOpenapi.KeyOpenAPITags, tags).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Param(ws.PathParameter("forge_type", "github, gitlab, gitea or gitee")).
+		Param(ws.PathParameter("repo_remote_id", "repository id on the forge")).
+		Writes(webhookResponse{}).
+		Returns(http.StatusCreated, "pipeline created", webhookResponse{}).
+		Returns(http.StatusBadRequest, "invalid payload", errorResponse{}).
+		Returns(http.StatusForbidden, "signature mismatch", errorResponse{}).
+		Returns(http.StatusNotFound, "repository not found", errorResponse{}).
+		Returns(http.StatusConflict, "repository inactive", errorResponse{}).
+		Returns(http.StatusUnprocessableEntity, "event ignored", errorResponse{}).
+		Returns(http.StatusInternalServerError, "error", errorResponse{}))
+
+	return []*restful.WebService{ws}
+}
+
+func (r *webhookRouter) receive(req *restful.Request, resp *restful.Response) {
+	ctx := req.Request.Context()
+	forgeType := model.ForgeType(strings.ToLower(strings.TrimSpace(req.PathParameter("forge_type"))))
+	remoteID := model.ForgeRemoteID(strings.TrimSpace(req.PathParameter("repo_remote_id")))
+
+	switch forgeType {
+	case model.ForgeTypeGithub, model.ForgeTypeGitlab, model.ForgeTypeGitea, model.ForgeTypeGitee:
+	default:
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("%w: %s", errWebhookUnsupported, forgeType))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Request.Body, webhookMaxBodySize))
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	repo, err := r.services.Repo.FindByForgeRemoteID(ctx, forgeType, remoteID)
+	if err != nil {
+		writeError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	if repo == nil {
+		writeError(resp, http.StatusNotFound, errRepoNotFound)
+		return
+	}
+
+	if err := verifyWebhookSignature(forgeType, req.Request, body, repo.Hash); err != nil {
+		log.Warn().Err(err).Str("forge", string(forgeType)).Int64("repo_id", repo.ID).Msg("rejected webhook")
+		writeError(resp, http.StatusForbidden, err)
+		return
+	}
+
+	if isWebhookPing(forgeType, req.Request) {
+		_ = resp.WriteHeaderAndEntity(http.StatusOK, map[string]string{"message": "pong"})
+		return
+	}
+
+	if !isWebhookPush(forgeType, req.Request) {
+		writeError(resp, http.StatusUnprocessableEntity, fmt.Errorf("%w: only push events trigger pipelines", errWebhookIgnored))
+		return
+	}
+
+	var payload webhookPushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeError(resp, http.StatusBadRequest, fmt.Errorf("invalid webhook payload: %w", err))
+		return
+	}
+
+	event, opts, author, message, err := payload.pipelineOptions()
+	if err != nil {
+		writeError(resp, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	pipeline, err := r.services.Pipeline.TriggerWebhookPipeline(ctx, repo, event, author, message, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, pipelinesvc.ErrRepoInactive):
+			status = http.StatusConflict
+		case errors.Is(err, pipelinesvc.ErrPipelineConfigMissing), errors.Is(err, pipelinesvc.ErrBranchNotAllowed):
+			status = http.StatusUnprocessableEntity
+		}
+		writeError(resp, status, err)
+		return
+	}
+
+	response := webhookResponse{
+		PipelineID: pipeline.ID,
+		Number:     pipeline.Number,
+		Event:      pipeline.Event,
+		Branch:     pipeline.Branch,
+		Commit:     pipeline.Commit,
+		Status:     pipeline.Status,
+	}
+	status := http.StatusCreated
+	if pipeline.Status == model.StatusSkipped {
+		// the skipped record is created, but nothing runs
+		response.Message = pipeline.Message
+		status = http.StatusOK
+	}
+	_ = resp.WriteHeaderAndEntity(status, response)
+}
+
+// pipelineOptions maps the push payload onto the event, options, author and message of a pipeline run.
+func (p webhookPushPayload) pipelineOptions() (model.WebhookEvent, model.PipelineOptions, string, string, error) {
+	commit := strings.TrimSpace(firstNonEmptyString(p.After, p.CheckoutSHA))
+	if commit == "" || strings.Trim(commit, "0") == "" {
+		return "", model.PipelineOptions{}, "", "", fmt.Errorf("%w: branch or tag deleted", errWebhookIgnored)
+	}
+
+	var message, author string
+	if p.HeadCommit != nil {
+		message = p.HeadCommit.Message
+		author = firstNonEmptyString(p.HeadCommit.Author.Username, p.HeadCommit.Author.Name)
+	} else if len(p.Commits) > 0 {
+		last := p.Commits[len(p.Commits)-1]
+		message = last.Message
+		author = firstNonEmptyString(last.Author.Username, last.Author.Name)
+	}
+	author = firstNonEmptyString(p.Pusher.Login, p.Pusher.Username, p.Pusher.Name, p.UserUsername, p.UserName, p.Sender.Login, p.Sender.Username, author)
+
+	opts := model.PipelineOptions{
+		Commit:       commit,
+		Variables:    map[string]string{},
+		ChangedFiles: p.changedFiles(),
+	}
+	ref := strings.TrimSpace(p.Ref)
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		opts.Branch = strings.TrimPrefix(ref, "refs/heads/")
+		return model.EventPush, opts, author, strings.TrimSpace(message), nil
+	case strings.HasPrefix(ref, "refs/tags/"):
+		opts.Ref = ref
+		return model.EventTag, opts, author, strings.TrimSpace(message), nil
+	default:
+		return "", model.PipelineOptions{}, "", "", fmt.Errorf("%w: unsupported ref %q", errWebhookIgnored, ref)
+	}
+}
+
+// changedFiles returns the files changed by the pushed commits, or nil when the payload
+// cannot tell: new branches, forced pushes, truncated commit lists and forges that do not
+// list the files of commits.
+func (p webhookPushPayload) changedFiles() []string {
+	before := strings.TrimSpace(p.Before)
+	if before == "" || strings.Trim(before, "0") == "" || p.Forced || len(p.Commits) == 0 {
+		return nil
+	}
+	if p.TotalCommitsCount > len(p.Commits) {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	files := make([]string, 0)
+	for _, commit := range p.Commits {
+		if commit.Added == nil && commit.Modified == nil && commit.Removed == nil {
+			return nil
+		}
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if _, ok := seen[file]; ok || file == "" {
+					continue
+				}
+				seen[file] = struct{}{}
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+func isWebhookPing(forgeType model.ForgeType, req *http.Request) bool {
+	switch forgeType {
+	case model.ForgeTypeGithub:
+		return req.Header.Get("X-GitHub-Event") == "ping"
+	case model.ForgeTypeGitea:
+		return req.Header.Get("X-Gitea-Event") == "ping"
+	default:
+		return false
+	}
+}
+
+func isWebhookPush(forgeType model.ForgeType, req *http.Request) bool {
+	switch forgeType {
+	case model.ForgeTypeGithub:
+		return req.Header.Get("X-GitHub-Event") == "push"
+	case model.ForgeTypeGitea:
+		return req.Header.Get("X-Gitea-Event") == "push"
+	case model.ForgeTypeGitlab:
+		event := req.Header.Get("X-Gitlab-Event")
+		return event == "Push Hook" || event == "Tag Push Hook"
+	case model.ForgeTypeGitee:
+		event := req.Header.Get("X-Gitee-Event")
+		return event == "Push Hook" || event == "Tag Push Hook"
+	default:
+		return false
+	}
+}
+
+// verifyWebhookSignature validates the forge specific signature using the repository hash as shared secret.
+func verifyWebhookSignature(forgeType model.ForgeType, req *http.Request, body []byte, secret string) error {
+	if strings.TrimSpace(secret) == "" {
+		return errWebhookSecret
+	}
+	switch forgeType {
+	case model.ForgeTypeGitlab:
+		if !hmac.Equal([]byte(req.Header.Get("X-Gitlab-Token")), []byte(secret)) {
+			return errWebhookSignature
+		}
+		return nil
+	case model.ForgeTypeGithub:
+		signature := strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256=")
+		return verifyHexHMAC(signature, body, secret)
+	case model.ForgeTypeGitea:
+		return verifyHexHMAC(req.Header.Get("X-Gitea-Signature"), body, secret)
+	case model.ForgeTypeGitee:
+		token := req.Header.Get("X-Gitee-Token")
+		timestamp := req.Header.Get("X-Gitee-Timestamp")
+		if timestamp == "" {
+			// password mode sends the secret verbatim
+			if !hmac.Equal([]byte(token), []byte(secret)) {
+				return errWebhookSignature
+			}
+			return nil
+		}
+		if decoded, err := url.QueryUnescape(token); err == nil {
+			token = decoded
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "\n" + secret))
+		expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(token), []byte(expected)) {
+			return errWebhookSignature
+		}
+		return nil
+	default:
+		return errWebhookUnsupported
+	}
+}
+
+func verifyHexHMAC(signature string, body []byte, secret string) error {
+	provided, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(provided) == 0 {
+		return errWebhookSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(provided, mac.Sum(nil)) {
+		return errWebhookSignature
+	}
+	return nil
+}
+
+func firstNonEmptyString(values ...string) string {
+	for _, value := range values {
+		if trimmed := strings.TrimSpace(value); trimmed != "" {
+			return trimmed
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/internal/config"
+)
+
+const (
+	defaultWebsocketMaxMessageSize = 64 << 10
+	defaultWebsocketPongWait       = 60 * time.Second
+	defaultWebsocketWriteWait      = 10 * time.Second
+)
+
+// websocketHub upgrades HTTP requests into websocket sessions that share origin checks,
+// read limits and keepalive settings.
+type websocketHub struct {
+	upgrader       websocket.Upgrader
+	allowedOrigins map[string]struct{}
+	maxMessageSize int64
+	pongWait       time.Duration
+	writeWait      time.Duration
+}
+
+func newWebsocketHub(cfg *config.Config) *websocketHub {
+	h := &websocketHub{
+		allowedOrigins: make(map[string]struct{}),
+		maxMessageSize: defaultWebsocketMaxMessageSize,
+		pongWait:       defaultWebsocketPongWait,
+		writeWait:      defaultWebsocketWriteWait,
+	}
+	if cfg != nil {
+		wsCfg := cfg.Server.Websocket
+		for _, origin := range wsCfg.AllowedOrigins {
+			if normalized := normalizeOrigin(origin); normalized != "" {
+				h.allowedOrigins[normalized] = struct{}{}
+			}
+		}
+		if normalized := normalizeOrigin(cfg.Server.PublicURL); normalized != "" {
+			h.allowedOrigins[normalized] = struct{}{}
+		}
+		if wsCfg.MaxMessageSize > 0 {
+			h.maxMessageSize = wsCfg.MaxMessageSize
+		}
+		if wsCfg.PongWait > 0 {
+			h.pongWait = wsCfg.PongWait
+		}
+		if wsCfg.WriteWait > 0 {
+			h.writeWait = wsCfg.WriteWait
+		}
+	}
+	h.upgrader = websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	return h
+}
+
+// checkOrigin accepts requests without an Origin header (non-browser clients), same-host
+// origins and the configured allow list.
+func (h *websocketHub) checkOrigin(r *http.Request) bool {
+	origin := strings.TrimSpace(r.Header.Get("Origin"))
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		log.Warn().Str("origin", origin).Msg("rejected websocket with malformed origin")
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	if _, ok := h.allowedOrigins[normalizeOrigin(origin)]; ok {
+		return true
+	}
+	log.Warn().Str("origin", origin).Str("path", r.URL.Path).Msg("rejected websocket from disallowed origin")
+	return false
+}
+
+// Upgrade upgrades the request and starts the ping keepalive. The caller must Close the session.
+func (h *websocketHub) Upgrade(w http.ResponseWriter, r *http.Request) (*websocketSession, error) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(h.maxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(h.pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.pongWait))
+	})
+
+	session := &websocketSession{
+		conn:      conn,
+		writeWait: h.writeWait,
+		done:      make(chan struct{}),
+	}
+	go session.keepalive(h.pongWait * 9 / 10)
+	return session, nil
+}
+
+// websocketSession serialises writes on a connection; gorilla allows one concurrent writer.
+type websocketSession struct {
+	conn      *websocket.Conn
+	writeWait time.Duration
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *websocketSession) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.writeWait))
+			s.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ReadMessage reads the next message. Oversized frames close the connection with
+// CloseMessageTooBig before the error is returned.
+func (s *websocketSession) ReadMessage() (int, []byte, error) {
+	messageType, data, err := s.conn.ReadMessage()
+	if errors.Is(err, websocket.ErrReadLimit) {
+		s.CloseWith(websocket.CloseMessageTooBig, "message exceeds size limit")
+	}
+	return messageType, data, err
+}
+
+func (s *websocketSession) WriteMessage(messageType int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.writeWait))
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// CloseWith sends a close frame with the code and reason and closes the connection.
+func (s *websocketSession) CloseWith(code int, reason string) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(s.writeWait))
+		s.mu.Unlock()
+		_ = s.conn.Close()
+	})
+}
+
+func (s *websocketSession) Close() {
+	s.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+func normalizeOrigin(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
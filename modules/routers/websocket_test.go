@@ -0,0 +1,131 @@
+package routers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/thepenn/devsys/internal/config"
+)
+
+// newEchoServer serves a websocket echoing the messages it reads through a hub built from cfg.
+func newEchoServer(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	hub := newWebsocketHub(cfg)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := hub.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		for {
+			messageType, data, err := session.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := session.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dialWebsocket(url, origin string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func TestWebsocketOrigins(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.PublicURL = "https://ci.example/devsys"
+	cfg.Server.Websocket.AllowedOrigins = []string{"http://localhost:5173"}
+	url := newEchoServer(t, cfg)
+
+	for _, origin := range []string{"", "https://ci.example", "http://LOCALHOST:5173"} {
+		conn, _, err := dialWebsocket(url, origin)
+		if err != nil {
+			t.Errorf("origin %q rejected: %v", origin, err)
+			continue
+		}
+		conn.Close()
+	}
+	for _, origin := range []string{"https://evil.example", "https://ci.example.evil.example", "null"} {
+		conn, resp, err := dialWebsocket(url, origin)
+		if err == nil {
+			conn.Close()
+			t.Errorf("origin %q accepted", origin)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q = %v, want 403", origin, err)
+		}
+	}
+}
+
+func TestWebsocketClosesOversizedMessages(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Websocket.MaxMessageSize = 1024
+	conn, _, err := dialWebsocket(newEchoServer(t, cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "small" {
+		t.Fatalf("echo = %q, %v", data, err)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after an oversized frame = %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestWebsocketKeepalive(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Websocket.PongWait = 100 * time.Millisecond
+	conn, _, err := dialWebsocket(newEchoServer(t, cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	// control frames are handled while reading; the server sends nothing else
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pinged:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server sent no ping")
+	}
+}
@@ -0,0 +1,296 @@
+// Package audit keeps a trail of who triggered, cancelled, approved or changed what.
+//
+// Events are recorded without touching the database: Record queues them on a buffered
+// channel and a flusher started by Start writes them in batches, so auditing never adds
+// latency to the request that caused the event. The caller is read from the context, where
+// the auth middleware attaches it.
+package audit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	defaultBufferSize      = 1024
+	defaultCleanupInterval = time.Hour
+	// flushInterval bounds how long a recorded event waits before it is written.
+	flushInterval = time.Second
+	flushBatch    = 100
+	// shutdownTimeout bounds how long Shutdown waits for the last events to be written.
+	shutdownTimeout = 10 * time.Second
+	// systemActor is recorded for actions no user is attached to, like cron runs.
+	systemActor = "system"
+)
+
+type ctxKey struct{}
+
+// WithActor attaches the login of the caller to ctx.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, strings.TrimSpace(actor))
+}
+
+// ActorFromContext returns the login attached by WithActor, empty when none is.
+func ActorFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(ctxKey{}).(string)
+	return actor
+}
+
+// Service records and lists audit events. A nil Service records nothing, so services may be
+// built without one.
+type Service struct {
+	db     *store.DB
+	events chan *model.AuditEvent
+	// retention is how long events are kept; 0 keeps them forever.
+	retention       time.Duration
+	cleanupInterval time.Duration
+
+	startOnce sync.Once
+	running   atomic.Bool
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type Option func(*Service)
+
+// WithBufferSize sets how many events may wait for the flusher; events recorded while the
+// buffer is full are dropped.
+func WithBufferSize(size int) Option {
+	return func(s *Service) {
+		if size > 0 {
+			s.events = make(chan *model.AuditEvent, size)
+		}
+	}
+}
+
+// WithRetention sets how long events are kept and how often older ones are deleted; a
+// retention of 0 keeps events forever.
+func WithRetention(retention, cleanupInterval time.Duration) Option {
+	return func(s *Service) {
+		if retention >= 0 {
+			s.retention = retention
+		}
+		if cleanupInterval > 0 {
+			s.cleanupInterval = cleanupInterval
+		}
+	}
+}
+
+// New creates the audit service; call Start to write the recorded events.
+func New(db *store.DB, opts ...Option) *Service {
+	s := &Service{
+		db:              db,
+		events:          make(chan *model.AuditEvent, defaultBufferSize),
+		cleanupInterval: defaultCleanupInterval,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Record queues an event for the caller attached to ctx. It never blocks.
+func (s *Service) Record(ctx context.Context, action, resourceType, resourceID string, repoID int64, metadata map[string]interface{}) {
+	s.RecordAs(ctx, ActorFromContext(ctx), action, resourceType, resourceID, repoID, metadata)
+}
+
+// RecordAs queues an event for actor, for callers that know the actor better than ctx, like
+// logins before a session exists.
+func (s *Service) RecordAs(_ context.Context, actor, action, resourceType, resourceID string, repoID int64, metadata map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	event := &model.AuditEvent{
+		Actor:        firstNonEmpty(actor, systemActor),
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		RepoID:       repoID,
+		Metadata:     metadata,
+		Created:      time.Now().Unix(),
+	}
+	select {
+	case s.events <- event:
+	default:
+		log.Warn().Str("action", action).Str("actor", event.Actor).Msg("audit queue full, event dropped")
+	}
+}
+
+// Start writes recorded events and deletes expired ones until ctx is done or Shutdown.
+func (s *Service) Start(ctx context.Context) {
+	if s == nil || s.db == nil {
+		return
+	}
+	s.startOnce.Do(func() {
+		s.running.Store(true)
+		go s.run(ctx)
+	})
+}
+
+// Shutdown writes the events still queued and stops the flusher.
+func (s *Service) Shutdown() {
+	if s == nil || !s.running.Load() {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	select {
+	case <-s.done:
+	case <-time.After(shutdownTimeout):
+		log.Warn().Msg("audit flusher did not stop in time")
+	}
+}
+
+func (s *Service) run(ctx context.Context) {
+	defer close(s.done)
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	var cleanup <-chan time.Time
+	if s.retention > 0 {
+		ticker := time.NewTicker(s.cleanupInterval)
+		defer ticker.Stop()
+		cleanup = ticker.C
+		s.deleteExpired(ctx)
+	}
+
+	batch := make([]*model.AuditEvent, 0, flushBatch)
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain(batch)
+			return
+		case <-s.stop:
+			s.drain(batch)
+			return
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) >= flushBatch {
+				s.write(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				s.write(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-cleanup:
+			s.deleteExpired(ctx)
+		}
+	}
+}
+
+// drain writes batch and the queued events on shutdown, when the run context may be done.
+func (s *Service) drain(batch []*model.AuditEvent) {
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+		default:
+			if len(batch) > 0 {
+				s.write(context.Background(), batch)
+			}
+			return
+		}
+	}
+}
+
+func (s *Service) write(ctx context.Context, batch []*model.AuditEvent) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).CreateInBatches(batch, flushBatch).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Int("events", len(batch)).Msg("failed to write audit events")
+	}
+}
+
+func (s *Service) deleteExpired(ctx context.Context) {
+	cutoff := time.Now().Add(-s.retention).Unix()
+	var deleted int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("created < ?", cutoff).Delete(&model.AuditEvent{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to delete expired audit events")
+		return
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Dur("retention", s.retention).Msg("deleted expired audit events")
+	}
+}
+
+// List returns the events matching filter, newest first, and the total count.
+func (s *Service) List(ctx context.Context, opts model.ListOptions, filter model.AuditEventFilter) ([]*model.AuditEvent, int64, error) {
+	var (
+		page    = opts.Page
+		perPage = opts.PerPage
+	)
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+
+	var (
+		events []*model.AuditEvent
+		total  int64
+	)
+	err := s.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Model(&model.AuditEvent{})
+		if actor := strings.TrimSpace(filter.Actor); actor != "" {
+			query = query.Where("actor = ?", actor)
+		}
+		if action := strings.TrimSpace(filter.Action); action != "" {
+			query = query.Where("action = ?", action)
+		}
+		if filter.RepoID != 0 {
+			query = query.Where("repo_id = ?", filter.RepoID)
+		}
+		if filter.Since > 0 {
+			query = query.Where("created >= ?", filter.Since)
+		}
+		if filter.Until > 0 {
+			query = query.Where("created <= ?", filter.Until)
+		}
+		if err := query.Count(&total).Error; err != nil {
+			return err
+		}
+		return query.Order("created DESC, id DESC").
+			Offset((page - 1) * perPage).
+			Limit(perPage).
+			Find(&events).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// APITokenPrefix starts every personal access token so it is not mistaken for a session JWT.
+	APITokenPrefix = "devsys_"
+	// apiTokenDisplayLength is how much of a token, prefix included, stays visible after creation.
+	apiTokenDisplayLength = len(APITokenPrefix) + 6
+	// apiTokenTouchInterval limits how often last_used is written for a busy token.
+	apiTokenTouchInterval = time.Minute
+)
+
+var (
+	ErrAPITokenInvalid = errors.New("API 令牌配置无效")
+	ErrAPITokenDenied  = errors.New("API 令牌无效或已过期")
+)
+
+// CreateAPIToken issues a token for userID and returns it with its plain value, which is not
+// stored and cannot be shown again. A zero ttl never expires.
+func (s *Service) CreateAPIToken(ctx context.Context, userID int64, name string, scopes []string, ttl time.Duration) (*model.APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", fmt.Errorf("%w: 名称不能为空", ErrAPITokenInvalid)
+	}
+	if ttl < 0 {
+		return nil, "", fmt.Errorf("%w: 有效期不能为负数", ErrAPITokenInvalid)
+	}
+	granted, err := normalizeAPITokenScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	plain := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	token := &model.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plain[:apiTokenDisplayLength],
+		TokenHash: hashAPIToken(plain),
+		Scopes:    granted,
+		Created:   now.Unix(),
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl).Unix()
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Create(token).Error
+	}); err != nil {
+		return nil, "", err
+	}
+	return token, plain, nil
+}
+
+// ListAPITokens lists the tokens of userID, newest first.
+func (s *Service) ListAPITokens(ctx context.Context, userID int64) ([]*model.APIToken, error) {
+	var tokens []*model.APIToken
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("user_id = ?", userID).Order("id DESC").Find(&tokens).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes a token of userID.
+func (s *Service) DeleteAPIToken(ctx context.Context, userID, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Delete(&model.APIToken{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// ParseAPIToken resolves a personal access token to the session claims of its user, carrying
+// the token id and scopes.
+func (s *Service) ParseAPIToken(ctx context.Context, plain string) (*SessionClaims, error) {
+	if !strings.HasPrefix(plain, APITokenPrefix) {
+		return nil, ErrAPITokenDenied
+	}
+	var token model.APIToken
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("token_hash = ?", hashAPIToken(plain)).Take(&token).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPITokenDenied
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if token.ExpiresAt > 0 && now.Unix() >= token.ExpiresAt {
+		return nil, ErrAPITokenDenied
+	}
+	user, err := s.users.FindByID(ctx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrAPITokenDenied
+	}
+	if now.Unix()-token.LastUsed >= int64(apiTokenTouchInterval/time.Second) {
+		// usage tracking is best effort and must not fail the request
+		_ = s.db.Transaction(func(tx *gorm.DB) error {
+			return tx.WithContext(ctx).Model(&model.APIToken{}).
+				Where("id = ?", token.ID).
+				Update("last_used", now.Unix()).Error
+		})
+	}
+	return &SessionClaims{
+		UserID:  user.ID,
+		Login:   user.Login,
+		TokenID: token.ID,
+		Scopes:  append([]string{}, token.Scopes...),
+	}, nil
+}
+
+func hashAPIToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeAPITokenScopes(scopes []string) ([]string, error) {
+	granted := make([]string, 0, len(scopes))
+	seen := make(map[string]struct{}, len(scopes))
+	for _, raw := range scopes {
+		scope := strings.ToLower(strings.TrimSpace(raw))
+		if scope == "" {
+			continue
+		}
+		known := false
+		for _, candidate := range model.APITokenScopes {
+			if candidate == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: 未知权限 %s", ErrAPITokenInvalid, raw)
+		}
+		if _, ok := seen[scope]; ok {
+			continue
+		}
+		seen[scope] = struct{}{}
+		granted = append(granted, scope)
+	}
+	if len(granted) == 0 {
+		return nil, fmt.Errorf("%w: 至少需要一个权限", ErrAPITokenInvalid)
+	}
+	return granted, nil
+}
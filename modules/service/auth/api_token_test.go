@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/repo"
+	"github.com/thepenn/devsys/service/user"
+)
+
+// newTokenService returns an auth service over a database holding users alice (1) and bob (2).
+func newTokenService(t *testing.T) *Service {
+	t.Helper()
+	db := storetest.Open(t, &model.User{}, &model.Repo{}, &model.APIToken{}, &model.RevokedToken{})
+	for _, u := range []*model.User{
+		{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", Hash: "alice-hash"},
+		{ID: 2, ForgeID: 1, ForgeRemoteID: "2", Login: "bob", Hash: "bob-hash"},
+	} {
+		if err := db.GetDB().Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{}
+	cfg.Auth.Provider = providerGitHub
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Git.GitHub = config.GitHub{Enabled: true, URL: "https://github.example", APIURL: "https://github.example", ClientID: "client", ClientSecret: "secret"}
+	svc, err := New(cfg, db, user.New(db), repo.New(db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestAPITokenLifecycle(t *testing.T) {
+	svc := newTokenService(t)
+	ctx := context.Background()
+
+	token, plain, err := svc.CreateAPIToken(ctx, 1, " deploy bot ", []string{"Pipeline:Trigger", "repo:read", "repo:read"}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if !strings.HasPrefix(plain, APITokenPrefix) || !strings.HasPrefix(plain, token.Prefix) || len(token.Prefix) != apiTokenDisplayLength {
+		t.Errorf("token %q with prefix %q, want the prefix to be the start of the token", plain, token.Prefix)
+	}
+	if token.Name != "deploy bot" || strings.Join(token.Scopes, ",") != "pipeline:trigger,repo:read" || token.ExpiresAt == 0 {
+		t.Errorf("token = %+v, want normalized name and scopes with an expiry", token)
+	}
+
+	// only the hash is kept, so listing never shows the token again
+	tokens, err := svc.ListAPITokens(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].TokenHash == plain || tokens[0].TokenHash != hashAPIToken(plain) {
+		t.Fatalf("stored tokens = %+v, want the hash of the token", tokens)
+	}
+	if other, _ := svc.ListAPITokens(ctx, 2); len(other) != 0 {
+		t.Errorf("bob lists %d tokens of alice", len(other))
+	}
+
+	claims, err := svc.ParseAPIToken(ctx, plain)
+	if err != nil {
+		t.Fatalf("ParseAPIToken: %v", err)
+	}
+	if claims.UserID != 1 || claims.Login != "alice" || claims.TokenID != token.ID || !claims.APIToken() {
+		t.Errorf("claims = %+v, want alice acting through the token", claims)
+	}
+	if !claims.HasScope(model.APITokenScopePipelineTrigger) || claims.HasScope(model.APITokenScopeRepoSync) {
+		t.Errorf("claims scopes = %v, want only the granted scopes", claims.Scopes)
+	}
+	if tokens, _ := svc.ListAPITokens(ctx, 1); tokens[0].LastUsed == 0 {
+		t.Errorf("last use of the token was not recorded")
+	}
+
+	if err := svc.DeleteAPIToken(ctx, 2, token.ID); err == nil {
+		t.Errorf("bob revoked a token of alice")
+	}
+	if err := svc.DeleteAPIToken(ctx, 1, token.ID); err != nil {
+		t.Fatalf("DeleteAPIToken: %v", err)
+	}
+	if _, err := svc.ParseAPIToken(ctx, plain); !errors.Is(err, ErrAPITokenDenied) {
+		t.Errorf("revoked token = %v, want ErrAPITokenDenied", err)
+	}
+}
+
+func TestParseAPITokenRejects(t *testing.T) {
+	svc := newTokenService(t)
+	ctx := context.Background()
+
+	_, expired, err := svc.CreateAPIToken(ctx, 1, "old", []string{"repo:read"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.db.GetDB().Model(&model.APIToken{}).Where("user_id = ?", 1).Update("expires_at", time.Now().Unix()-1).Error; err != nil {
+		t.Fatal(err)
+	}
+	_, orphan, err := svc.CreateAPIToken(ctx, 3, "orphan", []string{"repo:read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, plain := range map[string]string{
+		"expired":      expired,
+		"unknown user": orphan,
+		"unknown":      APITokenPrefix + "not-issued",
+		"not a token":  "eyJhbGciOiJIUzI1NiJ9.e30.sig",
+	} {
+		if _, err := svc.ParseAPIToken(ctx, plain); !errors.Is(err, ErrAPITokenDenied) {
+			t.Errorf("%s token = %v, want ErrAPITokenDenied", name, err)
+		}
+	}
+}
+
+func TestCreateAPITokenValidates(t *testing.T) {
+	svc := newTokenService(t)
+	cases := map[string]struct {
+		name   string
+		scopes []string
+		ttl    time.Duration
+	}{
+		"no name":       {name: " ", scopes: []string{"repo:read"}},
+		"no scope":      {name: "bot", scopes: []string{" "}},
+		"unknown scope": {name: "bot", scopes: []string{"admin"}},
+		"negative ttl":  {name: "bot", scopes: []string{"repo:read"}, ttl: -time.Hour},
+	}
+	for name, c := range cases {
+		if _, _, err := svc.CreateAPIToken(context.Background(), 1, c.name, c.scopes, c.ttl); !errors.Is(err, ErrAPITokenInvalid) {
+			t.Errorf("%s: %v, want ErrAPITokenInvalid", name, err)
+		}
+	}
+}
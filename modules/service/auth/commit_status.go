@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/thepenn/devsys/model"
+)
+
+type githubStatusRequest struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+// ReportCommitStatus sets a commit status on the forge with the token of userID, usually the
+// owner of the repository. Forges without a running state show running builds as pending.
+func (s *Service) ReportCommitStatus(ctx context.Context, userID int64, repoModel *model.Repo, status model.CommitStatus) error {
+	userModel, err := s.contentUser(ctx, userID, repoModel)
+	if err != nil {
+		return err
+	}
+	commit := strings.TrimSpace(status.Commit)
+	if commit == "" {
+		return fmt.Errorf("commit is required")
+	}
+
+	switch s.provider {
+	case providerGitLab:
+		accessToken, err := s.freshAccessToken(ctx, s.gitLabOAuthConfig(), userModel)
+		if err != nil {
+			return err
+		}
+		client, err := s.gitLabClient(accessToken)
+		if err != nil {
+			return err
+		}
+		_, _, err = client.Commits.SetCommitStatus(string(repoModel.ForgeRemoteID), commit, &gitlab.SetCommitStatusOptions{
+			State:       gitlabCommitState(status.State),
+			Name:        gitlab.String(status.Context),
+			TargetURL:   gitlab.String(status.TargetURL),
+			Description: gitlab.String(status.Description),
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("set gitlab commit status: %w", err)
+		}
+		return nil
+	case providerGitHub:
+		ctx, client, err := s.githubUserClient(ctx, userModel)
+		if err != nil {
+			return err
+		}
+		body := githubStatusRequest{
+			State:       githubCommitState(status.State),
+			TargetURL:   status.TargetURL,
+			Description: status.Description,
+			Context:     status.Context,
+		}
+		if _, err := s.githubAPIWithBody(ctx, client, http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", repoModel.FullName, commit), nil, body, nil); err != nil {
+			return fmt.Errorf("set github commit status: %w", err)
+		}
+		return nil
+	case providerGitea:
+		accessToken, err := s.freshAccessToken(ctx, s.giteaOAuthConfig(), userModel)
+		if err != nil {
+			return err
+		}
+		client, err := s.giteaClient(accessToken)
+		if err != nil {
+			return err
+		}
+		_, _, err = client.CreateStatus(repoModel.Owner, repoModel.Name, commit, gitea.CreateStatusOption{
+			State:       gitea.StatusState(githubCommitState(status.State)),
+			TargetURL:   status.TargetURL,
+			Description: status.Description,
+			Context:     status.Context,
+		})
+		if err != nil {
+			return fmt.Errorf("set gitea commit status: %w", err)
+		}
+		return nil
+	case providerGitee:
+		accessToken, err := s.freshAccessToken(ctx, s.giteeOAuthConfig(), userModel)
+		if err != nil {
+			return err
+		}
+		body := githubStatusRequest{
+			State:       githubCommitState(status.State),
+			TargetURL:   status.TargetURL,
+			Description: status.Description,
+			Context:     status.Context,
+		}
+		path := fmt.Sprintf("/repos/%s/%s/statuses/%s", repoModel.Owner, repoModel.Name, commit)
+		return s.giteeAPIPost(ctx, path, accessToken, body)
+	default:
+		return fmt.Errorf("unsupported auth provider: %s", s.provider)
+	}
+}
+
+func gitlabCommitState(state model.CommitState) gitlab.BuildStateValue {
+	switch state {
+	case model.CommitStateRunning:
+		return gitlab.Running
+	case model.CommitStateSuccess:
+		return gitlab.Success
+	case model.CommitStateFailure:
+		return gitlab.Failed
+	default:
+		return gitlab.Pending
+	}
+}
+
+// githubCommitState maps state to the states of the GitHub statuses API, which Gitea and
+// Gitee share.
+func githubCommitState(state model.CommitState) string {
+	switch state {
+	case model.CommitStateSuccess:
+		return "success"
+	case model.CommitStateFailure:
+		return "failure"
+	default:
+		return "pending"
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/thepenn/devsys/model"
+)
+
+type githubContentEntry struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+type giteeTree struct {
+	Tree []struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+	} `json:"tree"`
+}
+
+type giteeContent struct {
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+// ListRepositoryFiles returns the top-level entries of a repository at ref using the user's
+// forge token. Directories carry a trailing slash.
+func (s *Service) ListRepositoryFiles(ctx context.Context, userID int64, repoModel *model.Repo, ref string) ([]string, error) {
+	userModel, err := s.contentUser(ctx, userID, repoModel)
+	if err != nil {
+		return nil, err
+	}
+	ref = firstNonEmpty(ref, repoModel.Branch)
+
+	switch s.provider {
+	case providerGitLab:
+		client, err := s.gitLabClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		nodes, _, err := client.Repositories.ListTree(string(repoModel.ForgeRemoteID), &gitlab.ListTreeOptions{
+			Ref:         gitlab.String(ref),
+			ListOptions: gitlab.ListOptions{PerPage: 100},
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("list gitlab repository tree: %w", err)
+		}
+		files := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			files = append(files, treeEntryName(node.Name, node.Type == "tree"))
+		}
+		return files, nil
+	case providerGitHub:
+		ctx, client, err := s.githubUserClient(ctx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{}
+		if ref != "" {
+			params.Set("ref", ref)
+		}
+		var entries []githubContentEntry
+		if _, err := s.githubAPI(ctx, client, http.MethodGet, fmt.Sprintf("/repos/%s/contents", repoModel.FullName), params, &entries); err != nil {
+			return nil, err
+		}
+		files := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			files = append(files, treeEntryName(entry.Name, entry.Type == "dir"))
+		}
+		return files, nil
+	case providerGitea:
+		client, err := s.giteaClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		entries, _, err := client.ListContents(repoModel.Owner, repoModel.Name, ref, "")
+		if err != nil {
+			return nil, fmt.Errorf("list gitea repository contents: %w", err)
+		}
+		files := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			files = append(files, treeEntryName(entry.Name, entry.Type == "dir"))
+		}
+		return files, nil
+	case providerGitee:
+		var tree giteeTree
+		path := fmt.Sprintf("/repos/%s/%s/git/trees/%s", repoModel.Owner, repoModel.Name, url.PathEscape(ref))
+		if err := s.giteeAPIGet(ctx, path, userModel.AccessToken, &tree); err != nil {
+			return nil, err
+		}
+		files := make([]string, 0, len(tree.Tree))
+		for _, entry := range tree.Tree {
+			files = append(files, treeEntryName(entry.Path, entry.Type == "tree"))
+		}
+		return files, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth provider: %s", s.provider)
+	}
+}
+
+// ReadRepositoryFile returns the raw content of a file at ref using the user's forge token.
+func (s *Service) ReadRepositoryFile(ctx context.Context, userID int64, repoModel *model.Repo, path, ref string) ([]byte, error) {
+	userModel, err := s.contentUser(ctx, userID, repoModel)
+	if err != nil {
+		return nil, err
+	}
+	ref = firstNonEmpty(ref, repoModel.Branch)
+	path = strings.TrimPrefix(path, "/")
+
+	switch s.provider {
+	case providerGitLab:
+		client, err := s.gitLabClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		content, _, err := client.RepositoryFiles.GetRawFile(string(repoModel.ForgeRemoteID), path, &gitlab.GetRawFileOptions{
+			Ref: gitlab.String(ref),
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("read gitlab file %s: %w", path, err)
+		}
+		return content, nil
+	case providerGitHub:
+		ctx, client, err := s.githubUserClient(ctx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{}
+		if ref != "" {
+			params.Set("ref", ref)
+		}
+		var entry githubContentEntry
+		if _, err := s.githubAPI(ctx, client, http.MethodGet, fmt.Sprintf("/repos/%s/contents/%s", repoModel.FullName, path), params, &entry); err != nil {
+			return nil, err
+		}
+		return decodeContent(entry.Content, entry.Encoding)
+	case providerGitea:
+		client, err := s.giteaClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		content, _, err := client.GetFile(repoModel.Owner, repoModel.Name, ref, path)
+		if err != nil {
+			return nil, fmt.Errorf("read gitea file %s: %w", path, err)
+		}
+		return content, nil
+	case providerGitee:
+		var entry giteeContent
+		apiPath := fmt.Sprintf("/repos/%s/%s/contents/%s?ref=%s", repoModel.Owner, repoModel.Name, path, url.QueryEscape(ref))
+		if err := s.giteeAPIGet(ctx, apiPath, userModel.AccessToken, &entry); err != nil {
+			return nil, err
+		}
+		return decodeContent(entry.Content, entry.Encoding)
+	default:
+		return nil, fmt.Errorf("unsupported auth provider: %s", s.provider)
+	}
+}
+
+func (s *Service) contentUser(ctx context.Context, userID int64, repoModel *model.Repo) (*model.User, error) {
+	if repoModel == nil {
+		return nil, fmt.Errorf("repository is required")
+	}
+	userModel, err := s.users.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if userModel == nil {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	if strings.TrimSpace(userModel.AccessToken) == "" {
+		return nil, fmt.Errorf("user has no stored %s token", s.provider)
+	}
+	return userModel, nil
+}
+
+func treeEntryName(name string, dir bool) string {
+	if dir {
+		return name + "/"
+	}
+	return name
+}
+
+func decodeContent(content, encoding string) ([]byte, error) {
+	if !strings.EqualFold(encoding, "base64") {
+		return []byte(content), nil
+	}
+	// the forges wrap base64 payloads at 60-76 columns
+	cleaned := strings.NewReplacer("\n", "", "\r", "").Replace(content)
+	return base64.StdEncoding.DecodeString(cleaned)
+}
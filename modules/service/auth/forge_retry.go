@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/service/repo"
+)
+
+const (
+	// forgeAPIMaxAttempts caps the requests made for one forge API call.
+	forgeAPIMaxAttempts = 4
+	forgeAPIBaseBackoff = time.Second
+	// forgeAPIMaxWait is the longest wait before a retry; a rate limit lifting later is
+	// reported as a RateLimitedError instead of waited for.
+	forgeAPIMaxWait = 30 * time.Second
+	// githubOrgListTimeout bounds listing one organization, so a forge that stops answering
+	// for it does not hold up the organizations after it.
+	githubOrgListTimeout = 2 * time.Minute
+)
+
+// RateLimitedError is returned when a forge keeps rejecting requests with its rate limit.
+// RetryAt is when the forge accepts requests again, zero when it did not say.
+type RateLimitedError struct {
+	Provider string
+	RetryAt  time.Time
+	Status   string
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAt.IsZero() {
+		return fmt.Sprintf("%s api rate limited: %s", e.Provider, e.Status)
+	}
+	return fmt.Sprintf("%s api rate limited: %s, retry after %s", e.Provider, e.Status, e.RetryAt.Format(time.RFC3339))
+}
+
+// doForgeRequest sends the request built by newRequest, retrying rate limits and the 5xx
+// responses of GET requests with exponential backoff or the wait the forge asks for; other
+// methods may have taken effect before a 5xx. newRequest is called per attempt so request
+// bodies are fresh. The last response is returned for the caller to
+// check, except for a rate limit that outlasts the retries, which is a RateLimitedError.
+func doForgeRequest(ctx context.Context, client *http.Client, provider string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		limited := forgeRateLimited(resp)
+		if !limited && (resp.StatusCode < http.StatusInternalServerError || req.Method != http.MethodGet) {
+			return resp, nil
+		}
+
+		retryAt := forgeRetryAt(resp.Header, time.Now())
+		wait := forgeAPIBaseBackoff << (attempt - 1)
+		if !retryAt.IsZero() {
+			wait = time.Until(retryAt)
+		}
+		if attempt >= forgeAPIMaxAttempts || wait > forgeAPIMaxWait {
+			if limited {
+				resp.Body.Close()
+				return nil, &RateLimitedError{Provider: provider, RetryAt: retryAt, Status: resp.Status}
+			}
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// forgeRateLimited reports whether resp rejects the request for the rate limit: a 429, or a
+// 403 with an exhausted quota or a rate limit message as GitHub and Gitee send. The body of
+// a 403 is read and replaced so callers can still read it.
+func forgeRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "" {
+			return true
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return strings.Contains(strings.ToLower(string(body)), "rate limit")
+	default:
+		return false
+	}
+}
+
+// forgeRetryAt returns when the forge accepts requests again from Retry-After, in seconds
+// or as a date, or from the X-RateLimit-Reset epoch; zero without either.
+func forgeRetryAt(header http.Header, now time.Time) time.Time {
+	if raw := strings.TrimSpace(header.Get("Retry-After")); raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+		if at, err := http.ParseTime(raw); err == nil {
+			return at
+		}
+	}
+	if raw := strings.TrimSpace(header.Get("X-RateLimit-Reset")); raw != "" {
+		if epoch, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return time.Unix(epoch, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// listingFailed records on report that listing stopped early, and whether the rate limit of
+// the forge stopped it.
+func listingFailed(report *repo.SyncReport, err error) {
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		var retryAt int64
+		if !limited.RetryAt.IsZero() {
+			retryAt = limited.RetryAt.Unix()
+		}
+		report.ListingRateLimited(err, retryAt)
+		return
+	}
+	report.ListingFailed(err)
+}
+
+// recordSyncStatus stores on the user whether the last sync of all their repositories was
+// cut short by the rate limit of the forge. Other failures leave the status as it was.
+func (s *Service) recordSyncStatus(ctx context.Context, userID int64, report *repo.SyncReport, err error) {
+	var notice string
+	var retryAt int64
+	var limited *RateLimitedError
+	switch {
+	case errors.As(err, &limited):
+		if !limited.RetryAt.IsZero() {
+			retryAt = limited.RetryAt.Unix()
+		}
+		notice = forgeSyncNotice(retryAt)
+	case err != nil:
+		return
+	case report != nil && report.RateLimited:
+		retryAt = report.RetryAt
+		notice = forgeSyncNotice(retryAt)
+	}
+	if err := s.users.UpdateSyncStatus(ctx, userID, notice, retryAt); err != nil {
+		log.Warn().Err(err).Int64("user_id", userID).Msg("failed to record repository sync status")
+	}
+}
+
+// forgeSyncNotice describes a sync the rate limit of the forge cut short.
+func forgeSyncNotice(retryAt int64) string {
+	if retryAt == 0 {
+		return "partial sync, rate limited by the forge"
+	}
+	return fmt.Sprintf("partial sync, retry after %s", time.Unix(retryAt, 0).Format(time.RFC3339))
+}
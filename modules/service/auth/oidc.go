@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+
+	"github.com/thepenn/devsys/internal/proxy"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/repo"
+	"github.com/thepenn/devsys/service/user"
+)
+
+const providerOIDC = "oidc"
+
+// oidcDiscovery holds the endpoints published in the issuer's openid-configuration.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// oidcProvider logs users in through a generic OpenID Connect identity provider. The users are
+// keyed on their subject and have no forge repositories, so repository sync does nothing.
+type oidcProvider struct {
+	svc    *Service
+	issuer string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+func newOIDCProvider(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error) {
+	cfg := s.cfg.Git.OIDC
+	if !cfg.Enabled {
+		return nil, errors.New("oidc authentication disabled")
+	}
+	issuer := strings.TrimSuffix(strings.TrimSpace(cfg.Issuer), "/")
+	if issuer == "" {
+		return nil, errors.New("oidc issuer not configured")
+	}
+	s.scopes = scopesOrDefault(cfg.Scopes, "openid", "profile", "email")
+	s.httpClient = newHTTPClient(proxyRules, cfg.SkipVerify)
+	return &oidcProvider{svc: s, issuer: issuer}, nil
+}
+
+func (p *oidcProvider) Name() string { return providerOIDC }
+
+func (p *oidcProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
+	cfg := p.svc.cfg.Git.OIDC
+	if cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.RedirectURL == "" {
+		return "", "", errors.New("oidc configuration incomplete")
+	}
+
+	oauthCfg, err := p.oauthConfig(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomState()
+	if err != nil {
+		return "", "", err
+	}
+
+	encodedState, err := p.svc.encodeState(state, redirect)
+	if err != nil {
+		return "", "", err
+	}
+
+	log.Debug().Str("state", state).Str("redirect", redirect).Msg("oidc begin")
+
+	authURL := oauthCfg.AuthCodeURL(encodedState, oauth2.SetAuthURLParam("scope", strings.Join(p.svc.scopes, " ")))
+	return encodedState, authURL, nil
+}
+
+func (p *oidcProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
+	if code == "" || state == "" {
+		return nil, errors.New("missing code or state")
+	}
+	rawState, redirect, err := p.svc.decodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("state", rawState).Msg("oidc callback")
+
+	oauthCfg, err := p.oauthConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.svc.httpClient)
+	token, err := oauthCfg.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("exchange oauth token: %w", err)
+	}
+
+	claims, err := p.fetchUserInfo(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	subject := claimString(claims, "sub")
+	if subject == "" {
+		return nil, errors.New("oidc userinfo missing subject")
+	}
+
+	forge, err := p.svc.ensureForge(ctx, model.ForgeTypeOIDC, p.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	appUser, err := p.svc.users.UpsertGitUser(ctx, forge.ID, user.GitUser{
+		RemoteID: subject,
+		Login:    firstNonEmpty(claimString(claims, "preferred_username"), claimString(claims, "email"), claimString(claims, "name"), subject),
+		Email:    claimString(claims, "email"),
+		Avatar:   claimString(claims, "picture"),
+		IsAdmin:  p.isAdmin(claims),
+	}, token)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtToken, err := p.svc.generateToken(appUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{
+		Token:    jwtToken,
+		User:     toUserInfo(appUser, providerOIDC),
+		Redirect: redirect,
+	}, nil
+}
+
+// SyncRepositories reports an empty, complete sync: OIDC users have no forge repositories.
+func (p *oidcProvider) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
+	return repo.NewSyncReport(providerOIDC), nil
+}
+
+func (p *oidcProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
+	return repo.NewSyncReport(providerOIDC), nil
+}
+
+func (p *oidcProvider) oauthConfig(ctx context.Context) (*oauth2.Config, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := p.svc.cfg.Git.OIDC
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Scopes:       p.svc.scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}, nil
+}
+
+// discover fetches the issuer's openid-configuration once; failures are retried on the next login.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, errors.New("oidc discovery: missing authorization, token or userinfo endpoint")
+	}
+	if discovery.Issuer != "" && strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch: %s", discovery.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) fetchUserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := p.getJSON(ctx, discovery.UserinfoEndpoint, accessToken, &claims); err != nil {
+		return nil, fmt.Errorf("fetch oidc userinfo: %w", err)
+	}
+	return claims, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint, accessToken string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := p.svc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// isAdmin reports whether the groups claim contains the configured admin group.
+func (p *oidcProvider) isAdmin(claims map[string]interface{}) bool {
+	cfg := p.svc.cfg.Git.OIDC
+	adminGroup := strings.TrimSpace(cfg.AdminGroup)
+	if adminGroup == "" {
+		return false
+	}
+	for _, group := range claimStrings(claims, firstNonEmpty(cfg.GroupsClaim, "groups")) {
+		if group == adminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return strings.TrimSpace(value)
+}
+
+// claimStrings reads a claim that identity providers publish either as a list or a single string.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return splitAndTrim(value, ",")
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
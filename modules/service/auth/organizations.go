@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/rs/zerolog/log"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Forge organizations are only looked up with multi-tenancy enabled. A failed lookup returns
+// nil so the stored memberships stay as they are rather than being revoked by a forge outage.
+
+func (s *Service) githubUserOrgs(ctx context.Context, client *http.Client) []string {
+	if !s.users.TenancyEnabled() {
+		return nil
+	}
+	const perPage = 100
+	orgs := []string{}
+	for page := 1; ; page++ {
+		params := url.Values{}
+		params.Set("per_page", strconv.Itoa(perPage))
+		params.Set("page", strconv.Itoa(page))
+
+		var batch []githubOrg
+		header, err := s.githubAPI(ctx, client, http.MethodGet, "/user/orgs", params, &batch)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to list github organizations of user")
+			return nil
+		}
+		for _, org := range batch {
+			orgs = append(orgs, org.Login)
+		}
+		if len(batch) == 0 || !githubHasNextPage(header) {
+			break
+		}
+	}
+	return orgs
+}
+
+func (s *Service) gitlabUserGroups(client *gitlab.Client) []string {
+	if !s.users.TenancyEnabled() {
+		return nil
+	}
+	opts := &gitlab.ListGroupsOptions{
+		MinAccessLevel: gitlab.AccessLevel(gitlab.GuestPermissions),
+		ListOptions: gitlab.ListOptions{
+			PerPage: 100,
+		},
+	}
+	groups := []string{}
+	for {
+		batch, resp, err := client.Groups.ListGroups(opts)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to list gitlab groups of user")
+			return nil
+		}
+		for _, group := range batch {
+			if group != nil {
+				groups = append(groups, group.FullPath)
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return groups
+}
+
+func (s *Service) giteaUserOrgs(client *gitea.Client) []string {
+	if !s.users.TenancyEnabled() {
+		return nil
+	}
+	opts := gitea.ListOrgsOptions{
+		ListOptions: gitea.ListOptions{
+			Page:     1,
+			PageSize: 50,
+		},
+	}
+	orgs := []string{}
+	for {
+		batch, resp, err := client.ListMyOrgs(opts)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to list gitea organizations of user")
+			return nil
+		}
+		for _, org := range batch {
+			if org != nil {
+				orgs = append(orgs, org.UserName)
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return orgs
+}
+
+func (s *Service) giteeUserOrgs(ctx context.Context, accessToken string) []string {
+	if !s.users.TenancyEnabled() {
+		return nil
+	}
+	const perPage = 100
+	orgs := []string{}
+	for page := 1; ; page++ {
+		var batch []struct {
+			Login string `json:"login"`
+		}
+		path := fmt.Sprintf("/user/orgs?page=%d&per_page=%d", page, perPage)
+		if err := s.giteeAPIGet(ctx, path, accessToken, &batch); err != nil {
+			log.Warn().Err(err).Msg("failed to list gitee organizations of user")
+			return nil
+		}
+		for _, org := range batch {
+			orgs = append(orgs, org.Login)
+		}
+		if len(batch) < perPage {
+			break
+		}
+	}
+	return orgs
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/thepenn/devsys/internal/proxy"
+	"github.com/thepenn/devsys/service/repo"
+)
+
+// providerFactory validates the configuration of one login provider, fills the provider specific
+// fields of s and returns the provider. Adding a provider only takes a factory registered in
+// providerFactories.
+type providerFactory func(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error)
+
+var providerFactories = map[string]providerFactory{
+	providerGitHub: newGitHubProvider,
+	providerGitLab: newGitLabProvider,
+	providerGitee:  newGiteeProvider,
+	providerGitea:  newGiteaProvider,
+	providerOIDC:   newOIDCProvider,
+}
+
+// scopesOrDefault splits the configured scopes, falling back to defaults when none are set.
+func scopesOrDefault(configured string, defaults ...string) []string {
+	scopes := strings.Fields(configured)
+	if len(scopes) == 0 {
+		return defaults
+	}
+	return scopes
+}
+
+func newGitHubProvider(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error) {
+	cfg := s.cfg.Git.GitHub
+	if !cfg.Enabled {
+		return nil, errors.New("github authentication disabled")
+	}
+	s.scopes = scopesOrDefault(cfg.Scopes, "read:user", "repo")
+	s.httpClient = newHTTPClient(proxyRules, cfg.SkipVerify)
+	s.githubWebBase = normalizeBaseURL(cfg.URL, "https://github.com")
+	s.githubAPIBase = normalizeBaseURL(cfg.APIURL, "https://api.github.com")
+	s.githubOrgs = splitAndTrim(cfg.Organizations, ",")
+	s.githubIncludeForks = cfg.IncludeForks
+	s.orgListTimeout = githubOrgListTimeout
+	return &gitHubProvider{svc: s}, nil
+}
+
+func newGitLabProvider(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error) {
+	cfg := s.cfg.Git.GitLab
+	if !cfg.Enabled {
+		return nil, errors.New("gitlab authentication disabled")
+	}
+	s.scopes = scopesOrDefault(cfg.Scopes, "read_user", "api")
+	s.httpClient = newHTTPClient(proxyRules, cfg.SkipVerify)
+	s.gitlabOrgs = splitAndTrim(cfg.Organizations, ",")
+	return &gitLabProvider{svc: s}, nil
+}
+
+func newGiteeProvider(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error) {
+	cfg := s.cfg.Git.Gitee
+	if !cfg.Enabled {
+		return nil, errors.New("gitee authentication disabled")
+	}
+	s.scopes = scopesOrDefault(cfg.Scopes, "user_info", "projects")
+	s.httpClient = newHTTPClient(proxyRules, cfg.SkipVerify)
+	s.giteeOrgs = splitAndTrim(cfg.Organizations, ",")
+	return &gitGiteeProvider{svc: s}, nil
+}
+
+func newGiteaProvider(s *Service, proxyRules *proxy.Rules) (gitAuthProvider, error) {
+	cfg := s.cfg.Git.Gitea
+	if !cfg.Enabled {
+		return nil, errors.New("gitea authentication disabled")
+	}
+	s.scopes = scopesOrDefault(cfg.Scopes, "read:user", "user:email", "repo")
+	s.httpClient = newHTTPClient(proxyRules, cfg.SkipVerify)
+	s.giteaOrgs = splitAndTrim(cfg.Organizations, ",")
+	return &gitGiteaProvider{svc: s}, nil
+}
+
+type gitHubProvider struct{ svc *Service }
+
+func (p *gitHubProvider) Name() string { return providerGitHub }
+func (p *gitHubProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
+	return p.svc.beginGitHubAuth(ctx, redirect)
+}
+func (p *gitHubProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
+	return p.svc.completeGitHubAuth(ctx, code, state)
+}
+func (p *gitHubProvider) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
+	return p.svc.syncGitHubRepositories(ctx, userID)
+}
+func (p *gitHubProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
+	return p.svc.syncGitHubRepository(ctx, userID, remoteID)
+}
+
+type gitLabProvider struct{ svc *Service }
+
+func (p *gitLabProvider) Name() string { return providerGitLab }
+func (p *gitLabProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
+	return p.svc.beginGitLabAuth(ctx, redirect)
+}
+func (p *gitLabProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
+	return p.svc.completeGitLabAuth(ctx, code, state)
+}
+func (p *gitLabProvider) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
+	return p.svc.syncGitLabRepositories(ctx, userID)
+}
+func (p *gitLabProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
+	return p.svc.syncGitLabRepository(ctx, userID, remoteID)
+}
+
+type gitGiteeProvider struct{ svc *Service }
+
+func (p *gitGiteeProvider) Name() string { return providerGitee }
+func (p *gitGiteeProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
+	return p.svc.beginGiteeAuth(ctx, redirect)
+}
+func (p *gitGiteeProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
+	return p.svc.completeGiteeAuth(ctx, code, state)
+}
+func (p *gitGiteeProvider) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
+	return p.svc.syncGiteeRepositories(ctx, userID)
+}
+func (p *gitGiteeProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
+	return p.svc.syncGiteeRepository(ctx, userID, remoteID)
+}
+
+type gitGiteaProvider struct{ svc *Service }
+
+func (p *gitGiteaProvider) Name() string { return providerGitea }
+func (p *gitGiteaProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
+	return p.svc.beginGiteaAuth(ctx, redirect)
+}
+func (p *gitGiteaProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
+	return p.svc.completeGiteaAuth(ctx, code, state)
+}
+func (p *gitGiteaProvider) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
+	return p.svc.syncGiteaRepositories(ctx, userID)
+}
+func (p *gitGiteaProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
+	return p.svc.syncGiteaRepository(ctx, userID, remoteID)
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	refsCacheTTL     = time.Minute
+	branchesCacheKey = "auth:branches:%d"
+	tagsCacheKey     = "auth:tags:%d"
+	refsPageSize     = 100
+)
+
+// GitRef is a branch or tag of a repository. Default marks the default branch.
+type GitRef struct {
+	Name    string `json:"name"`
+	Commit  string `json:"commit"`
+	Default bool   `json:"default"`
+}
+
+type githubGitRef struct {
+	Ref    string `json:"ref"`
+	Object struct {
+		SHA string `json:"sha"`
+	} `json:"object"`
+}
+
+type githubTag struct {
+	Name   string `json:"name"`
+	Commit struct {
+		SHA string `json:"sha"`
+	} `json:"commit"`
+}
+
+// giteeRef is a branch or tag of the Gitee API; both carry the commit the same way.
+type giteeRef struct {
+	Name   string `json:"name"`
+	Commit struct {
+		SHA string `json:"sha"`
+	} `json:"commit"`
+}
+
+// ListBranches returns every branch of a repository through the forge API with the token of
+// userID. Results are cached for a minute per repository.
+func (s *Service) ListBranches(ctx context.Context, userID, repoID int64) ([]GitRef, error) {
+	return s.cachedRefs(ctx, fmt.Sprintf(branchesCacheKey, repoID), userID, repoID, s.listBranches)
+}
+
+// ListTags returns every tag of a repository through the forge API with the token of userID.
+// Results are cached for a minute per repository.
+func (s *Service) ListTags(ctx context.Context, userID, repoID int64) ([]GitRef, error) {
+	return s.cachedRefs(ctx, fmt.Sprintf(tagsCacheKey, repoID), userID, repoID, s.listTags)
+}
+
+// BranchHead returns the commit a branch points at, or "" when the branch does not exist.
+// It reads the forge rather than the cache so a push of the last minute is seen.
+func (s *Service) BranchHead(ctx context.Context, userID, repoID int64, branch string) (string, error) {
+	repoModel, userModel, err := s.webhookContext(ctx, userID, repoID)
+	if err != nil {
+		return "", err
+	}
+	refs, err := s.listBranches(ctx, userModel, repoModel)
+	if err != nil {
+		return "", err
+	}
+	if s.cache != nil && refs != nil {
+		s.cache.Set(fmt.Sprintf(branchesCacheKey, repoID), refs, refsCacheTTL)
+	}
+	for _, ref := range refs {
+		if ref.Name == branch {
+			return ref.Commit, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *Service) cachedRefs(ctx context.Context, key string, userID, repoID int64, list func(context.Context, *model.User, *model.Repo) ([]GitRef, error)) ([]GitRef, error) {
+	if s.cache != nil {
+		var refs []GitRef
+		if s.cache.Get(key, &refs) {
+			return refs, nil
+		}
+	}
+	repoModel, userModel, err := s.webhookContext(ctx, userID, repoID)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := list(ctx, userModel, repoModel)
+	if err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		refs = []GitRef{}
+	}
+	if s.cache != nil {
+		s.cache.Set(key, refs, refsCacheTTL)
+	}
+	return refs, nil
+}
+
+func (s *Service) listBranches(ctx context.Context, userModel *model.User, repoModel *model.Repo) ([]GitRef, error) {
+	var refs []GitRef
+	add := func(name, commit string) {
+		refs = append(refs, GitRef{Name: name, Commit: commit, Default: name == repoModel.Branch})
+	}
+
+	switch s.provider {
+	case providerGitLab:
+		client, err := s.gitLabClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		opts := &gitlab.ListBranchesOptions{ListOptions: gitlab.ListOptions{PerPage: refsPageSize}}
+		for {
+			branches, resp, err := client.Branches.ListBranches(string(repoModel.ForgeRemoteID), opts, gitlab.WithContext(ctx))
+			if err != nil {
+				return nil, fmt.Errorf("list gitlab branches: %w", err)
+			}
+			for _, branch := range branches {
+				commit := ""
+				if branch.Commit != nil {
+					commit = branch.Commit.ID
+				}
+				add(branch.Name, commit)
+			}
+			if resp == nil || resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+	case providerGitHub:
+		ctx, client, err := s.githubUserClient(ctx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{"per_page": {strconv.Itoa(refsPageSize)}}
+		for page := 1; ; page++ {
+			params.Set("page", strconv.Itoa(page))
+			var items []githubGitRef
+			header, err := s.githubAPI(ctx, client, http.MethodGet, fmt.Sprintf("/repos/%s/git/refs/heads", repoModel.FullName), params, &items)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				add(strings.TrimPrefix(item.Ref, "refs/heads/"), item.Object.SHA)
+			}
+			if !githubHasNextPage(header) {
+				break
+			}
+		}
+	case providerGitea:
+		client, err := s.giteaClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		opts := gitea.ListRepoBranchesOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: refsPageSize}}
+		for {
+			branches, resp, err := client.ListRepoBranches(repoModel.Owner, repoModel.Name, opts)
+			if err != nil {
+				return nil, fmt.Errorf("list gitea branches: %w", err)
+			}
+			for _, branch := range branches {
+				commit := ""
+				if branch.Commit != nil {
+					commit = branch.Commit.ID
+				}
+				add(branch.Name, commit)
+			}
+			if resp == nil || resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+	case providerGitee:
+		items, err := s.giteeRefs(ctx, userModel.AccessToken, fmt.Sprintf("/repos/%s/%s/branches", repoModel.Owner, repoModel.Name))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(item.Name, item.Commit.SHA)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth provider: %s", s.provider)
+	}
+	return refs, nil
+}
+
+func (s *Service) listTags(ctx context.Context, userModel *model.User, repoModel *model.Repo) ([]GitRef, error) {
+	var refs []GitRef
+	add := func(name, commit string) {
+		refs = append(refs, GitRef{Name: name, Commit: commit})
+	}
+
+	switch s.provider {
+	case providerGitLab:
+		client, err := s.gitLabClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		opts := &gitlab.ListTagsOptions{ListOptions: gitlab.ListOptions{PerPage: refsPageSize}}
+		for {
+			tags, resp, err := client.Tags.ListTags(string(repoModel.ForgeRemoteID), opts, gitlab.WithContext(ctx))
+			if err != nil {
+				return nil, fmt.Errorf("list gitlab tags: %w", err)
+			}
+			for _, tag := range tags {
+				commit := ""
+				if tag.Commit != nil {
+					commit = tag.Commit.ID
+				}
+				add(tag.Name, commit)
+			}
+			if resp == nil || resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+	case providerGitHub:
+		ctx, client, err := s.githubUserClient(ctx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		// the tags endpoint resolves annotated tags to their commit, git/refs/tags does not
+		params := url.Values{"per_page": {strconv.Itoa(refsPageSize)}}
+		for page := 1; ; page++ {
+			params.Set("page", strconv.Itoa(page))
+			var items []githubTag
+			header, err := s.githubAPI(ctx, client, http.MethodGet, fmt.Sprintf("/repos/%s/tags", repoModel.FullName), params, &items)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				add(item.Name, item.Commit.SHA)
+			}
+			if !githubHasNextPage(header) {
+				break
+			}
+		}
+	case providerGitea:
+		client, err := s.giteaClient(userModel.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		opts := gitea.ListRepoTagsOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: refsPageSize}}
+		for {
+			tags, resp, err := client.ListRepoTags(repoModel.Owner, repoModel.Name, opts)
+			if err != nil {
+				return nil, fmt.Errorf("list gitea tags: %w", err)
+			}
+			for _, tag := range tags {
+				commit := ""
+				if tag.Commit != nil {
+					commit = tag.Commit.SHA
+				}
+				add(tag.Name, commit)
+			}
+			if resp == nil || resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+	case providerGitee:
+		items, err := s.giteeRefs(ctx, userModel.AccessToken, fmt.Sprintf("/repos/%s/%s/tags", repoModel.Owner, repoModel.Name))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(item.Name, item.Commit.SHA)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth provider: %s", s.provider)
+	}
+	return refs, nil
+}
+
+// giteeRefs pages through a Gitee branch or tag listing until a short page.
+func (s *Service) giteeRefs(ctx context.Context, accessToken, path string) ([]giteeRef, error) {
+	var refs []giteeRef
+	for page := 1; ; page++ {
+		var items []giteeRef
+		if err := s.giteeAPIGet(ctx, fmt.Sprintf("%s?page=%d&per_page=%d", path, page, refsPageSize), accessToken, &items); err != nil {
+			return nil, err
+		}
+		refs = append(refs, items...)
+		if len(items) < refsPageSize {
+			return refs, nil
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/rand"
@@ -24,9 +25,12 @@ import (
 	"golang.org/x/oauth2"
 	githuboauth "golang.org/x/oauth2/github"
 
+	"github.com/thepenn/devsys/internal/cache"
 	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/proxy"
 	"github.com/thepenn/devsys/internal/store"
 	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
 	"github.com/thepenn/devsys/service/repo"
 	"github.com/thepenn/devsys/service/user"
 	"gorm.io/gorm"
@@ -45,17 +49,23 @@ type Service struct {
 	users *user.Service
 	repos *repo.Service
 
-	provider   string
-	authProv   gitAuthProvider
-	sessionKey []byte
-	tokenTTL   time.Duration
-	scopes     []string
-	httpClient *http.Client
+	provider    string
+	authProv    gitAuthProvider
+	sessionKeys sessionKeyRing
+	keyStore    SessionKeyStore
+	audit       *audit.Service
+	cache       cache.Store
+	tokenTTL    time.Duration
+	grace       time.Duration
+	scopes      []string
+	httpClient  *http.Client
 
 	githubWebBase      string
 	githubAPIBase      string
 	githubOrgs         []string
 	githubIncludeForks bool
+	// orgListTimeout bounds listing the repositories of one GitHub organization.
+	orgListTimeout time.Duration
 
 	gitlabOrgs []string
 	giteaOrgs  []string
@@ -66,8 +76,8 @@ type gitAuthProvider interface {
 	Name() string
 	BeginAuth(ctx context.Context, redirect string) (string, string, error)
 	CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error)
-	SyncRepositories(ctx context.Context, userID int64) error
-	SyncRepository(ctx context.Context, userID int64, remoteID string) error
+	SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error)
+	SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error)
 }
 
 type giteeUser struct {
@@ -141,7 +151,8 @@ type githubRepo struct {
 	Archived      bool            `json:"archived"`
 }
 
-func New(cfg *config.Config, db *store.DB, users *user.Service, repos *repo.Service) (*Service, error) {
+// New creates the auth service. Forge API traffic is routed according to proxyRules.
+func New(cfg *config.Config, db *store.DB, users *user.Service, repos *repo.Service, proxyRules *proxy.Rules) (*Service, error) {
 	secret := strings.TrimSpace(cfg.Auth.SessionSecret)
 	if secret == "" {
 		generated, err := randomState()
@@ -157,84 +168,24 @@ func New(cfg *config.Config, db *store.DB, users *user.Service, repos *repo.Serv
 		provider = providerGitLab
 	}
 
-	var scopes []string
-	var httpClient *http.Client
-	var githubWebBase string
-	var githubAPIBase string
-	var githubOrgs []string
-	var githubIncludeForks bool
-	var gitlabOrgs []string
-	var giteaOrgs []string
-	var giteeOrgs []string
-	switch provider {
-	case providerGitHub:
-		if !cfg.Git.GitHub.Enabled {
-			return nil, errors.New("github authentication disabled")
-		}
-		scopes = strings.Fields(cfg.Git.GitHub.Scopes)
-		if len(scopes) == 0 {
-			scopes = []string{"read:user", "repo"}
-		}
-		httpClient = newHTTPClient(cfg.Git.GitHub.SkipVerify)
-		githubWebBase = normalizeBaseURL(cfg.Git.GitHub.URL, "https://github.com")
-		githubAPIBase = normalizeBaseURL(cfg.Git.GitHub.APIURL, "https://api.github.com")
-		githubOrgs = splitAndTrim(cfg.Git.GitHub.Organizations, ",")
-		githubIncludeForks = cfg.Git.GitHub.IncludeForks
-	case providerGitLab:
-		if !cfg.Git.GitLab.Enabled {
-			return nil, errors.New("gitlab authentication disabled")
-		}
-		scopes = strings.Fields(cfg.Git.GitLab.Scopes)
-		if len(scopes) == 0 {
-			scopes = []string{"read_user", "api"}
-		}
-		httpClient = newHTTPClient(cfg.Git.GitLab.SkipVerify)
-		gitlabOrgs = splitAndTrim(cfg.Git.GitLab.Organizations, ",")
-	case providerGitee:
-		if !cfg.Git.Gitee.Enabled {
-			return nil, errors.New("gitee authentication disabled")
-		}
-		scopes = strings.Fields(cfg.Git.Gitee.Scopes)
-		if len(scopes) == 0 {
-			scopes = []string{"user_info", "projects"}
-		}
-		httpClient = newHTTPClient(cfg.Git.Gitee.SkipVerify)
-		giteeOrgs = splitAndTrim(cfg.Git.Gitee.Organizations, ",")
-	case providerGitea:
-		if !cfg.Git.Gitea.Enabled {
-			return nil, errors.New("gitea authentication disabled")
-		}
-		scopes = strings.Fields(cfg.Git.Gitea.Scopes)
-		if len(scopes) == 0 {
-			scopes = []string{"read:user", "user:email", "repo"}
-		}
-		httpClient = newHTTPClient(cfg.Git.Gitea.SkipVerify)
-		giteaOrgs = splitAndTrim(cfg.Git.Gitea.Organizations, ",")
-	default:
+	factory, ok := providerFactories[provider]
+	if !ok {
 		return nil, fmt.Errorf("unsupported auth provider: %s", provider)
 	}
 
 	service := &Service{
-		cfg:        cfg,
-		db:         db,
-		users:      users,
-		repos:      repos,
-		provider:   provider,
-		sessionKey: []byte(secret),
-		tokenTTL:   cfg.Auth.TokenTTL,
-		scopes:     scopes,
-		httpClient: httpClient,
-
-		githubWebBase:      githubWebBase,
-		githubAPIBase:      githubAPIBase,
-		githubOrgs:         githubOrgs,
-		githubIncludeForks: githubIncludeForks,
-		gitlabOrgs:         gitlabOrgs,
-		giteaOrgs:          giteaOrgs,
-		giteeOrgs:          giteeOrgs,
+		cfg:      cfg,
+		db:       db,
+		users:    users,
+		repos:    repos,
+		provider: provider,
+		tokenTTL: cfg.Auth.TokenTTL,
+		grace:    cfg.Auth.RefreshGrace,
 	}
 
-	prov, err := newGitProvider(service, provider)
+	service.sessionKeys.load(&model.SessionKeys{Primary: secret})
+
+	prov, err := factory(service, proxyRules)
 	if err != nil {
 		return nil, err
 	}
@@ -253,40 +204,110 @@ func (s *Service) CompleteGitLabAuth(ctx context.Context, code, state string) (*
 	if s.authProv == nil {
 		return nil, errors.New("auth provider not configured")
 	}
-	return s.authProv.CompleteAuth(ctx, code, state)
+	resp, err := s.authProv.CompleteAuth(ctx, code, state)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.RecordAs(ctx, resp.User.Login, model.AuditActionLogin, model.AuditResourceUser, strconv.FormatInt(resp.User.ID, 10), 0, map[string]interface{}{
+		"provider": resp.User.Provider,
+	})
+	return resp, nil
 }
 
-func (s *Service) SyncGitLabRepositories(ctx context.Context, userID int64) error {
+func (s *Service) SyncGitLabRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	if s.authProv == nil {
-		return errors.New("auth provider not configured")
+		return nil, errors.New("auth provider not configured")
 	}
-	return s.authProv.SyncRepositories(ctx, userID)
+	report, err := s.authProv.SyncRepositories(ctx, userID)
+	s.recordSync(ctx, userID, "", report)
+	return report, err
 }
 
-func (s *Service) SyncRepositories(ctx context.Context, userID int64) error {
+// SyncRepositories synchronizes the repositories of userID from the configured provider.
+// Repositories that are skipped or fail are listed in the report; the error is only set when
+// nothing could be synchronized.
+func (s *Service) SyncRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	return s.SyncGitLabRepositories(ctx, userID)
 }
 
-func (s *Service) SyncRepository(ctx context.Context, userID int64, remoteID string) error {
+func (s *Service) SyncRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
 	if s.authProv == nil {
-		return errors.New("auth provider not configured")
+		return nil, errors.New("auth provider not configured")
+	}
+	if model.ForgeRemoteID(remoteID).IsManual() {
+		// imported repositories have no forge to sync from
+		report := repo.NewSyncReport(s.provider)
+		report.Skip(remoteID, repo.SyncSkipManualRepo)
+		return report, nil
+	}
+	report, err := s.authProv.SyncRepository(ctx, userID, remoteID)
+	s.recordSync(ctx, userID, remoteID, report)
+	return report, err
+}
+
+// UseAudit records logins and repository syncs.
+func (s *Service) UseAudit(recorder *audit.Service) {
+	s.audit = recorder
+}
+
+// UseCache caches the branch and tag listings of repositories.
+func (s *Service) UseCache(c cache.Store) {
+	s.cache = c
+}
+
+// recordSync records a repository sync that produced a report; remoteID is empty for a sync
+// of every repository of the user.
+func (s *Service) recordSync(ctx context.Context, userID int64, remoteID string, report *repo.SyncReport) {
+	if report == nil {
+		return
+	}
+	metadata := map[string]interface{}{
+		"provider": report.Provider,
+		"created":  report.Created,
+		"updated":  report.Updated,
+		"skipped":  report.Skipped,
+		"failed":   report.Failed,
+	}
+	if remoteID != "" {
+		metadata["remote_id"] = remoteID
+	}
+	s.audit.Record(ctx, model.AuditActionRepoSync, model.AuditResourceUser, strconv.FormatInt(userID, 10), 0, metadata)
+}
+
+// ParseToken verifies a session token. The errors are ErrTokenExpired, ErrTokenRevoked or
+// ErrTokenMalformed so that callers can tell whether refreshing may help.
+func (s *Service) ParseToken(ctx context.Context, tokenString string) (*SessionClaims, error) {
+	claims, err := s.verifyToken(tokenString, jwt.NewParser())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRevoked(ctx, claims); err != nil {
+		return nil, err
 	}
-	return s.authProv.SyncRepository(ctx, userID, remoteID)
+	return claims, nil
 }
 
-func (s *Service) ParseToken(tokenString string) (*SessionClaims, error) {
+func (s *Service) verifyToken(tokenString string, parser *jwt.Parser) (*SessionClaims, error) {
 	claims := &SessionClaims{}
-	parsed, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+	parsed, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.sessionKey, nil
+		keys := s.sessionKeys.verificationKeys()
+		set := jwt.VerificationKeySet{Keys: make([]jwt.VerificationKey, 0, len(keys))}
+		for _, key := range keys {
+			set.Keys = append(set.Keys, key)
+		}
+		return set, nil
 	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrTokenExpired
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrTokenMalformed, err)
 	}
 	if !parsed.Valid {
-		return nil, errors.New("invalid token")
+		return nil, ErrTokenMalformed
 	}
 	return claims, nil
 }
@@ -363,18 +384,21 @@ func (s *Service) completeGitLabAuth(ctx context.Context, code, state string) (*
 		Email:    firstNonEmpty(gitUser.Email, gitUser.PublicEmail),
 		Avatar:   gitUser.AvatarURL,
 		IsAdmin:  gitUser.IsAdmin,
+		Orgs:     s.gitlabUserGroups(client),
 	}, token)
 	if err != nil {
 		return nil, err
 	}
 
-	repos, err := s.listGitLabProjects(ctx, client)
+	report := repo.NewSyncReport(providerGitLab)
+	repos, err := s.listGitLabProjects(ctx, client, report)
 	if err != nil {
 		return nil, err
 	}
-	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false); err != nil {
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false, report); err != nil {
 		return nil, err
 	}
+	logSyncReport(report)
 
 	jwtToken, err := s.generateToken(appUser)
 	if err != nil {
@@ -388,66 +412,70 @@ func (s *Service) completeGitLabAuth(ctx context.Context, code, state string) (*
 	}, nil
 }
 
-func (s *Service) syncGitLabRepositories(ctx context.Context, userID int64) error {
+func (s *Service) syncGitLabRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitlab token")
+		return nil, errors.New("user has no stored gitlab token")
 	}
 
 	client, err := s.gitLabClient(userModel.AccessToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitlab, s.cfg.Git.GitLab.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repos, err := s.listGitLabProjects(ctx, client)
+	report := repo.NewSyncReport(providerGitLab)
+	repos, err := s.listGitLabProjects(ctx, client, report)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
-func (s *Service) syncGitLabRepository(ctx context.Context, userID int64, remoteID string) error {
+func (s *Service) syncGitLabRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitlab token")
+		return nil, errors.New("user has no stored gitlab token")
 	}
 
 	client, err := s.gitLabClient(userModel.AccessToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitlab, s.cfg.Git.GitLab.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	projectID, err := strconv.ParseInt(remoteID, 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid repository id: %w", err)
+		return nil, fmt.Errorf("invalid repository id: %w", err)
 	}
 
 	project, _, err := client.Projects.GetProject(projectID, nil)
 	if err != nil {
-		return fmt.Errorf("fetch gitlab project: %w", err)
+		return nil, fmt.Errorf("fetch gitlab project: %w", err)
 	}
 
 	owner := gitLabProjectNamespace(project)
@@ -455,11 +483,15 @@ func (s *Service) syncGitLabRepository(ctx context.Context, userID int64, remote
 		if strings.TrimSpace(owner) == "" {
 			owner = "(unknown)"
 		}
-		return fmt.Errorf("gitlab project owner %s not permitted by configuration", owner)
+		return nil, fmt.Errorf("gitlab project owner %s not permitted by configuration", owner)
 	}
 
 	repoData := convertGitLabProject(project)
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true)
+	report := repo.NewSyncReport(providerGitLab)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
 func (s *Service) beginGitHubAuth(ctx context.Context, redirect string) (string, string, error) {
@@ -546,18 +578,22 @@ func (s *Service) completeGitHubAuth(ctx context.Context, code, state string) (*
 		Email:    userInfo.Email,
 		Avatar:   userInfo.AvatarURL,
 		IsAdmin:  isAdmin,
+		Orgs:     s.githubUserOrgs(ctx, apiClient),
 	}, token)
 	if err != nil {
 		return nil, err
 	}
 
-	repositories, err := s.listGitHubRepositories(ctx, apiClient)
+	report := repo.NewSyncReport(providerGitHub)
+	repositories, err := s.listGitHubRepositories(ctx, apiClient, report)
+	s.recordSyncStatus(ctx, appUser.ID, report, err)
 	if err != nil {
 		return nil, err
 	}
-	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repositories, false); err != nil {
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repositories, false, report); err != nil {
 		return nil, err
 	}
+	logSyncReport(report)
 
 	jwtToken, err := s.generateToken(appUser)
 	if err != nil {
@@ -571,16 +607,16 @@ func (s *Service) completeGitHubAuth(ctx context.Context, code, state string) (*
 	}, nil
 }
 
-func (s *Service) syncGitHubRepositories(ctx context.Context, userID int64) error {
+func (s *Service) syncGitHubRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if strings.TrimSpace(userModel.AccessToken) == "" {
-		return errors.New("user has no stored github token")
+		return nil, errors.New("user has no stored github token")
 	}
 
 	token := &oauth2.Token{
@@ -593,7 +629,7 @@ func (s *Service) syncGitHubRepositories(ctx context.Context, userID int64) erro
 
 	oauthCfg, err := s.githubOAuthConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
@@ -605,12 +641,14 @@ func (s *Service) syncGitHubRepositories(ctx context.Context, userID int64) erro
 	}
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGithub, forgeURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repositories, err := s.listGitHubRepositories(ctx, apiClient)
+	report := repo.NewSyncReport(providerGitHub)
+	repositories, err := s.listGitHubRepositories(ctx, apiClient, report)
+	s.recordSyncStatus(ctx, userModel.ID, report, err)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !userModel.Admin {
@@ -626,24 +664,27 @@ func (s *Service) syncGitHubRepositories(ctx context.Context, userID int64) erro
 		}
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repositories, true)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repositories, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
-func (s *Service) syncGitHubRepository(ctx context.Context, userID int64, remoteID string) error {
+func (s *Service) syncGitHubRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if strings.TrimSpace(userModel.AccessToken) == "" {
-		return errors.New("user has no stored github token")
+		return nil, errors.New("user has no stored github token")
 	}
 
 	repoID, err := strconv.ParseInt(remoteID, 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid repository id: %w", err)
+		return nil, fmt.Errorf("invalid repository id: %w", err)
 	}
 
 	token := &oauth2.Token{
@@ -656,7 +697,7 @@ func (s *Service) syncGitHubRepository(ctx context.Context, userID int64, remote
 
 	oauthCfg, err := s.githubOAuthConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
@@ -664,18 +705,18 @@ func (s *Service) syncGitHubRepository(ctx context.Context, userID int64, remote
 
 	repository, err := s.fetchGitHubRepositoryByID(ctx, apiClient, repoID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if repository == nil {
-		return fmt.Errorf("github repository %d not found", repoID)
+		return nil, fmt.Errorf("github repository %d not found", repoID)
 	}
 	if !s.githubOrgAllowed(repository.Owner.Login) {
-		return fmt.Errorf("repository owner %s not permitted by configuration", repository.Owner.Login)
+		return nil, fmt.Errorf("repository owner %s not permitted by configuration", repository.Owner.Login)
 	}
 
 	converted, _, ok := s.convertGitHubRepository(*repository, true)
 	if !ok {
-		return fmt.Errorf("github repository %d is filtered by configuration", repoID)
+		return nil, fmt.Errorf("github repository %d is filtered by configuration", repoID)
 	}
 
 	forgeURL := s.githubWebBase
@@ -684,10 +725,14 @@ func (s *Service) syncGitHubRepository(ctx context.Context, userID int64, remote
 	}
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGithub, forgeURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{converted}, true)
+	report := repo.NewSyncReport(providerGitHub)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{converted}, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
 func (s *Service) beginGiteeAuth(ctx context.Context, redirect string) (string, string, error) {
@@ -744,18 +789,28 @@ func (s *Service) completeGiteeAuth(ctx context.Context, code, state string) (*A
 		Login:    firstNonEmpty(userInfo.Login, userInfo.Name),
 		Email:    userInfo.Email,
 		Avatar:   userInfo.AvatarURL,
+		Orgs:     s.giteeUserOrgs(ctx, token.AccessToken),
 	}, token)
 	if err != nil {
 		return nil, err
 	}
 
-	repos, err := s.fetchGiteeRepos(ctx, token.AccessToken)
+	report := repo.NewSyncReport(providerGitee)
+	repos, err := s.fetchGiteeRepos(ctx, token.AccessToken, report)
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		// a rate limited listing must not block the login; the repositories sync later
+		listingFailed(report, err)
+		err = nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false); err != nil {
+	s.recordSyncStatus(ctx, appUser.ID, report, nil)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false, report); err != nil {
 		return nil, err
 	}
+	logSyncReport(report)
 
 	jwtToken, err := s.generateToken(appUser)
 	if err != nil {
@@ -769,51 +824,64 @@ func (s *Service) completeGiteeAuth(ctx context.Context, code, state string) (*A
 	}, nil
 }
 
-func (s *Service) syncGiteeRepositories(ctx context.Context, userID int64) error {
+func (s *Service) syncGiteeRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitee token")
+		return nil, errors.New("user has no stored gitee token")
+	}
+	accessToken, err := s.freshAccessToken(ctx, s.giteeOAuthConfig(), userModel)
+	if err != nil {
+		return nil, err
 	}
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitee, s.cfg.Git.Gitee.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repos, err := s.fetchGiteeRepos(ctx, userModel.AccessToken)
+	report := repo.NewSyncReport(providerGitee)
+	repos, err := s.fetchGiteeRepos(ctx, accessToken, report)
+	s.recordSyncStatus(ctx, userModel.ID, report, err)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
-func (s *Service) syncGiteeRepository(ctx context.Context, userID int64, remoteID string) error {
+func (s *Service) syncGiteeRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitee token")
+		return nil, errors.New("user has no stored gitee token")
+	}
+	accessToken, err := s.freshAccessToken(ctx, s.giteeOAuthConfig(), userModel)
+	if err != nil {
+		return nil, err
 	}
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitee, s.cfg.Git.Gitee.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repoData, err := s.fetchGiteeRepoByID(ctx, userModel.AccessToken, remoteID)
+	repoData, err := s.fetchGiteeRepoByID(ctx, accessToken, remoteID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !s.giteeOrgAllowed(repoData.Owner) {
@@ -821,10 +889,14 @@ func (s *Service) syncGiteeRepository(ctx context.Context, userID int64, remoteI
 		if strings.TrimSpace(owner) == "" {
 			owner = "(unknown)"
 		}
-		return fmt.Errorf("gitee repository owner %s not permitted by configuration", owner)
+		return nil, fmt.Errorf("gitee repository owner %s not permitted by configuration", owner)
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true)
+	report := repo.NewSyncReport(providerGitee)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
 func (s *Service) beginGiteaAuth(ctx context.Context, redirect string) (string, string, error) {
@@ -888,18 +960,21 @@ func (s *Service) completeGiteaAuth(ctx context.Context, code, state string) (*A
 		Email:    gitUser.Email,
 		Avatar:   gitUser.AvatarURL,
 		IsAdmin:  gitUser.IsAdmin,
+		Orgs:     s.giteaUserOrgs(client),
 	}, token)
 	if err != nil {
 		return nil, err
 	}
 
-	repos, err := s.listGiteaRepositories(ctx, client)
+	report := repo.NewSyncReport(providerGitea)
+	repos, err := s.listGiteaRepositories(ctx, client, report)
 	if err != nil {
 		return nil, err
 	}
-	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false); err != nil {
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, appUser.ID, repos, false, report); err != nil {
 		return nil, err
 	}
+	logSyncReport(report)
 
 	jwtToken, err := s.generateToken(appUser)
 	if err != nil {
@@ -913,68 +988,80 @@ func (s *Service) completeGiteaAuth(ctx context.Context, code, state string) (*A
 	}, nil
 }
 
-func (s *Service) syncGiteaRepositories(ctx context.Context, userID int64) error {
+func (s *Service) syncGiteaRepositories(ctx context.Context, userID int64) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitea token")
+		return nil, errors.New("user has no stored gitea token")
+	}
+	accessToken, err := s.freshAccessToken(ctx, s.giteaOAuthConfig(), userModel)
+	if err != nil {
+		return nil, err
 	}
 
-	client, err := s.giteaClient(userModel.AccessToken)
+	client, err := s.giteaClient(accessToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	client.SetContext(ctx)
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitea, s.cfg.Git.Gitea.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	repos, err := s.listGiteaRepositories(ctx, client)
+	report := repo.NewSyncReport(providerGitea)
+	repos, err := s.listGiteaRepositories(ctx, client, report)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, repos, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
-func (s *Service) syncGiteaRepository(ctx context.Context, userID int64, remoteID string) error {
+func (s *Service) syncGiteaRepository(ctx context.Context, userID int64, remoteID string) (*repo.SyncReport, error) {
 	userModel, err := s.users.FindByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if userModel == nil {
-		return fmt.Errorf("user %d not found", userID)
+		return nil, fmt.Errorf("user %d not found", userID)
 	}
 	if userModel.AccessToken == "" {
-		return errors.New("user has no stored gitea token")
+		return nil, errors.New("user has no stored gitea token")
+	}
+	accessToken, err := s.freshAccessToken(ctx, s.giteaOAuthConfig(), userModel)
+	if err != nil {
+		return nil, err
 	}
 
-	client, err := s.giteaClient(userModel.AccessToken)
+	client, err := s.giteaClient(accessToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	client.SetContext(ctx)
 
 	forge, err := s.ensureForge(ctx, model.ForgeTypeGitea, s.cfg.Git.Gitea.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	repoID, err := strconv.ParseInt(remoteID, 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid repository id: %w", err)
+		return nil, fmt.Errorf("invalid repository id: %w", err)
 	}
 
 	repository, _, err := client.GetRepoByID(repoID)
 	if err != nil {
-		return fmt.Errorf("fetch gitea repository: %w", err)
+		return nil, fmt.Errorf("fetch gitea repository: %w", err)
 	}
 
 	repoData := convertGiteaRepo(repository)
@@ -983,10 +1070,14 @@ func (s *Service) syncGiteaRepository(ctx context.Context, userID int64, remoteI
 		if strings.TrimSpace(owner) == "" {
 			owner = "(unknown)"
 		}
-		return fmt.Errorf("gitea repository owner %s not permitted by configuration", owner)
+		return nil, fmt.Errorf("gitea repository owner %s not permitted by configuration", owner)
 	}
 
-	return s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true)
+	report := repo.NewSyncReport(providerGitea)
+	if err := s.repos.SyncGitRepositories(ctx, forge.ID, userModel.ID, []repo.GitRepository{repoData}, true, report); err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
 func (s *Service) giteaOAuthConfig() *oauth2.Config {
@@ -1015,7 +1106,7 @@ func (s *Service) giteaClient(accessToken string) (*gitea.Client, error) {
 	return client, nil
 }
 
-func (s *Service) listGiteaRepositories(ctx context.Context, client *gitea.Client) ([]repo.GitRepository, error) {
+func (s *Service) listGiteaRepositories(ctx context.Context, client *gitea.Client, report *repo.SyncReport) ([]repo.GitRepository, error) {
 	opts := gitea.ListReposOptions{
 		ListOptions: gitea.ListOptions{
 			Page:     1,
@@ -1027,7 +1118,12 @@ func (s *Service) listGiteaRepositories(ctx context.Context, client *gitea.Clien
 	for {
 		items, resp, err := client.ListMyRepos(opts)
 		if err != nil {
-			return nil, fmt.Errorf("list gitea repositories: %w", err)
+			err = fmt.Errorf("list gitea repositories: %w", err)
+			if opts.Page == 1 {
+				return nil, err
+			}
+			report.ListingFailed(err)
+			break
 		}
 		for _, item := range items {
 			if item == nil {
@@ -1037,10 +1133,14 @@ func (s *Service) listGiteaRepositories(ctx context.Context, client *gitea.Clien
 			if item.Owner != nil {
 				owner = item.Owner.UserName
 			}
-			if !s.giteaOrgAllowed(owner) {
-				continue
+			switch {
+			case !s.giteaOrgAllowed(owner):
+				report.Skip(item.FullName, repo.SyncSkipOrgFilter)
+			case item.Archived:
+				report.Skip(item.FullName, repo.SyncSkipArchived)
+			default:
+				repositories = append(repositories, convertGiteaRepo(item))
 			}
-			repositories = append(repositories, convertGiteaRepo(item))
 		}
 		if resp == nil || resp.NextPage == 0 {
 			break
@@ -1113,7 +1213,7 @@ func (s *Service) gitLabClient(accessToken string) (*gitlab.Client, error) {
 	return client, nil
 }
 
-func (s *Service) listGitLabProjects(ctx context.Context, client *gitlab.Client) ([]repo.GitRepository, error) {
+func (s *Service) listGitLabProjects(ctx context.Context, client *gitlab.Client, report *repo.SyncReport) ([]repo.GitRepository, error) {
 	opts := &gitlab.ListProjectsOptions{
 		Membership: gitlab.Bool(true),
 		ListOptions: gitlab.ListOptions{
@@ -1125,17 +1225,25 @@ func (s *Service) listGitLabProjects(ctx context.Context, client *gitlab.Client)
 	for {
 		projects, resp, err := client.Projects.ListProjects(opts)
 		if err != nil {
-			return nil, fmt.Errorf("list gitlab projects: %w", err)
+			err = fmt.Errorf("list gitlab projects: %w", err)
+			if opts.Page <= 1 {
+				return nil, err
+			}
+			report.ListingFailed(err)
+			break
 		}
 		for _, project := range projects {
 			if project == nil {
 				continue
 			}
-			if !s.gitlabOrgAllowed(gitLabProjectNamespace(project)) {
-				continue
+			switch {
+			case !s.gitlabOrgAllowed(gitLabProjectNamespace(project)):
+				report.Skip(project.PathWithNamespace, repo.SyncSkipOrgFilter)
+			case project.Archived:
+				report.Skip(project.PathWithNamespace, repo.SyncSkipArchived)
+			default:
+				repositories = append(repositories, convertGitLabProject(project))
 			}
-
-			repositories = append(repositories, convertGitLabProject(project))
 		}
 		if resp == nil || resp.NextPage == 0 {
 			break
@@ -1157,7 +1265,9 @@ func (s *Service) fetchGiteeUser(ctx context.Context, accessToken string) (*gite
 	return &user, nil
 }
 
-func (s *Service) fetchGiteeRepos(ctx context.Context, accessToken string) ([]repo.GitRepository, error) {
+// fetchGiteeRepos lists the repositories of the user. Paging stops at the total_page header
+// Gitee sends, or at a short page without it.
+func (s *Service) fetchGiteeRepos(ctx context.Context, accessToken string, report *repo.SyncReport) ([]repo.GitRepository, error) {
 	perPage := 100
 	page := 1
 	var repositories []repo.GitRepository
@@ -1165,8 +1275,13 @@ func (s *Service) fetchGiteeRepos(ctx context.Context, accessToken string) ([]re
 	for {
 		path := fmt.Sprintf("/user/repos?page=%d&per_page=%d", page, perPage)
 		var items []giteeRepo
-		if err := s.giteeAPIGet(ctx, path, accessToken, &items); err != nil {
-			return nil, err
+		header, err := s.giteeAPIGetWithHeader(ctx, path, accessToken, &items)
+		if err != nil {
+			if page == 1 {
+				return nil, err
+			}
+			listingFailed(report, err)
+			break
 		}
 		if len(items) == 0 {
 			break
@@ -1174,12 +1289,17 @@ func (s *Service) fetchGiteeRepos(ctx context.Context, accessToken string) ([]re
 
 		for _, item := range items {
 			if !s.giteeOrgAllowed(item.Owner.Login) {
+				report.Skip(item.FullName, repo.SyncSkipOrgFilter)
 				continue
 			}
 			repositories = append(repositories, convertGiteeRepo(item))
 		}
 
-		if len(items) < perPage {
+		if totalPages, err := strconv.Atoi(header.Get("total_page")); err == nil {
+			if page >= totalPages {
+				break
+			}
+		} else if len(items) < perPage {
 			break
 		}
 		page++
@@ -1189,36 +1309,80 @@ func (s *Service) fetchGiteeRepos(ctx context.Context, accessToken string) ([]re
 }
 
 func (s *Service) giteeAPIGet(ctx context.Context, path, accessToken string, v interface{}) error {
+	_, err := s.giteeAPIGetWithHeader(ctx, path, accessToken, v)
+	return err
+}
+
+// giteeAPIGetWithHeader decodes the response of path into v and returns its headers. 5xx
+// responses and rate limits are retried.
+func (s *Service) giteeAPIGetWithHeader(ctx context.Context, path, accessToken string, v interface{}) (http.Header, error) {
 	base := strings.TrimSuffix(s.cfg.Git.Gitee.URL, "/")
 	baseURL, err := url.Parse(base)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rel, err := url.Parse("/api/v5" + path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	apiURL := baseURL.ResolveReference(rel)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+	resp, err := doForgeRequest(ctx, s.httpClient, providerGitee, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gitee api %s failed: %s", path, resp.Status)
+	}
+
+	return resp.Header, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// giteeAPIPost sends body as JSON to path and discards the response.
+func (s *Service) giteeAPIPost(ctx context.Context, path, accessToken string, body interface{}) error {
+	baseURL, err := url.Parse(strings.TrimSuffix(s.cfg.Git.Gitee.URL, "/"))
+	if err != nil {
+		return err
+	}
+	rel, err := url.Parse("/api/v5" + path)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := s.httpClient.Do(req)
+	resp, err := doForgeRequest(ctx, s.httpClient, providerGitee, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL.ResolveReference(rel).String(), bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode >= 300 {
 		return fmt.Errorf("gitee api %s failed: %s", path, resp.Status)
 	}
-
-	return json.NewDecoder(resp.Body).Decode(v)
+	return nil
 }
 
 func (s *Service) fetchGiteeRepoByID(ctx context.Context, accessToken, remoteID string) (repo.GitRepository, error) {
@@ -1230,7 +1394,7 @@ func (s *Service) fetchGiteeRepoByID(ctx context.Context, accessToken, remoteID
 	return convertGiteeRepo(item), nil
 }
 
-func (s *Service) listGitHubRepositories(ctx context.Context, client *http.Client) ([]repo.GitRepository, error) {
+func (s *Service) listGitHubRepositories(ctx context.Context, client *http.Client, report *repo.SyncReport) ([]repo.GitRepository, error) {
 	includeForks := s.githubIncludeForks
 	seen := make(map[int64]struct{})
 	repositories := make([]repo.GitRepository, 0)
@@ -1240,50 +1404,80 @@ func (s *Service) listGitHubRepositories(ctx context.Context, client *http.Clien
 		params.Set("affiliation", "owner,organization_member")
 		items, err := s.fetchGitHubReposForPath(ctx, client, "/user/repos", params)
 		if err != nil {
-			return nil, err
+			if len(items) == 0 {
+				return nil, err
+			}
+			listingFailed(report, err)
 		}
 		for _, item := range items {
-			repo, id, ok := s.convertGitHubRepository(item, includeForks)
-			if !ok || !s.githubOrgAllowed(repo.Owner) {
+			if _, exists := seen[item.ID]; exists {
 				continue
 			}
-			if _, exists := seen[id]; exists {
+			seen[item.ID] = struct{}{}
+			if reason := githubSkipReason(item, includeForks); reason != "" {
+				report.Skip(item.FullName, reason)
 				continue
 			}
-			seen[id] = struct{}{}
-			repositories = append(repositories, repo)
+			converted, _, _ := s.convertGitHubRepository(item, includeForks)
+			if !s.githubOrgAllowed(converted.Owner) {
+				report.Skip(item.FullName, repo.SyncSkipOrgFilter)
+				continue
+			}
+			repositories = append(repositories, converted)
 		}
 		return repositories, nil
 	}
 
+	// an organization that fails or stops answering is recorded and the others are still
+	// listed; the sync only fails when no organization could be listed at all
+	listed := false
+	var lastErr error
 	for _, org := range s.githubOrgs {
 		orgName := strings.TrimSpace(org)
 		if orgName == "" {
 			continue
 		}
-		path := fmt.Sprintf("/orgs/%s/repos", url.PathEscape(orgName))
-		params := url.Values{}
-		params.Set("type", "all")
-		items, err := s.fetchGitHubReposForPath(ctx, client, path, params)
+		items, err := s.fetchGitHubOrgRepos(ctx, client, orgName)
 		if err != nil {
-			return nil, err
+			lastErr = err
+			listingFailed(report, fmt.Errorf("list repositories of %s: %w", orgName, err))
+		}
+		if err == nil || len(items) > 0 {
+			listed = true
 		}
 		for _, item := range items {
-			repo, id, ok := s.convertGitHubRepository(item, includeForks)
-			if !ok {
+			if _, exists := seen[item.ID]; exists {
 				continue
 			}
-			if _, exists := seen[id]; exists {
+			seen[item.ID] = struct{}{}
+			if reason := githubSkipReason(item, includeForks); reason != "" {
+				report.Skip(item.FullName, reason)
 				continue
 			}
-			seen[id] = struct{}{}
-			repositories = append(repositories, repo)
+			converted, _, _ := s.convertGitHubRepository(item, includeForks)
+			repositories = append(repositories, converted)
 		}
 	}
+	if !listed && lastErr != nil {
+		return nil, lastErr
+	}
 
 	return repositories, nil
 }
 
+// fetchGitHubOrgRepos lists the repositories of one organization within orgListTimeout.
+func (s *Service) fetchGitHubOrgRepos(ctx context.Context, client *http.Client, org string) ([]githubRepo, error) {
+	if s.orgListTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.orgListTimeout)
+		defer cancel()
+	}
+	path := fmt.Sprintf("/orgs/%s/repos", url.PathEscape(org))
+	params := url.Values{}
+	params.Set("type", "all")
+	return s.fetchGitHubReposForPath(ctx, client, path, params)
+}
+
 func (s *Service) fetchGitHubReposForPath(ctx context.Context, client *http.Client, path string, baseParams url.Values) ([]githubRepo, error) {
 	const perPage = 100
 
@@ -1296,7 +1490,8 @@ func (s *Service) fetchGitHubReposForPath(ctx context.Context, client *http.Clie
 		var batch []githubRepo
 		header, err := s.githubAPI(ctx, client, http.MethodGet, path, params, &batch)
 		if err != nil {
-			return nil, err
+			// the pages fetched so far are returned with the error
+			return results, err
 		}
 		if len(batch) == 0 {
 			break
@@ -1399,6 +1594,19 @@ func (s *Service) githubIsOrganizationAdmin(ctx context.Context, client *http.Cl
 	return false, nil
 }
 
+// githubSkipReason returns why a listed repository is left out of a sync, or "" to keep it.
+func githubSkipReason(item githubRepo, includeForks bool) string {
+	switch {
+	case item.ID == 0:
+		return repo.SyncSkipConversionError
+	case !includeForks && item.Fork:
+		return repo.SyncSkipForkExcluded
+	case item.Archived:
+		return repo.SyncSkipArchived
+	}
+	return ""
+}
+
 func (s *Service) convertGitHubRepository(item githubRepo, includeForks bool) (repo.GitRepository, int64, bool) {
 	if item.ID == 0 {
 		return repo.GitRepository{}, 0, false
@@ -1446,6 +1654,10 @@ func (e *githubAPIError) Error() string {
 }
 
 func (s *Service) githubAPI(ctx context.Context, client *http.Client, method, path string, params url.Values, out interface{}) (http.Header, error) {
+	return s.githubAPIWithBody(ctx, client, method, path, params, nil, out)
+}
+
+func (s *Service) githubAPIWithBody(ctx context.Context, client *http.Client, method, path string, params url.Values, in interface{}, out interface{}) (http.Header, error) {
 	base := normalizeBaseURL(s.githubAPIBase, "https://api.github.com")
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
@@ -1455,13 +1667,29 @@ func (s *Service) githubAPI(ctx context.Context, client *http.Client, method, pa
 		endpoint = endpoint + "?" + params.Encode()
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
-	if err != nil {
-		return nil, err
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
 	}
-	req.Header.Set("Accept", "application/vnd.github+json")
 
-	resp, err := client.Do(req)
+	resp, err := doForgeRequest(ctx, client, providerGitHub, func() (*http.Request, error) {
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -1567,28 +1795,30 @@ func githubHasNextPage(header http.Header) bool {
 }
 
 func (s *Service) generateToken(user *model.User) (string, error) {
+	jti, err := randomState()
+	if err != nil {
+		return "", err
+	}
 	now := time.Now()
 	claims := &SessionClaims{
 		UserID: user.ID,
 		Login:  user.Login,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.tokenTTL)),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.sessionKey)
+	return token.SignedString(s.sessionKeys.signingKey())
 }
 
 func (s *Service) encodeState(state, redirect string) (string, error) {
 	stateBytes := []byte(state)
 	redirectBytes := []byte(redirect)
 
-	mac := hmac.New(sha256.New, s.sessionKey)
-	mac.Write(stateBytes)
-	mac.Write(redirectBytes)
-	sum := mac.Sum(nil)
+	sum := signState(s.sessionKeys.signingKey(), stateBytes, redirectBytes)
 
 	encoded := strings.Join([]string{
 		base64.RawURLEncoding.EncodeToString(stateBytes),
@@ -1619,12 +1849,15 @@ func (s *Service) decodeState(encoded string) (string, string, error) {
 		return "", "", errors.New("invalid oauth state")
 	}
 
-	mac := hmac.New(sha256.New, s.sessionKey)
-	mac.Write(stateBytes)
-	mac.Write(redirectBytes)
-	expected := mac.Sum(nil)
-
-	if !hmac.Equal(signature, expected) {
+	// states issued before a key rotation still verify against the secondary key
+	valid := false
+	for _, key := range s.sessionKeys.verificationKeys() {
+		if hmac.Equal(signature, signState(key, stateBytes, redirectBytes)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
 		log.Warn().Str("state", encoded).Msg("oauth state signature mismatch")
 		return "", "", errors.New("invalid oauth state")
 	}
@@ -1656,6 +1889,13 @@ func (s *Service) ensureForge(ctx context.Context, forgeType model.ForgeType, ra
 	return &forge, nil
 }
 
+func signState(key, state, redirect []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(state)
+	mac.Write(redirect)
+	return mac.Sum(nil)
+}
+
 func randomState() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -1664,87 +1904,22 @@ func randomState() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func newGitProvider(s *Service, name string) (gitAuthProvider, error) {
-	switch name {
-	case providerGitHub:
-		return &gitHubProvider{svc: s}, nil
-	case providerGitLab:
-		return &gitLabProvider{svc: s}, nil
-	case providerGitee:
-		return &gitGiteeProvider{svc: s}, nil
-	case providerGitea:
-		return &gitGiteaProvider{svc: s}, nil
-	default:
-		return nil, fmt.Errorf("unsupported auth provider: %s", name)
+// logSyncReport records the problems of a sync that has no caller to report to, such as the
+// one run at login.
+func logSyncReport(report *repo.SyncReport) {
+	if report.Complete && report.Failed == 0 {
+		return
 	}
+	log.Warn().
+		Str("provider", report.Provider).
+		Bool("complete", report.Complete).
+		Int("failed", report.Failed).
+		Interface("errors", report.Errors).
+		Msg("repository sync finished with errors")
 }
 
-type gitHubProvider struct{ svc *Service }
-
-func (p *gitHubProvider) Name() string { return providerGitHub }
-func (p *gitHubProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
-	return p.svc.beginGitHubAuth(ctx, redirect)
-}
-func (p *gitHubProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
-	return p.svc.completeGitHubAuth(ctx, code, state)
-}
-func (p *gitHubProvider) SyncRepositories(ctx context.Context, userID int64) error {
-	return p.svc.syncGitHubRepositories(ctx, userID)
-}
-func (p *gitHubProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) error {
-	return p.svc.syncGitHubRepository(ctx, userID, remoteID)
-}
-
-type gitLabProvider struct{ svc *Service }
-
-func (p *gitLabProvider) Name() string { return providerGitLab }
-func (p *gitLabProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
-	return p.svc.beginGitLabAuth(ctx, redirect)
-}
-func (p *gitLabProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
-	return p.svc.completeGitLabAuth(ctx, code, state)
-}
-func (p *gitLabProvider) SyncRepositories(ctx context.Context, userID int64) error {
-	return p.svc.syncGitLabRepositories(ctx, userID)
-}
-func (p *gitLabProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) error {
-	return p.svc.syncGitLabRepository(ctx, userID, remoteID)
-}
-
-type gitGiteeProvider struct{ svc *Service }
-
-func (p *gitGiteeProvider) Name() string { return providerGitee }
-func (p *gitGiteeProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
-	return p.svc.beginGiteeAuth(ctx, redirect)
-}
-func (p *gitGiteeProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
-	return p.svc.completeGiteeAuth(ctx, code, state)
-}
-func (p *gitGiteeProvider) SyncRepositories(ctx context.Context, userID int64) error {
-	return p.svc.syncGiteeRepositories(ctx, userID)
-}
-func (p *gitGiteeProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) error {
-	return p.svc.syncGiteeRepository(ctx, userID, remoteID)
-}
-
-type gitGiteaProvider struct{ svc *Service }
-
-func (p *gitGiteaProvider) Name() string { return providerGitea }
-func (p *gitGiteaProvider) BeginAuth(ctx context.Context, redirect string) (string, string, error) {
-	return p.svc.beginGiteaAuth(ctx, redirect)
-}
-func (p *gitGiteaProvider) CompleteAuth(ctx context.Context, code, state string) (*AuthResponse, error) {
-	return p.svc.completeGiteaAuth(ctx, code, state)
-}
-func (p *gitGiteaProvider) SyncRepositories(ctx context.Context, userID int64) error {
-	return p.svc.syncGiteaRepositories(ctx, userID)
-}
-func (p *gitGiteaProvider) SyncRepository(ctx context.Context, userID int64, remoteID string) error {
-	return p.svc.syncGiteaRepository(ctx, userID, remoteID)
-}
-
-func newHTTPClient(skipVerify bool) *http.Client {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
+func newHTTPClient(proxyRules *proxy.Rules, skipVerify bool) *http.Client {
+	transport := proxyRules.Transport()
 	if skipVerify {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec G402
 	}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	// ErrTokenExpired is returned for session tokens past their expiry; they may still be
+	// refreshed within the grace window.
+	ErrTokenExpired = errors.New("登录已过期")
+	// ErrTokenRevoked is returned for session tokens revoked by logout or refresh.
+	ErrTokenRevoked = errors.New("登录已注销")
+	// ErrTokenMalformed is returned for tokens that are not session tokens issued by this server.
+	ErrTokenMalformed = errors.New("登录凭证无效")
+)
+
+// RefreshToken exchanges a session token that is valid, or expired for less than the refresh
+// grace window, for a new token with a full lifetime. The old token is revoked.
+func (s *Service) RefreshToken(ctx context.Context, tokenString string) (*AuthResponse, error) {
+	claims, err := s.verifyToken(tokenString, jwt.NewParser(jwt.WithLeeway(s.grace)))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRevoked(ctx, claims); err != nil {
+		return nil, err
+	}
+	userModel, err := s.users.FindByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if userModel == nil {
+		return nil, ErrTokenRevoked
+	}
+
+	token, err := s.generateToken(userModel)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revoke(ctx, claims); err != nil {
+		return nil, err
+	}
+	return &AuthResponse{
+		Token: token,
+		User:  toUserInfo(userModel, s.provider),
+	}, nil
+}
+
+// Logout revokes the session token of claims. Personal access tokens are revoked through their
+// own endpoint and are left alone.
+func (s *Service) Logout(ctx context.Context, claims *SessionClaims) error {
+	if claims == nil || claims.APIToken() {
+		return nil
+	}
+	if err := s.revoke(ctx, claims); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, model.AuditActionLogout, model.AuditResourceUser, strconv.FormatInt(claims.UserID, 10), 0, nil)
+	return nil
+}
+
+// checkRevoked returns ErrTokenRevoked when the token of claims was revoked. Tokens issued
+// before tokens carried a jti cannot be revoked.
+func (s *Service) checkRevoked(ctx context.Context, claims *SessionClaims) error {
+	if claims.ID == "" {
+		return nil
+	}
+	var count int64
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Model(&model.RevokedToken{}).Where("jti = ?", claims.ID).Count(&count).Error
+	})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// revoke records the jti of claims and prunes revocations of tokens that can no longer be
+// refreshed anyway.
+func (s *Service) revoke(ctx context.Context, claims *SessionClaims) error {
+	if claims.ID == "" {
+		return nil
+	}
+	now := time.Now()
+	var expiresAt int64
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Unix()
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).
+			Where("expires_at < ?", now.Add(-s.grace).Unix()).
+			Delete(&model.RevokedToken{}).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.RevokedToken{JTI: claims.ID, ExpiresAt: expiresAt, Created: now.Unix()}).Error
+	})
+}
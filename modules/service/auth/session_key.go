@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrNoSecondarySessionKey is returned when there is no previous session key to drop.
+var ErrNoSecondarySessionKey = errors.New("no secondary session key")
+
+// SessionKeyStore persists rotated session keys so they survive restarts.
+type SessionKeyStore interface {
+	LoadSessionKeys(ctx context.Context) (*model.SessionKeys, error)
+	SaveSessionKeys(ctx context.Context, keys *model.SessionKeys) error
+}
+
+// SessionKeyStatus describes the session keys without exposing them.
+type SessionKeyStatus struct {
+	Rotated          int64 `json:"rotated,omitempty"`
+	HasSecondary     bool  `json:"has_secondary"`
+	SecondaryExpires int64 `json:"secondary_expires,omitempty"`
+}
+
+// sessionKeyRing signs with the primary key and verifies with the primary and, until it
+// expires, the secondary key left behind by the last rotation.
+type sessionKeyRing struct {
+	// rotating serialises rotations so concurrent calls cannot lose a key.
+	rotating         sync.Mutex
+	mu               sync.RWMutex
+	primary          []byte
+	secondary        []byte
+	secondaryExpires time.Time
+	rotated          time.Time
+}
+
+func (r *sessionKeyRing) signingKey() []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.primary
+}
+
+func (r *sessionKeyRing) verificationKeys() [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := [][]byte{r.primary}
+	if len(r.secondary) > 0 && time.Now().Before(r.secondaryExpires) {
+		keys = append(keys, r.secondary)
+	}
+	return keys
+}
+
+func (r *sessionKeyRing) snapshot() *model.SessionKeys {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := &model.SessionKeys{Primary: string(r.primary)}
+	if len(r.secondary) > 0 {
+		keys.Secondary = string(r.secondary)
+		keys.SecondaryExpires = r.secondaryExpires.Unix()
+	}
+	if !r.rotated.IsZero() {
+		keys.Rotated = r.rotated.Unix()
+	}
+	return keys
+}
+
+func (r *sessionKeyRing) load(keys *model.SessionKeys) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.primary = []byte(keys.Primary)
+	r.secondary = nil
+	r.secondaryExpires = time.Time{}
+	r.rotated = time.Time{}
+	if keys.Secondary != "" && keys.SecondaryExpires > 0 {
+		r.secondary = []byte(keys.Secondary)
+		r.secondaryExpires = time.Unix(keys.SecondaryExpires, 0)
+	}
+	if keys.Rotated > 0 {
+		r.rotated = time.Unix(keys.Rotated, 0)
+	}
+}
+
+func (r *sessionKeyRing) status() SessionKeyStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	status := SessionKeyStatus{}
+	if !r.rotated.IsZero() {
+		status.Rotated = r.rotated.Unix()
+	}
+	if len(r.secondary) > 0 && time.Now().Before(r.secondaryExpires) {
+		status.HasSecondary = true
+		status.SecondaryExpires = r.secondaryExpires.Unix()
+	}
+	return status
+}
+
+// UseSessionKeyStore loads the keys of an earlier rotation from store, which then take
+// precedence over the configured session secret, and persists later rotations to it.
+func (s *Service) UseSessionKeyStore(ctx context.Context, store SessionKeyStore) error {
+	s.keyStore = store
+	if store == nil {
+		return nil
+	}
+	keys, err := store.LoadSessionKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("load session keys: %w", err)
+	}
+	if keys == nil || keys.Primary == "" {
+		return nil
+	}
+	s.sessionKeys.load(keys)
+	return nil
+}
+
+// SessionKeyStatus reports when the session key was rotated and whether the previous key
+// is still accepted.
+func (s *Service) SessionKeyStatus() SessionKeyStatus {
+	return s.sessionKeys.status()
+}
+
+// RotateSessionKey promotes a freshly generated key to primary. The old primary stays valid
+// for verification for one token lifetime, so issued sessions and OAuth flows in progress
+// keep working until they expire.
+func (s *Service) RotateSessionKey(ctx context.Context) (SessionKeyStatus, error) {
+	generated, err := randomState()
+	if err != nil {
+		return SessionKeyStatus{}, fmt.Errorf("generate session secret: %w", err)
+	}
+	s.sessionKeys.rotating.Lock()
+	defer s.sessionKeys.rotating.Unlock()
+
+	now := time.Now()
+	grace := s.tokenTTL
+	if grace <= 0 {
+		grace = 24 * time.Hour
+	}
+
+	current := s.sessionKeys.snapshot()
+	next := &model.SessionKeys{
+		Primary:          generated,
+		Secondary:        current.Primary,
+		SecondaryExpires: now.Add(grace).Unix(),
+		Rotated:          now.Unix(),
+	}
+	if err := s.saveSessionKeys(ctx, next); err != nil {
+		return SessionKeyStatus{}, err
+	}
+	s.sessionKeys.load(next)
+	log.Info().Time("secondary_expires", now.Add(grace)).Msg("session signing key rotated")
+	return s.sessionKeys.status(), nil
+}
+
+// DropSecondarySessionKey stops accepting the key replaced by the last rotation. Sessions
+// signed with it become invalid immediately.
+func (s *Service) DropSecondarySessionKey(ctx context.Context) (SessionKeyStatus, error) {
+	s.sessionKeys.rotating.Lock()
+	defer s.sessionKeys.rotating.Unlock()
+
+	current := s.sessionKeys.snapshot()
+	if current.Secondary == "" {
+		return SessionKeyStatus{}, ErrNoSecondarySessionKey
+	}
+	current.Secondary = ""
+	current.SecondaryExpires = 0
+	if err := s.saveSessionKeys(ctx, current); err != nil {
+		return SessionKeyStatus{}, err
+	}
+	s.sessionKeys.load(current)
+	log.Info().Msg("secondary session signing key dropped")
+	return s.sessionKeys.status(), nil
+}
+
+func (s *Service) saveSessionKeys(ctx context.Context, keys *model.SessionKeys) error {
+	if s.keyStore == nil {
+		// without a store the rotation only lasts until the next restart
+		return nil
+	}
+	if err := s.keyStore.SaveSessionKeys(ctx, keys); err != nil {
+		return fmt.Errorf("save session keys: %w", err)
+	}
+	return nil
+}
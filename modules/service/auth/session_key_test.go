@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// memoryKeyStore keeps session keys in memory, like the system settings row would.
+type memoryKeyStore struct {
+	keys *model.SessionKeys
+}
+
+func (m *memoryKeyStore) LoadSessionKeys(context.Context) (*model.SessionKeys, error) {
+	if m.keys == nil {
+		return nil, nil
+	}
+	keys := *m.keys
+	return &keys, nil
+}
+
+func (m *memoryKeyStore) SaveSessionKeys(_ context.Context, keys *model.SessionKeys) error {
+	saved := *keys
+	m.keys = &saved
+	return nil
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	svc := newTokenService(t)
+	svc.tokenTTL = time.Hour
+	ctx := context.Background()
+	store := &memoryKeyStore{}
+	if err := svc.UseSessionKeyStore(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	alice := &model.User{ID: 1, Login: "alice"}
+
+	before, err := svc.generateToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := svc.encodeState("nonce", "/repos/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := svc.RotateSessionKey(ctx)
+	if err != nil {
+		t.Fatalf("RotateSessionKey: %v", err)
+	}
+	if !status.HasSecondary || status.Rotated == 0 {
+		t.Fatalf("status = %+v, want a rotation with a secondary key", status)
+	}
+	if expires := time.Unix(status.SecondaryExpires, 0); expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(61*time.Minute)) {
+		t.Errorf("secondary expires at %v, want one token lifetime from now", expires)
+	}
+	if store.keys == nil || store.keys.Secondary != "session-secret" || store.keys.Primary == "session-secret" {
+		t.Fatalf("stored keys = %+v, want the configured secret kept as secondary", store.keys)
+	}
+
+	// during the rotation window both old and new sessions and states verify
+	if claims, err := svc.ParseToken(ctx, before); err != nil || claims.UserID != 1 {
+		t.Fatalf("ParseToken(old) = %+v, %v, want alice", claims, err)
+	}
+	after, err := svc.generateToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ParseToken(ctx, after); err != nil {
+		t.Fatalf("ParseToken(new): %v", err)
+	}
+	if nonce, redirect, err := svc.decodeState(state); err != nil || nonce != "nonce" || redirect != "/repos/1" {
+		t.Fatalf("decodeState(old) = %q, %q, %v", nonce, redirect, err)
+	}
+
+	// a restart picks the rotated keys up from the store
+	restarted := newTokenService(t)
+	if err := restarted.UseSessionKeyStore(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.ParseToken(ctx, before); err != nil {
+		t.Errorf("ParseToken(old) after restart: %v", err)
+	}
+	if _, err := restarted.ParseToken(ctx, after); err != nil {
+		t.Errorf("ParseToken(new) after restart: %v", err)
+	}
+
+	status, err = svc.DropSecondarySessionKey(ctx)
+	if err != nil {
+		t.Fatalf("DropSecondarySessionKey: %v", err)
+	}
+	if status.HasSecondary || store.keys.Secondary != "" {
+		t.Fatalf("status = %+v, stored = %+v, want no secondary key", status, store.keys)
+	}
+	if _, err := svc.ParseToken(ctx, before); !errors.Is(err, ErrTokenMalformed) {
+		t.Errorf("ParseToken(old) after drop = %v, want ErrTokenMalformed", err)
+	}
+	if _, _, err := svc.decodeState(state); err == nil {
+		t.Errorf("decodeState(old) after drop succeeded")
+	}
+	if _, err := svc.ParseToken(ctx, after); err != nil {
+		t.Errorf("ParseToken(new) after drop: %v", err)
+	}
+	if _, err := svc.DropSecondarySessionKey(ctx); !errors.Is(err, ErrNoSecondarySessionKey) {
+		t.Errorf("second drop = %v, want ErrNoSecondarySessionKey", err)
+	}
+}
+
+func TestSessionKeySecondaryExpires(t *testing.T) {
+	svc := newTokenService(t)
+	svc.tokenTTL = time.Hour
+	ctx := context.Background()
+	old, err := svc.generateToken(&model.User{ID: 1, Login: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.RotateSessionKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the grace period ends without an explicit drop
+	keys := svc.sessionKeys.snapshot()
+	keys.SecondaryExpires = time.Now().Add(-time.Second).Unix()
+	svc.sessionKeys.load(keys)
+
+	if _, err := svc.ParseToken(ctx, old); !errors.Is(err, ErrTokenMalformed) {
+		t.Errorf("ParseToken(old) after the grace period = %v, want ErrTokenMalformed", err)
+	}
+	if status := svc.SessionKeyStatus(); status.HasSecondary {
+		t.Errorf("status = %+v, want the expired secondary key not reported", status)
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/repo"
+	"github.com/thepenn/devsys/service/user"
+)
+
+// fakeGitHubOrgs serves the repository listings of GitHub organizations. An organization in
+// repos answers with its repositories, one in failing with the status, and one in hanging
+// does not answer until the request is cancelled.
+type fakeGitHubOrgs struct {
+	repos   map[string][]githubRepo
+	failing map[string]int
+	hanging map[string]bool
+}
+
+func (f *fakeGitHubOrgs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	org, hasPrefix := strings.CutPrefix(req.URL.Path, "/orgs/")
+	org, hasSuffix := strings.CutSuffix(org, "/repos")
+	switch {
+	case !hasPrefix || !hasSuffix:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	case f.hanging[org]:
+		<-req.Context().Done()
+	case f.failing[org] != 0:
+		http.Error(w, `{"message":"boom"}`, f.failing[org])
+	case req.URL.Query().Get("page") != "1":
+		_, _ = w.Write([]byte("[]"))
+	default:
+		_ = json.NewEncoder(w).Encode(f.repos[org])
+	}
+}
+
+func githubOrgRepo(id int64, org, name string) githubRepo {
+	return githubRepo{ID: id, Name: name, FullName: org + "/" + name, Owner: githubRepoOwner{Login: org}, DefaultBranch: "main"}
+}
+
+// newSyncService returns an auth service for GitHub organizations orgs served by forge, with
+// user 1 holding a token.
+func newSyncService(t *testing.T, forge http.Handler, orgs ...string) (*Service, *repo.Service) {
+	t.Helper()
+	ts := httptest.NewServer(forge)
+	t.Cleanup(ts.Close)
+
+	db := storetest.Open(t, &model.User{}, &model.Repo{}, &model.Forge{}, &model.Organization{})
+	if err := db.GetDB().Create(&model.User{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", AccessToken: "token", Hash: "user-hash"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Auth.Provider = providerGitHub
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Git.GitHub = config.GitHub{
+		Enabled:       true,
+		URL:           ts.URL,
+		APIURL:        ts.URL,
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		RedirectURL:   "https://ci.example/login/callback",
+		Organizations: strings.Join(orgs, ","),
+	}
+	repos := repo.New(db)
+	svc, err := New(cfg, db, user.New(db), repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.orgListTimeout = 200 * time.Millisecond
+	return svc, repos
+}
+
+func TestSyncRepositoriesAcrossOrganizations(t *testing.T) {
+	archived := githubOrgRepo(12, "alpha", "legacy")
+	archived.Archived = true
+	forge := &fakeGitHubOrgs{
+		repos: map[string][]githubRepo{
+			"alpha": {githubOrgRepo(11, "alpha", "api"), archived},
+			"omega": {githubOrgRepo(21, "omega", "web")},
+		},
+		failing: map[string]int{"broken": http.StatusNotFound},
+		hanging: map[string]bool{"slow": true},
+	}
+	// the failing and hanging organizations come first so they would block the others
+	svc, repos := newSyncService(t, forge, "broken", "slow", "alpha", "omega")
+
+	started := time.Now()
+	report, err := svc.SyncRepositories(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("SyncRepositories: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("sync took %s, want the hanging organization cut off", elapsed)
+	}
+
+	if report.Complete {
+		t.Errorf("report is complete although two organizations were not listed")
+	}
+	if report.Discovered != 3 || report.Created != 2 || report.Skipped != 1 || report.Failed != 0 {
+		t.Errorf("report = %+v, want 3 discovered, 2 created and the archived one skipped", report)
+	}
+	if len(report.Skips) != 1 || report.Skips[0] != (repo.SyncSkipEntry{Repo: "alpha/legacy", Reason: repo.SyncSkipArchived}) {
+		t.Errorf("skips = %+v, want alpha/legacy archived", report.Skips)
+	}
+	if len(report.Errors) != 2 {
+		t.Fatalf("errors = %+v, want one per unlisted organization", report.Errors)
+	}
+	if msg := report.Errors[0].Error; !strings.Contains(msg, "broken") || !strings.Contains(msg, "404") {
+		t.Errorf("first error = %q, want the failing organization", msg)
+	}
+	if msg := report.Errors[1].Error; !strings.Contains(msg, "slow") || !strings.Contains(msg, context.DeadlineExceeded.Error()) {
+		t.Errorf("second error = %q, want the hanging organization timed out", msg)
+	}
+
+	for _, fullName := range []string{"alpha/api", "omega/web"} {
+		owner, name, _ := strings.Cut(fullName, "/")
+		stored, err := repos.FindByFullName(context.Background(), owner, name)
+		if err != nil || stored == nil {
+			t.Errorf("repository %s = %v, %v, want it synced", fullName, stored, err)
+		}
+	}
+}
+
+func TestSyncRepositoriesFailsWhenNoOrganizationIsListed(t *testing.T) {
+	forge := &fakeGitHubOrgs{
+		failing: map[string]int{"broken": http.StatusNotFound},
+		hanging: map[string]bool{"slow": true},
+	}
+	svc, _ := newSyncService(t, forge, "broken", "slow")
+
+	report, err := svc.SyncRepositories(context.Background(), 1)
+	if err == nil {
+		t.Fatalf("SyncRepositories = %+v, want an error when nothing could be listed", report)
+	}
+}
+
+func TestSyncRepositoriesOfHealthyOrganizations(t *testing.T) {
+	forge := &fakeGitHubOrgs{repos: map[string][]githubRepo{
+		"alpha": {githubOrgRepo(11, "alpha", "api")},
+		"omega": {githubOrgRepo(21, "omega", "web")},
+	}}
+	svc, _ := newSyncService(t, forge, "alpha", "omega")
+
+	report, err := svc.SyncRepositories(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("SyncRepositories: %v", err)
+	}
+	if !report.Complete || report.Created != 2 || len(report.Errors) != 0 {
+		t.Fatalf("report = %+v, want a complete sync of both organizations", report)
+	}
+}
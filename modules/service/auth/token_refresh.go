@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrReauthRequired is returned when the stored forge token expired and cannot be refreshed;
+// the user has to log in again.
+var ErrReauthRequired = errors.New("代码平台授权已失效，请重新登录")
+
+// freshAccessToken returns a usable access token of userModel for providers whose API is
+// called with the raw token. An expired token is refreshed through oauthCfg and the rotated
+// tokens are stored on the user.
+func (s *Service) freshAccessToken(ctx context.Context, oauthCfg *oauth2.Config, userModel *model.User) (string, error) {
+	current := &oauth2.Token{
+		AccessToken:  userModel.AccessToken,
+		RefreshToken: userModel.RefreshToken,
+	}
+	if userModel.Expiry > 0 {
+		current.Expiry = time.Unix(userModel.Expiry, 0)
+	}
+	if current.Valid() {
+		return current.AccessToken, nil
+	}
+	if current.RefreshToken == "" {
+		return "", ErrReauthRequired
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
+	token, err := oauthCfg.TokenSource(ctx, current).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response != nil &&
+			retrieveErr.Response.StatusCode >= http.StatusBadRequest && retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+			return "", fmt.Errorf("%w: %v", ErrReauthRequired, err)
+		}
+		return "", fmt.Errorf("refresh oauth token: %w", err)
+	}
+
+	if token.AccessToken != userModel.AccessToken || (token.RefreshToken != "" && token.RefreshToken != userModel.RefreshToken) {
+		userModel.AccessToken = token.AccessToken
+		if token.RefreshToken != "" {
+			userModel.RefreshToken = token.RefreshToken
+		}
+		if !token.Expiry.IsZero() {
+			userModel.Expiry = token.Expiry.Unix()
+		}
+		// the refreshed token is usable for this request even when storing it fails
+		if err := s.users.Update(ctx, userModel); err != nil {
+			log.Warn().Err(err).Int64("user_id", userModel.ID).Msg("failed to store refreshed oauth token")
+		}
+	}
+	return token.AccessToken, nil
+}
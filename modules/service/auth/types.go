@@ -25,9 +25,30 @@ type UserInfo struct {
 type SessionClaims struct {
 	UserID int64  `json:"uid"`
 	Login  string `json:"login"`
+	// TokenID and Scopes are set for requests authenticated with a personal access token.
+	TokenID int64    `json:"-"`
+	Scopes  []string `json:"-"`
 	jwt.RegisteredClaims
 }
 
+// APIToken reports whether the claims come from a personal access token.
+func (c *SessionClaims) APIToken() bool {
+	return c != nil && c.TokenID != 0
+}
+
+// HasScope reports whether the caller may act within scope; sessions hold every scope.
+func (c *SessionClaims) HasScope(scope string) bool {
+	if !c.APIToken() {
+		return true
+	}
+	for _, candidate := range c.Scopes {
+		if candidate == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func toUserInfo(user *model.User, provider string) UserInfo {
 	return UserInfo{
 		ID:       user.ID,
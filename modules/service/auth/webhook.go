@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/oauth2"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrWebhookUnsupported is returned when the configured provider cannot manage webhooks.
+var ErrWebhookUnsupported = errors.New("webhook registration not supported for provider")
+
+type githubHookConfig struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Secret      string `json:"secret"`
+	InsecureSSL string `json:"insecure_ssl"`
+}
+
+type githubHookRequest struct {
+	Name   string           `json:"name,omitempty"`
+	Active bool             `json:"active"`
+	Events []string         `json:"events"`
+	Config githubHookConfig `json:"config"`
+}
+
+type githubHook struct {
+	ID int64 `json:"id"`
+}
+
+// RegisterWebhook creates or updates the push/tag webhook for a repository on the
+// configured forge using the user's stored token, and records the remote hook id.
+func (s *Service) RegisterWebhook(ctx context.Context, userID, repoID int64) error {
+	repoModel, userModel, err := s.webhookContext(ctx, userID, repoID)
+	if err != nil {
+		return err
+	}
+	if repoModel.IsManual() {
+		// no forge sends events for imported repositories
+		return nil
+	}
+	if strings.TrimSpace(repoModel.Hash) == "" {
+		return fmt.Errorf("repository %d has no webhook secret", repoID)
+	}
+	hookURL := s.webhookURL(repoModel.ForgeRemoteID)
+
+	var hookID string
+	switch s.provider {
+	case providerGitLab:
+		hookID, err = s.registerGitLabWebhook(ctx, userModel, repoModel, hookURL)
+	case providerGitHub:
+		hookID, err = s.registerGitHubWebhook(ctx, userModel, repoModel, hookURL)
+	case providerGitea:
+		hookID, err = s.registerGiteaWebhook(userModel, repoModel, hookURL)
+	default:
+		return fmt.Errorf("%w: %s", ErrWebhookUnsupported, s.provider)
+	}
+	if err != nil {
+		return err
+	}
+	return s.repos.SetWebhookID(ctx, repoModel.ID, hookID)
+}
+
+// UnregisterWebhook removes the webhook previously registered for a repository.
+func (s *Service) UnregisterWebhook(ctx context.Context, userID, repoID int64) error {
+	repoModel, userModel, err := s.webhookContext(ctx, userID, repoID)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(repoModel.WebhookID) == "" {
+		return nil
+	}
+
+	switch s.provider {
+	case providerGitLab:
+		err = s.unregisterGitLabWebhook(ctx, userModel, repoModel)
+	case providerGitHub:
+		err = s.unregisterGitHubWebhook(ctx, userModel, repoModel)
+	case providerGitea:
+		err = s.unregisterGiteaWebhook(userModel, repoModel)
+	default:
+		return fmt.Errorf("%w: %s", ErrWebhookUnsupported, s.provider)
+	}
+	if err != nil {
+		return err
+	}
+	return s.repos.SetWebhookID(ctx, repoModel.ID, "")
+}
+
+func (s *Service) webhookContext(ctx context.Context, userID, repoID int64) (*model.Repo, *model.User, error) {
+	repoModel, err := s.repos.FindByID(ctx, repoID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if repoModel == nil {
+		return nil, nil, fmt.Errorf("repository %d not found", repoID)
+	}
+	if repoModel.IsManual() {
+		// imported repositories have no webhook, so no forge token is needed
+		return repoModel, nil, nil
+	}
+	userModel, err := s.users.FindByID(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userModel == nil {
+		return nil, nil, fmt.Errorf("user %d not found", userID)
+	}
+	if strings.TrimSpace(userModel.AccessToken) == "" {
+		return nil, nil, fmt.Errorf("user has no stored %s token", s.provider)
+	}
+	return repoModel, userModel, nil
+}
+
+// webhookURL builds the public endpoint served by routers/webhook.go.
+func (s *Service) webhookURL(remoteID model.ForgeRemoteID) string {
+	base := strings.TrimSpace(s.cfg.Server.PublicURL)
+	if base == "" {
+		base = "http://" + strings.TrimSpace(s.cfg.Server.Host)
+	}
+	base = strings.TrimSuffix(base, "/")
+	root := "/" + strings.Trim(s.cfg.Server.RootPath, "/")
+	if root == "/" {
+		root = ""
+	}
+	return fmt.Sprintf("%s%s/hooks/%s/%s", base, root, s.provider, remoteID)
+}
+
+func (s *Service) registerGitLabWebhook(ctx context.Context, userModel *model.User, repoModel *model.Repo, hookURL string) (string, error) {
+	client, err := s.gitLabClient(userModel.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	projectID, err := strconv.Atoi(string(repoModel.ForgeRemoteID))
+	if err != nil {
+		return "", fmt.Errorf("invalid repository id: %w", err)
+	}
+	sslVerify := !s.cfg.Git.GitLab.SkipVerify
+
+	if existing, convErr := strconv.Atoi(repoModel.WebhookID); convErr == nil && existing > 0 {
+		hook, resp, err := client.Projects.EditProjectHook(projectID, existing, &gitlab.EditProjectHookOptions{
+			URL:                   gitlab.String(hookURL),
+			Token:                 gitlab.String(repoModel.Hash),
+			PushEvents:            gitlab.Bool(true),
+			TagPushEvents:         gitlab.Bool(true),
+			EnableSSLVerification: gitlab.Bool(sslVerify),
+		}, gitlab.WithContext(ctx))
+		if err == nil {
+			return strconv.Itoa(hook.ID), nil
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("update gitlab webhook: %w", err)
+		}
+	}
+
+	hook, _, err := client.Projects.AddProjectHook(projectID, &gitlab.AddProjectHookOptions{
+		URL:                   gitlab.String(hookURL),
+		Token:                 gitlab.String(repoModel.Hash),
+		PushEvents:            gitlab.Bool(true),
+		TagPushEvents:         gitlab.Bool(true),
+		EnableSSLVerification: gitlab.Bool(sslVerify),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("create gitlab webhook: %w", err)
+	}
+	return strconv.Itoa(hook.ID), nil
+}
+
+func (s *Service) unregisterGitLabWebhook(ctx context.Context, userModel *model.User, repoModel *model.Repo) error {
+	client, err := s.gitLabClient(userModel.AccessToken)
+	if err != nil {
+		return err
+	}
+	projectID, err := strconv.Atoi(string(repoModel.ForgeRemoteID))
+	if err != nil {
+		return fmt.Errorf("invalid repository id: %w", err)
+	}
+	hookID, err := strconv.Atoi(repoModel.WebhookID)
+	if err != nil {
+		return fmt.Errorf("invalid webhook id: %w", err)
+	}
+	resp, err := client.Projects.DeleteProjectHook(projectID, hookID, gitlab.WithContext(ctx))
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return fmt.Errorf("delete gitlab webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) githubUserClient(ctx context.Context, userModel *model.User) (context.Context, *http.Client, error) {
+	oauthCfg, err := s.githubOAuthConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	token := &oauth2.Token{
+		AccessToken:  userModel.AccessToken,
+		RefreshToken: userModel.RefreshToken,
+	}
+	if userModel.Expiry > 0 {
+		token.Expiry = time.Unix(userModel.Expiry, 0)
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
+	return ctx, oauthCfg.Client(ctx, token), nil
+}
+
+func (s *Service) registerGitHubWebhook(ctx context.Context, userModel *model.User, repoModel *model.Repo, hookURL string) (string, error) {
+	ctx, client, err := s.githubUserClient(ctx, userModel)
+	if err != nil {
+		return "", err
+	}
+	insecure := "0"
+	if s.cfg.Git.GitHub.SkipVerify {
+		insecure = "1"
+	}
+	request := githubHookRequest{
+		Active: true,
+		Events: []string{"push"},
+		Config: githubHookConfig{
+			URL:         hookURL,
+			ContentType: "json",
+			Secret:      repoModel.Hash,
+			InsecureSSL: insecure,
+		},
+	}
+	hooksPath := fmt.Sprintf("/repos/%s/hooks", repoModel.FullName)
+
+	var hook githubHook
+	if existing := strings.TrimSpace(repoModel.WebhookID); existing != "" {
+		_, err := s.githubAPIWithBody(ctx, client, http.MethodPatch, hooksPath+"/"+existing, nil, request, &hook)
+		if err == nil {
+			return strconv.FormatInt(hook.ID, 10), nil
+		}
+		var apiErr *githubAPIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("update github webhook: %w", err)
+		}
+	}
+
+	request.Name = "web"
+	if _, err := s.githubAPIWithBody(ctx, client, http.MethodPost, hooksPath, nil, request, &hook); err != nil {
+		return "", fmt.Errorf("create github webhook: %w", err)
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+func (s *Service) unregisterGitHubWebhook(ctx context.Context, userModel *model.User, repoModel *model.Repo) error {
+	ctx, client, err := s.githubUserClient(ctx, userModel)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/repos/%s/hooks/%s", repoModel.FullName, repoModel.WebhookID)
+	if _, err := s.githubAPI(ctx, client, http.MethodDelete, path, nil, nil); err != nil {
+		var apiErr *githubAPIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("delete github webhook: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) registerGiteaWebhook(userModel *model.User, repoModel *model.Repo, hookURL string) (string, error) {
+	client, err := s.giteaClient(userModel.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	config := map[string]string{
+		"url":          hookURL,
+		"content_type": "json",
+		"secret":       repoModel.Hash,
+	}
+	events := []string{"push"}
+
+	if existing, convErr := strconv.ParseInt(repoModel.WebhookID, 10, 64); convErr == nil && existing > 0 {
+		active := true
+		resp, err := client.EditRepoHook(repoModel.Owner, repoModel.Name, existing, gitea.EditHookOption{
+			Config: config,
+			Events: events,
+			Active: &active,
+		})
+		if err == nil {
+			return repoModel.WebhookID, nil
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("update gitea webhook: %w", err)
+		}
+	}
+
+	hook, _, err := client.CreateRepoHook(repoModel.Owner, repoModel.Name, gitea.CreateHookOption{
+		Type:   gitea.HookTypeGitea,
+		Config: config,
+		Events: events,
+		Active: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("create gitea webhook: %w", err)
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+func (s *Service) unregisterGiteaWebhook(userModel *model.User, repoModel *model.Repo) error {
+	client, err := s.giteaClient(userModel.AccessToken)
+	if err != nil {
+		return err
+	}
+	hookID, err := strconv.ParseInt(repoModel.WebhookID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook id: %w", err)
+	}
+	resp, err := client.DeleteRepoHook(repoModel.Owner, repoModel.Name, hookID)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return fmt.Errorf("delete gitea webhook: %w", err)
+	}
+	return nil
+}
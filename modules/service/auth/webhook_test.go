@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/repo"
+	"github.com/thepenn/devsys/service/user"
+)
+
+// fakeGitHubHooks serves the webhook API of a GitHub repository team/app.
+type fakeGitHubHooks struct {
+	mu      sync.Mutex
+	hooks   map[string]githubHookRequest
+	deleted []string
+	// fail answers every call with the status when set.
+	fail int
+}
+
+func (f *fakeGitHubHooks) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != 0 {
+		http.Error(w, `{"message":"Validation Failed"}`, f.fail)
+		return
+	}
+	var body githubHookRequest
+	_ = json.NewDecoder(req.Body).Decode(&body)
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/repos/team/app/hooks":
+		f.hooks["42"] = body
+		_ = json.NewEncoder(w).Encode(githubHook{ID: 42})
+	case req.Method == http.MethodPatch && req.URL.Path == "/repos/team/app/hooks/42":
+		f.hooks["42"] = body
+		_ = json.NewEncoder(w).Encode(githubHook{ID: 42})
+	case req.Method == http.MethodDelete && req.URL.Path == "/repos/team/app/hooks/42":
+		delete(f.hooks, "42")
+		f.deleted = append(f.deleted, "42")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}
+}
+
+// newWebhookService returns an auth service for GitHub served by forge, with user 1 holding a
+// token and repository 1 (team/app) pointing at the forge.
+func newWebhookService(t *testing.T, forge http.Handler) (*Service, *repo.Service) {
+	t.Helper()
+	ts := httptest.NewServer(forge)
+	t.Cleanup(ts.Close)
+
+	db := storetest.Open(t, &model.User{}, &model.Repo{})
+	if err := db.GetDB().Create(&model.User{ID: 1, ForgeID: 1, ForgeRemoteID: "1", Login: "alice", AccessToken: "token", Hash: "user-hash"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetDB().Create(&model.Repo{ID: 1, ForgeID: 1, ForgeRemoteID: "1001", Owner: "team", Name: "app", FullName: "team/app", Hash: "hook-secret"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Auth.Provider = providerGitHub
+	cfg.Auth.SessionSecret = "session-secret"
+	cfg.Server.PublicURL = "https://ci.example"
+	cfg.Git.GitHub = config.GitHub{
+		Enabled:      true,
+		URL:          ts.URL,
+		APIURL:       ts.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://ci.example/login/callback",
+	}
+	repos := repo.New(db)
+	svc, err := New(cfg, db, user.New(db), repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, repos
+}
+
+func webhookID(t *testing.T, repos *repo.Service) string {
+	t.Helper()
+	repoModel, err := repos.FindByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repoModel.WebhookID
+}
+
+func TestRegisterWebhookGitHub(t *testing.T) {
+	forge := &fakeGitHubHooks{hooks: make(map[string]githubHookRequest)}
+	svc, repos := newWebhookService(t, forge)
+	ctx := context.Background()
+
+	if err := svc.RegisterWebhook(ctx, 1, 1); err != nil {
+		t.Fatalf("RegisterWebhook: %v", err)
+	}
+	if got := webhookID(t, repos); got != "42" {
+		t.Fatalf("webhook id = %q, want 42", got)
+	}
+	hook := forge.hooks["42"]
+	if hook.Config.URL != "https://ci.example/hooks/github/1001" || hook.Config.Secret != "hook-secret" || !hook.Active {
+		t.Errorf("hook = %+v, want the repository endpoint signed with its secret", hook)
+	}
+
+	// registering again updates the hook in place
+	if err := svc.RegisterWebhook(ctx, 1, 1); err != nil {
+		t.Fatalf("RegisterWebhook again: %v", err)
+	}
+	if len(forge.hooks) != 1 {
+		t.Errorf("forge holds %d hooks, want 1", len(forge.hooks))
+	}
+
+	if err := svc.UnregisterWebhook(ctx, 1, 1); err != nil {
+		t.Fatalf("UnregisterWebhook: %v", err)
+	}
+	if len(forge.deleted) != 1 || len(forge.hooks) != 0 {
+		t.Errorf("hook was not deleted on the forge: %v", forge.hooks)
+	}
+	if got := webhookID(t, repos); got != "" {
+		t.Errorf("webhook id = %q after unregistering, want it cleared", got)
+	}
+}
+
+func TestRegisterWebhookSurfacesForgeErrors(t *testing.T) {
+	forge := &fakeGitHubHooks{hooks: make(map[string]githubHookRequest), fail: http.StatusUnprocessableEntity}
+	svc, repos := newWebhookService(t, forge)
+
+	if err := svc.RegisterWebhook(context.Background(), 1, 1); err == nil {
+		t.Fatal("RegisterWebhook succeeded while the forge rejected the hook")
+	}
+	if got := webhookID(t, repos); got != "" {
+		t.Errorf("webhook id = %q after a failed registration, want none", got)
+	}
+}
+
+func TestRegisterWebhookSkipsManualRepos(t *testing.T) {
+	svc, repos := newWebhookService(t, http.NotFoundHandler())
+	db := svc.db.GetDB()
+	if err := db.Create(&model.Repo{ID: 2, ForgeRemoteID: "manual-2", Owner: "team", Name: "imported", FullName: "team/imported"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.RegisterWebhook(context.Background(), 1, 2); err != nil {
+		t.Fatalf("RegisterWebhook of an imported repository: %v", err)
+	}
+	repoModel, _ := repos.FindByID(context.Background(), 2)
+	if repoModel.WebhookID != "" {
+		t.Errorf("imported repository got webhook %q", repoModel.WebhookID)
+	}
+}
@@ -0,0 +1,215 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrKindInvalid is returned for query kinds the cluster does not serve or serves in several
+// groups.
+var ErrKindInvalid = errors.New("kind cannot be resolved")
+
+// discoveryTTL is how long the discovery data of a cluster is reused before it is read again.
+const discoveryTTL = 10 * time.Minute
+
+// ListAPIResources lists the resources the cluster serves, grouped by API group. Each resource
+// is reported in the first version of its group serving it, the preferred version first;
+// subresources are left out. Groups whose discovery fails, such as aggregated APIs whose
+// service is down, are listed in FailedGroups instead of failing the whole catalog.
+func (s *Service) ListAPIResources(ctx context.Context, clusterID int64) (*model.KubernetesAPIResourceCatalog, error) {
+	client, err := s.discoveryClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	groups, lists, err := client.ServerGroupsAndResources()
+	failed, err := partialDiscovery(err)
+	if err != nil {
+		return nil, err
+	}
+
+	byGroupVersion := make(map[string]*metav1.APIResourceList, len(lists))
+	for _, list := range lists {
+		if list != nil {
+			byGroupVersion[list.GroupVersion] = list
+		}
+	}
+	catalog := &model.KubernetesAPIResourceCatalog{
+		Groups:       make([]model.KubernetesAPIGroup, 0, len(groups)),
+		FailedGroups: failed,
+	}
+	s.mu.RLock()
+	if at, ok := s.discoAt[clusterID]; ok {
+		catalog.Refreshed = at.Unix()
+	}
+	s.mu.RUnlock()
+
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		entry := model.KubernetesAPIGroup{
+			Name:             group.Name,
+			PreferredVersion: group.PreferredVersion.Version,
+			Versions:         make([]string, 0, len(group.Versions)),
+			Resources:        []model.KubernetesAPIResource{},
+		}
+		for _, version := range group.Versions {
+			entry.Versions = append(entry.Versions, version.Version)
+		}
+		seen := map[string]bool{}
+		for _, version := range preferredFirst(group) {
+			list, ok := byGroupVersion[version.GroupVersion]
+			if !ok {
+				continue
+			}
+			for _, resource := range list.APIResources {
+				if strings.Contains(resource.Name, "/") || seen[resource.Name] {
+					continue
+				}
+				seen[resource.Name] = true
+				entry.Resources = append(entry.Resources, model.KubernetesAPIResource{
+					Name:       resource.Name,
+					Kind:       resource.Kind,
+					Version:    version.Version,
+					Namespaced: resource.Namespaced,
+					Verbs:      []string(resource.Verbs),
+					ShortNames: resource.ShortNames,
+				})
+			}
+		}
+		sort.Slice(entry.Resources, func(i, j int) bool { return entry.Resources[i].Name < entry.Resources[j].Name })
+		catalog.Groups = append(catalog.Groups, entry)
+	}
+	sort.SliceStable(catalog.Groups, func(i, j int) bool { return catalog.Groups[i].Name < catalog.Groups[j].Name })
+	return catalog, nil
+}
+
+// preferredFirst returns the versions of group with its preferred version moved to the front.
+func preferredFirst(group *metav1.APIGroup) []metav1.GroupVersionForDiscovery {
+	versions := make([]metav1.GroupVersionForDiscovery, 0, len(group.Versions))
+	preferred := group.PreferredVersion.Version
+	for _, version := range group.Versions {
+		if version.Version == preferred {
+			versions = append([]metav1.GroupVersionForDiscovery{version}, versions...)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// partialDiscovery separates the group versions a discovery call could not read from other
+// errors, which it returns.
+func partialDiscovery(err error) ([]string, error) {
+	if err == nil {
+		return nil, nil
+	}
+	var groupErr *discovery.ErrGroupDiscoveryFailed
+	if !errors.As(err, &groupErr) {
+		return nil, err
+	}
+	failed := make([]string, 0, len(groupErr.Groups))
+	for gv := range groupErr.Groups {
+		failed = append(failed, gv.String())
+	}
+	sort.Strings(failed)
+	return failed, nil
+}
+
+// queryGVR returns the resource a query targets. Queries naming a Resource use it as given;
+// those naming only a Kind are resolved through a RESTMapper built from the discovery data of
+// the cluster, in Version when set and otherwise in the preferred version of the group, which
+// the API server reports as the version it stores the resource in. Without a Group the kind
+// must be served by a single group, the core group winning ties.
+func (s *Service) queryGVR(ctx context.Context, clusterID int64, query model.KubernetesResourceQuery) (schema.GroupVersionResource, error) {
+	if strings.TrimSpace(query.Resource) != "" {
+		return resolveGVR(query.Group, query.Version, query.Resource), nil
+	}
+	kind := strings.TrimSpace(query.Kind)
+	if kind == "" {
+		return schema.GroupVersionResource{}, fmt.Errorf("resource or kind is required")
+	}
+	client, err := s.discoveryClient(ctx, clusterID)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	gvr, err := mapKind(client, strings.TrimSpace(query.Group), strings.TrimSpace(query.Version), kind)
+	if meta.IsNoMatchError(err) {
+		// the cached discovery may predate a CRD installed since; look once more
+		client.Invalidate()
+		gvr, err = mapKind(client, strings.TrimSpace(query.Group), strings.TrimSpace(query.Version), kind)
+	}
+	if meta.IsNoMatchError(err) {
+		return schema.GroupVersionResource{}, fmt.Errorf("%w: %v", ErrKindInvalid, err)
+	}
+	return gvr, err
+}
+
+func mapKind(client discovery.DiscoveryInterface, group, version, kind string) (schema.GroupVersionResource, error) {
+	resources, err := restmapper.GetAPIGroupResources(client)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if group == "" {
+		if group, kind, err = kindGroup(resources, kind); err != nil {
+			return schema.GroupVersionResource{}, err
+		}
+	}
+	var versions []string
+	if version != "" {
+		versions = append(versions, version)
+	}
+	mapping, err := restmapper.NewDiscoveryRESTMapper(resources).RESTMapping(schema.GroupKind{Group: group, Kind: kind}, versions...)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return mapping.Resource, nil
+}
+
+// kindGroup finds the group serving kind, matched case-insensitively, and returns it with the
+// kind as served. Kinds served by several groups other than the core group are ambiguous and
+// need a group.
+func kindGroup(resources []*restmapper.APIGroupResources, kind string) (string, string, error) {
+	var groups []string
+	served := kind
+	for _, group := range resources {
+		found := ""
+		for _, list := range group.VersionedResources {
+			for _, resource := range list {
+				if !strings.Contains(resource.Name, "/") && strings.EqualFold(resource.Kind, kind) {
+					found = resource.Kind
+					break
+				}
+			}
+		}
+		if found == "" {
+			continue
+		}
+		if group.Group.Name == "" {
+			return "", found, nil
+		}
+		groups = append(groups, group.Group.Name)
+		served = found
+	}
+	switch len(groups) {
+	case 0:
+		return "", kind, &meta.NoKindMatchError{GroupKind: schema.GroupKind{Kind: kind}}
+	case 1:
+		return groups[0], served, nil
+	default:
+		sort.Strings(groups)
+		return "", kind, fmt.Errorf("%w: %s is served by several groups (%s); set group", ErrKindInvalid, kind, strings.Join(groups, ", "))
+	}
+}
@@ -0,0 +1,171 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrManifestInvalid is returned for manifests that cannot be decoded.
+var ErrManifestInvalid = errors.New("manifest is invalid")
+
+// ManifestApplyError reports the document a multi-document apply stopped at. Documents before
+// it were applied and are named in Applied.
+type ManifestApplyError struct {
+	Index   int
+	Kind    string
+	Name    string
+	Applied []string
+	DryRun  bool
+	Err     error
+}
+
+func (e *ManifestApplyError) Error() string {
+	msg := fmt.Sprintf("document %d", e.Index)
+	if e.Kind != "" {
+		msg += fmt.Sprintf(" (%s/%s)", e.Kind, e.Name)
+	}
+	msg += ": " + e.Err.Error()
+	if len(e.Applied) > 0 && !e.DryRun {
+		msg += fmt.Sprintf("; %d earlier document(s) were applied: %s", len(e.Applied), strings.Join(e.Applied, ", "))
+	}
+	return msg
+}
+
+func (e *ManifestApplyError) Unwrap() error {
+	return e.Err
+}
+
+type manifestDocument struct {
+	index     int
+	obj       *unstructured.Unstructured
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+// ApplyManifest applies the documents of a manifest in order, creating missing objects and
+// updating existing ones. Every document is decoded and resolved before the first write. When
+// a write fails the result lists the documents applied so far together with the failed one.
+// A dry run of several documents cannot see objects that earlier documents would create.
+func (s *Service) ApplyManifest(ctx context.Context, clusterID int64, req model.KubernetesManifestRequest) (*model.KubernetesApplyResult, error) {
+	raw := SplitManifest(req.Manifest)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: manifest is required", ErrManifestInvalid)
+	}
+	explicit := strings.TrimSpace(req.Resource) != ""
+	if explicit && len(raw) > 1 {
+		return nil, fmt.Errorf("%w: resource can only be given for a single-document manifest", ErrManifestInvalid)
+	}
+	client, err := s.dynamicClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]manifestDocument, 0, len(raw))
+	for i, body := range raw {
+		obj, namespace, err := decodeManifest(body, req.Namespace)
+		if err != nil {
+			return nil, &ManifestApplyError{Index: i + 1, DryRun: req.DryRun, Err: fmt.Errorf("%w: %v", ErrManifestInvalid, err)}
+		}
+		doc := manifestDocument{index: i + 1, obj: obj, namespace: namespace}
+		if explicit {
+			doc.gvr = resolveGVR(req.Group, req.Version, req.Resource)
+		} else {
+			gvr, namespaced, err := s.ResolveResource(ctx, clusterID, obj.GetAPIVersion(), obj.GetKind())
+			if err != nil {
+				return nil, &ManifestApplyError{Index: doc.index, Kind: obj.GetKind(), Name: obj.GetName(), DryRun: req.DryRun, Err: err}
+			}
+			doc.gvr = gvr
+			if !namespaced {
+				doc.namespace = ""
+			}
+		}
+		if err := checkNamespaceGuard(ctx, doc.namespace); err != nil {
+			return nil, &ManifestApplyError{Index: doc.index, Kind: obj.GetKind(), Name: obj.GetName(), DryRun: req.DryRun, Err: err}
+		}
+		docs = append(docs, doc)
+	}
+
+	result := &model.KubernetesApplyResult{DryRun: req.DryRun, Documents: make([]model.KubernetesAppliedDocument, 0, len(docs))}
+	applied := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		entry := model.KubernetesAppliedDocument{
+			Index:     doc.index,
+			Group:     doc.gvr.Group,
+			Version:   doc.gvr.Version,
+			Resource:  doc.gvr.Resource,
+			Kind:      doc.obj.GetKind(),
+			Namespace: doc.namespace,
+			Name:      doc.obj.GetName(),
+		}
+		obj, action, err := applyObject(ctx, client, doc, req.DryRun)
+		if err == nil {
+			var resp *model.KubernetesObjectResponse
+			if resp, err = buildObjectResponse(obj); err == nil {
+				entry.Object = resp.Object
+				entry.YAML = resp.YAML
+				entry.Action = action
+			}
+		}
+		if err != nil {
+			entry.Error = err.Error()
+			result.Documents = append(result.Documents, entry)
+			return result, &ManifestApplyError{
+				Index:   doc.index,
+				Kind:    entry.Kind,
+				Name:    entry.Name,
+				Applied: applied,
+				DryRun:  req.DryRun,
+				Err:     err,
+			}
+		}
+		result.Documents = append(result.Documents, entry)
+		applied = append(applied, entry.Kind+"/"+entry.Name)
+	}
+	if !req.DryRun {
+		for _, entry := range result.Documents {
+			s.recordAudit(ctx, model.AuditActionK8sApply, clusterID, entry.Namespace, entry.Kind, entry.Name, map[string]interface{}{
+				"action": entry.Action,
+			})
+		}
+	}
+	return result, nil
+}
+
+func applyObject(ctx context.Context, client dynamic.Interface, doc manifestDocument, dryRun bool) (*unstructured.Unstructured, string, error) {
+	resource := client.Resource(doc.gvr)
+	target := dynamic.ResourceInterface(resource)
+	if doc.namespace != "" {
+		target = resource.Namespace(doc.namespace)
+	}
+	var dryRunOpt []string
+	if dryRun {
+		dryRunOpt = []string{metav1.DryRunAll}
+	}
+	current, err := target.Get(ctx, doc.obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, "", err
+		}
+		created, err := target.Create(ctx, doc.obj, metav1.CreateOptions{FieldManager: fieldManager, DryRun: dryRunOpt})
+		if err != nil {
+			return nil, "", err
+		}
+		return created, model.KubernetesApplyCreated, nil
+	}
+	doc.obj.SetResourceVersion(current.GetResourceVersion())
+	updated, err := target.Update(ctx, doc.obj, metav1.UpdateOptions{FieldManager: fieldManager, DryRun: dryRunOpt})
+	if err != nil {
+		return nil, "", err
+	}
+	return updated, model.KubernetesApplyUpdated, nil
+}
@@ -0,0 +1,22 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// recordAudit records a write to an object of a cluster, identified as
+// cluster/namespace/kind/name with an empty namespace for cluster-scoped objects.
+func (s *Service) recordAudit(ctx context.Context, action string, clusterID int64, namespace, kind, name string, metadata map[string]interface{}) {
+	if s.audit == nil {
+		return
+	}
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["cluster_id"] = clusterID
+	resourceID := fmt.Sprintf("%d/%s/%s/%s", clusterID, namespace, kind, name)
+	s.audit.Record(ctx, action, model.AuditResourceK8s, resourceID, 0, metadata)
+}
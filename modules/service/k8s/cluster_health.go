@@ -0,0 +1,73 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// clusterHealthTimeout bounds TestCluster so an unreachable API server is reported quickly
+// instead of after the 30s client timeout.
+const clusterHealthTimeout = 5 * time.Second
+
+// TestCluster checks connectivity to a cluster by asking its API server for the version. An
+// unreachable cluster is reported in the result; errors are only returned when the cluster
+// cannot be resolved.
+func (s *Service) TestCluster(ctx context.Context, clusterID int64) (*model.KubernetesClusterHealth, error) {
+	cfg, err := s.restConfig(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	probeCfg := rest.CopyConfig(cfg)
+	probeCfg.Timeout = clusterHealthTimeout
+
+	health := model.KubernetesClusterHealth{ClusterID: clusterID}
+	started := time.Now()
+	client, err := discovery.NewDiscoveryClientForConfig(probeCfg)
+	if err == nil {
+		version, verr := client.ServerVersion()
+		if verr == nil {
+			health.Reachable = true
+			health.Version = version.GitVersion
+		}
+		err = verr
+	}
+	health.LatencyMs = time.Since(started).Milliseconds()
+	health.CheckedAt = time.Now().Unix()
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	s.health[clusterID] = health
+	s.mu.Unlock()
+	return &health, nil
+}
+
+// LastHealth returns the result of the most recent TestCluster call, or nil when the cluster
+// has not been checked since its clients were last built.
+func (s *Service) LastHealth(clusterID int64) *model.KubernetesClusterHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	health, ok := s.health[clusterID]
+	if !ok {
+		return nil
+	}
+	return &health
+}
+
+// InvalidateCluster drops the cached clients and health of a cluster so the next call reads
+// the certificate again.
+func (s *Service) InvalidateCluster(clusterID int64) {
+	s.mu.Lock()
+	delete(s.clientCache, clusterID)
+	delete(s.dynCache, clusterID)
+	delete(s.discoCache, clusterID)
+	delete(s.discoAt, clusterID)
+	delete(s.health, clusterID)
+	s.mu.Unlock()
+}
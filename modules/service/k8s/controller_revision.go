@@ -0,0 +1,148 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// controllerRevisionPatch mirrors the patch StatefulSet and DaemonSet controllers store in
+// ControllerRevision.Data; only the pod template is recorded.
+type controllerRevisionPatch struct {
+	Spec struct {
+		Template corev1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// ownedControllerRevisions lists the ControllerRevisions owned by the workload with the given UID.
+func ownedControllerRevisions(ctx context.Context, client kubernetes.Interface, namespace string, owner types.UID) ([]appsv1.ControllerRevision, error) {
+	list, err := client.AppsV1().ControllerRevisions(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]appsv1.ControllerRevision, 0, len(list.Items))
+	for _, rev := range list.Items {
+		if ownedBy(rev.OwnerReferences, owner) {
+			revisions = append(revisions, rev)
+		}
+	}
+	return revisions, nil
+}
+
+// controllerRevisionTemplate decodes the pod template stored in a ControllerRevision.
+func controllerRevisionTemplate(rev *appsv1.ControllerRevision) (*corev1.PodTemplateSpec, error) {
+	raw := rev.Data.Raw
+	if len(raw) == 0 && rev.Data.Object != nil {
+		encoded, err := json.Marshal(rev.Data.Object)
+		if err != nil {
+			return nil, err
+		}
+		raw = encoded
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("controller revision %s has no data", rev.Name)
+	}
+	var patch controllerRevisionPatch
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, fmt.Errorf("decode controller revision %s: %w", rev.Name, err)
+	}
+	return &patch.Spec.Template, nil
+}
+
+func controllerRevisionHistoryEntries(ctx context.Context, client kubernetes.Interface, namespace string, owner types.UID) ([]model.KubernetesWorkloadHistoryEntry, error) {
+	revisions, err := ownedControllerRevisions(ctx, client, namespace, owner)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]model.KubernetesWorkloadHistoryEntry, 0, len(revisions))
+	for i := range revisions {
+		rev := &revisions[i]
+		entry := model.KubernetesWorkloadHistoryEntry{
+			Revision:  rev.Revision,
+			CreatedAt: rev.CreationTimestamp.Unix(),
+			Source:    rev.Name,
+		}
+		if template, err := controllerRevisionTemplate(rev); err == nil {
+			entry.Images = collectTemplateImages(template)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Revision == entries[j].Revision {
+			return entries[i].CreatedAt > entries[j].CreatedAt
+		}
+		return entries[i].Revision > entries[j].Revision
+	})
+	return entries, nil
+}
+
+// controllerRevisionTemplateByRevision returns the pod template recorded for the given revision.
+func controllerRevisionTemplateByRevision(ctx context.Context, client kubernetes.Interface, namespace string, owner types.UID, revision int64) (*corev1.PodTemplateSpec, error) {
+	revisions, err := ownedControllerRevisions(ctx, client, namespace, owner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		if revisions[i].Revision == revision {
+			return controllerRevisionTemplate(&revisions[i])
+		}
+	}
+	return nil, fmt.Errorf("revision %d not found", revision)
+}
+
+// rollbackTemplate prepares a recorded pod template to replace the live one.
+func rollbackTemplate(template *corev1.PodTemplateSpec, revision int64) corev1.PodTemplateSpec {
+	out := *template.DeepCopy()
+	if out.Annotations == nil {
+		out.Annotations = map[string]string{}
+	}
+	out.Annotations["devsys.dev/rollback-revision"] = fmt.Sprintf("%d", revision)
+	return out
+}
+
+// rollbackStatefulSet restores the pod template of a StatefulSet from a ControllerRevision.
+// A rolling update partition is reset so the rollback reaches every ordinal instead of only
+// those at or above the partition; with the OnDelete strategy pods pick up the restored
+// template when they are next deleted.
+func rollbackStatefulSet(ctx context.Context, client kubernetes.Interface, namespace, name string, revision int64) error {
+	sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	template, err := controllerRevisionTemplateByRevision(ctx, client, namespace, sts.UID, revision)
+	if err != nil {
+		return err
+	}
+	sts.Spec.Template = rollbackTemplate(template, revision)
+	if ru := sts.Spec.UpdateStrategy.RollingUpdate; sts.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType &&
+		ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+		partition := int32(0)
+		ru.Partition = &partition
+	}
+	_, err = client.AppsV1().StatefulSets(namespace).Update(ctx, sts, metav1.UpdateOptions{})
+	return err
+}
+
+// rollbackDaemonSet restores the pod template of a DaemonSet from a ControllerRevision.
+func rollbackDaemonSet(ctx context.Context, client kubernetes.Interface, namespace, name string, revision int64) error {
+	ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	template, err := controllerRevisionTemplateByRevision(ctx, client, namespace, ds.UID, revision)
+	if err != nil {
+		return err
+	}
+	ds.Spec.Template = rollbackTemplate(template, revision)
+	_, err = client.AppsV1().DaemonSets(namespace).Update(ctx, ds, metav1.UpdateOptions{})
+	return err
+}
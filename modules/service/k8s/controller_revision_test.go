@@ -0,0 +1,157 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// controllerRevision returns a revision of the workload with the given UID, recording a pod
+// template that runs image the way the StatefulSet and DaemonSet controllers store it.
+func controllerRevision(name string, owner types.UID, revision int64, image string) *appsv1.ControllerRevision {
+	data := fmt.Sprintf(`{"spec":{"template":{"metadata":{"labels":{"app":"web"}},"spec":{"containers":[{"name":"web","image":%q}]}}}}`, image)
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			OwnerReferences:   []metav1.OwnerReference{{UID: owner, Name: "web"}},
+			CreationTimestamp: metav1.Unix(1700000000+revision, 0),
+		},
+		Revision: revision,
+		Data:     runtime.RawExtension{Raw: []byte(data)},
+	}
+}
+
+// newStatefulSetClient returns a fake clientset holding the StatefulSet web at its third
+// revision, its three revisions and a revision of another workload.
+func newStatefulSetClient(strategy appsv1.StatefulSetUpdateStrategy) *fake.Clientset {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "sts-uid"}}
+	sts.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "web:3"}}
+	sts.Spec.UpdateStrategy = strategy
+	return fake.NewClientset(
+		sts,
+		controllerRevision("web-1", "sts-uid", 1, "web:1"),
+		controllerRevision("web-3", "sts-uid", 3, "web:3"),
+		controllerRevision("web-2", "sts-uid", 2, "web:2"),
+		controllerRevision("other-9", "other-uid", 9, "other:9"),
+	)
+}
+
+func rollingUpdate(partition int32) appsv1.StatefulSetUpdateStrategy {
+	return appsv1.StatefulSetUpdateStrategy{
+		Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+	}
+}
+
+func TestControllerRevisionHistory(t *testing.T) {
+	client := newStatefulSetClient(rollingUpdate(0))
+
+	entries, err := controllerRevisionHistoryEntries(context.Background(), client, "default", "sts-uid")
+	if err != nil {
+		t.Fatalf("controllerRevisionHistoryEntries: %v", err)
+	}
+	var revisions []int64
+	for _, entry := range entries {
+		revisions = append(revisions, entry.Revision)
+	}
+	if !slices.Equal(revisions, []int64{3, 2, 1}) {
+		t.Fatalf("revisions = %v, want the owned ones newest first", revisions)
+	}
+	first := entries[0]
+	if first.Source != "web-3" || !slices.Equal(first.Images, []string{"web:3"}) || first.CreatedAt != 1700000003 {
+		t.Errorf("entry = %+v, want web-3 running web:3", first)
+	}
+}
+
+func TestRollbackStatefulSet(t *testing.T) {
+	ctx := context.Background()
+	client := newStatefulSetClient(rollingUpdate(2))
+
+	if err := rollbackStatefulSet(ctx, client, "default", "web", 1); err != nil {
+		t.Fatalf("rollbackStatefulSet: %v", err)
+	}
+	sts, err := client.AppsV1().StatefulSets("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sts.Spec.Template.Spec.Containers[0].Image; got != "web:1" {
+		t.Errorf("image = %s, want the one of revision 1", got)
+	}
+	if got := sts.Spec.Template.Annotations["devsys.dev/rollback-revision"]; got != "1" {
+		t.Errorf("rollback annotation = %q, want 1", got)
+	}
+	if got := *sts.Spec.UpdateStrategy.RollingUpdate.Partition; got != 0 {
+		t.Errorf("partition = %d, want it reset so every ordinal rolls back", got)
+	}
+}
+
+func TestRollbackStatefulSetOnDelete(t *testing.T) {
+	ctx := context.Background()
+	client := newStatefulSetClient(appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType})
+
+	if err := rollbackStatefulSet(ctx, client, "default", "web", 2); err != nil {
+		t.Fatalf("rollbackStatefulSet: %v", err)
+	}
+	sts, err := client.AppsV1().StatefulSets("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sts.Spec.Template.Spec.Containers[0].Image; got != "web:2" {
+		t.Errorf("image = %s, want the one of revision 2", got)
+	}
+	if sts.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType || sts.Spec.UpdateStrategy.RollingUpdate != nil {
+		t.Errorf("strategy = %+v, want OnDelete kept", sts.Spec.UpdateStrategy)
+	}
+}
+
+func TestRollbackStatefulSetUnknownRevision(t *testing.T) {
+	ctx := context.Background()
+	client := newStatefulSetClient(rollingUpdate(0))
+
+	// revision 9 belongs to another workload
+	if err := rollbackStatefulSet(ctx, client, "default", "web", 9); err == nil {
+		t.Fatalf("rollbackStatefulSet to a revision of another workload succeeded")
+	}
+	sts, err := client.AppsV1().StatefulSets("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sts.Spec.Template.Spec.Containers[0].Image; got != "web:3" {
+		t.Errorf("image = %s, want the StatefulSet untouched", got)
+	}
+}
+
+func TestRollbackDaemonSet(t *testing.T) {
+	ctx := context.Background()
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default", UID: "ds-uid"}}
+	ds.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "agent:2"}}
+	client := fake.NewClientset(
+		ds,
+		controllerRevision("agent-1", "ds-uid", 1, "agent:1"),
+		controllerRevision("agent-2", "ds-uid", 2, "agent:2"),
+	)
+
+	entries, err := controllerRevisionHistoryEntries(ctx, client, "default", "ds-uid")
+	if err != nil || len(entries) != 2 || entries[0].Revision != 2 {
+		t.Fatalf("history = %+v, %v, want revisions 2 and 1", entries, err)
+	}
+	if err := rollbackDaemonSet(ctx, client, "default", "agent", 1); err != nil {
+		t.Fatalf("rollbackDaemonSet: %v", err)
+	}
+	got, err := client.AppsV1().DaemonSets("default").Get(ctx, "agent", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := got.Spec.Template.Spec.Containers[0].Image; image != "agent:1" || got.Spec.Template.Annotations["devsys.dev/rollback-revision"] != "1" {
+		t.Errorf("template = %+v, want revision 1 restored", got.Spec.Template)
+	}
+}
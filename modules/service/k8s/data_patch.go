@@ -0,0 +1,179 @@
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrDataPatchInvalid is returned for data patches with invalid keys or values.
+var ErrDataPatchInvalid = errors.New("data patch is invalid")
+
+// PatchConfigMapData sets and deletes keys of a ConfigMap; a nil value deletes the key. The
+// diff is taken against the object read for the update, which fails on a conflicting write
+// in between. With dryRun only the diff is returned.
+func (s *Service) PatchConfigMapData(ctx context.Context, clusterID int64, namespace, name string, changes map[string]*string, dryRun bool) (*model.KubernetesDataDiff, error) {
+	if err := validateDataChanges(changes); err != nil {
+		return nil, err
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for key := range changes {
+		if _, binary := cm.BinaryData[key]; binary {
+			return nil, fmt.Errorf("%w: key %q holds binary data", ErrDataPatchInvalid, key)
+		}
+	}
+
+	data, diff := applyDataChanges(cm.Data, changes, false)
+	diff.Kind, diff.Namespace, diff.Name, diff.DryRun = "ConfigMap", namespace, name, dryRun
+	if dryRun || diffEmpty(diff) {
+		return diff, nil
+	}
+	cm.Data = data
+	if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return nil, err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sDataPatch, clusterID, namespace, "configmaps", name, dataDiffSummary(diff))
+	return diff, nil
+}
+
+// PatchSecretData sets and deletes keys of a Secret like PatchConfigMapData. Values are plain
+// text, or base64 encoded with encoded set. Values in the diff are redacted.
+func (s *Service) PatchSecretData(ctx context.Context, clusterID int64, namespace, name string, changes map[string]*string, encoded, dryRun bool) (*model.KubernetesDataDiff, error) {
+	if err := validateDataChanges(changes); err != nil {
+		return nil, err
+	}
+	plain := make(map[string]*string, len(changes))
+	for key, value := range changes {
+		if value == nil || !encoded {
+			plain[key] = value
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(*value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: value of key %q is not valid base64", ErrDataPatchInvalid, key)
+		}
+		text := string(decoded)
+		plain[key] = &text
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		current[key] = string(value)
+	}
+	data, diff := applyDataChanges(current, plain, true)
+	diff.Kind, diff.Namespace, diff.Name, diff.DryRun = "Secret", namespace, name, dryRun
+	if dryRun || diffEmpty(diff) {
+		return diff, nil
+	}
+	secret.Data = make(map[string][]byte, len(data))
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	// stringData would be merged over data again on the server
+	secret.StringData = nil
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return nil, err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sDataPatch, clusterID, namespace, "secrets", name, dataDiffSummary(diff))
+	return diff, nil
+}
+
+func validateDataChanges(changes map[string]*string) error {
+	if len(changes) == 0 {
+		return fmt.Errorf("%w: no keys to change", ErrDataPatchInvalid)
+	}
+	for key := range changes {
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return fmt.Errorf("%w: key %q: %s", ErrDataPatchInvalid, key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// applyDataChanges returns current with changes applied and the diff between both, keys in
+// order. With redact the diff holds the mask instead of values.
+func applyDataChanges(current map[string]string, changes map[string]*string, redact bool) (map[string]string, *model.KubernetesDataDiff) {
+	data := make(map[string]string, len(current)+len(changes))
+	for key, value := range current {
+		data[key] = value
+	}
+	shown := func(value string) *string {
+		if redact {
+			value = model.DefaultSecretMask
+		}
+		return &value
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	diff := &model.KubernetesDataDiff{
+		Added:   []model.KubernetesDataChange{},
+		Changed: []model.KubernetesDataChange{},
+		Removed: []model.KubernetesDataChange{},
+	}
+	for _, key := range keys {
+		value := changes[key]
+		old, exists := current[key]
+		switch {
+		case value == nil && exists:
+			delete(data, key)
+			diff.Removed = append(diff.Removed, model.KubernetesDataChange{Key: key, Old: shown(old)})
+		case value == nil:
+		case !exists:
+			data[key] = *value
+			diff.Added = append(diff.Added, model.KubernetesDataChange{Key: key, New: shown(*value)})
+		case old != *value:
+			data[key] = *value
+			diff.Changed = append(diff.Changed, model.KubernetesDataChange{Key: key, Old: shown(old), New: shown(*value)})
+		}
+	}
+	return data, diff
+}
+
+func diffEmpty(diff *model.KubernetesDataDiff) bool {
+	return len(diff.Added) == 0 && len(diff.Changed) == 0 && len(diff.Removed) == 0
+}
+
+// dataDiffSummary lists the changed keys of diff for the audit trail, without values.
+func dataDiffSummary(diff *model.KubernetesDataDiff) map[string]interface{} {
+	keys := func(changes []model.KubernetesDataChange) []string {
+		result := make([]string, 0, len(changes))
+		for _, change := range changes {
+			result = append(result, change.Key)
+		}
+		return result
+	}
+	return map[string]interface{}{
+		"added":   keys(diff.Added),
+		"changed": keys(diff.Changed),
+		"removed": keys(diff.Removed),
+	}
+}
@@ -0,0 +1,448 @@
+package k8s
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"k8s.io/client-go/tools/remotecommand"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
+)
+
+// ErrExecSessionNotFound is returned for exec sessions that do not exist or whose cluster is
+// outside the scope of the caller.
+var ErrExecSessionNotFound = errors.New("exec session not found")
+
+const (
+	defaultRecordingInlineMax = 64 << 10
+	// recordingBuffer is how many chunks may wait for the recording writer; chunks recorded
+	// while it is full are counted as dropped so the terminal never waits on the disk.
+	recordingBuffer        = 1024
+	recordingFlushInterval = time.Second
+	// recordingFinishTimeout bounds the database update closing a session, which runs after
+	// the request context is gone.
+	recordingFinishTimeout = 10 * time.Second
+
+	castInput  = "i"
+	castOutput = "o"
+	castResize = "r"
+)
+
+// WithExecRecording records interactive exec sessions as asciinema casts. Recordings up to
+// inlineMax bytes are kept in the database and larger ones in dir.
+func WithExecRecording(dir string, inlineMax int64) Option {
+	return func(s *Service) {
+		s.recordingDir = strings.TrimSpace(dir)
+		s.recordingInlineMax = inlineMax
+	}
+}
+
+func (s *Service) execRecordingPath(session *model.ExecSession) string {
+	root := s.recordingDir
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "devsys-exec-recordings")
+	}
+	day := time.Unix(session.Started, 0).UTC().Format("2006-01-02")
+	return filepath.Join(root, day, strconv.FormatInt(session.ID, 10)+".cast")
+}
+
+// ListExecSessions lists exec sessions on clusters in the scope of ctx, newest first.
+func (s *Service) ListExecSessions(ctx context.Context, opts model.ListOptions, filter model.ExecSessionFilter) ([]*model.ExecSession, int64, error) {
+	if s.db == nil {
+		return nil, 0, errTargetStoreUnavailable
+	}
+	page, perPage := opts.Page, opts.PerPage
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+
+	var (
+		sessions []*model.ExecSession
+		total    int64
+	)
+	err := s.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Model(&model.ExecSession{})
+		if !tenancy.FromContext(ctx).All {
+			clusters := tenancy.Filter(ctx, tx.Model(&model.Certificate{}).Select("id"), "org_id")
+			query = query.Where("cluster_id IN (?)", clusters)
+		}
+		if filter.ClusterID > 0 {
+			query = query.Where("cluster_id = ?", filter.ClusterID)
+		}
+		if namespace := strings.TrimSpace(filter.Namespace); namespace != "" {
+			query = query.Where("namespace = ?", namespace)
+		}
+		if pod := strings.TrimSpace(filter.Pod); pod != "" {
+			query = query.Where("pod = ?", pod)
+		}
+		if user := strings.TrimSpace(filter.User); user != "" {
+			query = query.Where("login = ?", user)
+		}
+		if filter.Since > 0 {
+			query = query.Where("started >= ?", filter.Since)
+		}
+		if filter.Until > 0 {
+			query = query.Where("started <= ?", filter.Until)
+		}
+		if err := query.Count(&total).Error; err != nil {
+			return err
+		}
+		return query.Omit("recording").
+			Order("started DESC, id DESC").
+			Offset((page - 1) * perPage).
+			Limit(perPage).
+			Find(&sessions).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return sessions, total, nil
+}
+
+// OpenExecRecording returns the session and a reader of its cast. The recording of a session
+// still open holds the events written so far.
+func (s *Service) OpenExecRecording(ctx context.Context, id int64) (*model.ExecSession, io.ReadCloser, error) {
+	if s.db == nil {
+		return nil, nil, errTargetStoreUnavailable
+	}
+	var session model.ExecSession
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("id = ?", id).Take(&session).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrExecSessionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.ensureClusterInScope(ctx, session.ClusterID); err != nil {
+		if errors.Is(err, ErrClusterNotFound) {
+			return nil, nil, ErrExecSessionNotFound
+		}
+		return nil, nil, err
+	}
+	if session.Storage == model.ExecRecordingInline {
+		recording := session.Recording
+		session.Recording = nil
+		return &session, io.NopCloser(bytes.NewReader(recording)), nil
+	}
+	file, err := os.Open(session.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: recording file is missing", ErrExecSessionNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &session, file, nil
+}
+
+type castEvent struct {
+	at   time.Duration
+	kind string
+	data []byte
+}
+
+// execRecorder writes the cast of one exec session. Streams hand it chunks through record,
+// which never blocks; a goroutine encodes them into a buffered file flushed every second.
+type execRecorder struct {
+	svc     *Service
+	session *model.ExecSession
+	file    *os.File
+	started time.Time
+	events  chan castEvent
+	done    chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	input   int64
+	output  int64
+	dropped int64
+
+	// size and writeErr belong to the writer goroutine until done is closed.
+	size     int64
+	writeErr error
+}
+
+// startExecRecording opens the session record and its cast file. It returns nil without a
+// store; a session that cannot be recorded is refused.
+func (s *Service) startExecRecording(ctx context.Context, clusterID int64, req model.KubernetesPodExecRequest, container string, command []string) (*execRecorder, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+	started := time.Now()
+	session := &model.ExecSession{
+		ClusterID: clusterID,
+		Namespace: req.Namespace,
+		Pod:       req.Name,
+		Container: container,
+		Command:   strings.Join(command, " "),
+		User:      audit.ActorFromContext(ctx),
+		Started:   started.Unix(),
+		Storage:   model.ExecRecordingFile,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).Create(session).Error; err != nil {
+			return err
+		}
+		session.Path = s.execRecordingPath(session)
+		return tx.WithContext(ctx).Model(session).Update("path", session.Path).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create exec session: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(session.Path), 0o750); err != nil {
+		return nil, fmt.Errorf("create exec recording directory: %w", err)
+	}
+	file, err := os.OpenFile(session.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("create exec recording: %w", err)
+	}
+
+	rec := &execRecorder{
+		svc:     s,
+		session: session,
+		file:    file,
+		started: started,
+		events:  make(chan castEvent, recordingBuffer),
+		done:    make(chan struct{}),
+	}
+	go rec.run(command)
+	return rec, nil
+}
+
+// wrap tees the streams of the session into the recording; nil streams stay nil.
+func (r *execRecorder) wrap(stdin io.Reader, stdout, stderr io.Writer, sizeQueue remotecommand.TerminalSizeQueue) (io.Reader, io.Writer, io.Writer, remotecommand.TerminalSizeQueue) {
+	if stdin != nil {
+		stdin = &recordingReader{r: stdin, rec: r}
+	}
+	if stdout != nil {
+		stdout = &recordingWriter{w: stdout, rec: r}
+	}
+	if stderr != nil {
+		stderr = &recordingWriter{w: stderr, rec: r}
+	}
+	if sizeQueue != nil {
+		sizeQueue = &recordingSizeQueue{queue: sizeQueue, rec: r}
+	}
+	return stdin, stdout, stderr, sizeQueue
+}
+
+func (r *execRecorder) record(kind string, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	switch kind {
+	case castInput:
+		r.input += int64(len(p))
+	case castOutput:
+		r.output += int64(len(p))
+	}
+	event := castEvent{at: time.Since(r.started), kind: kind, data: append([]byte(nil), p...)}
+	select {
+	case r.events <- event:
+	default:
+		r.dropped++
+	}
+}
+
+func (r *execRecorder) run(command []string) {
+	defer close(r.done)
+	w := bufio.NewWriter(r.file)
+	shell := ""
+	if len(command) > 0 {
+		shell = command[0]
+	}
+	r.writeLine(w, map[string]interface{}{
+		"version":   2,
+		"width":     80,
+		"height":    24,
+		"timestamp": r.session.Started,
+		"title":     fmt.Sprintf("%s/%s/%s", r.session.Namespace, r.session.Pod, r.session.Container),
+		"env":       map[string]string{"SHELL": shell, "TERM": "xterm"},
+	})
+
+	// a chunk may end inside a multi-byte character; its tail waits for the next chunk
+	pending := map[string][]byte{}
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-r.events:
+			if !ok {
+				for kind, rest := range pending {
+					r.writeEvent(w, time.Since(r.started), kind, rest)
+				}
+				if err := w.Flush(); err != nil && r.writeErr == nil {
+					r.writeErr = err
+				}
+				return
+			}
+			data := event.data
+			if event.kind != castResize {
+				data = append(pending[event.kind], data...)
+				data, pending[event.kind] = splitIncompleteRune(data)
+			}
+			r.writeEvent(w, event.at, event.kind, data)
+		case <-ticker.C:
+			if err := w.Flush(); err != nil && r.writeErr == nil {
+				r.writeErr = err
+			}
+		}
+	}
+}
+
+func (r *execRecorder) writeEvent(w *bufio.Writer, at time.Duration, kind string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	r.writeLine(w, []interface{}{float64(at.Microseconds()) / 1e6, kind, string(data)})
+}
+
+func (r *execRecorder) writeLine(w *bufio.Writer, value interface{}) {
+	if r.writeErr != nil {
+		return
+	}
+	line, err := json.Marshal(value)
+	if err != nil {
+		r.writeErr = err
+		return
+	}
+	n, err := w.Write(append(line, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		r.writeErr = err
+	}
+}
+
+// finish closes the recording and the session record. It runs however the stream ended,
+// including a dropped websocket, so it does not use the request context.
+func (r *execRecorder) finish() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.events)
+	r.mu.Unlock()
+	<-r.done
+
+	session := r.session
+	if err := r.file.Close(); err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	if r.writeErr != nil {
+		log.Error().Err(r.writeErr).Int64("session_id", session.ID).Msg("exec recording incomplete")
+	}
+	updates := map[string]interface{}{
+		"ended":        time.Now().Unix(),
+		"input_bytes":  r.input,
+		"output_bytes": r.output,
+		"dropped":      r.dropped,
+		"size":         r.size,
+	}
+	inlineMax := r.svc.recordingInlineMax
+	if inlineMax <= 0 {
+		inlineMax = defaultRecordingInlineMax
+	}
+	inline := false
+	if r.writeErr == nil && r.size <= inlineMax {
+		if recording, err := os.ReadFile(session.Path); err == nil {
+			updates["storage"] = model.ExecRecordingInline
+			updates["recording"] = recording
+			updates["path"] = ""
+			inline = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordingFinishTimeout)
+	defer cancel()
+	err := r.svc.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Model(&model.ExecSession{}).Where("id = ?", session.ID).Updates(updates).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Int64("session_id", session.ID).Msg("failed to close exec session")
+		return
+	}
+	if inline {
+		if err := os.Remove(session.Path); err != nil {
+			log.Warn().Err(err).Str("path", session.Path).Msg("failed to remove inlined exec recording")
+		}
+	}
+}
+
+// splitIncompleteRune splits off a trailing partial UTF-8 character.
+func splitIncompleteRune(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if utf8.FullRune(b[i:]) {
+			return b, nil
+		}
+		return b[:i], append([]byte(nil), b[i:]...)
+	}
+	return b, nil
+}
+
+type recordingReader struct {
+	r   io.Reader
+	rec *execRecorder
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.rec.record(castInput, p[:n])
+	return n, err
+}
+
+type recordingWriter struct {
+	w   io.Writer
+	rec *execRecorder
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.rec.record(castOutput, p[:n])
+	return n, err
+}
+
+type recordingSizeQueue struct {
+	queue remotecommand.TerminalSizeQueue
+	rec   *execRecorder
+}
+
+func (q *recordingSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.queue.Next()
+	if size != nil {
+		q.rec.record(castResize, []byte(fmt.Sprintf("%dx%d", size.Width, size.Height)))
+	}
+	return size
+}
@@ -0,0 +1,139 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (s *Service) helmStorage(ctx context.Context, clusterID int64) (*helmSecretStorage, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return &helmSecretStorage{client: client}, nil
+}
+
+// ListReleases returns the newest revision of every Helm release in namespace, or in all
+// namespaces when namespace is empty.
+func (s *Service) ListReleases(ctx context.Context, clusterID int64, namespace string) ([]model.KubernetesHelmRelease, error) {
+	storage, err := s.helmStorage(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := storage.latest(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]model.KubernetesHelmRelease, 0, len(releases))
+	for _, rel := range releases {
+		result = append(result, helmReleaseSummary(rel))
+	}
+	return result, nil
+}
+
+// ReleaseHistory returns the stored revisions of a release, oldest first. Helm prunes old
+// revisions according to its --history-max setting, so the first may not be revision 1.
+func (s *Service) ReleaseHistory(ctx context.Context, clusterID int64, namespace, name string) ([]model.KubernetesHelmRelease, error) {
+	storage, err := s.helmStorage(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := storage.history(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]model.KubernetesHelmRelease, 0, len(releases))
+	for _, rel := range releases {
+		result = append(result, helmReleaseSummary(rel))
+	}
+	return result, nil
+}
+
+// GetReleaseValues returns the values a release revision was installed with, the newest
+// revision when revision is 0. With all set the chart defaults are included, as
+// `helm get values --all` does.
+func (s *Service) GetReleaseValues(ctx context.Context, clusterID int64, namespace, name string, revision int, all bool) (*model.KubernetesHelmReleaseValues, error) {
+	storage, err := s.helmStorage(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := storage.get(ctx, namespace, name, revision)
+	if err != nil {
+		return nil, err
+	}
+	values := rel.Config
+	if all {
+		values = coalesceHelmValues(rel.Config, rel.Chart.Values)
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return &model.KubernetesHelmReleaseValues{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		All:       all,
+		Values:    values,
+	}, nil
+}
+
+// GetReleaseManifest returns the manifest rendered for a release revision, the newest
+// revision when revision is 0.
+func (s *Service) GetReleaseManifest(ctx context.Context, clusterID int64, namespace, name string, revision int) (*model.KubernetesHelmReleaseManifest, error) {
+	storage, err := s.helmStorage(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := storage.get(ctx, namespace, name, revision)
+	if err != nil {
+		return nil, err
+	}
+	return &model.KubernetesHelmReleaseManifest{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		Manifest:  rel.Manifest,
+	}, nil
+}
+
+func helmReleaseSummary(rel *helmRelease) model.KubernetesHelmRelease {
+	summary := model.KubernetesHelmRelease{
+		Name:         rel.Name,
+		Namespace:    rel.Namespace,
+		Revision:     rel.Version,
+		Status:       rel.Info.Status,
+		Chart:        rel.Chart.Metadata.Name,
+		ChartVersion: rel.Chart.Metadata.Version,
+		AppVersion:   rel.Chart.Metadata.AppVersion,
+		Description:  rel.Info.Description,
+	}
+	if deployed, err := time.Parse(time.RFC3339, rel.Info.LastDeployed); err == nil {
+		summary.Updated = deployed.Unix()
+	}
+	return summary
+}
+
+// coalesceHelmValues merges values over the chart defaults: nested maps merge key by key,
+// any other value replaces the default, and a null value removes the default key.
+func coalesceHelmValues(values, defaults map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(defaults)+len(values))
+	for key, value := range defaults {
+		result[key] = value
+	}
+	for key, value := range values {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		nested, isMap := value.(map[string]interface{})
+		base, baseIsMap := result[key].(map[string]interface{})
+		if isMap && baseIsMap {
+			result[key] = coalesceHelmValues(nested, base)
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
@@ -0,0 +1,210 @@
+package k8s
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrHelmReleaseNotFound is returned for releases, or release revisions, without a record.
+var ErrHelmReleaseNotFound = errors.New("helm release not found")
+
+// Helm v3 stores every revision of a release in a secret of this type named
+// sh.helm.release.v1.<name>.v<revision> and labelled with owner=helm, name, version and status.
+const (
+	helmReleaseSecretType = corev1.SecretType("helm.sh/release.v1")
+	helmReleaseDataKey    = "release"
+	helmOwnerLabel        = "owner"
+	helmOwnerValue        = "helm"
+	helmNameLabel         = "name"
+	helmVersionLabel      = "version"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// helmRelease mirrors the parts of the release record Helm writes that devsys reads.
+type helmRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Version   int    `json:"version"`
+	Info      struct {
+		LastDeployed string `json:"last_deployed"`
+		Description  string `json:"description"`
+		Status       string `json:"status"`
+	} `json:"info"`
+	Chart struct {
+		Metadata struct {
+			Name       string `json:"name"`
+			Version    string `json:"version"`
+			AppVersion string `json:"appVersion"`
+		} `json:"metadata"`
+		Values map[string]interface{} `json:"values"`
+	} `json:"chart"`
+	Config   map[string]interface{} `json:"config"`
+	Manifest string                 `json:"manifest"`
+}
+
+// helmSecretStorage reads release records kept by the secrets driver, Helm's default. Writes
+// go through the same records: a new revision is one more secret next to the others.
+type helmSecretStorage struct {
+	client kubernetes.Interface
+}
+
+func helmReleaseSecretName(name string, revision int) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, revision)
+}
+
+// list returns the release secrets of namespace, all namespaces when empty, restricted to the
+// release name when set.
+func (st helmSecretStorage) list(ctx context.Context, namespace, name string) ([]corev1.Secret, error) {
+	selector := labels.Set{helmOwnerLabel: helmOwnerValue}
+	if name != "" {
+		selector[helmNameLabel] = name
+	}
+	list, err := st.client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.AsSelector().String(),
+		FieldSelector: fields.OneTermEqualSelector("type", string(helmReleaseSecretType)).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// latest returns the newest revision of every release in namespace, all namespaces when empty.
+func (st helmSecretStorage) latest(ctx context.Context, namespace string) ([]*helmRelease, error) {
+	secrets, err := st.list(ctx, namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	newest := make(map[string]*corev1.Secret)
+	for i := range secrets {
+		secret := &secrets[i]
+		key := secret.Namespace + "/" + secret.Labels[helmNameLabel]
+		if current, ok := newest[key]; !ok || secretRevision(secret) > secretRevision(current) {
+			newest[key] = secret
+		}
+	}
+	releases := make([]*helmRelease, 0, len(newest))
+	for _, secret := range newest {
+		rel, err := decodeHelmReleaseSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].Namespace == releases[j].Namespace {
+			return releases[i].Name < releases[j].Name
+		}
+		return releases[i].Namespace < releases[j].Namespace
+	})
+	return releases, nil
+}
+
+// history returns every stored revision of the release, oldest first.
+func (st helmSecretStorage) history(ctx context.Context, namespace, name string) ([]*helmRelease, error) {
+	secrets, err := st.list(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, ErrHelmReleaseNotFound
+	}
+	releases := make([]*helmRelease, 0, len(secrets))
+	for i := range secrets {
+		rel, err := decodeHelmReleaseSecret(&secrets[i])
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].Version < releases[j].Version })
+	return releases, nil
+}
+
+// get returns one revision of the release, the newest when revision is 0.
+func (st helmSecretStorage) get(ctx context.Context, namespace, name string, revision int) (*helmRelease, error) {
+	if revision <= 0 {
+		secrets, err := st.list(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		var newest *corev1.Secret
+		for i := range secrets {
+			if newest == nil || secretRevision(&secrets[i]) > secretRevision(newest) {
+				newest = &secrets[i]
+			}
+		}
+		if newest == nil {
+			return nil, ErrHelmReleaseNotFound
+		}
+		return decodeHelmReleaseSecret(newest)
+	}
+	secret, err := st.client.CoreV1().Secrets(namespace).Get(ctx, helmReleaseSecretName(name, revision), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) || (err == nil && secret.Type != helmReleaseSecretType) {
+		return nil, ErrHelmReleaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeHelmReleaseSecret(secret)
+}
+
+func secretRevision(secret *corev1.Secret) int {
+	revision, _ := strconv.Atoi(secret.Labels[helmVersionLabel])
+	return revision
+}
+
+func decodeHelmReleaseSecret(secret *corev1.Secret) (*helmRelease, error) {
+	rel, err := decodeHelmRelease(secret.Data[helmReleaseDataKey])
+	if err != nil {
+		return nil, fmt.Errorf("decode helm release secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	if rel.Namespace == "" {
+		rel.Namespace = secret.Namespace
+	}
+	return rel, nil
+}
+
+// decodeHelmRelease reverses the encoding of the secrets driver: JSON, gzipped, then base64
+// encoded once more on top of the encoding of secret data. Records written uncompressed by
+// old Helm 3 releases are accepted too.
+func decodeHelmRelease(data []byte) (*helmRelease, error) {
+	if len(data) == 0 {
+		return nil, errors.New("release data is empty")
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		if raw, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	var rel helmRelease
+	if err := json.Unmarshal(raw, &rel); err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
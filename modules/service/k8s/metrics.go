@@ -0,0 +1,36 @@
+package k8s
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/client-go/transport"
+
+	"github.com/thepenn/devsys/internal/metrics"
+)
+
+// instrumentRoundTripper records the latency and status code of every API server request
+// made for cluster.
+func instrumentRoundTripper(registry *metrics.Registry, cluster string) transport.WrapperFunc {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &metricsRoundTripper{next: rt, registry: registry, cluster: cluster}
+	}
+}
+
+type metricsRoundTripper struct {
+	next     http.RoundTripper
+	registry *metrics.Registry
+	cluster  string
+}
+
+func (t *metricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.registry.ObserveK8sRequest(t.cluster, req.Method, code, time.Since(start))
+	return resp, err
+}
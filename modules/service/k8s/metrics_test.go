@@ -0,0 +1,47 @@
+package k8s
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/metrics"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestInstrumentRoundTripperRecordsLatency(t *testing.T) {
+	registry := metrics.New()
+	rt := instrumentRoundTripper(registry, "prod")(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/down") {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	}))
+
+	if resp, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "https://k8s.example/api/v1/pods/missing", nil)); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("RoundTrip = %v, %v, want the response of the wrapped transport", resp, err)
+	}
+	if _, err := rt.RoundTrip(httptest.NewRequest(http.MethodDelete, "https://k8s.example/down", nil)); err == nil {
+		t.Fatalf("RoundTrip hid the error of the wrapped transport")
+	}
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`devsys_k8s_request_duration_seconds_count{cluster="prod",code="404",method="GET"} 1`,
+		`devsys_k8s_request_duration_seconds_count{cluster="prod",code="error",method="DELETE"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
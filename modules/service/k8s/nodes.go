@@ -0,0 +1,443 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	nodeRoleLabelPrefix = "node-role.kubernetes.io/"
+	// nodeEventLimit bounds the events GetNode returns.
+	nodeEventLimit = 20
+
+	defaultDrainTimeout = 5 * time.Minute
+	maxDrainTimeout     = time.Hour
+)
+
+// drainRetryInterval paces evictions refused by a PodDisruptionBudget and the checks for
+// evicted pods to go away.
+var drainRetryInterval = 5 * time.Second
+
+// ErrNodeDrainInvalid is returned for drains without confirmation or with invalid options.
+var ErrNodeDrainInvalid = errors.New("node drain is invalid")
+
+// ListNodes returns the nodes of a cluster by name with the number of unfinished pods on each.
+func (s *Service) ListNodes(ctx context.Context, clusterID int64) ([]model.KubernetesNode, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return listNodes(ctx, client)
+}
+
+// GetNode returns a node with its conditions, the pods scheduled on it and its latest events,
+// newest first.
+func (s *Service) GetNode(ctx context.Context, clusterID int64, name string) (*model.KubernetesNodeDetails, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return nodeDetails(ctx, client, name)
+}
+
+func listNodes(ctx context.Context, client kubernetes.Interface) ([]model.KubernetesNode, error) {
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	if err != nil {
+		return nil, err
+	}
+	podCounts := make(map[string]int, len(nodes.Items))
+	for i := range pods.Items {
+		if node := pods.Items[i].Spec.NodeName; node != "" {
+			podCounts[node]++
+		}
+	}
+	items := make([]model.KubernetesNode, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		summary := buildNodeSummary(&nodes.Items[i])
+		summary.PodCount = podCounts[summary.Name]
+		items = append(items, summary)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func nodeDetails(ctx context.Context, client kubernetes.Interface, name string) (*model.KubernetesNodeDetails, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := listNodePods(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+	events, err := client.CoreV1().Events(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Node,involvedObject.name=%s", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	details := &model.KubernetesNodeDetails{
+		KubernetesNode:   buildNodeSummary(node),
+		Labels:           node.Labels,
+		OSImage:          node.Status.NodeInfo.OSImage,
+		KernelVersion:    node.Status.NodeInfo.KernelVersion,
+		ContainerRuntime: node.Status.NodeInfo.ContainerRuntimeVersion,
+		Architecture:     node.Status.NodeInfo.Architecture,
+		Conditions:       make([]model.KubernetesCondition, 0, len(node.Status.Conditions)),
+		Pods:             make([]model.KubernetesPodRow, 0, len(pods)),
+		Events:           make([]model.KubernetesEvent, 0, len(events.Items)),
+	}
+	for _, cond := range node.Status.Conditions {
+		details.Conditions = append(details.Conditions, model.KubernetesCondition{
+			Type:               string(cond.Type),
+			Status:             string(cond.Status),
+			LastTransitionTime: cond.LastTransitionTime.Unix(),
+			Reason:             cond.Reason,
+			Message:            cond.Message,
+		})
+	}
+	for i := range pods {
+		if !podFinished(&pods[i]) {
+			details.PodCount++
+		}
+		details.Pods = append(details.Pods, buildPodRow(&pods[i]))
+	}
+	for i := range events.Items {
+		details.Events = append(details.Events, toKubernetesEvent(&events.Items[i]))
+	}
+	sort.SliceStable(details.Events, func(i, j int) bool {
+		return details.Events[i].LastTimestamp > details.Events[j].LastTimestamp
+	})
+	if len(details.Events) > nodeEventLimit {
+		details.Events = details.Events[:nodeEventLimit]
+	}
+	return details, nil
+}
+
+// CordonNode marks a node unschedulable, like `kubectl cordon`. Pods already running on it
+// stay.
+func (s *Service) CordonNode(ctx context.Context, clusterID int64, name string) (*model.KubernetesNode, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := setNodeUnschedulable(ctx, client, name, true)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sNodeCordon, clusterID, "", "nodes", name, nil)
+	return node, nil
+}
+
+// UncordonNode lets new pods be scheduled on a node again.
+func (s *Service) UncordonNode(ctx context.Context, clusterID int64, name string) (*model.KubernetesNode, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := setNodeUnschedulable(ctx, client, name, false)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sNodeUncordon, clusterID, "", "nodes", name, nil)
+	return node, nil
+}
+
+func setNodeUnschedulable(ctx context.Context, client kubernetes.Interface, name string, unschedulable bool) (*model.KubernetesNode, error) {
+	patch := []byte(`{"spec":{"unschedulable":null}}`)
+	if unschedulable {
+		patch = []byte(`{"spec":{"unschedulable":true}}`)
+	}
+	node, err := client.CoreV1().Nodes().Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	summary := buildNodeSummary(node)
+	return &summary, nil
+}
+
+// DrainNode cordons a node and evicts its pods through the eviction API, like `kubectl
+// drain`, reporting progress to emit. DaemonSet pods and static pods are skipped since their
+// controllers would put them straight back. Evictions a PodDisruptionBudget refuses are
+// retried until the drain times out; pods failing otherwise are listed in the result and the
+// drain goes on with the rest. It returns once every evicted pod is gone, after sending a
+// DONE event with the result. The node stays cordoned when the drain is cut short by ctx,
+// the timeout or a failing emit.
+func (s *Service) DrainNode(ctx context.Context, clusterID int64, name string, req model.KubernetesNodeDrainRequest, emit func(model.KubernetesNodeDrainEvent) error) (*model.KubernetesNodeDrainResult, error) {
+	if !req.Confirm {
+		return nil, fmt.Errorf("%w: draining a node evicts its pods and must be confirmed", ErrNodeDrainInvalid)
+	}
+	if req.GracePeriodSeconds != nil && *req.GracePeriodSeconds < 0 {
+		return nil, fmt.Errorf("%w: grace_period_seconds must not be negative", ErrNodeDrainInvalid)
+	}
+	timeout := defaultDrainTimeout
+	if req.TimeoutSeconds != 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout < 0 || timeout > maxDrainTimeout {
+			return nil, fmt.Errorf("%w: timeout_seconds must be between 1 and %d", ErrNodeDrainInvalid, int(maxDrainTimeout.Seconds()))
+		}
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := drainNode(ctx, client, name, req.GracePeriodSeconds, emit)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sNodeDrain, clusterID, "", "nodes", name, map[string]interface{}{
+		"evicted": len(result.Evicted),
+		"skipped": len(result.Skipped),
+		"failed":  result.Failed,
+	})
+	message := fmt.Sprintf("evicted %d pods, skipped %d", len(result.Evicted), len(result.Skipped))
+	if len(result.Failed) > 0 {
+		message += fmt.Sprintf(", failed to evict %d", len(result.Failed))
+	}
+	if err := emit(model.KubernetesNodeDrainEvent{Type: model.KubernetesDrainDone, Node: name, Message: message, Result: result}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// drainNode cordons a node, evicts its pods and waits for the evicted ones to go away.
+func drainNode(ctx context.Context, client kubernetes.Interface, name string, gracePeriodSeconds *int64, emit func(model.KubernetesNodeDrainEvent) error) (*model.KubernetesNodeDrainResult, error) {
+	if _, err := setNodeUnschedulable(ctx, client, name, true); err != nil {
+		return nil, err
+	}
+	if err := emit(model.KubernetesNodeDrainEvent{Type: model.KubernetesDrainCordoned, Node: name}); err != nil {
+		return nil, err
+	}
+	pods, err := listNodePods(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.KubernetesNodeDrainResult{Node: name, Evicted: []string{}, Skipped: []string{}, Failed: []string{}}
+	podEvent := func(eventType string, pod *corev1.Pod, message string) model.KubernetesNodeDrainEvent {
+		return model.KubernetesNodeDrainEvent{Type: eventType, Node: name, Namespace: pod.Namespace, Pod: pod.Name, Message: message}
+	}
+	evicting := make([]*corev1.Pod, 0, len(pods))
+	for i := range pods {
+		pod := &pods[i]
+		key := pod.Namespace + "/" + pod.Name
+		if reason := drainSkipReason(pod); reason != "" {
+			result.Skipped = append(result.Skipped, key)
+			if err := emit(podEvent(model.KubernetesDrainSkipped, pod, reason)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := emit(podEvent(model.KubernetesDrainEvicting, pod, "")); err != nil {
+			return nil, err
+		}
+		var emitErr error
+		err := evictPod(ctx, client, pod, gracePeriodSeconds, func(blocked error) error {
+			emitErr = emit(podEvent(model.KubernetesDrainBlocked, pod, blocked.Error()))
+			return emitErr
+		})
+		if emitErr != nil {
+			return nil, emitErr
+		}
+		if ctx.Err() != nil {
+			return nil, drainInterrupted(ctx)
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, key)
+			if err := emit(podEvent(model.KubernetesDrainFailed, pod, err.Error())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		evicting = append(evicting, pod)
+	}
+
+	// evicted pods take their grace period to terminate
+	for len(evicting) > 0 {
+		remaining := evicting[:0]
+		for _, pod := range evicting {
+			current, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			switch {
+			case k8serrors.IsNotFound(err) || (err == nil && current.UID != pod.UID):
+				result.Evicted = append(result.Evicted, pod.Namespace+"/"+pod.Name)
+				if err := emit(podEvent(model.KubernetesDrainEvicted, pod, "")); err != nil {
+					return nil, err
+				}
+			case err != nil && ctx.Err() != nil:
+				return nil, drainInterrupted(ctx)
+			default:
+				remaining = append(remaining, pod)
+			}
+		}
+		evicting = remaining
+		if len(evicting) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, drainInterrupted(ctx)
+		case <-time.After(drainRetryInterval):
+		}
+	}
+	return result, nil
+}
+
+// evictPod asks the eviction API to remove pod, retrying while a PodDisruptionBudget refuses
+// with 429 and calling blocked for each refusal. A pod already gone counts as evicted.
+func evictPod(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod, gracePeriodSeconds *int64, blocked func(error) error) error {
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		DeleteOptions: &metav1.DeleteOptions{
+			GracePeriodSeconds: gracePeriodSeconds,
+			Preconditions:      &metav1.Preconditions{UID: &pod.UID},
+		},
+	}
+	for {
+		err := client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+		switch {
+		case err == nil, k8serrors.IsNotFound(err):
+			return nil
+		case !k8serrors.IsTooManyRequests(err):
+			return err
+		}
+		if err := blocked(err); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainRetryInterval):
+		}
+	}
+}
+
+func drainInterrupted(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("drain timed out; the node stays cordoned")
+	}
+	return ctx.Err()
+}
+
+// drainSkipReason returns why a drain leaves pod alone, or "" when it is evicted.
+func drainSkipReason(pod *corev1.Pod) string {
+	if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+		return "static pod managed by the kubelet"
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "DaemonSet" {
+		return "managed by daemonset " + owner.Name
+	}
+	return ""
+}
+
+func listNodePods(ctx context.Context, client kubernetes.Interface, node string) ([]corev1.Pod, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + node,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		if pods.Items[i].Namespace != pods.Items[j].Namespace {
+			return pods.Items[i].Namespace < pods.Items[j].Namespace
+		}
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+	return pods.Items, nil
+}
+
+func podFinished(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func buildNodeSummary(node *corev1.Node) model.KubernetesNode {
+	summary := model.KubernetesNode{
+		Name:           node.Name,
+		Roles:          nodeRoles(node.Labels),
+		KubeletVersion: node.Status.NodeInfo.KubeletVersion,
+		Unschedulable:  node.Spec.Unschedulable,
+		Capacity:       nodeResources(node.Status.Capacity),
+		Allocatable:    nodeResources(node.Status.Allocatable),
+		Taints:         make([]model.KubernetesNodeTaint, 0, len(node.Spec.Taints)),
+		Created:        node.CreationTimestamp.Unix(),
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			summary.InternalIP = addr.Address
+			break
+		}
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			summary.Ready = cond.Status == corev1.ConditionTrue
+			if !summary.Ready {
+				summary.ReadyMessage = cond.Message
+			}
+		}
+	}
+	for _, taint := range node.Spec.Taints {
+		summary.Taints = append(summary.Taints, model.KubernetesNodeTaint{
+			Key:    taint.Key,
+			Value:  taint.Value,
+			Effect: string(taint.Effect),
+		})
+	}
+	return summary
+}
+
+// nodeRoles reads the roles of a node from its node-role.kubernetes.io/<role> labels and the
+// older kubernetes.io/role label.
+func nodeRoles(labels map[string]string) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	add := func(role string) {
+		if role = strings.TrimSpace(role); role != "" && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	for key := range labels {
+		if role, ok := strings.CutPrefix(key, nodeRoleLabelPrefix); ok {
+			add(role)
+		}
+	}
+	add(labels["kubernetes.io/role"])
+	sort.Strings(roles)
+	return roles
+}
+
+func nodeResources(list corev1.ResourceList) model.KubernetesNodeResources {
+	var resources model.KubernetesNodeResources
+	if q, ok := list[corev1.ResourceCPU]; ok {
+		resources.CPUMillicores = q.MilliValue()
+	}
+	if q, ok := list[corev1.ResourceMemory]; ok {
+		resources.MemoryBytes = q.Value()
+	}
+	if q, ok := list[corev1.ResourcePods]; ok {
+		resources.Pods = q.Value()
+	}
+	return resources
+}
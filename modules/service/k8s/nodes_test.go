@@ -0,0 +1,331 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func testNode(name string, ready bool, nodeLabels map[string]string) *corev1.Node {
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionFalse
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: "dedicated", Value: "ci", Effect: corev1.TaintEffectNoSchedule}}},
+		Status: corev1.NodeStatus{
+			NodeInfo:  corev1.NodeSystemInfo{KubeletVersion: "v1.34.1", OSImage: "Debian 12"},
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeHostName, Address: name}, {Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+			Capacity: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("4"),
+				corev1.ResourceMemory: resource.MustParse("8Gi"),
+				corev1.ResourcePods:   resource.MustParse("110"),
+			},
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("3500m"),
+				corev1.ResourceMemory: resource.MustParse("7Gi"),
+				corev1.ResourcePods:   resource.MustParse("110"),
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status, Message: "kubelet stopped posting node status"}},
+		},
+	}
+}
+
+func testPod(namespace, name, node string, podLabels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, UID: types.UID("uid-" + name), Labels: podLabels},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestListNodes(t *testing.T) {
+	client := fake.NewClientset(
+		testNode("worker-1", false, map[string]string{"kubernetes.io/role": "worker"}),
+		testNode("cp-1", true, map[string]string{nodeRoleLabelPrefix + "control-plane": "", nodeRoleLabelPrefix + "etcd": ""}),
+		testPod("default", "web-1", "worker-1", nil),
+		testPod("default", "web-2", "worker-1", nil),
+		testPod("kube-system", "apiserver", "cp-1", nil),
+	)
+
+	nodes, err := listNodes(context.Background(), client)
+	if err != nil {
+		t.Fatalf("listNodes: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "cp-1" || nodes[1].Name != "worker-1" {
+		t.Fatalf("nodes = %+v, want cp-1 and worker-1 by name", nodes)
+	}
+	cp, worker := nodes[0], nodes[1]
+	if !slices.Equal(cp.Roles, []string{"control-plane", "etcd"}) || !slices.Equal(worker.Roles, []string{"worker"}) {
+		t.Errorf("roles = %v and %v, want them read from the labels", cp.Roles, worker.Roles)
+	}
+	if !cp.Ready || worker.Ready || worker.ReadyMessage != "kubelet stopped posting node status" {
+		t.Errorf("ready = %v and %v %q, want only cp-1 ready", cp.Ready, worker.Ready, worker.ReadyMessage)
+	}
+	if cp.PodCount != 1 || worker.PodCount != 2 {
+		t.Errorf("pod counts = %d and %d, want 1 and 2", cp.PodCount, worker.PodCount)
+	}
+	want := model.KubernetesNodeResources{CPUMillicores: 3500, MemoryBytes: 7 << 30, Pods: 110}
+	if worker.Allocatable != want || worker.Capacity.CPUMillicores != 4000 {
+		t.Errorf("allocatable = %+v capacity = %+v, want %+v of 4 cores", worker.Allocatable, worker.Capacity, want)
+	}
+	if worker.InternalIP != "10.0.0.1" || worker.KubeletVersion != "v1.34.1" {
+		t.Errorf("address %s version %s, want the internal IP and kubelet version", worker.InternalIP, worker.KubeletVersion)
+	}
+	if len(worker.Taints) != 1 || worker.Taints[0] != (model.KubernetesNodeTaint{Key: "dedicated", Value: "ci", Effect: "NoSchedule"}) {
+		t.Errorf("taints = %+v, want dedicated=ci:NoSchedule", worker.Taints)
+	}
+}
+
+func TestNodeDetails(t *testing.T) {
+	event := func(name, reason string, last int64) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Node", Name: "worker-1"},
+			Reason:         reason,
+			LastTimestamp:  metav1.Unix(last, 0),
+		}
+	}
+	finished := testPod("default", "job-1", "worker-1", nil)
+	finished.Status.Phase = corev1.PodSucceeded
+	client := fake.NewClientset(
+		testNode("worker-1", true, nil),
+		testPod("default", "web-1", "worker-1", nil),
+		finished,
+		event("older", "NodeNotReady", 100),
+		event("newer", "NodeReady", 200),
+	)
+
+	details, err := nodeDetails(context.Background(), client, "worker-1")
+	if err != nil {
+		t.Fatalf("nodeDetails: %v", err)
+	}
+	if details.PodCount != 1 || len(details.Pods) != 2 {
+		t.Errorf("pods = %d of %d, want the finished one listed but not counted", details.PodCount, len(details.Pods))
+	}
+	if len(details.Events) != 2 || details.Events[0].Reason != "NodeReady" {
+		t.Errorf("events = %+v, want the newest first", details.Events)
+	}
+	if len(details.Conditions) != 1 || details.Conditions[0].Type != "Ready" || details.OSImage != "Debian 12" {
+		t.Errorf("details = %+v, want the conditions and system information", details)
+	}
+	if _, err := nodeDetails(context.Background(), client, "missing"); !k8serrors.IsNotFound(err) {
+		t.Errorf("nodeDetails of a missing node = %v, want not found", err)
+	}
+}
+
+func TestCordonAndUncordonNode(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(testNode("worker-1", true, nil))
+
+	node, err := setNodeUnschedulable(ctx, client, "worker-1", true)
+	if err != nil || !node.Unschedulable {
+		t.Fatalf("cordon = %+v, %v, want the node unschedulable", node, err)
+	}
+	node, err = setNodeUnschedulable(ctx, client, "worker-1", false)
+	if err != nil || node.Unschedulable {
+		t.Fatalf("uncordon = %+v, %v, want the node schedulable", node, err)
+	}
+	stored, err := client.CoreV1().Nodes().Get(ctx, "worker-1", metav1.GetOptions{})
+	if err != nil || stored.Spec.Unschedulable || len(stored.Spec.Taints) != 1 {
+		t.Errorf("stored node = %+v, %v, want it schedulable with its taints kept", stored.Spec, err)
+	}
+}
+
+// withEvictionAPI answers evictions like the API server: pods covered by a
+// PodDisruptionBudget allowing no disruptions are refused with 429 and the others deleted.
+// Evictions of pods named in failing fail with an internal error.
+func withEvictionAPI(t *testing.T, client *fake.Clientset, failing ...string) {
+	t.Helper()
+	podsResource := corev1.SchemeGroupVersion.WithResource("pods")
+	pdbResource := policyv1.SchemeGroupVersion.WithResource("poddisruptionbudgets")
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		namespace := action.GetNamespace()
+		if slices.Contains(failing, eviction.Name) {
+			return true, nil, k8serrors.NewInternalError(errors.New("etcd is unavailable"))
+		}
+		obj, err := client.Tracker().Get(podsResource, namespace, eviction.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		pod := obj.(*corev1.Pod)
+		obj, err = client.Tracker().List(pdbResource, policyv1.SchemeGroupVersion.WithKind("PodDisruptionBudget"), namespace)
+		if err != nil {
+			return true, nil, err
+		}
+		for _, pdb := range obj.(*policyv1.PodDisruptionBudgetList).Items {
+			selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+			if err != nil {
+				return true, nil, err
+			}
+			if selector.Matches(labels.Set(pod.Labels)) && pdb.Status.DisruptionsAllowed < 1 {
+				return true, nil, k8serrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+			}
+		}
+		return true, nil, client.Tracker().Delete(podsResource, namespace, eviction.Name)
+	})
+}
+
+func guardedPods() []runtime.Object {
+	daemon := testPod("kube-system", "fluentd", "worker-1", nil)
+	daemon.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd", Controller: boolPtr(true)}}
+	static := testPod("kube-system", "etcd-worker-1", "worker-1", nil)
+	static.Annotations = map[string]string{corev1.MirrorPodAnnotationKey: "hash"}
+	return []runtime.Object{
+		testNode("worker-1", true, nil),
+		daemon,
+		static,
+		testPod("default", "db-0", "worker-1", map[string]string{"app": "db"}),
+		testPod("default", "web-1", "worker-1", map[string]string{"app": "web"}),
+		&policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       policyv1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+		},
+	}
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func shortenDrainRetries(t *testing.T) {
+	interval := drainRetryInterval
+	drainRetryInterval = 10 * time.Millisecond
+	t.Cleanup(func() { drainRetryInterval = interval })
+}
+
+func TestDrainNodeWaitsForDisruptionBudget(t *testing.T) {
+	shortenDrainRetries(t)
+	ctx := context.Background()
+	client := fake.NewClientset(guardedPods()...)
+	withEvictionAPI(t, client)
+
+	var events []string
+	emit := func(event model.KubernetesNodeDrainEvent) error {
+		events = append(events, event.Type+" "+event.Pod)
+		if event.Type == model.KubernetesDrainBlocked {
+			// the budget allows a disruption once another replica is ready
+			pdb, err := client.PolicyV1().PodDisruptionBudgets("default").Get(ctx, "db", metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			pdb.Status.DisruptionsAllowed = 1
+			_, err = client.PolicyV1().PodDisruptionBudgets("default").UpdateStatus(ctx, pdb, metav1.UpdateOptions{})
+			return err
+		}
+		return nil
+	}
+
+	result, err := drainNode(ctx, client, "worker-1", nil, emit)
+	if err != nil {
+		t.Fatalf("drainNode: %v", err)
+	}
+	if !slices.Equal(result.Evicted, []string{"default/db-0", "default/web-1"}) || len(result.Failed) != 0 {
+		t.Errorf("evicted = %v failed = %v, want db-0 and web-1 evicted", result.Evicted, result.Failed)
+	}
+	if !slices.Equal(result.Skipped, []string{"kube-system/etcd-worker-1", "kube-system/fluentd"}) {
+		t.Errorf("skipped = %v, want the static and DaemonSet pods", result.Skipped)
+	}
+	want := []string{"CORDONED ", "EVICTING db-0", "BLOCKED db-0", "EVICTING web-1", "SKIPPED etcd-worker-1", "SKIPPED fluentd", "EVICTED db-0", "EVICTED web-1"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker-1", metav1.GetOptions{})
+	if err != nil || !node.Spec.Unschedulable {
+		t.Errorf("node = %+v, %v, want it cordoned", node.Spec, err)
+	}
+	if _, err := client.CoreV1().Pods("kube-system").Get(ctx, "fluentd", metav1.GetOptions{}); err != nil {
+		t.Errorf("DaemonSet pod was evicted: %v", err)
+	}
+}
+
+func TestDrainNodeTimesOutOnDisruptionBudget(t *testing.T) {
+	shortenDrainRetries(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	client := fake.NewClientset(guardedPods()...)
+	withEvictionAPI(t, client)
+
+	blocked := 0
+	_, err := drainNode(ctx, client, "worker-1", nil, func(event model.KubernetesNodeDrainEvent) error {
+		if event.Type == model.KubernetesDrainBlocked {
+			blocked++
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "stays cordoned") {
+		t.Fatalf("drainNode = %v, want the timeout", err)
+	}
+	if blocked < 2 {
+		t.Errorf("blocked %d times, want the eviction retried", blocked)
+	}
+	if _, err := client.CoreV1().Pods("default").Get(context.Background(), "db-0", metav1.GetOptions{}); err != nil {
+		t.Errorf("pod guarded by the budget was evicted: %v", err)
+	}
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "worker-1", metav1.GetOptions{})
+	if err != nil || !node.Spec.Unschedulable {
+		t.Errorf("node = %+v, %v, want it left cordoned", node.Spec, err)
+	}
+}
+
+func TestDrainNodeGoesOnAfterFailedEviction(t *testing.T) {
+	shortenDrainRetries(t)
+	client := fake.NewClientset(testNode("worker-1", true, nil), testPod("default", "a", "worker-1", nil), testPod("default", "b", "worker-1", nil))
+	withEvictionAPI(t, client, "a")
+
+	var failed []string
+	result, err := drainNode(context.Background(), client, "worker-1", nil, func(event model.KubernetesNodeDrainEvent) error {
+		if event.Type == model.KubernetesDrainFailed {
+			failed = append(failed, event.Pod+": "+event.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("drainNode: %v", err)
+	}
+	if !slices.Equal(result.Failed, []string{"default/a"}) || !slices.Equal(result.Evicted, []string{"default/b"}) {
+		t.Errorf("failed = %v evicted = %v, want a failed and b evicted", result.Failed, result.Evicted)
+	}
+	if len(failed) != 1 || !strings.Contains(failed[0], "etcd is unavailable") {
+		t.Errorf("failed events = %v, want the eviction error", failed)
+	}
+}
+
+func TestDrainNodeRequiresConfirmation(t *testing.T) {
+	negative := int64(-1)
+	for name, req := range map[string]model.KubernetesNodeDrainRequest{
+		"unconfirmed":           {},
+		"negative grace period": {Confirm: true, GracePeriodSeconds: &negative},
+		"negative timeout":      {Confirm: true, TimeoutSeconds: -1},
+		"timeout over an hour":  {Confirm: true, TimeoutSeconds: 7200},
+	} {
+		emit := func(model.KubernetesNodeDrainEvent) error {
+			t.Errorf("%s: drain started", name)
+			return nil
+		}
+		if _, err := (&Service{}).DrainNode(context.Background(), 1, "worker-1", req, emit); !errors.Is(err, ErrNodeDrainInvalid) {
+			t.Errorf("%s: DrainNode = %v, want ErrNodeDrainInvalid", name, err)
+		}
+	}
+}
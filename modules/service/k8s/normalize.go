@@ -0,0 +1,492 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// serverDefault matches values the API server sets when a manifest omits them. Paths use
+// dots for fields and [] for list entries; a rule matches when the path ends in suffix.
+type serverDefault struct {
+	kinds  []string
+	suffix string
+	value  interface{}
+}
+
+// anyValue marks fields the server assigns and a manifest never declares.
+var anyValue = struct{}{}
+
+var workloadKinds = []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet"}
+
+var serverDefaults = buildServerDefaults()
+
+func buildServerDefaults() []serverDefault {
+	rules := []serverDefault{
+		{kinds: []string{"Deployment", "StatefulSet", "ReplicaSet"}, suffix: "spec.replicas", value: 1.0},
+		{kinds: workloadKinds, suffix: "spec.revisionHistoryLimit", value: 10.0},
+		{kinds: []string{"Deployment"}, suffix: "spec.progressDeadlineSeconds", value: 600.0},
+		{kinds: []string{"Deployment"}, suffix: "spec.strategy.type", value: "RollingUpdate"},
+		{kinds: []string{"Deployment"}, suffix: "spec.strategy.rollingUpdate.maxSurge", value: "25%"},
+		{kinds: []string{"Deployment"}, suffix: "spec.strategy.rollingUpdate.maxUnavailable", value: "25%"},
+		{kinds: []string{"StatefulSet"}, suffix: "spec.podManagementPolicy", value: "OrderedReady"},
+		{kinds: []string{"StatefulSet", "DaemonSet"}, suffix: "spec.updateStrategy.type", value: "RollingUpdate"},
+		{kinds: []string{"StatefulSet"}, suffix: "spec.updateStrategy.rollingUpdate.partition", value: 0.0},
+		{kinds: []string{"StatefulSet"}, suffix: "spec.persistentVolumeClaimRetentionPolicy.whenDeleted", value: "Retain"},
+		{kinds: []string{"StatefulSet"}, suffix: "spec.persistentVolumeClaimRetentionPolicy.whenScaled", value: "Retain"},
+		{kinds: []string{"DaemonSet"}, suffix: "spec.updateStrategy.rollingUpdate.maxUnavailable", value: 1.0},
+		{kinds: []string{"DaemonSet"}, suffix: "spec.updateStrategy.rollingUpdate.maxSurge", value: 0.0},
+		{kinds: []string{"Service"}, suffix: "spec.type", value: "ClusterIP"},
+		{kinds: []string{"Service"}, suffix: "spec.sessionAffinity", value: "None"},
+		{kinds: []string{"Service"}, suffix: "spec.internalTrafficPolicy", value: "Cluster"},
+		{kinds: []string{"Service"}, suffix: "spec.ipFamilyPolicy", value: "SingleStack"},
+		{kinds: []string{"Service"}, suffix: "spec.clusterIP", value: anyValue},
+		{kinds: []string{"Service"}, suffix: "spec.clusterIPs", value: anyValue},
+		{kinds: []string{"Service"}, suffix: "spec.ipFamilies", value: anyValue},
+		{suffix: "ports[].protocol", value: "TCP"},
+		// pod specs, top level for pods and under template for workloads
+		{suffix: "spec.restartPolicy", value: "Always"},
+		{suffix: "spec.dnsPolicy", value: "ClusterFirst"},
+		{suffix: "spec.schedulerName", value: "default-scheduler"},
+		{suffix: "spec.terminationGracePeriodSeconds", value: 30.0},
+		{suffix: "spec.enableServiceLinks", value: true},
+		{suffix: "volumes[].configMap.defaultMode", value: 420.0},
+		{suffix: "volumes[].secret.defaultMode", value: 420.0},
+		{suffix: "volumes[].projected.defaultMode", value: 420.0},
+	}
+	for _, containers := range []string{"containers[]", "initContainers[]"} {
+		rules = append(rules,
+			serverDefault{suffix: containers + ".terminationMessagePath", value: "/dev/termination-log"},
+			serverDefault{suffix: containers + ".terminationMessagePolicy", value: "File"},
+		)
+		for _, probe := range []string{"livenessProbe", "readinessProbe", "startupProbe"} {
+			prefix := containers + "." + probe
+			rules = append(rules,
+				serverDefault{suffix: prefix + ".timeoutSeconds", value: 1.0},
+				serverDefault{suffix: prefix + ".periodSeconds", value: 10.0},
+				serverDefault{suffix: prefix + ".successThreshold", value: 1.0},
+				serverDefault{suffix: prefix + ".failureThreshold", value: 3.0},
+				serverDefault{suffix: prefix + ".httpGet.scheme", value: "HTTP"},
+			)
+		}
+	}
+	return rules
+}
+
+// ignoredAnnotations are written by tools and controllers rather than declared.
+var ignoredAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"deployment.kubernetes.io/revision",
+}
+
+// listKeys identify entries of lists that merge by key; the first key present in every entry
+// of a list is used, so reordering such a list is not a change.
+var listKeys = []string{"name", "mountPath", "devicePath", "containerPort", "port", "ip"}
+
+// redactedValue replaces Secret values in normalized objects.
+const redactedValue = "<redacted>"
+
+// NormalizeObject returns a copy of obj reduced to what a manifest declares: status, server
+// populated metadata and fields the server defaults are removed, resource quantities are
+// canonical (500m and 0.5 are equal), numbers are float64 and empty maps and lists are
+// dropped. Baselines are stored normalized and live objects are normalized before diffing.
+// Secret values are never kept: data values are redacted so only added and removed keys
+// show up as drift, and the write-only stringData is dropped.
+func NormalizeObject(obj map[string]interface{}) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	delete(out, "status")
+	if metadata, ok := out["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"managedFields", "resourceVersion", "uid", "generation",
+			"creationTimestamp", "selfLink", "deletionTimestamp", "deletionGracePeriodSeconds"} {
+			delete(metadata, field)
+		}
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			for _, key := range ignoredAnnotations {
+				delete(annotations, key)
+			}
+		}
+	}
+	kind, _ := out["kind"].(string)
+	if kind == "Secret" {
+		redactSecret(out)
+	}
+	normalizeValue(kind, "", out)
+	if kind == "Service" {
+		normalizeServicePorts(out)
+	}
+	pruned, _ := pruneEmpty(out).(map[string]interface{})
+	if pruned == nil {
+		pruned = map[string]interface{}{}
+	}
+	return pruned, nil
+}
+
+// redactSecret replaces the values of a Secret so they are neither stored nor reported.
+func redactSecret(obj map[string]interface{}) {
+	delete(obj, "stringData")
+	if data, ok := obj["data"].(map[string]interface{}); ok {
+		for key := range data {
+			data[key] = redactedValue
+		}
+	}
+}
+
+// normalizeValue removes server defaults below path and canonicalises quantities in place.
+func normalizeValue(kind, path string, value interface{}) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if strings.HasSuffix(path, "containers[]") || strings.HasSuffix(path, "Containers[]") {
+			pruneImagePullPolicy(typed)
+		}
+		for key, child := range typed {
+			childPath := joinPath(path, key)
+			if isServerDefault(kind, childPath, child) {
+				delete(typed, key)
+				continue
+			}
+			if isQuantityMap(childPath) {
+				if quantities, ok := child.(map[string]interface{}); ok {
+					for name, quantity := range quantities {
+						quantities[name] = canonicalQuantity(quantity)
+					}
+					continue
+				}
+			}
+			normalizeValue(kind, childPath, child)
+		}
+	case []interface{}:
+		for _, item := range typed {
+			normalizeValue(kind, path+"[]", item)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func isServerDefault(kind, path string, value interface{}) bool {
+	for _, rule := range serverDefaults {
+		if path != rule.suffix && !strings.HasSuffix(path, "."+rule.suffix) {
+			continue
+		}
+		if len(rule.kinds) > 0 && !containsString(rule.kinds, kind) {
+			continue
+		}
+		if rule.value == anyValue || reflect.DeepEqual(rule.value, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
+
+func isQuantityMap(path string) bool {
+	return strings.HasSuffix(path, "resources.limits") || strings.HasSuffix(path, "resources.requests") ||
+		strings.HasSuffix(path, "spec.hard") || strings.HasSuffix(path, "spec.capacity")
+}
+
+// canonicalQuantity renders value as the canonical string of a resource quantity; values
+// that are not quantities are returned unchanged.
+func canonicalQuantity(value interface{}) interface{} {
+	var text string
+	switch typed := value.(type) {
+	case string:
+		text = typed
+	case float64:
+		text = strconv.FormatFloat(typed, 'f', -1, 64)
+	default:
+		return value
+	}
+	quantity, err := resource.ParseQuantity(strings.TrimSpace(text))
+	if err != nil {
+		return value
+	}
+	return quantity.String()
+}
+
+// pruneImagePullPolicy drops the pull policy the server derives from the image tag: Always
+// for untagged and latest images, IfNotPresent otherwise.
+func pruneImagePullPolicy(container map[string]interface{}) {
+	policy, ok := container["imagePullPolicy"].(string)
+	if !ok {
+		return
+	}
+	image, _ := container["image"].(string)
+	expected := "IfNotPresent"
+	if !strings.Contains(image, "@") {
+		name := image
+		if slash := strings.LastIndex(name, "/"); slash >= 0 {
+			name = name[slash+1:]
+		}
+		tag := ""
+		if colon := strings.LastIndex(name, ":"); colon >= 0 {
+			tag = name[colon+1:]
+		}
+		if tag == "" || tag == "latest" {
+			expected = "Always"
+		}
+	}
+	if policy == expected {
+		delete(container, "imagePullPolicy")
+	}
+}
+
+// normalizeServicePorts drops target ports equal to the service port, the server default.
+func normalizeServicePorts(obj map[string]interface{}) {
+	spec, _ := obj["spec"].(map[string]interface{})
+	ports, _ := spec["ports"].([]interface{})
+	for _, item := range ports {
+		port, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if target, ok := port["targetPort"]; ok && reflect.DeepEqual(target, port["port"]) {
+			delete(port, "targetPort")
+		}
+	}
+}
+
+// pruneEmpty drops nil values and empty maps and lists, recursively.
+func pruneEmpty(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			child = pruneEmpty(child)
+			if child == nil {
+				delete(typed, key)
+				continue
+			}
+			typed[key] = child
+		}
+		if len(typed) == 0 {
+			return nil
+		}
+		return typed
+	case []interface{}:
+		items := typed[:0]
+		for _, child := range typed {
+			if child = pruneEmpty(child); child != nil {
+				items = append(items, child)
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return items
+	default:
+		return value
+	}
+}
+
+// DiffObjects compares two normalized objects and returns the fields that differ, sorted by
+// path. Lists of keyed entries are matched by key, other lists are compared as a whole.
+func DiffObjects(baseline, live map[string]interface{}) []model.KubernetesDriftFinding {
+	var findings []model.KubernetesDriftFinding
+	diffValue("", baseline, live, &findings)
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].Path < findings[j].Path
+	})
+	return findings
+}
+
+func diffValue(path string, baseline, live interface{}, findings *[]model.KubernetesDriftFinding) {
+	baseMap, baseIsMap := baseline.(map[string]interface{})
+	liveMap, liveIsMap := live.(map[string]interface{})
+	if baseIsMap && liveIsMap {
+		keys := make(map[string]struct{}, len(baseMap)+len(liveMap))
+		for key := range baseMap {
+			keys[key] = struct{}{}
+		}
+		for key := range liveMap {
+			keys[key] = struct{}{}
+		}
+		for key := range keys {
+			diffValue(joinPath(path, key), baseMap[key], liveMap[key], findings)
+		}
+		return
+	}
+	baseList, baseIsList := baseline.([]interface{})
+	liveList, liveIsList := live.([]interface{})
+	if baseIsList && liveIsList {
+		if key := commonListKey(baseList, liveList); key != "" {
+			baseEntries := keyedEntries(baseList, key)
+			liveEntries := keyedEntries(liveList, key)
+			ids := make(map[string]struct{}, len(baseEntries)+len(liveEntries))
+			for id := range baseEntries {
+				ids[id] = struct{}{}
+			}
+			for id := range liveEntries {
+				ids[id] = struct{}{}
+			}
+			for id := range ids {
+				diffValue(fmt.Sprintf("%s[%s=%s]", path, key, id), baseEntries[id], liveEntries[id], findings)
+			}
+			return
+		}
+	}
+	if reflect.DeepEqual(baseline, live) {
+		return
+	}
+	*findings = append(*findings, model.KubernetesDriftFinding{
+		Path:     path,
+		Baseline: baseline,
+		Live:     live,
+	})
+}
+
+// commonListKey returns the first list key present and unique in every entry of both lists.
+func commonListKey(lists ...[]interface{}) string {
+	for _, key := range listKeys {
+		usable := true
+		for _, list := range lists {
+			seen := make(map[string]struct{}, len(list))
+			for _, item := range list {
+				entry, ok := item.(map[string]interface{})
+				if !ok {
+					return ""
+				}
+				value, ok := entry[key]
+				if !ok {
+					usable = false
+					break
+				}
+				id := fmt.Sprint(value)
+				if _, dup := seen[id]; dup {
+					usable = false
+					break
+				}
+				seen[id] = struct{}{}
+			}
+			if !usable {
+				break
+			}
+		}
+		if usable {
+			return key
+		}
+	}
+	return ""
+}
+
+func keyedEntries(list []interface{}, key string) map[string]interface{} {
+	entries := make(map[string]interface{}, len(list))
+	for _, item := range list {
+		entry := item.(map[string]interface{})
+		entries[fmt.Sprint(entry[key])] = entry
+	}
+	return entries
+}
+
+// attributeManagers fills the managers of each finding from the server-side apply data of
+// the live object. Only fields tracked in metadata.managedFields can be attributed.
+func attributeManagers(live map[string]interface{}, findings []model.KubernetesDriftFinding) {
+	metadata, _ := live["metadata"].(map[string]interface{})
+	entries, _ := metadata["managedFields"].([]interface{})
+	if len(entries) == 0 {
+		return
+	}
+	owned := make(map[string][]string, len(entries))
+	for _, item := range entries {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		manager, _ := entry["manager"].(string)
+		fields, _ := entry["fieldsV1"].(map[string]interface{})
+		if manager == "" || fields == nil {
+			continue
+		}
+		var paths []string
+		collectManagedPaths("", fields, &paths)
+		owned[manager] = append(owned[manager], paths...)
+	}
+	for i := range findings {
+		var managers []string
+		for manager, paths := range owned {
+			for _, path := range paths {
+				if pathsOverlap(path, findings[i].Path) {
+					managers = append(managers, manager)
+					break
+				}
+			}
+		}
+		sort.Strings(managers)
+		findings[i].Managers = managers
+	}
+}
+
+// collectManagedPaths converts a fieldsV1 set into the paths used by drift findings.
+func collectManagedPaths(path string, fields map[string]interface{}, paths *[]string) {
+	for key, child := range fields {
+		var childPath string
+		switch {
+		case key == ".":
+			continue
+		case strings.HasPrefix(key, "f:"):
+			childPath = joinPath(path, strings.TrimPrefix(key, "f:"))
+		case strings.HasPrefix(key, "k:"):
+			var itemKey map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &itemKey); err != nil {
+				continue
+			}
+			childPath = path
+			for _, name := range listKeys {
+				if value, ok := itemKey[name]; ok {
+					childPath = fmt.Sprintf("%s[%s=%v]", path, name, value)
+					break
+				}
+			}
+		default:
+			// sets of scalars and positional entries are owned as a whole list
+			childPath = path
+		}
+		// a field with children is owned as a whole only when its set marks it with "."
+		nested, _ := child.(map[string]interface{})
+		if _, self := nested["."]; len(nested) == 0 || self {
+			*paths = append(*paths, childPath)
+		}
+		if len(nested) > 0 {
+			collectManagedPaths(childPath, nested, paths)
+		}
+	}
+}
+
+// pathsOverlap reports whether one path is the other or contains it.
+func pathsOverlap(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if !strings.HasPrefix(b, a) {
+		return false
+	}
+	return len(a) == len(b) || b[len(a)] == '.' || b[len(a)] == '['
+}
@@ -0,0 +1,209 @@
+package k8s
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeObject(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	return obj
+}
+
+func TestNormalizeObject(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "status and server metadata",
+			in: `{"kind":"ConfigMap","metadata":{"name":"app","namespace":"default","uid":"u1","resourceVersion":"42",
+				"generation":3,"creationTimestamp":"2024-01-01T00:00:00Z",
+				"managedFields":[{"manager":"kubectl","operation":"Apply","fieldsV1":{"f:data":{}}}]},
+				"data":{"mode":"prod"},"status":{"phase":"Active"}}`,
+			want: `{"kind":"ConfigMap","metadata":{"name":"app","namespace":"default"},"data":{"mode":"prod"}}`,
+		},
+		{
+			name: "tool annotations",
+			in: `{"kind":"Deployment","metadata":{"name":"web","annotations":{
+				"kubectl.kubernetes.io/last-applied-configuration":"{}","deployment.kubernetes.io/revision":"7",
+				"team":"payments"}}}`,
+			want: `{"kind":"Deployment","metadata":{"name":"web","annotations":{"team":"payments"}}}`,
+		},
+		{
+			name: "only tool annotations",
+			in:   `{"kind":"Deployment","metadata":{"name":"web","annotations":{"deployment.kubernetes.io/revision":"7"}}}`,
+			want: `{"kind":"Deployment","metadata":{"name":"web"}}`,
+		},
+		{
+			name: "defaulted deployment fields",
+			in: `{"kind":"Deployment","metadata":{"name":"web"},"spec":{"replicas":1,"revisionHistoryLimit":10,
+				"progressDeadlineSeconds":600,"strategy":{"type":"RollingUpdate","rollingUpdate":{"maxSurge":"25%","maxUnavailable":"25%"}},
+				"template":{"spec":{"restartPolicy":"Always","dnsPolicy":"ClusterFirst","schedulerName":"default-scheduler",
+				"terminationGracePeriodSeconds":30,"containers":[{"name":"web","image":"web:1.2","imagePullPolicy":"IfNotPresent",
+				"terminationMessagePath":"/dev/termination-log","terminationMessagePolicy":"File",
+				"ports":[{"containerPort":8080,"protocol":"TCP"}]}]}}}}`,
+			want: `{"kind":"Deployment","metadata":{"name":"web"},"spec":{"template":{"spec":{"containers":[
+				{"name":"web","image":"web:1.2","ports":[{"containerPort":8080}]}]}}}}`,
+		},
+		{
+			name: "declared values differing from defaults",
+			in: `{"kind":"Deployment","metadata":{"name":"web"},"spec":{"replicas":3,"strategy":{"type":"Recreate"},
+				"template":{"spec":{"containers":[{"name":"web","image":"web:latest","imagePullPolicy":"IfNotPresent"}]}}}}`,
+			want: `{"kind":"Deployment","metadata":{"name":"web"},"spec":{"replicas":3,"strategy":{"type":"Recreate"},
+				"template":{"spec":{"containers":[{"name":"web","image":"web:latest","imagePullPolicy":"IfNotPresent"}]}}}}`,
+		},
+		{
+			name: "defaulted probes",
+			in: `{"kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"web","image":"web:1",
+				"livenessProbe":{"httpGet":{"path":"/healthz","port":8080,"scheme":"HTTP"},"timeoutSeconds":1,"periodSeconds":10,
+				"successThreshold":1,"failureThreshold":3},
+				"readinessProbe":{"tcpSocket":{"port":8080},"periodSeconds":5,"failureThreshold":3}}]}}`,
+			want: `{"kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"web","image":"web:1",
+				"livenessProbe":{"httpGet":{"path":"/healthz","port":8080}},
+				"readinessProbe":{"tcpSocket":{"port":8080},"periodSeconds":5}}]}}`,
+		},
+		{
+			name: "quantities",
+			in: `{"kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"web","image":"web:1",
+				"resources":{"limits":{"cpu":"0.5","memory":"1Gi"},"requests":{"cpu":0.25}}}]}}`,
+			want: `{"kind":"Pod","metadata":{"name":"web"},"spec":{"containers":[{"name":"web","image":"web:1",
+				"resources":{"limits":{"cpu":"500m","memory":"1Gi"},"requests":{"cpu":"250m"}}}]}}`,
+		},
+		{
+			name: "service assigned fields",
+			in: `{"kind":"Service","metadata":{"name":"web"},"spec":{"type":"ClusterIP","clusterIP":"10.0.0.7",
+				"clusterIPs":["10.0.0.7"],"ipFamilies":["IPv4"],"ipFamilyPolicy":"SingleStack","sessionAffinity":"None",
+				"ports":[{"port":80,"targetPort":80,"protocol":"TCP"},{"name":"admin","port":81,"targetPort":9000}]}}`,
+			want: `{"kind":"Service","metadata":{"name":"web"},"spec":{"ports":[{"port":80},{"name":"admin","port":81,"targetPort":9000}]}}`,
+		},
+		{
+			name: "secret values",
+			in: `{"kind":"Secret","metadata":{"name":"db"},"type":"Opaque","data":{"password":"aHVudGVyMg==","user":"cm9vdA=="},
+				"stringData":{"token":"plain"}}`,
+			want: `{"kind":"Secret","metadata":{"name":"db"},"type":"Opaque","data":{"password":"<redacted>","user":"<redacted>"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := decodeObject(t, tc.in)
+			got, err := NormalizeObject(in)
+			if err != nil {
+				t.Fatalf("NormalizeObject: %v", err)
+			}
+			if want := decodeObject(t, tc.want); !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				t.Fatalf("NormalizeObject =\n%s\nwant\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestNormalizeObjectKeepsInput(t *testing.T) {
+	in := decodeObject(t, `{"kind":"Secret","metadata":{"name":"db"},"data":{"password":"aHVudGVyMg=="},"status":{}}`)
+	if _, err := NormalizeObject(in); err != nil {
+		t.Fatalf("NormalizeObject: %v", err)
+	}
+	if data := in["data"].(map[string]interface{}); data["password"] != "aHVudGVyMg==" {
+		t.Fatalf("input data = %v, want it untouched", data)
+	}
+	if _, ok := in["status"]; !ok {
+		t.Fatalf("input status was removed")
+	}
+}
+
+func TestDiffObjects(t *testing.T) {
+	cases := []struct {
+		name     string
+		baseline string
+		live     string
+		paths    []string
+	}{
+		{
+			name: "reordered env list",
+			baseline: `{"kind":"Pod","spec":{"containers":[{"name":"web","image":"web:1",
+				"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}]}}`,
+			live: `{"kind":"Pod","spec":{"containers":[{"name":"web","image":"web:1",
+				"env":[{"name":"B","value":"2"},{"name":"A","value":"1"}]}]}}`,
+		},
+		{
+			name:     "equivalent quantities",
+			baseline: `{"kind":"Pod","spec":{"containers":[{"name":"web","resources":{"limits":{"cpu":"500m"}}}]}}`,
+			live:     `{"kind":"Pod","spec":{"containers":[{"name":"web","resources":{"limits":{"cpu":0.5}}}]}}`,
+		},
+		{
+			name:     "defaulted probe on the live object",
+			baseline: `{"kind":"Pod","spec":{"containers":[{"name":"web","livenessProbe":{"tcpSocket":{"port":80}}}]}}`,
+			live: `{"kind":"Pod","spec":{"containers":[{"name":"web","livenessProbe":{"tcpSocket":{"port":80},
+				"timeoutSeconds":1,"periodSeconds":10,"successThreshold":1,"failureThreshold":3}}]}}`,
+		},
+		{
+			name: "changed env value and image",
+			baseline: `{"kind":"Pod","spec":{"containers":[{"name":"web","image":"web:1",
+				"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}]}}`,
+			live: `{"kind":"Pod","spec":{"containers":[{"name":"web","image":"web:2",
+				"env":[{"name":"B","value":"3"},{"name":"A","value":"1"}]}]}}`,
+			paths: []string{"spec.containers[name=web].env[name=B].value", "spec.containers[name=web].image"},
+		},
+		{
+			name:     "changed secret value",
+			baseline: `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`,
+			live:     `{"kind":"Secret","data":{"password":"c3dvcmRmaXNo"}}`,
+		},
+		{
+			name:     "added secret key",
+			baseline: `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`,
+			live:     `{"kind":"Secret","data":{"password":"aHVudGVyMg==","token":"dG9rZW4="}}`,
+			paths:    []string{"data.token"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			baseline, err := NormalizeObject(decodeObject(t, tc.baseline))
+			if err != nil {
+				t.Fatalf("normalize baseline: %v", err)
+			}
+			live, err := NormalizeObject(decodeObject(t, tc.live))
+			if err != nil {
+				t.Fatalf("normalize live: %v", err)
+			}
+			findings := DiffObjects(baseline, live)
+			var paths []string
+			for _, finding := range findings {
+				paths = append(paths, finding.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Fatalf("drift paths = %v, want %v", paths, tc.paths)
+			}
+		})
+	}
+}
+
+func TestAttributeManagers(t *testing.T) {
+	live := decodeObject(t, `{"metadata":{"managedFields":[
+		{"manager":"devsys","fieldsV1":{"f:spec":{"f:containers":{"k:{\"name\":\"web\"}":{"f:image":{}}}}}},
+		{"manager":"kubectl-edit","fieldsV1":{"f:spec":{"f:replicas":{}}}}]}}`)
+	findings := DiffObjects(
+		decodeObject(t, `{"spec":{"replicas":2,"containers":[{"name":"web","image":"web:1"}]}}`),
+		decodeObject(t, `{"spec":{"replicas":5,"containers":[{"name":"web","image":"web:2"}]}}`),
+	)
+	attributeManagers(live, findings)
+	got := map[string][]string{}
+	for _, finding := range findings {
+		got[finding.Path] = finding.Managers
+	}
+	want := map[string][]string{
+		"spec.containers[name=web].image": {"devsys"},
+		"spec.replicas":                   {"kubectl-edit"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("managers = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrPermissionInvalid is returned for cluster permissions that cannot be granted.
+var ErrPermissionInvalid = errors.New("cluster permission is invalid")
+
+// ErrPermissionNotFound is returned for permissions or users that do not exist.
+var ErrPermissionNotFound = errors.New("cluster permission not found")
+
+// ErrNamespaceForbidden is returned when the caller may not touch a namespace.
+var ErrNamespaceForbidden = errors.New("namespace is not permitted")
+
+// ClusterPermissionFilter narrows ListPermissions; zero fields match everything.
+type ClusterPermissionFilter struct {
+	UserID    int64
+	ClusterID int64
+}
+
+// ListPermissions lists cluster permissions with the login of their users.
+func (s *Service) ListPermissions(ctx context.Context, filter ClusterPermissionFilter) ([]model.ClusterPermissionInfo, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	var perms []model.ClusterPermissionInfo
+	err := s.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).
+			Table("cluster_permissions").
+			Select("cluster_permissions.*, users.login AS login").
+			Joins("JOIN users ON users.id = cluster_permissions.user_id")
+		if filter.UserID > 0 {
+			query = query.Where("cluster_permissions.user_id = ?", filter.UserID)
+		}
+		if filter.ClusterID > 0 {
+			query = query.Where("cluster_permissions.cluster_id = ?", filter.ClusterID)
+		}
+		return query.Order("cluster_permissions.cluster_id ASC, users.login ASC").Scan(&perms).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return perms, nil
+}
+
+// Permission returns the permission of userID on clusterID, or nil when none was granted.
+func (s *Service) Permission(ctx context.Context, userID, clusterID int64) (*model.ClusterPermission, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	var perm model.ClusterPermission
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("user_id = ? AND cluster_id = ?", userID, clusterID).Take(&perm).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &perm, nil
+}
+
+// SetPermission grants login access on a cluster, replacing an earlier grant. The user must
+// have logged in once.
+func (s *Service) SetPermission(ctx context.Context, clusterID int64, login string, access model.ClusterAccess, namespaces []string) (*model.ClusterPermission, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, fmt.Errorf("%w: login is required", ErrPermissionInvalid)
+	}
+	if !access.Valid() {
+		return nil, fmt.Errorf("%w: unknown access level %q", ErrPermissionInvalid, access)
+	}
+	namespaces, err := normalizeNamespaces(namespaces)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureClusterInScope(ctx, clusterID); err != nil {
+		return nil, err
+	}
+
+	var result *model.ClusterPermission
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var user model.User
+		err := tx.WithContext(ctx).Where("login = ?", login).Take(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: user %s", ErrPermissionNotFound, login)
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		var perm model.ClusterPermission
+		err = tx.WithContext(ctx).Where("user_id = ? AND cluster_id = ?", user.ID, clusterID).Take(&perm).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			perm = model.ClusterPermission{
+				UserID:     user.ID,
+				ClusterID:  clusterID,
+				Access:     access,
+				Namespaces: namespaces,
+				Created:    now,
+				Updated:    now,
+			}
+			if err := tx.WithContext(ctx).Create(&perm).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			perm.Access = access
+			perm.Namespaces = namespaces
+			perm.Updated = now
+			if err := tx.WithContext(ctx).Save(&perm).Error; err != nil {
+				return err
+			}
+		}
+		result = &perm
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeletePermission revokes a cluster permission by id.
+func (s *Service) DeletePermission(ctx context.Context, id int64) error {
+	if s.db == nil {
+		return errTargetStoreUnavailable
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Delete(&model.ClusterPermission{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPermissionNotFound
+		}
+		return nil
+	})
+}
+
+func normalizeNamespaces(namespaces []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(namespaces))
+	out := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return nil, fmt.Errorf("%w: namespace %q: %s", ErrPermissionInvalid, ns, strings.Join(errs, "; "))
+		}
+		if _, ok := seen[ns]; ok {
+			continue
+		}
+		seen[ns] = struct{}{}
+		out = append(out, ns)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+type namespaceGuardKey struct{}
+
+// WithNamespaceGuard returns a context whose manifest applies call guard with the namespace of
+// every document before anything is written; cluster-scoped documents pass the empty
+// namespace. Routers use it to enforce namespace permissions on multi-document manifests.
+func WithNamespaceGuard(ctx context.Context, guard func(namespace string) error) context.Context {
+	return context.WithValue(ctx, namespaceGuardKey{}, guard)
+}
+
+func checkNamespaceGuard(ctx context.Context, namespace string) error {
+	guard, ok := ctx.Value(namespaceGuardKey{}).(func(string) error)
+	if !ok || guard == nil {
+		return nil
+	}
+	return guard(namespace)
+}
@@ -0,0 +1,222 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// SplitManifest splits a multi-document YAML manifest on its `---` separator lines. Documents
+// holding nothing but comments are dropped.
+func SplitManifest(manifest string) []string {
+	var docs []string
+	var current []string
+	flush := func() {
+		doc := strings.TrimSpace(strings.Join(current, "\n"))
+		current = current[:0]
+		if doc != "" && !commentsOnly(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(manifest, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimRight(line, " \t")
+		if trimmed == "---" || strings.HasPrefix(trimmed, "--- ") {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return docs
+}
+
+func commentsOnly(doc string) bool {
+	for _, line := range strings.Split(doc, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveResource maps the apiVersion and kind of a manifest to the resource the cluster
+// serves them under, and reports whether that resource is namespaced.
+func (s *Service) ResolveResource(ctx context.Context, clusterID int64, apiVersion, kind string) (schema.GroupVersionResource, bool, error) {
+	gv, err := schema.ParseGroupVersion(strings.TrimSpace(apiVersion))
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	client, err := s.discoveryClient(ctx, clusterID)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	gk := schema.GroupKind{Group: gv.Group, Kind: kind}
+	mapping, err := restmapper.NewDeferredDiscoveryRESTMapper(client).RESTMapping(gk, gv.Version)
+	if meta.IsNoMatchError(err) {
+		// the cached discovery may predate a CRD installed since; look once more
+		client.Invalidate()
+		mapping, err = restmapper.NewDeferredDiscoveryRESTMapper(client).RESTMapping(gk, gv.Version)
+	}
+	if err != nil {
+		return schema.GroupVersionResource{}, false, fmt.Errorf("cluster does not serve kind %s in %s: %w", kind, gv.String(), err)
+	}
+	return mapping.Resource, mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+}
+
+// discoveryClient returns a discovery client whose results are cached in memory until the
+// cluster is invalidated or discoveryTTL passes, so CRDs installed since show up.
+func (s *Service) discoveryClient(ctx context.Context, clusterID int64) (discovery.CachedDiscoveryInterface, error) {
+	if err := s.ensureClusterInScope(ctx, clusterID); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if client, ok := s.discoCache[clusterID]; ok {
+		if time.Since(s.discoAt[clusterID]) > discoveryTTL {
+			client.Invalidate()
+			s.discoAt[clusterID] = time.Now()
+		}
+		s.mu.Unlock()
+		return client, nil
+	}
+	s.mu.Unlock()
+	cfg, err := s.restConfig(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := memory.NewMemCacheClient(direct)
+	s.mu.Lock()
+	s.discoCache[clusterID] = client
+	s.discoAt[clusterID] = time.Now()
+	s.mu.Unlock()
+	return client, nil
+}
+
+// HasRollout reports whether RolloutStatus tracks workloads of kind.
+func HasRollout(kind string) bool {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "deployment", "statefulset", "daemonset":
+		return true
+	}
+	return false
+}
+
+// RolloutStatus reports how far a deployment, statefulset or daemonset got towards its
+// current spec. Kinds without a rollout are reported done.
+func (s *Service) RolloutStatus(ctx context.Context, clusterID int64, kind, namespace, name string) (*model.KubernetesRolloutStatus, error) {
+	status := &model.KubernetesRolloutStatus{Kind: kind, Namespace: namespace, Name: name}
+	if !HasRollout(kind) {
+		status.Done = true
+		return status, nil
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "deployment":
+		dep, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		status.Desired = replicasOrDefault(dep.Spec.Replicas)
+		status.Updated = dep.Status.UpdatedReplicas
+		status.Ready = dep.Status.ReadyReplicas
+		status.Available = dep.Status.AvailableReplicas
+		for _, cond := range dep.Status.Conditions {
+			if cond.Type == appsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+				status.Failed = true
+				status.Message = cond.Message
+			}
+		}
+		// old replicas still running keep Replicas above Updated until the rollout ends
+		status.Done = dep.Status.ObservedGeneration >= dep.Generation &&
+			status.Updated == status.Desired && dep.Status.Replicas == status.Desired &&
+			status.Available == status.Desired
+	case "statefulset":
+		sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		status.Desired = replicasOrDefault(sts.Spec.Replicas)
+		status.Updated = sts.Status.UpdatedReplicas
+		status.Ready = sts.Status.ReadyReplicas
+		status.Available = sts.Status.AvailableReplicas
+		wantUpdated := status.Desired
+		switch strategy := sts.Spec.UpdateStrategy; {
+		case strategy.Type == appsv1.OnDeleteStatefulSetStrategyType:
+			// pods only change when deleted by hand; readiness is all a rollout can wait for
+			wantUpdated = 0
+		case strategy.RollingUpdate != nil && strategy.RollingUpdate.Partition != nil:
+			wantUpdated -= *strategy.RollingUpdate.Partition
+		}
+		status.Done = sts.Status.ObservedGeneration >= sts.Generation &&
+			status.Updated >= wantUpdated && status.Ready == status.Desired
+	case "daemonset":
+		ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		status.Desired = ds.Status.DesiredNumberScheduled
+		status.Updated = ds.Status.UpdatedNumberScheduled
+		status.Ready = ds.Status.NumberReady
+		status.Available = ds.Status.NumberAvailable
+		status.Done = ds.Status.ObservedGeneration >= ds.Generation &&
+			status.Updated == status.Desired && status.Available == status.Desired
+	}
+	return status, nil
+}
+
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// WorkloadEvents returns the latest events of a workload and of the replicasets and pods it
+// owns, newest first. Owned objects are matched by the name prefix controllers give them.
+func (s *Service) WorkloadEvents(ctx context.Context, clusterID int64, kind, namespace, name string, limit int) ([]model.KubernetesEvent, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := client.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]*corev1.Event, 0)
+	for i := range events.Items {
+		object := events.Items[i].InvolvedObject
+		own := object.Name == name && strings.EqualFold(object.Kind, kind)
+		owned := strings.HasPrefix(object.Name, name+"-") && (object.Kind == "Pod" || object.Kind == "ReplicaSet")
+		if own || owned {
+			matched = append(matched, &events.Items[i])
+		}
+	}
+	items := make([]model.KubernetesEvent, 0, len(matched))
+	for _, evt := range matched {
+		items = append(items, toKubernetesEvent(evt))
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].LastTimestamp > items[j].LastTimestamp })
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
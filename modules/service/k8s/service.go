@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
@@ -16,7 +17,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -33,34 +33,72 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 	sigyaml "sigs.k8s.io/yaml"
 
+	"github.com/thepenn/devsys/internal/metrics"
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/internal/tenancy"
 	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
 	systemService "github.com/thepenn/devsys/service/system"
 )
 
+var errSystemUnavailable = model.NewFeatureUnavailableError(model.CapabilityKubernetes, "system service unavailable")
+
+// ErrClusterNotFound is returned for clusters that do not exist or belong to an organization
+// outside the scope of the caller.
+var ErrClusterNotFound = errors.New("cluster not found")
+
+// fieldManager names devsys in the server-side apply data of the objects it writes, so drift
+// findings can tell its fields from those changed by other tools.
+const fieldManager = "devsys"
+
 // Service exposes helper APIs to work with Kubernetes clusters stored as certificates.
 type Service struct {
-	system *systemService.Service
+	system  *systemService.Service
+	metrics *metrics.Registry
+	// db stores deploy targets; nil disables drift tracking.
+	db            *store.DB
+	drift         DriftNotifier
+	driftInterval time.Duration
+	// audit records writes to clusters; nil disables it.
+	audit *audit.Service
+	// recordingDir stores exec recordings over recordingInlineMax bytes; empty uses a
+	// directory in the temp dir. Recording needs db.
+	recordingDir       string
+	recordingInlineMax int64
 
 	mu          sync.RWMutex
 	clientCache map[int64]*rest.Config
 	dynCache    map[int64]dynamic.Interface
-	discoCache  map[int64]discovery.DiscoveryInterface
+	discoCache  map[int64]discovery.CachedDiscoveryInterface
+	// discoAt holds when the cached discovery data of each cluster was last read.
+	discoAt map[int64]time.Time
+	health  map[int64]model.KubernetesClusterHealth
 }
 
 // New creates a new Kubernetes helper service.
-func New(system *systemService.Service) *Service {
-	return &Service{
+func New(system *systemService.Service, registry *metrics.Registry, opts ...Option) *Service {
+	s := &Service{
 		system:      system,
+		metrics:     registry,
 		clientCache: map[int64]*rest.Config{},
 		dynCache:    map[int64]dynamic.Interface{},
-		discoCache:  map[int64]discovery.DiscoveryInterface{},
+		discoCache:  map[int64]discovery.CachedDiscoveryInterface{},
+		discoAt:     map[int64]time.Time{},
+		health:      map[int64]model.KubernetesClusterHealth{},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if system != nil {
+		system.OnCertificateChange(s.InvalidateCluster)
+	}
+	return s
 }
 
 // ListClusters lists all kubernetes certificates.
 func (s *Service) ListClusters(ctx context.Context) ([]model.KubernetesClusterSummary, error) {
 	if s.system == nil {
-		return nil, fmt.Errorf("system service unavailable")
+		return nil, errSystemUnavailable
 	}
 	certs, _, err := s.system.ListCertificates(ctx, model.ListOptions{All: true}, model.CertificateFilter{
 		Type: model.CertificateTypeKubernetes,
@@ -110,14 +148,14 @@ func (s *Service) ListNamespaces(ctx context.Context, clusterID int64) ([]model.
 
 // ListResources lists resources by query.
 func (s *Service) ListResources(ctx context.Context, clusterID int64, query model.KubernetesResourceQuery) ([]map[string]interface{}, error) {
-	if strings.TrimSpace(query.Resource) == "" {
-		return nil, fmt.Errorf("resource is required")
+	gvr, err := s.queryGVR(ctx, clusterID, query)
+	if err != nil {
+		return nil, err
 	}
 	client, err := s.dynamicClient(ctx, clusterID)
 	if err != nil {
 		return nil, err
 	}
-	gvr := resolveGVR(query.Group, query.Version, query.Resource)
 	resource := client.Resource(gvr)
 	target := dynamic.ResourceInterface(resource)
 	if ns := strings.TrimSpace(query.Namespace); ns != "" {
@@ -139,14 +177,17 @@ func (s *Service) ListResources(ctx context.Context, clusterID int64, query mode
 
 // GetResource returns a single resource.
 func (s *Service) GetResource(ctx context.Context, clusterID int64, query model.KubernetesResourceQuery) (*model.KubernetesObjectResponse, error) {
-	if strings.TrimSpace(query.Resource) == "" || strings.TrimSpace(query.Name) == "" {
-		return nil, fmt.Errorf("resource and name are required")
+	if strings.TrimSpace(query.Name) == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	gvr, err := s.queryGVR(ctx, clusterID, query)
+	if err != nil {
+		return nil, err
 	}
 	client, err := s.dynamicClient(ctx, clusterID)
 	if err != nil {
 		return nil, err
 	}
-	gvr := resolveGVR(query.Group, query.Version, query.Resource)
 	resource := client.Resource(gvr)
 	target := dynamic.ResourceInterface(resource)
 	if ns := strings.TrimSpace(query.Namespace); ns != "" {
@@ -159,48 +200,6 @@ func (s *Service) GetResource(ctx context.Context, clusterID int64, query model.
 	return buildObjectResponse(obj)
 }
 
-// ApplyManifest applies manifest to cluster.
-func (s *Service) ApplyManifest(ctx context.Context, clusterID int64, req model.KubernetesManifestRequest) (*model.KubernetesObjectResponse, error) {
-	manifest := strings.TrimSpace(req.Manifest)
-	if manifest == "" {
-		return nil, fmt.Errorf("manifest is required")
-	}
-	if strings.TrimSpace(req.Resource) == "" {
-		return nil, fmt.Errorf("resource is required")
-	}
-	gvr := resolveGVR(req.Group, req.Version, req.Resource)
-	obj, namespace, err := decodeManifest(manifest, req.Namespace)
-	if err != nil {
-		return nil, err
-	}
-	client, err := s.dynamicClient(ctx, clusterID)
-	if err != nil {
-		return nil, err
-	}
-	resource := client.Resource(gvr)
-	target := dynamic.ResourceInterface(resource)
-	if namespace != "" {
-		target = resource.Namespace(namespace)
-	}
-	current, err := target.Get(ctx, obj.GetName(), metav1.GetOptions{})
-	if err != nil {
-		if !k8serrors.IsNotFound(err) {
-			return nil, err
-		}
-		created, err := target.Create(ctx, obj, metav1.CreateOptions{})
-		if err != nil {
-			return nil, err
-		}
-		return buildObjectResponse(created)
-	}
-	obj.SetResourceVersion(current.GetResourceVersion())
-	updated, err := target.Update(ctx, obj, metav1.UpdateOptions{})
-	if err != nil {
-		return nil, err
-	}
-	return buildObjectResponse(updated)
-}
-
 // DeleteResource deletes resource.
 func (s *Service) DeleteResource(ctx context.Context, clusterID int64, req model.KubernetesResourceDeleteRequest) error {
 	if strings.TrimSpace(req.Resource) == "" || strings.TrimSpace(req.Name) == "" {
@@ -216,7 +215,11 @@ func (s *Service) DeleteResource(ctx context.Context, clusterID int64, req model
 	if ns := strings.TrimSpace(req.Namespace); ns != "" {
 		target = resource.Namespace(ns)
 	}
-	return target.Delete(ctx, req.Name, metav1.DeleteOptions{})
+	if err := target.Delete(ctx, req.Name, metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sDelete, clusterID, req.Namespace, gvr.Resource, req.Name, nil)
+	return nil
 }
 
 // AggregateDeployment collects deployment and related resources.
@@ -339,6 +342,9 @@ func (s *Service) ListWorkloadPods(ctx context.Context, clusterID int64, kind, n
 	for _, pod := range podList.Items {
 		rows = append(rows, buildPodRow(&pod))
 	}
+	if usage := s.podUsage(ctx, clusterID, namespace, selector.String()); usage != nil {
+		applyPodUsage(rows, usage)
+	}
 	return rows, nil
 }
 
@@ -389,6 +395,10 @@ func (s *Service) ExecPod(ctx context.Context, clusterID int64, req model.Kubern
 	if err != nil {
 		return nil, err
 	}
+	s.recordAudit(ctx, model.AuditActionK8sExec, clusterID, req.Namespace, "pods", req.Name, map[string]interface{}{
+		"container": container,
+		"command":   req.Command,
+	})
 	if err := exec.Stream(remotecommand.StreamOptions{
 		Stdout: &stdout,
 		Stderr: &stderr,
@@ -402,7 +412,7 @@ func (s *Service) ExecPod(ctx context.Context, clusterID int64, req model.Kubern
 	}, nil
 }
 
-// StreamPodExec establishes a streaming exec session.
+// StreamPodExec establishes a streaming exec session, recorded when the service has a store.
 func (s *Service) StreamPodExec(
 	ctx context.Context,
 	clusterID int64,
@@ -457,6 +467,21 @@ func (s *Service) StreamPodExec(
 	if err != nil {
 		return err
 	}
+	recorder, err := s.startExecRecording(ctx, clusterID, req, container, command)
+	if err != nil {
+		return err
+	}
+	auditMetadata := map[string]interface{}{
+		"container":   container,
+		"command":     command,
+		"interactive": true,
+	}
+	if recorder != nil {
+		defer recorder.finish()
+		stdin, stdout, stderr, sizeQueue = recorder.wrap(stdin, stdout, stderr, sizeQueue)
+		auditMetadata["session_id"] = recorder.session.ID
+	}
+	s.recordAudit(ctx, model.AuditActionK8sExec, clusterID, req.Namespace, "pods", req.Name, auditMetadata)
 	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{
 		Stdin:             stdin,
 		Stdout:            stdout,
@@ -515,22 +540,7 @@ func (s *Service) ListEvents(ctx context.Context, clusterID int64, namespace, ki
 	}
 	items := make([]model.KubernetesEvent, 0, len(events.Items))
 	for _, evt := range events.Items {
-		first := evt.FirstTimestamp.Unix()
-		if first == 0 {
-			first = evt.EventTime.Unix()
-		}
-		last := evt.LastTimestamp.Unix()
-		if last == 0 {
-			last = evt.EventTime.Unix()
-		}
-		items = append(items, model.KubernetesEvent{
-			Type:           evt.Type,
-			Reason:         evt.Reason,
-			Message:        evt.Message,
-			Count:          evt.Count,
-			FirstTimestamp: first,
-			LastTimestamp:  last,
-		})
+		items = append(items, toKubernetesEvent(&evt))
 	}
 	total := int64(len(items))
 	page := opts.Page
@@ -552,6 +562,26 @@ func (s *Service) ListEvents(ctx context.Context, clusterID int64, namespace, ki
 	return items[start:end], total, nil
 }
 
+func toKubernetesEvent(evt *corev1.Event) model.KubernetesEvent {
+	first := evt.FirstTimestamp.Unix()
+	if first == 0 {
+		first = evt.EventTime.Unix()
+	}
+	last := evt.LastTimestamp.Unix()
+	if last == 0 {
+		last = evt.EventTime.Unix()
+	}
+	return model.KubernetesEvent{
+		Object:         evt.InvolvedObject.Kind + "/" + evt.InvolvedObject.Name,
+		Type:           evt.Type,
+		Reason:         evt.Reason,
+		Message:        evt.Message,
+		Count:          evt.Count,
+		FirstTimestamp: first,
+		LastTimestamp:  last,
+	}
+}
+
 // WorkloadDetails returns related resources for workload kinds (deployment/statefulset/daemonset).
 func (s *Service) WorkloadDetails(ctx context.Context, clusterID int64, kind, namespace, name string) (*model.KubernetesWorkloadDetails, error) {
 	client, err := s.typedClient(ctx, clusterID)
@@ -618,6 +648,9 @@ func (s *Service) WorkloadDetails(ctx context.Context, clusterID int64, kind, na
 		for _, pod := range podList.Items {
 			result.Pods = append(result.Pods, buildPodRow(&pod))
 		}
+		if usage := s.podUsage(ctx, clusterID, namespace, labelSelector.String()); usage != nil {
+			result.Overview.Usage = applyPodUsage(result.Pods, usage)
+		}
 	}
 
 	matchedServices := map[string]struct{}{}
@@ -962,13 +995,35 @@ func (s *Service) WorkloadHistory(ctx context.Context, clusterID int64, kind, na
 			return nil, err
 		}
 		return deploymentHistoryEntries(ctx, client, dep)
+	case "statefulset":
+		sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return controllerRevisionHistoryEntries(ctx, client, namespace, sts.UID)
+	case "daemonset":
+		ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return controllerRevisionHistoryEntries(ctx, client, namespace, ds.UID)
 	default:
 		return nil, fmt.Errorf("history for %s not supported", kind)
 	}
 }
 
-// RollbackWorkload rolls workload back to a previous revision (deployment only).
+// RollbackWorkload rolls a deployment, statefulset or daemonset back to a previous revision.
 func (s *Service) RollbackWorkload(ctx context.Context, clusterID int64, kind, namespace, name string, revision int64) error {
+	if err := s.rollbackWorkload(ctx, clusterID, kind, namespace, name, revision); err != nil {
+		return err
+	}
+	s.recordAudit(ctx, model.AuditActionK8sRollback, clusterID, namespace, strings.ToLower(strings.TrimSpace(kind)), name, map[string]interface{}{
+		"revision": revision,
+	})
+	return nil
+}
+
+func (s *Service) rollbackWorkload(ctx context.Context, clusterID int64, kind, namespace, name string, revision int64) error {
 	if revision <= 0 {
 		return fmt.Errorf("revision must be greater than zero")
 	}
@@ -994,6 +1049,10 @@ func (s *Service) RollbackWorkload(ctx context.Context, clusterID int64, kind, n
 		dep.Spec.Template.Annotations["devsys.dev/rollback-revision"] = fmt.Sprintf("%d", revision)
 		_, err = client.AppsV1().Deployments(namespace).Update(ctx, dep, metav1.UpdateOptions{})
 		return err
+	case "statefulset":
+		return rollbackStatefulSet(ctx, client, namespace, name, revision)
+	case "daemonset":
+		return rollbackDaemonSet(ctx, client, namespace, name, revision)
 	default:
 		return fmt.Errorf("rollback for %s not implemented", kind)
 	}
@@ -1332,6 +1391,9 @@ func (s *Service) typedClient(ctx context.Context, clusterID int64) (kubernetes.
 }
 
 func (s *Service) dynamicClient(ctx context.Context, clusterID int64) (dynamic.Interface, error) {
+	if err := s.ensureClusterInScope(ctx, clusterID); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	if client, ok := s.dynCache[clusterID]; ok {
 		s.mu.RUnlock()
@@ -1353,8 +1415,8 @@ func (s *Service) dynamicClient(ctx context.Context, clusterID int64) (dynamic.I
 }
 
 func (s *Service) restConfig(ctx context.Context, clusterID int64) (*rest.Config, error) {
-	if s.system == nil {
-		return nil, fmt.Errorf("system service unavailable")
+	if err := s.ensureClusterInScope(ctx, clusterID); err != nil {
+		return nil, err
 	}
 	s.mu.RLock()
 	if cfg, ok := s.clientCache[clusterID]; ok {
@@ -1368,7 +1430,7 @@ func (s *Service) restConfig(ctx context.Context, clusterID int64) (*rest.Config
 		return nil, err
 	}
 	if cert == nil {
-		return nil, fmt.Errorf("cluster %d not found", clusterID)
+		return nil, fmt.Errorf("%w: %d", ErrClusterNotFound, clusterID)
 	}
 	kubeCert, err := cert.AsKubernetesCertificate()
 	if err != nil {
@@ -1384,6 +1446,9 @@ func (s *Service) restConfig(ctx context.Context, clusterID int64) (*rest.Config
 	cfg.QPS = 50
 	cfg.Burst = 100
 	cfg.Timeout = 30 * time.Second
+	if s.metrics != nil {
+		cfg.Wrap(instrumentRoundTripper(s.metrics, cert.Name))
+	}
 
 	s.mu.Lock()
 	s.clientCache[clusterID] = cfg
@@ -1391,6 +1456,25 @@ func (s *Service) restConfig(ctx context.Context, clusterID int64) (*rest.Config
 	return cfg, nil
 }
 
+// ensureClusterInScope checks the organization of a cluster before cached clients are handed
+// out, since the caches are shared by all callers.
+func (s *Service) ensureClusterInScope(ctx context.Context, clusterID int64) error {
+	if s.system == nil {
+		return errSystemUnavailable
+	}
+	if tenancy.FromContext(ctx).All {
+		return nil
+	}
+	cert, err := s.system.GetCertificate(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if cert == nil || cert.Type != model.CertificateTypeKubernetes {
+		return fmt.Errorf("%w: %d", ErrClusterNotFound, clusterID)
+	}
+	return nil
+}
+
 func resolveGVR(group, version, resource string) schema.GroupVersionResource {
 	gvr := schema.GroupVersionResource{
 		Group:    strings.TrimSpace(group),
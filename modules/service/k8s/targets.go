@@ -0,0 +1,313 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
+)
+
+// ErrTargetNotFound is returned for targets that do not exist or belong to another repository.
+var ErrTargetNotFound = errors.New("kubernetes target not found")
+
+// ErrTargetInvalid is returned when an object to adopt is not fully identified.
+var ErrTargetInvalid = errors.New("kubernetes target is invalid")
+
+var errTargetStoreUnavailable = model.NewFeatureUnavailableError(model.CapabilityKubernetes, "target store unavailable")
+
+// DriftNotifier announces targets whose live object drifted from the baseline.
+type DriftNotifier interface {
+	NotifyDrift(target *model.KubernetesTarget)
+}
+
+// Option configures the service.
+type Option func(*Service)
+
+// WithStore persists the deploy targets of repositories; drift tracking is unavailable
+// without it.
+func WithStore(db *store.DB) Option {
+	return func(s *Service) {
+		s.db = db
+	}
+}
+
+// WithDriftCheckInterval sets how often StartDriftChecks checks every target; 0 disables it.
+func WithDriftCheckInterval(interval time.Duration) Option {
+	return func(s *Service) {
+		s.driftInterval = interval
+	}
+}
+
+// WithAudit records applies, deletes, execs and rollbacks.
+func WithAudit(recorder *audit.Service) Option {
+	return func(s *Service) {
+		s.audit = recorder
+	}
+}
+
+// SetDriftNotifier announces drift found by checks. The pipeline service both notifies drift
+// and deploys through this service, so the notifier is set after both are built and before
+// StartDriftChecks.
+func (s *Service) SetDriftNotifier(notifier DriftNotifier) {
+	s.drift = notifier
+}
+
+// ListTargets lists the deploy targets of a repository.
+func (s *Service) ListTargets(ctx context.Context, repoID int64) ([]*model.KubernetesTarget, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	var targets []*model.KubernetesTarget
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Order("cluster_id ASC, namespace ASC, kind ASC, name ASC").
+			Find(&targets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// RecordApplied stores obj, as returned by the server after a pipeline applied it, as the
+// baseline of its target.
+func (s *Service) RecordApplied(ctx context.Context, repoID, pipelineID, clusterID int64, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	if s.db == nil {
+		return errTargetStoreUnavailable
+	}
+	_, err := s.saveBaseline(ctx, repoID, clusterID, gvr, obj, model.KubernetesTargetApplied, pipelineID)
+	return err
+}
+
+// AdoptTarget records the current live state of an existing object as the baseline of a
+// repository target without changing the object.
+func (s *Service) AdoptTarget(ctx context.Context, repoID int64, ref model.KubernetesTargetRef) (*model.KubernetesTarget, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	if strings.TrimSpace(ref.Resource) == "" || strings.TrimSpace(ref.Name) == "" {
+		return nil, fmt.Errorf("%w: resource and name are required", ErrTargetInvalid)
+	}
+	gvr := resolveGVR(ref.Group, ref.Version, ref.Resource)
+	namespace := strings.TrimSpace(ref.Namespace)
+	live, err := s.fetchLive(ctx, ref.ClusterID, gvr, namespace, strings.TrimSpace(ref.Name))
+	if err != nil {
+		return nil, err
+	}
+	// callers are authorized for the namespace they name; a cluster-scoped object fetched
+	// under a namespace lies outside of it
+	if live.GetNamespace() != namespace {
+		return nil, fmt.Errorf("%w: %s %s is not in namespace %q", ErrNamespaceForbidden, live.GetKind(), live.GetName(), namespace)
+	}
+	return s.saveBaseline(ctx, repoID, ref.ClusterID, gvr, live, model.KubernetesTargetAdopted, 0)
+}
+
+// DeleteTarget stops tracking a target; the live object is left alone.
+func (s *Service) DeleteTarget(ctx context.Context, repoID, id int64) error {
+	if s.db == nil {
+		return errTargetStoreUnavailable
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("id = ? AND repo_id = ?", id, repoID).Delete(&model.KubernetesTarget{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTargetNotFound
+		}
+		return nil
+	})
+}
+
+// CheckDrift compares the live object of a target with its baseline and records the result.
+func (s *Service) CheckDrift(ctx context.Context, repoID, id int64) (*model.KubernetesTarget, error) {
+	if s.db == nil {
+		return nil, errTargetStoreUnavailable
+	}
+	var target model.KubernetesTarget
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("id = ? AND repo_id = ?", id, repoID).Take(&target).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTargetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkTarget(ctx, &target); err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// StartDriftChecks checks every target each drift check interval until ctx is done.
+func (s *Service) StartDriftChecks(ctx context.Context) {
+	if s == nil || s.db == nil || s.driftInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.driftInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.checkAllTargets(ctx); err != nil && ctx.Err() == nil {
+					log.Warn().Err(err).Msg("failed to run kubernetes drift checks")
+				}
+			}
+		}
+	}()
+}
+
+func (s *Service) checkAllTargets(ctx context.Context) error {
+	var targets []*model.KubernetesTarget
+	if err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Order("id ASC").Find(&targets).Error
+	}); err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// unreachable clusters are recorded on the target and do not stop the sweep
+		if err := s.checkTarget(ctx, target); err != nil {
+			log.Warn().Err(err).Int64("target_id", target.ID).Msg("failed to record drift check")
+		}
+	}
+	return nil
+}
+
+// checkTarget diffs the live object against the baseline, stores the outcome and notifies
+// when the target newly drifted or its findings changed.
+func (s *Service) checkTarget(ctx context.Context, target *model.KubernetesTarget) error {
+	previousState := target.DriftState
+	previousPaths := findingPaths(target.Findings)
+
+	now := time.Now().Unix()
+	target.CheckedAt = now
+	target.CheckError = ""
+	gvr := resolveGVR(target.Group, target.Version, target.Resource)
+	live, err := s.fetchLive(ctx, target.ClusterID, gvr, target.Namespace, target.Name)
+	switch {
+	case k8serrors.IsNotFound(err):
+		target.DriftState = model.KubernetesDriftMissing
+		target.Findings = nil
+	case err != nil:
+		target.DriftState = model.KubernetesDriftUnknown
+		target.Findings = nil
+		target.CheckError = err.Error()
+	default:
+		normalized, err := NormalizeObject(live.Object)
+		if err != nil {
+			return err
+		}
+		findings := DiffObjects(target.Baseline, normalized)
+		attributeManagers(live.Object, findings)
+		target.Findings = findings
+		target.DriftState = model.KubernetesDriftInSync
+		if len(findings) > 0 {
+			target.DriftState = model.KubernetesDriftDrifted
+		}
+	}
+
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		// struct updates go through the JSON serializer of findings; Select also writes zero values
+		return tx.WithContext(ctx).Model(target).
+			Select("drift_state", "findings", "check_error", "checked_at").
+			Updates(target).Error
+	}); err != nil {
+		return err
+	}
+
+	drifted := target.DriftState == model.KubernetesDriftDrifted || target.DriftState == model.KubernetesDriftMissing
+	if drifted && s.drift != nil &&
+		(previousState != target.DriftState || previousPaths != findingPaths(target.Findings)) {
+		s.drift.NotifyDrift(target)
+	}
+	return nil
+}
+
+func findingPaths(findings []model.KubernetesDriftFinding) string {
+	paths := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		paths = append(paths, finding.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (s *Service) fetchLive(ctx context.Context, clusterID int64, gvr schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error) {
+	client, err := s.dynamicClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	resource := client.Resource(gvr)
+	target := dynamic.ResourceInterface(resource)
+	if namespace != "" {
+		target = resource.Namespace(namespace)
+	}
+	return target.Get(ctx, name, metav1.GetOptions{})
+}
+
+// saveBaseline upserts the target of obj with the normalized object as its baseline.
+func (s *Service) saveBaseline(ctx context.Context, repoID, clusterID int64, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, source string, pipelineID int64) (*model.KubernetesTarget, error) {
+	if obj == nil {
+		return nil, fmt.Errorf("object is nil")
+	}
+	baseline, err := NormalizeObject(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var target model.KubernetesTarget
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.WithContext(ctx).
+			Where("repo_id = ? AND cluster_id = ? AND namespace = ? AND api_group = ? AND kind = ? AND name = ?",
+				repoID, clusterID, obj.GetNamespace(), gvr.Group, obj.GetKind(), obj.GetName()).
+			Take(&target).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		target.RepoID = repoID
+		target.ClusterID = clusterID
+		target.Namespace = obj.GetNamespace()
+		target.Group = gvr.Group
+		target.Version = gvr.Version
+		target.Kind = obj.GetKind()
+		target.Resource = gvr.Resource
+		target.Name = obj.GetName()
+		target.Source = source
+		target.PipelineID = pipelineID
+		target.Baseline = baseline
+		target.DriftState = model.KubernetesDriftInSync
+		target.Findings = nil
+		target.CheckError = ""
+		target.CheckedAt = now
+		target.Updated = now
+		if target.ID == 0 {
+			target.Created = now
+			return tx.WithContext(ctx).Create(&target).Error
+		}
+		return tx.WithContext(ctx).Save(&target).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
@@ -0,0 +1,161 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// podMetricsGVR is the PodMetrics resource served by metrics-server. It is read through the
+// dynamic client so the metrics API types are not needed.
+var podMetricsGVR = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+// metricsClient returns the PodMetrics client of a cluster, or nil when the cluster does not
+// serve the metrics.k8s.io API.
+func (s *Service) metricsClient(ctx context.Context, clusterID int64) (dynamic.NamespaceableResourceInterface, error) {
+	disco, err := s.discoveryClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := disco.ServerResourcesForGroupVersion(podMetricsGVR.GroupVersion().String()); err != nil {
+		return nil, nil
+	}
+	client, err := s.dynamicClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return client.Resource(podMetricsGVR), nil
+}
+
+// podUsage returns the latest metrics-server samples of the pods matching selector by pod
+// name. It returns nil when metrics are unavailable, so callers omit usage instead of failing.
+func (s *Service) podUsage(ctx context.Context, clusterID int64, namespace, selector string) map[string]model.KubernetesPodMetrics {
+	client, err := s.metricsClient(ctx, clusterID)
+	if err != nil || client == nil {
+		return nil
+	}
+	list, err := client.Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		log.Debug().Err(err).Int64("cluster_id", clusterID).Str("namespace", namespace).Msg("failed to list pod metrics")
+		return nil
+	}
+	usage := make(map[string]model.KubernetesPodMetrics, len(list.Items))
+	for i := range list.Items {
+		sample := parsePodMetrics(&list.Items[i])
+		usage[sample.Name] = sample
+	}
+	return usage
+}
+
+func parsePodMetrics(obj *unstructured.Unstructured) model.KubernetesPodMetrics {
+	sample := model.KubernetesPodMetrics{Name: obj.GetName()}
+	if ts, ok, _ := unstructured.NestedString(obj.Object, "timestamp"); ok {
+		if parsed, err := time.Parse(time.RFC3339, ts); err == nil {
+			sample.Timestamp = parsed.Unix()
+		}
+	}
+	sample.Window, _, _ = unstructured.NestedString(obj.Object, "window")
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "containers")
+	for _, raw := range containers {
+		entry, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(entry, "name")
+		container := model.KubernetesContainerUsage{Name: name}
+		if cpu, ok, _ := unstructured.NestedString(entry, "usage", "cpu"); ok {
+			if q, err := resource.ParseQuantity(cpu); err == nil {
+				container.CPUMillicores = q.MilliValue()
+			}
+		}
+		if mem, ok, _ := unstructured.NestedString(entry, "usage", "memory"); ok {
+			if q, err := resource.ParseQuantity(mem); err == nil {
+				container.MemoryBytes = q.Value()
+			}
+		}
+		sample.Usage.CPUMillicores += container.CPUMillicores
+		sample.Usage.MemoryBytes += container.MemoryBytes
+		sample.Containers = append(sample.Containers, container)
+	}
+	sort.Slice(sample.Containers, func(i, j int) bool {
+		return sample.Containers[i].Name < sample.Containers[j].Name
+	})
+	return sample
+}
+
+// applyPodUsage copies the usage of the sampled pods into rows and returns their sum, or nil
+// when no pod was sampled.
+func applyPodUsage(rows []model.KubernetesPodRow, usage map[string]model.KubernetesPodMetrics) *model.KubernetesResourceUsage {
+	var total *model.KubernetesResourceUsage
+	for i := range rows {
+		sample, ok := usage[rows[i].Name]
+		if !ok {
+			continue
+		}
+		podUsage := sample.Usage
+		rows[i].Usage = &podUsage
+		rows[i].ContainerUsage = sample.Containers
+		if total == nil {
+			total = &model.KubernetesResourceUsage{}
+		}
+		total.CPUMillicores += podUsage.CPUMillicores
+		total.MemoryBytes += podUsage.MemoryBytes
+	}
+	return total
+}
+
+// WorkloadMetrics returns the current usage of the pods of a deployment, statefulset or
+// daemonset. Clusters without metrics-server report Available false instead of an error.
+func (s *Service) WorkloadMetrics(ctx context.Context, clusterID int64, kind, namespace, name string) (*model.KubernetesWorkloadMetrics, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	labelSelector, err := s.selectorForWorkload(ctx, client, kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if labelSelector == nil {
+		return nil, fmt.Errorf("workload %s has no selector", name)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	result := &model.KubernetesWorkloadMetrics{
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Pods:      []model.KubernetesPodMetrics{},
+	}
+	usage := s.podUsage(ctx, clusterID, namespace, selector.String())
+	if usage == nil {
+		return result, nil
+	}
+	result.Available = true
+	for _, sample := range usage {
+		if result.Usage == nil {
+			result.Usage = &model.KubernetesResourceUsage{}
+		}
+		result.Usage.CPUMillicores += sample.Usage.CPUMillicores
+		result.Usage.MemoryBytes += sample.Usage.MemoryBytes
+		if sample.Timestamp > result.Timestamp {
+			result.Timestamp = sample.Timestamp
+		}
+		result.Pods = append(result.Pods, sample)
+	}
+	sort.Slice(result.Pods, func(i, j int) bool {
+		return result.Pods[i].Name < result.Pods[j].Name
+	})
+	return result, nil
+}
@@ -0,0 +1,129 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// errWatchExpired ends a watch whose resource version the server no longer keeps.
+var errWatchExpired = errors.New("watch expired")
+
+// WatchResources streams the resources matching query to emit. It starts with a snapshot of
+// the current list, then sends ADDED, MODIFIED and DELETED events from that resource version
+// on. Watches the server closes are resumed from the last seen version; expired ones (410 Gone)
+// list again and send a new snapshot. It returns when ctx is done or emit fails.
+func (s *Service) WatchResources(ctx context.Context, clusterID int64, query model.KubernetesResourceQuery, emit func(model.KubernetesWatchEvent) error) error {
+	gvr, err := s.queryGVR(ctx, clusterID, query)
+	if err != nil {
+		return err
+	}
+	client, err := s.dynamicClient(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	resource := client.Resource(gvr)
+	target := dynamic.ResourceInterface(resource)
+	if ns := strings.TrimSpace(query.Namespace); ns != "" {
+		target = resource.Namespace(ns)
+	}
+	opts := metav1.ListOptions{
+		LabelSelector: query.LabelSelector,
+		FieldSelector: query.FieldSelector,
+	}
+
+	resourceVersion := ""
+	for {
+		if resourceVersion == "" {
+			list, err := target.List(ctx, opts)
+			if err != nil {
+				return err
+			}
+			resourceVersion = list.GetResourceVersion()
+			objects := make([]map[string]interface{}, 0, len(list.Items))
+			for _, item := range list.Items {
+				objects = append(objects, item.UnstructuredContent())
+			}
+			if err := emit(model.KubernetesWatchEvent{
+				Type:            model.KubernetesWatchSnapshot,
+				ResourceVersion: resourceVersion,
+				Objects:         objects,
+			}); err != nil {
+				return err
+			}
+		}
+
+		watchOpts := opts
+		watchOpts.ResourceVersion = resourceVersion
+		watchOpts.AllowWatchBookmarks = true
+		w, err := target.Watch(ctx, watchOpts)
+		if err != nil {
+			if isWatchExpired(err) {
+				resourceVersion = ""
+				continue
+			}
+			return err
+		}
+		resourceVersion, err = forwardWatch(ctx, w, resourceVersion, emit)
+		if errors.Is(err, errWatchExpired) {
+			resourceVersion = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// forwardWatch passes the events of w to emit until the watch ends, returning the last
+// resource version seen so the caller can resume.
+func forwardWatch(ctx context.Context, w watch.Interface, resourceVersion string, emit func(model.KubernetesWatchEvent) error) (string, error) {
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return resourceVersion, ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return resourceVersion, nil
+			}
+			switch event.Type {
+			case watch.Error:
+				err := k8serrors.FromObject(event.Object)
+				if isWatchExpired(err) {
+					return resourceVersion, errWatchExpired
+				}
+				return resourceVersion, err
+			case watch.Bookmark:
+				if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+					resourceVersion = obj.GetResourceVersion()
+				}
+			case watch.Added, watch.Modified, watch.Deleted:
+				obj, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					continue
+				}
+				resourceVersion = obj.GetResourceVersion()
+				if err := emit(model.KubernetesWatchEvent{
+					Type:            string(event.Type),
+					ResourceVersion: resourceVersion,
+					Object:          obj.UnstructuredContent(),
+				}); err != nil {
+					return resourceVersion, err
+				}
+			}
+		}
+	}
+}
+
+func isWatchExpired(err error) bool {
+	return k8serrors.IsGone(err) || k8serrors.IsResourceExpired(err)
+}
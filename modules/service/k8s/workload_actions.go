@@ -0,0 +1,232 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// MaxWorkloadReplicas bounds ScaleWorkload so a typo cannot start thousands of pods.
+const MaxWorkloadReplicas = 1000
+
+// previousImageAnnotation records the image SetWorkloadImage replaced as <container>=<image>.
+const previousImageAnnotation = "devsys.dev/previous-image"
+
+// ErrWorkloadActionInvalid is returned for actions a workload kind does not support and for
+// invalid action parameters.
+var ErrWorkloadActionInvalid = errors.New("workload action is invalid")
+
+// RestartWorkload restarts the pods of a deployment, statefulset or daemonset through a
+// rolling update, like `kubectl rollout restart`, and returns the updated overview.
+func (s *Service) RestartWorkload(ctx context.Context, clusterID int64, kind, namespace, name string) (*model.KubernetesWorkloadOverview, error) {
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`,
+		time.Now().Format(time.RFC3339)))
+	opts := metav1.PatchOptions{FieldManager: fieldManager}
+
+	var overview model.KubernetesWorkloadOverview
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "deployment":
+		dep, err := client.AppsV1().Deployments(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		overview = buildDeploymentOverview(dep)
+	case "statefulset":
+		sts, err := client.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		overview = buildStatefulSetOverview(sts)
+	case "daemonset":
+		ds, err := client.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		overview = buildDaemonSetOverview(ds)
+	default:
+		return nil, fmt.Errorf("%w: restart for %s not supported", ErrWorkloadActionInvalid, kind)
+	}
+	return &overview, nil
+}
+
+// ScaleWorkload sets the replica count of a deployment or statefulset through the scale
+// subresource and returns the updated overview.
+func (s *Service) ScaleWorkload(ctx context.Context, clusterID int64, kind, namespace, name string, replicas int32) (*model.KubernetesWorkloadOverview, error) {
+	if replicas < 0 || replicas > MaxWorkloadReplicas {
+		return nil, fmt.Errorf("%w: replicas must be between 0 and %d", ErrWorkloadActionInvalid, MaxWorkloadReplicas)
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	updateOpts := metav1.UpdateOptions{FieldManager: fieldManager}
+
+	var overview model.KubernetesWorkloadOverview
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "deployment":
+		deployments := client.AppsV1().Deployments(namespace)
+		scale, err := deployments.GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		scale.Spec.Replicas = replicas
+		if _, err := deployments.UpdateScale(ctx, name, scale, updateOpts); err != nil {
+			return nil, err
+		}
+		dep, err := deployments.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		overview = buildDeploymentOverview(dep)
+	case "statefulset":
+		statefulSets := client.AppsV1().StatefulSets(namespace)
+		scale, err := statefulSets.GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		scale.Spec.Replicas = replicas
+		if _, err := statefulSets.UpdateScale(ctx, name, scale, updateOpts); err != nil {
+			return nil, err
+		}
+		sts, err := statefulSets.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		overview = buildStatefulSetOverview(sts)
+	case "daemonset":
+		return nil, fmt.Errorf("%w: daemonsets run one pod per eligible node and cannot be scaled", ErrWorkloadActionInvalid)
+	default:
+		return nil, fmt.Errorf("%w: scale for %s not supported", ErrWorkloadActionInvalid, kind)
+	}
+	return &overview, nil
+}
+
+// SetWorkloadImage points one container of a deployment, statefulset or daemonset at image,
+// leaving the rest of the pod template alone. The image needs an explicit tag or digest. With
+// recordPrevious the replaced image is kept in the devsys.dev/previous-image annotation.
+func (s *Service) SetWorkloadImage(ctx context.Context, clusterID int64, kind, namespace, name, container, image string, recordPrevious bool) (*model.KubernetesWorkloadImageUpdate, error) {
+	container = strings.TrimSpace(container)
+	if container == "" {
+		return nil, fmt.Errorf("%w: container is required", ErrWorkloadActionInvalid)
+	}
+	image, err := validateImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.typedClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	var template *corev1.PodTemplateSpec
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	switch kind {
+	case "deployment":
+		dep, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		template = &dep.Spec.Template
+	case "statefulset":
+		sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		template = &sts.Spec.Template
+	case "daemonset":
+		ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		template = &ds.Spec.Template
+	default:
+		return nil, fmt.Errorf("%w: image update for %s not supported", ErrWorkloadActionInvalid, kind)
+	}
+	previous, found := "", false
+	for _, c := range template.Spec.Containers {
+		if c.Name == container {
+			previous, found = c.Image, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: workload %s has no container %s", ErrWorkloadActionInvalid, name, container)
+	}
+
+	// a JSON merge patch would replace the whole container list; the strategic merge patch
+	// merges containers by name, so only the image of this one changes
+	patchBody := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{{"name": container, "image": image}},
+				},
+			},
+		},
+	}
+	if recordPrevious && previous != image {
+		patchBody["metadata"] = map[string]interface{}{
+			"annotations": map[string]string{previousImageAnnotation: container + "=" + previous},
+		}
+	}
+	patch, err := json.Marshal(patchBody)
+	if err != nil {
+		return nil, err
+	}
+	opts := metav1.PatchOptions{FieldManager: fieldManager}
+
+	result := &model.KubernetesWorkloadImageUpdate{Container: container, Image: image, PreviousImage: previous}
+	switch kind {
+	case "deployment":
+		dep, err := client.AppsV1().Deployments(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Overview = buildDeploymentOverview(dep)
+	case "statefulset":
+		sts, err := client.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Overview = buildStatefulSetOverview(sts)
+	case "daemonset":
+		ds, err := client.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Overview = buildDaemonSetOverview(ds)
+	}
+	return result, nil
+}
+
+// validateImageReference accepts image references with an explicit tag or digest.
+func validateImageReference(image string) (string, error) {
+	image = strings.TrimSpace(image)
+	if image == "" {
+		return "", fmt.Errorf("%w: image is required", ErrWorkloadActionInvalid)
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("%w: image %q: %v", ErrWorkloadActionInvalid, image, err)
+	}
+	_, tagged := named.(reference.Tagged)
+	_, digested := named.(reference.Digested)
+	if !tagged && !digested {
+		return "", fmt.Errorf("%w: image %q needs a tag or digest", ErrWorkloadActionInvalid, image)
+	}
+	return image, nil
+}
@@ -28,6 +28,27 @@ func AutoMigrate(db *store.DB) error {
 		&model.LogEntry{},
 		&model.Redirection{},
 		&model.Certificate{},
+		&model.ApproverGroup{},
+		&model.NamespaceLock{},
+		&model.Secret{},
+		&model.PipelineProvenance{},
+		&model.PipelineSnapshot{},
+		&model.Artifact{},
+		&model.NotificationTarget{},
+		&model.NotificationAttempt{},
+		&model.StepStatistic{},
+		&model.Organization{},
+		&model.OrgMember{},
+		&model.RepoMember{},
+		&model.KubernetesTarget{},
+		&model.APIToken{}, &model.RepoVariable{}, &model.ClusterPermission{},
+		&model.AuditEvent{},
+		&model.RepoPipelineConfigRevision{},
+		&model.EnvTemplate{},
+		&model.RevokedToken{},
+		&model.ExecSession{},
+		&model.Agent{},
+		&model.PluginDefinition{},
 	); err != nil {
 		return err
 	}
@@ -61,10 +82,21 @@ func AutoMigrate(db *store.DB) error {
 		}
 	}
 
+	// global approver group names became unique per organization
+	if gormDB.Migrator().HasIndex(&model.ApproverGroup{}, "idx_approver_groups_repo_name") {
+		if err := gormDB.Migrator().DropIndex(&model.ApproverGroup{}, "idx_approver_groups_repo_name"); err != nil {
+			return err
+		}
+	}
+
 	if err := migratePipelineSettingsIntoConfig(gormDB); err != nil {
 		return err
 	}
 
+	if err := migrateDefaultOrganization(gormDB); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -189,3 +221,44 @@ func migrateCronSchedules(enabled bool, spec string) []string {
 	}
 	return []string{trimmed}
 }
+
+// migrateDefaultOrganization assigns data without an organization to the default one. When the
+// default organization is first created, the existing users join it so that enabling
+// multi-tenancy keeps their access.
+func migrateDefaultOrganization(gormDB *gorm.DB) error {
+	return gormDB.Transaction(func(tx *gorm.DB) error {
+		var org model.Organization
+		err := tx.Where("name = ?", model.DefaultOrganizationName).Take(&org).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			now := time.Now().Unix()
+			org = model.Organization{Name: model.DefaultOrganizationName, Created: now, Updated: now}
+			if err := tx.Create(&org).Error; err != nil {
+				return err
+			}
+			var userIDs []int64
+			if err := tx.Model(&model.User{}).Pluck("id", &userIDs).Error; err != nil {
+				return err
+			}
+			for _, userID := range userIDs {
+				if err := tx.Create(&model.OrgMember{
+					OrgID:   org.ID,
+					UserID:  userID,
+					Source:  model.OrgMemberSourceManual,
+					Created: now,
+				}).Error; err != nil {
+					return err
+				}
+			}
+		case err != nil:
+			return err
+		}
+
+		for _, owned := range []interface{}{&model.Certificate{}, &model.ApproverGroup{}, &model.Repo{}} {
+			if err := tx.Model(owned).Where("org_id = 0").Update("org_id", org.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,246 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// agentRetryBackoff is how long an agent waits after a failed call to the server.
+	agentRetryBackoff = 5 * time.Second
+	// agentCancelAfterFailures is how many heartbeats in a row may fail before an agent gives
+	// up its task, which the server has requeued by then.
+	agentCancelAfterFailures = 5
+)
+
+// AgentClient calls the agent endpoints of a server. Agents have no database: they take
+// tasks, read and write the records of their runs and report when they finished through
+// the server, authenticating with the agent token.
+type AgentClient struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// AgentRegistration is what an agent announces when it registers.
+type AgentRegistration struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// AgentHeartbeatRequest is sent by an agent every AgentHeartbeatInterval.
+type AgentHeartbeatRequest struct {
+	TaskID string `json:"task_id"`
+}
+
+// AgentHeartbeatResponse tells an agent whether to cancel the task it runs.
+type AgentHeartbeatResponse struct {
+	Cancel bool `json:"cancel"`
+}
+
+// AgentTaskResult reports a finished task; Error is empty on success.
+type AgentTaskResult struct {
+	Error string `json:"error,omitempty"`
+}
+
+// NewAgentClient returns a client for the server API at server, root path included.
+func NewAgentClient(server, token string) *AgentClient {
+	return &AgentClient{
+		server: strings.TrimRight(strings.TrimSpace(server), "/"),
+		token:  strings.TrimSpace(token),
+		// polls are held open by the server for up to AgentPollTimeout
+		http: &http.Client{Timeout: AgentPollTimeout + 15*time.Second},
+	}
+}
+
+// Register registers the agent and returns it with its id.
+func (c *AgentClient) Register(ctx context.Context, registration AgentRegistration) (*model.Agent, error) {
+	var agent model.Agent
+	if _, err := c.call(ctx, "/internal/agents/register", registration, &agent); err != nil {
+		return nil, err
+	}
+	return &agent, nil
+}
+
+// Next waits for the next task of the agent; it returns nil when none came in time.
+func (c *AgentClient) Next(ctx context.Context, agentID int64) (*model.Task, error) {
+	var task AgentTask
+	found, err := c.call(ctx, fmt.Sprintf("/internal/agents/%d/next", agentID), nil, &task)
+	if err != nil || !found {
+		return nil, err
+	}
+	task.Task.Data = task.Data
+	return &task.Task, nil
+}
+
+// Heartbeat reports the task the agent runs and returns whether to cancel it.
+func (c *AgentClient) Heartbeat(ctx context.Context, agentID int64, taskID string) (bool, error) {
+	var result AgentHeartbeatResponse
+	if _, err := c.call(ctx, fmt.Sprintf("/internal/agents/%d/heartbeat", agentID), AgentHeartbeatRequest{TaskID: taskID}, &result); err != nil {
+		return false, err
+	}
+	return result.Cancel, nil
+}
+
+// Complete reports that the agent finished taskID with taskErr.
+func (c *AgentClient) Complete(ctx context.Context, agentID int64, taskID string, taskErr error) error {
+	var result AgentTaskResult
+	if taskErr != nil {
+		result.Error = taskErr.Error()
+	}
+	_, err := c.call(ctx, fmt.Sprintf("/internal/agents/%d/tasks/%s/done", agentID, url.PathEscape(taskID)), result, nil)
+	return err
+}
+
+// call posts body to path and decodes the response into out. It reports false for an empty
+// response.
+func (c *AgentClient) call(ctx context.Context, path string, body, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server+path, reader)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return false, nil
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("agent %s: %s: %s", path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return true, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("agent %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// RunAgent registers with the server the service was made an agent of with WithAgentServer
+// and runs the tasks it hands out, one at a time, until ctx is done.
+func (s *Service) RunAgent(ctx context.Context, registration AgentRegistration) error {
+	remote, ok := s.store.(*agentStore)
+	if !ok {
+		return fmt.Errorf("agent runs need a service made with WithAgentServer")
+	}
+	client := remote.client
+	agent, err := client.Register(ctx, registration)
+	for err != nil {
+		log.Warn().Err(err).Msg("failed to register agent, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(agentRetryBackoff):
+		}
+		agent, err = client.Register(ctx, registration)
+	}
+	log.Info().Int64("agent_id", agent.ID).Str("name", agent.Name).Msg("agent registered, waiting for tasks")
+
+	for ctx.Err() == nil {
+		task, err := client.Next(ctx, agent.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Warn().Err(err).Msg("failed to poll for pipeline tasks")
+			select {
+			case <-ctx.Done():
+			case <-time.After(agentRetryBackoff):
+			}
+			continue
+		}
+		if task != nil {
+			remote.bind(agent.ID, task.ID)
+			s.runAgentTask(ctx, client, agent.ID, task)
+			remote.bind(agent.ID, "")
+		}
+	}
+	return nil
+}
+
+// runAgentTask runs task while sending heartbeats, cancels it when the server asks to or
+// cannot be reached for a while, and reports the result.
+func (s *Service) runAgentTask(ctx context.Context, client *AgentClient, agentID int64, task *model.Task) {
+	_, pipelineID := taskPipelineIDs(task)
+	log.Info().Str("task_id", task.ID).Int64("pipeline_id", pipelineID).Msg("agent received pipeline task")
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(AgentHeartbeatInterval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cancel, err := client.Heartbeat(ctx, agentID, task.ID)
+			if err != nil {
+				failures++
+				log.Warn().Err(err).Str("task_id", task.ID).Int("failures", failures).Msg("agent heartbeat failed")
+				cancel = failures >= agentCancelAfterFailures
+			} else {
+				failures = 0
+			}
+			if cancel {
+				s.cancelLocalExecution(pipelineID)
+				return
+			}
+		}
+	}()
+
+	taskErr := s.handleTask(ctx, task)
+	close(done)
+	if taskErr != nil {
+		log.Error().Err(taskErr).Str("task_id", task.ID).Msg("pipeline task failed on agent")
+	}
+	// reported even when ctx ended, so the server does not wait for the offline timeout
+	reportCtx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	if err := client.Complete(reportCtx, agentID, task.ID, taskErr); err != nil && !errors.Is(err, context.Canceled) {
+		log.Warn().Err(err).Str("task_id", task.ID).Msg("failed to report pipeline task result")
+	}
+}
+
+// cancelLocalExecution stops the pipeline running in this process, like a cancel does.
+func (s *Service) cancelLocalExecution(pipelineID int64) {
+	handleAny, ok := s.executions.Load(pipelineID)
+	if !ok {
+		return
+	}
+	if handle, ok := handleAny.(*executionHandle); ok && handle.cancel != nil {
+		log.Info().Int64("pipeline_id", pipelineID).Msg("cancelling pipeline on request of the server")
+		handle.cancel()
+		go s.stopExecutionContainers(handle)
+	}
+}
@@ -0,0 +1,312 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// The codes of the store errors an agent matches on.
+const (
+	agentStoreNotFound          = "not_found"
+	agentStoreIllegalTransition = "illegal_transition"
+)
+
+// AgentStoreResult answers a store call of an agent. Error and Code describe the error the
+// store failed with; Code names the error the agent matches on, when it is one.
+type AgentStoreResult struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Code   string          `json:"code,omitempty"`
+}
+
+// agentStoreArgs are the arguments of a store call; each call reads the ones it takes.
+type agentStoreArgs struct {
+	RepoID     int64             `json:"repo_id,omitempty"`
+	PipelineID int64             `json:"pipeline_id,omitempty"`
+	WorkflowID int64             `json:"workflow_id,omitempty"`
+	StepID     int64             `json:"step_id,omitempty"`
+	Status     model.StatusValue `json:"status,omitempty"`
+	Time       int64             `json:"time,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	TaskID     string            `json:"task_id,omitempty"`
+	Branch     string            `json:"branch,omitempty"`
+	BeforeID   int64             `json:"before_id,omitempty"`
+	Exclude    string            `json:"exclude,omitempty"`
+	StepName   string            `json:"step_name,omitempty"`
+	// Updates are column values by column name.
+	Updates map[string]json.RawMessage `json:"updates,omitempty"`
+	Entry   *model.LogEntry            `json:"entry,omitempty"`
+}
+
+// agentStepRecord is a step on the wire. The JSON form of model.Step hides whether its
+// failure fails the pipeline, which the run needs.
+type agentStepRecord struct {
+	*model.Step
+	Failure string `json:"failure"`
+}
+
+func newAgentStepRecord(step *model.Step) agentStepRecord {
+	return agentStepRecord{Step: step, Failure: step.Failure}
+}
+
+func (r agentStepRecord) restore() *model.Step {
+	r.Step.Failure = r.Failure
+	return r.Step
+}
+
+// agentStoreError is a store error the server reported. It matches the error its code names.
+type agentStoreError struct {
+	code    string
+	message string
+}
+
+func (e *agentStoreError) Error() string {
+	return e.message
+}
+
+func (e *agentStoreError) Is(target error) bool {
+	switch e.code {
+	case agentStoreNotFound:
+		return target == gorm.ErrRecordNotFound
+	case agentStoreIllegalTransition:
+		return target == ErrIllegalTransition
+	default:
+		return false
+	}
+}
+
+// WithAgentServer makes the service an agent of the server client calls: the records of the
+// tasks it runs are read and written through the server, which also resolves their secrets
+// and sends their notifications.
+func WithAgentServer(client *AgentClient) Option {
+	return func(s *Service) {
+		s.store = &agentStore{client: client}
+		s.notifications = nil
+	}
+}
+
+// agentStore is the store of an agent. It only implements what running a task needs, each
+// call scoped by the server to the pipeline of the task bound with bind; the agent never
+// reaches the other methods of the embedded nil store.
+type agentStore struct {
+	pipelineStore
+
+	client  *AgentClient
+	mu      sync.Mutex
+	agentID int64
+	taskID  string
+}
+
+// bind scopes the calls that follow to taskID run by agentID.
+func (a *agentStore) bind(agentID int64, taskID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.agentID, a.taskID = agentID, taskID
+}
+
+// call runs op with args on the server and decodes its result into out.
+func (a *agentStore) call(ctx context.Context, op string, args agentStoreArgs, out interface{}) error {
+	a.mu.Lock()
+	agentID, taskID := a.agentID, a.taskID
+	a.mu.Unlock()
+	if taskID == "" {
+		return fmt.Errorf("agent store: %s outside of a task", op)
+	}
+
+	var result AgentStoreResult
+	path := fmt.Sprintf("/internal/agents/%d/tasks/%s/store/%s", agentID, url.PathEscape(taskID), op)
+	if _, err := a.client.call(ctx, path, args, &result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return &agentStoreError{code: result.Code, message: result.Error}
+	}
+	if out == nil || len(result.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(result.Result, out); err != nil {
+		return fmt.Errorf("agent store %s: %w", op, err)
+	}
+	return nil
+}
+
+func encodeAgentUpdates(updates map[string]any) (map[string]json.RawMessage, error) {
+	encoded := make(map[string]json.RawMessage, len(updates))
+	for column, value := range updates {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %w", column, err)
+		}
+		encoded[column] = data
+	}
+	return encoded, nil
+}
+
+func (a *agentStore) GetRepo(ctx context.Context, repoID int64) (*model.Repo, error) {
+	var repo model.Repo
+	if err := a.call(ctx, "GetRepo", agentStoreArgs{RepoID: repoID}, &repo); err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+func (a *agentStore) GetPipeline(ctx context.Context, pipelineID int64) (*model.Pipeline, error) {
+	pipeline := cachedPipeline{Pipeline: &model.Pipeline{}}
+	if err := a.call(ctx, "GetPipeline", agentStoreArgs{PipelineID: pipelineID}, &pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline.restore(), nil
+}
+
+func (a *agentStore) GetPipelineStatus(ctx context.Context, pipelineID int64) (model.StatusValue, error) {
+	var status model.StatusValue
+	err := a.call(ctx, "GetPipelineStatus", agentStoreArgs{PipelineID: pipelineID}, &status)
+	return status, err
+}
+
+func (a *agentStore) GetPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
+	var cfg model.RepoPipelineConfig
+	if err := a.call(ctx, "GetPipelineConfig", agentStoreArgs{RepoID: repoID}, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (a *agentStore) LastSuccessfulCommit(ctx context.Context, repoID int64, branch string, beforeID int64, exclude string) (string, error) {
+	var commit string
+	err := a.call(ctx, "LastSuccessfulCommit", agentStoreArgs{RepoID: repoID, Branch: branch, BeforeID: beforeID, Exclude: exclude}, &commit)
+	return commit, err
+}
+
+func (a *agentStore) LastPipelineCommit(ctx context.Context, repoID int64, branch string) (string, error) {
+	var commit string
+	err := a.call(ctx, "LastPipelineCommit", agentStoreArgs{RepoID: repoID, Branch: branch}, &commit)
+	return commit, err
+}
+
+func (a *agentStore) UpdatePipeline(ctx context.Context, pipelineID int64, updates map[string]any) error {
+	encoded, err := encodeAgentUpdates(updates)
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, "UpdatePipeline", agentStoreArgs{PipelineID: pipelineID, Updates: encoded}, nil)
+}
+
+func (a *agentStore) MarkPipelineRunning(ctx context.Context, pipelineID int64, started int64) error {
+	return a.call(ctx, "MarkPipelineRunning", agentStoreArgs{PipelineID: pipelineID, Time: started}, nil)
+}
+
+func (a *agentStore) MarkPipelineBlocked(ctx context.Context, pipelineID int64, message string, updated int64) error {
+	return a.call(ctx, "MarkPipelineBlocked", agentStoreArgs{PipelineID: pipelineID, Message: message, Time: updated}, nil)
+}
+
+func (a *agentStore) MarkPipelineFinished(ctx context.Context, pipelineID int64, status model.StatusValue, finished int64, message string, taskID string) error {
+	return a.call(ctx, "MarkPipelineFinished", agentStoreArgs{PipelineID: pipelineID, Status: status, Time: finished, Message: message, TaskID: taskID}, nil)
+}
+
+func (a *agentStore) ListPipelineWorkflows(ctx context.Context, pipelineID int64) ([]model.Workflow, error) {
+	var workflows []model.Workflow
+	err := a.call(ctx, "ListPipelineWorkflows", agentStoreArgs{PipelineID: pipelineID}, &workflows)
+	return workflows, err
+}
+
+func (a *agentStore) TransitionWorkflow(ctx context.Context, workflowID int64, to model.StatusValue, updates map[string]any) error {
+	encoded, err := encodeAgentUpdates(updates)
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, "TransitionWorkflow", agentStoreArgs{WorkflowID: workflowID, Status: to, Updates: encoded}, nil)
+}
+
+func (a *agentStore) ListPipelineSteps(ctx context.Context, pipelineID int64) ([]model.Step, error) {
+	var records []agentStepRecord
+	if err := a.call(ctx, "ListPipelineSteps", agentStoreArgs{PipelineID: pipelineID}, &records); err != nil {
+		return nil, err
+	}
+	steps := make([]model.Step, 0, len(records))
+	for _, record := range records {
+		steps = append(steps, *record.restore())
+	}
+	return steps, nil
+}
+
+func (a *agentStore) GetStep(ctx context.Context, stepID int64) (*model.Step, error) {
+	record := agentStepRecord{Step: &model.Step{}}
+	if err := a.call(ctx, "GetStep", agentStoreArgs{StepID: stepID}, &record); err != nil {
+		return nil, err
+	}
+	return record.restore(), nil
+}
+
+func (a *agentStore) TransitionStep(ctx context.Context, stepID int64, to model.StatusValue, updates map[string]any) error {
+	encoded, err := encodeAgentUpdates(updates)
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, "TransitionStep", agentStoreArgs{StepID: stepID, Status: to, Updates: encoded}, nil)
+}
+
+func (a *agentStore) UpdateStep(ctx context.Context, stepID int64, updates map[string]any) error {
+	encoded, err := encodeAgentUpdates(updates)
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, "UpdateStep", agentStoreArgs{StepID: stepID, Updates: encoded}, nil)
+}
+
+func (a *agentStore) AppendLog(ctx context.Context, entry *model.LogEntry) error {
+	return a.call(ctx, "AppendLog", agentStoreArgs{StepID: entry.StepID, Entry: entry}, &entry.ID)
+}
+
+func (a *agentStore) MaxLogLine(ctx context.Context, stepID int64) (int, error) {
+	var line int
+	err := a.call(ctx, "MaxLogLine", agentStoreArgs{StepID: stepID}, &line)
+	return line, err
+}
+
+// UpdateStepStatistic leaves the statistic to the server, which records the duration of a
+// step when the step finishes.
+func (a *agentStore) UpdateStepStatistic(context.Context, int64, string, func(*model.StepStatistic)) error {
+	return nil
+}
+
+func (a *agentStore) PreviousBuildStep(ctx context.Context, repoID, pipelineID int64, stepName string) (*model.Step, error) {
+	record := agentStepRecord{Step: &model.Step{}}
+	if err := a.call(ctx, "PreviousBuildStep", agentStoreArgs{RepoID: repoID, PipelineID: pipelineID, StepName: stepName}, &record); err != nil {
+		return nil, err
+	}
+	return record.restore(), nil
+}
+
+func (a *agentStore) DeleteTask(ctx context.Context, taskID string) error {
+	return a.call(ctx, "DeleteTask", agentStoreArgs{TaskID: taskID}, nil)
+}
+
+func (a *agentStore) ListRunEnvTemplates(ctx context.Context, repoID int64) ([]*model.EnvTemplate, error) {
+	var templates []*model.EnvTemplate
+	err := a.call(ctx, "ListRunEnvTemplates", agentStoreArgs{RepoID: repoID}, &templates)
+	return templates, err
+}
+
+func (a *agentStore) ListRepoVariables(ctx context.Context, repoID int64) ([]*model.RepoVariable, error) {
+	var variables []*model.RepoVariable
+	err := a.call(ctx, "ListRepoVariables", agentStoreArgs{RepoID: repoID}, &variables)
+	return variables, err
+}
+
+// RunSecrets asks the server for the secrets of the bound task, which it resolves for the
+// aliases the steps of the task request.
+func (a *agentStore) RunSecrets(ctx context.Context) (*runSecrets, error) {
+	var secrets runSecrets
+	if err := a.call(ctx, "RunSecrets", agentStoreArgs{}, &secrets); err != nil {
+		return nil, err
+	}
+	return &secrets, nil
+}
@@ -0,0 +1,277 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrAgentStoreDenied is returned for store calls of an agent that reach beyond the task it
+// runs, name an unknown call or write columns agents may not write.
+var ErrAgentStoreDenied = errors.New("agent store call denied")
+
+// The columns agents may write besides the status, which only changes through transitions.
+var (
+	agentPipelineColumns = []string{"changed_files", "workspace_size", "outputs", "commit"}
+	agentWorkflowColumns = []string{"started", "finished", "error"}
+	agentStepColumns     = []string{"started", "finished", "error", "failure", "failure_reason", "exit_code", "approval", "outputs"}
+)
+
+// agentSchemas caches the parsed models agent updates are decoded against.
+var agentSchemas sync.Map
+
+// agentStoreCall is a store call of an agent running task, whose pipeline and repository
+// bound the records the call may touch.
+type agentStoreCall struct {
+	task       *model.Task
+	repoID     int64
+	pipelineID int64
+	args       agentStoreArgs
+}
+
+// AgentStoreCall runs the store call op of agentID for taskID, the task the agent was handed.
+// Store errors are returned in the result; the error is ErrAgentTaskNotFound when the agent
+// does not run the task and ErrAgentStoreDenied when the call is not allowed.
+func (s *Service) AgentStoreCall(ctx context.Context, agentID int64, taskID, op string, body []byte) (*AgentStoreResult, error) {
+	run := s.agents.run(taskID)
+	if run == nil || run.agentID != agentID {
+		return nil, ErrAgentTaskNotFound
+	}
+	run.lastSeen.Store(time.Now().Unix())
+
+	call := &agentStoreCall{task: run.task}
+	call.repoID, call.pipelineID = taskPipelineIDs(run.task)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &call.args); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrAgentStoreDenied, err)
+		}
+	}
+	value, err := s.runAgentStoreCall(ctx, call, op)
+	if errors.Is(err, ErrAgentStoreDenied) {
+		return nil, err
+	}
+	if err != nil {
+		result := &AgentStoreResult{Error: err.Error()}
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			result.Code = agentStoreNotFound
+		case errors.Is(err, ErrIllegalTransition):
+			result.Code = agentStoreIllegalTransition
+		}
+		return result, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &AgentStoreResult{Result: data}, nil
+}
+
+// runAgentStoreCall checks that op stays within the task of call and runs it. Status changes
+// go through the same paths as local runs, so events, metrics, commit statuses and
+// notifications come from the server.
+func (s *Service) runAgentStoreCall(ctx context.Context, call *agentStoreCall, op string) (any, error) {
+	args := call.args
+	switch op {
+	case "GetRepo", "GetPipelineConfig", "LastSuccessfulCommit", "LastPipelineCommit", "ListRunEnvTemplates", "ListRepoVariables":
+		if args.RepoID != call.repoID {
+			return nil, call.denied("repository %d", args.RepoID)
+		}
+	case "GetPipeline", "GetPipelineStatus", "UpdatePipeline", "MarkPipelineRunning", "MarkPipelineBlocked",
+		"MarkPipelineFinished", "ListPipelineWorkflows", "ListPipelineSteps":
+		if args.PipelineID != call.pipelineID {
+			return nil, call.denied("pipeline %d", args.PipelineID)
+		}
+	case "GetStep", "TransitionStep", "UpdateStep", "AppendLog", "MaxLogLine":
+		if err := s.agentStepOfTask(ctx, call, args.StepID); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op {
+	case "GetRepo":
+		return s.store.GetRepo(ctx, call.repoID)
+	case "GetPipelineConfig":
+		return s.store.GetPipelineConfig(ctx, call.repoID)
+	case "LastSuccessfulCommit":
+		return s.store.LastSuccessfulCommit(ctx, call.repoID, args.Branch, args.BeforeID, args.Exclude)
+	case "LastPipelineCommit":
+		return s.store.LastPipelineCommit(ctx, call.repoID, args.Branch)
+	case "ListRunEnvTemplates":
+		return s.store.ListRunEnvTemplates(ctx, call.repoID)
+	case "ListRepoVariables":
+		return s.store.ListRepoVariables(ctx, call.repoID)
+	case "PreviousBuildStep":
+		if args.RepoID != call.repoID || args.PipelineID != call.pipelineID {
+			return nil, call.denied("pipeline %d", args.PipelineID)
+		}
+		step, err := s.store.PreviousBuildStep(ctx, call.repoID, call.pipelineID, args.StepName)
+		if err != nil {
+			return nil, err
+		}
+		return newAgentStepRecord(step), nil
+
+	case "GetPipeline":
+		pipeline, err := s.store.GetPipeline(ctx, call.pipelineID)
+		if err != nil {
+			return nil, err
+		}
+		return newCachedPipeline(pipeline), nil
+	case "GetPipelineStatus":
+		return s.store.GetPipelineStatus(ctx, call.pipelineID)
+	case "UpdatePipeline":
+		updates, err := decodeAgentUpdates(&model.Pipeline{}, args.Updates, agentPipelineColumns)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.store.UpdatePipeline(ctx, call.pipelineID, updates)
+	case "MarkPipelineRunning":
+		return nil, s.markPipelineRunning(ctx, call.pipelineID, args.Time)
+	case "MarkPipelineBlocked":
+		return nil, s.markPipelineBlocked(ctx, call.pipelineID, args.Message)
+	case "MarkPipelineFinished":
+		if args.TaskID != "" && args.TaskID != call.task.ID {
+			return nil, call.denied("task %s", args.TaskID)
+		}
+		return nil, s.markPipelineFinished(ctx, call.pipelineID, args.Status, args.Time, args.Message, args.TaskID)
+	case "ListPipelineWorkflows":
+		return s.store.ListPipelineWorkflows(ctx, call.pipelineID)
+	case "TransitionWorkflow":
+		workflows, err := s.store.ListPipelineWorkflows(ctx, call.pipelineID)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(workflows, func(workflow model.Workflow) bool { return workflow.ID == args.WorkflowID }) {
+			return nil, call.denied("workflow %d", args.WorkflowID)
+		}
+		updates, err := decodeAgentUpdates(&model.Workflow{}, args.Updates, agentWorkflowColumns)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.store.TransitionWorkflow(ctx, args.WorkflowID, args.Status, updates)
+	case "ListPipelineSteps":
+		steps, err := s.store.ListPipelineSteps(ctx, call.pipelineID)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]agentStepRecord, 0, len(steps))
+		for i := range steps {
+			records = append(records, newAgentStepRecord(&steps[i]))
+		}
+		return records, nil
+
+	case "GetStep":
+		step, err := s.store.GetStep(ctx, args.StepID)
+		if err != nil {
+			return nil, err
+		}
+		return newAgentStepRecord(step), nil
+	case "TransitionStep":
+		updates, err := decodeAgentUpdates(&model.Step{}, args.Updates, agentStepColumns)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.transitionStepWithEvent(ctx, args.StepID, args.Status, updates); err != nil {
+			return nil, err
+		}
+		// the agent leaves what a local run records for a finished step to the server
+		if step, err := s.store.GetStep(ctx, args.StepID); err == nil {
+			s.recordStepDuration(ctx, call.repoID, step)
+			if s.metrics != nil {
+				repo, _ := s.fetchRepo(ctx, call.repoID)
+				s.observeStep(repo, step)
+			}
+		}
+		return nil, nil
+	case "UpdateStep":
+		updates, err := decodeAgentUpdates(&model.Step{}, args.Updates, agentStepColumns)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.store.UpdateStep(ctx, args.StepID, updates)
+	case "AppendLog":
+		if args.Entry == nil || args.Entry.StepID != args.StepID {
+			return nil, call.denied("log entry of step %d", args.StepID)
+		}
+		entry := *args.Entry
+		entry.ID = 0
+		if entry.Created == 0 {
+			entry.Created = entry.Time
+		}
+		if err := s.store.AppendLog(ctx, &entry); err != nil {
+			return nil, err
+		}
+		return entry.ID, nil
+	case "MaxLogLine":
+		return s.store.MaxLogLine(ctx, args.StepID)
+
+	case "DeleteTask":
+		if args.TaskID != call.task.ID {
+			return nil, call.denied("task %s", args.TaskID)
+		}
+		return nil, s.store.DeleteTask(ctx, call.task.ID)
+	case "RunSecrets":
+		repo, err := s.store.GetRepo(ctx, call.repoID)
+		if err != nil {
+			return nil, err
+		}
+		settings, err := s.GetPipelineSettings(ctx, call.repoID)
+		if err != nil {
+			return nil, err
+		}
+		var payload pipelineTaskPayload
+		if len(call.task.Data) > 0 {
+			if err := json.Unmarshal(call.task.Data, &payload); err != nil {
+				return nil, err
+			}
+		}
+		return s.runSecrets(ctx, repo, settings, collectRequestedAliases(payload.Steps))
+	default:
+		return nil, fmt.Errorf("%w: unknown call %q", ErrAgentStoreDenied, op)
+	}
+}
+
+func (c *agentStoreCall) denied(format string, args ...any) error {
+	return fmt.Errorf("%w: %s is not part of task %s", ErrAgentStoreDenied, fmt.Sprintf(format, args...), c.task.ID)
+}
+
+// agentStepOfTask returns ErrAgentStoreDenied unless stepID is a step of the pipeline of call.
+func (s *Service) agentStepOfTask(ctx context.Context, call *agentStoreCall, stepID int64) error {
+	step, err := s.store.GetStep(ctx, stepID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && step.PipelineID != call.pipelineID) {
+		return call.denied("step %d", stepID)
+	}
+	return err
+}
+
+// decodeAgentUpdates decodes the column values an agent sent into the types of the fields of
+// record they belong to, rejecting columns outside allowed.
+func decodeAgentUpdates(record any, raw map[string]json.RawMessage, allowed []string) (map[string]any, error) {
+	parsed, err := schema.Parse(record, &agentSchemas, schema.NamingStrategy{})
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string]any, len(raw))
+	for column, data := range raw {
+		field := parsed.LookUpField(column)
+		if field == nil || !slices.Contains(allowed, column) {
+			return nil, fmt.Errorf("%w: column %s", ErrAgentStoreDenied, column)
+		}
+		value := reflect.New(field.FieldType)
+		if err := json.Unmarshal(data, value.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: column %s: %v", ErrAgentStoreDenied, column, err)
+		}
+		updates[column] = value.Elem().Interface()
+	}
+	return updates, nil
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const testAgentID = 7
+
+// newAgentServer serves the store calls of agents to server, which hands task to agent 7, and
+// returns an agent service calling it.
+func newAgentServer(t *testing.T, server *Service, task *model.Task) *Service {
+	t.Helper()
+	server.agents.mu.Lock()
+	server.agents.running[task.ID] = &agentRun{agentID: testAgentID, task: task, done: make(chan error, 1)}
+	server.agents.mu.Unlock()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var agentID int64
+		var taskID, op string
+		path := strings.ReplaceAll(strings.TrimPrefix(req.URL.Path, "/internal/agents/"), "/", " ")
+		if _, err := fmt.Sscanf(path, "%d tasks %s store %s", &agentID, &taskID, &op); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		result, err := server.AgentStoreCall(req.Context(), agentID, taskID, op, body)
+		switch {
+		case errors.Is(err, ErrAgentTaskNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrAgentStoreDenied):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			_ = json.NewEncoder(w).Encode(result)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return NewService(nil, nil, nil, WithAgentServer(NewAgentClient(ts.URL, "agent-token")))
+}
+
+func TestAgentRunsThroughServer(t *testing.T) {
+	server, fake, task := newFakeRun(t, hostStep("greet", "echo hello-from-agent"))
+	agent := newAgentServer(t, server, task)
+	remote := agent.store.(*agentStore)
+	remote.bind(testAgentID, task.ID)
+
+	if err := agent.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v\n%s", err, fake)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusSuccess || got.Finished == 0 {
+		t.Fatalf("pipeline = %s finished %d, want success\n%s", got.Status, got.Finished, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusSuccess {
+		t.Fatalf("step = %s, want success\n%s", got.State, fake)
+	}
+	if !strings.Contains(fake.logText(1), "hello-from-agent") {
+		t.Errorf("server log misses the output of the agent:\n%s", fake.logText(1))
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of the finished pipeline was kept")
+	}
+}
+
+func TestAgentStoreCallStaysInTask(t *testing.T) {
+	server, fake, task := newFakeRun(t, hostStep("greet", "echo hello"))
+	fake.pipelines[2] = &model.Pipeline{ID: 2, RepoID: 1, Number: 2, Status: model.StatusPending}
+	fake.steps[9] = &model.Step{ID: 9, PipelineID: 2, Name: "other", State: model.StatusPending}
+	agent := newAgentServer(t, server, task)
+	remote := agent.store.(*agentStore)
+	ctx := context.Background()
+
+	remote.bind(testAgentID, task.ID)
+	if _, err := remote.GetPipeline(ctx, 1); err != nil {
+		t.Fatalf("GetPipeline of the task: %v", err)
+	}
+	denied := map[string]error{
+		"pipeline of another run": remote.MarkPipelineRunning(ctx, 2, 1),
+		"step of another run":     remote.TransitionStep(ctx, 9, model.StatusRunning, nil),
+		"log of another run":      remote.AppendLog(ctx, &model.LogEntry{StepID: 9, Data: []byte("x")}),
+		"column agents never set": remote.UpdateStep(ctx, 1, map[string]any{"name": "renamed"}),
+		"another task":            remote.DeleteTask(ctx, "task-2"),
+	}
+	for name, err := range denied {
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("%s = %v, want 403", name, err)
+		}
+	}
+	if got := fake.pipeline(2); got.Status != model.StatusPending {
+		t.Errorf("pipeline of another run = %s, want it untouched", got.Status)
+	}
+	if got := fake.step(9); got.State != model.StatusPending || fake.logText(9) != "" {
+		t.Errorf("step of another run = %s, want it untouched", got.State)
+	}
+
+	remote.bind(testAgentID+1, task.ID)
+	if _, err := remote.GetPipeline(ctx, 1); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("GetPipeline of another agent = %v, want 404", err)
+	}
+}
+
+func TestAgentStoreErrors(t *testing.T) {
+	server, fake, task := newFakeRun(t, hostStep("greet", "echo hello"))
+	fake.steps[1].State = model.StatusSuccess
+	agent := newAgentServer(t, server, task)
+	remote := agent.store.(*agentStore)
+	remote.bind(testAgentID, task.ID)
+	ctx := context.Background()
+
+	// the step already finished, so it cannot start
+	err := remote.TransitionStep(ctx, 1, model.StatusRunning, nil)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("TransitionStep = %v, want an illegal transition", err)
+	}
+	if _, err := remote.GetPipelineConfig(ctx, 1); err != nil {
+		t.Errorf("GetPipelineConfig: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// AgentPollTimeout is how long a poll for the next task waits before answering empty.
+	AgentPollTimeout = 25 * time.Second
+	// AgentHeartbeatInterval is how often an agent reports the task it runs.
+	AgentHeartbeatInterval = 10 * time.Second
+	// agentOfflineAfter is how long an agent may go unseen before it counts as gone; its
+	// running task is then requeued.
+	agentOfflineAfter = 45 * time.Second
+)
+
+var (
+	// ErrAgentNotFound is returned for agents that never registered.
+	ErrAgentNotFound = errors.New("agent not found")
+	// ErrAgentTaskNotFound is returned when an agent reports on a task it was not given.
+	ErrAgentTaskNotFound = errors.New("agent task not found")
+	errAgentLost         = errors.New("agent stopped reporting")
+)
+
+// AgentTask is a task as handed to an agent, with the payload the task JSON leaves out.
+type AgentTask struct {
+	model.Task
+	Data []byte `json:"data"`
+}
+
+// WithAgentToken enables remote agents authenticating with token.
+func WithAgentToken(token string) Option {
+	return func(s *Service) {
+		s.agentToken = strings.TrimSpace(token)
+	}
+}
+
+// AgentsEnabled reports whether remote agents may connect.
+func (s *Service) AgentsEnabled() bool {
+	return s.agentToken != ""
+}
+
+// AuthenticateAgent reports whether token is the agent token.
+func (s *Service) AuthenticateAgent(token string) bool {
+	if s.agentToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(s.agentToken)) == 1
+}
+
+// agentHub pairs queued tasks with the agents waiting in a poll and tracks the tasks agents
+// run. It only lives in memory: after a restart agents poll again and the tasks they ran are
+// recovered like local ones.
+type agentHub struct {
+	mu      sync.Mutex
+	idle    map[int64]*agentPoll
+	running map[string]*agentRun
+}
+
+type agentPoll struct {
+	agent *model.Agent
+	// offer receives at most one task; it is buffered so handing one over never blocks.
+	offer chan *model.Task
+}
+
+type agentRun struct {
+	agentID   int64
+	task      *model.Task
+	done      chan error
+	lastSeen  atomic.Int64
+	cancelled atomic.Bool
+}
+
+func newAgentHub() *agentHub {
+	return &agentHub{
+		idle:    make(map[int64]*agentPoll),
+		running: make(map[string]*agentRun),
+	}
+}
+
+// matching reports whether an idle agent accepts task.
+func (h *agentHub) matching(task *model.Task) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, poll := range h.idle {
+		if poll.agent.Accepts(task) {
+			return true
+		}
+	}
+	return false
+}
+
+// offer hands task to the idle agent accepting it that has waited longest, or returns nil
+// when none accepts it.
+func (h *agentHub) offer(task *model.Task) *agentRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var chosen *agentPoll
+	for _, poll := range h.idle {
+		if !poll.agent.Accepts(task) {
+			continue
+		}
+		if chosen == nil || poll.agent.LastSeen < chosen.agent.LastSeen {
+			chosen = poll
+		}
+	}
+	if chosen == nil {
+		return nil
+	}
+	delete(h.idle, chosen.agent.ID)
+	run := &agentRun{agentID: chosen.agent.ID, task: task, done: make(chan error, 1)}
+	run.lastSeen.Store(time.Now().Unix())
+	h.running[task.ID] = run
+	chosen.offer <- task
+	return run
+}
+
+func (h *agentHub) run(taskID string) *agentRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.running[taskID]
+}
+
+func (h *agentHub) forget(taskID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.running, taskID)
+}
+
+// executeTask is the queue executor: it hands task to an idle agent accepting it and waits
+// for the agent to finish, or runs it here when no agent accepts it or the task cannot run
+// on an agent. Either way the task holds a queue worker while it runs.
+func (s *Service) executeTask(ctx context.Context, task *model.Task) error {
+	if !s.AgentsEnabled() || !agentRunnable(task) || !s.agents.matching(task) {
+		return s.handleTask(ctx, task)
+	}
+	repoID, pipelineID := taskPipelineIDs(task)
+	settings, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return err
+	}
+	// the slot is taken here, as agents know nothing of the pipelines held back on the server
+	if !s.takeRepoSlot(ctx, settings, task, repoID, pipelineID) {
+		return nil
+	}
+	defer s.releaseRepoSlot(repoID, pipelineID)
+
+	run := s.agents.offer(task)
+	if run == nil {
+		// the agent left in the meantime
+		return s.handleTask(ctx, task)
+	}
+	defer s.agents.forget(task.ID)
+
+	handle := &executionHandle{pipelineID: pipelineID, cancel: func() { run.cancelled.Store(true) }}
+	s.executions.Store(pipelineID, handle)
+	defer s.executions.Delete(pipelineID)
+
+	log.Info().Str("task_id", task.ID).Int64("pipeline_id", pipelineID).Int64("agent_id", run.agentID).Msg("pipeline task handed to agent")
+	ticker := time.NewTicker(AgentHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-run.done:
+			return err
+		case <-ticker.C:
+			if time.Since(time.Unix(run.lastSeen.Load(), 0)) > agentOfflineAfter {
+				s.requeueLostTask(ctx, task, pipelineID)
+				return fmt.Errorf("%w: agent %d", errAgentLost, run.agentID)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// requeueLostTask resets the pipeline of a task whose agent went away and enqueues it again,
+// like recovery does for tasks interrupted by a restart.
+func (s *Service) requeueLostTask(ctx context.Context, task *model.Task, pipelineID int64) {
+	if err := s.store.ResetPipeline(ctx, pipelineID, time.Now().Unix()); err != nil {
+		if !errors.Is(err, ErrIllegalTransition) {
+			log.Error().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to reset pipeline of lost agent")
+		}
+		return
+	}
+	log.Warn().Str("task_id", task.ID).Int64("pipeline_id", pipelineID).Msg("agent lost, pipeline requeued")
+	// enqueue off the worker, which still holds a queue slot
+	go func() {
+		if err := s.EnqueueTask(context.Background(), task); err != nil {
+			log.Error().Err(err).Str("task_id", task.ID).Msg("failed to requeue pipeline task of lost agent")
+		}
+	}()
+}
+
+// agentRunnable reports whether task may run on an agent. Deploy steps need the cluster
+// credentials and namespace locks of the server, and collected artifacts are stored where
+// the server serves them from, so tasks with either stay on the server.
+func agentRunnable(task *model.Task) bool {
+	var payload pipelineTaskPayload
+	if len(task.Data) > 0 {
+		if err := json.Unmarshal(task.Data, &payload); err != nil {
+			return false
+		}
+	}
+	for _, step := range payload.Steps {
+		if step.Type == model.StepTypeDeploy || step.Deploy != nil || len(step.Artifacts) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func taskPipelineIDs(task *model.Task) (repoID, pipelineID int64) {
+	var payload pipelineTaskPayload
+	if len(task.Data) > 0 {
+		_ = json.Unmarshal(task.Data, &payload)
+	}
+	repoID, pipelineID = payload.RepoID, payload.PipelineID
+	if repoID == 0 {
+		repoID = task.RepoID
+	}
+	if pipelineID == 0 {
+		pipelineID = task.PipelineID
+	}
+	return repoID, pipelineID
+}
+
+// RegisterAgent records an agent under name, updating the labels and version of an agent
+// registered before under the same name.
+func (s *Service) RegisterAgent(ctx context.Context, name, version string, labels map[string]string) (*model.Agent, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("agent name is required")
+	}
+	now := time.Now().Unix()
+	agent := &model.Agent{
+		Name:     name,
+		Labels:   labels,
+		Version:  strings.TrimSpace(version),
+		LastSeen: now,
+		Created:  now,
+	}
+	if err := s.store.UpsertAgent(ctx, agent); err != nil {
+		return nil, err
+	}
+	log.Info().Int64("agent_id", agent.ID).Str("name", name).Interface("labels", labels).Msg("agent registered")
+	return agent, nil
+}
+
+func (s *Service) getAgent(ctx context.Context, agentID int64) (*model.Agent, error) {
+	agent, err := s.store.GetAgent(ctx, agentID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAgentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+func (s *Service) touchAgent(ctx context.Context, agentID int64, taskID string, pipelineID int64) error {
+	return s.store.TouchAgent(ctx, agentID, time.Now().Unix(), taskID, pipelineID)
+}
+
+// NextAgentTask waits up to AgentPollTimeout for a task the agent accepts and returns nil
+// when none came.
+func (s *Service) NextAgentTask(ctx context.Context, agentID int64) (*model.Task, error) {
+	agent, err := s.getAgent(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.touchAgent(ctx, agentID, "", 0); err != nil {
+		return nil, err
+	}
+	agent.LastSeen = time.Now().Unix()
+	poll := &agentPoll{agent: agent, offer: make(chan *model.Task, 1)}
+	s.agents.mu.Lock()
+	s.agents.idle[agentID] = poll
+	s.agents.mu.Unlock()
+
+	timer := time.NewTimer(AgentPollTimeout)
+	defer timer.Stop()
+	select {
+	case task := <-poll.offer:
+		return s.acceptAgentTask(ctx, agentID, task)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	s.agents.mu.Lock()
+	current, waiting := s.agents.idle[agentID]
+	if waiting && current == poll {
+		delete(s.agents.idle, agentID)
+	}
+	s.agents.mu.Unlock()
+	if waiting && current == poll {
+		return nil, nil
+	}
+	// a task was offered while the poll was ending
+	select {
+	case task := <-poll.offer:
+		return s.acceptAgentTask(ctx, agentID, task)
+	default:
+		return nil, nil
+	}
+}
+
+func (s *Service) acceptAgentTask(ctx context.Context, agentID int64, task *model.Task) (*model.Task, error) {
+	_, pipelineID := taskPipelineIDs(task)
+	if err := s.touchAgent(ctx, agentID, task.ID, pipelineID); err != nil {
+		log.Warn().Err(err).Int64("agent_id", agentID).Msg("failed to record agent task")
+	}
+	return task, nil
+}
+
+// AgentHeartbeat records that the agent is alive and runs taskID, empty while idle. It
+// reports whether the agent should cancel the task because its pipeline was cancelled.
+func (s *Service) AgentHeartbeat(ctx context.Context, agentID int64, taskID string) (bool, error) {
+	var pipelineID int64
+	run := s.agents.run(taskID)
+	if run != nil && run.agentID == agentID {
+		run.lastSeen.Store(time.Now().Unix())
+		_, pipelineID = taskPipelineIDs(run.task)
+	}
+	if err := s.touchAgent(ctx, agentID, taskID, pipelineID); err != nil {
+		return false, err
+	}
+	if run == nil || run.agentID != agentID {
+		return taskID != "", nil
+	}
+	return run.cancelled.Load() || s.pipelineFinalised(ctx, pipelineID), nil
+}
+
+// CompleteAgentTask reports that the agent finished taskID; message is the error the task
+// failed with, empty on success.
+func (s *Service) CompleteAgentTask(ctx context.Context, agentID int64, taskID, message string) error {
+	run := s.agents.run(taskID)
+	if run == nil || run.agentID != agentID {
+		return ErrAgentTaskNotFound
+	}
+	var err error
+	if strings.TrimSpace(message) != "" {
+		err = errors.New(message)
+	}
+	select {
+	case run.done <- err:
+	default:
+	}
+	return s.touchAgent(ctx, agentID, "", 0)
+}
+
+// ListAgents lists the registered agents by name with whether they are online.
+func (s *Service) ListAgents(ctx context.Context) ([]*model.AgentInfo, error) {
+	agents, err := s.store.ListAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-agentOfflineAfter).Unix()
+	result := make([]*model.AgentInfo, 0, len(agents))
+	for _, agent := range agents {
+		info := &model.AgentInfo{Agent: *agent, Online: agent.LastSeen >= cutoff}
+		if !info.Online {
+			info.TaskID, info.PipelineID = "", 0
+		}
+		result = append(result, info)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Online && !result[j].Online })
+	return result, nil
+}
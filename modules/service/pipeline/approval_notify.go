@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// defaultApprovalReminderRatio reminds the approvers halfway through the approval timeout.
+const defaultApprovalReminderRatio = 0.5
+
+// WithApprovalReminderRatio sets the part of an approval timeout after which the approvers of
+// a still pending approval are reminded; 0 disables reminders.
+func WithApprovalReminderRatio(ratio float64) Option {
+	return func(s *Service) {
+		if ratio >= 0 && ratio < 1 {
+			s.approvalReminderRatio = ratio
+		}
+	}
+}
+
+// publishApprovalNotification hands the request or reminder of an approval step to the
+// notifier, like publishNotification.
+func (s *Service) publishApprovalNotification(pipelineID, stepID int64, event string) {
+	if s.notifications == nil {
+		return
+	}
+	select {
+	case s.notifications <- notificationEvent{pipelineID: pipelineID, stepID: stepID, event: event}:
+	default:
+		log.Warn().Int64("pipeline_id", pipelineID).Int64("step_id", stepID).Str("event", event).Msg("notification queue full, approval event dropped")
+	}
+}
+
+// approvalReminderDue reports whether a pending approval has waited ratio of its timeout
+// without a reminder. Approvals without a timeout are never reminded.
+func approvalReminderDue(approval *model.StepApproval, ratio float64, now int64) bool {
+	if approval == nil || ratio <= 0 || approval.State != model.StepApprovalStatePending {
+		return false
+	}
+	if approval.Timeout <= 0 || approval.RequestedAt == 0 || approval.RemindedAt > 0 {
+		return false
+	}
+	return now >= approval.RequestedAt+int64(float64(approval.Timeout)*ratio)
+}
+
+// sendApprovalNotices sends the approval notifications still due for a blocked step: the
+// request when it was parked before notifications existed or by a replica that went away,
+// and the reminder once it is due.
+func (s *Service) sendApprovalNotices(ctx context.Context, step *model.Step, now int64) {
+	approval := step.Approval
+	if approval == nil || approval.State != model.StepApprovalStatePending || approval.RequestedAt == 0 {
+		return
+	}
+	if approval.NotifiedAt == 0 {
+		s.claimApprovalNotice(ctx, step, model.NotificationEventApproval, now)
+	}
+	if approvalReminderDue(approval, s.approvalReminderRatio, now) {
+		s.claimApprovalNotice(ctx, step, model.NotificationEventApprovalReminder, now)
+	}
+}
+
+// claimApprovalNotice records event as sent on the approval before publishing it, so a
+// restart or a concurrent sweep does not send it again.
+func (s *Service) claimApprovalNotice(ctx context.Context, step *model.Step, event string, now int64) {
+	var claimed *model.StepApproval
+	err := s.store.ChangeStep(ctx, 0, step.ID, func(current *model.Step) (*stepChange, error) {
+		approval := current.Approval
+		if current.State != model.StatusBlocked || approval == nil || approval.State != model.StepApprovalStatePending {
+			return nil, nil
+		}
+		switch event {
+		case model.NotificationEventApproval:
+			if approval.NotifiedAt > 0 {
+				return nil, nil
+			}
+			approval.NotifiedAt = now
+		case model.NotificationEventApprovalReminder:
+			if !approvalReminderDue(approval, s.approvalReminderRatio, now) {
+				return nil, nil
+			}
+			approval.RemindedAt = now
+		}
+		claimed = approval
+		return &stepChange{updates: map[string]any{"approval": approval}}, nil
+	})
+	if err != nil {
+		log.Error().Err(err).
+			Int64("pipeline_id", step.PipelineID).
+			Int64("step_id", step.ID).
+			Str("event", event).
+			Msg("failed to record approval notification")
+		return
+	}
+	if claimed != nil {
+		step.Approval = claimed
+		s.publishApprovalNotification(step.PipelineID, step.ID, event)
+	}
+}
+
+// deliverApprovalNotification sends an approval request or reminder to the subscribed
+// targets of the repository, naming the approvers still expected to decide.
+func (s *Service) deliverApprovalNotification(ctx context.Context, event notificationEvent) {
+	step, err := s.getStepByID(ctx, event.stepID)
+	if err != nil || step == nil || step.Approval == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("step_id", event.stepID).Msg("failed to load approval step for notification")
+		}
+		return
+	}
+	if step.State != model.StatusBlocked || step.Approval.State != model.StepApprovalStatePending {
+		// decided while the event was queued
+		return
+	}
+	pipeline, err := s.fetchPipeline(ctx, step.PipelineID)
+	if err != nil || pipeline == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("pipeline_id", step.PipelineID).Msg("failed to load pipeline for notification")
+		}
+		return
+	}
+	targets, err := s.ListNotificationTargets(ctx, pipeline.RepoID)
+	if err != nil {
+		log.Error().Err(err).Int64("repo_id", pipeline.RepoID).Msg("failed to load notification targets")
+		return
+	}
+	var subscribed []*model.NotificationTarget
+	for _, target := range targets {
+		if target.Enabled && target.Subscribed(event.event) {
+			subscribed = append(subscribed, target)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+	repo, err := s.fetchRepo(ctx, pipeline.RepoID)
+	if err != nil || repo == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("repo_id", pipeline.RepoID).Msg("failed to load repo for notification")
+		}
+		return
+	}
+
+	approval := step.Approval
+	message := s.notificationMessage(repo, pipeline, event.event)
+	message.Status = string(model.StatusBlocked)
+	message.Message = strings.TrimSpace(firstNonEmpty(approval.Message, step.Name))
+	message.RequestedBy = approval.RequestedBy
+	message.ExpiresAt = approval.ExpiresAt
+	message.Approvers = s.pendingApproverLogins(ctx, pipeline.RepoID, approval)
+	s.sendToTargets(ctx, subscribed, message)
+}
+
+// pendingApproverLogins lists the users who may still decide on approval, with groups
+// expanded to their members. The references are returned as is when the groups cannot be
+// loaded.
+func (s *Service) pendingApproverLogins(ctx context.Context, repoID int64, approval *model.StepApproval) []string {
+	groups, err := s.ApproverGroupMembers(ctx, repoID)
+	if err != nil {
+		log.Warn().Err(err).Int64("repo_id", repoID).Msg("failed to load approver groups for notification")
+		return append([]string{}, approval.Approvers...)
+	}
+	pending := PendingApprovers(ResolveApprovers(approval.Approvers, groups), approval.Decisions)
+	var logins []string
+	for _, requirement := range pending {
+		for _, member := range requirement.Members {
+			if !containsIgnoreCase(logins, member) {
+				logins = append(logins, member)
+			}
+		}
+	}
+	return logins
+}
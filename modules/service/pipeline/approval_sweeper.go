@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	defaultApprovalSweepInterval = 30 * time.Second
+	approvalExpiredMessage       = "审批已超时"
+)
+
+// WithApprovalSweepInterval sets how often blocked approval steps are checked for expiry.
+func WithApprovalSweepInterval(interval time.Duration) Option {
+	return func(s *Service) {
+		if interval > 0 {
+			s.approvalSweepInterval = interval
+		}
+	}
+}
+
+// runApprovalSweeper expires timed out approvals and reminds the approvers of pending ones
+// until ctx is done, so a pipeline nobody touches does not stay blocked forever.
+func (s *Service) runApprovalSweeper(ctx context.Context) {
+	interval := s.approvalSweepInterval
+	if interval <= 0 {
+		interval = defaultApprovalSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.sweepExpiredApprovals(ctx); err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Msg("failed to sweep expired approvals")
+			}
+		}
+	}
+}
+
+// sweepExpiredApprovals finalises every blocked approval step whose timeout has passed and
+// sends the approval notifications still due for the others.
+func (s *Service) sweepExpiredApprovals(ctx context.Context) error {
+	steps, err := s.store.ListBlockedApprovalSteps(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, step := range steps {
+		if !approvalExpired(step.Approval, now) {
+			s.sendApprovalNotices(ctx, step, now)
+			continue
+		}
+		if err := s.expireApprovalStep(ctx, step.ID, now); err != nil {
+			log.Error().Err(err).
+				Int64("pipeline_id", step.PipelineID).
+				Int64("step_id", step.ID).
+				Msg("failed to expire approval")
+		}
+	}
+	return nil
+}
+
+// expireApprovalStep fails an expired approval step and finishes its pipeline. It does
+// nothing when a concurrent decision or sweep already finalised the step.
+func (s *Service) expireApprovalStep(ctx context.Context, stepID int64, now int64) error {
+	var pipelineID int64
+	expired := false
+	err := s.store.ChangeStep(ctx, 0, stepID, func(step *model.Step) (*stepChange, error) {
+		if step.State != model.StatusBlocked || !approvalExpired(step.Approval, now) {
+			return nil, nil
+		}
+		approval := step.Approval
+		approval.State = model.StepApprovalStateExpired
+		approval.FinalizedAt = now
+		pipelineID = step.PipelineID
+		expired = true
+		return &stepChange{state: model.StatusFailure, updates: map[string]any{
+			"approval":       approval,
+			"finished":       now,
+			"exit_code":      -1,
+			"error":          approvalExpiredMessage,
+			"failure_reason": model.StepFailureTimeout,
+		}}, nil
+	})
+	if errors.Is(err, ErrIllegalTransition) {
+		// a racing decision won the guarded transition
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !expired {
+		return nil
+	}
+
+	task, err := s.findPipelineTask(ctx, pipelineID)
+	if err != nil {
+		return err
+	}
+	taskID := ""
+	if task != nil {
+		taskID = task.ID
+	}
+	err = s.markPipelineFinished(ctx, pipelineID, model.StatusFailure, now, approvalExpiredMessage, taskID)
+	if errors.Is(err, ErrIllegalTransition) {
+		// the pipeline was cancelled or finished meanwhile
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("pipeline_id", pipelineID).Int64("step_id", stepID).Msg("approval expired")
+	return nil
+}
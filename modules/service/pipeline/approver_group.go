@@ -0,0 +1,234 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// approverGroupPrefix marks an approvers entry as a group reference, e.g. "@release-managers".
+const approverGroupPrefix = "@"
+
+var (
+	ErrApproverGroupExists  = errors.New("审批组名称已存在")
+	ErrApproverGroupInvalid = errors.New("审批组配置无效")
+)
+
+// ApproverRequirement is one approvers entry resolved against the current group rosters.
+type ApproverRequirement struct {
+	Ref     string
+	Group   string
+	Members []string
+}
+
+// Includes reports whether login may decide on behalf of this requirement.
+func (r ApproverRequirement) Includes(login string) bool {
+	return containsIgnoreCase(r.Members, login)
+}
+
+// SatisfiedBy reports whether any current member has approved.
+func (r ApproverRequirement) SatisfiedBy(decisions []model.StepApprovalDecision) bool {
+	for _, decision := range decisions {
+		if strings.ToLower(strings.TrimSpace(decision.Action)) != "approve" {
+			continue
+		}
+		if r.Includes(decision.User) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveApprovers expands the approvers list of a step. Group references use the rosters
+// in groups (keyed by lower-case name); an unknown group resolves to no members.
+func ResolveApprovers(approvers []string, groups map[string][]string) []ApproverRequirement {
+	requirements := make([]ApproverRequirement, 0, len(approvers))
+	for _, raw := range approvers {
+		ref := strings.TrimSpace(raw)
+		if ref == "" {
+			continue
+		}
+		if name, ok := approverGroupName(ref); ok {
+			requirements = append(requirements, ApproverRequirement{
+				Ref:     ref,
+				Group:   name,
+				Members: append([]string{}, groups[strings.ToLower(name)]...),
+			})
+			continue
+		}
+		requirements = append(requirements, ApproverRequirement{Ref: ref, Members: []string{ref}})
+	}
+	return requirements
+}
+
+// ApproverAllowed reports whether login appears in any requirement. An empty list allows everyone.
+func ApproverAllowed(requirements []ApproverRequirement, login string) bool {
+	if len(requirements) == 0 {
+		return true
+	}
+	for _, requirement := range requirements {
+		if requirement.Includes(login) {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingApprovers returns the requirements that no current member has approved yet.
+func PendingApprovers(requirements []ApproverRequirement, decisions []model.StepApprovalDecision) []ApproverRequirement {
+	pending := make([]ApproverRequirement, 0, len(requirements))
+	for _, requirement := range requirements {
+		if !requirement.SatisfiedBy(decisions) {
+			pending = append(pending, requirement)
+		}
+	}
+	return pending
+}
+
+func approverGroupName(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, approverGroupPrefix) {
+		return "", false
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(ref, approverGroupPrefix))
+	return name, name != ""
+}
+
+func groupSnapshots(requirements []ApproverRequirement, login string) []model.StepApprovalGroupSnapshot {
+	var snapshots []model.StepApprovalGroupSnapshot
+	for _, requirement := range requirements {
+		if requirement.Group == "" || !requirement.Includes(login) {
+			continue
+		}
+		snapshots = append(snapshots, model.StepApprovalGroupSnapshot{
+			Name:    requirement.Group,
+			Members: append([]string{}, requirement.Members...),
+		})
+	}
+	return snapshots
+}
+
+// ApproverGroupMembers returns the rosters visible to a repository keyed by lower-case group
+// name. Repository groups take precedence over global groups with the same name; global groups
+// of other organizations are never visible.
+func (s *Service) ApproverGroupMembers(ctx context.Context, repoID int64) (map[string][]string, error) {
+	ctx, err := s.repoScopeByID(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.ListVisibleApproverGroups(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string][]string, len(groups))
+	for _, group := range groups {
+		members[strings.ToLower(group.Name)] = group.Members
+	}
+	return members, nil
+}
+
+// ListApproverGroups lists the groups owned by repoID; 0 lists global groups. Only groups of
+// the organizations in the scope of ctx are listed.
+func (s *Service) ListApproverGroups(ctx context.Context, repoID int64) ([]*model.ApproverGroup, error) {
+	return s.store.ListApproverGroups(ctx, repoID)
+}
+
+// GetApproverGroup returns the group or nil when it does not exist or belongs to an
+// organization outside the scope of ctx.
+func (s *Service) GetApproverGroup(ctx context.Context, id int64) (*model.ApproverGroup, error) {
+	group, err := s.store.GetApproverGroup(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// CreateApproverGroup persists a new group after normalising its name and members. A
+// repository group belongs to the organization of its repository; a global group to OrgID,
+// or the first organization of the caller when unset.
+func (s *Service) CreateApproverGroup(ctx context.Context, group *model.ApproverGroup) (*model.ApproverGroup, error) {
+	if group == nil {
+		return nil, fmt.Errorf("approver group is nil")
+	}
+	if err := normalizeApproverGroup(group); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	group.ID = 0
+	group.Created = now
+	group.Updated = now
+
+	if err := s.store.CreateApproverGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// UpdateApproverGroup replaces the name and members of a group. Pending approvals pick up
+// the new roster on their next decision. Returns nil when the group does not exist.
+func (s *Service) UpdateApproverGroup(ctx context.Context, id int64, patch *model.ApproverGroup) (*model.ApproverGroup, error) {
+	if patch == nil {
+		return nil, fmt.Errorf("approver group is nil")
+	}
+	updated, err := s.store.UpdateApproverGroup(ctx, id, func(group *model.ApproverGroup) error {
+		group.Name = patch.Name
+		group.Members = patch.Members
+		if err := normalizeApproverGroup(group); err != nil {
+			return err
+		}
+		group.Updated = time.Now().Unix()
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteApproverGroup removes a group. Approvals still referencing it can no longer be satisfied by it.
+func (s *Service) DeleteApproverGroup(ctx context.Context, id int64) error {
+	return s.store.DeleteApproverGroup(ctx, id)
+}
+
+func normalizeApproverGroup(group *model.ApproverGroup) error {
+	group.Name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(group.Name), approverGroupPrefix))
+	if group.Name == "" {
+		return fmt.Errorf("%w: 名称不能为空", ErrApproverGroupInvalid)
+	}
+	if strings.ContainsAny(group.Name, " \t,@") {
+		return fmt.Errorf("%w: 名称不能包含空白、逗号或 @", ErrApproverGroupInvalid)
+	}
+	if group.RepoID < 0 {
+		group.RepoID = 0
+	}
+
+	seen := make(map[string]struct{}, len(group.Members))
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		trimmed := strings.TrimSpace(member)
+		if trimmed == "" {
+			continue
+		}
+		key := strings.ToLower(trimmed)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		members = append(members, trimmed)
+	}
+	sort.Strings(members)
+	group.Members = members
+	return nil
+}
@@ -0,0 +1,241 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+// newApprovalRun returns a service over pipeline 1 of repository 1 blocked on approval step 1
+// with the given approvers, and the repository groups created from rosters before the
+// approval was requested.
+func newApprovalRun(t *testing.T, strategy model.StepApprovalStrategy, approvers []string, rosters map[string][]string) (*Service, *gormPipelineStore, map[string]int64) {
+	t.Helper()
+	st := newTransitionStore(t, model.StatusBlocked)
+	db := st.db.GetDB()
+	mustCreate(t, db, &model.Step{
+		ID: 1, PipelineID: 1, PID: 2, PPID: 1, Name: "release", Type: model.StepTypeApproval, State: model.StatusBlocked,
+		Approval: &model.StepApproval{State: model.StepApprovalStatePending, Strategy: strategy, Approvers: approvers},
+	})
+	mustCreate(t, db, &model.Task{ID: "task-1", PipelineID: 1, RepoID: 1})
+	svc := NewService(st.db, nil, nil)
+
+	// an approved step resumes the run through the queue
+	q := queue.New(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := q.Start(ctx, 1, func(context.Context, *model.Task) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Shutdown)
+	svc.queue = q
+
+	ids := make(map[string]int64, len(rosters))
+	for name, members := range rosters {
+		group, err := svc.CreateApproverGroup(context.Background(), &model.ApproverGroup{RepoID: 1, Name: name, Members: members})
+		if err != nil {
+			t.Fatalf("create group %s: %v", name, err)
+		}
+		ids[name] = group.ID
+	}
+	return svc, st, ids
+}
+
+func TestSubmitStepApprovalWithGroups(t *testing.T) {
+	type decision struct {
+		// roster replaces group rosters before the decision, as an admin editing the groups
+		// while the approval is pending
+		roster  map[string][]string
+		user    string
+		action  string
+		refused bool
+		state   model.StepApprovalState
+		pending []string
+		// snapshot is the group membership recorded with the decision, checked when set
+		snapshot []model.StepApprovalGroupSnapshot
+	}
+	cases := []struct {
+		name      string
+		strategy  model.StepApprovalStrategy
+		approvers []string
+		rosters   map[string][]string
+		decisions []decision
+	}{
+		{
+			name:      "any: member added after the request",
+			strategy:  model.StepApprovalStrategyAny,
+			approvers: []string{"@release"},
+			rosters:   map[string][]string{"release": {"alice"}},
+			decisions: []decision{
+				{user: "carol", action: "approve", refused: true, state: model.StepApprovalStatePending, pending: []string{"@release"}},
+				{
+					roster: map[string][]string{"release": {"alice", "carol"}},
+					user:   "carol", action: "approve", state: model.StepApprovalStateApproved,
+					snapshot: []model.StepApprovalGroupSnapshot{{Name: "release", Members: []string{"alice", "carol"}}},
+				},
+			},
+		},
+		{
+			name:      "any: member removed after the request",
+			strategy:  model.StepApprovalStrategyAny,
+			approvers: []string{"@release"},
+			rosters:   map[string][]string{"release": {"alice", "bob"}},
+			decisions: []decision{
+				{roster: map[string][]string{"release": {"bob"}}, user: "alice", action: "approve", refused: true, state: model.StepApprovalStatePending, pending: []string{"@release"}},
+				{user: "bob", action: "approve", state: model.StepApprovalStateApproved},
+			},
+		},
+		{
+			name:      "any: individual in a mixed list",
+			strategy:  model.StepApprovalStrategyAny,
+			approvers: []string{"dave", "@release"},
+			rosters:   map[string][]string{"release": {"alice"}},
+			decisions: []decision{
+				{user: "dave", action: "approve", state: model.StepApprovalStateApproved, pending: []string{"@release"}},
+			},
+		},
+		{
+			name:      "any: group member in a mixed list",
+			strategy:  model.StepApprovalStrategyAny,
+			approvers: []string{"dave", "@release"},
+			rosters:   map[string][]string{"release": {"alice"}},
+			decisions: []decision{
+				{user: "ALICE", action: "approve", state: model.StepApprovalStateApproved, pending: []string{"dave"}},
+			},
+		},
+		{
+			name:      "all: one approval per group and individual",
+			strategy:  model.StepApprovalStrategyAll,
+			approvers: []string{"dave", "@release", "@qa"},
+			rosters:   map[string][]string{"release": {"alice", "bob"}, "qa": {"erin"}},
+			decisions: []decision{
+				{user: "alice", action: "approve", state: model.StepApprovalStatePending, pending: []string{"dave", "@qa"}},
+				{user: "bob", action: "approve", state: model.StepApprovalStatePending, pending: []string{"dave", "@qa"}},
+				{user: "dave", action: "approve", state: model.StepApprovalStatePending, pending: []string{"@qa"}},
+				{user: "erin", action: "approve", state: model.StepApprovalStateApproved},
+			},
+		},
+		{
+			name:      "all: member in two groups satisfies both",
+			strategy:  model.StepApprovalStrategyAll,
+			approvers: []string{"@release", "@qa"},
+			rosters:   map[string][]string{"release": {"alice"}, "qa": {"alice", "erin"}},
+			decisions: []decision{
+				{
+					user: "alice", action: "approve", state: model.StepApprovalStateApproved,
+					snapshot: []model.StepApprovalGroupSnapshot{
+						{Name: "release", Members: []string{"alice"}},
+						{Name: "qa", Members: []string{"alice", "erin"}},
+					},
+				},
+			},
+		},
+		{
+			name:      "all: approval of a removed member no longer counts",
+			strategy:  model.StepApprovalStrategyAll,
+			approvers: []string{"@release", "dave"},
+			rosters:   map[string][]string{"release": {"alice"}},
+			decisions: []decision{
+				{user: "alice", action: "approve", state: model.StepApprovalStatePending, pending: []string{"dave"}},
+				{roster: map[string][]string{"release": {"bob"}}, user: "dave", action: "approve", state: model.StepApprovalStatePending, pending: []string{"@release"}},
+				{user: "bob", action: "approve", state: model.StepApprovalStateApproved},
+			},
+		},
+		{
+			name:      "all: rejection by a group member",
+			strategy:  model.StepApprovalStrategyAll,
+			approvers: []string{"@release", "dave"},
+			rosters:   map[string][]string{"release": {"alice"}},
+			decisions: []decision{
+				{user: "dave", action: "approve", state: model.StepApprovalStatePending, pending: []string{"@release"}},
+				{user: "alice", action: "reject", state: model.StepApprovalStateRejected, pending: []string{"@release"}},
+			},
+		},
+		{
+			name:      "unknown group",
+			strategy:  model.StepApprovalStrategyAny,
+			approvers: []string{"@ghost"},
+			decisions: []decision{
+				{user: "alice", action: "approve", refused: true, state: model.StepApprovalStatePending, pending: []string{"@ghost"}},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc, st, ids := newApprovalRun(t, tc.strategy, tc.approvers, tc.rosters)
+			for i, d := range tc.decisions {
+				for name, members := range d.roster {
+					if _, err := svc.UpdateApproverGroup(ctx, ids[name], &model.ApproverGroup{Name: name, Members: members}); err != nil {
+						t.Fatalf("decision %d: update group %s: %v", i, name, err)
+					}
+				}
+				_, err := svc.SubmitStepApproval(ctx, 1, 1, 1, d.user, d.action, "")
+				if d.refused {
+					if err == nil || !strings.Contains(err.Error(), "不在审批名单") {
+						t.Fatalf("decision %d: %s %s = %v, want refused", i, d.user, d.action, err)
+					}
+				} else if err != nil {
+					t.Fatalf("decision %d: %s %s: %v", i, d.user, d.action, err)
+				}
+
+				step, err := st.GetStep(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if step.Approval.State != d.state {
+					t.Fatalf("decision %d: approval = %s, want %s", i, step.Approval.State, d.state)
+				}
+				groups, err := svc.ApproverGroupMembers(ctx, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var pending []string
+				for _, requirement := range PendingApprovers(ResolveApprovers(step.Approval.Approvers, groups), step.Approval.Decisions) {
+					pending = append(pending, requirement.Ref)
+				}
+				if !reflect.DeepEqual(pending, d.pending) {
+					t.Fatalf("decision %d: pending approvers = %v, want %v", i, pending, d.pending)
+				}
+				if d.snapshot != nil {
+					var recorded []model.StepApprovalGroupSnapshot
+					for _, item := range step.Approval.Decisions {
+						if strings.EqualFold(item.User, d.user) {
+							recorded = item.Groups
+						}
+					}
+					if !reflect.DeepEqual(recorded, d.snapshot) {
+						t.Fatalf("decision %d: recorded groups = %+v, want %+v", i, recorded, d.snapshot)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestResolveApproversUsesCurrentRoster(t *testing.T) {
+	approvers := []string{"dave", "@Release", " ", "@"}
+	requirements := ResolveApprovers(approvers, map[string][]string{"release": {"alice"}})
+	if len(requirements) != 3 {
+		t.Fatalf("requirements = %+v, want dave, @Release and the literal @", requirements)
+	}
+	if requirements[1].Group != "Release" || !requirements[1].Includes("Alice") || requirements[1].Includes("dave") {
+		t.Fatalf("group requirement = %+v, want the release roster", requirements[1])
+	}
+	if ApproverAllowed(requirements, "bob") {
+		t.Fatalf("bob is allowed before joining the group")
+	}
+
+	// the same approvers list resolved after a roster edit
+	requirements = ResolveApprovers(approvers, map[string][]string{"release": {"bob"}})
+	if !ApproverAllowed(requirements, "bob") || ApproverAllowed(requirements, "alice") {
+		t.Fatalf("requirements = %+v, want bob in and alice out after the roster edit", requirements)
+	}
+	if !ApproverAllowed(nil, "anyone") {
+		t.Fatalf("an empty approvers list must allow everyone")
+	}
+}
@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrArtifactFileMissing is returned when an artifact record outlived its file.
+var ErrArtifactFileMissing = errors.New("制品文件不存在")
+
+// ArtifactLimits bounds what a single step may collect. Zero disables a limit.
+type ArtifactLimits struct {
+	MaxFiles     int
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+var defaultArtifactLimits = ArtifactLimits{
+	MaxFiles:     100,
+	MaxFileSize:  100 << 20,
+	MaxTotalSize: 500 << 20,
+}
+
+// WithArtifacts sets the directory artifacts are stored in and the per-step limits.
+func WithArtifacts(root string, limits ArtifactLimits) Option {
+	return func(s *Service) {
+		s.artifactRoot = strings.TrimSpace(root)
+		s.artifactLimits = limits
+	}
+}
+
+func (s *Service) artifactDir(pipelineID, stepID int64) string {
+	root := s.artifactRoot
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "go-devops-artifacts")
+	}
+	dir := filepath.Join(root, strconv.FormatInt(pipelineID, 10))
+	if stepID > 0 {
+		dir = filepath.Join(dir, strconv.FormatInt(stepID, 10))
+	}
+	return dir
+}
+
+// collectArtifacts copies the workspace files matching patterns into the artifact directory
+// of the step and records them, replacing what an earlier attempt of the step collected.
+// Files over the limits are skipped with a log line rather than failing the step.
+func (s *Service) collectArtifacts(ctx context.Context, pipelineID int64, step *model.Step, workspace string, patterns []string, logFn func(string) error) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	if workspace == "" {
+		_ = logFn("未准备工作目录，跳过制品收集")
+		return nil
+	}
+
+	dir := s.artifactDir(pipelineID, step.ID)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("清理制品目录失败: %w", err)
+	}
+
+	limits := s.artifactLimits
+	var artifacts []*model.Artifact
+	var total int64
+	now := time.Now().Unix()
+
+	err := filepath.WalkDir(workspace, func(current string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// symlinks are skipped so a step cannot publish files from outside the workspace
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(workspace, current)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchAnyArtifactPattern(patterns, rel) {
+			return nil
+		}
+
+		if limits.MaxFiles > 0 && len(artifacts) >= limits.MaxFiles {
+			_ = logFn(fmt.Sprintf("制品数量超过上限 %d，停止收集", limits.MaxFiles))
+			return fs.SkipAll
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if limits.MaxFileSize > 0 && info.Size() > limits.MaxFileSize {
+			_ = logFn(fmt.Sprintf("制品 %s 大小 %d 字节超过单文件上限 %d，已跳过", rel, info.Size(), limits.MaxFileSize))
+			return nil
+		}
+		if limits.MaxTotalSize > 0 && total+info.Size() > limits.MaxTotalSize {
+			_ = logFn(fmt.Sprintf("制品 %s 使总大小超过上限 %d 字节，已跳过", rel, limits.MaxTotalSize))
+			return nil
+		}
+
+		size, checksum, err := copyArtifact(current, filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return fmt.Errorf("收集制品 %s 失败: %w", rel, err)
+		}
+		total += size
+		artifacts = append(artifacts, &model.Artifact{
+			PipelineID: pipelineID,
+			StepID:     step.ID,
+			Path:       rel,
+			Size:       size,
+			Checksum:   checksum,
+			Created:    now,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.ReplaceStepArtifacts(ctx, step.ID, artifacts); err != nil {
+		return fmt.Errorf("保存制品记录失败: %w", err)
+	}
+	if len(artifacts) == 0 {
+		_ = logFn(fmt.Sprintf("未找到匹配 %s 的制品", strings.Join(patterns, ", ")))
+		return nil
+	}
+	_ = logFn(fmt.Sprintf("已收集 %d 个制品，共 %d 字节", len(artifacts), total))
+	return nil
+}
+
+func copyArtifact(src, dst string) (int64, string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, "", err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// matchAnyArtifactPattern reports whether rel, or a directory containing it, matches one of
+// the patterns; matching a directory collects everything below it.
+func matchAnyArtifactPattern(patterns []string, rel string) bool {
+	segments := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		if pattern == "." {
+			return true
+		}
+		patternSegments := strings.Split(pattern, "/")
+		for end := 1; end <= len(segments); end++ {
+			if matchArtifactSegments(patternSegments, segments[:end]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchArtifactSegments matches path segments against pattern segments, where `**` spans
+// any number of segments, including none.
+func matchArtifactSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(segments); skip++ {
+			if matchArtifactSegments(pattern[1:], segments[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+		return false
+	}
+	return matchArtifactSegments(pattern[1:], segments[1:])
+}
+
+// removeArtifactFiles deletes the artifact directories of deleted pipelines.
+func (s *Service) removeArtifactFiles(pipelineIDs []int64) {
+	for _, id := range pipelineIDs {
+		dir := s.artifactDir(id, 0)
+		if err := os.RemoveAll(dir); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", dir).Msg("failed to remove pipeline artifacts")
+		}
+	}
+}
+
+// ListPipelineArtifacts lists the artifacts of a pipeline of repoID.
+func (s *Service) ListPipelineArtifacts(ctx context.Context, repoID, pipelineID int64) ([]*model.Artifact, error) {
+	return s.store.ListArtifacts(ctx, repoID, pipelineID)
+}
+
+// OpenArtifact returns an artifact of a pipeline of repoID with its opened file, which the
+// caller must close. The artifact is nil when no such record exists.
+func (s *Service) OpenArtifact(ctx context.Context, repoID, pipelineID, artifactID int64) (*model.Artifact, *os.File, error) {
+	artifact, err := s.store.GetArtifact(ctx, repoID, pipelineID, artifactID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filepath.Join(s.artifactDir(artifact.PipelineID, artifact.StepID), filepath.FromSlash(artifact.Path)))
+	if errors.Is(err, os.ErrNotExist) {
+		return artifact, nil, ErrArtifactFileMissing
+	}
+	if err != nil {
+		return artifact, nil, err
+	}
+	return artifact, file, nil
+}
@@ -0,0 +1,239 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+func TestMatchAnyArtifactPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"app", "app", true},
+		{"*.xml", "report.xml", true},
+		{"*.xml", "reports/report.xml", false},
+		{"dist", "dist/bin/app", true},
+		{"dist/*", "dist/app", true},
+		{"dist/*.tar.gz", "dist/app.zip", false},
+		{"**/*.xml", "report.xml", true},
+		{"**/*.xml", "a/b/c/report.xml", true},
+		{"build/**/app", "build/app", true},
+		{"build/**/app", "build/linux/amd64/app", true},
+		{"build/**/app", "build/linux/amd64/app.sha", false},
+		{".", "anything/at/all", true},
+		{"[", "[", false},
+	}
+	for _, c := range cases {
+		if got := matchAnyArtifactPattern([]string{c.pattern}, c.path); got != c.want {
+			t.Errorf("match(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+// newArtifactService returns a service over a database holding step 1 of pipeline 1 of
+// repository 1, storing artifacts under a temporary root with limits.
+func newArtifactService(t *testing.T, limits ArtifactLimits) (*Service, string) {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.LogEntry{},
+		&model.Task{}, &model.Artifact{}, &model.PipelineProvenance{}, &model.PipelineSnapshot{}, &model.NotificationAttempt{})
+	records := []any{
+		&model.Repo{ID: 1, Owner: "team", Name: "app", FullName: "team/app"},
+		&model.Pipeline{ID: 1, RepoID: 1, Number: 1, Status: model.StatusRunning, Created: 100},
+		&model.Step{ID: 1, PipelineID: 1, PID: 2, PPID: 1, Name: "build", State: model.StatusRunning},
+	}
+	for _, record := range records {
+		mustCreate(t, db.GetDB(), record)
+	}
+	root := t.TempDir()
+	return NewService(db, nil, nil, WithArtifacts(root, limits)), root
+}
+
+func writeWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+	workspace := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(workspace, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return workspace
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	svc, _ := newArtifactService(t, defaultArtifactLimits)
+	ctx := context.Background()
+	workspace := writeWorkspace(t, map[string]string{
+		"dist/app":            "binary",
+		"dist/lib/helper.so":  "library",
+		"reports/unit.xml":    "<testsuite/>",
+		"src/main.go":         "package main",
+		".git/objects/packed": "git",
+	})
+	// symlinks could publish files from outside the workspace
+	if err := os.Symlink("/etc/hostname", filepath.Join(workspace, "dist", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	var logs []string
+	logFn := func(line string) error {
+		logs = append(logs, line)
+		return nil
+	}
+
+	step := &model.Step{ID: 1, PipelineID: 1}
+	if err := svc.collectArtifacts(ctx, 1, step, workspace, []string{"dist", "**/*.xml", ".git"}, logFn); err != nil {
+		t.Fatalf("collectArtifacts: %v", err)
+	}
+	artifacts, err := svc.ListPipelineArtifacts(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, artifact := range artifacts {
+		paths = append(paths, artifact.Path)
+	}
+	if got := strings.Join(paths, ","); got != "dist/app,dist/lib/helper.so,reports/unit.xml" {
+		t.Fatalf("collected %s, want the matching regular files outside .git", got)
+	}
+	sum := sha256.Sum256([]byte("binary"))
+	if artifacts[0].Size != 6 || artifacts[0].Checksum != hex.EncodeToString(sum[:]) || artifacts[0].StepID != 1 {
+		t.Errorf("artifact = %+v, want the size and checksum of dist/app", artifacts[0])
+	}
+	if len(logs) == 0 || !strings.Contains(logs[len(logs)-1], "已收集 3 个制品") {
+		t.Errorf("logs = %q, want the collected count", logs)
+	}
+
+	artifact, file, err := svc.OpenArtifact(ctx, 1, 1, artifacts[0].ID)
+	if err != nil {
+		t.Fatalf("OpenArtifact: %v", err)
+	}
+	content, _ := io.ReadAll(file)
+	file.Close()
+	if artifact.Path != "dist/app" || string(content) != "binary" {
+		t.Errorf("opened %s with %q, want dist/app with its content", artifact.Path, content)
+	}
+	if artifact, _, err := svc.OpenArtifact(ctx, 2, 1, artifacts[0].ID); artifact != nil || err != nil {
+		t.Errorf("OpenArtifact through another repository = %+v %v, want nothing", artifact, err)
+	}
+
+	// a retried step replaces what the earlier attempt collected
+	if err := os.Remove(filepath.Join(workspace, "reports", "unit.xml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.collectArtifacts(ctx, 1, step, workspace, []string{"**/*.xml"}, logFn); err != nil {
+		t.Fatalf("collectArtifacts again: %v", err)
+	}
+	if artifacts, _ := svc.ListPipelineArtifacts(ctx, 1, 1); len(artifacts) != 0 {
+		t.Errorf("artifacts after the retry = %d, want none", len(artifacts))
+	}
+	if _, _, err := svc.OpenArtifact(ctx, 1, 1, artifact.ID); err != nil {
+		t.Errorf("OpenArtifact of a replaced record = %v, want no record", err)
+	}
+}
+
+func TestCollectArtifactsLimits(t *testing.T) {
+	svc, root := newArtifactService(t, ArtifactLimits{MaxFiles: 2, MaxFileSize: 5, MaxTotalSize: 6})
+	ctx := context.Background()
+	workspace := writeWorkspace(t, map[string]string{
+		"out/a": "1234",
+		"out/b": "123456",
+		"out/c": "123",
+		"out/d": "1",
+		"out/e": "1",
+	})
+	var logs []string
+	logFn := func(line string) error {
+		logs = append(logs, line)
+		return nil
+	}
+
+	if err := svc.collectArtifacts(ctx, 1, &model.Step{ID: 1}, workspace, []string{"out"}, logFn); err != nil {
+		t.Fatalf("collectArtifacts: %v", err)
+	}
+	artifacts, err := svc.ListPipelineArtifacts(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, artifact := range artifacts {
+		paths = append(paths, artifact.Path)
+	}
+	// b is over the file limit, c over the total and collection stops at two files
+	if got := strings.Join(paths, ","); got != "out/a,out/d" {
+		t.Fatalf("collected %s, want out/a,out/d", got)
+	}
+	joined := strings.Join(logs, "\n")
+	for _, want := range []string{"out/b 大小 6 字节超过单文件上限 5", "out/c 使总大小超过上限 6", "制品数量超过上限 2"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("logs miss %q:\n%s", want, joined)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "1", "1", "out", "b")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("skipped file was stored: %v", err)
+	}
+}
+
+func TestArtifactFileMissing(t *testing.T) {
+	svc, root := newArtifactService(t, defaultArtifactLimits)
+	ctx := context.Background()
+	workspace := writeWorkspace(t, map[string]string{"app": "binary"})
+	if err := svc.collectArtifacts(ctx, 1, &model.Step{ID: 1}, workspace, []string{"app"}, func(string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	artifacts, _ := svc.ListPipelineArtifacts(ctx, 1, 1)
+	if len(artifacts) != 1 {
+		t.Fatalf("artifacts = %d, want 1", len(artifacts))
+	}
+	if _, _, err := svc.OpenArtifact(ctx, 1, 1, artifacts[0].ID); !errors.Is(err, ErrArtifactFileMissing) {
+		t.Errorf("OpenArtifact = %v, want ErrArtifactFileMissing", err)
+	}
+}
+
+func TestRetentionRemovesArtifacts(t *testing.T) {
+	svc, root := newArtifactService(t, defaultArtifactLimits)
+	ctx := context.Background()
+	db := svc.store.(*gormPipelineStore).db.GetDB()
+	mustCreate(t, db, &model.Pipeline{ID: 2, RepoID: 1, Number: 2, Status: model.StatusSuccess, Created: 200})
+	mustCreate(t, db, &model.Step{ID: 2, PipelineID: 2, PID: 2, PPID: 1, Name: "build", State: model.StatusSuccess})
+
+	workspace := writeWorkspace(t, map[string]string{"app": "binary"})
+	for _, step := range []*model.Step{{ID: 1, PipelineID: 1}, {ID: 2, PipelineID: 2}} {
+		if err := svc.collectArtifacts(ctx, step.PipelineID, step, workspace, []string{"app"}, func(string) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := &model.Repo{ID: 1, Name: "app", FullName: "team/app"}
+	if err := svc.enforcePipelineRetention(ctx, repo, &model.RepoPipelineConfig{MaxRecords: 1}); err != nil {
+		t.Fatalf("enforcePipelineRetention: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("artifacts of the deleted pipeline stayed on disk: %v", err)
+	}
+	var count int64
+	db.Model(&model.Artifact{}).Where("pipeline_id = ?", 1).Count(&count)
+	if count != 0 {
+		t.Errorf("%d artifact records of the deleted pipeline stayed", count)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2", "2", "app")); err != nil {
+		t.Errorf("artifacts of the kept pipeline: %v", err)
+	}
+}
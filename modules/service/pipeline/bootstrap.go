@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+	"github.com/thepenn/devsys/service/pipeline/starter"
+)
+
+const (
+	bootstrapFilesCacheKey    = "bootstrap:files:%d:%d"
+	bootstrapManifestCacheKey = "bootstrap:manifest:%d:%d:%s"
+	bootstrapCacheTTL         = time.Minute
+)
+
+// RepositoryContentReader reads repository files from the forge with the caller's token.
+type RepositoryContentReader interface {
+	ListRepositoryFiles(ctx context.Context, userID int64, repo *model.Repo, ref string) ([]string, error)
+	ReadRepositoryFile(ctx context.Context, userID int64, repo *model.Repo, path, ref string) ([]byte, error)
+}
+
+// PipelineBootstrap is a proposed pipeline configuration rendered from a starter template.
+type PipelineBootstrap struct {
+	Stack   starter.Stack
+	Module  string
+	Content string
+	Files   []string
+}
+
+// BootstrapPipelineConfig inspects the repository's top-level files, picks a starter template
+// for the detected stack and renders it. The result is not saved.
+func (s *Service) BootstrapPipelineConfig(ctx context.Context, repo *model.Repo, userID int64) (*PipelineBootstrap, error) {
+	if repo == nil {
+		return nil, fmt.Errorf("repository is required")
+	}
+	if s.contents == nil {
+		return nil, model.NewFeatureUnavailableError(model.CapabilityPipeline, "repository content reader not configured")
+	}
+
+	files, err := s.bootstrapFiles(ctx, repo, userID)
+	if err != nil {
+		return nil, fmt.Errorf("读取仓库文件列表失败: %w", err)
+	}
+
+	stack := starter.Detect(files)
+	var module string
+	if manifest, ok := starter.ManifestFiles[stack]; ok {
+		content, err := s.bootstrapManifest(ctx, repo, userID, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %w", manifest, err)
+		}
+		module = starter.ModuleName(stack, content)
+	}
+
+	content, err := starter.Render(stack, starter.Values{
+		Name:       repo.Name,
+		Branch:     repo.Branch,
+		Module:     module,
+		Dockerfile: starter.HasDockerfile(files),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := spec.Parse(content); err != nil {
+		return nil, fmt.Errorf("生成的流水线配置无效: %w", err)
+	}
+
+	return &PipelineBootstrap{
+		Stack:   stack,
+		Module:  module,
+		Content: content,
+		Files:   files,
+	}, nil
+}
+
+func (s *Service) bootstrapFiles(ctx context.Context, repo *model.Repo, userID int64) ([]string, error) {
+	key := fmt.Sprintf(bootstrapFilesCacheKey, userID, repo.ID)
+	if s.cache != nil {
+		var files []string
+		if s.cache.Get(key, &files) {
+			return files, nil
+		}
+	}
+	files, err := s.contents.ListRepositoryFiles(ctx, userID, repo, repo.Branch)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.Set(key, files, bootstrapCacheTTL)
+	}
+	return files, nil
+}
+
+func (s *Service) bootstrapManifest(ctx context.Context, repo *model.Repo, userID int64, path string) ([]byte, error) {
+	key := fmt.Sprintf(bootstrapManifestCacheKey, userID, repo.ID, path)
+	if s.cache != nil {
+		var content []byte
+		if s.cache.Get(key, &content) {
+			return content, nil
+		}
+	}
+	content, err := s.contents.ReadRepositoryFile(ctx, userID, repo, path, repo.Branch)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.Set(key, content, bootstrapCacheTTL)
+	}
+	return content, nil
+}
@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	pipelineruntime "github.com/thepenn/devsys/service/pipeline/runtime"
+	dockerruntime "github.com/thepenn/devsys/service/pipeline/runtime/docker"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// pipelineBuildConfig is a built-in image build as stored in the task payload.
+type pipelineBuildConfig struct {
+	Dockerfile string            `json:"dockerfile"`
+	Context    string            `json:"context"`
+	Tags       []string          `json:"tags"`
+	Args       map[string]string `json:"args,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Push       bool              `json:"push,omitempty"`
+}
+
+func newPipelineBuildConfig(build *spec.BuildSpec) *pipelineBuildConfig {
+	if build == nil {
+		return nil
+	}
+	return &pipelineBuildConfig{
+		Dockerfile: build.Dockerfile,
+		Context:    build.Context,
+		Tags:       append([]string{}, build.Tags...),
+		Args:       cloneStringMap(build.Args),
+		Target:     build.Target,
+		Push:       build.Push,
+	}
+}
+
+// buildStepRequest is a build step with its placeholders resolved.
+type buildStepRequest struct {
+	Repo     *model.Repo
+	Pipeline *model.Pipeline
+	StepName string
+	Config   *pipelineBuildConfig
+	Tags     []string
+	Args     map[string]string
+	// InlineDockerfile is the Dockerfile of the repository settings, built when the
+	// workspace has none.
+	InlineDockerfile string
+	Secrets          map[string]resolvedSecretBinding
+}
+
+// runBuildStep builds the image of a build step through the docker API and, with push, pushes
+// every tag. The image of the previous successful run of the step and the tags themselves
+// seed the layer cache. It returns the step outputs: the first tag as image and its digest,
+// the registry digest when pushed and the image id otherwise.
+func (s *Service) runBuildStep(ctx context.Context, workspace string, req buildStepRequest, logFn func(string) error) (map[string]string, error) {
+	if workspace == "" {
+		return nil, fmt.Errorf("工作目录不可用，无法构建镜像")
+	}
+	runtime, err := s.dockerRunner()
+	if err != nil {
+		return nil, fmt.Errorf("初始化 Docker 运行时失败: %w", err)
+	}
+	contextDir, err := workspaceSubpath(workspace, req.Config.Context)
+	if err != nil {
+		return nil, fmt.Errorf("构建上下文 %s 无效: %w", req.Config.Context, err)
+	}
+	if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("构建上下文 %s 不是目录", req.Config.Context)
+	}
+
+	cfg := dockerruntime.BuildConfig{
+		ContextDir: contextDir,
+		Tags:       req.Tags,
+		Args:       req.Args,
+		Target:     req.Config.Target,
+	}
+	if req.Pipeline.Commit != "" {
+		cfg.Labels = map[string]string{"org.opencontainers.image.revision": req.Pipeline.Commit}
+	}
+	cfg.Dockerfile, err = workspaceSubpath(workspace, req.Config.Dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("Dockerfile %s 无效: %w", req.Config.Dockerfile, err)
+	}
+	if info, err := os.Stat(cfg.Dockerfile); err != nil || info.IsDir() {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("读取 Dockerfile 失败: %w", err)
+		}
+		if strings.TrimSpace(req.InlineDockerfile) == "" {
+			return nil, fmt.Errorf("未检测到仓库中的 %s，且未在系统中定义 Dockerfile", req.Config.Dockerfile)
+		}
+		cfg.DockerfileContent = []byte(req.InlineDockerfile)
+		_ = logFn(fmt.Sprintf("未检测到仓库中的 %s，已使用系统配置的 Dockerfile", req.Config.Dockerfile))
+	}
+
+	if previous := s.previousBuildImage(ctx, req.Repo.ID, req.Pipeline.ID, req.StepName); previous != "" {
+		cfg.CacheFrom = append(cfg.CacheFrom, previous)
+	}
+	for _, tag := range req.Tags {
+		if !slices.Contains(cfg.CacheFrom, tag) {
+			cfg.CacheFrom = append(cfg.CacheFrom, tag)
+		}
+	}
+	auths := make(map[string]*pipelineruntime.RegistryAuth)
+	for _, image := range append(append([]string{}, req.Tags...), cfg.CacheFrom...) {
+		host := imageRegistryHost(image)
+		if _, ok := auths[host]; ok {
+			continue
+		}
+		auth := registryAuthForImage(image, req.Secrets)
+		auths[host] = auth
+		if auth != nil {
+			cfg.RegistryAuths = append(cfg.RegistryAuths, *auth)
+		}
+	}
+
+	_ = logFn(fmt.Sprintf("构建镜像 %s", strings.Join(req.Tags, ", ")))
+	imageID, err := runtime.BuildImage(ctx, cfg, logFn)
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]string{"image": req.Tags[0], "digest": imageID}
+	if !req.Config.Push {
+		return outputs, nil
+	}
+
+	for idx, tag := range req.Tags {
+		auth := auths[imageRegistryHost(tag)]
+		if auth == nil {
+			_ = logFn(fmt.Sprintf("未找到镜像仓库 %s 的 docker 凭据，匿名推送", imageRegistryHost(tag)))
+		}
+		digest, err := runtime.PushImage(ctx, tag, auth, logFn)
+		if err != nil {
+			return nil, err
+		}
+		if idx == 0 && digest != "" {
+			outputs["digest"] = digest
+		}
+	}
+	return outputs, nil
+}
+
+// previousBuildImage returns the image of the last successful run of the build step before
+// pipelineID, or "" when there is none.
+func (s *Service) previousBuildImage(ctx context.Context, repoID, pipelineID int64, stepName string) string {
+	step, err := s.store.PreviousBuildStep(ctx, repoID, pipelineID, stepName)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Warn().Err(err).Int64("repo_id", repoID).Str("step", stepName).Msg("failed to look up previous build image")
+		}
+		return ""
+	}
+	return step.Outputs["image"]
+}
+
+// workspaceSubpath joins a slash separated relative path to workspace and rejects paths
+// that leave it through symlinks. The path itself need not exist.
+func workspaceSubpath(workspace, rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(workspace)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	resolved, err := filepath.EvalSymlinks(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if out, err := filepath.Rel(root, resolved); err != nil || out == ".." || strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("位于工作目录之外")
+	}
+	return resolved, nil
+}
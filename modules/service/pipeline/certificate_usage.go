@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// CertificateUsage lists the repositories whose pipelines reference the certificate id: by
+// a settings binding, by a step secret alias or deploy cluster naming it, or through
+// kubernetes objects they manage in it. Configs read from a repository file are matched on
+// their bindings only. It returns nil when the certificate does not exist.
+func (s *Service) CertificateUsage(ctx context.Context, id int64) (*model.CertificateUsage, error) {
+	if s.systemSvc == nil {
+		return nil, fmt.Errorf("system service unavailable")
+	}
+	cert, err := s.systemSvc.GetCertificate(ctx, id)
+	if err != nil || cert == nil {
+		return nil, err
+	}
+
+	configs, err := s.store.ListPipelineConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*model.KubernetesTarget
+	if cert.Type == model.CertificateTypeKubernetes {
+		if targets, err = s.store.ListKubernetesTargets(ctx, cert.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	references := make(map[int64][]model.CertificateReference)
+	for _, cfg := range configs {
+		if refs := configCertificateReferences(cfg, cert); len(refs) > 0 {
+			references[cfg.RepoID] = refs
+		}
+	}
+	targetRepos := make(map[int64]struct{})
+	for _, target := range targets {
+		if _, seen := targetRepos[target.RepoID]; seen {
+			continue
+		}
+		targetRepos[target.RepoID] = struct{}{}
+		references[target.RepoID] = append(references[target.RepoID], model.CertificateReference{Kind: model.CertificateRefTarget})
+	}
+
+	usage := &model.CertificateUsage{
+		CertificateID: cert.ID,
+		Name:          cert.Name,
+		Type:          cert.Type,
+		Repos:         []model.CertificateRepoUsage{},
+	}
+	if len(references) == 0 {
+		return usage, nil
+	}
+	repoIDs := make([]int64, 0, len(references))
+	for repoID := range references {
+		repoIDs = append(repoIDs, repoID)
+	}
+	repos, err := s.store.ListRepos(ctx, repoIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		// pipelines resolve certificates within the organization of their repository only
+		if s.tenancy && repo.OrgID != cert.OrgID {
+			continue
+		}
+		usage.Repos = append(usage.Repos, model.CertificateRepoUsage{
+			RepoID:     repo.ID,
+			FullName:   repo.FullName,
+			References: references[repo.ID],
+		})
+	}
+	return usage, nil
+}
+
+// configCertificateReferences returns how the pipeline config references cert.
+func configCertificateReferences(cfg *model.RepoPipelineConfig, cert *model.Certificate) []model.CertificateReference {
+	var refs []model.CertificateReference
+	for _, binding := range cfg.LegacyCertificates {
+		if binding.CertificateID == cert.ID {
+			refs = append(refs, model.CertificateReference{Kind: model.CertificateRefBinding})
+			break
+		}
+	}
+	if cfg.ConfigSource == model.PipelineConfigSourceRepo || strings.TrimSpace(cfg.Content) == "" {
+		return refs
+	}
+	parsed, err := spec.Parse(cfg.Content)
+	if err != nil {
+		log.Debug().Err(err).Int64("repo_id", cfg.RepoID).Msg("skipping unparsable pipeline config in certificate usage")
+		return refs
+	}
+	for _, step := range parsed.Steps {
+		for _, alias := range step.Secrets {
+			if strings.EqualFold(strings.TrimSpace(alias), cert.Name) {
+				refs = append(refs, model.CertificateReference{Kind: model.CertificateRefSecret, Step: step.Name})
+				break
+			}
+		}
+		if step.Deploy != nil && cert.Type == model.CertificateTypeKubernetes {
+			cluster := strings.TrimSpace(step.Deploy.Cluster)
+			if cluster == cert.Name || cluster == strconv.FormatInt(cert.ID, 10) {
+				refs = append(refs, model.CertificateReference{Kind: model.CertificateRefDeploy, Step: step.Name})
+			}
+		}
+	}
+	return refs
+}
+
+// certificateRotationWarnings returns a step log line for every certificate among bindings
+// that was updated after the run was triggered at triggered.
+func certificateRotationWarnings(bindings map[string]resolvedSecretBinding, triggered int64) []string {
+	var warnings []string
+	for _, binding := range bindings {
+		if binding.CertificateID == 0 || binding.CertificateUpdated <= triggered {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("警告: 凭证 %s 在流水线触发后已更新（版本 %d），本步骤使用更新后的凭证", binding.Alias, binding.CertificateVersion))
+	}
+	sort.Strings(warnings)
+	return warnings
+}
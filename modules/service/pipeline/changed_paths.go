@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// resolveChangedFiles returns the files the pipeline changed and whether they are known.
+// The list comes from the webhook when it carried one, otherwise from diffing the cloned
+// workspace against the commit of the last successful pipeline of the branch, and is stored
+// on the pipeline. The changes are unknown for the first run of a branch or when that
+// commit cannot be reached, in which case every step runs.
+func (s *Service) resolveChangedFiles(ctx context.Context, pipeline *model.Pipeline, workspace string, logFn func(string) error) ([]string, bool) {
+	if pipeline.ChangedFiles != nil {
+		return pipeline.ChangedFiles, true
+	}
+	logf := func(message string) {
+		if logFn != nil {
+			_ = logFn(message)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(workspace, ".git")); err != nil || !info.IsDir() {
+		logf("工作目录不是 git 仓库，无法计算变更文件，路径条件不生效")
+		return nil, false
+	}
+	branch := strings.TrimSpace(pipeline.Branch)
+	previous, err := s.store.LastSuccessfulCommit(ctx, pipeline.RepoID, branch, pipeline.ID, pipeline.Commit)
+	if err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipeline.ID).Msg("failed to look up previous successful commit")
+		logf("查询上次成功构建失败，路径条件不生效")
+		return nil, false
+	}
+	if previous == "" {
+		logf(fmt.Sprintf("分支 %s 没有成功的构建记录，路径条件不生效", branch))
+		return nil, false
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", workspace, "diff", "--name-only", previous, "HEAD")
+	cmd.Env = s.hostEnvList()
+	output, err := cmd.Output()
+	if err != nil {
+		// shallow clones and rewritten history leave the previous commit unreachable
+		logf(fmt.Sprintf("无法对比上次成功构建的提交 %s，路径条件不生效", shortCommit(previous)))
+		return nil, false
+	}
+	files := make([]string, 0)
+	for _, line := range strings.Split(string(output), "\n") {
+		if file := strings.TrimSpace(line); file != "" {
+			files = append(files, file)
+		}
+	}
+	if err := s.store.UpdatePipeline(ctx, pipeline.ID, map[string]any{"changed_files": files}); err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipeline.ID).Msg("failed to store changed files")
+	}
+	pipeline.ChangedFiles = files
+	logf(fmt.Sprintf("相对上次成功构建的提交 %s 变更了 %d 个文件", shortCommit(previous), len(files)))
+	return files, true
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
@@ -0,0 +1,413 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// cloneProgressInterval limits how often git progress lines are written to the step log.
+const cloneProgressInterval = 3 * time.Second
+
+var (
+	errGitUnavailable    = errors.New("未找到 git 可执行文件，无法执行内置克隆")
+	errGitLFSUnavailable = errors.New("已启用 clone.lfs，但当前环境未安装 git-lfs 扩展")
+)
+
+// gitProgressPattern matches git/git-lfs progress output such as
+// "Receiving objects:  45% (450/1000)" or "Downloading LFS objects:  50% (1/2), 10 MB".
+var gitProgressPattern = regexp.MustCompile(`\d{1,3}%\s*\(\d+/\d+\)`)
+
+type pipelineCloneConfig struct {
+	LFS        bool  `json:"lfs,omitempty"`
+	Depth      int   `json:"depth,omitempty"`
+	Submodules bool  `json:"submodules,omitempty"`
+	FetchTags  *bool `json:"fetch_tags,omitempty"`
+}
+
+// progressThrottler forwards regular output immediately while collapsing git
+// progress lines to at most one update per interval.
+type progressThrottler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	now      func() time.Time
+	last     time.Time
+	pending  string
+	logFn    func(string) error
+}
+
+func newProgressThrottler(interval time.Duration, logFn func(string) error) *progressThrottler {
+	return &progressThrottler{
+		interval: interval,
+		now:      time.Now,
+		logFn:    logFn,
+	}
+}
+
+func (t *progressThrottler) Log(line string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.logFn == nil {
+		return nil
+	}
+	if !gitProgressPattern.MatchString(line) {
+		return t.logFn(line)
+	}
+	now := t.now()
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		t.pending = line
+		return nil
+	}
+	t.last = now
+	t.pending = ""
+	return t.logFn(line)
+}
+
+// Flush writes the most recent suppressed progress line so the final state is always visible.
+func (t *progressThrottler) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == "" || t.logFn == nil {
+		return nil
+	}
+	line := t.pending
+	t.pending = ""
+	return t.logFn(line)
+}
+
+// runClonePhase clones the repository into the prepared workspace, fetches LFS
+// objects and submodules when requested and records the resulting workspace size. SSH
+// clone URLs authenticate with sshKey when one is bound.
+func (s *Service) runClonePhase(ctx context.Context, pipelineID int64, workspace string, payload pipelineTaskPayload, env map[string]string, sshKey *model.SSHCertificate, logFn func(string) error) error {
+	cloneURL := strings.TrimSpace(firstNonEmpty(env["REPO_CLONE_URL_AUTH"], env["REPO_CLONE_URL"], payload.RepoClone))
+	if cloneURL == "" {
+		return fmt.Errorf("仓库克隆地址缺失，无法执行内置克隆")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return errGitUnavailable
+	}
+
+	// git echoes the remote in errors; keep the credentials out of the log
+	masked := maskCloneURL(cloneURL)
+	maskKey := func(line string) string { return line }
+	if sshKey != nil {
+		maskKey = buildSecretMasker(nil, sshKey.PrivateKey, sshKey.Passphrase)
+	}
+	rawLogFn := logFn
+	logFn = func(line string) error {
+		return rawLogFn(maskKey(strings.ReplaceAll(line, cloneURL, masked)))
+	}
+
+	cloneEnv := envMapToSlice(env)
+	cloneEnv = append(cloneEnv, "GIT_TERMINAL_PROMPT=0", "GIT_LFS_SKIP_SMUDGE=1")
+	if sshKey != nil && isSSHCloneURL(cloneURL) {
+		command, cleanup, err := writeSSHCloneKey(sshKey)
+		if err != nil {
+			return fmt.Errorf("准备 SSH 部署密钥失败: %w", err)
+		}
+		// the key leaves the disk with the clone, whether it failed or not
+		defer cleanup()
+		cloneEnv = append(cloneEnv, "GIT_SSH_COMMAND="+command)
+		_ = logFn("使用 SSH 部署密钥克隆")
+	}
+
+	options := pipelineCloneConfig{}
+	if payload.Clone != nil {
+		options = *payload.Clone
+	}
+	branch := strings.TrimSpace(firstNonEmpty(payload.Branch, payload.RepoBranch))
+	commit := strings.TrimSpace(payload.Commit)
+	ref := normalizePipelineRef(payload.Ref)
+	tag := tagFromRef(ref)
+	// refs other than branches and tags, like merge request heads, are fetched after cloning
+	// the default branch
+	otherRef := ""
+	if ref != "" && tag == "" && branchFromRef(ref) == "" {
+		otherRef = ref
+	}
+
+	switch {
+	case tag != "":
+		// git clone --branch accepts tags and checks them out detached
+		branch = tag
+		_ = logFn(fmt.Sprintf("克隆仓库 %s（标签 %s）", masked, tag))
+	case otherRef != "":
+		branch = ""
+		_ = logFn(fmt.Sprintf("克隆仓库 %s（引用 %s）", masked, otherRef))
+	case branch != "":
+		_ = logFn(fmt.Sprintf("克隆仓库 %s（分支 %s）", masked, branch))
+	default:
+		_ = logFn(fmt.Sprintf("克隆仓库 %s", masked))
+	}
+	if options.Depth > 0 {
+		_ = logFn(fmt.Sprintf("浅克隆深度: %d", options.Depth))
+	}
+
+	fetchRef := ref
+	if fetchRef == "" && branch != "" {
+		fetchRef = refHeadsPrefix + branch
+	}
+
+	var err error
+	switch {
+	case commit != "" && options.Depth > 0:
+		err = shallowCheckoutCommit(ctx, workspace, cloneURL, fetchRef, commit, options, cloneEnv, logFn)
+	case otherRef != "":
+		err = cloneAndCheckoutRef(ctx, workspace, cloneURL, otherRef, commit, options, cloneEnv, logFn)
+	default:
+		err = cloneAndCheckout(ctx, workspace, cloneURL, branch, commit, options, cloneEnv, logFn)
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.Submodules {
+		args := []string{"submodule", "update", "--init", "--recursive", "--progress"}
+		if options.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(options.Depth))
+		}
+		_ = logFn("初始化子模块")
+		if err := runGitWithProgress(ctx, workspace, args, cloneEnv, logFn); err != nil {
+			return fmt.Errorf("更新子模块失败: %w", err)
+		}
+	}
+
+	usesLFS, err := workspaceUsesLFS(workspace)
+	if err != nil {
+		return fmt.Errorf("读取 .gitattributes 失败: %w", err)
+	}
+	lfsEnabled := options.LFS
+	switch {
+	case lfsEnabled && usesLFS:
+		if err := ensureGitLFS(ctx, workspace, cloneEnv); err != nil {
+			return err
+		}
+		_ = logFn("检测到 Git LFS 文件，开始拉取 LFS 对象")
+		if err := runGitWithProgress(ctx, workspace, []string{"lfs", "install", "--local"}, cloneEnv, logFn); err != nil {
+			return fmt.Errorf("初始化 git-lfs 失败: %w", err)
+		}
+		if err := runGitWithProgress(ctx, workspace, []string{"lfs", "pull"}, cloneEnv, logFn); err != nil {
+			return fmt.Errorf("拉取 LFS 对象失败: %w", err)
+		}
+	case lfsEnabled:
+		_ = logFn("未在 .gitattributes 中检测到 LFS 跟踪规则，跳过 git lfs pull")
+	case usesLFS:
+		_ = logFn("检测到仓库使用 Git LFS，但未启用 clone.lfs，LFS 文件将保留为指针文件")
+	}
+
+	size, err := workspaceSize(workspace)
+	if err != nil {
+		_ = logFn(fmt.Sprintf("统计工作区大小失败: %v", err))
+		return nil
+	}
+	_ = logFn(fmt.Sprintf("工作区大小: %s", formatByteSize(size)))
+	if err := s.updatePipelineWorkspaceSize(ctx, pipelineID, size); err != nil {
+		return err
+	}
+	return nil
+}
+
+// cloneAndCheckout clones branch (the remote default when empty) and checks out commit when set.
+func cloneAndCheckout(ctx context.Context, workspace, cloneURL, branch, commit string, options pipelineCloneConfig, env []string, logFn func(string) error) error {
+	args := []string{"clone", "--progress"}
+	if branch != "" {
+		args = append(args, "--branch", branch)
+	}
+	if options.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(options.Depth))
+	}
+	if options.FetchTags != nil && !*options.FetchTags {
+		args = append(args, "--no-tags")
+	}
+	args = append(args, cloneURL, ".")
+	if err := runGitWithProgress(ctx, workspace, args, env, logFn); err != nil {
+		return fmt.Errorf("克隆仓库失败: %w", err)
+	}
+
+	// a shallow clone only follows tags pointing into the fetched history
+	if options.Depth > 0 && options.FetchTags != nil && *options.FetchTags {
+		if err := runGitWithProgress(ctx, workspace, []string{"fetch", "--progress", "--tags", "--depth", strconv.Itoa(options.Depth), "origin"}, env, logFn); err != nil {
+			return fmt.Errorf("拉取标签失败: %w", err)
+		}
+	}
+
+	if commit != "" {
+		if err := runGitWithProgress(ctx, workspace, []string{"checkout", "--quiet", commit}, env, logFn); err != nil {
+			return fmt.Errorf("检出提交 %s 失败: %w", commit, err)
+		}
+	}
+	return nil
+}
+
+// cloneAndCheckoutRef clones the remote default branch, fetches ref and checks out commit, or
+// the fetched ref when commit is empty.
+func cloneAndCheckoutRef(ctx context.Context, workspace, cloneURL, ref, commit string, options pipelineCloneConfig, env []string, logFn func(string) error) error {
+	if err := cloneAndCheckout(ctx, workspace, cloneURL, "", "", options, env, logFn); err != nil {
+		return err
+	}
+	args := []string{"fetch", "--progress"}
+	if options.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(options.Depth))
+	}
+	if err := runGitWithProgress(ctx, workspace, append(args, "origin", ref), env, logFn); err != nil {
+		return fmt.Errorf("拉取引用 %s 失败: %w", ref, err)
+	}
+	target := firstNonEmpty(commit, "FETCH_HEAD")
+	if err := runGitWithProgress(ctx, workspace, []string{"checkout", "--quiet", target}, env, logFn); err != nil {
+		return fmt.Errorf("检出 %s 失败: %w", firstNonEmpty(commit, ref), err)
+	}
+	return nil
+}
+
+// fetchRefspec maps a branch or tag ref onto the local ref a fallback fetch updates.
+func fetchRefspec(ref string) string {
+	if branch := branchFromRef(ref); branch != "" {
+		return fmt.Sprintf("+%s:refs/remotes/origin/%s", ref, branch)
+	}
+	return fmt.Sprintf("+%s:%s", ref, ref)
+}
+
+// shallowCheckoutCommit fetches exactly commit with the configured depth, so the build runs
+// on that commit even when the branch has moved on since the pipeline was created. Servers
+// that refuse fetching by sha fall back to ref with the history needed to reach it.
+func shallowCheckoutCommit(ctx context.Context, workspace, cloneURL, ref, commit string, options pipelineCloneConfig, env []string, logFn func(string) error) error {
+	if err := runGitWithProgress(ctx, workspace, []string{"init", "--quiet"}, env, logFn); err != nil {
+		return fmt.Errorf("初始化仓库失败: %w", err)
+	}
+	if err := runGitWithProgress(ctx, workspace, []string{"remote", "add", "origin", cloneURL}, env, logFn); err != nil {
+		return fmt.Errorf("配置远程仓库失败: %w", err)
+	}
+
+	fetchArgs := func(extra ...string) []string {
+		args := []string{"fetch", "--progress"}
+		if options.FetchTags != nil {
+			if *options.FetchTags {
+				args = append(args, "--tags")
+			} else {
+				args = append(args, "--no-tags")
+			}
+		}
+		return append(args, extra...)
+	}
+
+	depth := strconv.Itoa(options.Depth)
+	err := runGitWithProgress(ctx, workspace, fetchArgs("--depth", depth, "origin", commit), env, logFn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if ref == "" {
+			return fmt.Errorf("拉取提交 %s 失败: %w", commit, err)
+		}
+		name := refName(ref)
+		_ = logFn(fmt.Sprintf("远程仓库不支持按提交拉取，改为拉取 %s 的完整历史", name))
+		if err := runGitWithProgress(ctx, workspace, fetchArgs("origin", fetchRefspec(ref)), env, logFn); err != nil {
+			return fmt.Errorf("拉取 %s 失败: %w", name, err)
+		}
+		if err := runGitWithProgress(ctx, workspace, []string{"checkout", "--quiet", commit}, env, logFn); err != nil {
+			return fmt.Errorf("检出提交 %s 失败: %w", commit, err)
+		}
+		return nil
+	}
+	if err := runGitWithProgress(ctx, workspace, []string{"checkout", "--quiet", "FETCH_HEAD"}, env, logFn); err != nil {
+		return fmt.Errorf("检出提交 %s 失败: %w", commit, err)
+	}
+	return nil
+}
+
+// runGitWithProgress executes git in dir, throttling progress output written to logFn.
+func runGitWithProgress(ctx context.Context, dir string, args []string, env []string, logFn func(string) error) error {
+	throttler := newProgressThrottler(cloneProgressInterval, logFn)
+	err := runCommandWithLogging(ctx, dir, "git", args, env, throttler.Log)
+	_ = throttler.Flush()
+	return err
+}
+
+func ensureGitLFS(ctx context.Context, dir string, env []string) error {
+	cmd := exec.CommandContext(ctx, "git", "lfs", "version")
+	cmd.Dir = dir
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		detail := strings.TrimSpace(string(output))
+		if detail == "" {
+			detail = err.Error()
+		}
+		return fmt.Errorf("%w: %s", errGitLFSUnavailable, detail)
+	}
+	return nil
+}
+
+// workspaceUsesLFS reports whether the checkout declares LFS tracked paths.
+func workspaceUsesLFS(workspace string) (bool, error) {
+	file, err := os.Open(filepath.Join(workspace, ".gitattributes"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "filter=lfs") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+func workspaceSize(workspace string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(workspace, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+func formatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func (s *Service) updatePipelineWorkspaceSize(ctx context.Context, pipelineID int64, size int64) error {
+	return s.store.UpdatePipeline(ctx, pipelineID, map[string]any{"workspace_size": size})
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// isSSHCloneURL reports whether rawURL is cloned over SSH, as ssh:// URLs and scp-like
+// user@host:path addresses are.
+func isSSHCloneURL(rawURL string) bool {
+	value := strings.TrimSpace(rawURL)
+	lower := strings.ToLower(value)
+	if strings.HasPrefix(lower, "ssh://") || strings.HasPrefix(lower, "git+ssh://") {
+		return true
+	}
+	if strings.Contains(value, "://") {
+		return false
+	}
+	at := strings.Index(value, "@")
+	colon := strings.Index(value, ":")
+	return at > 0 && colon > at+1
+}
+
+// writeSSHCloneKey writes the deploy key and its known hosts to a private temp directory and
+// returns the GIT_SSH_COMMAND using them, which only trusts the pinned host keys. Encrypted
+// keys are written decrypted, as nobody is there to type the passphrase. cleanup removes the
+// directory.
+func writeSSHCloneKey(key *model.SSHCertificate) (command string, cleanup func(), err error) {
+	privateKey := []byte(strings.TrimSpace(key.PrivateKey) + "\n")
+	if key.Passphrase != "" {
+		raw, err := ssh.ParseRawPrivateKeyWithPassphrase(privateKey, []byte(key.Passphrase))
+		if err != nil {
+			return "", nil, fmt.Errorf("解密 SSH 私钥失败: %w", err)
+		}
+		block, err := ssh.MarshalPrivateKey(raw, "")
+		if err != nil {
+			return "", nil, fmt.Errorf("导出 SSH 私钥失败: %w", err)
+		}
+		privateKey = pem.EncodeToMemory(block)
+	}
+
+	dir, err := os.MkdirTemp("", "devsys-ssh-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { _ = os.RemoveAll(dir) }
+	keyPath := filepath.Join(dir, "id")
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(keyPath, privateKey, 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := os.WriteFile(knownHostsPath, []byte(strings.TrimSpace(key.KnownHosts)+"\n"), 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	command = fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -o GlobalKnownHostsFile=/dev/null",
+		shellQuote(keyPath), shellQuote(knownHostsPath))
+	return command, cleanup, nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
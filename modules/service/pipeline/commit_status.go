@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// commitStatusContext names the statuses devsys sets among those of other systems.
+	commitStatusContext = "devsys/pipeline"
+	commitStatusTimeout = 10 * time.Second
+)
+
+// ForgeStatusReporter sets commit statuses on the forge with the token of a user.
+type ForgeStatusReporter interface {
+	ReportCommitStatus(ctx context.Context, userID int64, repo *model.Repo, status model.CommitStatus) error
+}
+
+// WithForgeStatusReporter reports the state of pipelines back to the forge for
+// repositories that enable it in their settings.
+func WithForgeStatusReporter(reporter ForgeStatusReporter) Option {
+	return func(s *Service) {
+		s.statusReporter = reporter
+	}
+}
+
+// reportCommitStatus sets the commit status of a pipeline when its repository asks for it.
+// Reporting is best effort: failures are logged and never affect the pipeline.
+func (s *Service) reportCommitStatus(ctx context.Context, pipelineID int64, status model.StatusValue) {
+	if s.statusReporter == nil {
+		return
+	}
+	// a cancelled run still reports its final state
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitStatusTimeout)
+	defer cancel()
+
+	pipeline, err := s.fetchPipeline(ctx, pipelineID)
+	if err != nil || pipeline == nil || strings.TrimSpace(pipeline.Commit) == "" {
+		return
+	}
+	settings, err := s.GetPipelineSettings(ctx, pipeline.RepoID)
+	if err != nil || settings == nil || !settings.ReportCommitStatus {
+		return
+	}
+	repo, err := s.fetchRepo(ctx, pipeline.RepoID)
+	if err != nil || repo == nil || repo.IsManual() {
+		return
+	}
+
+	state := commitStateFor(status)
+	err = s.statusReporter.ReportCommitStatus(ctx, repo.UserID, repo, model.CommitStatus{
+		Commit:      pipeline.Commit,
+		State:       state,
+		Context:     commitStatusContext,
+		Description: fmt.Sprintf("pipeline #%d %s", pipeline.Number, status),
+		TargetURL:   s.pipelineRunURL(repo, pipeline.ID),
+	})
+	if err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipelineID).Str("state", string(state)).Msg("failed to report commit status")
+	}
+}
+
+func commitStateFor(status model.StatusValue) model.CommitState {
+	switch status {
+	case model.StatusRunning:
+		return model.CommitStateRunning
+	case model.StatusSuccess:
+		return model.CommitStateSuccess
+	case model.StatusPending, model.StatusBlocked, model.StatusCreated:
+		return model.CommitStatePending
+	default:
+		return model.CommitStateFailure
+	}
+}
+
+// pipelineRunURL links the run detail page, empty without a public base URL.
+func (s *Service) pipelineRunURL(repo *model.Repo, pipelineID int64) string {
+	if s.notifyBaseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/dev/projects/%s/%s/pipeline/%d", s.notifyBaseURL,
+		url.PathEscape(repo.Owner), url.PathEscape(repo.Name), pipelineID)
+}
@@ -0,0 +1,60 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func TestStepConditionsAllowsRef(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions *pipelineStepConditions
+		branch     string
+		tag        string
+		want       bool
+	}{
+		{"no conditions", nil, "main", "", true},
+		{"exact branch", &pipelineStepConditions{Branches: []string{"main"}}, "main", "", true},
+		{"glob branch", &pipelineStepConditions{Branches: []string{"release/*"}}, "release/1.2", "", true},
+		{"glob stays in segment", &pipelineStepConditions{Branches: []string{"release/*"}}, "release/1.2/fix", "", false},
+		{"regex branch", &pipelineStepConditions{Branches: []string{`~^hotfix-\d+$`}}, "hotfix-7", "", true},
+		{"trailing slash", &pipelineStepConditions{Branches: []string{"release/"}}, "release", "", true},
+		{"empty branch", &pipelineStepConditions{Branches: []string{"*"}}, "", "", false},
+		{"glob tag", &pipelineStepConditions{Tags: []string{"v1.*"}}, "", "v1.4", true},
+		{"regex tag", &pipelineStepConditions{Tags: []string{"regex:^v\\d+\\.0$"}}, "", "v2.1", false},
+		{"tag only step on a branch", &pipelineStepConditions{Tags: []string{"v*"}}, "main", "", false},
+		{"tag pipeline on branch conditions", &pipelineStepConditions{Branches: []string{"v*"}}, "", "v1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conditions.allowsRef(tt.branch, tt.tag); got != tt.want {
+				t.Errorf("allowsRef(%q, %q) = %v, want %v", tt.branch, tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleTaskSkipsStepOutsideBranchPatterns(t *testing.T) {
+	release := hostStep("release", "echo released")
+	release.Conditions = &pipelineStepConditions{Branches: []string{"release/*", `~^hotfix-\d+$`}}
+	anyBranch := hostStep("build", "echo built")
+	anyBranch.Conditions = &pipelineStepConditions{Branches: []string{"regex:^ma"}}
+	svc, fake, task := newFakeRun(t, release, anyBranch)
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if got := fake.step(1); got.State != model.StatusSkipped {
+		t.Fatalf("step outside the patterns = %s, want skipped\n%s", got.State, fake)
+	}
+	want := `当前分支 main，仅在 release/*, ~^hotfix-\d+$ 执行`
+	if !strings.Contains(fake.logText(1), want) {
+		t.Errorf("skip message = %q, want it to name the patterns", fake.logText(1))
+	}
+	if got := fake.step(2); got.State != model.StatusSuccess {
+		t.Errorf("step matching the regex = %s, want success", got.State)
+	}
+}
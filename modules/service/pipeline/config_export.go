@@ -0,0 +1,166 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// settingsFooterMarker starts the commented settings block appended to exported configs.
+const settingsFooterMarker = "# devsys-settings:"
+
+// exportedSettings is the footer schema. Unknown keys are ignored on import so newer
+// exports stay importable by older servers.
+type exportedSettings struct {
+	CleanupEnabled     bool     `yaml:"cleanup_enabled"`
+	RetentionDays      int      `yaml:"retention_days"`
+	MaxRecords         int      `yaml:"max_records"`
+	DisallowParallel   bool     `yaml:"disallow_parallel"`
+	CronSchedules      []string `yaml:"cron_schedules,omitempty"`
+	Dockerfile         string   `yaml:"dockerfile,omitempty"`
+	ConfigSource       string   `yaml:"config_source,omitempty"`
+	ConfigFile         string   `yaml:"config_file,omitempty"`
+	StepCPU            string   `yaml:"step_cpu,omitempty"`
+	StepMemory         string   `yaml:"step_memory,omitempty"`
+	ReportCommitStatus bool     `yaml:"report_commit_status,omitempty"`
+	LogRetentionDays   int      `yaml:"log_retention_days,omitempty"`
+	PublicStatus       bool     `yaml:"public_status,omitempty"`
+	PublicMessages     bool     `yaml:"public_messages,omitempty"`
+}
+
+// PipelineConfigImport is the parsed content of an exported config file. Settings is nil
+// when the file carries no settings footer.
+type PipelineConfigImport struct {
+	Content  string
+	Settings *model.RepoPipelineConfig
+}
+
+// ExportPipelineConfig renders the repository config followed by its settings encoded as a
+// commented YAML footer.
+func (s *Service) ExportPipelineConfig(ctx context.Context, repoID int64) (string, error) {
+	settings, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return "", err
+	}
+	return renderPipelineConfigExport(settings)
+}
+
+// ImportPipelineConfig stores the config content as a revision by author and, when present,
+// the footer settings.
+func (s *Service) ImportPipelineConfig(ctx context.Context, repoID int64, parsed *PipelineConfigImport, author string) (*model.RepoPipelineConfig, error) {
+	if parsed == nil {
+		return nil, fmt.Errorf("导入内容为空")
+	}
+	cfg, err := s.UpsertPipelineConfig(ctx, repoID, parsed.Content, author, "导入流水线配置")
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Settings == nil {
+		return cfg, nil
+	}
+	return s.UpsertPipelineSettings(ctx, repoID, *parsed.Settings)
+}
+
+func renderPipelineConfigExport(cfg *model.RepoPipelineConfig) (string, error) {
+	footer, err := yaml.Marshal(exportedSettings{
+		CleanupEnabled:     cfg.CleanupEnabled,
+		RetentionDays:      cfg.RetentionDays,
+		MaxRecords:         cfg.MaxRecords,
+		DisallowParallel:   cfg.DisallowParallel,
+		CronSchedules:      cfg.CronSchedules,
+		Dockerfile:         cfg.Dockerfile,
+		ConfigSource:       cfg.ConfigSource,
+		ConfigFile:         cfg.ConfigFile,
+		StepCPU:            cfg.StepCPU,
+		StepMemory:         cfg.StepMemory,
+		ReportCommitStatus: cfg.ReportCommitStatus,
+		LogRetentionDays:   cfg.LogRetentionDays,
+		PublicStatus:       cfg.PublicStatus,
+		PublicMessages:     cfg.PublicMessages,
+	})
+	if err != nil {
+		return "", fmt.Errorf("序列化流水线设置失败: %w", err)
+	}
+
+	var b strings.Builder
+	if content := strings.TrimRight(cfg.Content, "\n"); content != "" {
+		b.WriteString(content)
+		b.WriteString("\n\n")
+	}
+	b.WriteString(settingsFooterMarker)
+	b.WriteString("\n")
+	for _, line := range strings.Split(strings.TrimRight(string(footer), "\n"), "\n") {
+		if line == "" {
+			b.WriteString("#\n")
+			continue
+		}
+		b.WriteString("# ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// ParsePipelineConfigExport splits an exported file into config content and settings. Files
+// without the footer import as config only.
+func ParsePipelineConfigExport(data string) (*PipelineConfigImport, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	lines := strings.Split(data, "\n")
+	marker := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimRight(lines[i], " \t") == settingsFooterMarker {
+			marker = i
+			break
+		}
+	}
+	if marker < 0 {
+		return &PipelineConfigImport{Content: data}, nil
+	}
+
+	var footer strings.Builder
+	for _, line := range lines[marker+1:] {
+		switch {
+		case line == "":
+			continue
+		case !strings.HasPrefix(line, "#"):
+			return nil, fmt.Errorf("流水线设置注释块之后不能包含其他内容")
+		}
+		line = strings.TrimPrefix(line, "#")
+		line = strings.TrimPrefix(line, " ")
+		footer.WriteString(line)
+		footer.WriteString("\n")
+	}
+
+	var decoded exportedSettings
+	if err := yaml.Unmarshal([]byte(footer.String()), &decoded); err != nil {
+		return nil, fmt.Errorf("解析流水线设置失败: %w", err)
+	}
+
+	content := strings.TrimRight(strings.Join(lines[:marker], "\n"), "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return &PipelineConfigImport{
+		Content: content,
+		Settings: &model.RepoPipelineConfig{
+			CleanupEnabled:     decoded.CleanupEnabled,
+			RetentionDays:      decoded.RetentionDays,
+			MaxRecords:         decoded.MaxRecords,
+			DisallowParallel:   decoded.DisallowParallel,
+			CronSchedules:      decoded.CronSchedules,
+			Dockerfile:         decoded.Dockerfile,
+			ConfigSource:       decoded.ConfigSource,
+			ConfigFile:         decoded.ConfigFile,
+			StepCPU:            decoded.StepCPU,
+			StepMemory:         decoded.StepMemory,
+			ReportCommitStatus: decoded.ReportCommitStatus,
+			LogRetentionDays:   decoded.LogRetentionDays,
+			PublicStatus:       decoded.PublicStatus,
+			PublicMessages:     decoded.PublicMessages,
+		},
+	}, nil
+}
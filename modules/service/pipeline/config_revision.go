@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// configSHA256 identifies a pipeline config revision by the hex sha256 of its content.
+func configSHA256(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// CurrentConfigHash returns the revision hash of the repository's current pipeline config,
+// empty when the repository has no config.
+func (s *Service) CurrentConfigHash(ctx context.Context, repoID int64) (string, error) {
+	settings, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return "", err
+	}
+	if settings == nil || strings.TrimSpace(settings.Content) == "" {
+		return "", nil
+	}
+	return configSHA256(settings.Content), nil
+}
+
+// ConfigChangedSince reports whether the config changed after run was created. Runs created
+// before revisions were recorded, and runs read from a repository file, never report a change.
+func ConfigChangedSince(run *model.Pipeline, currentHash string) bool {
+	if run == nil || run.ConfigHash == "" || run.ConfigContent != "" || currentHash == "" {
+		return false
+	}
+	return run.ConfigHash != currentHash
+}
+
+// ErrConfigRevisionNotFound is returned for a revision the repository does not have.
+var ErrConfigRevisionNotFound = errors.New("流水线配置版本不存在")
+
+// PipelineConfigRevision is a revision in the config history. PreviousContent is the content
+// of the version before it, empty for the first one, so a client can diff each entry alone.
+type PipelineConfigRevision struct {
+	model.RepoPipelineConfigRevision
+	PreviousContent string `json:"previous_content"`
+	// Current marks the revision the repository config is at.
+	Current bool `json:"current"`
+}
+
+// ListPipelineConfigRevisions returns the config history of a repository, newest first, and
+// the number of revisions.
+func (s *Service) ListPipelineConfigRevisions(ctx context.Context, repoID int64, page, perPage int) ([]PipelineConfigRevision, int64, error) {
+	if page <= 0 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+	cfg, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// one more than the page, for the previous content of its last entry
+	revisions, total, err := s.store.ListConfigRevisions(ctx, repoID, (page-1)*perPage, perPage+1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]PipelineConfigRevision, 0, perPage)
+	for i := 0; i < len(revisions) && i < perPage; i++ {
+		item := PipelineConfigRevision{
+			RepoPipelineConfigRevision: revisions[i],
+			Current:                    cfg != nil && cfg.Version == revisions[i].Version,
+		}
+		if i+1 < len(revisions) {
+			item.PreviousContent = revisions[i+1].Content
+		}
+		result = append(result, item)
+	}
+	return result, total, nil
+}
+
+// RevertPipelineConfig restores the content of a revision, saved as a new revision by author.
+func (s *Service) RevertPipelineConfig(ctx context.Context, repoID, revisionID int64, author string) (*model.RepoPipelineConfig, error) {
+	revision, err := s.store.GetConfigRevision(ctx, repoID, revisionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrConfigRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.savePipelineConfig(ctx, repoID, revision.Content, model.RepoPipelineConfigRevision{
+		Author:       strings.TrimSpace(author),
+		Message:      fmt.Sprintf("回滚到版本 v%d", revision.Version),
+		RevertedFrom: revision.Version,
+	})
+}
@@ -0,0 +1,163 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+const revisionTestConfig = `name: app
+steps:
+  build:
+    image: golang:1.22
+    commands:
+      - go build ./...
+`
+
+// newRevisionService returns a service over active repository 1 with a config and a cron
+// schedule, whose queue accepts tasks without running them.
+func newRevisionService(t *testing.T) (*Service, *model.Repo) {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.RepoPipelineConfig{}, &model.RepoPipelineConfigRevision{},
+		&model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.Task{}, &model.PluginDefinition{}, &model.RepoVariable{})
+	repo := &model.Repo{ID: 1, ForgeRemoteID: "1", Owner: "team", Name: "app", FullName: "team/app", Branch: "main", IsActive: true}
+	mustCreate(t, db.GetDB(), repo)
+	svc := NewService(db, nil, nil)
+
+	q := queue.New(16)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := q.Start(ctx, 1, func(context.Context, *model.Task) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Shutdown)
+	svc.queue = q
+
+	if _, err := svc.UpsertPipelineConfig(context.Background(), 1, revisionTestConfig, "alice", ""); err != nil {
+		t.Fatalf("UpsertPipelineConfig: %v", err)
+	}
+	if _, err := svc.UpsertPipelineSettings(context.Background(), 1, model.RepoPipelineConfig{CronSchedules: []string{"0 2 * * *"}}); err != nil {
+		t.Fatalf("UpsertPipelineSettings: %v", err)
+	}
+	return svc, repo
+}
+
+func TestTriggersRecordConfigRevision(t *testing.T) {
+	svc, repo := newRevisionService(t)
+	ctx := context.Background()
+
+	triggers := []struct {
+		name    string
+		trigger func() (*model.Pipeline, error)
+	}{
+		{"manual", func() (*model.Pipeline, error) {
+			cfg, err := svc.GetPipelineSettings(ctx, repo.ID)
+			if err != nil {
+				return nil, err
+			}
+			return svc.TriggerManualPipeline(ctx, repo, "alice", model.PipelineOptions{Branch: "main"}, cfg)
+		}},
+		{"cron", func() (*model.Pipeline, error) {
+			return svc.TriggerCronSchedule(ctx, repo, "0 2 * * *", "alice")
+		}},
+		{"webhook", func() (*model.Pipeline, error) {
+			return svc.TriggerWebhookPipeline(ctx, repo, model.EventPush, "bob", "", model.PipelineOptions{Ref: "refs/heads/main", Commit: "abc123"})
+		}},
+	}
+
+	initial, err := svc.CurrentConfigHash(ctx, repo.ID)
+	if err != nil || initial == "" {
+		t.Fatalf("CurrentConfigHash = %q, %v, want the hash of the config", initial, err)
+	}
+	runs := make(map[string]int64, len(triggers))
+	for _, tc := range triggers {
+		run, err := tc.trigger()
+		if err != nil {
+			t.Fatalf("%s trigger: %v", tc.name, err)
+		}
+		stored, err := svc.store.GetPipeline(ctx, run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ConfigHash != initial || stored.ConfigVersion != 1 {
+			t.Fatalf("%s run recorded revision %q v%d, want %q v1", tc.name, stored.ConfigHash, stored.ConfigVersion, initial)
+		}
+		if ConfigChangedSince(stored, initial) {
+			t.Fatalf("%s run reports a config change before any edit", tc.name)
+		}
+		runs[tc.name] = run.ID
+	}
+
+	// badge flips once the config is edited
+	edited := revisionTestConfig + "      - go vet ./...\n"
+	if _, err := svc.UpsertPipelineConfig(ctx, repo.ID, edited, "alice", "add vet"); err != nil {
+		t.Fatalf("UpsertPipelineConfig: %v", err)
+	}
+	current, err := svc.CurrentConfigHash(ctx, repo.ID)
+	if err != nil || current == initial {
+		t.Fatalf("CurrentConfigHash after the edit = %q, %v, want a new hash", current, err)
+	}
+	for name, id := range runs {
+		stored, err := svc.store.GetPipeline(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ConfigHash != initial {
+			t.Fatalf("%s run revision = %q after the edit, want it kept at %q", name, stored.ConfigHash, initial)
+		}
+		if !ConfigChangedSince(stored, current) {
+			t.Fatalf("%s run does not report the config change", name)
+		}
+	}
+	for _, tc := range triggers {
+		run, err := tc.trigger()
+		if err != nil {
+			t.Fatalf("%s trigger after the edit: %v", tc.name, err)
+		}
+		if run.ConfigHash != current || run.ConfigVersion != 2 || ConfigChangedSince(run, current) {
+			t.Fatalf("%s run after the edit recorded %q v%d, want the current revision v2", tc.name, run.ConfigHash, run.ConfigVersion)
+		}
+	}
+
+	// reverting to identical content clears the badge of the earlier runs again
+	if _, err := svc.UpsertPipelineConfig(ctx, repo.ID, revisionTestConfig, "alice", "revert"); err != nil {
+		t.Fatalf("UpsertPipelineConfig: %v", err)
+	}
+	reverted, err := svc.CurrentConfigHash(ctx, repo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range runs {
+		stored, err := svc.store.GetPipeline(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ConfigChangedSince(stored, reverted) {
+			t.Fatalf("%s run reports a change although the config is back to its revision", name)
+		}
+	}
+}
+
+func TestConfigChangedSince(t *testing.T) {
+	cases := []struct {
+		name    string
+		run     *model.Pipeline
+		current string
+		want    bool
+	}{
+		{"same revision", &model.Pipeline{ConfigHash: "a"}, "a", false},
+		{"other revision", &model.Pipeline{ConfigHash: "a"}, "b", true},
+		{"run before revisions were recorded", &model.Pipeline{}, "b", false},
+		{"repository without config", &model.Pipeline{ConfigHash: "a"}, "", false},
+		{"config read from the repository", &model.Pipeline{ConfigHash: "a", ConfigContent: "name: app"}, "b", false},
+		{"no run", nil, "b", false},
+	}
+	for _, tc := range cases {
+		if got := ConfigChangedSince(tc.run, tc.current); got != tc.want {
+			t.Errorf("%s: ConfigChangedSince = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
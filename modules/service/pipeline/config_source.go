@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrInvalidConfigSource is returned when pipeline settings name an unknown config source
+// or one that cannot be served.
+var ErrInvalidConfigSource = errors.New("流水线配置来源无效")
+
+// normalizeConfigSource validates the config source and file of pipeline settings. The file
+// is kept only for the repo source.
+func (s *Service) normalizeConfigSource(source, file string) (string, string, error) {
+	source = strings.ToLower(strings.TrimSpace(source))
+	file = cleanConfigFilePath(file)
+	switch source {
+	case "", model.PipelineConfigSourceDB:
+		return model.PipelineConfigSourceDB, "", nil
+	case model.PipelineConfigSourceRepo:
+		if s.contents == nil {
+			return "", "", fmt.Errorf("%w: 未配置仓库文件读取，无法从仓库读取流水线配置", ErrInvalidConfigSource)
+		}
+		if strings.Contains(file, "..") {
+			return "", "", fmt.Errorf("%w: 配置文件路径 %q 无效", ErrInvalidConfigSource, file)
+		}
+		return source, file, nil
+	default:
+		return "", "", fmt.Errorf("%w: %q", ErrInvalidConfigSource, source)
+	}
+}
+
+// pipelineConfigFile returns the repository path the pipeline definition is read from for the
+// repo source.
+func pipelineConfigFile(repo *model.Repo, cfg *model.RepoPipelineConfig) string {
+	if path := cleanConfigFilePath(cfg.ConfigFile); path != "" {
+		return path
+	}
+	if path := cleanConfigFilePath(repo.Config); path != "" {
+		return path
+	}
+	return model.DefaultPipelineConfigFile
+}
+
+func cleanConfigFilePath(path string) string {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "./")
+	return strings.TrimLeft(path, "/")
+}
+
+// resolvePipelineContent returns the definition a run of ref uses: the stored content, or
+// for the repo source the config file at the run's commit, tag or branch read with the
+// repository owner's token. snapshot reports whether the content came from the repository
+// and must be kept on the run.
+func (s *Service) resolvePipelineContent(ctx context.Context, repo *model.Repo, cfg *model.RepoPipelineConfig, ref, branch, commit string) (content string, snapshot bool, err error) {
+	if cfg == nil {
+		return "", false, ErrPipelineConfigMissing
+	}
+	if cfg.ConfigSource != model.PipelineConfigSourceRepo {
+		if strings.TrimSpace(cfg.Content) == "" {
+			return "", false, ErrPipelineConfigMissing
+		}
+		return cfg.Content, false, nil
+	}
+
+	if repo.IsManual() {
+		return "", false, fmt.Errorf("导入的仓库没有关联代码平台，无法从仓库读取流水线配置")
+	}
+	if s.contents == nil {
+		return "", false, model.NewFeatureUnavailableError(model.CapabilityPipeline, "repository content reader not configured")
+	}
+	path := pipelineConfigFile(repo, cfg)
+	revision := firstNonEmpty(strings.TrimSpace(commit), tagFromRef(ref), branch, repo.Branch)
+	data, err := s.contents.ReadRepositoryFile(ctx, repo.UserID, repo, path, revision)
+	if err != nil {
+		return "", false, fmt.Errorf("从仓库读取流水线配置 %s（%s）失败: %w", path, revision, err)
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return "", false, fmt.Errorf("%w: 仓库文件 %s（%s）为空", ErrPipelineConfigMissing, path, revision)
+	}
+	return string(data), true, nil
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	dockerruntime "github.com/thepenn/devsys/service/pipeline/runtime/docker"
+)
+
+// orphanCleanupTimeout bounds the container cleanup done on Start.
+const orphanCleanupTimeout = 30 * time.Second
+
+// Track implements pipelineruntime.ContainerTracker.
+func (h *executionHandle) Track(id string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.containers == nil {
+		h.containers = make(map[string]struct{})
+	}
+	h.containers[id] = struct{}{}
+}
+
+// Untrack implements pipelineruntime.ContainerTracker.
+func (h *executionHandle) Untrack(id string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.containers, id)
+}
+
+func (h *executionHandle) trackedContainers() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]string, 0, len(h.containers))
+	for id := range h.containers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// labels returns the labels tying the containers of the run to its pipeline, found again by
+// cleanupOrphanedContainers after a crash.
+func (h *executionHandle) labels() map[string]string {
+	if h == nil {
+		return nil
+	}
+	return map[string]string{dockerruntime.PipelineLabel: strconv.FormatInt(h.pipelineID, 10)}
+}
+
+// stopExecutionContainers stops the containers the cancelled run is still inside of.
+func (s *Service) stopExecutionContainers(handle *executionHandle) {
+	ids := handle.trackedContainers()
+	if len(ids) == 0 {
+		return
+	}
+	runtime, err := s.dockerRunner()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		if err := runtime.StopContainer(context.Background(), id, dockerruntime.DefaultStopGrace); err != nil {
+			log.Warn().Err(err).Int64("pipeline_id", handle.pipelineID).Str("container", id).Msg("failed to stop container of cancelled pipeline")
+		}
+	}
+}
+
+// cleanupOrphanedContainers removes devsys containers left behind by runs of a crashed
+// process, i.e. those whose pipeline is gone or no longer running. Containers of running
+// pipelines are kept as another replica may own them.
+func (s *Service) cleanupOrphanedContainers(ctx context.Context) {
+	runtime, err := s.dockerRunner()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, orphanCleanupTimeout)
+	defer cancel()
+
+	containers, err := runtime.ManagedContainers(ctx)
+	if err != nil {
+		log.Debug().Err(err).Msg("skip orphaned container cleanup")
+		return
+	}
+	removed := 0
+	for _, container := range containers {
+		pipelineID, err := strconv.ParseInt(container.Labels[dockerruntime.PipelineLabel], 10, 64)
+		if err != nil {
+			continue
+		}
+		status, err := s.getPipelineStatus(ctx, pipelineID)
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// the pipeline was deleted
+		case err != nil:
+			log.Warn().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to load pipeline of container")
+			continue
+		case status == model.StatusRunning:
+			continue
+		}
+		runtime.RemoveContainer(ctx, container.ID)
+		removed++
+	}
+	if removed > 0 {
+		log.Info().Int("containers", removed).Msg("removed orphaned pipeline containers")
+	}
+}
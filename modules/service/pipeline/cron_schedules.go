@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	cron "github.com/gdgvda/cron"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrCronScheduleNotFound is returned when firing an expression the repository does not schedule.
+var ErrCronScheduleNotFound = errors.New("仓库未配置该定时表达式")
+
+// cronEntry is a cron expression of a repository as handed to the scheduler;
+// err is the parse error of an expression the scheduler rejected.
+type cronEntry struct {
+	expression string
+	id         cron.ID
+	err        error
+}
+
+// CronSchedule reports a configured cron expression of a repository.
+type CronSchedule struct {
+	Expression string `json:"expression"`
+	Valid      bool   `json:"valid"`
+	// Error is the parse error of an invalid expression, or why a valid one is not scheduled.
+	Error string `json:"error,omitempty"`
+	// LastTriggered and NextRun are unix seconds; 0 when unknown.
+	LastTriggered int64 `json:"last_triggered,omitempty"`
+	NextRun       int64 `json:"next_run,omitempty"`
+}
+
+// ListCronSchedules returns the cron expressions configured for a repository together with
+// their scheduler state.
+func (s *Service) ListCronSchedules(ctx context.Context, repoID int64) ([]CronSchedule, error) {
+	cfg, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	expressions := sanitizeCronSchedules(cfg.CronSchedules)
+	result := make([]CronSchedule, 0, len(expressions))
+
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	registered := make(map[string]cronEntry, len(s.cronEntries[repoID]))
+	for _, entry := range s.cronEntries[repoID] {
+		registered[entry.expression] = entry
+	}
+	for _, expression := range expressions {
+		item := CronSchedule{
+			Expression:    expression,
+			LastTriggered: cfg.CronLastTriggered[expression],
+		}
+		entry, ok := registered[expression]
+		switch {
+		case s.scheduler == nil:
+			item.Error = "调度器未运行"
+		case !ok:
+			item.Error = "定时任务未注册"
+		case entry.err != nil:
+			item.Error = entry.err.Error()
+		default:
+			item.Valid = true
+			if next := s.scheduler.Entry(entry.id).Next; !next.IsZero() {
+				item.NextRun = next.Unix()
+			}
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// TriggerCronSchedule fires the pipeline of a configured cron expression right away, so a
+// schedule can be tested without waiting for it.
+func (s *Service) TriggerCronSchedule(ctx context.Context, repo *model.Repo, expression, author string) (*model.Pipeline, error) {
+	if repo == nil {
+		return nil, errors.New("repository is required")
+	}
+	cfg, err := s.GetPipelineSettings(ctx, repo.ID)
+	if err != nil {
+		return nil, err
+	}
+	expression = strings.TrimSpace(expression)
+	configured := false
+	for _, candidate := range sanitizeCronSchedules(cfg.CronSchedules) {
+		if candidate == expression {
+			configured = true
+			break
+		}
+	}
+	if !configured {
+		return nil, ErrCronScheduleNotFound
+	}
+	return s.fireCronPipeline(ctx, repo, expression, firstNonEmpty(strings.TrimSpace(author), repo.Owner, "cron"))
+}
+
+// recordCronTrigger stores when an expression last started a pipeline, dropping the times of
+// expressions that are no longer configured.
+func (s *Service) recordCronTrigger(ctx context.Context, repoID int64, expression string, at int64) error {
+	return s.store.UpdateCronTriggers(ctx, repoID, func(cfg *model.RepoPipelineConfig) map[string]int64 {
+		current := make(map[string]struct{}, len(cfg.CronSchedules))
+		for _, schedule := range sanitizeCronSchedules(normalizePipelineConfig(cfg).CronSchedules) {
+			current[schedule] = struct{}{}
+		}
+		triggered := make(map[string]int64, len(current))
+		for key, value := range cfg.CronLastTriggered {
+			if _, ok := current[key]; ok {
+				triggered[key] = value
+			}
+		}
+		triggered[expression] = at
+		return triggered
+	})
+}
@@ -0,0 +1,276 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/thepenn/devsys/model"
+	k8ssvc "github.com/thepenn/devsys/service/k8s"
+)
+
+const (
+	// defaultDeployReadyTimeout bounds wait_ready for steps without a timeout.
+	defaultDeployReadyTimeout = 5 * time.Minute
+	deployReadyPollInterval   = 5 * time.Second
+	// deployFailureEvents is how many events of a failed workload are written to the log.
+	deployFailureEvents = 20
+	// maxDeployManifestSize bounds manifest_file.
+	maxDeployManifestSize = 5 << 20
+)
+
+// WithK8sService applies the manifests of built-in deploy steps; those steps fail without it.
+func WithK8sService(k8s *k8ssvc.Service) Option {
+	return func(s *Service) {
+		s.k8s = k8s
+	}
+}
+
+// deployedObject is an object applied by a deploy step.
+type deployedObject struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (o deployedObject) String() string {
+	return o.Kind + "/" + o.Name
+}
+
+// loadDeployManifest returns the inline manifest of target or reads its manifest file from
+// the workspace.
+func loadDeployManifest(workspace string, target *pipelineDeployTarget) (string, error) {
+	if target.ManifestFile == "" {
+		return target.Manifest, nil
+	}
+	if workspace == "" {
+		return "", fmt.Errorf("工作目录不可用，无法读取部署清单 %s", target.ManifestFile)
+	}
+	root, err := filepath.EvalSymlinks(workspace)
+	if err != nil {
+		return "", err
+	}
+	file, err := filepath.EvalSymlinks(filepath.Join(workspace, filepath.FromSlash(target.ManifestFile)))
+	if err != nil {
+		return "", fmt.Errorf("读取部署清单 %s 失败: %w", target.ManifestFile, err)
+	}
+	if rel, err := filepath.Rel(root, file); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("部署清单 %s 位于工作目录之外", target.ManifestFile)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("读取部署清单 %s 失败: %w", target.ManifestFile, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxDeployManifestSize+1))
+	if err != nil {
+		return "", fmt.Errorf("读取部署清单 %s 失败: %w", target.ManifestFile, err)
+	}
+	if len(data) > maxDeployManifestSize {
+		return "", fmt.Errorf("部署清单 %s 超过 %d 字节", target.ManifestFile, maxDeployManifestSize)
+	}
+	return string(data), nil
+}
+
+// runDeployStep applies the documents of manifest in order, records every applied object as
+// a deploy target of the repository and, with wait_ready, follows the workload rollouts.
+func (s *Service) runDeployStep(ctx context.Context, repo *model.Repo, pipeline *model.Pipeline, target *pipelineDeployTarget, manifest string, logFn func(string) error) error {
+	if s.k8s == nil {
+		return fmt.Errorf("未配置 Kubernetes 服务，无法执行部署步骤")
+	}
+	ctx = s.repoScope(ctx, repo)
+	clusterID, err := s.resolveDeployCluster(ctx, target.Cluster)
+	if err != nil {
+		return err
+	}
+	docs := k8ssvc.SplitManifest(manifest)
+	if len(docs) == 0 {
+		return fmt.Errorf("部署清单为空")
+	}
+	_ = logFn(fmt.Sprintf("部署到集群 %s，命名空间 %s，共 %d 个对象", target.Cluster, target.Namespace, len(docs)))
+
+	deployed := make([]deployedObject, 0, len(docs))
+	for idx, doc := range docs {
+		var header struct {
+			APIVersion string `yaml:"apiVersion"`
+			Kind       string `yaml:"kind"`
+			Metadata   struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &header); err != nil {
+			return fmt.Errorf("解析部署清单第 %d 个文档失败: %w", idx+1, err)
+		}
+		if header.APIVersion == "" || header.Kind == "" || header.Metadata.Name == "" {
+			return fmt.Errorf("部署清单第 %d 个文档缺少 apiVersion、kind 或 metadata.name", idx+1)
+		}
+		gvr, namespaced, err := s.k8s.ResolveResource(ctx, clusterID, header.APIVersion, header.Kind)
+		if err != nil {
+			return fmt.Errorf("部署清单第 %d 个文档 %s/%s: %w", idx+1, header.Kind, header.Metadata.Name, err)
+		}
+		namespace := ""
+		if namespaced {
+			namespace = firstNonEmpty(header.Metadata.Namespace, target.Namespace)
+		}
+		applied, err := s.k8s.ApplyManifest(ctx, clusterID, model.KubernetesManifestRequest{
+			Group:     gvr.Group,
+			Version:   gvr.Version,
+			Resource:  gvr.Resource,
+			Namespace: namespace,
+			Manifest:  doc,
+		})
+		if err != nil {
+			return fmt.Errorf("应用 %s/%s 失败: %w", header.Kind, header.Metadata.Name, err)
+		}
+		object := deployedObject{Kind: header.Kind, Namespace: namespace, Name: header.Metadata.Name}
+		if namespace != "" {
+			_ = logFn(fmt.Sprintf("已应用 %s（命名空间 %s）", object, namespace))
+		} else {
+			_ = logFn(fmt.Sprintf("已应用 %s", object))
+		}
+		// the baseline only feeds drift detection; the deploy itself already succeeded
+		if err := s.k8s.RecordApplied(ctx, repo.ID, pipeline.ID, clusterID, gvr, &unstructured.Unstructured{Object: applied.Documents[0].Object}); err != nil {
+			log.Warn().Err(err).Int64("pipeline_id", pipeline.ID).Str("object", object.String()).Msg("failed to record deploy target")
+		}
+		deployed = append(deployed, object)
+	}
+
+	if !target.WaitReady {
+		return nil
+	}
+	return s.waitDeployReady(ctx, clusterID, deployed, logFn)
+}
+
+// runSetImageStep points one container of an existing workload at image, keeping the replaced
+// image in an annotation, and with wait_ready follows the rollout.
+func (s *Service) runSetImageStep(ctx context.Context, repo *model.Repo, target *pipelineDeployTarget, image string, logFn func(string) error) error {
+	if s.k8s == nil {
+		return fmt.Errorf("未配置 Kubernetes 服务，无法执行部署步骤")
+	}
+	ctx = s.repoScope(ctx, repo)
+	clusterID, err := s.resolveDeployCluster(ctx, target.Cluster)
+	if err != nil {
+		return err
+	}
+	set := target.SetImage
+	updated, err := s.k8s.SetWorkloadImage(ctx, clusterID, set.Kind, target.Namespace, set.Name, set.Container, image, true)
+	if err != nil {
+		return fmt.Errorf("更新 %s/%s 的镜像失败: %w", set.Kind, set.Name, err)
+	}
+	object := deployedObject{Kind: updated.Overview.Kind, Namespace: target.Namespace, Name: set.Name}
+	_ = logFn(fmt.Sprintf("已将 %s（命名空间 %s）容器 %s 的镜像由 %s 更新为 %s",
+		object, target.Namespace, set.Container, updated.PreviousImage, updated.Image))
+	if !target.WaitReady {
+		return nil
+	}
+	return s.waitDeployReady(ctx, clusterID, []deployedObject{object}, logFn)
+}
+
+// resolveDeployCluster accepts the id or the name of a kubernetes certificate.
+func (s *Service) resolveDeployCluster(ctx context.Context, ref string) (int64, error) {
+	ref = strings.TrimSpace(ref)
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil && id > 0 {
+		return id, nil
+	}
+	clusters, err := s.k8s.ListClusters(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, cluster := range clusters {
+		if cluster.Name == ref {
+			return cluster.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("未找到 Kubernetes 集群 %s", ref)
+}
+
+// waitDeployReady polls the rollouts of the deployed workloads one after another, logging
+// progress whenever it changes. Waiting ends with the step timeout, or after
+// defaultDeployReadyTimeout for steps without one.
+func (s *Service) waitDeployReady(ctx context.Context, clusterID int64, objects []deployedObject, logFn func(string) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDeployReadyTimeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(deployReadyPollInterval)
+	defer ticker.Stop()
+
+	for _, object := range objects {
+		if !k8ssvc.HasRollout(object.Kind) {
+			continue
+		}
+		lastProgress := ""
+		for {
+			status, err := s.k8s.RolloutStatus(ctx, clusterID, object.Kind, object.Namespace, object.Name)
+			if err != nil {
+				if ctx.Err() != nil {
+					return s.deployFailure(ctx, clusterID, object, fmt.Errorf("等待 %s 就绪超时", object), logFn)
+				}
+				return s.deployFailure(ctx, clusterID, object, fmt.Errorf("查询 %s 状态失败: %w", object, err), logFn)
+			}
+			progress := fmt.Sprintf("%s: 已更新 %d/%d，就绪 %d/%d，可用 %d/%d", object,
+				status.Updated, status.Desired, status.Ready, status.Desired, status.Available, status.Desired)
+			if progress != lastProgress {
+				_ = logFn(progress)
+				lastProgress = progress
+			}
+			if status.Done {
+				_ = logFn(fmt.Sprintf("%s 已就绪", object))
+				break
+			}
+			if status.Failed {
+				return s.deployFailure(ctx, clusterID, object, fmt.Errorf("%s 发布失败: %s", object, status.Message), logFn)
+			}
+			select {
+			case <-ctx.Done():
+				return s.deployFailure(ctx, clusterID, object, fmt.Errorf("等待 %s 就绪超时", object), logFn)
+			case <-ticker.C:
+			}
+		}
+	}
+	return nil
+}
+
+// deployFailure writes the latest events of a failed workload and its pods to the step log
+// and adds the newest warning to err, since that usually names the cause.
+func (s *Service) deployFailure(ctx context.Context, clusterID int64, object deployedObject, err error, logFn func(string) error) error {
+	// the step context may be what expired; the events are still worth fetching
+	eventCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 15*time.Second)
+	defer cancel()
+	events, eventErr := s.k8s.WorkloadEvents(eventCtx, clusterID, object.Kind, object.Namespace, object.Name, deployFailureEvents)
+	if eventErr != nil {
+		_ = logFn(fmt.Sprintf("获取 %s 的事件失败: %v", object, eventErr))
+		return err
+	}
+	if len(events) == 0 {
+		_ = logFn(fmt.Sprintf("%s 没有相关事件", object))
+		return err
+	}
+	_ = logFn(fmt.Sprintf("%s 的最近事件:", object))
+	var warning *model.KubernetesEvent
+	for i, event := range events {
+		line := fmt.Sprintf("  [%s] %s %s: %s", event.Type, event.Object, event.Reason, event.Message)
+		if event.Count > 1 {
+			line += fmt.Sprintf("（%d 次）", event.Count)
+		}
+		_ = logFn(line)
+		if warning == nil && event.Type == "Warning" {
+			warning = &events[i]
+		}
+	}
+	if warning != nil {
+		return fmt.Errorf("%w（%s %s: %s）", err, warning.Object, warning.Reason, warning.Message)
+	}
+	return err
+}
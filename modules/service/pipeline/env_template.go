@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+var ErrEnvTemplateInvalid = errors.New("流水线环境变量模板无效")
+
+var envTemplateKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envTemplateScope returns the scope of the templates of repoID, global for 0.
+func envTemplateScope(repoID int64) model.EnvTemplateScope {
+	if repoID > 0 {
+		return model.EnvTemplateScopeRepo
+	}
+	return model.EnvTemplateScopeGlobal
+}
+
+// ListEnvTemplates lists the env templates of a repository, or the global ones for repoID 0,
+// by key with values included. Callers returning them from the API must redact masked values.
+func (s *Service) ListEnvTemplates(ctx context.Context, repoID int64) ([]*model.EnvTemplate, error) {
+	return s.store.ListEnvTemplates(ctx, envTemplateScope(repoID), repoID)
+}
+
+// SetEnvTemplate creates or updates the env template key of a repository, or a global one for
+// repoID 0. A nil value keeps the stored one, so masking can be toggled without sending the
+// value again.
+func (s *Service) SetEnvTemplate(ctx context.Context, repoID int64, key string, value *string, masked bool) (*model.EnvTemplate, error) {
+	key = strings.TrimSpace(key)
+	if !envTemplateKeyPattern.MatchString(key) {
+		return nil, fmt.Errorf("%w: 变量名只能包含字母、数字和下划线，且不能以数字开头", ErrEnvTemplateInvalid)
+	}
+	if spec.IsReservedEnv(key) {
+		return nil, fmt.Errorf("%w: %s 与系统保留变量冲突", ErrEnvTemplateInvalid, key)
+	}
+	scope := envTemplateScope(repoID)
+
+	result, err := s.store.SaveEnvTemplate(ctx, scope, repoID, key, value, masked)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: 新变量必须提供值", ErrEnvTemplateInvalid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(ctx, model.AuditActionEnvUpdate, model.AuditResourceEnv, key, repoID, map[string]interface{}{
+		"scope":  scope,
+		"masked": masked,
+	})
+	return result, nil
+}
+
+// DeleteEnvTemplate removes the env template key of a repository, or a global one for repoID 0.
+func (s *Service) DeleteEnvTemplate(ctx context.Context, repoID int64, key string) error {
+	scope := envTemplateScope(repoID)
+	err := s.store.DeleteEnvTemplate(ctx, scope, repoID, strings.TrimSpace(key))
+	if err != nil {
+		return err
+	}
+	s.audit.Record(ctx, model.AuditActionEnvDelete, model.AuditResourceEnv, strings.TrimSpace(key), repoID, map[string]interface{}{
+		"scope": scope,
+	})
+	return nil
+}
+
+// envTemplateEnv merges the global and repository env templates for a run of repoID, the
+// repository ones winning, and returns the masked values for the log masker. Templates are
+// read for every run, so changes apply to the next one.
+func (s *Service) envTemplateEnv(ctx context.Context, repoID int64) (map[string]string, []string, error) {
+	templates, err := s.store.ListRunEnvTemplates(ctx, repoID)
+	if err != nil {
+		return nil, nil, err
+	}
+	env := make(map[string]string, len(templates))
+	var masked []string
+	for _, scope := range []model.EnvTemplateScope{model.EnvTemplateScopeGlobal, model.EnvTemplateScopeRepo} {
+		for _, template := range templates {
+			if template.Scope != scope || spec.IsProtectedEnv(template.Key) {
+				continue
+			}
+			env[template.Key] = template.Value
+			if template.Masked && strings.TrimSpace(template.Value) != "" {
+				masked = append(masked, template.Value)
+			}
+		}
+	}
+	return env, masked, nil
+}
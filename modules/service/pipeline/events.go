@@ -0,0 +1,206 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// eventHistorySize is how many past events a reconnecting client can resume from.
+	eventHistorySize = 1024
+	// eventQueueSize is how many events a subscriber may fall behind before it is dropped.
+	eventQueueSize = 256
+)
+
+// eventBus fans pipeline events out to the subscribers of this process. Publishing never
+// blocks: a subscriber whose queue is full is dropped, so a stuck client cannot hold back
+// pipeline execution.
+type eventBus struct {
+	mu     sync.Mutex
+	nextID int64
+	// history is a ring of the last events; start indexes the oldest once it is full.
+	history     []model.PipelineEvent
+	start       int
+	subscribers map[*EventSubscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		nextID:      1,
+		history:     make([]model.PipelineEvent, 0, eventHistorySize),
+		subscribers: make(map[*EventSubscription]struct{}),
+	}
+}
+
+// EventSubscription receives the events published after it was created.
+type EventSubscription struct {
+	bus    *eventBus
+	events chan model.PipelineEvent
+	// slow is set when the subscription was dropped for not keeping up.
+	slow bool
+	once sync.Once
+}
+
+// Events is closed when the subscription is closed or dropped.
+func (sub *EventSubscription) Events() <-chan model.PipelineEvent {
+	return sub.events
+}
+
+// Slow reports whether the subscription was dropped because its queue was full. Valid once
+// Events is closed.
+func (sub *EventSubscription) Slow() bool {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	return sub.slow
+}
+
+// Close stops the subscription.
+func (sub *EventSubscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	sub.bus.remove(sub)
+}
+
+// remove drops sub; the caller holds mu.
+func (b *eventBus) remove(sub *EventSubscription) {
+	sub.once.Do(func() {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	})
+}
+
+// subscribe registers a subscriber and returns the kept events after the cursor after. The
+// bool is false when events after the cursor are no longer kept, e.g. after a restart of the
+// server, and the client has to reload instead.
+func (b *eventBus) subscribe(after int64) (*EventSubscription, []model.PipelineEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := &EventSubscription{bus: b, events: make(chan model.PipelineEvent, eventQueueSize)}
+	b.subscribers[sub] = struct{}{}
+	if after <= 0 {
+		return sub, nil, true
+	}
+	if after >= b.nextID {
+		// a cursor of an earlier server process
+		return sub, nil, false
+	}
+	var missed []model.PipelineEvent
+	complete := len(b.history) == 0 || b.history[b.start].ID <= after+1
+	for i := range b.history {
+		event := b.history[(b.start+i)%len(b.history)]
+		if event.ID > after {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, complete
+}
+
+func (b *eventBus) publish(event model.PipelineEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	event.ID = b.nextID
+	b.nextID++
+	if event.Created == 0 {
+		event.Created = time.Now().Unix()
+	}
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, event)
+	} else {
+		b.history[b.start] = event
+		b.start = (b.start + 1) % len(b.history)
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.slow = true
+			b.remove(sub)
+		}
+	}
+}
+
+// SubscribeEvents streams pipeline events of every repository; callers filter what their
+// user may see. Events after the cursor after are returned first when the history still
+// holds all of them, otherwise the bool is false. Events are kept per server process.
+func (s *Service) SubscribeEvents(after int64) (*EventSubscription, []model.PipelineEvent, bool) {
+	return s.events.subscribe(after)
+}
+
+// publishPipelineCreated announces a new run.
+func (s *Service) publishPipelineCreated(pipeline *model.Pipeline) {
+	s.events.publish(model.PipelineEvent{
+		Type:       model.PipelineEventCreated,
+		RepoID:     pipeline.RepoID,
+		PipelineID: pipeline.ID,
+		Number:     pipeline.Number,
+		Status:     pipeline.Status,
+	})
+}
+
+// pipelineStatusBefore reads the status of a pipeline about to change for its event; an
+// unreadable status is left out of the event.
+func (s *Service) pipelineStatusBefore(ctx context.Context, pipelineID int64) model.StatusValue {
+	status, err := s.store.GetPipelineStatus(ctx, pipelineID)
+	if err != nil {
+		log.Debug().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to read pipeline status for event")
+	}
+	return status
+}
+
+// publishPipelineStatus announces a status change of a pipeline; re-entering the same
+// status, like a re-delivered task running again, is not a change.
+func (s *Service) publishPipelineStatus(ctx context.Context, pipelineID int64, from, to model.StatusValue) {
+	if from == to {
+		return
+	}
+	pipeline, err := s.GetPipeline(ctx, pipelineID)
+	if err != nil || pipeline == nil {
+		return
+	}
+	s.events.publish(model.PipelineEvent{
+		Type:       model.PipelineEventStatusChanged,
+		RepoID:     pipeline.RepoID,
+		PipelineID: pipelineID,
+		Number:     pipeline.Number,
+		OldStatus:  from,
+		Status:     to,
+	})
+}
+
+// transitionStepWithEvent moves a step to status to and announces the change.
+func (s *Service) transitionStepWithEvent(ctx context.Context, stepID int64, to model.StatusValue, updates map[string]any) error {
+	before, err := s.store.GetStep(ctx, stepID)
+	if err != nil {
+		return err
+	}
+	if err := s.store.TransitionStep(ctx, stepID, to, updates); err != nil {
+		return err
+	}
+	if before != nil && before.State != to {
+		s.publishStepEvent(ctx, model.StepEventStatusChanged, before, before.State, to)
+	}
+	return nil
+}
+
+// publishStepEvent announces a step event of the run the step belongs to.
+func (s *Service) publishStepEvent(ctx context.Context, eventType model.PipelineEventType, step *model.Step, from, to model.StatusValue) {
+	pipeline, err := s.GetPipeline(ctx, step.PipelineID)
+	if err != nil || pipeline == nil {
+		return
+	}
+	s.events.publish(model.PipelineEvent{
+		Type:       eventType,
+		RepoID:     pipeline.RepoID,
+		PipelineID: step.PipelineID,
+		Number:     pipeline.Number,
+		StepID:     step.ID,
+		StepName:   step.Name,
+		OldStatus:  from,
+		Status:     to,
+	})
+}
@@ -0,0 +1,246 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// stepOutcome is the result of running a single pipeline step.
+type stepOutcome struct {
+	status  model.StatusValue
+	message string
+	// env holds the step env definitions exported to the steps that follow it.
+	env map[string]string
+	// err is a persistence failure that aborts the task without finalising the pipeline.
+	err error
+	// timedOut marks a failure caused by a step or pipeline deadline.
+	timedOut bool
+}
+
+type stepRunner func(step pipelineTaskStep, inheritedEnv map[string]string) stepOutcome
+
+type stepSkipper func(step pipelineTaskStep, reason string) error
+
+func canceledStepOutcome() stepOutcome {
+	return stepOutcome{status: model.StatusKilled, message: "pipeline canceled"}
+}
+
+// interruptedStepOutcome distinguishes an expired pipeline deadline from a user cancel.
+func interruptedStepOutcome(ctx context.Context) stepOutcome {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return stepOutcome{status: model.StatusFailure, message: "pipeline timed out", timedOut: true}
+	}
+	return canceledStepOutcome()
+}
+
+// mergeStepOutcome folds a step outcome into the pipeline result. Persistence errors win,
+// then cancellation, failure and finally a pending approval.
+func mergeStepOutcome(result, outcome stepOutcome) stepOutcome {
+	rank := func(o stepOutcome) int {
+		switch {
+		case o.err != nil:
+			return 4
+		case o.status == model.StatusKilled:
+			return 3
+		case o.status == model.StatusFailure:
+			return 2
+		case o.status == model.StatusBlocked:
+			return 1
+		default:
+			return 0
+		}
+	}
+	if rank(outcome) > rank(result) {
+		outcome.env = nil
+		return outcome
+	}
+	// a timeout after an earlier failure, in an always_run step, still ends the run as one
+	if outcome.timedOut && rank(outcome) == rank(result) {
+		result.timedOut = true
+	}
+	return result
+}
+
+func hasStepDependencies(steps []pipelineTaskStep) bool {
+	for _, step := range steps {
+		if len(step.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runStepSequence executes steps in slice order, passing each step's exported env to the next.
+// After a failure only always_run steps run; a cancellation or pending approval stops the
+// sequence.
+func runStepSequence(ctx context.Context, steps []pipelineTaskStep, run stepRunner) stepOutcome {
+	env := map[string]string{}
+	result := stepOutcome{status: model.StatusSuccess}
+	for _, step := range steps {
+		failed := result.status != model.StatusSuccess
+		if failed && !step.AlwaysRun {
+			continue
+		}
+		if ctx.Err() != nil {
+			return mergeStepOutcome(result, interruptedStepOutcome(ctx))
+		}
+		outcome := run(step, env)
+		if outcome.err != nil {
+			return mergeStepOutcome(result, outcome)
+		}
+		switch outcome.status {
+		case model.StatusSuccess, model.StatusSkipped:
+			if !failed && outcome.env != nil {
+				env = outcome.env
+			}
+		case model.StatusFailure:
+			result = mergeStepOutcome(result, outcome)
+		default:
+			return mergeStepOutcome(result, outcome)
+		}
+	}
+	return result
+}
+
+// runStepGraph executes steps as a DAG built from depends_on. Independent steps run
+// concurrently up to the service's parallel limit; dependents of a failed step are skipped
+// unless they are always_run. A step timeout stops new steps other than always_run ones from
+// starting; a cancellation, pipeline timeout or pending approval stops every new step. Both
+// wait for the running steps to return.
+func (s *Service) runStepGraph(ctx context.Context, steps []pipelineTaskStep, run stepRunner, skip stepSkipper) stepOutcome {
+	limit := s.maxParallelSteps
+	if limit <= 0 {
+		limit = 1
+	}
+
+	const (
+		nodePending = iota
+		nodeRunning
+		nodeDone
+	)
+	type stepResult struct {
+		index   int
+		outcome stepOutcome
+	}
+
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		index[step.Name] = i
+	}
+	states := make([]int, len(steps))
+	outcomes := make([]stepOutcome, len(steps))
+	broken := make([]bool, len(steps))
+	results := make(chan stepResult)
+	running := 0
+	// halted only lets always_run steps start; stopped lets none start
+	halted, stopped := false, false
+	result := stepOutcome{status: model.StatusSuccess}
+
+	// dependencyState reports whether every dependency has finished and names the first
+	// dependency that did not succeed. always_run steps wait for their dependencies whatever
+	// the outcome, and once halted no longer for the steps that will not start.
+	dependencyState := func(i int) (bool, string) {
+		ready := true
+		for _, dep := range steps[i].DependsOn {
+			j, ok := index[dep]
+			if !ok {
+				continue
+			}
+			if steps[i].AlwaysRun {
+				if states[j] != nodeDone && !(halted && states[j] == nodePending && !steps[j].AlwaysRun) {
+					ready = false
+				}
+				continue
+			}
+			if states[j] != nodeDone {
+				ready = false
+				continue
+			}
+			if broken[j] {
+				return false, dep
+			}
+		}
+		return ready, ""
+	}
+
+	inheritedEnv := func(i int) map[string]string {
+		env := map[string]string{}
+		for _, dep := range steps[i].DependsOn {
+			if j, ok := index[dep]; ok {
+				for key, value := range outcomes[j].env {
+					env[key] = value
+				}
+			}
+		}
+		return env
+	}
+
+	// schedule skips steps behind failed dependencies and launches ready ones. It reports
+	// whether any step changed state so that skips can cascade.
+	schedule := func() bool {
+		changed := false
+		for i := range steps {
+			if stopped || (halted && !steps[i].AlwaysRun) || states[i] != nodePending {
+				continue
+			}
+			ready, failedDep := dependencyState(i)
+			if failedDep != "" {
+				states[i] = nodeDone
+				broken[i] = true
+				changed = true
+				if err := skip(steps[i], fmt.Sprintf("依赖步骤 %s 未成功，已跳过", failedDep)); err != nil {
+					result = mergeStepOutcome(result, stepOutcome{err: err})
+					halted, stopped = true, true
+				}
+				continue
+			}
+			if !ready || running >= limit {
+				continue
+			}
+			states[i] = nodeRunning
+			running++
+			changed = true
+			go func(i int, env map[string]string) {
+				results <- stepResult{index: i, outcome: run(steps[i], env)}
+			}(i, inheritedEnv(i))
+		}
+		return changed
+	}
+
+	for {
+		if !stopped && ctx.Err() != nil {
+			halted, stopped = true, true
+			result = mergeStepOutcome(result, interruptedStepOutcome(ctx))
+		}
+		for schedule() {
+		}
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		states[res.index] = nodeDone
+		outcomes[res.index] = res.outcome
+		if res.outcome.err != nil {
+			halted, stopped = true, true
+		}
+		if res.outcome.timedOut {
+			halted = true
+		}
+		switch res.outcome.status {
+		case model.StatusSuccess, model.StatusSkipped:
+		case model.StatusKilled, model.StatusBlocked:
+			broken[res.index] = true
+			halted, stopped = true, true
+		default:
+			broken[res.index] = true
+		}
+		result = mergeStepOutcome(result, res.outcome)
+	}
+
+	return result
+}
@@ -0,0 +1,327 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// newFakeRun returns a service over a fake store holding a pending run of repository 1 with
+// one workflow and a step per entry of steps, and the task that executes it.
+func newFakeRun(t *testing.T, steps ...pipelineTaskStep) (*Service, *fakeStore, *model.Task) {
+	t.Helper()
+	fake := newFakeStore()
+	fake.repos[1] = &model.Repo{ID: 1, Owner: "team", Name: "app", FullName: "team/app"}
+	// steps leaving files in the workspace get the configured Dockerfile, as without one they fail
+	fake.configs[1] = &model.RepoPipelineConfig{RepoID: 1, Dockerfile: "FROM scratch\n"}
+	fake.pipelines[1] = &model.Pipeline{ID: 1, RepoID: 1, Number: 1, Status: model.StatusPending, Branch: "main"}
+	fake.workflows[1] = &model.Workflow{ID: 1, PipelineID: 1, PID: 1, Name: "build", State: model.StatusPending}
+
+	payload := pipelineTaskPayload{PipelineID: 1, RepoID: 1, Branch: "main", RunName: "build", WorkspaceRoot: t.TempDir()}
+	for i, step := range steps {
+		step.PID = i + 2
+		step.PPID = 1
+		payload.Steps = append(payload.Steps, step)
+		fake.steps[int64(i+1)] = &model.Step{ID: int64(i + 1), PipelineID: 1, PID: step.PID, PPID: 1, Name: step.Name, State: model.StatusPending, Type: step.Type}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &model.Task{ID: "task-1", PipelineID: 1, RepoID: 1, Data: data}
+	fake.tasks[task.ID] = task
+
+	svc := NewService(nil, nil, nil)
+	svc.store = fake
+	return svc, fake, task
+}
+
+func hostStep(name string, commands ...string) pipelineTaskStep {
+	return pipelineTaskStep{Name: name, Commands: commands, Runtime: spec.StepRuntimeHost}
+}
+
+func TestHandleTaskRunsSteps(t *testing.T) {
+	svc, fake, task := newFakeRun(t, hostStep("greet", "echo hello-from-step"))
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v\n%s", err, fake)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusSuccess || got.Started == 0 || got.Finished == 0 {
+		t.Fatalf("pipeline = %s started %d finished %d, want success\n%s", got.Status, got.Started, got.Finished, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusSuccess || got.ExitCode != 0 {
+		t.Fatalf("step = %s exit %d, want success\n%s", got.State, got.ExitCode, fake)
+	}
+	if !strings.Contains(fake.logText(1), "hello-from-step") {
+		t.Errorf("step log misses the command output:\n%s", fake.logText(1))
+	}
+	if fake.workflows[1].State != model.StatusSuccess {
+		t.Errorf("workflow = %s, want success", fake.workflows[1].State)
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of the finished pipeline was kept")
+	}
+}
+
+func TestHandleTaskFailingStepFailsPipeline(t *testing.T) {
+	svc, fake, task := newFakeRun(t, hostStep("broken", "exit 3"), hostStep("after", "echo unreachable"))
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusFailure {
+		t.Fatalf("pipeline = %s, want failure\n%s", got.Status, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusFailure || got.ExitCode != 3 {
+		t.Errorf("failed step = %s exit %d, want failure exit 3", got.State, got.ExitCode)
+	}
+	if got := fake.step(2); got.State == model.StatusSuccess || strings.Contains(fake.logText(2), "unreachable") {
+		t.Errorf("step after the failure ran: %s", got.State)
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of the failed pipeline was kept")
+	}
+}
+
+func TestHandleTaskDropsFinishedPipeline(t *testing.T) {
+	svc, fake, task := newFakeRun(t, hostStep("greet", "echo hello"))
+	fake.pipelines[1].Status = model.StatusKilled
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of a killed pipeline was kept")
+	}
+	if got := fake.step(1); got.State != model.StatusPending || fake.logText(1) != "" {
+		t.Errorf("step of a killed pipeline ran: %s", got.State)
+	}
+}
+
+func TestHandleTaskReturnsStoreErrors(t *testing.T) {
+	storeErr := errors.New("database is gone")
+	svc, fake, task := newFakeRun(t, hostStep("greet", "echo hello"))
+	fake.failWith("TransitionStep", storeErr)
+
+	if err := svc.handleTask(context.Background(), task); !errors.Is(err, storeErr) {
+		t.Fatalf("handleTask = %v, want the store error", err)
+	}
+	// the task stays so the run is picked up again
+	if !fake.hasTask(task.ID) {
+		t.Errorf("task was dropped after a store error")
+	}
+}
+
+func TestHandleTaskBlocksOnApproval(t *testing.T) {
+	approval := pipelineTaskStep{
+		Name:     "release",
+		Type:     model.StepTypeApproval,
+		Approval: &pipelineApprovalConfig{Message: "ship it?", Approvers: []string{"alice"}},
+	}
+	svc, fake, task := newFakeRun(t, approval, hostStep("deploy", "echo deployed"))
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusBlocked {
+		t.Fatalf("pipeline = %s, want blocked\n%s", got.Status, fake)
+	}
+	got := fake.step(1)
+	if got.State != model.StatusBlocked || got.Approval == nil || got.Approval.State != model.StepApprovalStatePending {
+		t.Fatalf("approval step = %s %+v, want blocked with a pending approval", got.State, got.Approval)
+	}
+	if got.Approval.RequestedAt == 0 || got.Approval.Message != "ship it?" {
+		t.Errorf("approval = %+v, want it requested with the configured message", got.Approval)
+	}
+	if got := fake.step(2); got.State != model.StatusPending {
+		t.Errorf("step behind the approval = %s, want pending", got.State)
+	}
+	// the task stays for the run to resume after the decision
+	if !fake.hasTask(task.ID) {
+		t.Errorf("task of the blocked pipeline was dropped")
+	}
+}
+
+func TestHandleTaskCancelled(t *testing.T) {
+	svc, fake, task := newFakeRun(t, hostStep("wait", "sleep 30"))
+
+	done := make(chan error, 1)
+	go func() { done <- svc.handleTask(context.Background(), task) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for fake.step(1).State != model.StatusRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("step did not start\n%s", fake)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := svc.CancelPipelineRun(context.Background(), 1, 1, ""); err != nil {
+		t.Fatalf("CancelPipelineRun: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("handleTask after a cancel: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("handleTask kept running after the cancel")
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusKilled {
+		t.Fatalf("pipeline = %s, want killed\n%s", got.Status, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusKilled {
+		t.Errorf("step = %s, want killed", got.State)
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of the cancelled pipeline was kept")
+	}
+}
+
+func TestHandleTaskStepTimeout(t *testing.T) {
+	slow := hostStep("slow", "sleep 30")
+	slow.Timeout = 1
+	svc, fake, task := newFakeRun(t, slow, hostStep("after", "echo unreachable"))
+
+	started := time.Now()
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 15*time.Second {
+		t.Fatalf("step ran %s past its 1s timeout", elapsed)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusFailure {
+		t.Fatalf("pipeline = %s, want failure\n%s", got.Status, fake)
+	}
+	got := fake.step(1)
+	if got.State != model.StatusFailure || got.Error != "step timed out after 1s" {
+		t.Errorf("timed out step = %s %q, want failure with the timeout", got.State, got.Error)
+	}
+	if !strings.Contains(fake.logText(1), "step timed out after 1s") {
+		t.Errorf("step log misses the timeout:\n%s", fake.logText(1))
+	}
+	// steps that never started are finalised like a cancel
+	if got := fake.step(2); got.State != model.StatusKilled {
+		t.Errorf("step after the timeout = %s, want killed", got.State)
+	}
+}
+
+func TestHandleTaskPipelineTimeout(t *testing.T) {
+	svc, fake, task := newFakeRun(t, hostStep("slow", "sleep 30"), hostStep("after", "echo unreachable"))
+	var payload pipelineTaskPayload
+	if err := json.Unmarshal(task.Data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	payload.Timeout = 1
+	task.Data, _ = json.Marshal(payload)
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusFailure {
+		t.Fatalf("pipeline = %s, want failure rather than killed\n%s", got.Status, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusFailure || got.Error != "pipeline timed out after 1s" {
+		t.Errorf("running step = %s %q, want failure with the pipeline timeout", got.State, got.Error)
+	}
+	if got := fake.step(2); got.State != model.StatusKilled {
+		t.Errorf("step after the timeout = %s, want killed", got.State)
+	}
+}
+
+func TestHandleTaskKeepsProtectedEnv(t *testing.T) {
+	step := hostStep("env", `echo "workspace=$WORKSPACE"`, `echo "sha=$CI_COMMIT_SHA"`)
+	step.Env = map[string]string{"WORKSPACE": "/tmp/elsewhere", "CI_COMMIT_SHA": "rebuilt"}
+	svc, fake, task := newFakeRun(t, step)
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	log := fake.logText(1)
+	if strings.Contains(log, "workspace=/tmp/elsewhere") || !strings.Contains(log, "workspace=/") {
+		t.Errorf("step env replaced the protected WORKSPACE:\n%s", log)
+	}
+	if !strings.Contains(log, "不允许覆盖") {
+		t.Errorf("log misses the refused override:\n%s", log)
+	}
+	if !strings.Contains(log, "sha=rebuilt") || !strings.Contains(log, "覆盖了系统变量 CI_COMMIT_SHA") {
+		t.Errorf("CI_COMMIT_SHA override was not applied with a notice:\n%s", log)
+	}
+}
+
+func TestHandleTaskSurvivesLogRetention(t *testing.T) {
+	release := filepath.Join(t.TempDir(), "release")
+	svc, fake, task := newFakeRun(t, hostStep("wait", "echo before-purge", fmt.Sprintf("while [ ! -f %s ]; do sleep 0.05; done", release), "echo after-purge"))
+	old := time.Now().AddDate(0, 0, -30).Unix()
+	fake.configs[1].LogRetentionDays = 7
+	// an earlier run of the repository that is past the retention
+	fake.pipelines[2] = &model.Pipeline{ID: 2, RepoID: 1, Number: 2, Status: model.StatusSuccess, Finished: old}
+	fake.steps[100] = &model.Step{ID: 100, PipelineID: 2, PID: 2, Name: "old", State: model.StatusSuccess}
+	fake.logs = append(fake.logs,
+		model.LogEntry{ID: 1000, StepID: 100, Line: 1, Data: []byte("old-output"), Created: old},
+		model.LogEntry{ID: 1001, StepID: 100, Line: 2, Data: []byte("old-output"), Created: old},
+	)
+
+	done := make(chan error, 1)
+	go func() { done <- svc.handleTask(context.Background(), task) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(fake.logText(1), "before-purge") {
+		if time.Now().After(deadline) {
+			t.Fatalf("step did not write its output\n%s", fake)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the lines of the running step look as old as those of the earlier run
+	fake.mu.Lock()
+	for i := range fake.logs {
+		if fake.logs[i].StepID == 1 {
+			fake.logs[i].Created = old
+		}
+	}
+	fake.mu.Unlock()
+
+	removed, err := svc.purgeExpiredLogs(context.Background())
+	if err != nil {
+		t.Fatalf("purgeExpiredLogs: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("purged %d lines, want the 2 of the earlier run", removed)
+	}
+	if text := fake.logText(100); strings.Contains(text, "old-output") || !strings.Contains(text, "logs purged after 7 days") {
+		t.Errorf("earlier run log = %q, want only the purge marker", text)
+	}
+
+	if err := os.WriteFile(release, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("handleTask: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("handleTask did not finish\n%s", fake)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusSuccess {
+		t.Fatalf("pipeline = %s, want success\n%s", got.Status, fake)
+	}
+	text := fake.logText(1)
+	if !strings.Contains(text, "before-purge") || !strings.Contains(text, "after-purge") || strings.Contains(text, "logs purged") {
+		t.Errorf("log of the run in flight = %q, want it complete without a purge marker", text)
+	}
+
+	// the run just finished, so it is within the retention however old its lines look
+	if removed, err := svc.purgeExpiredLogs(context.Background()); err != nil || removed != 0 {
+		t.Errorf("purge after the run = %d, %v, want nothing removed", removed, err)
+	}
+}
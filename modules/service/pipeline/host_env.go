@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"os"
+	"strings"
+)
+
+// defaultHostEnv lists the server variables every step receives. The rest of the server
+// environment holds its database DSN, session secret and cloud credentials, which builds
+// must not see.
+var defaultHostEnv = []string{"PATH", "HOME", "LANG", "TZ"}
+
+// WithHostEnv sets which variables of the server environment reach steps: extra adds names to
+// PATH, HOME, LANG and TZ, and inherit passes the whole environment as releases before the
+// allowlist did.
+func WithHostEnv(inherit bool, extra []string) Option {
+	return func(s *Service) {
+		s.inheritHostEnv = inherit
+		s.hostEnv = s.hostEnv[:0]
+		for _, name := range extra {
+			if name = strings.TrimSpace(name); name != "" {
+				s.hostEnv = append(s.hostEnv, name)
+			}
+		}
+	}
+}
+
+// hostEnvMap returns the variables of the server environment passed to steps.
+func (s *Service) hostEnvMap() map[string]string {
+	if s.inheritHostEnv {
+		return envMapFromOS()
+	}
+	return lookupHostEnv(defaultHostEnv, s.hostEnv)
+}
+
+// hostEnvList returns the variables of hostEnvMap as KEY=value entries, for the git commands
+// the server runs itself.
+func (s *Service) hostEnvList() []string {
+	return envMapToSlice(s.hostEnvMap())
+}
+
+// defaultHostEnvList returns the variables of defaultHostEnv as KEY=value entries. Commands
+// run without an environment of their own get these instead of the server environment.
+func defaultHostEnvList() []string {
+	return envMapToSlice(lookupHostEnv(defaultHostEnv))
+}
+
+func lookupHostEnv(lists ...[]string) map[string]string {
+	env := make(map[string]string)
+	for _, names := range lists {
+		for _, name := range names {
+			if value, ok := os.LookupEnv(name); ok {
+				env[name] = value
+			}
+		}
+	}
+	return env
+}
@@ -0,0 +1,200 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/model"
+)
+
+const secretDSN = "root:hunter2@tcp(db:3306)/devsys"
+
+func TestStepEnvLeavesOutServerSecrets(t *testing.T) {
+	t.Setenv("DEVSYS_DATABASE_DSN", secretDSN)
+	t.Setenv("EXTRA_TOOL_HOME", "/opt/tool")
+
+	envCtx := &pipelineEnvContext{
+		repo:     &model.Repo{ID: 1, FullName: "team/app"},
+		pipeline: &model.Pipeline{ID: 1, Number: 1},
+	}
+	svc := NewService(nil, nil, nil, WithHostEnv(false, []string{"EXTRA_TOOL_HOME"}))
+	env := svc.buildBaseEnv(envCtx)
+	if _, ok := env["DEVSYS_DATABASE_DSN"]; ok {
+		t.Fatalf("step environment holds DEVSYS_DATABASE_DSN")
+	}
+	if env["EXTRA_TOOL_HOME"] != "/opt/tool" {
+		t.Errorf("allowlisted EXTRA_TOOL_HOME = %q, want /opt/tool", env["EXTRA_TOOL_HOME"])
+	}
+
+	// a step command sees the environment it is given, whatever the login profile prints
+	output, err := runShellCommandCapture(context.Background(), t.TempDir(), "echo dsn=${DEVSYS_DATABASE_DSN:-unset}", envMapToSlice(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "dsn=unset") || strings.Contains(output, secretDSN) {
+		t.Fatalf("step saw %q", output)
+	}
+
+	inherited := NewService(nil, nil, nil, WithHostEnv(true, nil)).buildBaseEnv(envCtx)
+	if inherited["DEVSYS_DATABASE_DSN"] != secretDSN {
+		t.Errorf("inherit did not pass the server environment")
+	}
+}
+
+// fakeDocker answers the Docker Engine API calls a container step makes and keeps the
+// environment of every container created. Each container prints its name and exits 0.
+type fakeDocker struct {
+	mu   sync.Mutex
+	envs [][]string
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// strip the negotiated /v1.xx prefix
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/v1.") {
+		if i := strings.Index(path[1:], "/"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	switch {
+	case path == "/_ping":
+		w.Header().Set("Api-Version", "1.47")
+		_, _ = w.Write([]byte("OK"))
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		_, _ = w.Write([]byte(`{"Id":"sha256:fake"}`))
+	case path == "/containers/create":
+		var body struct{ Env []string }
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		d.envs = append(d.envs, body.Env)
+		id := fmt.Sprintf("container-%d", len(d.envs))
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"Id":%q,"Warnings":[]}`, id)
+	case strings.HasSuffix(path, "/start"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/attach"):
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.multiplexed-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		_, _ = fmt.Fprintln(stdcopy.NewStdWriter(buf, stdcopy.Stdout), "ran", strings.Split(path, "/")[2])
+		_ = buf.Flush()
+	case strings.HasSuffix(path, "/wait"):
+		_, _ = w.Write([]byte(`{"StatusCode":0}`))
+	case req.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"message":"not implemented by the fake"}`, http.StatusNotFound)
+	}
+}
+
+func (d *fakeDocker) containerEnvs() [][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.envs)
+}
+
+func TestContainerStepEnvHonoursHostEnvConfig(t *testing.T) {
+	docker := &fakeDocker{}
+	daemon := httptest.NewServer(docker)
+	t.Cleanup(daemon.Close)
+	t.Setenv("DOCKER_HOST", "tcp://"+daemon.Listener.Addr().String())
+	t.Setenv("DOCKER_API_VERSION", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+
+	t.Setenv("DEVSYS_DATABASE_DSN", secretDSN)
+	t.Setenv("DEVSYS_SESSION_SECRET", "session-secret")
+	t.Setenv("EXTRA_TOOL_HOME", "/opt/tool")
+	t.Setenv("GOPROXY", "https://proxy.internal")
+	t.Setenv("PIPELINE_HOST_ENV", "EXTRA_TOOL_HOME,GOPROXY")
+	t.Setenv("PIPELINE_INHERIT_HOST_ENV", "false")
+	cfg, err := config.Environ()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := pipelineTaskStep{Name: "build", Image: "alpine:3.20", Commands: []string{"go build ./...", "go test ./..."}}
+	svc, fake, task := newFakeRun(t, step)
+	WithHostEnv(cfg.Pipeline.InheritHostEnv, cfg.Pipeline.HostEnv)(svc)
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v\n%s", err, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusSuccess {
+		t.Fatalf("step = %s, want success\n%s", got.State, fake)
+	}
+	if !strings.Contains(fake.logText(1), "ran container-2") {
+		t.Errorf("step log misses the output of the second container:\n%s", fake.logText(1))
+	}
+
+	envs := docker.containerEnvs()
+	if len(envs) != len(step.Commands) {
+		t.Fatalf("created %d containers, want one per command", len(envs))
+	}
+	for i, env := range envs {
+		vars := make(map[string]string, len(env))
+		for _, entry := range env {
+			name, value, _ := strings.Cut(entry, "=")
+			vars[name] = value
+		}
+		for _, name := range []string{"DEVSYS_DATABASE_DSN", "DEVSYS_SESSION_SECRET", "PIPELINE_HOST_ENV", "DOCKER_HOST"} {
+			if _, ok := vars[name]; ok {
+				t.Errorf("container %d got server variable %s", i+1, name)
+			}
+		}
+		for name, want := range map[string]string{"EXTRA_TOOL_HOME": "/opt/tool", "GOPROXY": "https://proxy.internal"} {
+			if vars[name] != want {
+				t.Errorf("container %d: %s = %q, want %q from PIPELINE_HOST_ENV", i+1, name, vars[name], want)
+			}
+		}
+		if strings.Contains(strings.Join(env, "\n"), secretDSN) {
+			t.Errorf("container %d environment holds the database DSN", i+1)
+		}
+	}
+}
+
+func TestCommandsWithoutEnvGetAllowlist(t *testing.T) {
+	t.Setenv("DEVSYS_DATABASE_DSN", secretDSN)
+
+	output, err := runShellCommandCapture(context.Background(), t.TempDir(), "env", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "DEVSYS_DATABASE_DSN") {
+		t.Fatalf("command without env saw DEVSYS_DATABASE_DSN:\n%s", output)
+	}
+
+	var lines []string
+	err = runCommandWithLogging(context.Background(), t.TempDir(), "env", nil, nil, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "DEVSYS_DATABASE_DSN") {
+			t.Fatalf("logged command without env saw DEVSYS_DATABASE_DSN")
+		}
+	}
+	if len(lines) == 0 {
+		t.Fatalf("env printed nothing; PATH should be passed")
+	}
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// logTruncatedMarker replaces the first line over LogLimits.MaxLines; later lines are dropped.
+const logTruncatedMarker = "日志超过 %d 行，后续输出已丢弃 (log truncated)"
+
+// LogLimits bounds the log of a step. Zero MaxLines keeps every line.
+type LogLimits struct {
+	MaxLines int
+	// TailLines is how many of the last lines of each step GetPipelineRunDetail returns.
+	TailLines int
+}
+
+var defaultLogLimits = LogLimits{
+	MaxLines:  50000,
+	TailLines: 200,
+}
+
+// WithLogLimits sets the per-step log cap and the tail returned with run details.
+func WithLogLimits(limits LogLimits) Option {
+	return func(s *Service) {
+		if limits.MaxLines >= 0 {
+			s.logLimits.MaxLines = limits.MaxLines
+		}
+		if limits.TailLines > 0 {
+			s.logLimits.TailLines = limits.TailLines
+		}
+	}
+}
+
+// logLineAllocator hands out strictly increasing line numbers per step. Every log source of a
+// step — system messages, command output and skip notices — draws from the same counter.
+type logLineAllocator struct {
+	mu   sync.Mutex
+	next map[int64]int
+}
+
+// allocate returns the next line of stepID. The first call for a step continues after the
+// highest persisted line so a resumed step does not reuse numbers.
+func (a *logLineAllocator) allocate(ctx context.Context, stepID int64, seed func(context.Context, int64) (int, error)) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.next == nil {
+		a.next = make(map[int64]int)
+	}
+	line, ok := a.next[stepID]
+	if !ok {
+		last, err := seed(ctx, stepID)
+		if err != nil {
+			return 0, err
+		}
+		line = last + 1
+	}
+	a.next[stepID] = line + 1
+	return line, nil
+}
+
+// release drops the counters of the given steps once their task stops appending.
+func (a *logLineAllocator) release(stepIDs ...int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, id := range stepIDs {
+		delete(a.next, id)
+	}
+}
+
+// appendLogLine stores a log line of stepID. Past LogLimits.MaxLines a single marker line is
+// stored and further lines are dropped.
+func (s *Service) appendLogLine(ctx context.Context, stepID int64, content string) error {
+	return s.appendLogEntry(ctx, stepID, model.LogEntryStdout, content)
+}
+
+// appendLogMarker stores a command marker as a metadata line of stepID.
+func (s *Service) appendLogMarker(ctx context.Context, stepID int64, marker model.LogCommandMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return s.appendLogEntry(ctx, stepID, model.LogEntryMetadata, string(data))
+}
+
+func (s *Service) appendLogEntry(ctx context.Context, stepID int64, entryType model.LogEntryType, content string) error {
+	line, err := s.logLines.allocate(ctx, stepID, s.store.MaxLogLine)
+	if err != nil {
+		return err
+	}
+	if maxLines := s.logLimits.MaxLines; maxLines > 0 && line > maxLines {
+		if line > maxLines+1 {
+			return nil
+		}
+		content = fmt.Sprintf(logTruncatedMarker, maxLines)
+		entryType = model.LogEntryStdout
+	}
+	now := time.Now().Unix()
+	entry := model.LogEntry{
+		StepID:  stepID,
+		Time:    now,
+		Line:    line,
+		Data:    []byte(content + "\n"),
+		Created: now,
+		Type:    entryType,
+	}
+	return s.store.AppendLog(ctx, &entry)
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// newLogService returns a service over a database holding running step 1 of pipeline 1.
+func newLogService(t *testing.T, opts ...Option) (*Service, *gorm.DB) {
+	t.Helper()
+	db := storetest.Open(t, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.LogEntry{})
+	records := []any{
+		&model.Pipeline{ID: 1, RepoID: 1, Number: 1, Status: model.StatusRunning},
+		&model.Workflow{ID: 1, PipelineID: 1, PID: 1, Name: "build", State: model.StatusRunning},
+		&model.Step{ID: 1, PipelineID: 1, PID: 2, PPID: 1, Name: "build", State: model.StatusRunning},
+	}
+	for _, record := range records {
+		mustCreate(t, db.GetDB(), record)
+	}
+	return NewService(db, nil, nil, opts...), db.GetDB()
+}
+
+func mustCreate(t *testing.T, db *gorm.DB, record any) {
+	t.Helper()
+	if err := db.Create(record).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogLinesInterleaveInOrder(t *testing.T) {
+	svc, _ := newLogService(t)
+	ctx := context.Background()
+
+	// system messages and the output of a command append concurrently
+	var wg sync.WaitGroup
+	for source := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				if err := svc.appendLogLine(ctx, 1, fmt.Sprintf("source %d line %d", source, i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := svc.appendLogMarker(ctx, 1, model.LogCommandMarker{}); err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err := svc.GetPipelineRunDetail(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := detail.Logs[1]
+	if len(entries) != 61 || detail.LogTotals[1] != 61 {
+		t.Fatalf("got %d lines of %d, want 61", len(entries), detail.LogTotals[1])
+	}
+	last := map[int]int{}
+	for i, entry := range entries {
+		if entry.Line != i+1 {
+			t.Fatalf("line %d is numbered %d, want strictly increasing numbers from 1", i, entry.Line)
+		}
+		// each source keeps its own order within the shared numbering
+		var source, n int
+		if _, err := fmt.Sscanf(string(entry.Data), "source %d line %d", &source, &n); err == nil {
+			if prev, ok := last[source]; ok && n != prev+1 {
+				t.Fatalf("source %d line %d follows line %d", source, n, prev)
+			}
+			last[source] = n
+		}
+	}
+	if entries[60].Type != model.LogEntryMetadata {
+		t.Errorf("last entry type = %v, want the marker", entries[60].Type)
+	}
+}
+
+func TestLogLinesContinueAfterPersistedLines(t *testing.T) {
+	svc, db := newLogService(t)
+	ctx := context.Background()
+	// a step resumed by another service instance already has lines
+	for line := 1; line <= 3; line++ {
+		mustCreate(t, db, &model.LogEntry{StepID: 1, Line: line, Data: []byte("earlier\n")})
+	}
+
+	if err := svc.appendLogLine(ctx, 1, "resumed"); err != nil {
+		t.Fatal(err)
+	}
+	detail, err := svc.GetPipelineRunDetail(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := detail.Logs[1]
+	if got := entries[len(entries)-1]; got.Line != 4 || !strings.HasPrefix(string(got.Data), "resumed") {
+		t.Errorf("resumed line = %d %q, want line 4", got.Line, got.Data)
+	}
+}
+
+func TestLogLinesKeepOldDuplicatesInInsertOrder(t *testing.T) {
+	svc, db := newLogService(t)
+	// lines written before the numbering was shared may repeat a number
+	for _, data := range []string{"system a", "output 1", "system b", "output 2"} {
+		line := 1
+		if strings.HasPrefix(data, "output 2") {
+			line = 2
+		}
+		mustCreate(t, db, &model.LogEntry{StepID: 1, Line: line, Data: []byte(data)})
+	}
+
+	detail, err := svc.GetPipelineRunDetail(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range detail.Logs[1] {
+		got = append(got, string(entry.Data))
+	}
+	if want := "system a,output 1,system b,output 2"; strings.Join(got, ",") != want {
+		t.Errorf("lines = %s, want %s", strings.Join(got, ","), want)
+	}
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	defaultLogRetentionInterval = time.Hour
+	// logPurgeBatchSize bounds the log lines deleted per statement, keeping table locks short.
+	logPurgeBatchSize = 1000
+	// logPurgedLine is the line of the marker left in place of purged logs; output starts at 1.
+	logPurgedLine   = 0
+	logPurgedMarker = "日志已在 %d 天后清理 (logs purged after %d days)\n"
+)
+
+// logRetentionStatuses are the pipeline states whose logs may be purged; running and blocked
+// runs still write to theirs.
+var logRetentionStatuses = []model.StatusValue{
+	model.StatusSuccess,
+	model.StatusFailure,
+	model.StatusKilled,
+	model.StatusError,
+	model.StatusSkipped,
+	model.StatusDeclined,
+}
+
+// WithLogRetentionInterval sets how often logs past the LogRetentionDays of their repository
+// are deleted; 0 disables the cleanup.
+func WithLogRetentionInterval(interval time.Duration) Option {
+	return func(s *Service) {
+		if interval >= 0 {
+			s.logRetentionInterval = interval
+		}
+	}
+}
+
+// runLogRetention purges expired logs until ctx is done.
+func (s *Service) runLogRetention(ctx context.Context) {
+	ticker := time.NewTicker(s.logRetentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := s.purgeExpiredLogs(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Msg("failed to purge expired pipeline logs")
+			}
+			if removed > 0 {
+				log.Info().Int64("log_entries", removed).Msg("purged expired pipeline logs")
+			}
+		}
+	}
+}
+
+// purgeExpiredLogs deletes the log lines of finished runs of every repository with a log
+// retention and returns how many it removed. A repository that fails is logged and the
+// others are still purged.
+func (s *Service) purgeExpiredLogs(ctx context.Context) (int64, error) {
+	configs, err := s.store.ListPipelineConfigs(ctx, "repo_id", "log_retention_days")
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, cfg := range configs {
+		if cfg.LogRetentionDays <= 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		removed, err := s.purgeRepoLogs(ctx, cfg.RepoID, cfg.LogRetentionDays)
+		total += removed
+		s.metrics.LogsPurged(removed)
+		if err != nil {
+			log.Warn().Err(err).Int64("repo_id", cfg.RepoID).Msg("failed to purge expired logs of repository")
+		}
+	}
+	return total, nil
+}
+
+// purgeRepoLogs deletes the log lines older than days of the finished runs of repoID in
+// batches. Every step that lost lines gets a single marker line explaining the gap.
+func (s *Service) purgeRepoLogs(ctx context.Context, repoID int64, days int) (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	var removed int64
+	for {
+		matched, deleted, err := s.store.PurgeLogs(ctx, repoID, cutoff, days, logPurgeBatchSize)
+		removed += deleted
+		if err != nil || matched < logPurgeBatchSize {
+			return removed, err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/thepenn/devsys/internal/metrics"
+	"github.com/thepenn/devsys/model"
+)
+
+// WithMetrics records pipeline, step and cron metrics in registry.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(s *Service) {
+		s.metrics = registry
+	}
+}
+
+func pipelineMetricResult(status model.StatusValue) string {
+	switch status {
+	case model.StatusSuccess:
+		return metrics.ResultSucceeded
+	case model.StatusKilled:
+		return metrics.ResultCancelled
+	default:
+		return metrics.ResultFailed
+	}
+}
+
+// observePipeline counts a pipeline lifecycle change; result is one of the metrics.Result*
+// values. Finished pipelines also record their duration.
+func (s *Service) observePipeline(ctx context.Context, pipelineID int64, result string) {
+	if s.metrics == nil {
+		return
+	}
+	pipeline, err := s.fetchPipeline(ctx, pipelineID)
+	if err != nil || pipeline == nil {
+		return
+	}
+	repoName := ""
+	if repo, err := s.fetchRepo(ctx, pipeline.RepoID); err == nil && repo != nil {
+		repoName = repo.FullName
+	}
+	if result == metrics.ResultStarted {
+		s.metrics.PipelineStarted(repoName, string(pipeline.Event))
+		return
+	}
+	var duration time.Duration
+	if pipeline.Started > 0 && pipeline.Finished >= pipeline.Started {
+		duration = time.Duration(pipeline.Finished-pipeline.Started) * time.Second
+	}
+	s.metrics.PipelineFinished(repoName, string(pipeline.Event), result, duration)
+}
+
+func (s *Service) observeStep(repo *model.Repo, step *model.Step) {
+	if s.metrics == nil || repo == nil || step.Started <= 0 || step.Finished < step.Started {
+		return
+	}
+	s.metrics.StepFinished(repo.FullName, string(step.State), time.Duration(step.Finished-step.Started)*time.Second)
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/metrics"
+	"github.com/thepenn/devsys/model"
+)
+
+func scrapeMetrics(t *testing.T, registry *metrics.Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestHandleTaskRecordsMetrics(t *testing.T) {
+	cases := map[string]struct {
+		steps  []pipelineTaskStep
+		result string
+		step   string
+	}{
+		"success": {[]pipelineTaskStep{hostStep("greet", "echo hello")}, metrics.ResultSucceeded, "success"},
+		"failure": {[]pipelineTaskStep{hostStep("broken", "exit 1")}, metrics.ResultFailed, "failure"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			svc, fake, task := newFakeRun(t, c.steps...)
+			fake.pipelines[1].Event = model.EventPush
+			registry := metrics.New()
+			WithMetrics(registry)(svc)
+
+			if err := svc.handleTask(context.Background(), task); err != nil {
+				t.Fatalf("handleTask: %v", err)
+			}
+			body := scrapeMetrics(t, registry)
+			for _, want := range []string{
+				`devsys_pipelines_total{event="push",repo="team/app",result="started"} 1`,
+				`devsys_pipelines_total{event="push",repo="team/app",result="` + c.result + `"} 1`,
+				`devsys_pipeline_duration_seconds_count{repo="team/app",result="` + c.result + `"}`,
+				`devsys_step_duration_seconds_count{repo="team/app",status="` + c.step + `"} 1`,
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("metrics miss %s", want)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelRecordsMetrics(t *testing.T) {
+	svc, fake, _ := newFakeRun(t, hostStep("greet", "echo hello"))
+	fake.pipelines[1].Event = model.EventCron
+	registry := metrics.New()
+	WithMetrics(registry)(svc)
+
+	if err := svc.CancelPipelineRun(context.Background(), 1, 1, ""); err != nil {
+		t.Fatalf("CancelPipelineRun: %v", err)
+	}
+	body := scrapeMetrics(t, registry)
+	if !strings.Contains(body, `devsys_pipelines_total{event="cron",repo="team/app",result="cancelled"} 1`) {
+		t.Errorf("cancelled pipeline was not counted:\n%s", body)
+	}
+}
+
+func TestPipelineMetricResult(t *testing.T) {
+	want := map[model.StatusValue]string{
+		model.StatusSuccess: metrics.ResultSucceeded,
+		model.StatusKilled:  metrics.ResultCancelled,
+		model.StatusFailure: metrics.ResultFailed,
+		model.StatusError:   metrics.ResultFailed,
+	}
+	for status, result := range want {
+		if got := pipelineMetricResult(status); got != result {
+			t.Errorf("pipelineMetricResult(%s) = %s, want %s", status, got, result)
+		}
+	}
+}
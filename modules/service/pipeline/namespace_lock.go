@@ -0,0 +1,165 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	defaultNamespaceLockTimeout = 10 * time.Minute
+	namespaceLockPollInterval   = 2 * time.Second
+)
+
+var ErrNamespaceLockTimeout = errors.New("等待命名空间锁超时")
+
+type pipelineDeployTarget struct {
+	Cluster      string               `json:"cluster"`
+	Namespace    string               `json:"namespace"`
+	Manifest     string               `json:"manifest,omitempty"`
+	ManifestFile string               `json:"manifest_file,omitempty"`
+	SetImage     *pipelineDeployImage `json:"set_image,omitempty"`
+	WaitReady    bool                 `json:"wait_ready,omitempty"`
+}
+
+type pipelineDeployImage struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+}
+
+func (t *pipelineDeployTarget) String() string {
+	return t.Cluster + "/" + t.Namespace
+}
+
+// WithNamespaceLockTimeout bounds how long a deploy step waits for its namespace lock.
+func WithNamespaceLockTimeout(timeout time.Duration) Option {
+	return func(s *Service) {
+		if timeout > 0 {
+			s.namespaceLockTimeout = timeout
+		}
+	}
+}
+
+// ListNamespaceLocks returns the namespace locks currently held by deploy steps.
+func (s *Service) ListNamespaceLocks(ctx context.Context) ([]*model.NamespaceLock, error) {
+	return s.store.ListNamespaceLocks(ctx)
+}
+
+// ReleaseNamespaceLock force-releases a lock. A step waiting on it acquires it on its next
+// poll; the previous holder keeps running but no longer blocks other deploys.
+func (s *Service) ReleaseNamespaceLock(ctx context.Context, lockID int64) error {
+	deleted, err := s.store.DeleteNamespaceLock(ctx, lockID, 0)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return gorm.ErrRecordNotFound
+	}
+	log.Warn().Int64("lock_id", lockID).Msg("namespace lock force-released")
+	return nil
+}
+
+// acquireNamespaceLock blocks until the deploy target is free, ctx ends or the lock timeout
+// expires. Locks held by pipelines that are no longer active are reclaimed. The returned
+// func releases the lock and must be called once the step finishes.
+func (s *Service) acquireNamespaceLock(ctx context.Context, target *pipelineDeployTarget, repo *model.Repo, pipeline *model.Pipeline, step *model.Step, logFn func(string) error) (func(), error) {
+	timeout := s.namespaceLockTimeout
+	if timeout <= 0 {
+		timeout = defaultNamespaceLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	lastHolder := int64(0)
+
+	for {
+		lock := &model.NamespaceLock{
+			Cluster:        target.Cluster,
+			Namespace:      target.Namespace,
+			RepoID:         repo.ID,
+			RepoName:       repo.FullName,
+			PipelineID:     pipeline.ID,
+			PipelineNumber: pipeline.Number,
+			StepID:         step.ID,
+			StepName:       step.Name,
+			Acquired:       time.Now().Unix(),
+		}
+		holder, acquired, err := s.store.TryAcquireNamespaceLock(ctx, lock)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			if lastHolder != 0 && logFn != nil {
+				_ = logFn(fmt.Sprintf("已获取命名空间锁 %s", target))
+			}
+			return func() { s.releaseNamespaceLock(lock) }, nil
+		}
+
+		if holder != nil {
+			if holder.StepID == step.ID {
+				// left behind by an earlier attempt of this same step
+				_, _ = s.store.DeleteNamespaceLock(ctx, holder.ID, holder.StepID)
+				continue
+			}
+			if s.namespaceLockStale(ctx, holder) {
+				if deleted, err := s.store.DeleteNamespaceLock(ctx, holder.ID, holder.StepID); err == nil && deleted {
+					log.Warn().Int64("lock_id", holder.ID).Int64("pipeline_id", holder.PipelineID).Str("target", target.String()).Msg("reclaimed namespace lock held by inactive pipeline")
+				}
+				continue
+			}
+			if holder.ID != lastHolder {
+				lastHolder = holder.ID
+				if logFn != nil {
+					_ = logFn(fmt.Sprintf("等待命名空间锁 %s，当前由仓库 %s 流水线 #%d（步骤 %s）持有", target, holder.RepoName, holder.PipelineNumber, holder.StepName))
+				}
+			}
+		}
+
+		wait := namespaceLockPollInterval
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w: %s（已等待 %s）", ErrNamespaceLockTimeout, target, timeout)
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Service) releaseNamespaceLock(lock *model.NamespaceLock) {
+	// release even when the step context is already cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := s.store.DeleteNamespaceLock(ctx, lock.ID, lock.StepID); err != nil {
+		log.Error().Err(err).Int64("lock_id", lock.ID).Str("cluster", lock.Cluster).Str("namespace", lock.Namespace).Msg("failed to release namespace lock")
+	}
+}
+
+func (s *Service) namespaceLockStale(ctx context.Context, holder *model.NamespaceLock) bool {
+	status, err := s.store.GetPipelineStatus(ctx, holder.PipelineID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	switch status {
+	case model.StatusPending, model.StatusRunning, model.StatusBlocked:
+		return false
+	default:
+		return true
+	}
+}
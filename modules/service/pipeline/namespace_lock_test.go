@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// lockRun is a running pipeline with a deploy step contending for a namespace lock.
+type lockRun struct {
+	repo     *model.Repo
+	pipeline *model.Pipeline
+	step     *model.Step
+}
+
+// newLockService returns a service over a database holding a running pipeline of each of
+// two repositories, both deploying to prod/payments.
+func newLockService(t *testing.T, opts ...Option) (*Service, [2]lockRun, *pipelineDeployTarget) {
+	t.Helper()
+	db := storetest.Open(t, &model.Pipeline{}, &model.NamespaceLock{})
+	var runs [2]lockRun
+	for i := range runs {
+		id := int64(i + 1)
+		pipeline := &model.Pipeline{ID: id, RepoID: id, Number: 7 * id, Status: model.StatusRunning}
+		if err := db.GetDB().Create(pipeline).Error; err != nil {
+			t.Fatal(err)
+		}
+		runs[i] = lockRun{
+			repo:     &model.Repo{ID: id, FullName: []string{"team/api", "team/web"}[i]},
+			pipeline: pipeline,
+			step:     &model.Step{ID: 10 + id, PipelineID: id, Name: "deploy"},
+		}
+	}
+	return NewService(db, nil, nil, opts...), runs, &pipelineDeployTarget{Cluster: "prod", Namespace: "payments"}
+}
+
+// collectLog returns a log func and a func reading what it logged.
+func collectLog() (func(string) error, func() string) {
+	var mu sync.Mutex
+	var lines []string
+	return func(line string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, line)
+			return nil
+		}, func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return strings.Join(lines, "\n")
+		}
+}
+
+func TestNamespaceLockContention(t *testing.T) {
+	svc, runs, target := newLockService(t)
+	ctx := context.Background()
+
+	release, err := svc.acquireNamespaceLock(ctx, target, runs[0].repo, runs[0].pipeline, runs[0].step, nil)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	logFn, logged := collectLog()
+	acquired := make(chan func(), 1)
+	go func() {
+		release, err := svc.acquireNamespaceLock(ctx, target, runs[1].repo, runs[1].pipeline, runs[1].step, logFn)
+		if err != nil {
+			t.Errorf("second acquire: %v", err)
+		}
+		acquired <- release
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logged(), "team/api 流水线 #7") {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting step did not log the holder:\n%s", logged())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-acquired:
+		t.Fatal("second pipeline got the lock while the first held it")
+	default:
+	}
+
+	release()
+	select {
+	case releaseSecond := <-acquired:
+		locks, _ := svc.ListNamespaceLocks(ctx)
+		if len(locks) != 1 || locks[0].PipelineID != 2 {
+			t.Errorf("locks = %+v, want the second pipeline holding the namespace", locks)
+		}
+		releaseSecond()
+	case <-time.After(10 * time.Second):
+		t.Fatal("second pipeline did not get the released lock")
+	}
+	if locks, _ := svc.ListNamespaceLocks(ctx); len(locks) != 0 {
+		t.Errorf("locks = %+v after both released, want none", locks)
+	}
+}
+
+func TestNamespaceLockTimeout(t *testing.T) {
+	svc, runs, target := newLockService(t, WithNamespaceLockTimeout(200*time.Millisecond))
+	ctx := context.Background()
+
+	release, err := svc.acquireNamespaceLock(ctx, target, runs[0].repo, runs[0].pipeline, runs[0].step, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	_, err = svc.acquireNamespaceLock(ctx, target, runs[1].repo, runs[1].pipeline, runs[1].step, nil)
+	if !errors.Is(err, ErrNamespaceLockTimeout) {
+		t.Fatalf("acquire = %v, want the lock timeout", err)
+	}
+}
+
+func TestNamespaceLockForceRelease(t *testing.T) {
+	svc, runs, target := newLockService(t)
+	ctx := context.Background()
+
+	if _, err := svc.acquireNamespaceLock(ctx, target, runs[0].repo, runs[0].pipeline, runs[0].step, nil); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := svc.acquireNamespaceLock(ctx, target, runs[1].repo, runs[1].pipeline, runs[1].step, nil)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	locks, err := svc.ListNamespaceLocks(ctx)
+	if err != nil || len(locks) != 1 {
+		t.Fatalf("locks = %+v, %v, want the first pipeline's", locks, err)
+	}
+	if err := svc.ReleaseNamespaceLock(ctx, locks[0].ID); err != nil {
+		t.Fatalf("ReleaseNamespaceLock: %v", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("waiting step after the force release: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting step did not get the force-released lock")
+	}
+	if err := svc.ReleaseNamespaceLock(ctx, locks[0].ID); err == nil {
+		t.Errorf("releasing a released lock succeeded")
+	}
+}
+
+func TestNamespaceLockReclaimsFinishedHolder(t *testing.T) {
+	svc, runs, target := newLockService(t, WithNamespaceLockTimeout(200*time.Millisecond))
+	ctx := context.Background()
+
+	if _, err := svc.acquireNamespaceLock(ctx, target, runs[0].repo, runs[0].pipeline, runs[0].step, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the holder finished without releasing, as after a crash
+	if err := svc.store.(*gormPipelineStore).db.GetDB().Model(&model.Pipeline{}).Where("id = ?", 1).Update("status", model.StatusFailure).Error; err != nil {
+		t.Fatal(err)
+	}
+	release, err := svc.acquireNamespaceLock(ctx, target, runs[1].repo, runs[1].pipeline, runs[1].step, nil)
+	if err != nil {
+		t.Fatalf("acquire over a finished holder: %v", err)
+	}
+	release()
+}
@@ -0,0 +1,572 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/proxy"
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	notificationQueueSize    = 256
+	notificationMaxAttempts  = 3
+	notificationTimeout      = 10 * time.Second
+	notificationRetryBackoff = 2 * time.Second
+	// headerNotificationSignature carries the HMAC-SHA256 of a generic webhook body.
+	headerNotificationSignature = "X-Devsys-Signature"
+)
+
+var ErrNotificationTargetInvalid = errors.New("通知配置无效")
+
+// notificationEvent asks the notifier to deliver event of a pipeline, of its approval step
+// when stepID is set, or of a drifted deploy target when drift is set.
+type notificationEvent struct {
+	pipelineID int64
+	stepID     int64
+	event      string
+	drift      *model.KubernetesTarget
+}
+
+// NotificationMessage is the payload posted to generic webhook targets.
+type NotificationMessage struct {
+	Event      string `json:"event"`
+	Repo       string `json:"repo"`
+	RepoID     int64  `json:"repo_id"`
+	PipelineID int64  `json:"pipeline_id"`
+	Number     int64  `json:"number"`
+	Branch     string `json:"branch"`
+	Commit     string `json:"commit"`
+	Author     string `json:"author"`
+	Status     string `json:"status"`
+	Duration   int64  `json:"duration"`
+	Message    string `json:"message,omitempty"`
+	URL        string `json:"url,omitempty"`
+	// RequestedBy, Approvers and ExpiresAt describe the approval of approval events.
+	RequestedBy string   `json:"requested_by,omitempty"`
+	Approvers   []string `json:"approvers,omitempty"`
+	ExpiresAt   int64    `json:"expires_at,omitempty"`
+}
+
+// WithNotifications sets the public base URL used for the links in notifications and the
+// proxy rules deliveries are sent with.
+func WithNotifications(baseURL string, proxyRules *proxy.Rules) Option {
+	return func(s *Service) {
+		s.notifyBaseURL = strings.TrimRight(strings.TrimSpace(baseURL), "/")
+		s.notifyClient = &http.Client{Timeout: notificationTimeout, Transport: proxyRules.Transport()}
+	}
+}
+
+// notificationEventFor maps a final pipeline status to the event targets subscribe to.
+// Killed pipelines were cancelled by a user and are not announced.
+func notificationEventFor(status model.StatusValue) string {
+	switch status {
+	case model.StatusSuccess:
+		return model.NotificationEventSuccess
+	case model.StatusFailure, model.StatusError:
+		return model.NotificationEventFailure
+	case model.StatusBlocked:
+		return model.NotificationEventBlocked
+	default:
+		return ""
+	}
+}
+
+// publishNotification hands an event to the notifier without blocking the pipeline; events
+// are dropped with a log line when the notifier falls behind.
+func (s *Service) publishNotification(pipelineID int64, status model.StatusValue) {
+	event := notificationEventFor(status)
+	if event == "" || s.notifications == nil {
+		return
+	}
+	select {
+	case s.notifications <- notificationEvent{pipelineID: pipelineID, event: event}:
+	default:
+		log.Warn().Int64("pipeline_id", pipelineID).Str("event", event).Msg("notification queue full, event dropped")
+	}
+}
+
+// NotifyDrift announces a deploy target whose live object drifted from its baseline to the
+// targets of its repository subscribed to drift.
+func (s *Service) NotifyDrift(target *model.KubernetesTarget) {
+	if target == nil || s.notifications == nil {
+		return
+	}
+	drift := *target
+	select {
+	case s.notifications <- notificationEvent{event: model.NotificationEventDrift, drift: &drift}:
+	default:
+		log.Warn().Int64("target_id", target.ID).Msg("notification queue full, drift event dropped")
+	}
+}
+
+// runNotifier delivers published events until ctx is done.
+func (s *Service) runNotifier(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.notifications:
+			s.deliverNotification(ctx, event)
+		}
+	}
+}
+
+func (s *Service) deliverNotification(ctx context.Context, event notificationEvent) {
+	if event.drift != nil {
+		s.deliverDriftNotification(ctx, event.drift)
+		return
+	}
+	if event.stepID != 0 {
+		s.deliverApprovalNotification(ctx, event)
+		return
+	}
+	pipeline, err := s.fetchPipeline(ctx, event.pipelineID)
+	if err != nil || pipeline == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("pipeline_id", event.pipelineID).Msg("failed to load pipeline for notification")
+		}
+		return
+	}
+	targets, err := s.ListNotificationTargets(ctx, pipeline.RepoID)
+	if err != nil {
+		log.Error().Err(err).Int64("repo_id", pipeline.RepoID).Msg("failed to load notification targets")
+		return
+	}
+	var subscribed []*model.NotificationTarget
+	for _, target := range targets {
+		if target.Enabled && target.Subscribed(event.event) {
+			subscribed = append(subscribed, target)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+	repo, err := s.fetchRepo(ctx, pipeline.RepoID)
+	if err != nil || repo == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("repo_id", pipeline.RepoID).Msg("failed to load repo for notification")
+		}
+		return
+	}
+
+	s.sendToTargets(ctx, subscribed, s.notificationMessage(repo, pipeline, event.event))
+}
+
+// deliverDriftNotification announces a drifted deploy target; drift events carry no pipeline.
+func (s *Service) deliverDriftNotification(ctx context.Context, drift *model.KubernetesTarget) {
+	targets, err := s.ListNotificationTargets(ctx, drift.RepoID)
+	if err != nil {
+		log.Error().Err(err).Int64("repo_id", drift.RepoID).Msg("failed to load notification targets")
+		return
+	}
+	var subscribed []*model.NotificationTarget
+	for _, target := range targets {
+		if target.Enabled && target.Subscribed(model.NotificationEventDrift) {
+			subscribed = append(subscribed, target)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+	repo, err := s.fetchRepo(ctx, drift.RepoID)
+	if err != nil || repo == nil {
+		if err != nil {
+			log.Error().Err(err).Int64("repo_id", drift.RepoID).Msg("failed to load repo for notification")
+		}
+		return
+	}
+	paths := make([]string, 0, len(drift.Findings))
+	for _, finding := range drift.Findings {
+		paths = append(paths, finding.Path)
+	}
+	text := fmt.Sprintf("%s %s/%s 已被删除", drift.Kind, drift.Namespace, drift.Name)
+	if drift.DriftState == model.KubernetesDriftDrifted {
+		text = fmt.Sprintf("%s %s/%s 与基线不一致: %s", drift.Kind, drift.Namespace, drift.Name, strings.Join(paths, ", "))
+	}
+	s.sendToTargets(ctx, subscribed, &NotificationMessage{
+		Event:   model.NotificationEventDrift,
+		Repo:    repo.FullName,
+		RepoID:  repo.ID,
+		Status:  drift.DriftState,
+		Message: text,
+	})
+}
+
+// sendToTargets delivers message to every target and records the attempts.
+func (s *Service) sendToTargets(ctx context.Context, targets []*model.NotificationTarget, message *NotificationMessage) {
+	var err error
+	for _, target := range targets {
+		attempt := &model.NotificationAttempt{
+			RepoID:     message.RepoID,
+			TargetID:   target.ID,
+			TargetName: target.Name,
+			PipelineID: message.PipelineID,
+			Event:      message.Event,
+			Status:     model.NotificationDelivered,
+		}
+		attempt.Attempts, err = s.sendNotificationWithRetry(ctx, target, message)
+		if err != nil {
+			attempt.Status = model.NotificationFailed
+			attempt.Error = err.Error()
+			log.Warn().Err(err).Int64("target_id", target.ID).Int64("pipeline_id", message.PipelineID).Msg("failed to deliver notification")
+		}
+		attempt.Created = time.Now().Unix()
+		if err := s.store.CreateNotificationAttempt(ctx, attempt); err != nil {
+			log.Error().Err(err).Int64("target_id", target.ID).Msg("failed to record notification attempt")
+		}
+	}
+}
+
+func (s *Service) notificationMessage(repo *model.Repo, pipeline *model.Pipeline, event string) *NotificationMessage {
+	message := &NotificationMessage{
+		Event:      event,
+		Repo:       repo.FullName,
+		RepoID:     repo.ID,
+		PipelineID: pipeline.ID,
+		Number:     pipeline.Number,
+		Branch:     pipeline.Branch,
+		Commit:     pipeline.Commit,
+		Author:     pipeline.Author,
+		Status:     string(pipeline.Status),
+		Message:    strings.TrimSpace(pipeline.Message),
+	}
+	if pipeline.Started > 0 {
+		end := pipeline.Finished
+		if end <= 0 {
+			end = time.Now().Unix()
+		}
+		message.Duration = end - pipeline.Started
+	}
+	message.URL = s.pipelineRunURL(repo, pipeline.ID)
+	return message
+}
+
+// sendNotificationWithRetry returns the number of attempts made and the last error.
+func (s *Service) sendNotificationWithRetry(ctx context.Context, target *model.NotificationTarget, message *NotificationMessage) (int, error) {
+	var err error
+	for attempt := 1; attempt <= notificationMaxAttempts; attempt++ {
+		if err = s.sendNotification(ctx, target, message); err == nil {
+			return attempt, nil
+		}
+		if attempt == notificationMaxAttempts {
+			return attempt, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(time.Duration(attempt) * notificationRetryBackoff):
+		}
+	}
+	return notificationMaxAttempts, err
+}
+
+func (s *Service) sendNotification(ctx context.Context, target *model.NotificationTarget, message *NotificationMessage) error {
+	endpoint := target.URL
+	var payload interface{}
+	switch target.Type {
+	case model.NotificationTypeSlack:
+		payload = map[string]string{"text": notificationText(message, false)}
+	case model.NotificationTypeDingTalk:
+		payload = map[string]interface{}{
+			"msgtype": "markdown",
+			"markdown": map[string]string{
+				"title": notificationTitle(message),
+				"text":  notificationText(message, true),
+			},
+		}
+		if target.Secret != "" {
+			signed, err := signDingTalkURL(endpoint, target.Secret, time.Now())
+			if err != nil {
+				return err
+			}
+			endpoint = signed
+		}
+	default:
+		payload = message
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if target.Type == model.NotificationTypeWebhook && target.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(target.Secret))
+		mac.Write(body)
+		req.Header.Set(headerNotificationSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if target.Type == model.NotificationTypeDingTalk {
+		// DingTalk answers 200 and reports failures in the body
+		var result struct {
+			ErrCode int    `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		if err := json.Unmarshal(respBody, &result); err == nil && result.ErrCode != 0 {
+			return fmt.Errorf("dingtalk error %d: %s", result.ErrCode, result.ErrMsg)
+		}
+	}
+	return nil
+}
+
+// signDingTalkURL appends the timestamp and signature a DingTalk robot with signing enabled
+// expects.
+func signDingTalkURL(endpoint, secret string, now time.Time) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + secret))
+	query := parsed.Query()
+	query.Set("timestamp", timestamp)
+	query.Set("sign", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+func notificationTitle(message *NotificationMessage) string {
+	var label string
+	switch message.Event {
+	case model.NotificationEventSuccess:
+		label = "成功"
+	case model.NotificationEventFailure:
+		label = "失败"
+	case model.NotificationEventBlocked, model.NotificationEventApproval:
+		label = "等待审批"
+	case model.NotificationEventApprovalReminder:
+		label = "审批提醒"
+	case model.NotificationEventDrift:
+		return fmt.Sprintf("%s 部署配置漂移", message.Repo)
+	default:
+		label = message.Status
+	}
+	return fmt.Sprintf("%s #%d %s", message.Repo, message.Number, label)
+}
+
+func notificationText(message *NotificationMessage, markdown bool) string {
+	if message.Event == model.NotificationEventDrift {
+		if markdown {
+			return "### " + notificationTitle(message) + "\n\n" + message.Message
+		}
+		return notificationTitle(message) + "\n" + message.Message
+	}
+	if message.Event == model.NotificationEventApproval || message.Event == model.NotificationEventApprovalReminder {
+		return approvalNotificationText(message, markdown)
+	}
+	lines := []string{
+		notificationTitle(message),
+		fmt.Sprintf("分支: %s", message.Branch),
+		fmt.Sprintf("状态: %s", message.Status),
+		fmt.Sprintf("耗时: %s", time.Duration(message.Duration)*time.Second),
+	}
+	if message.Author != "" {
+		lines = append(lines, fmt.Sprintf("触发人: %s", message.Author))
+	}
+	if message.URL != "" {
+		if markdown {
+			lines = append(lines, fmt.Sprintf("[查看详情](%s)", message.URL))
+		} else {
+			lines = append(lines, message.URL)
+		}
+	}
+	if markdown {
+		lines[0] = "### " + lines[0]
+		return strings.Join(lines, "\n\n")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// approvalNotificationText asks the pending approvers of message to decide.
+func approvalNotificationText(message *NotificationMessage, markdown bool) string {
+	lines := []string{
+		notificationTitle(message),
+		fmt.Sprintf("分支: %s", message.Branch),
+	}
+	if message.Message != "" {
+		lines = append(lines, fmt.Sprintf("说明: %s", message.Message))
+	}
+	if message.RequestedBy != "" {
+		lines = append(lines, fmt.Sprintf("发起人: %s", message.RequestedBy))
+	}
+	if len(message.Approvers) > 0 {
+		mentions := make([]string, 0, len(message.Approvers))
+		for _, approver := range message.Approvers {
+			mentions = append(mentions, "@"+approver)
+		}
+		lines = append(lines, fmt.Sprintf("审批人: %s", strings.Join(mentions, " ")))
+	}
+	if message.ExpiresAt > 0 {
+		lines = append(lines, fmt.Sprintf("截止时间: %s", time.Unix(message.ExpiresAt, 0).Format(time.DateTime)))
+	}
+	if message.URL != "" {
+		if markdown {
+			lines = append(lines, fmt.Sprintf("[前往审批](%s)", message.URL))
+		} else {
+			lines = append(lines, message.URL)
+		}
+	}
+	if markdown {
+		lines[0] = "### " + lines[0]
+		return strings.Join(lines, "\n\n")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ListNotificationTargets lists the notification targets of repoID.
+func (s *Service) ListNotificationTargets(ctx context.Context, repoID int64) ([]*model.NotificationTarget, error) {
+	return s.store.ListNotificationTargets(ctx, repoID)
+}
+
+// GetNotificationTarget returns a target of repoID or nil when it does not exist.
+func (s *Service) GetNotificationTarget(ctx context.Context, repoID, id int64) (*model.NotificationTarget, error) {
+	target, err := s.store.GetNotificationTarget(ctx, repoID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// CreateNotificationTarget validates and persists a new target.
+func (s *Service) CreateNotificationTarget(ctx context.Context, target *model.NotificationTarget) (*model.NotificationTarget, error) {
+	if target == nil {
+		return nil, fmt.Errorf("notification target is nil")
+	}
+	if err := normalizeNotificationTarget(target); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	target.ID = 0
+	target.Created = now
+	target.Updated = now
+	if err := s.store.CreateNotificationTarget(ctx, target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// UpdateNotificationTarget applies patch to a target of repoID. Returns nil when the target
+// does not exist.
+func (s *Service) UpdateNotificationTarget(ctx context.Context, repoID, id int64, patch model.NotificationTargetPatch) (*model.NotificationTarget, error) {
+	updated, err := s.store.UpdateNotificationTarget(ctx, repoID, id, func(target *model.NotificationTarget) error {
+		if patch.Name != nil {
+			target.Name = *patch.Name
+		}
+		if patch.Type != nil {
+			target.Type = *patch.Type
+		}
+		if patch.URL != nil {
+			target.URL = *patch.URL
+		}
+		if patch.Secret != nil && *patch.Secret != model.DefaultSecretMask {
+			target.Secret = *patch.Secret
+		}
+		if patch.Events != nil {
+			target.Events = *patch.Events
+		}
+		if patch.Enabled != nil {
+			target.Enabled = *patch.Enabled
+		}
+		if err := normalizeNotificationTarget(target); err != nil {
+			return err
+		}
+		target.Updated = time.Now().Unix()
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteNotificationTarget removes a target of repoID.
+func (s *Service) DeleteNotificationTarget(ctx context.Context, repoID, id int64) error {
+	return s.store.DeleteNotificationTarget(ctx, repoID, id)
+}
+
+// ListNotificationAttempts lists the most recent notification attempts of repoID.
+func (s *Service) ListNotificationAttempts(ctx context.Context, repoID int64, limit int) ([]*model.NotificationAttempt, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	return s.store.ListNotificationAttempts(ctx, repoID, limit)
+}
+
+func normalizeNotificationTarget(target *model.NotificationTarget) error {
+	target.Name = strings.TrimSpace(target.Name)
+	target.Type = strings.ToLower(strings.TrimSpace(target.Type))
+	target.URL = strings.TrimSpace(target.URL)
+	target.Secret = strings.TrimSpace(target.Secret)
+	if target.Name == "" {
+		return fmt.Errorf("%w: 名称不能为空", ErrNotificationTargetInvalid)
+	}
+	switch target.Type {
+	case "":
+		target.Type = model.NotificationTypeWebhook
+	case model.NotificationTypeWebhook, model.NotificationTypeSlack, model.NotificationTypeDingTalk:
+	default:
+		return fmt.Errorf("%w: 不支持的类型 %s", ErrNotificationTargetInvalid, target.Type)
+	}
+	parsed, err := url.Parse(target.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: 无效的地址", ErrNotificationTargetInvalid)
+	}
+
+	events := make([]string, 0, len(target.Events))
+	seen := make(map[string]struct{}, len(target.Events))
+	for _, raw := range target.Events {
+		event := strings.ToLower(strings.TrimSpace(raw))
+		switch event {
+		case model.NotificationEventSuccess, model.NotificationEventFailure, model.NotificationEventBlocked,
+			model.NotificationEventDrift, model.NotificationEventApproval, model.NotificationEventApprovalReminder:
+		default:
+			return fmt.Errorf("%w: 不支持的事件 %s", ErrNotificationTargetInvalid, raw)
+		}
+		if _, ok := seen[event]; ok {
+			continue
+		}
+		seen[event] = struct{}{}
+		events = append(events, event)
+	}
+	target.Events = events
+	return nil
+}
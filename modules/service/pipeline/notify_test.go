@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// newNotifyService returns a service over a database holding running pipeline 1 of
+// repository team/app, linking to runs under https://ci.example.com.
+func newNotifyService(t *testing.T) *Service {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.Pipeline{}, &model.Workflow{}, &model.Step{},
+		&model.NotificationTarget{}, &model.NotificationAttempt{})
+	records := []any{
+		&model.Repo{ID: 1, Owner: "team", Name: "app", FullName: "team/app"},
+		&model.Pipeline{ID: 1, RepoID: 1, Number: 7, Status: model.StatusRunning, Branch: "main",
+			Commit: "abc123", Author: "alice", Started: time.Now().Unix() - 90},
+	}
+	for _, record := range records {
+		mustCreate(t, db.GetDB(), record)
+	}
+	return NewService(db, nil, nil, WithNotifications("https://ci.example.com/", nil))
+}
+
+// received collects the requests a notification target was sent.
+type received struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *received) serve(t *testing.T, respond func(n int, w http.ResponseWriter)) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		n := len(r.requests)
+		r.mu.Unlock()
+		respond(n, w)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func (r *received) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func respondOK(int, http.ResponseWriter) {}
+
+func addTarget(t *testing.T, svc *Service, target *model.NotificationTarget) *model.NotificationTarget {
+	t.Helper()
+	target.RepoID = 1
+	target.Enabled = true
+	created, err := svc.CreateNotificationTarget(context.Background(), target)
+	if err != nil {
+		t.Fatalf("CreateNotificationTarget: %v", err)
+	}
+	return created
+}
+
+func nextNotification(t *testing.T, svc *Service) notificationEvent {
+	t.Helper()
+	select {
+	case event := <-svc.notifications:
+		return event
+	default:
+		t.Fatalf("no notification was published")
+		return notificationEvent{}
+	}
+}
+
+func TestPipelineFinishPublishesNotification(t *testing.T) {
+	ctx := context.Background()
+	svc := newNotifyService(t)
+	if err := svc.markPipelineBlocked(ctx, 1, "waiting for approval"); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextNotification(t, svc); event.event != model.NotificationEventBlocked || event.pipelineID != 1 {
+		t.Errorf("blocked pipeline published %+v, want blocked", event)
+	}
+	if err := svc.markPipelineFinished(ctx, 1, model.StatusFailure, time.Now().Unix(), "boom", ""); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextNotification(t, svc); event.event != model.NotificationEventFailure {
+		t.Errorf("failed pipeline published %+v, want failure", event)
+	}
+
+	// cancelled pipelines are not announced
+	svc = newNotifyService(t)
+	if err := svc.markPipelineFinished(ctx, 1, model.StatusKilled, time.Now().Unix(), "cancelled", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-svc.notifications:
+		t.Errorf("killed pipeline published %+v", event)
+	default:
+	}
+}
+
+func TestDeliverNotificationToTargets(t *testing.T) {
+	ctx := context.Background()
+	svc := newNotifyService(t)
+	var webhook, slack, dingtalk, unsubscribed received
+	addTarget(t, svc, &model.NotificationTarget{Name: "hook", Type: "webhook", URL: webhook.serve(t, respondOK), Secret: "s3cret"})
+	addTarget(t, svc, &model.NotificationTarget{Name: "slack", Type: "slack", URL: slack.serve(t, respondOK), Events: []string{"success"}})
+	addTarget(t, svc, &model.NotificationTarget{Name: "ding", Type: "dingtalk", URL: dingtalk.serve(t, func(_ int, w http.ResponseWriter) {
+		_, _ = io.WriteString(w, `{"errcode":0}`)
+	}) + "/robot/send?access_token=tok", Secret: "SECdemo"})
+	addTarget(t, svc, &model.NotificationTarget{Name: "failures", Type: "webhook", URL: unsubscribed.serve(t, respondOK), Events: []string{"failure"}})
+	disabled := addTarget(t, svc, &model.NotificationTarget{Name: "off", Type: "webhook", URL: unsubscribed.serve(t, respondOK)})
+	enabled := false
+	if _, err := svc.UpdateNotificationTarget(ctx, 1, disabled.ID, model.NotificationTargetPatch{Enabled: &enabled}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.markPipelineFinished(ctx, 1, model.StatusSuccess, time.Now().Unix(), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	svc.deliverNotification(ctx, nextNotification(t, svc))
+
+	if webhook.count() != 1 || slack.count() != 1 || dingtalk.count() != 1 {
+		t.Fatalf("deliveries webhook %d slack %d dingtalk %d, want one each", webhook.count(), slack.count(), dingtalk.count())
+	}
+	if unsubscribed.count() != 0 {
+		t.Errorf("unsubscribed or disabled targets were notified %d times", unsubscribed.count())
+	}
+
+	var message NotificationMessage
+	if err := json.Unmarshal(webhook.bodies[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Repo != "team/app" || message.Number != 7 || message.Branch != "main" || message.Status != "success" ||
+		message.Duration < 90 || message.URL != "https://ci.example.com/dev/projects/team/app/pipeline/1" {
+		t.Errorf("webhook message = %+v", message)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(webhook.bodies[0])
+	if got := webhook.requests[0].Header.Get(headerNotificationSignature); got != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("webhook signature = %q, want the HMAC of the body", got)
+	}
+
+	var slackBody struct{ Text string }
+	_ = json.Unmarshal(slack.bodies[0], &slackBody)
+	if !strings.Contains(slackBody.Text, "team/app #7 成功") || !strings.Contains(slackBody.Text, "分支: main") {
+		t.Errorf("slack text = %q", slackBody.Text)
+	}
+
+	query := dingtalk.requests[0].URL.Query()
+	if query.Get("access_token") != "tok" || query.Get("timestamp") == "" || query.Get("sign") == "" {
+		t.Errorf("dingtalk query = %v, want the token kept and the request signed", query)
+	}
+	sign := hmac.New(sha256.New, []byte("SECdemo"))
+	sign.Write([]byte(query.Get("timestamp") + "\nSECdemo"))
+	if query.Get("sign") != base64.StdEncoding.EncodeToString(sign.Sum(nil)) {
+		t.Errorf("dingtalk sign = %q does not match the timestamp", query.Get("sign"))
+	}
+
+	attempts, err := svc.ListNotificationAttempts(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("recorded %d attempts, want 3", len(attempts))
+	}
+	for _, attempt := range attempts {
+		if attempt.Status != model.NotificationDelivered || attempt.Attempts != 1 || attempt.PipelineID != 1 {
+			t.Errorf("attempt = %+v, want delivered at once", attempt)
+		}
+	}
+}
+
+func TestDeliverNotificationRetries(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	svc := newNotifyService(t)
+	var flaky, down received
+	addTarget(t, svc, &model.NotificationTarget{Name: "flaky", URL: flaky.serve(t, func(n int, w http.ResponseWriter) {
+		if n == 1 {
+			http.Error(w, "try later", http.StatusBadGateway)
+		}
+	})})
+	addTarget(t, svc, &model.NotificationTarget{Name: "down", URL: down.serve(t, func(_ int, w http.ResponseWriter) {
+		http.Error(w, "gone", http.StatusInternalServerError)
+	})})
+	targets, err := svc.ListNotificationTargets(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.sendToTargets(ctx, targets, &NotificationMessage{RepoID: 1, PipelineID: 1, Event: model.NotificationEventFailure})
+	attempts, err := svc.ListNotificationAttempts(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byTarget := make(map[string]*model.NotificationAttempt)
+	for _, attempt := range attempts {
+		byTarget[attempt.TargetName] = attempt
+	}
+	if got := byTarget["flaky"]; got == nil || got.Status != model.NotificationDelivered || got.Attempts != 2 {
+		t.Errorf("flaky attempt = %+v, want delivered on the second try", got)
+	}
+	got := byTarget["down"]
+	if got == nil || got.Status != model.NotificationFailed || got.Attempts != notificationMaxAttempts {
+		t.Fatalf("down attempt = %+v, want failed after %d tries", got, notificationMaxAttempts)
+	}
+	if !strings.Contains(got.Error, "unexpected status 500: gone") {
+		t.Errorf("failed attempt error = %q, want the response", got.Error)
+	}
+}
+
+func TestDingTalkErrorInBody(t *testing.T) {
+	svc := newNotifyService(t)
+	var robot received
+	target := &model.NotificationTarget{Type: model.NotificationTypeDingTalk, URL: robot.serve(t, func(_ int, w http.ResponseWriter) {
+		_, _ = io.WriteString(w, `{"errcode":310000,"errmsg":"sign not match"}`)
+	})}
+	err := svc.sendNotification(context.Background(), target, &NotificationMessage{Event: model.NotificationEventSuccess})
+	if err == nil || !strings.Contains(err.Error(), "dingtalk error 310000: sign not match") {
+		t.Errorf("sendNotification = %v, want the error DingTalk answered with", err)
+	}
+}
+
+func TestNormalizeNotificationTarget(t *testing.T) {
+	target := &model.NotificationTarget{Name: " hook ", Type: "", URL: " https://example.com/hook ", Events: []string{"Success", "success", " failure"}}
+	if err := normalizeNotificationTarget(target); err != nil {
+		t.Fatalf("normalizeNotificationTarget: %v", err)
+	}
+	if target.Name != "hook" || target.Type != model.NotificationTypeWebhook || target.URL != "https://example.com/hook" ||
+		strings.Join(target.Events, ",") != "success,failure" {
+		t.Errorf("normalized = %+v", target)
+	}
+
+	invalid := map[string]*model.NotificationTarget{
+		"no name":      {Type: "webhook", URL: "https://example.com"},
+		"unknown type": {Name: "x", Type: "email", URL: "https://example.com"},
+		"not http":     {Name: "x", URL: "ftp://example.com"},
+		"no host":      {Name: "x", URL: "https://"},
+		"bad event":    {Name: "x", URL: "https://example.com", Events: []string{"started"}},
+	}
+	for name, target := range invalid {
+		if err := normalizeNotificationTarget(target); !errors.Is(err, ErrNotificationTargetInvalid) {
+			t.Errorf("%s: %v, want ErrNotificationTargetInvalid", name, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// stepOutputPlaceholder is the env key under which a step output resolves, matched by
+// envPlaceholderRegex as ${steps.<step>.outputs.<key>}.
+func stepOutputPlaceholder(step, key string) string {
+	return fmt.Sprintf("steps.%s.outputs.%s", step, key)
+}
+
+// stepOutputEnv flattens the outputs of finished steps into placeholder keys. The result
+// only feeds placeholder resolution and never reaches a step environment.
+func stepOutputEnv(outputs map[string]map[string]string) map[string]string {
+	env := make(map[string]string)
+	for step, values := range outputs {
+		for key, value := range values {
+			env[stepOutputPlaceholder(step, key)] = value
+		}
+	}
+	return env
+}
+
+// withStepOutputs returns env extended with the step output placeholders.
+func withStepOutputs(env, outputEnv map[string]string) map[string]string {
+	if len(outputEnv) == 0 {
+		return env
+	}
+	merged := cloneStringMap(env)
+	if merged == nil {
+		merged = make(map[string]string, len(outputEnv))
+	}
+	for key, value := range outputEnv {
+		merged[key] = value
+	}
+	return merged
+}
+
+// stepOutputValues picks the step env values computed after the step ran that may be kept
+// as outputs: values whose definition references a secret or that contain a secret value
+// are dropped, as are protected names the step could not set.
+func stepOutputValues(definitions, values map[string]string, secrets map[string]resolvedSecretBinding, maskFn func(string) string) map[string]string {
+	outputs := make(map[string]string, len(values))
+	for key, value := range values {
+		if spec.IsProtectedEnv(key) {
+			continue
+		}
+		if raw, ok := definitions[key]; ok && applySecretPlaceholderToString(raw, secrets) != raw {
+			continue
+		}
+		if maskFn != nil && maskFn(value) != value {
+			continue
+		}
+		outputs[key] = value
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+	return outputs
+}
+
+// saveStepOutputs stores the outputs of a step and the updated outputs of the pipeline.
+func (s *Service) saveStepOutputs(ctx context.Context, pipelineID, stepID int64, outputs map[string]string, pipelineOutputs map[string]map[string]string) error {
+	if err := s.store.UpdateStep(ctx, stepID, map[string]any{"outputs": outputs}); err != nil {
+		return err
+	}
+	return s.store.UpdatePipeline(ctx, pipelineID, map[string]any{"outputs": pipelineOutputs})
+}
+
+func cloneStepOutputs(outputs map[string]map[string]string) map[string]map[string]string {
+	cloned := make(map[string]map[string]string, len(outputs))
+	for step, values := range outputs {
+		cloned[step] = cloneStringMap(values)
+	}
+	return cloned
+}
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// defaultPipelineStatsWindow is the window of a stats query without since.
+	defaultPipelineStatsWindow = 30 * 24 * time.Hour
+	// maxPipelineStatsWindow caps the window so the daily trend stays bounded.
+	maxPipelineStatsWindow = 366 * 24 * time.Hour
+	// maxPipelineStatsSteps caps the steps reported, most frequent first.
+	maxPipelineStatsSteps = 50
+	// maxPipelineStatsGroups caps the branch and event groups reported, largest first.
+	maxPipelineStatsGroups = 100
+	secondsPerDay          = 24 * 60 * 60
+)
+
+// ErrInvalidStatsQuery is returned for stats windows that end before they start.
+var ErrInvalidStatsQuery = errors.New("invalid pipeline stats query")
+
+// failedStatuses are the outcomes counted as failures; skipped and cancelled-before-start
+// runs count towards neither side.
+var failedStatuses = []model.StatusValue{model.StatusFailure, model.StatusError, model.StatusKilled}
+
+// PipelineStatsQuery selects the pipelines a stats report covers. Since and Until are unix
+// seconds; Until defaults to now and Since to 30 days before Until. When Step is set the
+// branch/event groups and the daily trend count the outcomes of that step instead of whole
+// pipelines.
+type PipelineStatsQuery struct {
+	Since  int64
+	Until  int64
+	Branch string
+	Step   string
+}
+
+// PipelineStats aggregates the finished runs of a repository over a time window.
+type PipelineStats struct {
+	Since     int64                 `json:"since"`
+	Until     int64                 `json:"until"`
+	Branch    string                `json:"branch,omitempty"`
+	Step      string                `json:"step,omitempty"`
+	Steps     []*StepStats          `json:"steps"`
+	Groups    []*PipelineStatsGroup `json:"groups"`
+	Daily     []*PipelineStatsDay   `json:"daily"`
+	Truncated bool                  `json:"truncated,omitempty"`
+}
+
+// StepStats summarizes the runs of one step name. Durations are in seconds over successful
+// runs. CurrentFailureStreak counts the failures since the last success.
+type StepStats struct {
+	StepName             string  `json:"step_name"`
+	Total                int64   `json:"total"`
+	Success              int64   `json:"success"`
+	Failure              int64   `json:"failure"`
+	SuccessRate          float64 `json:"success_rate"`
+	AvgDuration          float64 `json:"avg_duration"`
+	P50Duration          int64   `json:"p50_duration"`
+	P90Duration          int64   `json:"p90_duration"`
+	CurrentFailureStreak int64   `json:"current_failure_streak"`
+	LongestFailureStreak int64   `json:"longest_failure_streak"`
+}
+
+// PipelineStatsGroup counts outcomes per branch and event.
+type PipelineStatsGroup struct {
+	Branch  string             `json:"branch"`
+	Event   model.WebhookEvent `json:"event"`
+	Total   int64              `json:"total"`
+	Success int64              `json:"success"`
+	Failure int64              `json:"failure"`
+}
+
+// PipelineStatsDay counts outcomes of one UTC day; Day is the unix time the day starts.
+type PipelineStatsDay struct {
+	Day     int64 `json:"day"`
+	Success int64 `json:"success"`
+	Failure int64 `json:"failure"`
+}
+
+// PipelineStats aggregates the pipelines of repoID created within the query window. The
+// counting is done by the database; only aggregated rows are read.
+func (s *Service) PipelineStats(ctx context.Context, repoID int64, query PipelineStatsQuery) (*PipelineStats, error) {
+	until := query.Until
+	if until <= 0 {
+		until = time.Now().Unix()
+	}
+	since := query.Since
+	if since <= 0 {
+		since = until - int64(defaultPipelineStatsWindow/time.Second)
+	}
+	if since > until {
+		return nil, ErrInvalidStatsQuery
+	}
+	if until-since > int64(maxPipelineStatsWindow/time.Second) {
+		since = until - int64(maxPipelineStatsWindow/time.Second)
+	}
+
+	stats := &PipelineStats{
+		Since:  since,
+		Until:  until,
+		Branch: query.Branch,
+		Step:   query.Step,
+		Steps:  []*StepStats{},
+		Groups: []*PipelineStatsGroup{},
+		Daily:  []*PipelineStatsDay{},
+	}
+	if err := s.store.CollectPipelineStats(ctx, repoID, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,325 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+var (
+	ErrPluginExists  = errors.New("插件名称已存在")
+	ErrPluginInvalid = errors.New("插件定义无效")
+)
+
+// pluginNamePattern is what steps may write after `plugin:`, e.g. docker-publish.
+var pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// PluginSettingIssue is a field of a plugin step that does not match its plugin definition.
+// Field is relative to the step, e.g. "plugin" or "settings.repo".
+type PluginSettingIssue struct {
+	Field   string
+	Message string
+}
+
+// ListPlugins lists the registered plugin definitions by name.
+func (s *Service) ListPlugins(ctx context.Context) ([]*model.PluginDefinition, error) {
+	return s.store.ListPlugins(ctx)
+}
+
+// GetPlugin returns the plugin definition or nil when it does not exist.
+func (s *Service) GetPlugin(ctx context.Context, id int64) (*model.PluginDefinition, error) {
+	plugin, err := s.store.GetPlugin(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// CreatePlugin registers a plugin definition after normalising its name and checking its
+// settings schema.
+func (s *Service) CreatePlugin(ctx context.Context, plugin *model.PluginDefinition) (*model.PluginDefinition, error) {
+	if plugin == nil {
+		return nil, fmt.Errorf("plugin definition is nil")
+	}
+	if err := normalizePluginDefinition(plugin); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	plugin.ID = 0
+	plugin.Created = now
+	plugin.Updated = now
+
+	if err := s.store.CreatePlugin(ctx, plugin); err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// UpdatePlugin replaces a plugin definition. Runs already triggered keep the image and
+// settings they resolved; configs referencing the plugin are checked against the new schema
+// from their next save or trigger. Returns nil when the plugin does not exist.
+func (s *Service) UpdatePlugin(ctx context.Context, id int64, patch *model.PluginDefinition) (*model.PluginDefinition, error) {
+	if patch == nil {
+		return nil, fmt.Errorf("plugin definition is nil")
+	}
+	updated, err := s.store.UpdatePlugin(ctx, id, func(plugin *model.PluginDefinition) error {
+		plugin.Name = patch.Name
+		plugin.Version = patch.Version
+		plugin.Image = patch.Image
+		plugin.Description = patch.Description
+		plugin.Settings = patch.Settings
+		if err := normalizePluginDefinition(plugin); err != nil {
+			return err
+		}
+		plugin.Updated = time.Now().Unix()
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeletePlugin removes a plugin definition. Configs still referencing it fail validation.
+func (s *Service) DeletePlugin(ctx context.Context, id int64) error {
+	return s.store.DeletePlugin(ctx, id)
+}
+
+func normalizePluginDefinition(plugin *model.PluginDefinition) error {
+	plugin.Name = strings.ToLower(strings.TrimSpace(plugin.Name))
+	if !pluginNamePattern.MatchString(plugin.Name) {
+		return fmt.Errorf("%w: 名称只能包含小写字母、数字、点、下划线和连字符", ErrPluginInvalid)
+	}
+	plugin.Image = strings.TrimSpace(plugin.Image)
+	if plugin.Image == "" {
+		return fmt.Errorf("%w: 镜像不能为空", ErrPluginInvalid)
+	}
+	plugin.Version = strings.TrimSpace(plugin.Version)
+	plugin.Description = strings.TrimSpace(plugin.Description)
+
+	settings := make([]model.PluginSetting, 0, len(plugin.Settings))
+	envKeys := make(map[string]string, len(plugin.Settings))
+	for _, setting := range plugin.Settings {
+		setting.Name = strings.TrimSpace(setting.Name)
+		envKey := sanitizeAlias(setting.Name)
+		if envKey == "" {
+			return fmt.Errorf("%w: 参数名称不能为空", ErrPluginInvalid)
+		}
+		if other, ok := envKeys[envKey]; ok {
+			return fmt.Errorf("%w: 参数 %s 与 %s 对应同一个环境变量 PLUGIN_%s", ErrPluginInvalid, setting.Name, other, envKey)
+		}
+		envKeys[envKey] = setting.Name
+		setting.Type = model.PluginSettingType(strings.ToLower(strings.TrimSpace(string(setting.Type))))
+		switch setting.Type {
+		case "":
+			setting.Type = model.PluginSettingString
+		case model.PluginSettingString, model.PluginSettingNumber, model.PluginSettingBoolean, model.PluginSettingList:
+		default:
+			return fmt.Errorf("%w: 参数 %s 的类型 %s 无效，仅支持 string、number、boolean 或 list", ErrPluginInvalid, setting.Name, setting.Type)
+		}
+		enum := setting.Enum[:0:0]
+		for _, value := range setting.Enum {
+			if value = strings.TrimSpace(value); value != "" && !slices.Contains(enum, value) {
+				enum = append(enum, value)
+			}
+		}
+		setting.Enum = enum
+		if len(setting.Enum) == 0 {
+			setting.Enum = nil
+		}
+		setting.Description = strings.TrimSpace(setting.Description)
+		if setting.Default != nil {
+			if err := checkPluginSetting(&setting, setting.Default); err != nil {
+				return fmt.Errorf("%w: 参数 %s 的默认值无效: %v", ErrPluginInvalid, setting.Name, err)
+			}
+		}
+		settings = append(settings, setting)
+	}
+	plugin.Settings = settings
+	return nil
+}
+
+// stepPlugins loads the definitions of the plugins steps reference, keyed by name. Plugins
+// nobody references are not loaded.
+func (s *Service) stepPlugins(ctx context.Context, steps []spec.StepSpec) (map[string]*model.PluginDefinition, error) {
+	var names []string
+	for _, step := range steps {
+		if name := strings.ToLower(step.Plugin); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	plugins, err := s.store.ListPluginsByName(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*model.PluginDefinition, len(plugins))
+	for _, plugin := range plugins {
+		byName[plugin.Name] = plugin
+	}
+	return byName, nil
+}
+
+// resolvePluginStep checks a step referencing a plugin against its definition in plugins. It
+// returns the step with the image of the plugin and its settings completed with the defaults,
+// or the issues found; every setting is checked so that all of them are reported at once.
+func resolvePluginStep(step spec.StepSpec, plugins map[string]*model.PluginDefinition) (spec.StepSpec, *model.PluginDefinition, []PluginSettingIssue) {
+	plugin := plugins[strings.ToLower(step.Plugin)]
+	if plugin == nil {
+		return step, nil, []PluginSettingIssue{{
+			Field:   "plugin",
+			Message: fmt.Sprintf("步骤 %s 引用的插件 %s 未注册", step.Name, step.Plugin),
+		}}
+	}
+
+	var issues []PluginSettingIssue
+	settings := make(map[string]any, len(plugin.Settings))
+	for key, value := range step.Settings {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		setting := plugin.Setting(key)
+		if setting == nil {
+			issues = append(issues, PluginSettingIssue{
+				Field:   "settings." + key,
+				Message: fmt.Sprintf("插件 %s 没有参数 %s", plugin.Name, key),
+			})
+			continue
+		}
+		if pluginSettingEmpty(value) {
+			// unset like a missing key, so the default or the required check applies
+			continue
+		}
+		if err := checkPluginSetting(setting, value); err != nil {
+			issues = append(issues, PluginSettingIssue{
+				Field:   "settings." + key,
+				Message: fmt.Sprintf("插件 %s 的参数 %s 无效: %v", plugin.Name, key, err),
+			})
+			continue
+		}
+		settings[setting.Name] = value
+	}
+	for _, setting := range plugin.Settings {
+		if _, ok := settings[setting.Name]; ok {
+			continue
+		}
+		switch {
+		case setting.Default != nil:
+			settings[setting.Name] = setting.Default
+		case setting.Required && !hasPluginSettingIssue(issues, setting.Name):
+			issues = append(issues, PluginSettingIssue{
+				Field:   "settings." + setting.Name,
+				Message: fmt.Sprintf("缺少插件 %s 的必填参数 %s", plugin.Name, setting.Name),
+			})
+		}
+	}
+	if len(issues) > 0 {
+		return step, plugin, issues
+	}
+
+	step.Image = plugin.Image
+	step.Settings = settings
+	return step, plugin, nil
+}
+
+// checkPluginSetting checks value against the type and the allowed values of setting.
+func checkPluginSetting(setting *model.PluginSetting, value any) error {
+	values, err := coerceToStringSlice(value)
+	if err != nil {
+		return err
+	}
+	if setting.Type != model.PluginSettingList && len(values) != 1 {
+		return fmt.Errorf("应为单个值")
+	}
+	for _, item := range values {
+		switch setting.Type {
+		case model.PluginSettingNumber:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(item), 64); err != nil {
+				return fmt.Errorf("%q 不是数字", item)
+			}
+		case model.PluginSettingBoolean:
+			if _, err := strconv.ParseBool(strings.TrimSpace(item)); err != nil {
+				return fmt.Errorf("%q 不是布尔值", item)
+			}
+		}
+		if len(setting.Enum) > 0 && !slices.Contains(setting.Enum, item) {
+			return fmt.Errorf("%q 不是可选值 %s 之一", item, strings.Join(setting.Enum, "、"))
+		}
+	}
+	return nil
+}
+
+// pluginSettingEmpty reports whether a step leaves a setting blank, e.g. `tag:` or `tags: []`.
+func pluginSettingEmpty(value any) bool {
+	values, err := coerceToStringSlice(value)
+	if err != nil {
+		return false
+	}
+	for _, item := range values {
+		if strings.TrimSpace(item) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPluginSettingIssue(issues []PluginSettingIssue, name string) bool {
+	for _, issue := range issues {
+		if strings.EqualFold(issue.Field, "settings."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintPluginSteps reports the plugin steps of result whose plugin is unknown or whose
+// settings do not match its definition.
+func (s *Service) lintPluginSteps(ctx context.Context, result *spec.LintResult) error {
+	plugins, err := s.stepPlugins(ctx, result.Spec.Steps)
+	if err != nil {
+		return err
+	}
+	for _, step := range result.Spec.Steps {
+		if step.Plugin == "" {
+			continue
+		}
+		_, _, issues := resolvePluginStep(step, plugins)
+		for _, issue := range issues {
+			result.Add("steps."+step.Name+"."+issue.Field, result.StepLine(step.Name), spec.SeverityError, issue.Message)
+		}
+	}
+	return nil
+}
+
+// pluginStepError rejects a trigger whose plugin step does not match its definition, with the
+// same diagnostics the config would get when saved.
+func pluginStepError(step spec.StepSpec, issues []PluginSettingIssue) error {
+	diagnostics := make([]spec.Diagnostic, 0, len(issues))
+	for _, issue := range issues {
+		diagnostics = append(diagnostics, spec.Diagnostic{
+			Path:     "steps." + step.Name + "." + issue.Field,
+			Severity: spec.SeverityError,
+			Message:  issue.Message,
+		})
+	}
+	return &PipelineConfigError{Diagnostics: diagnostics}
+}
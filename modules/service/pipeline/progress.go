@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// maxRunningProgress caps the estimate of unfinished pipelines, which may still take longer
+// than their baselines suggest.
+const maxRunningProgress = 99
+
+// PipelineProgress estimates how far an unfinished pipeline is. ETA is the estimated number
+// of seconds left. A blocked pipeline waits for approval and keeps its progress until decided.
+type PipelineProgress struct {
+	Percent float64 `json:"percent"`
+	ETA     int64   `json:"eta"`
+	Blocked bool    `json:"blocked,omitempty"`
+}
+
+// EstimateProgress estimates the progress of a running or blocked pipeline from the median
+// duration of its steps at time now. Finished steps count their whole baseline, the running
+// step the share of its baseline already elapsed. Skipped steps, approval steps and steps
+// without a baseline are left out; matrix and retried steps match baselines by their own
+// name. It returns nil for other statuses and when no step has a baseline.
+func EstimateProgress(status model.StatusValue, steps []*model.Step, baselines map[string]*StepDurationBaseline, now int64) *PipelineProgress {
+	if status != model.StatusRunning && status != model.StatusBlocked {
+		return nil
+	}
+	var total, done, remaining int64
+	for _, step := range steps {
+		if step == nil || step.Type == model.StepTypeApproval || step.State == model.StatusSkipped {
+			continue
+		}
+		baseline := baselines[step.Name]
+		if baseline == nil || baseline.P50 <= 0 {
+			continue
+		}
+		expected := baseline.P50
+		total += expected
+		switch step.State {
+		case model.StatusSuccess, model.StatusFailure, model.StatusError, model.StatusKilled, model.StatusDeclined:
+			done += expected
+		case model.StatusRunning:
+			elapsed := int64(0)
+			if step.Started > 0 && now > step.Started {
+				elapsed = now - step.Started
+			}
+			if elapsed > expected {
+				elapsed = expected
+			}
+			done += elapsed
+			remaining += expected - elapsed
+		default:
+			remaining += expected
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	percent := float64(done) * 100 / float64(total)
+	if percent > maxRunningProgress {
+		percent = maxRunningProgress
+	}
+	return &PipelineProgress{
+		Percent: percent,
+		ETA:     remaining,
+		Blocked: status == model.StatusBlocked,
+	}
+}
+
+// PipelinesProgress estimates the progress of the running and blocked pipelines among
+// pipelines of repoID, keyed by pipeline id. Progress is computed on read and never stored.
+func (s *Service) PipelinesProgress(ctx context.Context, repoID int64, pipelines []*model.Pipeline) (map[int64]*PipelineProgress, error) {
+	ids := make([]int64, 0, len(pipelines))
+	statuses := make(map[int64]model.StatusValue, len(pipelines))
+	for _, pipeline := range pipelines {
+		if pipeline == nil || (pipeline.Status != model.StatusRunning && pipeline.Status != model.StatusBlocked) {
+			continue
+		}
+		ids = append(ids, pipeline.ID)
+		statuses[pipeline.ID] = pipeline.Status
+	}
+	result := make(map[int64]*PipelineProgress, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	baselines, err := s.StepDurationBaselines(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	if len(baselines) == 0 {
+		return result, nil
+	}
+	steps, err := s.store.ListPipelinesSteps(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byPipeline := make(map[int64][]*model.Step, len(ids))
+	for _, step := range steps {
+		byPipeline[step.PipelineID] = append(byPipeline[step.PipelineID], step)
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if progress := EstimateProgress(statuses[id], byPipeline[id], baselines, now); progress != nil {
+			result[id] = progress
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+func TestEstimateProgress(t *testing.T) {
+	const now = 10000
+	baselines := map[string]*StepDurationBaseline{
+		"build":         {P50: 60},
+		"test":          {P50: 120},
+		"deploy":        {P50: 20},
+		"test (go1.21)": {P50: 40},
+		"zero":          {P50: 0},
+	}
+	step := func(name string, state model.StatusValue, started int64) *model.Step {
+		return &model.Step{Name: name, State: state, Started: started}
+	}
+
+	cases := []struct {
+		name   string
+		status model.StatusValue
+		steps  []*model.Step
+		want   *PipelineProgress
+	}{
+		{
+			name:   "nothing started",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("build", model.StatusPending, 0), step("test", model.StatusPending, 0)},
+			want:   &PipelineProgress{Percent: 0, ETA: 180},
+		},
+		{
+			name:   "halfway through the running step",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("build", model.StatusSuccess, 0), step("test", model.StatusRunning, now-60), step("deploy", model.StatusPending, 0)},
+			want:   &PipelineProgress{Percent: 60, ETA: 80},
+		},
+		{
+			name:   "running step over its baseline counts as done",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("build", model.StatusRunning, now-600), step("deploy", model.StatusPending, 0)},
+			want:   &PipelineProgress{Percent: 75, ETA: 20},
+		},
+		{
+			name:   "clamped below 100 until finished",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("build", model.StatusSuccess, 0), step("test", model.StatusRunning, now-500)},
+			want:   &PipelineProgress{Percent: 99, ETA: 0},
+		},
+		{
+			name:   "skipped, approval and unknown steps leave the denominator",
+			status: model.StatusRunning,
+			steps: []*model.Step{
+				step("build", model.StatusSuccess, 0),
+				step("test", model.StatusSkipped, 0),
+				{Name: "deploy", State: model.StatusPending, Type: model.StepTypeApproval},
+				step("lint", model.StatusPending, 0),
+				step("zero", model.StatusPending, 0),
+				step("deploy", model.StatusPending, 0),
+			},
+			want: &PipelineProgress{Percent: 75, ETA: 20},
+		},
+		{
+			name:   "matrix steps use their own baseline",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("test (go1.21)", model.StatusSuccess, 0), step("test", model.StatusPending, 0)},
+			want:   &PipelineProgress{Percent: 25, ETA: 120},
+		},
+		{
+			name:   "blocked keeps its progress",
+			status: model.StatusBlocked,
+			steps:  []*model.Step{step("build", model.StatusSuccess, 0), step("test", model.StatusFailure, 0), step("deploy", model.StatusPending, 0)},
+			want:   &PipelineProgress{Percent: 90, ETA: 20, Blocked: true},
+		},
+		{
+			name:   "no baseline",
+			status: model.StatusRunning,
+			steps:  []*model.Step{step("lint", model.StatusRunning, now-5)},
+		},
+		{
+			name:   "finished pipeline",
+			status: model.StatusSuccess,
+			steps:  []*model.Step{step("build", model.StatusSuccess, 0)},
+		},
+		{
+			name:   "pending pipeline",
+			status: model.StatusPending,
+			steps:  []*model.Step{step("build", model.StatusPending, 0)},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := EstimateProgress(c.status, c.steps, baselines, now)
+			if c.want == nil {
+				if got != nil {
+					t.Fatalf("progress = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || *got != *c.want {
+				t.Fatalf("progress = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPipelinesProgress(t *testing.T) {
+	db := storetest.Open(t, &model.Pipeline{}, &model.Step{}, &model.StepStatistic{})
+	now := time.Now().Unix()
+	records := []any{
+		&model.StepStatistic{RepoID: 1, StepName: "build", P50: 100, Samples: []int64{90, 100, 110}},
+		// too few samples for a baseline
+		&model.StepStatistic{RepoID: 1, StepName: "test", P50: 50, Samples: []int64{50}},
+		&model.Step{PipelineID: 1, PID: 2, Name: "build", State: model.StatusRunning, Started: now - 50},
+		&model.Step{PipelineID: 1, PID: 3, Name: "test", State: model.StatusPending},
+		&model.Step{PipelineID: 2, PID: 2, Name: "build", State: model.StatusSuccess},
+		&model.Step{PipelineID: 3, PID: 2, Name: "test", State: model.StatusRunning, Started: now},
+	}
+	for _, record := range records {
+		mustCreate(t, db.GetDB(), record)
+	}
+	svc := NewService(db, nil, nil)
+
+	progress, err := svc.PipelinesProgress(context.Background(), 1, []*model.Pipeline{
+		{ID: 1, Status: model.StatusRunning},
+		{ID: 2, Status: model.StatusSuccess},
+		{ID: 3, Status: model.StatusRunning},
+	})
+	if err != nil {
+		t.Fatalf("PipelinesProgress: %v", err)
+	}
+	if len(progress) != 1 {
+		t.Fatalf("progress = %v, want only pipeline 1", progress)
+	}
+	got := progress[1]
+	if got == nil || got.Percent < 45 || got.Percent > 55 || got.ETA < 45 || got.ETA > 55 || got.Blocked {
+		t.Errorf("progress of pipeline 1 = %+v, want about half of build done", got)
+	}
+}
@@ -0,0 +1,411 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+const (
+	provenanceStatementType = "https://in-toto.io/Statement/v1"
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "https://github.com/thepenn/devsys/pipeline@v1"
+	// provenanceDigestTimeout bounds the best-effort image digest lookups.
+	provenanceDigestTimeout = 10 * time.Second
+)
+
+var (
+	ErrProvenanceDisabled         = errors.New("build provenance is not configured")
+	ErrProvenanceUnknownKey       = errors.New("unknown provenance key")
+	ErrProvenanceSignatureInvalid = errors.New("provenance signature is invalid")
+)
+
+// ProvenanceSigner signs provenance documents with the current ed25519 key and verifies
+// signatures made by it or by retired keys.
+type ProvenanceSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+	keys  map[string]ed25519.PublicKey
+}
+
+// NewProvenanceSigner decodes a base64 ed25519 private key (32 byte seed or 64 byte key).
+// verifyKeys lists retired public keys as key_id=base64 so old documents stay verifiable.
+func NewProvenanceSigner(encodedKey, keyID string, verifyKeys []string) (*ProvenanceSigner, error) {
+	keyID = strings.TrimSpace(keyID)
+	if keyID == "" {
+		return nil, fmt.Errorf("provenance key id is required")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil {
+		return nil, fmt.Errorf("decode provenance key: %w", err)
+	}
+	var key ed25519.PrivateKey
+	switch len(raw) {
+	case ed25519.SeedSize:
+		key = ed25519.NewKeyFromSeed(raw)
+	case ed25519.PrivateKeySize:
+		key = ed25519.PrivateKey(raw)
+	default:
+		return nil, fmt.Errorf("provenance key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+
+	signer := &ProvenanceSigner{
+		keyID: keyID,
+		key:   key,
+		keys:  map[string]ed25519.PublicKey{keyID: key.Public().(ed25519.PublicKey)},
+	}
+	for _, entry := range verifyKeys {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("provenance verify key %q must be key_id=base64", entry)
+		}
+		pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("decode provenance verify key %s: %w", id, err)
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("provenance verify key %s must be %d bytes", id, ed25519.PublicKeySize)
+		}
+		if _, exists := signer.keys[id]; exists {
+			continue
+		}
+		signer.keys[id] = ed25519.PublicKey(pub)
+	}
+	return signer, nil
+}
+
+// Sign returns the id of the signing key and the base64 signature over document.
+func (p *ProvenanceSigner) Sign(document []byte) (string, string) {
+	return p.keyID, base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, document))
+}
+
+// Verify checks a base64 signature over document made by the key keyID.
+func (p *ProvenanceSigner) Verify(keyID string, document []byte, signature string) error {
+	pub, ok := p.keys[strings.TrimSpace(keyID)]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrProvenanceUnknownKey, keyID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(pub, document, sig) {
+		return ErrProvenanceSignatureInvalid
+	}
+	return nil
+}
+
+// PublicKeys returns the base64 public keys accepted for verification keyed by key id.
+func (p *ProvenanceSigner) PublicKeys() map[string]string {
+	keys := make(map[string]string, len(p.keys))
+	for id, pub := range p.keys {
+		keys[id] = base64.StdEncoding.EncodeToString(pub)
+	}
+	return keys
+}
+
+// WithProvenance enables signed build provenance for successful pipelines.
+func WithProvenance(signer *ProvenanceSigner, builderID string) Option {
+	return func(s *Service) {
+		s.provenance = signer
+		s.provenanceBuilderID = strings.TrimSpace(builderID)
+	}
+}
+
+// provenanceStatement is an in-toto statement carrying a SLSA v1 provenance predicate.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition provenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      provenanceRunDetails      `json:"runDetails"`
+}
+
+type provenanceBuildDefinition struct {
+	BuildType            string                       `json:"buildType"`
+	ExternalParameters   provenanceExternalParameters `json:"externalParameters"`
+	InternalParameters   provenanceInternalParameters `json:"internalParameters"`
+	ResolvedDependencies []provenanceResource         `json:"resolvedDependencies"`
+}
+
+type provenanceExternalParameters struct {
+	Repository  string `json:"repository"`
+	Ref         string `json:"ref"`
+	Event       string `json:"event"`
+	TriggeredBy string `json:"triggeredBy"`
+	// Variables holds the names of the trigger variables; values are never recorded.
+	Variables []string `json:"variables,omitempty"`
+}
+
+type provenanceInternalParameters struct {
+	ConfigSHA256 string                    `json:"configSha256"`
+	Steps        []provenanceStepParameter `json:"steps"`
+}
+
+type provenanceStepParameter struct {
+	Name        string `json:"name"`
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+}
+
+type provenanceResource struct {
+	URI    string            `json:"uri"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type provenanceRunDetails struct {
+	Builder  provenanceBuilder  `json:"builder"`
+	Metadata provenanceMetadata `json:"metadata"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceMetadata struct {
+	InvocationID string `json:"invocationId"`
+	StartedOn    string `json:"startedOn,omitempty"`
+	FinishedOn   string `json:"finishedOn,omitempty"`
+}
+
+// provenanceStep is a step that ran in the pipeline with its best-effort image digest.
+type provenanceStep struct {
+	Name        string
+	Image       string
+	ImageDigest string
+}
+
+// provenanceInput is everything buildProvenance records. It must not carry secret values.
+type provenanceInput struct {
+	BuilderID    string
+	Repo         *model.Repo
+	Pipeline     *model.Pipeline
+	ConfigSHA256 string
+	Steps        []provenanceStep
+}
+
+// buildProvenance assembles the provenance document of a pipeline. The output only depends
+// on in, so equal inputs produce byte-identical documents. The subject is the built source
+// revision since pipelines do not declare their published artifacts.
+func buildProvenance(in provenanceInput) ([]byte, error) {
+	if in.Repo == nil || in.Pipeline == nil {
+		return nil, fmt.Errorf("provenance needs the repository and the pipeline")
+	}
+	repoURI := firstNonEmpty(in.Repo.ForgeURL, in.Repo.Clone, in.Repo.FullName)
+
+	variables := make([]string, 0, len(in.Pipeline.AdditionalVariables))
+	for name := range in.Pipeline.AdditionalVariables {
+		variables = append(variables, name)
+	}
+	sort.Strings(variables)
+
+	steps := make([]provenanceStepParameter, 0, len(in.Steps))
+	dependencies := []provenanceResource{{
+		URI:    "git+" + firstNonEmpty(in.Repo.Clone, repoURI),
+		Name:   in.Repo.FullName,
+		Digest: commitDigest(in.Pipeline.Commit),
+	}}
+	seenImages := make(map[string]struct{})
+	for _, step := range in.Steps {
+		steps = append(steps, provenanceStepParameter{
+			Name:        step.Name,
+			Image:       step.Image,
+			ImageDigest: step.ImageDigest,
+		})
+		image := strings.TrimSpace(step.Image)
+		if image == "" {
+			continue
+		}
+		if _, ok := seenImages[image]; ok {
+			continue
+		}
+		seenImages[image] = struct{}{}
+		resource := provenanceResource{URI: "docker://" + image}
+		if algorithm, value, ok := strings.Cut(step.ImageDigest, ":"); ok && value != "" {
+			resource.Digest = map[string]string{algorithm: value}
+		}
+		dependencies = append(dependencies, resource)
+	}
+	images := dependencies[1:]
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].URI < images[j].URI
+	})
+
+	statement := provenanceStatement{
+		Type: provenanceStatementType,
+		Subject: []provenanceSubject{{
+			Name:   firstNonEmpty(in.Repo.FullName, repoURI),
+			Digest: commitDigest(in.Pipeline.Commit),
+		}},
+		PredicateType: provenancePredicateType,
+		Predicate: provenancePredicate{
+			BuildDefinition: provenanceBuildDefinition{
+				BuildType: provenanceBuildType,
+				ExternalParameters: provenanceExternalParameters{
+					Repository:  repoURI,
+					Ref:         in.Pipeline.Ref,
+					Event:       string(in.Pipeline.Event),
+					TriggeredBy: in.Pipeline.Author,
+					Variables:   variables,
+				},
+				InternalParameters: provenanceInternalParameters{
+					ConfigSHA256: in.ConfigSHA256,
+					Steps:        steps,
+				},
+				ResolvedDependencies: dependencies,
+			},
+			RunDetails: provenanceRunDetails{
+				Builder: provenanceBuilder{ID: in.BuilderID},
+				Metadata: provenanceMetadata{
+					InvocationID: fmt.Sprintf("%s#%d", firstNonEmpty(in.Repo.FullName, repoURI), in.Pipeline.Number),
+					StartedOn:    provenanceTime(in.Pipeline.Started),
+					FinishedOn:   provenanceTime(in.Pipeline.Finished),
+				},
+			},
+		},
+	}
+	return json.Marshal(statement)
+}
+
+func commitDigest(commit string) map[string]string {
+	commit = strings.TrimSpace(commit)
+	if commit == "" {
+		return map[string]string{}
+	}
+	return map[string]string{"gitCommit": commit}
+}
+
+func provenanceTime(unix int64) string {
+	if unix <= 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// recordProvenance signs and stores the provenance of a successful pipeline. Failures are
+// logged and never fail the pipeline.
+func (s *Service) recordProvenance(ctx context.Context, repo *model.Repo, pipelineID int64, payload pipelineTaskPayload, stepRecords []model.Step) {
+	if s.provenance == nil {
+		return
+	}
+	pipeline, err := s.fetchPipeline(ctx, pipelineID)
+	if err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to load pipeline for provenance")
+		return
+	}
+
+	ran := make(map[int]bool, len(stepRecords))
+	for _, step := range stepRecords {
+		ran[step.PID] = step.State == model.StatusSuccess
+	}
+	steps := make([]provenanceStep, 0, len(payload.Steps))
+	for _, step := range payload.Steps {
+		if !ran[step.PID] {
+			continue
+		}
+		entry := provenanceStep{Name: step.Name, Image: step.Image}
+		if step.Runtime != spec.StepRuntimeHost {
+			entry.ImageDigest = s.imageDigest(ctx, step.Image)
+		}
+		steps = append(steps, entry)
+	}
+
+	builderID := s.provenanceBuilderID
+	if builderID == "" {
+		builderID = "devsys"
+	}
+	document, err := buildProvenance(provenanceInput{
+		BuilderID:    builderID,
+		Repo:         repo,
+		Pipeline:     pipeline,
+		ConfigSHA256: payload.ConfigSHA256,
+		Steps:        steps,
+	})
+	if err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to build provenance")
+		return
+	}
+	keyID, signature := s.provenance.Sign(document)
+	record := &model.PipelineProvenance{
+		PipelineID: pipelineID,
+		KeyID:      keyID,
+		Document:   document,
+		Signature:  signature,
+		Created:    time.Now().Unix(),
+	}
+	if err := s.store.SavePipelineProvenance(ctx, record); err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipelineID).Msg("failed to store provenance")
+	}
+}
+
+// imageDigest looks the digest of a step image up in the local docker daemon; an unknown
+// digest is recorded as empty.
+func (s *Service) imageDigest(ctx context.Context, image string) string {
+	if strings.TrimSpace(image) == "" {
+		return ""
+	}
+	runner, err := s.dockerRunner()
+	if err != nil || runner == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, provenanceDigestTimeout)
+	defer cancel()
+	digest, err := runner.ImageDigest(ctx, image)
+	if err != nil {
+		log.Debug().Err(err).Str("image", image).Msg("image digest unavailable for provenance")
+		return ""
+	}
+	return digest
+}
+
+// GetPipelineProvenance returns the provenance of a pipeline, or nil when none was recorded.
+func (s *Service) GetPipelineProvenance(ctx context.Context, repoID, pipelineID int64) (*model.PipelineProvenance, error) {
+	record, err := s.store.GetPipelineProvenance(ctx, repoID, pipelineID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// VerifyProvenance checks a detached signature over a provenance document.
+func (s *Service) VerifyProvenance(document []byte, keyID, signature string) error {
+	if s.provenance == nil {
+		return ErrProvenanceDisabled
+	}
+	return s.provenance.Verify(keyID, document, signature)
+}
+
+// ProvenancePublicKeys lists the public keys accepted for verification, nil when disabled.
+func (s *Service) ProvenancePublicKeys() map[string]string {
+	if s.provenance == nil {
+		return nil
+	}
+	return s.provenance.PublicKeys()
+}
@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thepenn/devsys/model"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata")
+
+func provenanceFixture() provenanceInput {
+	return provenanceInput{
+		BuilderID: "https://ci.example.com/devsys",
+		Repo: &model.Repo{
+			FullName: "team/app",
+			ForgeURL: "https://git.example.com/team/app",
+			Clone:    "https://git.example.com/team/app.git",
+		},
+		Pipeline: &model.Pipeline{
+			Number:   42,
+			Commit:   "0123456789abcdef0123456789abcdef01234567",
+			Ref:      "refs/heads/main",
+			Event:    model.EventPush,
+			Author:   "alice",
+			Started:  1700000000,
+			Finished: 1700000300,
+			AdditionalVariables: map[string]string{
+				"RELEASE_TOKEN": "do-not-record",
+				"DEPLOY_ENV":    "production",
+			},
+		},
+		ConfigSHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Steps: []provenanceStep{
+			{Name: "test", Image: "golang:1.22", ImageDigest: "sha256:aaaa"},
+			{Name: "lint", Image: "golang:1.22", ImageDigest: "sha256:aaaa"},
+			{Name: "build", Image: "docker:24", ImageDigest: "sha256:bbbb"},
+			{Name: "notify", Image: "alpine:3.19"},
+			{Name: "script"},
+		},
+	}
+}
+
+func TestBuildProvenanceGolden(t *testing.T) {
+	document, err := buildProvenance(provenanceFixture())
+	if err != nil {
+		t.Fatalf("buildProvenance: %v", err)
+	}
+	var got bytes.Buffer
+	if err := json.Indent(&got, document, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteByte('\n')
+
+	golden := filepath.Join("testdata", "provenance.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("read golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("provenance differs from %s:\n%s", golden, got.String())
+	}
+	if bytes.Contains(document, []byte("do-not-record")) || bytes.Contains(document, []byte("production")) {
+		t.Errorf("provenance records variable values:\n%s", document)
+	}
+}
+
+func TestBuildProvenanceIsDeterministic(t *testing.T) {
+	first, err := buildProvenance(provenanceFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the random map iteration order of the variables must not leak into the document
+	for i := 0; i < 20; i++ {
+		again, err := buildProvenance(provenanceFixture())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, again) {
+			t.Fatalf("equal inputs produced different documents:\n%s\n%s", first, again)
+		}
+	}
+}
+
+func TestBuildProvenanceNeedsRepoAndPipeline(t *testing.T) {
+	in := provenanceFixture()
+	in.Pipeline = nil
+	if _, err := buildProvenance(in); err == nil {
+		t.Errorf("buildProvenance without a pipeline succeeded")
+	}
+	in = provenanceFixture()
+	in.Repo = nil
+	if _, err := buildProvenance(in); err == nil {
+		t.Errorf("buildProvenance without a repository succeeded")
+	}
+}
+
+func newTestSigner(t *testing.T, seed byte, keyID string, verifyKeys ...string) (*ProvenanceSigner, ed25519.PublicKey) {
+	t.Helper()
+	raw := bytes.Repeat([]byte{seed}, ed25519.SeedSize)
+	signer, err := NewProvenanceSigner(base64.StdEncoding.EncodeToString(raw), keyID, verifyKeys)
+	if err != nil {
+		t.Fatalf("NewProvenanceSigner: %v", err)
+	}
+	return signer, ed25519.NewKeyFromSeed(raw).Public().(ed25519.PublicKey)
+}
+
+func TestProvenanceSignerRotation(t *testing.T) {
+	document, err := buildProvenance(provenanceFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, oldPub := newTestSigner(t, 1, "2023")
+	oldID, oldSig := old.Sign(document)
+	if oldID != "2023" {
+		t.Fatalf("key id = %q, want 2023", oldID)
+	}
+
+	current, _ := newTestSigner(t, 2, "2024", "2023="+base64.StdEncoding.EncodeToString(oldPub))
+	keyID, sig := current.Sign(document)
+	if keyID != "2024" {
+		t.Fatalf("key id = %q, want 2024", keyID)
+	}
+	if err := current.Verify(keyID, document, sig); err != nil {
+		t.Errorf("Verify with the current key: %v", err)
+	}
+	if err := current.Verify(oldID, document, oldSig); err != nil {
+		t.Errorf("Verify with the retired key: %v", err)
+	}
+	if keys := current.PublicKeys(); len(keys) != 2 || keys["2023"] == "" || keys["2024"] == "" {
+		t.Errorf("PublicKeys = %v, want the current and the retired key", keys)
+	}
+
+	if err := old.Verify("2024", document, sig); !errors.Is(err, ErrProvenanceUnknownKey) {
+		t.Errorf("Verify with a key the signer does not know = %v, want ErrProvenanceUnknownKey", err)
+	}
+	tampered := bytes.Replace(document, []byte("alice"), []byte("mallory"), 1)
+	if err := current.Verify(keyID, tampered, sig); !errors.Is(err, ErrProvenanceSignatureInvalid) {
+		t.Errorf("Verify of a tampered document = %v, want ErrProvenanceSignatureInvalid", err)
+	}
+	if err := current.Verify(oldID, document, sig); !errors.Is(err, ErrProvenanceSignatureInvalid) {
+		t.Errorf("Verify under the wrong key = %v, want ErrProvenanceSignatureInvalid", err)
+	}
+}
+
+func TestNewProvenanceSignerRejectsBadKeys(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	cases := map[string]struct {
+		key, keyID string
+		verifyKeys []string
+	}{
+		"missing key id":        {key: seed},
+		"not base64":            {key: "not base64!", keyID: "k"},
+		"short key":             {key: base64.StdEncoding.EncodeToString([]byte("short")), keyID: "k"},
+		"verify key without id": {key: seed, keyID: "k", verifyKeys: []string{"=" + seed}},
+		"short verify key":      {key: seed, keyID: "k", verifyKeys: []string{"old=" + base64.StdEncoding.EncodeToString([]byte("short"))}},
+	}
+	for name, c := range cases {
+		if _, err := NewProvenanceSigner(c.key, c.keyID, c.verifyKeys); err == nil {
+			t.Errorf("%s: NewProvenanceSigner succeeded", name)
+		}
+	}
+	if _, err := NewProvenanceSigner(seed, "k", []string{"", "  "}); err != nil {
+		t.Errorf("blank verify keys: %v", err)
+	}
+}
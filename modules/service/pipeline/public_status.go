@@ -0,0 +1,31 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// PublicStatusSettings returns the pipeline settings of a repository that serves the status
+// of its runs without authentication, nil when the repository does not exist or keeps its
+// status private.
+func (s *Service) PublicStatusSettings(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
+	cfg, err := s.store.GetPublicPipelineConfig(ctx, repoID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// settings may outlive a deleted repository
+	if _, err := s.fetchRepo(ctx, repoID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// queuedTask is a task waiting in the queue. seq orders tasks of equal priority by
+// enqueue time.
+type queuedTask struct {
+	task  *model.Task
+	seq   uint64
+	index int
+}
+
+// readyHeap orders the tasks that may run now by priority, highest first, then by
+// enqueue order.
+type readyHeap []*queuedTask
+
+func (h readyHeap) Len() int { return len(h) }
+
+func (h readyHeap) Less(i, j int) bool {
+	if h[i].task.Priority != h[j].task.Priority {
+		return h[i].task.Priority > h[j].task.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h readyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *readyHeap) Push(x any) {
+	item := x.(*queuedTask)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *readyHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// readyOrder sorts a copy of a readyHeap without touching the heap indexes.
+type readyOrder struct{ readyHeap }
+
+func (o readyOrder) Swap(i, j int) { o.readyHeap[i], o.readyHeap[j] = o.readyHeap[j], o.readyHeap[i] }
+
+// delayedHeap orders the tasks held back until their RunAfter, earliest first.
+type delayedHeap []*queuedTask
+
+func (h delayedHeap) Len() int { return len(h) }
+
+func (h delayedHeap) Less(i, j int) bool {
+	if h[i].task.RunAfter != h[j].task.RunAfter {
+		return h[i].task.RunAfter < h[j].task.RunAfter
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h delayedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayedHeap) Push(x any) { *h = append(*h, x.(*queuedTask)) }
+
+func (h *delayedHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// promote moves the delayed tasks due at now to ready and returns when the next delayed
+// task matures, or the zero time when none is left.
+func promote(ready *readyHeap, delayed *delayedHeap, now time.Time) time.Time {
+	for delayed.Len() > 0 {
+		next := (*delayed)[0]
+		due := time.Unix(next.task.RunAfter, 0)
+		if due.After(now) {
+			return due
+		}
+		heap.Pop(delayed)
+		heap.Push(ready, next)
+	}
+	return time.Time{}
+}
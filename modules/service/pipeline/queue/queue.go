@@ -1,11 +1,14 @@
 package queue
 
 import (
+	"container/heap"
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -21,32 +24,58 @@ var (
 	ErrInvalidWorkerCount = errors.New("worker count must be greater than zero")
 )
 
+// drainPollInterval is how often Drain checks for in-flight tasks.
+const drainPollInterval = 200 * time.Millisecond
+
 // Executor defines the signature for processing tasks pulled from the queue.
 type Executor func(context.Context, *model.Task) error
 
 // Stats provides insight into the current queue state.
 type Stats struct {
-	Running       bool
-	Workers       int
-	Pending       int
-	InFlight      int
+	Running bool
+	Paused  bool
+	Workers int
+	// Pending counts the tasks that may start now; Delayed those held back until their RunAfter.
+	Pending  int
+	Delayed  int
+	InFlight int
+	// Parked counts tasks workers took from the queue and hold until it is resumed.
+	Parked        int
 	EnqueuedTotal uint64
 	Processed     uint64
 }
 
-// PipelineQueue handles asynchronous task dispatch for pipelines.
+// PipelineQueue handles asynchronous task dispatch for pipelines. Tasks start by priority,
+// highest first, and in enqueue order within a priority; tasks with a RunAfter in the future
+// are held back until then.
 type PipelineQueue struct {
-	tasks   chan *model.Task
+	// tasks hands the next task from the dispatcher to a worker.
+	tasks chan *model.Task
+	// slots bounds the number of queued tasks to the capacity.
+	slots      chan struct{}
+	wake       chan struct{}
+	dispatched chan struct{}
+
+	mu      sync.Mutex
+	ready   readyHeap
+	delayed delayedHeap
+	seq     uint64
+
 	ctx     context.Context
 	cancel  context.CancelFunc
 	wg      sync.WaitGroup
 	started atomic.Bool
 	closed  atomic.Bool
 
+	pauseMu sync.Mutex
+	paused  bool
+	resumed chan struct{}
+
 	enqueueCount   atomic.Uint64
 	processedCount atomic.Uint64
 	workerCount    atomic.Int32
 	inflight       atomic.Int32
+	parked         atomic.Int32
 }
 
 // New creates a queue with the provided capacity.
@@ -56,13 +85,17 @@ func New(capacity int) *PipelineQueue {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &PipelineQueue{
-		tasks:  make(chan *model.Task, capacity),
-		ctx:    ctx,
-		cancel: cancel,
+		tasks:      make(chan *model.Task),
+		slots:      make(chan struct{}, capacity),
+		wake:       make(chan struct{}, 1),
+		dispatched: make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 }
 
-// Start launches worker goroutines that pull tasks from the queue.
+// Start launches worker goroutines that pull tasks from the queue. Cancelling parent pauses
+// the queue so running tasks can finish; Shutdown stops it.
 func (q *PipelineQueue) Start(parent context.Context, workers int, executor Executor) error {
 	if workers <= 0 {
 		return ErrInvalidWorkerCount
@@ -77,11 +110,12 @@ func (q *PipelineQueue) Start(parent context.Context, workers int, executor Exec
 	go func() {
 		select {
 		case <-parent.Done():
-			q.Shutdown()
+			q.Pause()
 		case <-q.ctx.Done():
 		}
 	}()
 
+	go q.dispatch()
 	for i := 0; i < workers; i++ {
 		q.wg.Add(1)
 		go q.worker(i+1, executor)
@@ -92,7 +126,8 @@ func (q *PipelineQueue) Start(parent context.Context, workers int, executor Exec
 	return nil
 }
 
-// Enqueue adds a task to the queue for asynchronous processing.
+// Enqueue adds a task to the queue for asynchronous processing. It blocks while the queue
+// holds as many tasks as its capacity.
 func (q *PipelineQueue) Enqueue(ctx context.Context, task *model.Task) error {
 	if task == nil {
 		return fmt.Errorf("queue: task is nil")
@@ -109,39 +144,196 @@ func (q *PipelineQueue) Enqueue(ctx context.Context, task *model.Task) error {
 		return ErrQueueClosed
 	case <-ctx.Done():
 		return ctx.Err()
-	case q.tasks <- task:
-		q.enqueueCount.Add(1)
-		return nil
+	case q.slots <- struct{}{}:
+	}
+
+	q.mu.Lock()
+	q.seq++
+	item := &queuedTask{task: task, seq: q.seq}
+	if task.RunAfter > time.Now().Unix() {
+		heap.Push(&q.delayed, item)
+	} else {
+		heap.Push(&q.ready, item)
 	}
+	q.mu.Unlock()
+	q.enqueueCount.Add(1)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the queued tasks in the order they will start: the tasks that may start
+// now, then the delayed ones by RunAfter.
+func (q *PipelineQueue) Pending() []model.Task {
+	q.mu.Lock()
+	ready := append(readyHeap{}, q.ready...)
+	delayed := append(delayedHeap{}, q.delayed...)
+	q.mu.Unlock()
+
+	tasks := make([]model.Task, 0, len(ready)+len(delayed))
+	sort.Sort(readyOrder{ready})
+	for _, item := range ready {
+		tasks = append(tasks, *item.task)
+	}
+	sort.Sort(delayed)
+	for _, item := range delayed {
+		tasks = append(tasks, *item.task)
+	}
+	return tasks
 }
 
 // Stats returns queue statistics.
 func (q *PipelineQueue) Stats() Stats {
+	q.mu.Lock()
+	pending, delayed := q.ready.Len(), q.delayed.Len()
+	q.mu.Unlock()
 	return Stats{
 		Running:       q.started.Load() && !q.closed.Load(),
+		Paused:        q.Paused(),
 		Workers:       int(q.workerCount.Load()),
-		Pending:       len(q.tasks),
+		Pending:       pending,
+		Delayed:       delayed,
 		InFlight:      int(q.inflight.Load()),
+		Parked:        int(q.parked.Load()),
 		EnqueuedTotal: q.enqueueCount.Load(),
 		Processed:     q.processedCount.Load(),
 	}
 }
 
+// Pause stops workers from starting new tasks; running tasks continue. Tasks stay queued
+// until Resume.
+func (q *PipelineQueue) Pause() {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+	if q.paused {
+		return
+	}
+	q.paused = true
+	q.resumed = make(chan struct{})
+	log.Info().Msg("pipeline queue paused")
+}
+
+// Resume lets workers start tasks again.
+func (q *PipelineQueue) Resume() {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+	if !q.paused {
+		return
+	}
+	q.paused = false
+	close(q.resumed)
+	log.Info().Msg("pipeline queue resumed")
+}
+
+// Paused reports whether the queue is paused.
+func (q *PipelineQueue) Paused() bool {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+	return q.paused
+}
+
+// Drain waits until no task is running or ctx is done. It does not pause the queue, so
+// callers pause first to wait for an idle queue.
+func (q *PipelineQueue) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for q.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// waitResumed blocks while the queue is paused and reports whether it was resumed rather
+// than stopped.
+func (q *PipelineQueue) waitResumed() bool {
+	q.pauseMu.Lock()
+	paused, resumed := q.paused, q.resumed
+	q.pauseMu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-q.ctx.Done():
+		return false
+	}
+}
+
 // Shutdown stops workers gracefully. It is safe to call multiple times.
 func (q *PipelineQueue) Shutdown() {
 	if q.closed.CompareAndSwap(false, true) {
 		q.cancel()
+		if q.started.Load() {
+			<-q.dispatched
+		}
 		close(q.tasks)
 		q.wg.Wait()
 		log.Info().Msg("pipeline queue stopped")
 	}
 }
 
+// dispatch offers the first ready task to the workers until one takes it, starting over when
+// a task is enqueued or a delayed task matures in the meantime.
+func (q *PipelineQueue) dispatch() {
+	defer close(q.dispatched)
+	for {
+		q.mu.Lock()
+		due := promote(&q.ready, &q.delayed, time.Now())
+		var next *queuedTask
+		var out chan *model.Task
+		if q.ready.Len() > 0 {
+			next, out = q.ready[0], q.tasks
+		}
+		q.mu.Unlock()
+
+		var matured <-chan time.Time
+		var timer *time.Timer
+		if !due.IsZero() {
+			timer = time.NewTimer(time.Until(due))
+			matured = timer.C
+		}
+		var task *model.Task
+		if next != nil {
+			task = next.task
+		}
+
+		select {
+		case out <- task:
+			q.mu.Lock()
+			heap.Remove(&q.ready, next.index)
+			q.mu.Unlock()
+			<-q.slots
+		case <-q.wake:
+		case <-matured:
+		case <-q.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
 func (q *PipelineQueue) worker(id int, executor Executor) {
 	defer q.wg.Done()
 	workerLogger := log.With().Int("worker", id).Logger()
 
 	for {
+		if !q.waitResumed() {
+			workerLogger.Debug().Msg("worker context canceled")
+			return
+		}
 		select {
 		case <-q.ctx.Done():
 			workerLogger.Debug().Msg("worker context canceled")
@@ -154,6 +346,13 @@ func (q *PipelineQueue) worker(id int, executor Executor) {
 			if task == nil {
 				continue
 			}
+			// the queue may have been paused while this worker waited for a task
+			q.parked.Add(1)
+			resumed := q.waitResumed()
+			q.parked.Add(-1)
+			if !resumed {
+				return
+			}
 
 			q.inflight.Add(1)
 			if err := executor(q.ctx, task); err != nil {
@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// defaultShutdownGracePeriod is how long Shutdown waits for running tasks by default.
+const defaultShutdownGracePeriod = 5 * time.Minute
+
+// WithShutdownGracePeriod sets how long Shutdown waits for running tasks before stopping
+// the workers; 0 stops them right away.
+func WithShutdownGracePeriod(period time.Duration) Option {
+	return func(s *Service) {
+		if period >= 0 {
+			s.shutdownGrace = period
+		}
+	}
+}
+
+// PauseQueue stops workers from starting queued tasks, for maintenance. Running tasks finish.
+func (s *Service) PauseQueue() error {
+	if s.queue == nil {
+		return s.queueUnavailableError()
+	}
+	s.queue.Pause()
+	return nil
+}
+
+// ResumeQueue starts the tasks held by PauseQueue.
+func (s *Service) ResumeQueue() error {
+	if s.queue == nil {
+		return s.queueUnavailableError()
+	}
+	s.queue.Resume()
+	return nil
+}
+
+// DrainQueue waits until no task is running or ctx is done.
+func (s *Service) DrainQueue(ctx context.Context) error {
+	if s.queue == nil {
+		return s.queueUnavailableError()
+	}
+	return s.queue.Drain(ctx)
+}
+
+// drainQueue pauses the queue and waits up to the shutdown grace period for running tasks,
+// so a restart does not kill builds in the middle of a step.
+func (s *Service) drainQueue() {
+	if s.queue == nil || s.shutdownGrace <= 0 {
+		return
+	}
+	s.queue.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownGrace)
+	defer cancel()
+	if err := s.queue.Drain(ctx); err != nil {
+		log.Warn().Int("running", s.queue.Stats().InFlight).Dur("grace_period", s.shutdownGrace).
+			Msg("pipeline tasks still running after the shutdown grace period")
+	}
+}
+
+// pipelineNumbers maps the pipelines of tasks to their run numbers.
+func (s *Service) pipelineNumbers(ctx context.Context, tasks []model.Task) (map[int64]int64, error) {
+	numbers := make(map[int64]int64, len(tasks))
+	if len(tasks) == 0 || s.store == nil {
+		return numbers, nil
+	}
+	ids := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.PipelineID)
+	}
+	return s.store.PipelineNumbers(ctx, ids)
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// recoverTasks re-enqueues the persisted tasks of pipelines that were pending or running
+// when the server stopped. Running pipelines lost their execution, so they are reset to
+// pending first and their interrupted steps run again; finished steps are kept. Blocked
+// pipelines are left alone: their task is enqueued once the approval resolves.
+func (s *Service) recoverTasks(ctx context.Context) {
+	tasks, err := s.store.ListRecoverableTasks(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load pipeline tasks for recovery")
+		return
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	recovered := 0
+	for _, task := range tasks {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.recoverTask(ctx, task); err != nil {
+			log.Error().Err(err).Str("task_id", task.ID).Int64("pipeline_id", task.PipelineID).Msg("failed to recover pipeline task")
+			continue
+		}
+		recovered++
+	}
+	log.Info().Int("tasks", recovered).Msg("recovered pipeline tasks after restart")
+}
+
+func (s *Service) recoverTask(ctx context.Context, task *model.Task) error {
+	status, err := s.getPipelineStatus(ctx, task.PipelineID)
+	if err != nil {
+		return err
+	}
+	if status == model.StatusRunning {
+		if err := s.store.ResetPipeline(ctx, task.PipelineID, time.Now().Unix()); err != nil {
+			if errors.Is(err, ErrIllegalTransition) {
+				// finished or blocked while recovery was starting
+				return nil
+			}
+			return err
+		}
+		log.Warn().Int64("pipeline_id", task.PipelineID).Msg("pipeline interrupted by restart, requeued")
+	}
+	return s.EnqueueTask(ctx, task)
+}
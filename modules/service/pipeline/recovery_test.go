@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+func TestRecoverTasksAfterRestart(t *testing.T) {
+	_, fake, task := newFakeRun(t, hostStep("first", "echo first-output"), hostStep("second", "echo second-output"))
+	// what a process killed during the second step leaves behind
+	started := time.Now().Add(-time.Minute).Unix()
+	fake.pipelines[1].Status = model.StatusRunning
+	fake.pipelines[1].Started = started
+	fake.workflows[1].State = model.StatusRunning
+	fake.steps[1].State = model.StatusSuccess
+	fake.steps[1].Started = started
+	fake.steps[1].Finished = started + 1
+	fake.steps[2].State = model.StatusRunning
+	fake.steps[2].Started = started + 1
+	fake.logs = append(fake.logs,
+		model.LogEntry{ID: 1000, StepID: 1, Line: 1, Data: []byte("first-output")},
+		model.LogEntry{ID: 1001, StepID: 2, Line: 1, Data: []byte("interrupted")},
+	)
+	// a queued run that never started and one waiting for an approval
+	fake.pipelines[2] = &model.Pipeline{ID: 2, RepoID: 1, Number: 2, Status: model.StatusPending}
+	fake.tasks["task-2"] = &model.Task{ID: "task-2", PipelineID: 2, RepoID: 1}
+	fake.pipelines[3] = &model.Pipeline{ID: 3, RepoID: 1, Number: 3, Status: model.StatusBlocked}
+	fake.tasks["task-3"] = &model.Task{ID: "task-3", PipelineID: 3, RepoID: 1}
+
+	restarted := NewService(nil, nil, nil)
+	restarted.store = fake
+	enqueued := make(chan *model.Task, 4)
+	q := queue.New(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := q.Start(ctx, 1, func(_ context.Context, task *model.Task) error {
+		enqueued <- task
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Shutdown)
+	restarted.queue = q
+
+	restarted.recoverTasks(ctx)
+
+	var ids []string
+	for len(ids) < 2 {
+		select {
+		case got := <-enqueued:
+			ids = append(ids, got.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("enqueued %v, want the tasks of pipelines 1 and 2", ids)
+		}
+	}
+	if strings.Join(ids, ",") != "task-1,task-2" {
+		t.Fatalf("enqueued %v, want task-1,task-2 in pipeline order", ids)
+	}
+	select {
+	case got := <-enqueued:
+		t.Fatalf("task %s of the blocked pipeline was enqueued", got.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if got := fake.pipeline(1); got.Status != model.StatusPending {
+		t.Fatalf("interrupted pipeline = %s, want reset to pending\n%s", got.Status, fake)
+	}
+	if got := fake.step(1); got.State != model.StatusSuccess {
+		t.Errorf("finished step = %s, want it kept", got.State)
+	}
+	if got := fake.step(2); got.State != model.StatusPending || got.Started != 0 {
+		t.Errorf("interrupted step = %s started %d, want pending", got.State, got.Started)
+	}
+	if fake.workflows[1].State != model.StatusPending {
+		t.Errorf("workflow = %s, want pending", fake.workflows[1].State)
+	}
+	if got := fake.pipeline(2); got.Status != model.StatusPending {
+		t.Errorf("queued pipeline = %s, want it untouched", got.Status)
+	}
+	if got := fake.pipeline(3); got.Status != model.StatusBlocked || !fake.hasTask("task-3") {
+		t.Errorf("blocked pipeline = %s, want it left waiting with its task", got.Status)
+	}
+
+	// the restarted service finishes the run, only executing the interrupted step again
+	if err := restarted.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask of the recovered task: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusSuccess {
+		t.Fatalf("recovered pipeline = %s, want success\n%s", got.Status, fake)
+	}
+	if got := fake.step(2); got.State != model.StatusSuccess || !strings.Contains(fake.logText(2), "second-output") {
+		t.Errorf("interrupted step = %s with log %q, want it run again", got.State, fake.logText(2))
+	}
+	if n := strings.Count(fake.logText(1), "first-output"); n != 1 {
+		t.Errorf("finished step wrote its output %d times, want it not run again", n)
+	}
+	if fake.hasTask(task.ID) {
+		t.Errorf("task of the recovered pipeline was kept")
+	}
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+const (
+	refHeadsPrefix = "refs/heads/"
+	refTagsPrefix  = "refs/tags/"
+)
+
+// normalizePipelineRef returns the full ref a pipeline is triggered for. Names without the
+// refs/ prefix are tags, so "v1.2.3" becomes refs/tags/v1.2.3.
+func normalizePipelineRef(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return refTagsPrefix + ref
+}
+
+// branchFromRef returns the branch of a refs/heads/ ref, empty for other refs.
+func branchFromRef(ref string) string {
+	if branch, ok := strings.CutPrefix(strings.TrimSpace(ref), refHeadsPrefix); ok {
+		return branch
+	}
+	return ""
+}
+
+// tagFromRef returns the tag of a refs/tags/ ref, empty for other refs.
+func tagFromRef(ref string) string {
+	if tag, ok := strings.CutPrefix(strings.TrimSpace(ref), refTagsPrefix); ok {
+		return tag
+	}
+	return ""
+}
+
+// refName returns the short name of a branch or tag ref and other refs unchanged.
+func refName(ref string) string {
+	return firstNonEmpty(branchFromRef(ref), tagFromRef(ref), ref)
+}
+
+func newPipelineStepConditions(conditions *spec.StepConditions) *pipelineStepConditions {
+	if conditions == nil || (len(conditions.Branches) == 0 && len(conditions.Tags) == 0 && len(conditions.Paths) == 0) {
+		return nil
+	}
+	return &pipelineStepConditions{
+		Branches: append([]string{}, conditions.Branches...),
+		Tags:     append([]string{}, conditions.Tags...),
+		Paths:    append([]string{}, conditions.Paths...),
+	}
+}
@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+
+	pipelineruntime "github.com/thepenn/devsys/service/pipeline/runtime"
+)
+
+// dockerHubRegistry is the registry of images without a registry host, like golang:1.22.
+const dockerHubRegistry = "docker.io"
+
+// registryAuthForImage returns the credentials of the docker certificate bound to the step
+// whose repo points at the registry of image, or nil to pull anonymously. A certificate
+// without repo counts as a Docker Hub login.
+func registryAuthForImage(image string, secrets map[string]resolvedSecretBinding) *pipelineruntime.RegistryAuth {
+	host := imageRegistryHost(image)
+	if host == "" {
+		return nil
+	}
+	// map order is random; sorted aliases keep the choice stable between runs
+	aliases := make([]string, 0, len(secrets))
+	for alias := range secrets {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		binding := secrets[alias]
+		if !strings.EqualFold(binding.Type, "docker") {
+			continue
+		}
+		registry := firstNonEmpty(binding.Values["docker.registry"], binding.Values["docker.repo"])
+		if registryHost(registry) != host {
+			continue
+		}
+		auth := &pipelineruntime.RegistryAuth{
+			Username:      binding.Values["docker.username"],
+			Password:      binding.Values["docker.password"],
+			ServerAddress: host,
+		}
+		if host == dockerHubRegistry {
+			auth.ServerAddress = "https://index.docker.io/v1/"
+		}
+		return auth
+	}
+	return nil
+}
+
+// imageRegistryHost returns the registry host of an image reference, docker.io for
+// Docker Hub images.
+func imageRegistryHost(image string) string {
+	named, err := reference.ParseNormalizedNamed(strings.TrimSpace(image))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(reference.Domain(named))
+}
+
+// registryHost extracts the host of the repo of a docker certificate, which may be a bare
+// host, a host with a namespace, a URL or a Docker Hub namespace.
+func registryHost(repo string) string {
+	repo = strings.TrimSpace(repo)
+	if repo == "" {
+		return dockerHubRegistry
+	}
+	if strings.Contains(repo, "://") {
+		if parsed, err := url.Parse(repo); err == nil {
+			repo = parsed.Host
+		}
+	}
+	host, _, _ := strings.Cut(repo, "/")
+	host = strings.ToLower(host)
+	// same rule as image references: a first segment without . or : is a namespace
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubRegistry
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubRegistry
+	}
+	return host
+}
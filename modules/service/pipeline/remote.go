@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// lsRemoteTimeout bounds the `git ls-remote` checking that an imported repository is reachable.
+const lsRemoteTimeout = 30 * time.Second
+
+// repoCloneCredentials returns the clone URL carrying the credentials of the certificate bound
+// to an imported repository, or its ssh key for ssh clone URLs. secret is the password to
+// mask in logs.
+func (s *Service) repoCloneCredentials(ctx context.Context, repo *model.Repo) (cloneURL string, sshKey *model.SSHCertificate, secret string, err error) {
+	cloneURL = strings.TrimSpace(firstNonEmpty(repo.Clone, repo.CloneSSH))
+	if repo.CertificateID == 0 {
+		return cloneURL, nil, "", nil
+	}
+	if s.systemSvc == nil {
+		return "", nil, "", fmt.Errorf("system service unavailable")
+	}
+	cert, err := s.systemSvc.GetCertificateWithSecrets(s.repoScope(ctx, repo), repo.CertificateID)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("读取仓库凭证 %d 失败: %w", repo.CertificateID, err)
+	}
+	if cert == nil {
+		return "", nil, "", fmt.Errorf("仓库凭证 %d 不存在", repo.CertificateID)
+	}
+	switch strings.ToLower(cert.Type) {
+	case "git":
+		if !cloneSupportsCredentials(cloneURL) {
+			return "", nil, "", fmt.Errorf("git 凭证 %s 只能用于 http(s) 克隆地址", cert.Name)
+		}
+		gitCert, err := cert.AsGitCertificate()
+		if err != nil {
+			return "", nil, "", err
+		}
+		authURL, err := gitCredentialURL(cloneURL, gitCert)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("git 凭证 %s: %w", cert.Name, err)
+		}
+		return authURL, nil, gitCert.Password, nil
+	case model.CertificateTypeSSH:
+		if !isSSHCloneURL(cloneURL) {
+			return "", nil, "", fmt.Errorf("SSH 凭证 %s 只能用于 SSH 克隆地址", cert.Name)
+		}
+		key, err := cert.AsSSHCertificate()
+		if err != nil {
+			return "", nil, "", err
+		}
+		return cloneURL, key, "", nil
+	default:
+		return "", nil, "", fmt.Errorf("凭证 %s 的类型 %s 不能用于克隆仓库", cert.Name, cert.Type)
+	}
+}
+
+// gitCredentialURL returns cloneURL carrying the credentials of cert. The credentials are only
+// added for clone URLs on the host cert is bound to, so a clone URL chosen by whoever binds
+// the certificate cannot send them elsewhere.
+func gitCredentialURL(cloneURL string, cert *model.GitCertificate) (string, error) {
+	host := strings.ToLower(strings.TrimSpace(cert.Host))
+	if host == "" {
+		return "", fmt.Errorf("未绑定主机，不能用于克隆")
+	}
+	parsed, err := url.Parse(strings.TrimSpace(cloneURL))
+	if err != nil {
+		return "", err
+	}
+	// a bound host without a port matches the clone URL on any port
+	target := strings.ToLower(parsed.Host)
+	if !strings.Contains(host, ":") {
+		target = strings.ToLower(parsed.Hostname())
+	}
+	if target != host {
+		return "", fmt.Errorf("绑定的主机 %s 与克隆地址的主机 %s 不符", cert.Host, parsed.Hostname())
+	}
+	return addCredentialsToURL(cloneURL, cert.Username, cert.Password)
+}
+
+// ListRemoteBranches runs `git ls-remote` against the clone URL of repo with its bound
+// certificate, returning the branches of the remote and the branch HEAD points at, which is
+// empty for a repository without commits.
+func (s *Service) ListRemoteBranches(ctx context.Context, repo *model.Repo) ([]string, string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, "", errGitUnavailable
+	}
+	cloneURL, sshKey, _, err := s.repoCloneCredentials(ctx, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	if cloneURL == "" {
+		return nil, "", fmt.Errorf("仓库克隆地址缺失")
+	}
+	env := append(s.hostEnvList(), "GIT_TERMINAL_PROMPT=0")
+	if sshKey != nil {
+		command, cleanup, err := writeSSHCloneKey(sshKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("准备 SSH 部署密钥失败: %w", err)
+		}
+		defer cleanup()
+		env = append(env, "GIT_SSH_COMMAND="+command)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lsRemoteTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--symref", cloneURL, "HEAD", "refs/heads/*")
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, "", fmt.Errorf("git ls-remote 超时")
+		}
+		// git echoes the remote in errors; keep the credentials out of them
+		detail := strings.ReplaceAll(strings.TrimSpace(stderr.String()), cloneURL, maskCloneURL(cloneURL))
+		if detail == "" {
+			detail = err.Error()
+		}
+		return nil, "", fmt.Errorf("git ls-remote 失败: %s", detail)
+	}
+	branches, head := parseLsRemote(stdout.String())
+	return branches, head, nil
+}
+
+// parseLsRemote reads the branches and the symbolic HEAD of `git ls-remote --symref` output.
+func parseLsRemote(output string) ([]string, string) {
+	var branches []string
+	head := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD":
+			head = strings.TrimPrefix(fields[1], refHeadsPrefix)
+		case len(fields) == 2 && strings.HasPrefix(fields[1], refHeadsPrefix):
+			branches = append(branches, strings.TrimPrefix(fields[1], refHeadsPrefix))
+		}
+	}
+	return branches, head
+}
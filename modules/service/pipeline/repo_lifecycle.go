@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// unfinishedPipelineStatuses are the states CancelRepositoryPipelines kills.
+var unfinishedPipelineStatuses = []model.StatusValue{model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked}
+
+// CancelRepositoryPipelines cancels every queued, running or blocked pipeline of a repository.
+func (s *Service) CancelRepositoryPipelines(ctx context.Context, repoID int64, reason string) error {
+	ids, err := s.store.ListUnfinishedPipelineIDs(ctx, repoID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.CancelPipelineRun(ctx, repoID, id, reason); err != nil && !errors.Is(err, ErrIllegalTransition) {
+			return fmt.Errorf("取消流水线 %d 失败: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// PurgeRepository deletes a repository with its pipelines, logs, tasks, pipeline config and
+// every other record scoped to it, then removes its workspaces, workspace cache and
+// artifact files. Pipelines must be cancelled and the repository deactivated first.
+func (s *Service) PurgeRepository(ctx context.Context, repo *model.Repo) error {
+	if repo == nil {
+		return fmt.Errorf("repository is required")
+	}
+	// read before the config is deleted; the spec may move the workspace root
+	settings, err := s.GetPipelineSettings(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+	pipelineIDs, err := s.store.DeleteRepository(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+	s.refreshCronEntries(repo.ID, nil)
+
+	s.cleanupObsoleteWorkspaces(repo, settings, pipelineIDs)
+	s.removeArtifactFiles(pipelineIDs)
+	for _, root := range workspaceRootCandidates(settings) {
+		cacheDir := filepath.Join(root, workspaceCacheDirName, strconv.FormatInt(repo.ID, 10))
+		if err := os.RemoveAll(cacheDir); err != nil {
+			log.Warn().Err(err).Str("path", cacheDir).Msg("failed to remove workspace cache of deleted repository")
+		}
+		// only succeeds once every workspace is gone; newer dirs of other replicas stay
+		_ = os.Remove(filepath.Join(root, sanitizeDirName(repo.Name)))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// parkedTask is a task waiting for its repository slot.
+type parkedTask struct {
+	task           *model.Task
+	pipelineNumber int64
+	blockedBy      int64
+}
+
+// repoSlots serialises the pipelines of repositories with DisallowParallel. A repository
+// slot is held by one pipeline while it executes; tasks of other pipelines are parked in
+// FIFO order and the slot is handed to the oldest one when the holder stops executing.
+type repoSlots struct {
+	mu      sync.Mutex
+	holders map[int64]int64
+	waiting map[int64][]*parkedTask
+}
+
+// acquire takes the slot of repoID for pipelineID. When another pipeline holds it the task
+// is parked and the holder returned with ok false.
+func (r *repoSlots) acquire(repoID, pipelineID, pipelineNumber int64, task *model.Task) (holder int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.holders == nil {
+		r.holders = make(map[int64]int64)
+		r.waiting = make(map[int64][]*parkedTask)
+	}
+	holder = r.holders[repoID]
+	if holder == 0 || holder == pipelineID {
+		r.holders[repoID] = pipelineID
+		return pipelineID, true
+	}
+	for _, parked := range r.waiting[repoID] {
+		if parked.task.PipelineID == pipelineID {
+			parked.task = task
+			parked.blockedBy = holder
+			return holder, false
+		}
+	}
+	r.waiting[repoID] = append(r.waiting[repoID], &parkedTask{
+		task:           task,
+		pipelineNumber: pipelineNumber,
+		blockedBy:      holder,
+	})
+	return holder, false
+}
+
+// release frees the slot of repoID when pipelineID holds it and hands it to the oldest
+// parked task, which is returned so the caller can enqueue it again.
+func (r *repoSlots) release(repoID, pipelineID int64) *model.Task {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.holders[repoID] != pipelineID {
+		return nil
+	}
+	queue := r.waiting[repoID]
+	if len(queue) == 0 {
+		delete(r.holders, repoID)
+		delete(r.waiting, repoID)
+		return nil
+	}
+	next := queue[0]
+	r.waiting[repoID] = queue[1:]
+	r.holders[repoID] = next.task.PipelineID
+	for _, parked := range r.waiting[repoID] {
+		parked.blockedBy = next.task.PipelineID
+	}
+	return next.task
+}
+
+// forget drops the parked task of pipelineID, e.g. after it was cancelled.
+func (r *repoSlots) forget(repoID, pipelineID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queue := r.waiting[repoID]
+	for i, parked := range queue {
+		if parked.task.PipelineID == pipelineID {
+			r.waiting[repoID] = append(queue[:i:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// parked lists the waiting tasks with the pipeline that blocks them.
+func (r *repoSlots) parked() []model.QueueTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tasks []model.QueueTask
+	for _, queue := range r.waiting {
+		for _, parked := range queue {
+			tasks = append(tasks, model.QueueTask{
+				Task:           *parked.task,
+				PipelineNumber: parked.pipelineNumber,
+				BlockedBy:      parked.blockedBy,
+			})
+		}
+	}
+	return tasks
+}
+
+// takeRepoSlot takes the slot of repoID for the pipeline when settings disallow parallel
+// pipelines. It reports false when the task was parked behind another pipeline.
+func (s *Service) takeRepoSlot(ctx context.Context, settings *model.RepoPipelineConfig, task *model.Task, repoID, pipelineID int64) bool {
+	if settings == nil || !settings.DisallowParallel {
+		return true
+	}
+	var number int64
+	if record, err := s.fetchPipeline(ctx, pipelineID); err == nil && record != nil {
+		number = record.Number
+	}
+	holder, ok := s.repoSlots.acquire(repoID, pipelineID, number, task)
+	if !ok {
+		log.Info().
+			Str("task_id", task.ID).
+			Int64("pipeline_id", pipelineID).
+			Int64("blocked_by", holder).
+			Msg("repository disallows parallel pipelines, task parked")
+	}
+	return ok
+}
+
+// releaseRepoSlot frees the repository slot held by pipelineID and enqueues the task that
+// takes it over. Tasks that cannot be enqueued pass the slot on in turn.
+func (s *Service) releaseRepoSlot(repoID, pipelineID int64) {
+	next := s.repoSlots.release(repoID, pipelineID)
+	if next == nil {
+		return
+	}
+	// enqueue off the worker: a full queue must not stall the task that just finished
+	go func() {
+		if err := s.EnqueueTask(context.Background(), next); err != nil {
+			log.Error().Err(err).Str("task_id", next.ID).Int64("pipeline_id", next.PipelineID).Msg("failed to resume parked pipeline task")
+			s.releaseRepoSlot(repoID, next.PipelineID)
+		}
+	}()
+}
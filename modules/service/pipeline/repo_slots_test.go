@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/queue"
+)
+
+func TestRepoSlotsHandOverInOrder(t *testing.T) {
+	var slots repoSlots
+	if _, ok := slots.acquire(1, 10, 1, &model.Task{ID: "a", PipelineID: 10}); !ok {
+		t.Fatalf("first pipeline did not get the free slot")
+	}
+	if _, ok := slots.acquire(2, 20, 1, &model.Task{ID: "other", PipelineID: 20}); !ok {
+		t.Errorf("slot of another repository was taken")
+	}
+	for _, id := range []int64{11, 12} {
+		if holder, ok := slots.acquire(1, id, id-9, &model.Task{ID: "t", PipelineID: id}); ok || holder != 10 {
+			t.Fatalf("acquire of pipeline %d = %d %v, want parked behind 10", id, holder, ok)
+		}
+	}
+	// a parked pipeline asking again keeps its place
+	if _, ok := slots.acquire(1, 11, 2, &model.Task{ID: "retry", PipelineID: 11}); ok {
+		t.Fatalf("parked pipeline took the held slot")
+	}
+	if got := len(slots.parked()); got != 2 {
+		t.Fatalf("parked = %d tasks, want 2", got)
+	}
+
+	if next := slots.release(1, 12); next != nil {
+		t.Errorf("release by a pipeline not holding the slot handed it to %s", next.ID)
+	}
+	next := slots.release(1, 10)
+	if next == nil || next.PipelineID != 11 || next.ID != "retry" {
+		t.Fatalf("release handed the slot to %+v, want the latest task of pipeline 11", next)
+	}
+	parked := slots.parked()
+	if len(parked) != 1 || parked[0].Task.PipelineID != 12 || parked[0].BlockedBy != 11 {
+		t.Fatalf("parked = %+v, want pipeline 12 blocked by 11", parked)
+	}
+	if next := slots.release(1, 11); next == nil || next.PipelineID != 12 {
+		t.Fatalf("release handed the slot to %+v, want pipeline 12", next)
+	}
+	if next := slots.release(1, 12); next != nil {
+		t.Fatalf("release of the last pipeline handed the slot to %+v", next)
+	}
+	if _, ok := slots.acquire(1, 13, 4, &model.Task{ID: "c", PipelineID: 13}); !ok {
+		t.Errorf("slot stayed held after the last pipeline released it")
+	}
+}
+
+func TestRepoSlotsForget(t *testing.T) {
+	var slots repoSlots
+	slots.acquire(1, 10, 1, &model.Task{ID: "a", PipelineID: 10})
+	slots.acquire(1, 11, 2, &model.Task{ID: "b", PipelineID: 11})
+	slots.acquire(1, 12, 3, &model.Task{ID: "c", PipelineID: 12})
+
+	slots.forget(1, 11)
+	if next := slots.release(1, 10); next == nil || next.PipelineID != 12 {
+		t.Fatalf("release handed the slot to %+v, want pipeline 12 past the forgotten one", next)
+	}
+}
+
+// newSerialRun returns a run of a repository that disallows parallel pipelines, whose queue
+// hands the tasks it receives to the returned channel.
+func newSerialRun(t *testing.T, steps ...pipelineTaskStep) (*Service, *fakeStore, *model.Task, <-chan *model.Task) {
+	t.Helper()
+	svc, fake, task := newFakeRun(t, steps...)
+	fake.configs[1].DisallowParallel = true
+
+	resumed := make(chan *model.Task, 4)
+	q := queue.New(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := q.Start(ctx, 1, func(_ context.Context, task *model.Task) error {
+		resumed <- task
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Shutdown)
+	svc.queue = q
+	return svc, fake, task, resumed
+}
+
+func TestHandleTaskParksBehindRunningPipeline(t *testing.T) {
+	svc, fake, task, resumed := newSerialRun(t, hostStep("greet", "echo hello"))
+	svc.repoSlots.acquire(1, 9, 7, &model.Task{ID: "task-9", PipelineID: 9})
+
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusPending {
+		t.Fatalf("parked pipeline = %s, want pending", got.Status)
+	}
+	if got := fake.step(1); got.State != model.StatusPending || fake.logText(1) != "" {
+		t.Fatalf("step of the parked pipeline ran: %s", got.State)
+	}
+	if !fake.hasTask(task.ID) {
+		t.Errorf("task of the parked pipeline was dropped")
+	}
+	waiting := svc.QueueInfo(context.Background()).WaitingOnDeps
+	if len(waiting) != 1 || waiting[0].Task.ID != task.ID || waiting[0].BlockedBy != 9 || waiting[0].PipelineNumber != 1 {
+		t.Fatalf("WaitingOnDeps = %+v, want pipeline 1 blocked by 9", waiting)
+	}
+
+	svc.releaseRepoSlot(1, 9)
+	select {
+	case got := <-resumed:
+		if got.ID != task.ID {
+			t.Fatalf("resumed task %s, want %s", got.ID, task.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("parked task was not enqueued after the holder finished")
+	}
+	if waiting := svc.QueueInfo(context.Background()).WaitingOnDeps; len(waiting) != 0 {
+		t.Errorf("WaitingOnDeps = %+v after the hand over, want none", waiting)
+	}
+	// the resumed task holds the slot now
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask of the resumed task: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusSuccess {
+		t.Fatalf("resumed pipeline = %s, want success\n%s", got.Status, fake)
+	}
+}
+
+func TestRepoSlotReleasedWhenRunStops(t *testing.T) {
+	approval := pipelineTaskStep{
+		Name:     "release",
+		Type:     model.StepTypeApproval,
+		Approval: &pipelineApprovalConfig{Message: "ship it?", Approvers: []string{"alice"}},
+	}
+	cases := map[string][]pipelineTaskStep{
+		"finished":             {hostStep("greet", "echo hello")},
+		"failed":               {hostStep("broken", "exit 1")},
+		"blocked for approval": {approval},
+	}
+	for name, steps := range cases {
+		t.Run(name, func(t *testing.T) {
+			svc, _, task, _ := newSerialRun(t, steps...)
+			if err := svc.handleTask(context.Background(), task); err != nil {
+				t.Fatalf("handleTask: %v", err)
+			}
+			if holder, ok := svc.repoSlots.acquire(1, 2, 2, &model.Task{ID: "task-2", PipelineID: 2}); !ok {
+				t.Errorf("next pipeline parked behind %d, want the slot released", holder)
+			}
+		})
+	}
+}
+
+func TestCancelDropsParkedTask(t *testing.T) {
+	svc, fake, task, resumed := newSerialRun(t, hostStep("greet", "echo hello"))
+	svc.repoSlots.acquire(1, 9, 7, &model.Task{ID: "task-9", PipelineID: 9})
+	if err := svc.handleTask(context.Background(), task); err != nil {
+		t.Fatalf("handleTask: %v", err)
+	}
+
+	if err := svc.CancelPipelineRun(context.Background(), 1, 1, ""); err != nil {
+		t.Fatalf("CancelPipelineRun: %v", err)
+	}
+	if got := fake.pipeline(1); got.Status != model.StatusKilled {
+		t.Fatalf("pipeline = %s, want killed", got.Status)
+	}
+	if waiting := svc.QueueInfo(context.Background()).WaitingOnDeps; len(waiting) != 0 {
+		t.Errorf("WaitingOnDeps = %+v, want the cancelled pipeline gone", waiting)
+	}
+	svc.releaseRepoSlot(1, 9)
+	select {
+	case got := <-resumed:
+		t.Errorf("cancelled task %s was enqueued", got.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
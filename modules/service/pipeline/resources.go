@@ -0,0 +1,146 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thepenn/devsys/model"
+	pipelineruntime "github.com/thepenn/devsys/service/pipeline/runtime"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// ErrInvalidStepResources is returned when pipeline settings carry an invalid step resource
+// limit or one above the ceiling set by the administrator.
+var ErrInvalidStepResources = errors.New("步骤资源限制无效")
+
+// StepResources are CPU and memory limits of step containers, kept with the values they
+// were written as for messages. Zero values are unlimited.
+type StepResources struct {
+	CPU         string
+	Memory      string
+	NanoCPUs    int64
+	MemoryBytes int64
+}
+
+// ParseStepResources parses limits written like the resources of a step, "2" and "4g".
+func ParseStepResources(cpu, memory string) (StepResources, error) {
+	resources := StepResources{CPU: strings.TrimSpace(cpu), Memory: strings.TrimSpace(memory)}
+	var err error
+	if resources.NanoCPUs, err = spec.ParseCPU(resources.CPU); err != nil {
+		return StepResources{}, err
+	}
+	if resources.MemoryBytes, err = spec.ParseMemory(resources.Memory); err != nil {
+		return StepResources{}, err
+	}
+	return resources, nil
+}
+
+// WithStepResourceCeiling caps the step resource limits of every repository. Steps without
+// limits run with the ceiling.
+func WithStepResourceCeiling(ceiling StepResources) Option {
+	return func(s *Service) {
+		s.stepCeiling = ceiling
+	}
+}
+
+func (r StepResources) runtime() pipelineruntime.Resources {
+	return pipelineruntime.Resources{NanoCPUs: r.NanoCPUs, Memory: r.MemoryBytes}
+}
+
+func (r StepResources) summary() string {
+	var parts []string
+	if r.CPU != "" {
+		parts = append(parts, "cpu "+r.CPU)
+	}
+	if r.Memory != "" {
+		parts = append(parts, "memory "+r.Memory)
+	}
+	return strings.Join(parts, ", ")
+}
+
+type pipelineStepResources struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+func newPipelineStepResources(resources *spec.Resources) *pipelineStepResources {
+	if resources == nil {
+		return nil
+	}
+	return &pipelineStepResources{CPU: resources.CPU, Memory: resources.Memory}
+}
+
+// normalizeStepResources validates the default step limits of repository settings.
+func (s *Service) normalizeStepResources(cpu, memory string) (string, string, error) {
+	resources, err := ParseStepResources(cpu, memory)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidStepResources, err)
+	}
+	ceiling := s.stepCeiling
+	if ceiling.NanoCPUs > 0 && resources.NanoCPUs > ceiling.NanoCPUs {
+		return "", "", fmt.Errorf("%w: CPU 限制 %s 超过上限 %s", ErrInvalidStepResources, resources.CPU, ceiling.CPU)
+	}
+	if ceiling.MemoryBytes > 0 && resources.MemoryBytes > ceiling.MemoryBytes {
+		return "", "", fmt.Errorf("%w: 内存限制 %s 超过上限 %s", ErrInvalidStepResources, resources.Memory, ceiling.Memory)
+	}
+	return resources.CPU, resources.Memory, nil
+}
+
+// resolveStepResources combines the limits of a step with the repository defaults and caps
+// them at the ceiling. It returns a note for every limit lowered to the ceiling.
+func (s *Service) resolveStepResources(step *pipelineStepResources, settings *model.RepoPipelineConfig) (StepResources, []string) {
+	var cpu, memory string
+	if settings != nil {
+		cpu, memory = settings.StepCPU, settings.StepMemory
+	}
+	if step != nil {
+		if strings.TrimSpace(step.CPU) != "" {
+			cpu = step.CPU
+		}
+		if strings.TrimSpace(step.Memory) != "" {
+			memory = step.Memory
+		}
+	}
+
+	var resolved StepResources
+	var notes []string
+	// values were validated when saved; ones that no longer parse leave the limit unset
+	if parsed, err := ParseStepResources(cpu, ""); err == nil {
+		resolved.CPU, resolved.NanoCPUs = parsed.CPU, parsed.NanoCPUs
+	}
+	if parsed, err := ParseStepResources("", memory); err == nil {
+		resolved.Memory, resolved.MemoryBytes = parsed.Memory, parsed.MemoryBytes
+	}
+
+	ceiling := s.stepCeiling
+	if ceiling.NanoCPUs > 0 && (resolved.NanoCPUs == 0 || resolved.NanoCPUs > ceiling.NanoCPUs) {
+		if resolved.NanoCPUs > 0 {
+			notes = append(notes, fmt.Sprintf("CPU 限制 %s 超过上限，按 %s 执行", resolved.CPU, ceiling.CPU))
+		}
+		resolved.CPU, resolved.NanoCPUs = ceiling.CPU, ceiling.NanoCPUs
+	}
+	if ceiling.MemoryBytes > 0 && (resolved.MemoryBytes == 0 || resolved.MemoryBytes > ceiling.MemoryBytes) {
+		if resolved.MemoryBytes > 0 {
+			notes = append(notes, fmt.Sprintf("内存限制 %s 超过上限，按 %s 执行", resolved.Memory, ceiling.Memory))
+		}
+		resolved.Memory, resolved.MemoryBytes = ceiling.Memory, ceiling.MemoryBytes
+	}
+	return resolved, notes
+}
+
+// stepRunError tells an out of memory kill apart from a failing command, which otherwise
+// only differ in the exit code.
+func stepRunError(step pipelineTaskStep, err error, logFn func(string) error) error {
+	if !errors.Is(err, pipelineruntime.ErrOutOfMemory) {
+		return err
+	}
+	message := "step killed: out of memory"
+	if step.Limits.Memory != "" {
+		message = fmt.Sprintf("step killed: out of memory (limit %s)", step.Limits.Memory)
+	}
+	if logFn != nil {
+		_ = logFn(message)
+	}
+	return errors.New(message)
+}
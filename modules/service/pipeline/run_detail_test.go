@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+func TestRunDetailNestsStepsUnderWorkflows(t *testing.T) {
+	db := storetest.Open(t, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.LogEntry{})
+	records := []any{
+		&model.Pipeline{ID: 1, RepoID: 1, Number: 1, Status: model.StatusRunning},
+		&model.Workflow{ID: 1, PipelineID: 1, PID: 1, Name: "build", State: model.StatusSuccess},
+		&model.Workflow{ID: 2, PipelineID: 1, PID: 4, Name: "deploy", State: model.StatusRunning},
+		// inserted out of order, listed by PID
+		&model.Step{ID: 1, PipelineID: 1, PID: 6, PPID: 4, Name: "rollout", State: model.StatusPending},
+		&model.Step{ID: 2, PipelineID: 1, PID: 3, PPID: 1, Name: "test", State: model.StatusSuccess},
+		&model.Step{ID: 3, PipelineID: 1, PID: 2, PPID: 1, Name: "compile", State: model.StatusSuccess},
+		&model.Step{ID: 4, PipelineID: 1, PID: 5, PPID: 4, Name: "release", State: model.StatusRunning},
+		// a step of another pipeline sharing the PIDs
+		&model.Step{ID: 5, PipelineID: 2, PID: 2, PPID: 1, Name: "elsewhere", State: model.StatusPending},
+	}
+	for _, record := range records {
+		mustCreate(t, db.GetDB(), record)
+	}
+	svc := NewService(db, nil, nil)
+
+	detail, err := svc.GetPipelineRunDetail(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Steps) != 4 {
+		t.Fatalf("flat steps = %d, want the 4 of the run", len(detail.Steps))
+	}
+	want := map[string][]string{"build": {"compile", "test"}, "deploy": {"release", "rollout"}}
+	for _, workflow := range detail.Workflows {
+		var names []string
+		for _, step := range workflow.Children {
+			names = append(names, step.Name)
+		}
+		if len(names) != len(want[workflow.Name]) || names[0] != want[workflow.Name][0] || names[1] != want[workflow.Name][1] {
+			t.Errorf("workflow %s children = %v, want %v", workflow.Name, names, want[workflow.Name])
+		}
+	}
+	// the nested steps are the records of the flat list, so decorating one decorates both
+	nested := detail.Workflows[0].Children[0]
+	for _, step := range detail.Steps {
+		if step.ID == nested.ID && step != nested {
+			t.Errorf("nested step %d is a copy of the flat one", nested.ID)
+		}
+	}
+}
+
+func TestRunDetailWorkflowWithoutSteps(t *testing.T) {
+	svc, db := newLogService(t)
+	mustCreate(t, db, &model.Workflow{ID: 2, PipelineID: 1, PID: 3, Name: "empty", State: model.StatusPending})
+
+	detail, err := svc.GetPipelineRunDetail(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Workflows) != 2 {
+		t.Fatalf("workflows = %d, want 2", len(detail.Workflows))
+	}
+	if children := detail.Workflows[1].Children; children == nil || len(children) != 0 {
+		t.Errorf("children of a workflow without steps = %#v, want an empty list", children)
+	}
+}
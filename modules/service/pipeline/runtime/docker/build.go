@@ -0,0 +1,383 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/build"
+	imagetypes "github.com/docker/docker/api/types/image"
+	registrytypes "github.com/docker/docker/api/types/registry"
+
+	"github.com/thepenn/devsys/service/pipeline/runtime"
+)
+
+// inlineDockerfileName is the name under which a Dockerfile that is not part of the build
+// context is added to it.
+const inlineDockerfileName = ".devsys.Dockerfile"
+
+// BuildConfig describes an image build from a directory of the agent.
+type BuildConfig struct {
+	// ContextDir is the build context; Dockerfile the path of the Dockerfile, usually inside it.
+	ContextDir string
+	Dockerfile string
+	// DockerfileContent is built instead of the Dockerfile file when set.
+	DockerfileContent []byte
+	Tags              []string
+	Args              map[string]string
+	Target            string
+	// CacheFrom lists images whose inline cache the build may reuse.
+	CacheFrom []string
+	Labels    map[string]string
+	// RegistryAuths log in to the registries of base and cache images.
+	RegistryAuths []runtime.RegistryAuth
+}
+
+// buildMessage is one message of the build stream. BuildKit sends its progress as aux
+// messages with the id moby.buildkit.trace; the classic builder sends plain text in stream.
+type buildMessage struct {
+	ID     string `json:"id"`
+	Stream string `json:"stream"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	ErrorMessage string          `json:"error"`
+	Aux          json.RawMessage `json:"aux"`
+}
+
+// BuildImage builds cfg with BuildKit and returns the id of the image. The image is built
+// with an inline cache, so that its tags can be used as CacheFrom by the next build.
+func (r *Runtime) BuildImage(ctx context.Context, cfg BuildConfig, logFn func(string) error) (string, error) {
+	if len(cfg.Tags) == 0 {
+		return "", fmt.Errorf("构建镜像需要至少一个标签")
+	}
+	dockerfile, content, err := buildDockerfile(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, cfg.ContextDir, dockerfile, content))
+	}()
+	defer reader.Close()
+
+	inlineCache := "1"
+	args := map[string]*string{"BUILDKIT_INLINE_CACHE": &inlineCache}
+	for key, value := range cfg.Args {
+		value := value
+		args[key] = &value
+	}
+	auths := make(map[string]registrytypes.AuthConfig, len(cfg.RegistryAuths))
+	for _, auth := range cfg.RegistryAuths {
+		auths[auth.ServerAddress] = registrytypes.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			ServerAddress: auth.ServerAddress,
+		}
+	}
+
+	resp, err := r.client.ImageBuild(ctx, reader, build.ImageBuildOptions{
+		Tags:        cfg.Tags,
+		Dockerfile:  dockerfile,
+		BuildArgs:   args,
+		Target:      cfg.Target,
+		CacheFrom:   cfg.CacheFrom,
+		Labels:      cfg.Labels,
+		AuthConfigs: auths,
+		Remove:      true,
+		ForceRemove: true,
+		Version:     build.BuilderBuildKit,
+	})
+	if err != nil {
+		return "", fmt.Errorf("构建镜像失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	imageID, err := streamBuildOutput(resp.Body, logFn)
+	if err != nil {
+		return "", fmt.Errorf("构建镜像失败: %w", err)
+	}
+	if imageID == "" {
+		inspect, _, err := r.client.ImageInspectWithRaw(ctx, cfg.Tags[0])
+		if err != nil {
+			return "", fmt.Errorf("读取镜像 %s 失败: %w", cfg.Tags[0], err)
+		}
+		imageID = inspect.ID
+	}
+	return imageID, nil
+}
+
+// PushImage pushes a tag and returns the digest reported by the registry.
+func (r *Runtime) PushImage(ctx context.Context, image string, auth *runtime.RegistryAuth, logFn func(string) error) (string, error) {
+	opts := imagetypes.PushOptions{}
+	// the daemon rejects pushes without an auth header, even to registries that need none
+	authConfig := registrytypes.AuthConfig{}
+	if auth != nil {
+		authConfig = registrytypes.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			ServerAddress: auth.ServerAddress,
+		}
+	}
+	encoded, err := registrytypes.EncodeAuthConfig(authConfig)
+	if err != nil {
+		return "", fmt.Errorf("推送镜像 %s 失败: %w", image, err)
+	}
+	opts.RegistryAuth = encoded
+
+	if logFn != nil {
+		_ = logFn(fmt.Sprintf("推送镜像 %s ...", image))
+	}
+	reader, err := r.client.ImagePush(ctx, image, opts)
+	if err != nil {
+		return "", fmt.Errorf("推送镜像 %s 失败: %w", image, err)
+	}
+	defer reader.Close()
+
+	var digest string
+	err = streamProgress(reader, "Pushing", func(aux json.RawMessage) {
+		var result struct {
+			Digest string `json:"Digest"`
+		}
+		if json.Unmarshal(aux, &result) == nil && result.Digest != "" {
+			digest = result.Digest
+		}
+	}, logFn)
+	if err != nil {
+		return "", fmt.Errorf("推送镜像 %s 失败: %w", image, err)
+	}
+	return digest, nil
+}
+
+// streamBuildOutput forwards the build output to logFn and returns the id of the built
+// image, or "" when the daemon did not report it.
+func streamBuildOutput(reader io.Reader, logFn func(string) error) (string, error) {
+	out := newLogWriter(logFn)
+	defer out.Flush()
+	trace := newBuildkitTrace(logFn)
+	defer trace.flush()
+
+	var imageID string
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg buildMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return imageID, nil
+			}
+			return imageID, err
+		}
+		if msg.Error != nil && msg.Error.Message != "" {
+			return imageID, errors.New(msg.Error.Message)
+		}
+		if msg.ErrorMessage != "" {
+			return imageID, errors.New(msg.ErrorMessage)
+		}
+		if msg.Stream != "" {
+			_, _ = out.Write([]byte(msg.Stream))
+		}
+		if len(msg.Aux) == 0 {
+			continue
+		}
+		if msg.ID == "moby.buildkit.trace" {
+			var data []byte
+			if err := json.Unmarshal(msg.Aux, &data); err != nil {
+				return imageID, fmt.Errorf("解析构建进度失败: %w", err)
+			}
+			if err := trace.write(data); err != nil {
+				return imageID, fmt.Errorf("解析构建进度失败: %w", err)
+			}
+			continue
+		}
+		var result build.Result
+		if json.Unmarshal(msg.Aux, &result) == nil && result.ID != "" {
+			imageID = result.ID
+		}
+	}
+}
+
+// buildDockerfile returns the Dockerfile name passed to the daemon, relative to the context,
+// and the content to add to the context when the Dockerfile lies outside of it.
+func buildDockerfile(cfg BuildConfig) (string, []byte, error) {
+	if cfg.DockerfileContent != nil {
+		return inlineDockerfileName, cfg.DockerfileContent, nil
+	}
+	rel, err := filepath.Rel(cfg.ContextDir, cfg.Dockerfile)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(rel), nil, nil
+	}
+	content, err := os.ReadFile(cfg.Dockerfile)
+	if err != nil {
+		return "", nil, fmt.Errorf("读取 Dockerfile 失败: %w", err)
+	}
+	return inlineDockerfileName, content, nil
+}
+
+// writeBuildContext writes dir as a tar stream, leaving out the paths matched by its
+// .dockerignore except the Dockerfile itself. content, when set, is added as dockerfile.
+func writeBuildContext(w io.Writer, dir, dockerfile string, content []byte) error {
+	ignore, err := readDockerignore(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name != dockerfile && ignore.matches(name) {
+			if info.IsDir() && !ignore.hasExceptions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		// files are owned by root in the image, like with docker build
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if content != nil {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     dockerfile,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// dockerignore holds the patterns of a .dockerignore file. As with docker, a path is
+// excluded when the last pattern matching it, or one of its parents, is not an exception.
+type dockerignore []ignorePattern
+
+type ignorePattern struct {
+	segments  []string
+	exception bool
+}
+
+func readDockerignore(dir string) (dockerignore, error) {
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns dockerignore
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+		if line == "" {
+			continue
+		}
+		pattern.segments = strings.Split(line, "/")
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+func (d dockerignore) hasExceptions() bool {
+	for _, pattern := range d {
+		if pattern.exception {
+			return true
+		}
+	}
+	return false
+}
+
+func (d dockerignore) matches(name string) bool {
+	segments := strings.Split(name, "/")
+	excluded := false
+	for _, pattern := range d {
+		for n := 1; n <= len(segments); n++ {
+			if matchSegments(pattern.segments, segments[:n]) {
+				excluded = !pattern.exception
+				break
+			}
+		}
+	}
+	return excluded
+}
+
+// matchSegments matches a path against a pattern segment by segment, with path.Match per
+// segment and ** matching any number of segments.
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the BuildKit control API messages sent as moby.buildkit.trace. Only the
+// fields written to the step log are decoded; pulling in the buildkit module for them would
+// add far more than it saves.
+const (
+	statusVertexes = 1
+	statusLogs     = 3
+	statusWarnings = 4
+
+	vertexDigest    = 1
+	vertexName      = 3
+	vertexCached    = 4
+	vertexStarted   = 5
+	vertexCompleted = 6
+	vertexError     = 7
+
+	vertexLogVertex = 1
+	vertexLogMsg    = 4
+
+	vertexWarningShort = 3
+)
+
+// buildkitTrace turns BuildKit status updates into log lines numbered like the docker CLI's
+// plain progress output: "#3 [2/4] RUN make", its output, then "#3 DONE" or "#3 ERROR".
+type buildkitTrace struct {
+	logFn    func(string) error
+	vertexes map[string]*traceVertex
+	next     int
+}
+
+type traceVertex struct {
+	index     int
+	started   bool
+	completed bool
+	out       *logWriter
+}
+
+type vertexStatus struct {
+	digest    string
+	name      string
+	cached    bool
+	started   bool
+	completed bool
+	err       string
+}
+
+func newBuildkitTrace(logFn func(string) error) *buildkitTrace {
+	return &buildkitTrace{logFn: logFn, vertexes: make(map[string]*traceVertex)}
+}
+
+func (t *buildkitTrace) emit(line string) {
+	if t.logFn != nil {
+		_ = t.logFn(line)
+	}
+}
+
+func (t *buildkitTrace) vertex(digest string) *traceVertex {
+	v, ok := t.vertexes[digest]
+	if !ok {
+		t.next++
+		v = &traceVertex{index: t.next}
+		prefix := fmt.Sprintf("#%d ", v.index)
+		v.out = newLogWriter(func(line string) error {
+			t.emit(prefix + line)
+			return nil
+		})
+		t.vertexes[digest] = v
+	}
+	return v
+}
+
+// write decodes one StatusResponse.
+func (t *buildkitTrace) write(data []byte) error {
+	return walkFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case statusVertexes:
+			status, err := decodeVertex(value)
+			if err != nil {
+				return err
+			}
+			t.updateVertex(status)
+		case statusLogs:
+			var digest string
+			var msg []byte
+			if err := walkFields(value, func(num protowire.Number, value []byte) error {
+				switch num {
+				case vertexLogVertex:
+					digest = string(value)
+				case vertexLogMsg:
+					msg = value
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			_, _ = t.vertex(digest).out.Write(msg)
+		case statusWarnings:
+			return walkFields(value, func(num protowire.Number, value []byte) error {
+				if num == vertexWarningShort {
+					t.emit("WARNING: " + strings.TrimSpace(string(value)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func (t *buildkitTrace) updateVertex(status vertexStatus) {
+	v := t.vertex(status.digest)
+	if status.started && !v.started {
+		v.started = true
+		t.emit(fmt.Sprintf("#%d %s", v.index, status.name))
+	}
+	if !status.completed || v.completed {
+		return
+	}
+	v.completed = true
+	v.out.Flush()
+	switch {
+	case status.err != "":
+		t.emit(fmt.Sprintf("#%d ERROR: %s", v.index, status.err))
+	case status.cached:
+		if !v.started {
+			t.emit(fmt.Sprintf("#%d %s", v.index, status.name))
+		}
+		t.emit(fmt.Sprintf("#%d CACHED", v.index))
+	default:
+		t.emit(fmt.Sprintf("#%d DONE", v.index))
+	}
+}
+
+// flush writes the partial output lines of all steps.
+func (t *buildkitTrace) flush() {
+	for _, v := range t.vertexes {
+		v.out.Flush()
+	}
+}
+
+func decodeVertex(data []byte) (vertexStatus, error) {
+	var status vertexStatus
+	err := walkFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case vertexDigest:
+			status.digest = string(value)
+		case vertexName:
+			status.name = string(value)
+		case vertexCached:
+			status.cached = len(value) > 0 && value[0] != 0
+		case vertexStarted:
+			status.started = true
+		case vertexCompleted:
+			status.completed = true
+		case vertexError:
+			status.err = string(value)
+		}
+		return nil
+	})
+	return status, err
+}
+
+// walkFields calls fn for every field of a protobuf message. Length-delimited fields are
+// passed their payload and varints their encoded bytes, so a bool is non-zero when set.
+func walkFields(data []byte, fn func(protowire.Number, []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			value = protowire.AppendVarint(nil, v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// ManagedLabel marks containers and networks created by devsys.
+	ManagedLabel = "devsys.managed"
+	// PipelineLabel holds the id of the pipeline a container belongs to.
+	PipelineLabel = "devsys.pipeline"
+
+	// DefaultStopGrace is how long a stopped container may take to exit before it is killed.
+	DefaultStopGrace = 5 * time.Second
+)
+
+// ManagedContainer is a container carrying ManagedLabel.
+type ManagedContainer struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+}
+
+// ManagedContainers lists the containers created by devsys, running or not.
+func (r *Runtime) ManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	list, err := r.client.ContainerList(ctx, containertypes.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", ManagedLabel+"=true")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]ManagedContainer, 0, len(list))
+	for _, item := range list {
+		name := ""
+		if len(item.Names) > 0 {
+			name = strings.TrimPrefix(item.Names[0], "/")
+		}
+		containers = append(containers, ManagedContainer{ID: item.ID, Name: name, Labels: item.Labels})
+	}
+	return containers, nil
+}
+
+// StopContainer stops a container, kills it when it has not exited after grace and removes
+// it. A container that is already gone is not an error.
+func (r *Runtime) StopContainer(ctx context.Context, id string, grace time.Duration) error {
+	timeout := int(grace / time.Second)
+	stopCtx, cancel := context.WithTimeout(ctx, grace+10*time.Second)
+	defer cancel()
+	defer r.removeContainer(ctx, id)
+
+	err := r.client.ContainerStop(stopCtx, id, containertypes.StopOptions{Timeout: &timeout})
+	if err == nil || client.IsErrNotFound(err) {
+		return nil
+	}
+	if killErr := r.client.ContainerKill(ctx, id, "KILL"); killErr != nil && !client.IsErrNotFound(killErr) {
+		return fmt.Errorf("停止容器 %s 失败: %w", id, err)
+	}
+	return nil
+}
+
+// RemoveContainer force-removes a container and its anonymous volumes.
+func (r *Runtime) RemoveContainer(ctx context.Context, id string) {
+	r.removeContainer(ctx, id)
+}
+
+func containerLabels(labels map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels)+1)
+	for key, value := range labels {
+		merged[key] = value
+	}
+	merged[ManagedLabel] = "true"
+	return merged
+}
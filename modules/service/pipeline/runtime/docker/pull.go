@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pullProgressStep is how far, in percent, a layer advances between two progress lines.
+const pullProgressStep = 25
+
+// progressMessage is one message of a pull or push stream; the daemon's jsonmessage package
+// pulls in terminal handling this runtime does not need.
+type progressMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress *struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	ErrorMessage string `json:"error"`
+	// Aux carries structured results, such as the digest of a pushed tag.
+	Aux json.RawMessage `json:"aux"`
+}
+
+// streamPullProgress reads the JSON stream of an image pull and forwards one line per layer
+// status change and per pullProgressStep percent. It returns the error reported in the
+// stream, which the daemon sends instead of failing the request, e.g. for unauthorized pulls.
+func streamPullProgress(reader io.Reader, logFn func(string) error) error {
+	return streamProgress(reader, "Pulling", nil, logFn)
+}
+
+// streamProgress follows a pull or push stream like streamPullProgress, prefixing layer lines
+// with verb and handing aux messages to auxFn.
+func streamProgress(reader io.Reader, verb string, auxFn func(json.RawMessage), logFn func(string) error) error {
+	type layerState struct {
+		status  string
+		percent int64
+	}
+	layers := make(map[string]*layerState)
+	emit := func(line string) {
+		if logFn != nil {
+			_ = logFn(line)
+		}
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg progressMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil && msg.Error.Message != "" {
+			return errors.New(msg.Error.Message)
+		}
+		if msg.ErrorMessage != "" {
+			return errors.New(msg.ErrorMessage)
+		}
+		if len(msg.Aux) > 0 && auxFn != nil {
+			auxFn(msg.Aux)
+		}
+		if msg.ID == "" {
+			// summary lines such as "Digest: sha256:..." and "Status: Downloaded newer image"
+			if msg.Status != "" {
+				emit(msg.Status)
+			}
+			continue
+		}
+		state, ok := layers[msg.ID]
+		if !ok {
+			state = &layerState{percent: -1}
+			layers[msg.ID] = state
+		}
+		if msg.Progress == nil || msg.Progress.Total <= 0 {
+			if msg.Status != state.status {
+				state.status = msg.Status
+				state.percent = -1
+				emit(fmt.Sprintf("%s layer %s: %s", verb, msg.ID, msg.Status))
+			}
+			continue
+		}
+		percent := msg.Progress.Current * 100 / msg.Progress.Total
+		bucket := percent / pullProgressStep * pullProgressStep
+		if msg.Status == state.status && bucket <= state.percent {
+			continue
+		}
+		state.status = msg.Status
+		state.percent = bucket
+		emit(fmt.Sprintf("%s layer %s: %s %d%%", verb, msg.ID, msg.Status, percent))
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"strings"
 	"sync"
 	"time"
@@ -13,8 +12,11 @@ import (
 	containertypes "github.com/docker/docker/api/types/container"
 	imagetypes "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
+	registrytypes "github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/thepenn/devsys/service/pipeline/runtime"
 )
 
 type Runtime struct {
@@ -32,7 +34,7 @@ func NewRuntime() (*Runtime, error) {
 
 // Run creates, attaches, waits and removes a container based on the provided configuration.
 func (r *Runtime) Run(ctx context.Context, cfg ContainerConfig, logFn func(string) error) (int, error) {
-	if err := r.ensureImage(ctx, cfg.Image, logFn); err != nil {
+	if err := r.ensureImage(ctx, cfg, logFn); err != nil {
 		return -1, err
 	}
 
@@ -43,6 +45,10 @@ func (r *Runtime) Run(ctx context.Context, cfg ContainerConfig, logFn func(strin
 	}
 	id := resp.ID
 	defer r.removeContainer(context.Background(), id)
+	if cfg.Tracker != nil {
+		cfg.Tracker.Track(id)
+		defer cfg.Tracker.Untrack(id)
+	}
 
 	if err := r.client.ContainerStart(ctx, id, containertypes.StartOptions{}); err != nil {
 		return -1, err
@@ -79,9 +85,12 @@ func (r *Runtime) Run(ctx context.Context, cfg ContainerConfig, logFn func(strin
 		}
 		if status.StatusCode != 0 && runErr == nil {
 			runErr = fmt.Errorf("container exited with status %d", status.StatusCode)
+			if r.oomKilled(id) {
+				runErr = fmt.Errorf("%w (exit status %d)", runtime.ErrOutOfMemory, status.StatusCode)
+			}
 		}
 	case <-ctx.Done():
-		_ = r.client.ContainerStop(context.Background(), id, containertypes.StopOptions{})
+		_ = r.StopContainer(context.Background(), id, DefaultStopGrace)
 		exitCode = -1
 		runErr = ctx.Err()
 	}
@@ -93,52 +102,98 @@ func (r *Runtime) Run(ctx context.Context, cfg ContainerConfig, logFn func(strin
 	return exitCode, runErr
 }
 
+// oomKilled reports whether the kernel killed the container for exceeding its memory limit.
+func (r *Runtime) oomKilled(id string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inspect, err := r.client.ContainerInspect(ctx, id)
+	if err != nil || inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return false
+	}
+	return inspect.State.OOMKilled
+}
+
 func (r *Runtime) removeContainer(ctx context.Context, id string) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	_ = r.client.ContainerRemove(ctx, id, containertypes.RemoveOptions{Force: true, RemoveVolumes: true})
 }
 
-func (r *Runtime) ensureImage(ctx context.Context, image string, logFn func(string) error) error {
-	if strings.TrimSpace(image) == "" {
+// ensureImage makes cfg.Image available locally according to cfg.PullPolicy.
+func (r *Runtime) ensureImage(ctx context.Context, cfg ContainerConfig, logFn func(string) error) error {
+	image := strings.TrimSpace(cfg.Image)
+	if image == "" {
 		return fmt.Errorf("container image is required")
 	}
-	if _, ok := r.pulled.Load(image); ok {
-		return nil
+	policy := cfg.PullPolicy
+	if policy == "" {
+		policy = runtime.PullIfNotPresent
 	}
-	if _, _, err := r.client.ImageInspectWithRaw(ctx, image); err == nil {
-		r.pulled.Store(image, struct{}{})
-		return nil
-	} else if err != nil && !client.IsErrNotFound(err) {
-		return err
+	if policy != runtime.PullAlways {
+		if _, ok := r.pulled.Load(image); ok {
+			return nil
+		}
+		if _, _, err := r.client.ImageInspectWithRaw(ctx, image); err == nil {
+			r.pulled.Store(image, struct{}{})
+			return nil
+		} else if !client.IsErrNotFound(err) {
+			return err
+		}
+		if policy == runtime.PullNever {
+			return fmt.Errorf("镜像 %s 不存在，且拉取策略为 never", image)
+		}
 	}
 
 	if logFn != nil {
 		_ = logFn(fmt.Sprintf("拉取镜像 %s ...", image))
 	}
-	reader, err := r.client.ImagePull(ctx, image, imagetypes.PullOptions{})
+	opts := imagetypes.PullOptions{}
+	if cfg.RegistryAuth != nil {
+		encoded, err := registrytypes.EncodeAuthConfig(registrytypes.AuthConfig{
+			Username:      cfg.RegistryAuth.Username,
+			Password:      cfg.RegistryAuth.Password,
+			ServerAddress: cfg.RegistryAuth.ServerAddress,
+		})
+		if err != nil {
+			return fmt.Errorf("拉取镜像 %s 失败: %w", image, err)
+		}
+		opts.RegistryAuth = encoded
+	}
+	reader, err := r.client.ImagePull(ctx, image, opts)
 	if err != nil {
 		return fmt.Errorf("拉取镜像 %s 失败: %w", image, err)
 	}
 	defer reader.Close()
-	_, _ = io.Copy(io.Discard, reader)
+	if err := streamPullProgress(reader, logFn); err != nil {
+		return fmt.Errorf("拉取镜像 %s 失败: %w", image, err)
+	}
 	r.pulled.Store(image, struct{}{})
 	return nil
 }
 
-type ContainerConfig struct {
-	Name       string
-	Image      string
-	Cmd        []string
-	Entrypoint []string
-	Env        []string
-	WorkingDir string
-	Volumes    map[string]struct{}
-	Binds      []string
-	Privileged bool
-	Network    string
+// ImageDigest returns the content digest of a local image, preferring the registry digest
+// ("sha256:...") over the local image id.
+func (r *Runtime) ImageDigest(ctx context.Context, image string) (string, error) {
+	inspect, _, err := r.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	for _, repoDigest := range inspect.RepoDigests {
+		if idx := strings.LastIndex(repoDigest, "@"); idx >= 0 {
+			return repoDigest[idx+1:], nil
+		}
+	}
+	return inspect.ID, nil
 }
 
+// cpuPeriod is the CFS period, in microseconds, CPU limits are expressed against.
+const cpuPeriod = 100000
+
+// ContainerConfig is the runtime configuration of a container.
+type ContainerConfig = runtime.Config
+
+var _ runtime.Runner = (*Runtime)(nil)
+
 func toDockerConfigs(cfg ContainerConfig) (*containertypes.Config, *containertypes.HostConfig) {
 	config := &containertypes.Config{
 		Image:      cfg.Image,
@@ -147,12 +202,21 @@ func toDockerConfigs(cfg ContainerConfig) (*containertypes.Config, *containertyp
 		Env:        cfg.Env,
 		WorkingDir: cfg.WorkingDir,
 		Volumes:    cfg.Volumes,
+		Labels:     containerLabels(cfg.Labels),
 	}
 	host := &containertypes.HostConfig{
 		Binds:       cfg.Binds,
 		Privileged:  cfg.Privileged,
 		NetworkMode: containertypes.NetworkMode(cfg.Network),
 	}
+	if cfg.Resources.NanoCPUs > 0 {
+		host.CPUPeriod = cpuPeriod
+		host.CPUQuota = cfg.Resources.NanoCPUs * cpuPeriod / 1e9
+	}
+	if cfg.Resources.Memory > 0 {
+		host.Memory = cfg.Resources.Memory
+		host.MemorySwap = cfg.Resources.Memory
+	}
 	return config, host
 }
 
@@ -0,0 +1,135 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/thepenn/devsys/service/pipeline/runtime"
+)
+
+// ServiceContainer is a long-running container started next to step containers, like a
+// database for integration tests. Its output is streamed until it is stopped.
+type ServiceContainer struct {
+	ID      string
+	runtime *Runtime
+	tracker runtime.ContainerTracker
+	logDone chan struct{}
+}
+
+// CreateNetwork creates a bridge network on which containers reach each other by name.
+func (r *Runtime) CreateNetwork(ctx context.Context, name string) (string, error) {
+	resp, err := r.client.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{ManagedLabel: "true"},
+	})
+	if err != nil {
+		return "", fmt.Errorf("创建网络 %s 失败: %w", name, err)
+	}
+	return resp.ID, nil
+}
+
+// RemoveNetwork removes a network created by CreateNetwork.
+func (r *Runtime) RemoveNetwork(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return r.client.NetworkRemove(ctx, id)
+}
+
+// StartService starts a container attached to cfg.Network, reachable there by aliases, and
+// streams its output to logFn until Stop.
+func (r *Runtime) StartService(ctx context.Context, cfg ContainerConfig, aliases []string, logFn func(string) error) (*ServiceContainer, error) {
+	if err := r.ensureImage(ctx, cfg, logFn); err != nil {
+		return nil, err
+	}
+
+	containerCfg, hostCfg := toDockerConfigs(cfg)
+	networkingCfg := &network.NetworkingConfig{}
+	if cfg.Network != "" {
+		networkingCfg.EndpointsConfig = map[string]*network.EndpointSettings{
+			cfg.Network: {Aliases: aliases},
+		}
+	}
+	resp, err := r.client.ContainerCreate(ctx, containerCfg, hostCfg, networkingCfg, nil, cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	svc := &ServiceContainer{ID: resp.ID, runtime: r, tracker: cfg.Tracker, logDone: make(chan struct{})}
+	if err := r.client.ContainerStart(ctx, resp.ID, containertypes.StartOptions{}); err != nil {
+		r.removeContainer(context.Background(), resp.ID)
+		return nil, err
+	}
+	if svc.tracker != nil {
+		svc.tracker.Track(resp.ID)
+	}
+
+	// the stream ends when the container is removed, so it outlives ctx on purpose
+	logs, err := r.client.ContainerLogs(context.Background(), resp.ID, containertypes.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		close(svc.logDone)
+		return svc, nil
+	}
+	go func() {
+		defer close(svc.logDone)
+		defer logs.Close()
+		writer := newLogWriter(logFn)
+		_, _ = stdcopy.StdCopy(writer, writer, logs)
+		writer.Flush()
+	}()
+	return svc, nil
+}
+
+// Exec runs cmd inside the service and returns its exit code.
+func (c *ServiceContainer) Exec(ctx context.Context, cmd []string) (int, error) {
+	created, err := c.runtime.client.ContainerExecCreate(ctx, c.ID, containertypes.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, err
+	}
+	attach, err := c.runtime.client.ContainerExecAttach(ctx, created.ID, containertypes.ExecAttachOptions{})
+	if err != nil {
+		return -1, err
+	}
+	_, _ = io.Copy(io.Discard, attach.Reader)
+	attach.Close()
+	inspect, err := c.runtime.client.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return -1, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// Running reports whether the service is still running, and its exit code when it is not.
+func (c *ServiceContainer) Running(ctx context.Context) (bool, int, error) {
+	inspect, err := c.runtime.client.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return false, -1, err
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return false, -1, nil
+	}
+	return inspect.State.Running, inspect.State.ExitCode, nil
+}
+
+// Stop removes the service and waits for the rest of its output.
+func (c *ServiceContainer) Stop() {
+	if c == nil {
+		return
+	}
+	c.runtime.removeContainer(context.Background(), c.ID)
+	if c.tracker != nil {
+		c.tracker.Untrack(c.ID)
+	}
+	select {
+	case <-c.logDone:
+	case <-time.After(5 * time.Second):
+	}
+}
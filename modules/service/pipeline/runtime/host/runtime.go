@@ -0,0 +1,113 @@
+// Package host runs step commands directly on the agent, for agents without a Docker daemon.
+package host
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/thepenn/devsys/service/pipeline/runtime"
+)
+
+// waitDelay bounds how long output of processes left behind by a finished or canceled
+// command is still read.
+const waitDelay = 10 * time.Second
+
+// Runtime runs commands as child processes of the server.
+type Runtime struct{}
+
+var _ runtime.Runner = (*Runtime)(nil)
+
+func NewRuntime() *Runtime {
+	return &Runtime{}
+}
+
+// Run executes cfg.Cmd in cfg.WorkingDir with exactly cfg.Env. Container options are
+// rejected; steps using them must run in the docker runtime.
+func (r *Runtime) Run(ctx context.Context, cfg runtime.Config, logFn func(string) error) (int, error) {
+	if len(cfg.Cmd) == 0 {
+		return -1, errors.New("command is required")
+	}
+	if cfg.Privileged || len(cfg.Binds) > 0 {
+		return -1, errors.New("host runtime does not support privileged mode or volumes")
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	cmd := exec.CommandContext(ctx, cfg.Cmd[0], cfg.Cmd[1:]...)
+	cmd.Dir = cfg.WorkingDir
+	cmd.Env = cfg.Env
+	if cmd.Env == nil {
+		// a nil Env would inherit the server environment
+		cmd.Env = []string{}
+	}
+	writer := newLogWriter(logFn)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.WaitDelay = waitDelay
+
+	err := cmd.Run()
+	writer.Flush()
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		code := exitErr.ExitCode()
+		return code, fmt.Errorf("command exited with status %d", code)
+	}
+	return -1, err
+}
+
+// logWriter splits the combined output into lines.
+type logWriter struct {
+	fn  func(string) error
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newLogWriter(fn func(string) error) *logWriter {
+	return &logWriter{fn: fn}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	total := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			w.buf.Write(p)
+			break
+		}
+		w.buf.Write(p[:i])
+		w.flushLocked()
+		p = p[i+1:]
+	}
+	return total, nil
+}
+
+func (w *logWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked()
+}
+
+func (w *logWriter) flushLocked() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	line := w.buf.String()
+	w.buf.Reset()
+	if w.fn != nil {
+		_ = w.fn(line)
+	}
+}
@@ -0,0 +1,77 @@
+// Package runtime defines how step commands are executed. The docker runtime runs each
+// command in a container; the host runtime runs it with the shell of the agent.
+package runtime
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrOutOfMemory is returned by Run when the container was killed for exceeding its memory
+// limit.
+var ErrOutOfMemory = errors.New("container killed: out of memory")
+
+// Config describes one command execution. Image, Entrypoint, Volumes, Binds, Privileged,
+// Network, PullPolicy, RegistryAuth, Labels, Tracker and Resources only apply to containers.
+type Config struct {
+	Name       string
+	Image      string
+	Cmd        []string
+	Entrypoint []string
+	Env        []string
+	WorkingDir string
+	Volumes    map[string]struct{}
+	Binds      []string
+	Privileged bool
+	Network    string
+	// PullPolicy decides when Image is pulled; empty pulls it when it is missing.
+	PullPolicy PullPolicy
+	// RegistryAuth logs in to the registry of Image for the pull; nil pulls anonymously.
+	RegistryAuth *RegistryAuth
+	// Labels are set on the container next to the label marking it as devsys-owned.
+	Labels map[string]string
+	// Tracker is told about the container while it exists, so it can be stopped from
+	// outside ctx.
+	Tracker ContainerTracker
+	// Resources limit the container; zero values are unlimited.
+	Resources Resources
+}
+
+// Resources are the CPU and memory limits of a container.
+type Resources struct {
+	// NanoCPUs is the CPU limit in billionths of a core.
+	NanoCPUs int64
+	// Memory is the memory limit in bytes; swap is not allowed on top of it.
+	Memory int64
+}
+
+// ContainerTracker follows the containers of a run, e.g. to stop them when the run is
+// cancelled while a step is still inside a container.
+type ContainerTracker interface {
+	Track(id string)
+	Untrack(id string)
+}
+
+// PullPolicy decides when a container image is pulled.
+type PullPolicy string
+
+const (
+	PullIfNotPresent PullPolicy = "if-not-present"
+	PullAlways       PullPolicy = "always"
+	// PullNever fails when the image is not present locally.
+	PullNever PullPolicy = "never"
+)
+
+// RegistryAuth holds the credentials for a container registry.
+type RegistryAuth struct {
+	Username      string
+	Password      string
+	ServerAddress string
+}
+
+// Runner executes a command and streams its output to logFn line by line. It returns the
+// exit code, or -1 when the command did not run to completion, and an error for non-zero
+// exits and for cancellation through ctx, which is returned as ctx.Err().
+type Runner interface {
+	Run(ctx context.Context, cfg Config, logFn func(string) error) (int, error)
+}
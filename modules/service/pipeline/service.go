@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -25,27 +26,33 @@ import (
 	cron "github.com/gdgvda/cron"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 
 	"github.com/thepenn/devsys/internal/cache"
+	"github.com/thepenn/devsys/internal/metrics"
 	"github.com/thepenn/devsys/internal/store"
 	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
+	k8ssvc "github.com/thepenn/devsys/service/k8s"
 	"github.com/thepenn/devsys/service/pipeline/queue"
+	pipelineruntime "github.com/thepenn/devsys/service/pipeline/runtime"
 	dockerruntime "github.com/thepenn/devsys/service/pipeline/runtime/docker"
+	hostruntime "github.com/thepenn/devsys/service/pipeline/runtime/host"
 	"github.com/thepenn/devsys/service/pipeline/spec"
 	systemsvc "github.com/thepenn/devsys/service/system"
 )
 
 const pipelineCacheKey = "pipeline:%d"
 
-var envPlaceholderRegex = regexp.MustCompile(`\$\{(?:env\.)?([A-Za-z0-9_]+)\}`)
+// envPlaceholderRegex matches ${VAR}, ${env.VAR} and ${steps.<step>.outputs.<key>}.
+var envPlaceholderRegex = regexp.MustCompile(`\$\{(?:env\.)?([A-Za-z0-9_]+|steps\.[^{}]+?\.outputs\.[A-Za-z0-9_]+)\}`)
 
 // Service orchestrates pipeline lifecycle operations.
 type Service struct {
-	db                *store.DB
+	store             pipelineStore
 	queue             *queue.PipelineQueue
-	cache             *cache.Cache
+	cache             cache.Store
 	workerCount       int
+	maxParallelSteps  int
 	cacheTTL          time.Duration
 	startOnce         sync.Once
 	started           atomic.Bool
@@ -53,37 +60,117 @@ type Service struct {
 	executions        sync.Map
 	systemSvc         *systemsvc.Service
 	scheduler         *cron.Cron
-	cronEntries       map[int64][]cron.ID
+	cronEntries       map[int64][]cronEntry
 	cronMu            sync.Mutex
 	dockerRuntime     *dockerruntime.Runtime
 	dockerRuntimeOnce sync.Once
 	dockerRuntimeErr  error
+	webhooks          WebhookRegistrar
+	contents          RepositoryContentReader
+	// namespaceLockTimeout bounds the wait of a deploy step for its namespace lock.
+	namespaceLockTimeout time.Duration
+	// logLines numbers the log lines of running steps.
+	logLines  logLineAllocator
+	logLimits LogLimits
+	// repoSlots holds back pipelines of repositories that disallow parallel runs.
+	repoSlots repoSlots
+	// provenance signs build provenance of successful pipelines; nil disables it.
+	provenance          *ProvenanceSigner
+	provenanceBuilderID string
+	// artifactRoot stores collected step artifacts; empty uses a directory in the temp dir.
+	artifactRoot   string
+	artifactLimits ArtifactLimits
+	// workspaceCacheLimit bounds the workspace caches under a workspace root.
+	workspaceCacheLimit int64
+	workspaceCacheMu    sync.Mutex
+	// workspaceSoftLimit and workspaceHardLimit are the workspace quota; 0 disables a limit.
+	workspaceSoftLimit int64
+	workspaceHardLimit int64
+	// workspaceUsage is the last workspace scan, reused for workspaceUsageTTL.
+	workspaceUsage     *model.WorkspaceUsage
+	workspaceUsageMu   sync.Mutex
+	workspaceQuotaMu   sync.Mutex
+	workspaceReclaimed time.Time
+	// hostEnv adds names to defaultHostEnv; inheritHostEnv passes the whole server environment.
+	hostEnv        []string
+	inheritHostEnv bool
+	// notifications feeds finished and blocked pipelines to the notifier goroutine.
+	notifications  chan notificationEvent
+	notifyClient   *http.Client
+	notifyBaseURL  string
+	statusReporter ForgeStatusReporter
+	branchHeads    BranchHeadReader
+	// metrics is nil when metrics are not wired in.
+	metrics *metrics.Registry
+	// tenancy scopes certificates and approver groups by repository organization.
+	tenancy bool
+	// approvalSweepInterval is how often timed out approvals are expired.
+	approvalSweepInterval time.Duration
+	// approvalReminderRatio is the part of an approval timeout after which the approvers are
+	// reminded; 0 disables reminders.
+	approvalReminderRatio float64
+	// logRetentionInterval is how often expired logs are purged; 0 disables it.
+	logRetentionInterval time.Duration
+	// shutdownGrace is how long Shutdown waits for running tasks.
+	shutdownGrace time.Duration
+	// stepCeiling caps the resource limits of step containers.
+	stepCeiling StepResources
+	// k8s applies the manifests of built-in deploy steps.
+	k8s *k8ssvc.Service
+	// stopBackground stops the approval sweeper and the log retention started by Start.
+	stopBackground context.CancelFunc
+	// audit records triggers, cancellations, approvals and config changes; nil disables it.
+	audit *audit.Service
+	// agentToken authenticates remote agents; empty runs every task here.
+	agentToken string
+	agents     *agentHub
+	// events pushes run and step changes to the UI.
+	events *eventBus
 }
 
 type Option func(*Service)
 
+// WebhookRegistrar manages forge webhooks when repositories are activated or deactivated.
+type WebhookRegistrar interface {
+	RegisterWebhook(ctx context.Context, userID, repoID int64) error
+	UnregisterWebhook(ctx context.Context, userID, repoID int64) error
+}
+
 type PipelineRunDetail struct {
-	Pipeline  *model.Pipeline
+	Pipeline *model.Pipeline
+	// Workflows hold their steps as Children; Steps lists the same records flat.
 	Workflows []*model.Workflow
 	Steps     []*model.Step
+	// Logs holds the last LogLimits.TailLines lines of each step; LogTotals counts all of them.
 	Logs      map[int64][]model.LogEntry
+	LogTotals map[int64]int64
 }
 
 type pipelineTaskPayload struct {
-	PipelineID    int64              `json:"pipeline_id"`
-	RepoID        int64              `json:"repo_id"`
-	Branch        string             `json:"branch"`
-	Commit        string             `json:"commit"`
-	Steps         []pipelineTaskStep `json:"steps"`
-	RunName       string             `json:"run_name"`
-	RepoURL       string             `json:"repo_url"`
-	RepoClone     string             `json:"repo_clone"`
-	RepoBranch    string             `json:"repo_branch"`
-	WorkspaceRoot string             `json:"workspace_root"`
+	PipelineID    int64                `json:"pipeline_id"`
+	RepoID        int64                `json:"repo_id"`
+	Branch        string               `json:"branch"`
+	Ref           string               `json:"ref,omitempty"`
+	Commit        string               `json:"commit"`
+	Steps         []pipelineTaskStep   `json:"steps"`
+	RunName       string               `json:"run_name"`
+	RepoURL       string               `json:"repo_url"`
+	RepoClone     string               `json:"repo_clone"`
+	RepoBranch    string               `json:"repo_branch"`
+	WorkspaceRoot string               `json:"workspace_root"`
+	Clone         *pipelineCloneConfig `json:"clone,omitempty"`
+	Timeout       int64                `json:"timeout,omitempty"`
+	// Cache lists the container paths kept between runs of the repository.
+	Cache []string `json:"cache,omitempty"`
+	// ConfigSHA256 is the hex sha256 of the pipeline config the run was created from.
+	ConfigSHA256 string `json:"config_sha256,omitempty"`
+	// Workflows lists the workflows of the run in execution order.
+	Workflows []pipelineTaskWorkflow `json:"workflows,omitempty"`
 }
 
 type pipelineTaskStep struct {
 	PID        int                     `json:"pid"`
+	PPID       int                     `json:"ppid,omitempty"`
 	Name       string                  `json:"name"`
 	Image      string                  `json:"image"`
 	Commands   []string                `json:"commands"`
@@ -95,6 +182,27 @@ type pipelineTaskStep struct {
 	Approval   *pipelineApprovalConfig `json:"approval,omitempty"`
 	Plugin     *pipelinePluginConfig   `json:"plugin,omitempty"`
 	Conditions *pipelineStepConditions `json:"conditions,omitempty"`
+	DependsOn  []string                `json:"depends_on,omitempty"`
+	Timeout    int64                   `json:"timeout,omitempty"`
+	Deploy     *pipelineDeployTarget   `json:"deploy,omitempty"`
+	Artifacts  []string                `json:"artifacts,omitempty"`
+	Runtime    spec.StepRuntime        `json:"runtime,omitempty"`
+	Services   []pipelineServiceConfig `json:"services,omitempty"`
+	Pull       spec.PullPolicy         `json:"pull,omitempty"`
+	Build      *pipelineBuildConfig    `json:"build,omitempty"`
+	Resources  *pipelineStepResources  `json:"resources,omitempty"`
+	// IgnoreFailure turns a failure of the step into a soft failure recorded on the step;
+	// AlwaysRun runs it after an earlier step of its workflow failed.
+	IgnoreFailure bool `json:"ignore_failure,omitempty"`
+	AlwaysRun     bool `json:"always_run,omitempty"`
+	// Network is the docker network the step containers join, set while its services run.
+	Network string `json:"-"`
+	// RegistryAuth is resolved from the docker certificates bound to the step when it runs.
+	RegistryAuth *pipelineruntime.RegistryAuth `json:"-"`
+	// Containers labels and follows the step containers so a cancel can stop them.
+	Containers *executionHandle `json:"-"`
+	// Limits are the container resources resolved against the settings when the step runs.
+	Limits StepResources `json:"-"`
 }
 
 type pipelinePluginConfig struct {
@@ -112,19 +220,27 @@ type pipelineApprovalConfig struct {
 
 type pipelineStepConditions struct {
 	Branches []string `json:"branches,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
 }
 
-func (c *pipelineStepConditions) allowsBranch(branch string) bool {
-	if c == nil || len(c.Branches) == 0 {
+// allowsRef reports whether the step runs for a pipeline of branch, or of tag when the
+// pipeline was triggered for a tag. Steps restricted to tags never run for branches; tag
+// pipelines are matched against the branch conditions of steps without tag conditions.
+func (c *pipelineStepConditions) allowsRef(branch, tag string) bool {
+	if c == nil {
 		return true
 	}
-	normalized := strings.TrimSpace(branch)
-	for _, candidate := range c.Branches {
-		if normalized == strings.TrimSpace(candidate) {
-			return true
-		}
+	if tag != "" && len(c.Tags) > 0 {
+		return spec.MatchAny(c.Tags, tag)
 	}
-	return false
+	if len(c.Tags) > 0 && len(c.Branches) == 0 {
+		return false
+	}
+	if len(c.Branches) == 0 {
+		return true
+	}
+	return spec.MatchAny(c.Branches, branch)
 }
 
 func (c *pipelineStepConditions) branchSummary() string {
@@ -134,11 +250,39 @@ func (c *pipelineStepConditions) branchSummary() string {
 	return strings.Join(c.Branches, ", ")
 }
 
-func (step pipelineTaskStep) allowsBranch(branch string) bool {
+func (c *pipelineStepConditions) tagSummary() string {
+	if c == nil || len(c.Tags) == 0 {
+		return ""
+	}
+	return strings.Join(c.Tags, ", ")
+}
+
+func (c *pipelineStepConditions) pathSummary() string {
+	if c == nil || len(c.Paths) == 0 {
+		return ""
+	}
+	return strings.Join(c.Paths, ", ")
+}
+
+// allowsChanges reports whether the step runs for a pipeline that changed files. Steps
+// without path conditions always run; so do all steps when the changes are unknown.
+func (c *pipelineStepConditions) allowsChanges(files []string, known bool) bool {
+	if c == nil || len(c.Paths) == 0 || !known {
+		return true
+	}
+	for _, file := range files {
+		if spec.MatchAny(c.Paths, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (step pipelineTaskStep) allowsRef(branch, tag string) bool {
 	if step.Conditions == nil {
 		return true
 	}
-	return step.Conditions.allowsBranch(branch)
+	return step.Conditions.allowsRef(branch, tag)
 }
 
 type approvalResult int
@@ -151,7 +295,11 @@ const (
 )
 
 type executionHandle struct {
-	cancel context.CancelFunc
+	pipelineID int64
+	cancel     context.CancelFunc
+
+	mu         sync.Mutex
+	containers map[string]struct{}
 }
 
 // EnvTemplate describes a default environment variable exposed to pipeline steps.
@@ -177,6 +325,15 @@ func WithWorkerCount(count int) Option {
 	}
 }
 
+// WithMaxParallelSteps caps how many independent steps of one pipeline run concurrently.
+func WithMaxParallelSteps(count int) Option {
+	return func(s *Service) {
+		if count > 0 {
+			s.maxParallelSteps = count
+		}
+	}
+}
+
 // WithCacheTTL sets a TTL for pipeline cache entries.
 func WithCacheTTL(ttl time.Duration) Option {
 	return func(s *Service) {
@@ -186,7 +343,7 @@ func WithCacheTTL(ttl time.Duration) Option {
 	}
 }
 
-// WithTaskTimeout defines a soft timeout for pipeline execution.
+// WithTaskTimeout sets the pipeline deadline used when the spec defines no timeout.
 func WithTaskTimeout(timeout time.Duration) Option {
 	return func(s *Service) {
 		if timeout > 0 {
@@ -202,15 +359,51 @@ func WithSystemService(system *systemsvc.Service) Option {
 	}
 }
 
-func NewService(db *store.DB, q *queue.PipelineQueue, c *cache.Cache, opts ...Option) *Service {
+// WithWebhookRegistrar registers forge webhooks when a repository becomes active.
+func WithWebhookRegistrar(registrar WebhookRegistrar) Option {
+	return func(s *Service) {
+		s.webhooks = registrar
+	}
+}
+
+// WithRepositoryContentReader reads repository files from the forge for config bootstrapping.
+func WithRepositoryContentReader(reader RepositoryContentReader) Option {
+	return func(s *Service) {
+		s.contents = reader
+	}
+}
+
+// WithAudit records pipeline triggers, cancellations, approvals and config changes.
+func WithAudit(recorder *audit.Service) Option {
+	return func(s *Service) {
+		s.audit = recorder
+	}
+}
+
+func NewService(db *store.DB, q *queue.PipelineQueue, c cache.Store, opts ...Option) *Service {
 	s := &Service{
-		db:             db,
-		queue:          q,
-		cache:          c,
-		workerCount:    runtime.NumCPU(),
-		cacheTTL:       2 * time.Minute,
-		defaultTimeout: 15 * time.Minute,
-		cronEntries:    make(map[int64][]cron.ID),
+		queue:                 q,
+		cache:                 c,
+		workerCount:           runtime.NumCPU(),
+		maxParallelSteps:      runtime.NumCPU(),
+		cacheTTL:              2 * time.Minute,
+		defaultTimeout:        15 * time.Minute,
+		namespaceLockTimeout:  defaultNamespaceLockTimeout,
+		cronEntries:           make(map[int64][]cronEntry),
+		artifactLimits:        defaultArtifactLimits,
+		logLimits:             defaultLogLimits,
+		notifications:         make(chan notificationEvent, notificationQueueSize),
+		notifyClient:          &http.Client{Timeout: notificationTimeout},
+		approvalSweepInterval: defaultApprovalSweepInterval,
+		approvalReminderRatio: defaultApprovalReminderRatio,
+		logRetentionInterval:  defaultLogRetentionInterval,
+		shutdownGrace:         defaultShutdownGracePeriod,
+		agents:                newAgentHub(),
+		events:                newEventBus(),
+	}
+
+	if db != nil {
+		s.store = newGormPipelineStore(db)
 	}
 
 	for _, opt := range opts {
@@ -225,19 +418,33 @@ func (s *Service) Start(ctx context.Context) error {
 	var startErr error
 	s.startOnce.Do(func() {
 		if s.queue == nil {
-			startErr = fmt.Errorf("pipeline queue not configured")
+			startErr = s.queueUnavailableError()
 			return
 		}
 
-		if err := s.queue.Start(ctx, s.workerCount, s.handleTask); err != nil {
+		// before the workers start, so no container of this process is mistaken for an orphan
+		s.cleanupOrphanedContainers(ctx)
+
+		if err := s.queue.Start(ctx, s.workerCount, s.executeTask); err != nil {
 			startErr = err
 			return
 		}
+		// the queue only lives in memory; refill it from the persisted tasks without
+		// blocking startup when there are more of them than the queue holds
+		go s.recoverTasks(ctx)
+		go s.runNotifier(ctx)
+
+		sweepCtx, stopSweep := context.WithCancel(ctx)
+		s.stopBackground = stopSweep
+		go s.runApprovalSweeper(sweepCtx)
+		if s.logRetentionInterval > 0 {
+			go s.runLogRetention(sweepCtx)
+		}
 
 		scheduler := cron.New()
 		s.cronMu.Lock()
 		s.scheduler = scheduler
-		s.cronEntries = make(map[int64][]cron.ID)
+		s.cronEntries = make(map[int64][]cronEntry)
 		s.cronMu.Unlock()
 
 		if err := s.reloadCronSchedules(ctx); err != nil {
@@ -267,7 +474,7 @@ func (s *Service) Shutdown() {
 	s.cronMu.Lock()
 	scheduler = s.scheduler
 	s.scheduler = nil
-	s.cronEntries = make(map[int64][]cron.ID)
+	s.cronEntries = make(map[int64][]cronEntry)
 	s.cronMu.Unlock()
 
 	if scheduler != nil {
@@ -275,6 +482,11 @@ func (s *Service) Shutdown() {
 		<-stopCtx.Done()
 	}
 
+	if s.stopBackground != nil {
+		s.stopBackground()
+	}
+
+	s.drainQueue()
 	if s.queue != nil {
 		s.queue.Shutdown()
 	}
@@ -286,101 +498,67 @@ func (s *Service) CreatePipeline(ctx context.Context, pipeline *model.Pipeline,
 		return fmt.Errorf("pipeline is required")
 	}
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		if pipeline.Number == 0 {
-			if err := tx.WithContext(ctx).
-				Table("repos").
-				Select("id").
-				Where("id = ?", pipeline.RepoID).
-				Clauses(clause.Locking{Strength: "UPDATE"}).
-				Take(&struct{ ID int64 }{}).Error; err != nil {
-				return err
-			}
-
-			var nextNumber int64
-			if err := tx.WithContext(ctx).
-				Model(&model.Pipeline{}).
-				Where("repo_id = ?", pipeline.RepoID).
-				Select("COALESCE(MAX(number), 0)").
-				Scan(&nextNumber).Error; err != nil {
-				return err
-			}
-			pipeline.Number = nextNumber + 1
-		}
-
-		if err := tx.WithContext(ctx).Create(pipeline).Error; err != nil {
-			return err
-		}
-
-		if len(workflows) > 0 {
-			for _, wf := range workflows {
-				wf.PipelineID = pipeline.ID
-			}
-			if err := tx.WithContext(ctx).Create(&workflows).Error; err != nil {
-				return err
-			}
-		}
-
-		if len(steps) > 0 {
-			for _, step := range steps {
-				step.PipelineID = pipeline.ID
-			}
-			if err := tx.WithContext(ctx).Create(&steps).Error; err != nil {
-				return err
-			}
-		}
-
-		if len(tasks) > 0 {
-			for _, task := range tasks {
-				task.PipelineID = pipeline.ID
-				task.RepoID = pipeline.RepoID
-				if strings.TrimSpace(task.Name) == "" {
-					task.Name = fmt.Sprintf("pipeline-%d", pipeline.Number)
-				}
-			}
-			if err := tx.WithContext(ctx).Create(&tasks).Error; err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
+	err := s.store.CreatePipelineGraph(ctx, pipeline, workflows, steps, tasks)
 	if err != nil {
 		return err
 	}
 
 	if s.cache != nil && s.cacheTTL > 0 {
-		s.cache.Set(fmt.Sprintf(pipelineCacheKey, pipeline.ID), pipeline, s.cacheTTL)
+		s.cache.Set(fmt.Sprintf(pipelineCacheKey, pipeline.ID), newCachedPipeline(pipeline), s.cacheTTL)
 	}
+	s.publishPipelineCreated(pipeline)
 
 	return nil
 }
 
+// Available reports whether the pipeline subsystem has the dependencies required to run pipelines.
+func (s *Service) Available() bool {
+	return s != nil && s.store != nil && s.queue != nil
+}
+
+func (s *Service) queueUnavailableError() error {
+	return model.NewFeatureUnavailableError(model.CapabilityPipeline, "pipeline queue not configured")
+}
+
 // EnqueueTask schedules a pipeline task for execution.
 func (s *Service) EnqueueTask(ctx context.Context, task *model.Task) error {
 	if task == nil {
 		return fmt.Errorf("task is required")
 	}
+	if s.queue == nil {
+		return s.queueUnavailableError()
+	}
 
 	return s.queue.Enqueue(ctx, task)
 }
 
+// cachedPipeline is the cache entry of a pipeline. The JSON form of model.Pipeline hides the
+// repository id, which a cache kept outside the process must not lose.
+type cachedPipeline struct {
+	*model.Pipeline
+	RepoID int64 `json:"repo_id"`
+}
+
+func newCachedPipeline(pipeline *model.Pipeline) cachedPipeline {
+	return cachedPipeline{Pipeline: pipeline, RepoID: pipeline.RepoID}
+}
+
+func (c cachedPipeline) restore() *model.Pipeline {
+	c.Pipeline.RepoID = c.RepoID
+	return c.Pipeline
+}
+
 // GetPipeline fetches a pipeline from cache or database.
 func (s *Service) GetPipeline(ctx context.Context, id int64) (*model.Pipeline, error) {
 	cacheKey := fmt.Sprintf(pipelineCacheKey, id)
 	if s.cache != nil {
-		if cached, ok := s.cache.Get(cacheKey); ok {
-			if pipeline, ok := cached.(*model.Pipeline); ok {
-				return pipeline, nil
-			}
+		var cached cachedPipeline
+		if s.cache.Get(cacheKey, &cached) && cached.Pipeline != nil {
+			return cached.restore(), nil
 		}
 	}
 
-	var pipeline model.Pipeline
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&pipeline, id).Error
-	})
-
+	pipeline, err := s.store.GetPipeline(ctx, id)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, nil
 	}
@@ -389,27 +567,22 @@ func (s *Service) GetPipeline(ctx context.Context, id int64) (*model.Pipeline, e
 	}
 
 	if s.cache != nil && s.cacheTTL > 0 {
-		s.cache.Set(cacheKey, &pipeline, s.cacheTTL)
+		s.cache.Set(cacheKey, newCachedPipeline(pipeline), s.cacheTTL)
 	}
 
-	return &pipeline, nil
+	return pipeline, nil
 }
 
 // GetPipelineConfig returns the stored pipeline configuration for a repository.
 func (s *Service) GetPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
-	var cfg model.RepoPipelineConfig
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Where("repo_id = ?", repoID).
-			Take(&cfg).Error
-	})
+	cfg, err := s.store.GetPipelineConfig(ctx, repoID)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return normalizePipelineConfig(&cfg), nil
+	return normalizePipelineConfig(cfg), nil
 }
 
 // EnsurePipelineConfig guarantees a repository has a persisted pipeline configuration.
@@ -426,56 +599,90 @@ func (s *Service) EnsurePipelineConfig(ctx context.Context, repo *model.Repo) (*
 		return cfg, nil
 	}
 
-	return s.UpsertPipelineConfig(ctx, repo.ID, "")
+	cfg, err = s.UpsertPipelineConfig(ctx, repo.ID, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	// saving the first config activates the repository
+	repo.IsActive = true
+	return cfg, nil
+}
+
+// PipelineConfigWarnings lints a pipeline config and trigger variables for entries that shadow
+// reserved environment variables. Configs that fail to parse yield no warnings.
+func PipelineConfigWarnings(content string, variables map[string]string) []string {
+	var warnings []string
+	if strings.TrimSpace(content) != "" {
+		if specDef, err := spec.Parse(content); err == nil {
+			warnings = append(warnings, specDef.Warnings()...)
+		}
+	}
+	return append(warnings, spec.VariableWarnings(variables)...)
 }
 
 // UpsertPipelineConfig creates or updates the pipeline configuration for the given repository.
-func (s *Service) UpsertPipelineConfig(ctx context.Context, repoID int64, content string) (*model.RepoPipelineConfig, error) {
-	now := time.Now().Unix()
-	var result *model.RepoPipelineConfig
+// A changed content is saved as a new revision by author with an optional message.
+func (s *Service) UpsertPipelineConfig(ctx context.Context, repoID int64, content, author, message string) (*model.RepoPipelineConfig, error) {
+	return s.savePipelineConfig(ctx, repoID, content, model.RepoPipelineConfigRevision{
+		Author:  strings.TrimSpace(author),
+		Message: strings.TrimSpace(message),
+	})
+}
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		var existing model.RepoPipelineConfig
-		err := tx.WithContext(ctx).
-			Where("repo_id = ?", repoID).
-			Take(&existing).Error
-		switch {
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			cfg := defaultPipelineSettings()
-			cfg.RepoID = repoID
+// savePipelineConfig stores content and records it as revision in the same transaction.
+func (s *Service) savePipelineConfig(ctx context.Context, repoID int64, content string, revision model.RepoPipelineConfigRevision) (*model.RepoPipelineConfig, error) {
+	if err := s.validatePipelineContent(ctx, repoID, content); err != nil {
+		return nil, err
+	}
+	result, repo, err := s.store.SavePipelineConfig(ctx, repoID, pipelineConfigChange{
+		now: time.Now().Unix(),
+		edit: func(cfg *model.RepoPipelineConfig) {
 			cfg.Content = content
-			cfg.Created = now
-			cfg.Updated = now
-			if err := tx.WithContext(ctx).Create(cfg).Error; err != nil {
-				return err
-			}
-			result = cfg
-		case err != nil:
-			return err
-		default:
-			existing.Content = content
-			existing.Updated = now
-			if err := tx.WithContext(ctx).Save(&existing).Error; err != nil {
-				return err
-			}
-			result = &existing
-		}
-		if err := tx.WithContext(ctx).
-			Model(&model.Repo{}).
-			Where("id = ?", repoID).
-			Update("active", true).Error; err != nil {
-			return err
-		}
-		return nil
+		},
+		revision: &revision,
+		activate: func(*model.RepoPipelineConfig) bool { return true },
 	})
 	if err != nil {
 		return nil, err
 	}
+	if !repo.IsActive && s.webhooks != nil {
+		if err := s.webhooks.RegisterWebhook(ctx, repo.UserID, repoID); err != nil {
+			if resetErr := s.setRepoActive(ctx, repoID, false); resetErr != nil {
+				log.Warn().Err(resetErr).Int64("repo_id", repoID).Msg("failed to revert repository activation")
+			}
+			return nil, fmt.Errorf("注册仓库 Webhook 失败: %w", err)
+		}
+	}
 	normalized := normalizePipelineConfig(result)
 	s.refreshCronEntries(repoID, normalized.CronSchedules)
+	s.audit.Record(ctx, model.AuditActionConfigUpdate, model.AuditResourceConfig, strconv.FormatInt(repoID, 10), repoID, map[string]interface{}{
+		"config_sha256": configSHA256(content),
+		"version":       normalized.Version,
+	})
 	return normalized, nil
 }
 
+// DeactivateRepository disables pipelines for a repository, removing its cron entries and forge webhook.
+func (s *Service) DeactivateRepository(ctx context.Context, repo *model.Repo) error {
+	if repo == nil {
+		return fmt.Errorf("repository is required")
+	}
+	if s.webhooks != nil && strings.TrimSpace(repo.WebhookID) != "" {
+		if err := s.webhooks.UnregisterWebhook(ctx, repo.UserID, repo.ID); err != nil {
+			return fmt.Errorf("删除仓库 Webhook 失败: %w", err)
+		}
+	}
+	if err := s.setRepoActive(ctx, repo.ID, false); err != nil {
+		return err
+	}
+	s.refreshCronEntries(repo.ID, nil)
+	return nil
+}
+
+func (s *Service) setRepoActive(ctx context.Context, repoID int64, active bool) error {
+	return s.store.SetRepoActive(ctx, repoID, active)
+}
+
 // TriggerManualPipeline stores a pipeline record representing a manual run against the provided configuration.
 func (s *Service) TriggerManualPipeline(ctx context.Context, repo *model.Repo, author string, opts model.PipelineOptions, cfg *model.RepoPipelineConfig) (*model.Pipeline, error) {
 	normalizedAuthor := strings.TrimSpace(author)
@@ -491,29 +698,50 @@ func (s *Service) triggerPipelineWithEvent(ctx context.Context, repo *model.Repo
 	if repo == nil {
 		return nil, fmt.Errorf("repository is required")
 	}
-	if cfg == nil || strings.TrimSpace(cfg.Content) == "" {
-		return nil, fmt.Errorf("pipeline configuration missing")
+	ref := normalizePipelineRef(opts.Ref)
+	content, snapshot, err := s.resolvePipelineContent(ctx, repo, cfg, ref, pipelineRunBranch(repo, ref, opts.Branch), opts.Commit)
+	if err != nil {
+		return nil, err
 	}
+	return s.triggerPipelineWithContent(ctx, repo, cfg, content, snapshot, opts, event, author, message, title)
+}
 
-	normalizedAuthor := strings.TrimSpace(author)
-	if normalizedAuthor == "" {
-		normalizedAuthor = "system"
+// pipelineRunBranch returns the branch a run of ref is recorded against: the branch of a
+// branch ref, else the requested branch, else the repository default.
+func pipelineRunBranch(repo *model.Repo, ref, branch string) string {
+	branch = strings.TrimSpace(branch)
+	if refBranch := branchFromRef(ref); refBranch != "" {
+		branch = refBranch
 	}
-
-	now := time.Now().Unix()
-	branch := strings.TrimSpace(opts.Branch)
 	if branch == "" {
 		branch = strings.TrimSpace(repo.Branch)
 		if branch == "" {
 			branch = "main"
 		}
 	}
+	return branch
+}
+
+// triggerPipelineWithContent stores and enqueues a run of the definition content, resolved
+// from cfg by resolvePipelineContent. snapshot keeps content on the run.
+func (s *Service) triggerPipelineWithContent(ctx context.Context, repo *model.Repo, cfg *model.RepoPipelineConfig, content string, snapshot bool, opts model.PipelineOptions, event model.WebhookEvent, author, message, title string) (*model.Pipeline, error) {
+	if !repo.IsActive {
+		return nil, ErrRepoInactive
+	}
+	normalizedAuthor := strings.TrimSpace(author)
+	if normalizedAuthor == "" {
+		normalizedAuthor = "system"
+	}
+
+	now := time.Now().Unix()
+	ref := normalizePipelineRef(opts.Ref)
+	branch := pipelineRunBranch(repo, ref, opts.Branch)
 
 	if opts.Variables == nil {
 		opts.Variables = map[string]string{}
 	}
 
-	specDef, err := spec.Parse(cfg.Content)
+	specDef, err := spec.Parse(content)
 	if err != nil {
 		return nil, err
 	}
@@ -537,94 +765,173 @@ func (s *Service) triggerPipelineWithEvent(ctx context.Context, repo *model.Repo
 		Created:             now,
 		Updated:             now,
 		Branch:              branch,
-		Ref:                 fmt.Sprintf("refs/heads/%s", branch),
+		Ref:                 firstNonEmpty(ref, fmt.Sprintf("refs/heads/%s", branch)),
 		Commit:              strings.TrimSpace(opts.Commit),
 		AdditionalVariables: opts.Variables,
+		ChangedFiles:        opts.ChangedFiles,
+		ConfigHash:          configSHA256(content),
+		ConfigVersion:       cfg.Version,
 	}
-
-	workflow := &model.Workflow{
-		PID:   1,
-		Name:  firstNonEmpty(specDef.Name, "default"),
-		State: model.StatusPending,
+	if snapshot {
+		// the file may change before a rerun; the version only tracks stored content
+		pipeline.ConfigContent = content
+		pipeline.ConfigVersion = 0
+	}
+	if reason := s.pipelineSkipReason(ctx, repo, specDef, pipeline, message); reason != "" {
+		return s.recordSkippedPipeline(ctx, repo, pipeline, reason)
 	}
 
+	workflowOrder, err := spec.WorkflowOrder(specDef.Workflows)
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := s.stepPlugins(ctx, specDef.Steps)
+	if err != nil {
+		return nil, err
+	}
+	workflows := make([]*model.Workflow, 0, len(specDef.Workflows))
+	taskWorkflows := make([]pipelineTaskWorkflow, len(specDef.Workflows))
 	steps := make([]*model.Step, 0, len(specDef.Steps))
 	taskSteps := make([]pipelineTaskStep, 0, len(specDef.Steps))
-	for idx, stepSpec := range specDef.Steps {
-		pid := idx + 1
-		stepName := stepSpec.Name
-		if stepName == "" {
-			stepName = fmt.Sprintf("step-%d", pid)
-		}
-		stepType := model.StepTypeCommands
-		var approvalModel *model.StepApproval
-		var approvalTaskCfg *pipelineApprovalConfig
-		if stepSpec.Kind == spec.StepKindApproval {
-			stepType = model.StepTypeApproval
-			strategy := model.StepApprovalStrategyAny
-			if stepSpec.Approval != nil && strings.ToLower(strings.TrimSpace(stepSpec.Approval.Strategy)) == string(model.StepApprovalStrategyAll) {
-				strategy = model.StepApprovalStrategyAll
-			}
-			approvalModel = &model.StepApproval{
-				Message:   "",
-				Approvers: nil,
-				Strategy:  strategy,
-				Timeout:   0,
-				State:     model.StepApprovalStatePending,
-			}
-			if stepSpec.Approval != nil {
-				approvalModel.Message = stepSpec.Approval.Message
-				if len(stepSpec.Approval.Approvers) > 0 {
-					approvalModel.Approvers = append([]string{}, stepSpec.Approval.Approvers...)
+	for wfIdx, workflowSpec := range specDef.Workflows {
+		workflow := &model.Workflow{
+			PID:   wfIdx + 1,
+			Name:  workflowSpec.Name,
+			State: model.StatusPending,
+		}
+		workflows = append(workflows, workflow)
+		for pos, idx := range workflowOrder {
+			if idx == wfIdx {
+				taskWorkflows[pos] = pipelineTaskWorkflow{
+					PID:       workflow.PID,
+					Name:      workflow.Name,
+					DependsOn: append([]string{}, workflowSpec.DependsOn...),
+				}
+			}
+		}
+		for _, stepSpec := range workflowSpec.Steps {
+			pid := len(steps) + 1
+			stepName := stepSpec.Name
+			if stepName == "" {
+				stepName = fmt.Sprintf("step-%d", pid)
+			}
+			stepType := model.StepTypeCommands
+			var approvalModel *model.StepApproval
+			var approvalTaskCfg *pipelineApprovalConfig
+			if stepSpec.Kind == spec.StepKindDeploy {
+				stepType = model.StepTypeDeploy
+			}
+			if stepSpec.Kind == spec.StepKindBuild {
+				stepType = model.StepTypeBuild
+			}
+			if stepSpec.Kind == spec.StepKindApproval {
+				stepType = model.StepTypeApproval
+				strategy := model.StepApprovalStrategyAny
+				if stepSpec.Approval != nil && strings.ToLower(strings.TrimSpace(stepSpec.Approval.Strategy)) == string(model.StepApprovalStrategyAll) {
+					strategy = model.StepApprovalStrategyAll
+				}
+				approvalModel = &model.StepApproval{
+					Message:   "",
+					Approvers: nil,
+					Strategy:  strategy,
+					Timeout:   0,
+					State:     model.StepApprovalStatePending,
 				}
-				if stepSpec.Approval.Timeout > 0 {
-					approvalModel.Timeout = stepSpec.Approval.Timeout
+				if stepSpec.Approval != nil {
+					approvalModel.Message = stepSpec.Approval.Message
+					if len(stepSpec.Approval.Approvers) > 0 {
+						approvalModel.Approvers = append([]string{}, stepSpec.Approval.Approvers...)
+					}
+					if stepSpec.Approval.Timeout > 0 {
+						approvalModel.Timeout = stepSpec.Approval.Timeout
+					}
+				}
+				approvalTaskCfg = &pipelineApprovalConfig{
+					Message:   approvalModel.Message,
+					Approvers: append([]string{}, approvalModel.Approvers...),
+					Timeout:   approvalModel.Timeout,
+					Strategy:  approvalModel.Strategy,
 				}
 			}
-			approvalTaskCfg = &pipelineApprovalConfig{
-				Message:   approvalModel.Message,
-				Approvers: append([]string{}, approvalModel.Approvers...),
-				Timeout:   approvalModel.Timeout,
-				Strategy:  approvalModel.Strategy,
-			}
-		}
-		steps = append(steps, &model.Step{
-			UUID:     generateRandomID("step"),
-			PID:      pid,
-			PPID:     workflow.PID,
-			Name:     stepName,
-			State:    model.StatusPending,
-			Type:     stepType,
-			Approval: approvalModel,
-		})
-		pluginCfg, err := buildPipelinePluginConfig(stepSpec)
-		if err != nil {
-			return nil, err
+			var pluginRef string
+			if stepSpec.Plugin != "" {
+				// the definition may have changed since the config was saved
+				resolved, plugin, issues := resolvePluginStep(stepSpec, plugins)
+				if len(issues) > 0 {
+					return nil, pluginStepError(stepSpec, issues)
+				}
+				stepSpec = resolved
+				stepType = model.StepTypePlugin
+				pluginRef = plugin.Ref()
+			}
+			steps = append(steps, &model.Step{
+				UUID:     generateRandomID("step"),
+				PID:      pid,
+				PPID:     workflow.PID,
+				Name:     stepName,
+				State:    model.StatusPending,
+				Type:     stepType,
+				Approval: approvalModel,
+				Plugin:   pluginRef,
+			})
+			pluginCfg, err := buildPipelinePluginConfig(stepSpec)
+			if err != nil {
+				return nil, err
+			}
+			var stepEnvVars map[string]string
+			if len(stepSpec.Env) > 0 {
+				stepEnvVars = cloneStringMap(stepSpec.Env)
+			}
+			var stepConditions *pipelineStepConditions
+			if stepSpec.Conditions != nil {
+				stepConditions = newPipelineStepConditions(stepSpec.Conditions)
+			}
+			var deployTarget *pipelineDeployTarget
+			if stepSpec.Deploy != nil {
+				deployTarget = &pipelineDeployTarget{
+					Cluster:      stepSpec.Deploy.Cluster,
+					Namespace:    stepSpec.Deploy.Namespace,
+					Manifest:     stepSpec.Deploy.Manifest,
+					ManifestFile: stepSpec.Deploy.ManifestFile,
+					WaitReady:    stepSpec.Deploy.WaitReady,
+				}
+				if set := stepSpec.Deploy.SetImage; set != nil {
+					deployTarget.SetImage = &pipelineDeployImage{
+						Kind:      set.Kind,
+						Name:      set.Name,
+						Container: set.Container,
+						Image:     set.Image,
+					}
+				}
+			}
+			taskSteps = append(taskSteps, pipelineTaskStep{
+				PID:        pid,
+				PPID:       workflow.PID,
+				Name:       stepName,
+				Image:      stepSpec.Image,
+				Commands:   append([]string{}, stepSpec.Commands...),
+				Secrets:    stepSpec.Secrets,
+				Env:        stepEnvVars,
+				Volumes:    append([]string{}, stepSpec.Volumes...),
+				Privileged: stepSpec.Privileged,
+				Type:       stepType,
+				Approval:   approvalTaskCfg,
+				Plugin:     pluginCfg,
+				Conditions: stepConditions,
+				DependsOn:  append([]string{}, stepSpec.DependsOn...),
+				Timeout:    int64(stepSpec.Timeout / time.Second),
+				Deploy:     deployTarget,
+				Artifacts:  append([]string{}, stepSpec.Artifacts...),
+				Runtime:    stepSpec.Runtime,
+				Services:   newPipelineServiceConfigs(stepSpec.Services),
+				Pull:       stepSpec.Pull,
+				Build:      newPipelineBuildConfig(stepSpec.Build),
+				Resources:  newPipelineStepResources(stepSpec.Resources),
+
+				IgnoreFailure: stepSpec.IgnoreFailure,
+				AlwaysRun:     stepSpec.AlwaysRun,
+			})
 		}
-		var stepEnvVars map[string]string
-		if len(stepSpec.Env) > 0 {
-			stepEnvVars = cloneStringMap(stepSpec.Env)
-		}
-		var stepConditions *pipelineStepConditions
-		if stepSpec.Conditions != nil && len(stepSpec.Conditions.Branches) > 0 {
-			stepConditions = &pipelineStepConditions{
-				Branches: append([]string{}, stepSpec.Conditions.Branches...),
-			}
-		}
-		taskSteps = append(taskSteps, pipelineTaskStep{
-			PID:        pid,
-			Name:       stepName,
-			Image:      stepSpec.Image,
-			Commands:   append([]string{}, stepSpec.Commands...),
-			Secrets:    stepSpec.Secrets,
-			Env:        stepEnvVars,
-			Volumes:    append([]string{}, stepSpec.Volumes...),
-			Privileged: stepSpec.Privileged,
-			Type:       stepType,
-			Approval:   approvalTaskCfg,
-			Plugin:     pluginCfg,
-			Conditions: stepConditions,
-		})
 	}
 
 	task := &model.Task{
@@ -635,26 +942,42 @@ func (s *Service) triggerPipelineWithEvent(ctx context.Context, repo *model.Repo
 		RunOn:        []string{string(model.StatusSuccess)},
 		DepStatus:    map[string]model.StatusValue{},
 		Labels:       map[string]string{},
+		Priority:     opts.Priority,
+		RunAfter:     opts.RunAfter,
 	}
 	if err := task.ApplyLabelsFromRepo(repo); err != nil {
 		log.Warn().Err(err).Msg("failed to apply labels to task")
 	}
 
-	if err := s.CreatePipeline(ctx, pipeline, []*model.Workflow{workflow}, steps, []*model.Task{task}); err != nil {
+	if err := s.CreatePipeline(ctx, pipeline, workflows, steps, []*model.Task{task}); err != nil {
 		return nil, err
 	}
+	s.savePipelineSnapshot(ctx, repo, cfg, pipeline, content, snapshot)
 
 	payload := pipelineTaskPayload{
 		PipelineID:    pipeline.ID,
 		RepoID:        repo.ID,
 		Branch:        branch,
+		Ref:           pipeline.Ref,
 		Commit:        pipeline.Commit,
-		RunName:       workflow.Name,
+		RunName:       firstNonEmpty(specDef.Name, workflows[0].Name),
 		RepoURL:       repo.ForgeURL,
 		RepoClone:     repo.Clone,
 		RepoBranch:    repo.Branch,
 		WorkspaceRoot: specDef.Workspace,
 		Steps:         taskSteps,
+		Timeout:       int64(specDef.Timeout / time.Second),
+		Cache:         specDef.Cache,
+		ConfigSHA256:  pipeline.ConfigHash,
+		Workflows:     taskWorkflows,
+	}
+	if specDef.Clone != nil {
+		payload.Clone = &pipelineCloneConfig{
+			LFS:        specDef.Clone.LFS,
+			Depth:      specDef.Clone.Depth,
+			Submodules: specDef.Clone.Submodules,
+			FetchTags:  specDef.Clone.FetchTags,
+		}
 	}
 
 	payloadBytes, err := json.Marshal(payload)
@@ -662,29 +985,23 @@ func (s *Service) triggerPipelineWithEvent(ctx context.Context, repo *model.Repo
 		return nil, fmt.Errorf("序列化流水线任务失败: %w", err)
 	}
 
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Task{}).
-			Where("id = ?", task.ID).
-			Update("data", payloadBytes).Error
-	}); err != nil {
+	if err := s.store.UpdateTaskData(ctx, task.ID, payloadBytes); err != nil {
 		return nil, err
 	}
 	task.Data = payloadBytes
 
 	if err := s.EnqueueTask(ctx, task); err != nil {
 		log.Error().Err(err).Int64("pipeline_id", pipeline.ID).Str("event", string(event)).Msg("failed to enqueue pipeline task")
-		_ = s.db.Transaction(func(tx *gorm.DB) error {
-			return tx.WithContext(ctx).
-				Model(&model.Pipeline{}).
-				Where("id = ?", pipeline.ID).
-				Updates(map[string]any{
-					"status":  model.StatusFailure,
-					"message": fmt.Sprintf("failed to enqueue pipeline task: %v", err),
-				}).Error
-		})
+		_ = s.markPipelineFinished(ctx, pipeline.ID, model.StatusFailure, time.Now().Unix(), fmt.Sprintf("failed to enqueue pipeline task: %v", err), "")
 		return nil, err
 	}
+	s.audit.RecordAs(ctx, firstNonEmpty(audit.ActorFromContext(ctx), normalizedAuthor), model.AuditActionPipelineTrigger, model.AuditResourcePipeline, strconv.FormatInt(pipeline.ID, 10), repo.ID, map[string]interface{}{
+		"number": pipeline.Number,
+		"event":  string(event),
+		"branch": pipeline.Branch,
+		"ref":    pipeline.Ref,
+		"commit": pipeline.Commit,
+	})
 
 	if settings, err := s.GetPipelineSettings(ctx, repo.ID); err != nil {
 		log.Warn().Err(err).Int64("repo_id", repo.ID).Msg("failed to load pipeline settings for retention")
@@ -703,8 +1020,9 @@ func (s *Service) triggerPipelineWithEvent(ctx context.Context, repo *model.Repo
 	return pipeline, nil
 }
 
-// ListPipelinesByRepo returns pipelines belonging to a repository ordered by creation time descending.
-func (s *Service) ListPipelinesByRepo(ctx context.Context, repoID int64, page, perPage int) ([]*model.Pipeline, int64, error) {
+// ListPipelinesByRepo returns pipelines belonging to a repository matching filter ordered by
+// creation time descending.
+func (s *Service) ListPipelinesByRepo(ctx context.Context, repoID int64, page, perPage int, filter model.PipelineFilter) ([]*model.Pipeline, int64, error) {
 	if page <= 0 {
 		page = 1
 	}
@@ -714,22 +1032,7 @@ func (s *Service) ListPipelinesByRepo(ctx context.Context, repoID int64, page, p
 		perPage = 100
 	}
 
-	var pipelines []*model.Pipeline
-	var total int64
-
-	err := s.db.View(func(tx *gorm.DB) error {
-		query := tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("repo_id = ?", repoID)
-		if err := query.Count(&total).Error; err != nil {
-			return err
-		}
-		return query.
-			Order("created DESC").
-			Offset((page - 1) * perPage).
-			Limit(perPage).
-			Find(&pipelines).Error
-	})
+	pipelines, total, err := s.store.ListPipelines(ctx, repoID, filter, (page-1)*perPage, perPage)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -745,6 +1048,19 @@ func (s *Service) ListPipelinesByRepo(ctx context.Context, repoID int64, page, p
 	return pipelines, total, nil
 }
 
+// LatestPipeline returns the newest pipeline of a repository matching filter, or nil when none
+// matches.
+func (s *Service) LatestPipeline(ctx context.Context, repoID int64, filter model.PipelineFilter) (*model.Pipeline, error) {
+	pipelines, _, err := s.ListPipelinesByRepo(ctx, repoID, 1, 1, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(pipelines) == 0 {
+		return nil, nil
+	}
+	return pipelines[0], nil
+}
+
 // GetPipelineSettings returns repository level pipeline settings.
 func (s *Service) GetPipelineSettings(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
 	cfg, err := s.GetPipelineConfig(ctx, repoID)
@@ -761,25 +1077,31 @@ func (s *Service) GetPipelineSettings(ctx context.Context, repoID int64) (*model
 
 // UpsertPipelineSettings stores repository pipeline settings.
 func (s *Service) UpsertPipelineSettings(ctx context.Context, repoID int64, settings model.RepoPipelineConfig) (*model.RepoPipelineConfig, error) {
-	now := time.Now().Unix()
+	configSource, configFile, err := s.normalizeConfigSource(settings.ConfigSource, settings.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	stepCPU, stepMemory, err := s.normalizeStepResources(settings.StepCPU, settings.StepMemory)
+	if err != nil {
+		return nil, err
+	}
 	schedules := sanitizeCronSchedules(settings.CronSchedules)
-	var result *model.RepoPipelineConfig
-
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		var existing model.RepoPipelineConfig
-		err := tx.WithContext(ctx).
-			Where("repo_id = ?", repoID).
-			Take(&existing).Error
-		switch {
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			cfg := defaultPipelineSettings()
-			cfg.RepoID = repoID
-			cfg.Content = ""
+	result, _, err := s.store.SavePipelineConfig(ctx, repoID, pipelineConfigChange{
+		now: time.Now().Unix(),
+		edit: func(cfg *model.RepoPipelineConfig) {
+			cfg.ConfigSource = configSource
+			cfg.ConfigFile = configFile
 			cfg.CleanupEnabled = settings.CleanupEnabled
 			cfg.RetentionDays = settings.RetentionDays
 			cfg.MaxRecords = settings.MaxRecords
 			cfg.DisallowParallel = settings.DisallowParallel
+			cfg.ReportCommitStatus = settings.ReportCommitStatus
+			cfg.LogRetentionDays = max(settings.LogRetentionDays, 0)
+			cfg.PublicStatus = settings.PublicStatus
+			cfg.PublicMessages = settings.PublicMessages
 			cfg.Dockerfile = settings.Dockerfile
+			cfg.StepCPU = stepCPU
+			cfg.StepMemory = stepMemory
 			cfg.CronSchedules = schedules
 			cfg.LegacyCronEnabled = len(schedules) > 0
 			if len(schedules) > 0 {
@@ -787,99 +1109,36 @@ func (s *Service) UpsertPipelineSettings(ctx context.Context, repoID int64, sett
 			} else {
 				cfg.LegacyCronSpec = ""
 			}
-			cfg.Created = now
-			cfg.Updated = now
-			if err := tx.WithContext(ctx).Create(cfg).Error; err != nil {
-				return err
-			}
-			result = cfg
-		case err != nil:
-			return err
-		default:
-			existing.CleanupEnabled = settings.CleanupEnabled
-			existing.RetentionDays = settings.RetentionDays
-			existing.MaxRecords = settings.MaxRecords
-			existing.DisallowParallel = settings.DisallowParallel
-			existing.Dockerfile = settings.Dockerfile
-			existing.CronSchedules = schedules
-			existing.LegacyCronEnabled = len(schedules) > 0
-			if len(schedules) > 0 {
-				existing.LegacyCronSpec = schedules[0]
-			} else {
-				existing.LegacyCronSpec = ""
-			}
-			existing.Updated = now
-			if err := tx.WithContext(ctx).Save(&existing).Error; err != nil {
-				return err
-			}
-			result = &existing
-		}
-		return nil
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
+	s.audit.Record(ctx, model.AuditActionSettingsUpdate, model.AuditResourceConfig, strconv.FormatInt(repoID, 10), repoID, map[string]interface{}{
+		"cleanup_enabled":      result.CleanupEnabled,
+		"retention_days":       result.RetentionDays,
+		"max_records":          result.MaxRecords,
+		"disallow_parallel":    result.DisallowParallel,
+		"cron_schedules":       schedules,
+		"config_source":        result.ConfigSource,
+		"config_file":          result.ConfigFile,
+		"step_cpu":             result.StepCPU,
+		"step_memory":          result.StepMemory,
+		"report_commit_status": result.ReportCommitStatus,
+		"log_retention_days":   result.LogRetentionDays,
+		"public_status":        result.PublicStatus,
+		"public_messages":      result.PublicMessages,
+	})
 	return normalizePipelineConfig(result), nil
 }
 
 // GetPipelineRunDetail returns pipeline, workflow, step and log information for a specific run.
 func (s *Service) GetPipelineRunDetail(ctx context.Context, repoID, pipelineID int64) (*PipelineRunDetail, error) {
-	detail := &PipelineRunDetail{
-		Workflows: []*model.Workflow{},
-		Steps:     []*model.Step{},
-		Logs:      map[int64][]model.LogEntry{},
+	tail := s.logLimits.TailLines
+	if tail <= 0 {
+		tail = defaultLogLimits.TailLines
 	}
-
-	err := s.db.View(func(tx *gorm.DB) error {
-		var pipeline model.Pipeline
-		if err := tx.WithContext(ctx).
-			Where("id = ? AND repo_id = ?", pipelineID, repoID).
-			Take(&pipeline).Error; err != nil {
-			return err
-		}
-		detail.Pipeline = &pipeline
-
-		var workflows []*model.Workflow
-		if err := tx.WithContext(ctx).
-			Where("pipeline_id = ?", pipelineID).
-			Order("pid ASC").
-			Find(&workflows).Error; err != nil {
-			return err
-		}
-		detail.Workflows = workflows
-
-		var steps []*model.Step
-		if err := tx.WithContext(ctx).
-			Where("pipeline_id = ?", pipelineID).
-			Order("pid ASC").
-			Find(&steps).Error; err != nil {
-			return err
-		}
-		detail.Steps = steps
-
-		if len(steps) == 0 {
-			return nil
-		}
-
-		stepIDs := make([]int64, 0, len(steps))
-		for _, step := range steps {
-			stepIDs = append(stepIDs, step.ID)
-		}
-
-		var logs []model.LogEntry
-		if err := tx.WithContext(ctx).
-			Where("step_id IN ?", stepIDs).
-			Order("step_id ASC, line ASC").
-			Find(&logs).Error; err != nil {
-			return err
-		}
-
-		for _, entry := range logs {
-			detail.Logs[entry.StepID] = append(detail.Logs[entry.StepID], entry)
-		}
-
-		return nil
-	})
+	detail, err := s.store.GetPipelineRunDetail(ctx, repoID, pipelineID, tail)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, nil
 	}
@@ -889,6 +1148,20 @@ func (s *Service) GetPipelineRunDetail(ctx context.Context, repoID, pipelineID i
 	return detail, nil
 }
 
+// nestWorkflowSteps sets the Children of each workflow to its steps, keeping their order.
+func nestWorkflowSteps(workflows []*model.Workflow, steps []*model.Step) {
+	byPID := make(map[int]*model.Workflow, len(workflows))
+	for _, workflow := range workflows {
+		workflow.Children = []*model.Step{}
+		byPID[workflow.PID] = workflow
+	}
+	for _, step := range steps {
+		if workflow, ok := byPID[step.PPID]; ok {
+			workflow.Children = append(workflow.Children, step)
+		}
+	}
+}
+
 func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, stepID int64, actor string, action string, comment string) (*model.Step, error) {
 	actor = strings.TrimSpace(actor)
 	if actor == "" {
@@ -902,45 +1175,40 @@ func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, st
 	if err != nil {
 		return nil, err
 	}
-	var pipeline model.Pipeline
-	if err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&pipeline, pipelineID).Error
-	}); err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, err
-		}
+	pipeline, err := s.store.GetPipeline(ctx, pipelineID)
+	if err != nil {
 		return nil, err
 	}
 	if pipeline.RepoID != repoID {
 		return nil, gorm.ErrRecordNotFound
 	}
+	// group rosters are read at decision time so roster edits apply to pending approvals
+	groups, err := s.ApproverGroupMembers(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
 	var finalAction string
 	now := time.Now().Unix()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		var step model.Step
-		if err := tx.WithContext(ctx).
-			Where("id = ? AND pipeline_id = ?", stepID, pipelineID).
-			Take(&step).Error; err != nil {
-			return err
-		}
+	if err := s.store.ChangeStep(ctx, pipelineID, stepID, func(step *model.Step) (*stepChange, error) {
 		if step.Type != model.StepTypeApproval {
-			return fmt.Errorf("该步骤不需要审批")
+			return nil, fmt.Errorf("该步骤不需要审批")
 		}
 		if step.Approval == nil {
-			return fmt.Errorf("审批配置缺失")
+			return nil, fmt.Errorf("审批配置缺失")
 		}
 		approval := step.Approval
 		if approval.State == model.StepApprovalStateApproved {
-			return fmt.Errorf("审批已通过")
+			return nil, fmt.Errorf("审批已通过")
 		}
 		if approval.State == model.StepApprovalStateRejected || approval.State == model.StepApprovalStateExpired {
-			return fmt.Errorf("审批已经结束")
+			return nil, fmt.Errorf("审批已经结束")
 		}
 		if approval.Timeout > 0 && approval.RequestedAt > 0 && now >= approval.RequestedAt+approval.Timeout {
-			return fmt.Errorf("审批已超时")
+			return nil, fmt.Errorf("审批已超时")
 		}
-		if len(approval.Approvers) > 0 && !containsIgnoreCase(approval.Approvers, actor) {
-			return fmt.Errorf("当前用户不在审批名单中")
+		requirements := ResolveApprovers(approval.Approvers, groups)
+		if !ApproverAllowed(requirements, actor) {
+			return nil, fmt.Errorf("当前用户不在审批名单中")
 		}
 		comments := strings.TrimSpace(comment)
 		approval.Decisions = upsertApprovalDecision(approval.Decisions, model.StepApprovalDecision{
@@ -948,6 +1216,7 @@ func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, st
 			Action:    action,
 			Comment:   comments,
 			Timestamp: now,
+			Groups:    groupSnapshots(requirements, actor),
 		})
 		updates := map[string]any{
 			"approval": approval,
@@ -968,13 +1237,15 @@ func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, st
 			updates["state"] = step.State
 			updates["finished"] = step.Finished
 			updates["error"] = step.Error
+			updates["failure_reason"] = model.StepFailureApprovalRejected
 		case "approve":
 			if approval.Strategy == "" {
 				approval.Strategy = model.StepApprovalStrategyAny
 			}
-			approvedAll := len(approval.Approvers) == 0 || approval.Strategy == model.StepApprovalStrategyAny
-			if approval.Strategy == model.StepApprovalStrategyAll && len(approval.Approvers) > 0 {
-				approvedAll = allApproversApproved(approval.Approvers, approval.Decisions)
+			approvedAll := len(requirements) == 0 || approval.Strategy == model.StepApprovalStrategyAny
+			if approval.Strategy == model.StepApprovalStrategyAll && len(requirements) > 0 {
+				// each entry, individual or group, needs one approval from a current member
+				approvedAll = len(PendingApprovers(requirements, approval.Decisions)) == 0
 			}
 			if approvedAll {
 				approval.State = model.StepApprovalStateApproved
@@ -991,33 +1262,19 @@ func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, st
 				approval.State = model.StepApprovalStatePending
 			}
 		}
-		if err := tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("id = ?", step.ID).
-			Updates(updates).Error; err != nil {
-			return err
+		change := &stepChange{updates: updates}
+		if state, ok := updates["state"].(model.StatusValue); ok {
+			delete(updates, "state")
+			change.state = state
 		}
 		if finalAction == "approved" {
-			if err := tx.WithContext(ctx).
-				Model(&model.Pipeline{}).
-				Where("id = ?", pipelineID).
-				Updates(map[string]any{
-					"status":  model.StatusRunning,
-					"message": "",
-					"updated": now,
-				}).Error; err != nil {
-				return err
-			}
-			if err := tx.WithContext(ctx).
-				Model(&model.Workflow{}).
-				Where("pipeline_id = ?", pipelineID).
-				Updates(map[string]any{
-					"state": model.StatusRunning,
-				}).Error; err != nil {
-				return err
+			// a pipeline cancelled while waiting cannot be resumed
+			change.resume = map[string]any{
+				"message": "",
+				"updated": now,
 			}
 		}
-		return nil
+		return change, nil
 	}); err != nil {
 		return nil, err
 	}
@@ -1039,22 +1296,45 @@ func (s *Service) SubmitStepApproval(ctx context.Context, repoID, pipelineID, st
 	if err != nil {
 		return nil, err
 	}
+	s.audit.RecordAs(ctx, actor, model.AuditActionStepApproval, model.AuditResourceStep, strconv.FormatInt(stepID, 10), repoID, map[string]interface{}{
+		"pipeline_id": pipelineID,
+		"step":        updatedStep.Name,
+		"decision":    action,
+		"comment":     comment,
+	})
 	return updatedStep, nil
 }
 
 // QueueInfo returns aggregated queue information.
-func (s *Service) QueueInfo() model.QueueInfo {
-	stats := s.queue.Stats()
+func (s *Service) QueueInfo(ctx context.Context) model.QueueInfo {
 	info := model.QueueInfo{
 		Pending:       make([]model.QueueTask, 0),
 		WaitingOnDeps: make([]model.QueueTask, 0),
 		Running:       make([]model.QueueTask, 0),
-		Paused:        !stats.Running,
+		Paused:        true,
+	}
+	if s.queue == nil {
+		return info
+	}
+	stats := s.queue.Stats()
+	info.Paused = !stats.Running || stats.Paused
+	if stats.Paused {
+		info.Stats.ParkedCount = stats.Pending + stats.Parked
 	}
 	info.Stats.WorkerCount = stats.Workers
 	info.Stats.PendingCount = stats.Pending
+	info.Stats.DelayedCount = stats.Delayed
 	info.Stats.RunningCount = stats.InFlight
-	info.Stats.WaitingOnDepsCount = 0
+	pending := s.queue.Pending()
+	numbers, err := s.pipelineNumbers(ctx, pending)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load pipeline numbers of queued tasks")
+	}
+	for _, task := range pending {
+		info.Pending = append(info.Pending, model.QueueTask{Task: task, PipelineNumber: numbers[task.PipelineID]})
+	}
+	info.WaitingOnDeps = append(info.WaitingOnDeps, s.repoSlots.parked()...)
+	info.Stats.WaitingOnDepsCount = len(info.WaitingOnDeps)
 
 	return info
 }
@@ -1086,17 +1366,47 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 	}
 	if status == model.StatusKilled || status == model.StatusSuccess || status == model.StatusFailure { // already finished
 		_ = s.removeTaskRecord(ctx, task.ID)
+		s.releaseRepoSlot(payload.RepoID, payload.PipelineID)
+		return nil
+	}
+
+	settings, err := s.GetPipelineSettings(ctx, payload.RepoID)
+	if err != nil {
+		return err
+	}
+	if !s.takeRepoSlot(ctx, settings, task, payload.RepoID, payload.PipelineID) {
 		return nil
 	}
+	// blocked and cancelled runs leave here too, so the next parked pipeline can start
+	defer s.releaseRepoSlot(payload.RepoID, payload.PipelineID)
 
 	taskCtx, cancel := context.WithCancel(ctx)
-	s.executions.Store(payload.PipelineID, &executionHandle{cancel: cancel})
+	handle := &executionHandle{pipelineID: payload.PipelineID, cancel: cancel}
+	s.executions.Store(payload.PipelineID, handle)
 	defer func() {
 		cancel()
 		s.executions.Delete(payload.PipelineID)
 	}()
 
+	// the deadline is layered below the cancel handle so a user cancel still surfaces as
+	// context.Canceled while an expired deadline surfaces as context.DeadlineExceeded.
+	pipelineTimeout := s.defaultTimeout
+	if payload.Timeout > 0 {
+		pipelineTimeout = time.Duration(payload.Timeout) * time.Second
+	}
+	if pipelineTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		taskCtx, cancelTimeout = context.WithTimeout(taskCtx, pipelineTimeout)
+		defer cancelTimeout()
+	}
+
 	if err := s.markPipelineRunning(ctx, payload.PipelineID, started); err != nil {
+		if errors.Is(err, ErrIllegalTransition) {
+			// finished between the check above and now, e.g. cancelled while queued
+			log.Info().Err(err).Str("task_id", task.ID).Msg("dropping task of finished pipeline")
+			_ = s.removeTaskRecord(ctx, task.ID)
+			return nil
+		}
 		return err
 	}
 
@@ -1104,6 +1414,13 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		ids := make([]int64, 0, len(stepRecords))
+		for _, step := range stepRecords {
+			ids = append(ids, step.ID)
+		}
+		s.logLines.release(ids...)
+	}()
 
 	repo, err := s.fetchRepo(ctx, payload.RepoID)
 	if err != nil {
@@ -1115,14 +1432,11 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 		return err
 	}
 
-	settings, err := s.GetPipelineSettings(ctx, repo.ID)
+	secrets, err := s.runSecrets(ctx, repo, settings, collectRequestedAliases(payload.Steps))
 	if err != nil {
 		return err
 	}
-
-	allRequested := collectRequestedAliases(payload.Steps)
-
-	certEnv, cloneOverride, resolvedSecrets := s.buildCertificateEnv(ctx, repo, settings, allRequested)
+	cloneKey, resolvedSecrets := secrets.CloneKey, secrets.Bindings
 
 	envMap := s.buildBaseEnv(&pipelineEnvContext{
 		repo:     repo,
@@ -1133,20 +1447,52 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 		envMap = make(map[string]string)
 	}
 
+	// admin env templates sit below everything the repository and the run define
+	templateEnv, variableSecrets, err := s.envTemplateEnv(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+	for key, value := range templateEnv {
+		envMap[key] = value
+	}
+
+	// repository variables apply to every run; trigger variables below override them
+	repoVariables, err := s.repoVariables(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+	for _, variable := range repoVariables {
+		if spec.IsProtectedEnv(variable.Key) {
+			continue
+		}
+		envMap[variable.Key] = variable.Value
+		if variable.Secret && strings.TrimSpace(variable.Value) != "" {
+			variableSecrets = append(variableSecrets, variable.Value)
+		}
+	}
+
 	if pipelineRecord.AdditionalVariables != nil {
 		for key, value := range pipelineRecord.AdditionalVariables {
 			if strings.TrimSpace(key) == "" {
 				continue
 			}
+			if spec.IsProtectedEnv(key) {
+				log.Warn().Int64("pipeline_id", pipelineRecord.ID).Str("key", key).Msg("ignored trigger variable shadowing a protected environment variable")
+				continue
+			}
 			envMap[key] = value
 		}
 	}
 
-	for key, value := range certEnv {
+	for key, value := range secrets.Env {
 		envMap[key] = value
 	}
-	if cloneOverride != "" {
-		envMap["REPO_CLONE_URL_AUTH"] = cloneOverride
+	variableSecrets = append(variableSecrets, secrets.Masked...)
+	if secrets.CloneURL != "" {
+		envMap["REPO_CLONE_URL_AUTH"] = secrets.CloneURL
+	} else if cloneKey != nil && strings.TrimSpace(repo.Clone) == "" && strings.TrimSpace(repo.CloneSSH) != "" {
+		// forges exposing only an SSH clone URL are cloned with the bound deploy key
+		envMap["REPO_CLONE_URL_AUTH"] = strings.TrimSpace(repo.CloneSSH)
 	} else if strings.TrimSpace(envMap["REPO_CLONE_URL_AUTH"]) == "" {
 		envMap["REPO_CLONE_URL_AUTH"] = envMap["REPO_CLONE_URL"]
 	}
@@ -1155,13 +1501,32 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 	var workspaceRoot string
 	workspaceCleanup := false
 	var workspacePrepared bool
-	var pipelineStatus = model.StatusSuccess
-	var failureMessage string
+	var workspaceErr error
+	var workspaceMu sync.Mutex
+	// cache is set with the workspace when the spec caches paths; cacheBinds mounts the
+	// cached paths outside the workspace into every step.
+	var cache *workspaceCache
+	var cacheBinds []string
+	// envMu guards envMap, stepOutputs and pipelineRecord.Commit, which concurrent steps update.
+	var envMu sync.Mutex
+	// stepOutputs holds the outputs of finished steps by name, including those of a
+	// previous attempt of the run.
+	stepOutputs := cloneStepOutputs(pipelineRecord.Outputs)
+	var dockerfileMu sync.Mutex
 	dockerfileInjected := false
+	// network is created for the first step with services and shared by the later ones.
+	network := &serviceNetwork{pipelineID: payload.PipelineID}
+	defer network.remove()
 
-	pipelineEnv := make(map[string]string)
+	defer func() {
+		if workspaceCleanup && workspace != "" {
+			_ = os.RemoveAll(workspace)
+		}
+	}()
 
 	ensureDockerfile := func(force bool, logger func(string) error) error {
+		dockerfileMu.Lock()
+		defer dockerfileMu.Unlock()
 		if dockerfileInjected {
 			return nil
 		}
@@ -1201,37 +1566,135 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 		return nil
 	}
 
-	for _, execStep := range payload.Steps {
-		select {
-		case <-taskCtx.Done():
-			pipelineStatus = model.StatusKilled
-			failureMessage = "pipeline canceled"
-			break
-		default:
+	// ensureWorkspace prepares the workspace (and runs the clone phase) once for the first
+	// step that needs it; concurrent steps wait for it and share the result.
+	ensureWorkspace := func(logFn func(string) error) error {
+		workspaceMu.Lock()
+		defer workspaceMu.Unlock()
+		if workspacePrepared {
+			return nil
+		}
+		if workspaceErr != nil {
+			return workspaceErr
 		}
 
-		if pipelineStatus == model.StatusKilled {
-			break
+		envMu.Lock()
+		prepareEnv := envMapToSlice(envMap)
+		envMu.Unlock()
+		preparedDir, preparedRoot, err := s.prepareWorkspace(taskCtx, repo, pipelineRecord.ID, payload.WorkspaceRoot, prepareEnv, logFn)
+		if err != nil {
+			workspaceErr = err
+			return err
+		}
+		workspace, workspaceRoot = preparedDir, preparedRoot
+		if settings != nil {
+			workspaceCleanup = settings.CleanupEnabled
+		}
+		if strings.TrimSpace(payload.WorkspaceRoot) != "" {
+			workspaceCleanup = false
+		}
+
+		envMu.Lock()
+		envMap["WORKSPACE_ROOT"] = workspaceRoot
+		envMap["CI_WORKSPACE_ROOT"] = workspaceRoot
+		envMap["WORKSPACE"] = workspace
+		envMap["CI_WORKSPACE"] = workspace
+		envMap["APP_NAME"] = repo.Name
+		envMap["APP_OWNER"] = repo.Owner
+		envMap["REPO_CLONE_PATH"] = workspace
+		cloneEnv := cloneStringMap(envMap)
+		envMu.Unlock()
+		if logFn != nil {
+			_ = logFn(fmt.Sprintf("Workspace directory: %s", workspace))
+		}
+		if payload.Clone != nil {
+			if err := s.runClonePhase(taskCtx, pipelineRecord.ID, workspace, payload, cloneEnv, cloneKey, logFn); err != nil {
+				_ = logFn(err.Error())
+				workspaceErr = err
+				return err
+			}
+		}
+		if cache = openWorkspaceCache(workspaceRoot, repo.ID, payload.Cache); cache != nil {
+			cache.restore(workspace, logFn)
+			cacheBinds = cache.binds()
+		}
+		workspacePrepared = true
+		return nil
+	}
+
+	// changedFiles resolves the files changed by the pipeline once the workspace exists, for
+	// the first step with path conditions.
+	var (
+		changedOnce  sync.Once
+		changed      []string
+		changedKnown bool
+	)
+	changedFiles := func(logFn func(string) error) ([]string, bool) {
+		changedOnce.Do(func() {
+			changed, changedKnown = s.resolveChangedFiles(taskCtx, pipelineRecord, workspace, logFn)
+		})
+		return changed, changedKnown
+	}
+
+	// finishStep persists the final state and mirrors it on the loaded record so that the
+	// pending-step finalisation below leaves it alone.
+	finishStep := func(stepRecord *model.Step, status model.StatusValue, cause error, exitCode int) error {
+		finished := time.Now().Unix()
+		if err := s.setStepFinished(ctx, stepRecord.ID, status, finished, cause, exitCode); err != nil {
+			return err
+		}
+		stepRecord.State = status
+		stepRecord.Finished = finished
+		s.recordStepDuration(ctx, pipelineRecord.RepoID, stepRecord)
+		s.observeStep(repo, stepRecord)
+		return nil
+	}
+
+	// failStep finishes a step after err and reports whether it was canceled, timed out or
+	// failed. stepCtx carries the step deadline when the step defines a timeout.
+	failStep := func(stepRecord *model.Step, stepCtx context.Context, stepTimeout time.Duration, logFn func(string) error, err error, exitCode int) stepOutcome {
+		var outcome stepOutcome
+		switch {
+		case errors.Is(taskCtx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("pipeline %w after %ds", errTimedOut, int64(pipelineTimeout/time.Second))
+			outcome = stepOutcome{status: model.StatusFailure, message: err.Error(), timedOut: true}
+		case taskCtx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("step %w after %ds", errTimedOut, int64(stepTimeout/time.Second))
+			outcome = stepOutcome{status: model.StatusFailure, message: err.Error(), timedOut: true}
+		case errors.Is(err, context.Canceled), errors.Is(taskCtx.Err(), context.Canceled):
+			outcome = canceledStepOutcome()
+		default:
+			outcome = stepOutcome{status: model.StatusFailure, message: err.Error()}
+		}
+		if outcome.timedOut && logFn != nil {
+			_ = logFn(err.Error())
 		}
+		_ = finishStep(stepRecord, statusFromPipeline(outcome.status), err, exitCode)
+		return outcome
+	}
 
+	runStep := func(execStep pipelineTaskStep, inheritedEnv map[string]string) stepOutcome {
 		stepRecord, ok := stepMap[execStep.PID]
 		if !ok {
 			log.Warn().Int("pid", execStep.PID).Msg("step record not found, skipping")
-			continue
+			return stepOutcome{status: model.StatusSkipped}
 		}
 
 		if stepRecord.State == model.StatusSuccess || stepRecord.State == model.StatusSkipped {
-			continue
+			return stepOutcome{status: stepRecord.State}
 		}
 
 		currentBranch := strings.TrimSpace(firstNonEmpty(payload.Branch, pipelineRecord.Branch))
-		if !execStep.allowsBranch(currentBranch) {
-			summary := ""
-			if execStep.Conditions != nil {
-				summary = execStep.Conditions.branchSummary()
-			}
+		currentTag := tagFromRef(firstNonEmpty(payload.Ref, pipelineRecord.Ref))
+		if !execStep.allowsRef(currentBranch, currentTag) {
+			summary := execStep.Conditions.branchSummary()
+			tagSummary := execStep.Conditions.tagSummary()
 			logMessage := "步骤因分支条件被跳过"
 			switch {
+			case currentTag != "" && tagSummary != "":
+				logMessage = fmt.Sprintf("步骤因标签条件被跳过（当前标签 %s，仅在 %s 执行）", currentTag, tagSummary)
+			case tagSummary != "" && summary == "":
+				logMessage = fmt.Sprintf("步骤因标签条件被跳过（仅在标签 %s 执行）", tagSummary)
 			case summary != "" && currentBranch != "":
 				logMessage = fmt.Sprintf("%s（当前分支 %s，仅在 %s 执行）", logMessage, currentBranch, summary)
 			case summary != "":
@@ -1239,23 +1702,29 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 			case currentBranch != "":
 				logMessage = fmt.Sprintf("%s（当前分支：%s）", logMessage, currentBranch)
 			}
-			if err := s.appendLogLine(ctx, stepRecord.ID, nil, logMessage); err != nil {
-				return err
+			if err := s.appendLogLine(ctx, stepRecord.ID, logMessage); err != nil {
+				return stepOutcome{err: err}
 			}
-			if err := s.setStepFinished(ctx, stepRecord.ID, model.StatusSkipped, time.Now().Unix(), nil, -1); err != nil {
-				return err
+			if err := finishStep(stepRecord, model.StatusSkipped, nil, -1); err != nil {
+				return stepOutcome{err: err}
 			}
-			continue
+			return stepOutcome{status: model.StatusSkipped}
 		}
 
 		stepStart := time.Now().Unix()
 		if err := s.setStepRunning(ctx, stepRecord.ID, stepStart); err != nil {
-			return err
+			return stepOutcome{err: err}
 		}
+		stepRecord.Started = stepStart
 
-		lineCounter := 1
+		// every log line of the step, not only command output, hides the step's secret values
+		maskLog := buildSecretMasker(nil, variableSecrets...)
 		logFn := func(message string) error {
-			return s.appendLogLine(ctx, stepRecord.ID, &lineCounter, message)
+			return s.appendLogLine(ctx, stepRecord.ID, maskLog(message))
+		}
+		markFn := func(marker model.LogCommandMarker) error {
+			marker.Command = maskLog(marker.Command)
+			return s.appendLogMarker(ctx, stepRecord.ID, marker)
 		}
 
 		if strings.TrimSpace(execStep.Image) != "" {
@@ -1265,89 +1734,75 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 		if execStep.Type == model.StepTypeApproval {
 			result, err := s.processApprovalStep(ctx, pipelineRecord, stepRecord, execStep, logFn)
 			if err != nil {
-				pipelineStatus = model.StatusFailure
-				failureMessage = err.Error()
-				break
+				return stepOutcome{status: model.StatusFailure, message: err.Error()}
 			}
 			switch result {
 			case approvalResultContinue:
-				continue
+				return stepOutcome{status: model.StatusSuccess}
 			case approvalResultWait:
-				pipelineStatus = model.StatusBlocked
-				failureMessage = ""
 				message := "等待审批"
 				if execStep.Approval != nil && strings.TrimSpace(execStep.Approval.Message) != "" {
 					message = execStep.Approval.Message
 				}
-				if err := s.markPipelineBlocked(ctx, pipelineRecord.ID, message); err != nil {
-					return err
-				}
-				return nil
-			case approvalResultRejected:
-				pipelineStatus = model.StatusFailure
-				if strings.TrimSpace(stepRecord.Error) != "" {
-					failureMessage = stepRecord.Error
-				} else {
-					failureMessage = "审批已拒绝"
-				}
-				break
+				return stepOutcome{status: model.StatusBlocked, message: message}
 			case approvalResultExpired:
-				pipelineStatus = model.StatusFailure
-				if strings.TrimSpace(stepRecord.Error) != "" {
-					failureMessage = stepRecord.Error
-				} else {
-					failureMessage = "审批已超时"
-				}
-				break
+				return stepOutcome{status: model.StatusFailure, message: firstNonEmpty(stepRecord.Error, "审批已超时")}
+			default:
+				return stepOutcome{status: model.StatusFailure, message: firstNonEmpty(stepRecord.Error, "审批已拒绝")}
 			}
-			break
 		}
 
-		if !workspacePrepared {
-			var prepareErr error
-			workspace, workspaceRoot, prepareErr = s.prepareWorkspace(taskCtx, repo, pipelineRecord.ID, payload.WorkspaceRoot, envMapToSlice(envMap), logFn)
-			if prepareErr != nil {
-				if errors.Is(prepareErr, context.Canceled) {
-					pipelineStatus = model.StatusKilled
-					failureMessage = "pipeline canceled"
-				} else {
-					pipelineStatus = model.StatusFailure
-					failureMessage = prepareErr.Error()
+		stepCtx := taskCtx
+		stepTimeout := time.Duration(execStep.Timeout) * time.Second
+		if stepTimeout > 0 {
+			var cancelStep context.CancelFunc
+			stepCtx, cancelStep = context.WithTimeout(taskCtx, stepTimeout)
+			defer cancelStep()
+		}
+		fail := func(err error, exitCode int) stepOutcome {
+			return failStep(stepRecord, stepCtx, stepTimeout, logFn, err, exitCode)
+		}
+
+		if err := ensureWorkspace(logFn); err != nil {
+			return fail(err, -1)
+		}
+
+		if pathSummary := execStep.Conditions.pathSummary(); pathSummary != "" {
+			files, known := changedFiles(logFn)
+			if !execStep.Conditions.allowsChanges(files, known) {
+				_ = logFn(fmt.Sprintf("步骤因路径条件被跳过（%d 个变更文件均不匹配 %s）", len(files), pathSummary))
+				if err := finishStep(stepRecord, model.StatusSkipped, nil, -1); err != nil {
+					return stepOutcome{err: err}
 				}
-				_ = s.setStepFinished(ctx, stepRecord.ID, statusFromPipeline(pipelineStatus), time.Now().Unix(), prepareErr, -1)
-				break
-			}
-			workspacePrepared = true
-			if settings != nil {
-				workspaceCleanup = settings.CleanupEnabled
-			}
-			if strings.TrimSpace(payload.WorkspaceRoot) != "" {
-				workspaceCleanup = false
-			}
-			if workspaceCleanup {
-				defer os.RemoveAll(workspace)
+				return stepOutcome{status: model.StatusSkipped}
 			}
+		}
 
-			envMap["WORKSPACE_ROOT"] = workspaceRoot
-			envMap["CI_WORKSPACE_ROOT"] = workspaceRoot
-			envMap["WORKSPACE"] = workspace
-			envMap["CI_WORKSPACE"] = workspace
-			envMap["APP_NAME"] = repo.Name
-			envMap["APP_OWNER"] = repo.Owner
-			envMap["REPO_CLONE_PATH"] = workspace
-			if logFn != nil {
-				_ = logFn(fmt.Sprintf("Workspace directory: %s", workspace))
+		if execStep.Deploy != nil {
+			release, err := s.acquireNamespaceLock(stepCtx, execStep.Deploy, repo, pipelineRecord, stepRecord, logFn)
+			if err != nil {
+				if errors.Is(err, ErrNamespaceLockTimeout) {
+					_ = logFn(err.Error())
+				}
+				return fail(err, -1)
 			}
+			// held until this step returns, not for the rest of the pipeline
+			defer release()
 		}
 
-		envMap["CI_STEP_NAME"] = execStep.Name
-		envMap["CI_STEP_IMAGE"] = execStep.Image
-
+		envMu.Lock()
 		stepEnv := cloneStringMap(envMap)
-		for key, value := range pipelineEnv {
+		outputEnv := stepOutputEnv(stepOutputs)
+		envMu.Unlock()
+		stepEnv["CI_STEP_NAME"] = execStep.Name
+		stepEnv["CI_STEP_IMAGE"] = execStep.Image
+		for key, value := range inheritedEnv {
 			stepEnv[key] = value
 		}
-		placeholderEnv := cloneStringMap(pipelineEnv)
+		for key, value := range serviceEnv(execStep.Services) {
+			stepEnv[key] = value
+		}
+		placeholderEnv := cloneStringMap(inheritedEnv)
 
 		stepSecrets := make(map[string]resolvedSecretBinding)
 		for _, alias := range execStep.Secrets {
@@ -1359,37 +1814,115 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 			if !ok {
 				err := fmt.Errorf("流水线步骤 %s 引用了未绑定的凭证 %s", execStep.Name, alias)
 				_ = logFn(err.Error())
-				pipelineStatus = model.StatusFailure
-				failureMessage = err.Error()
-				_ = s.setStepFinished(ctx, stepRecord.ID, statusFromPipeline(pipelineStatus), time.Now().Unix(), err, -1)
-				break
+				return fail(err, -1)
 			}
 			stepSecrets[aliasKey] = binding
 		}
-		if pipelineStatus == model.StatusFailure {
-			break
+		maskLog = buildSecretMasker(stepSecrets, variableSecrets...)
+		// secrets resolve when the step runs, so a certificate rotated while the run was
+		// queued is used in its new version
+		for _, warning := range certificateRotationWarnings(stepSecrets, pipelineRecord.Created) {
+			_ = logFn(warning)
 		}
 
-		preStepEnv, postStepEnv := prepareStepEnv(execStep.Env, stepSecrets, placeholderEnv)
-		for key, value := range preStepEnv {
-			stepEnv[key] = value
-			placeholderEnv[key] = value
-		}
+		preStepEnv, postStepEnv := prepareStepEnv(execStep.Env, stepSecrets, withStepOutputs(placeholderEnv, outputEnv))
+		applyStepEnv(stepEnv, placeholderEnv, preStepEnv, logFn)
 
 		pluginEnv := buildPluginEnv(execStep)
 		if len(pluginEnv) > 0 {
 			pluginEnv = applySecretPlaceholdersToMap(pluginEnv, stepSecrets)
 			// use full step env so placeholders like ${CI_REPO_NAME} resolve
-			pluginEnv = applyEnvPlaceholdersToMap(pluginEnv, stepEnv)
+			pluginEnv = applyEnvPlaceholdersToMap(pluginEnv, withStepOutputs(stepEnv, outputEnv))
 			for key, value := range pluginEnv {
 				stepEnv[key] = value
 			}
 		}
 
+		collectArtifacts := func() error {
+			return s.collectArtifacts(ctx, pipelineRecord.ID, stepRecord, workspace, execStep.Artifacts, logFn)
+		}
+
+		if execStep.Type == model.StepTypeDeploy && execStep.Deploy != nil && execStep.Deploy.SetImage != nil {
+			image := applyEnvPlaceholderToString(execStep.Deploy.SetImage.Image, withStepOutputs(stepEnv, outputEnv))
+			image = applySecretPlaceholders([]string{image}, stepSecrets)[0]
+			if err := s.runSetImageStep(stepCtx, repo, execStep.Deploy, image, logFn); err != nil {
+				return fail(err, -1)
+			}
+			if err := collectArtifacts(); err != nil {
+				return fail(err, -1)
+			}
+			if err := finishStep(stepRecord, model.StatusSuccess, nil, 0); err != nil {
+				return stepOutcome{err: err}
+			}
+			return stepOutcome{status: model.StatusSuccess, env: placeholderEnv}
+		}
+
+		if execStep.Type == model.StepTypeDeploy && execStep.Deploy != nil {
+			manifest, err := loadDeployManifest(workspace, execStep.Deploy)
+			if err != nil {
+				return fail(err, -1)
+			}
+			manifest = applyEnvPlaceholderToString(manifest, withStepOutputs(stepEnv, outputEnv))
+			manifest = applySecretPlaceholders([]string{manifest}, stepSecrets)[0]
+			if err := s.runDeployStep(stepCtx, repo, pipelineRecord, execStep.Deploy, manifest, logFn); err != nil {
+				return fail(err, -1)
+			}
+			if err := collectArtifacts(); err != nil {
+				return fail(err, -1)
+			}
+			if err := finishStep(stepRecord, model.StatusSuccess, nil, 0); err != nil {
+				return stepOutcome{err: err}
+			}
+			return stepOutcome{status: model.StatusSuccess, env: placeholderEnv}
+		}
+
+		if execStep.Type == model.StepTypeBuild && execStep.Build != nil {
+			resolve := func(value string) string {
+				value = applyEnvPlaceholderToString(value, withStepOutputs(stepEnv, outputEnv))
+				return applySecretPlaceholders([]string{value}, stepSecrets)[0]
+			}
+			req := buildStepRequest{
+				Repo:     repo,
+				Pipeline: pipelineRecord,
+				StepName: execStep.Name,
+				Config:   execStep.Build,
+				Args:     make(map[string]string, len(execStep.Build.Args)),
+				Secrets:  stepSecrets,
+			}
+			for _, tag := range execStep.Build.Tags {
+				req.Tags = append(req.Tags, resolve(tag))
+			}
+			for key, value := range execStep.Build.Args {
+				req.Args[key] = resolve(value)
+			}
+			if settings != nil {
+				req.InlineDockerfile = settings.Dockerfile
+			}
+			outputs, err := s.runBuildStep(stepCtx, workspace, req, logFn)
+			if err != nil {
+				return fail(err, -1)
+			}
+			envMu.Lock()
+			stepOutputs[execStep.Name] = outputs
+			if err := s.saveStepOutputs(ctx, pipelineRecord.ID, stepRecord.ID, outputs, stepOutputs); err != nil {
+				log.Warn().Err(err).Int64("pipeline_id", pipelineRecord.ID).Int64("step_id", stepRecord.ID).Msg("failed to persist step outputs")
+			}
+			envMu.Unlock()
+			if err := collectArtifacts(); err != nil {
+				return fail(err, -1)
+			}
+			if err := finishStep(stepRecord, model.StatusSuccess, nil, 0); err != nil {
+				return stepOutcome{err: err}
+			}
+			return stepOutcome{status: model.StatusSuccess, env: placeholderEnv}
+		}
+
 		usePluginRuntime := execStep.Plugin != nil && len(execStep.Commands) == 0
 		commands := append([]string{}, execStep.Commands...)
 		commands = applySecretPlaceholders(commands, stepSecrets)
-		maskFn := buildSecretMasker(stepSecrets)
+		// the shell resolves ${VAR}; step outputs are not in its env and are substituted here
+		commands = applyEnvPlaceholders(commands, outputEnv)
+		maskFn := buildSecretMasker(stepSecrets, variableSecrets...)
 
 		preHook := func(command string) error {
 			if workspace == "" {
@@ -1409,51 +1942,71 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 			return ensureDockerfile(false, logFn)
 		}
 
+		if len(cacheBinds) > 0 && execStep.Runtime != spec.StepRuntimeHost {
+			execStep.Volumes = append(append([]string{}, execStep.Volumes...), cacheBinds...)
+		}
+
+		if execStep.Runtime != spec.StepRuntimeHost {
+			limits, notes := s.resolveStepResources(execStep.Resources, settings)
+			for _, note := range notes {
+				_ = logFn(note)
+			}
+			if summary := limits.summary(); summary != "" {
+				_ = logFn(fmt.Sprintf("资源限制: %s", summary))
+			}
+			execStep.Limits = limits
+		}
+		execStep.RegistryAuth = registryAuthForImage(execStep.Image, stepSecrets)
+		execStep.Containers = handle
+		serviceNetworkName, stopServices, err := s.startStepServices(stepCtx, execStep, stepEnv, stepSecrets, network, func(line string) error {
+			return logFn(maskFn(line))
+		})
+		// services go with the step, whether it succeeds, fails or is cancelled
+		defer stopServices()
+		if err != nil {
+			_ = logFn(err.Error())
+			return fail(err, -1)
+		}
+		execStep.Network = serviceNetworkName
+
 		if usePluginRuntime {
-			exitCode, err := s.runPluginStep(taskCtx, execStep, stepEnv, workspace, execStep.Plugin, ensureDockerfile, logFn)
+			pluginCfg := execStep.Plugin
+			if len(cacheBinds) > 0 {
+				withCache := *pluginCfg
+				withCache.Volumes = append(append([]string{}, pluginCfg.Volumes...), cacheBinds...)
+				pluginCfg = &withCache
+			}
+			exitCode, err := s.runPluginStep(stepCtx, execStep, stepEnv, workspace, pluginCfg, ensureDockerfile, logFn)
 			if err != nil {
-				if errors.Is(err, context.Canceled) {
-					pipelineStatus = model.StatusKilled
-					failureMessage = "pipeline canceled"
-				} else {
-					pipelineStatus = model.StatusFailure
-					failureMessage = err.Error()
-				}
-				_ = s.setStepFinished(ctx, stepRecord.ID, statusFromPipeline(pipelineStatus), time.Now().Unix(), err, exitCode)
-				break
+				return fail(err, exitCode)
 			}
-			if err := s.setStepFinished(ctx, stepRecord.ID, model.StatusSuccess, time.Now().Unix(), nil, 0); err != nil {
-				return err
+			if err := collectArtifacts(); err != nil {
+				return fail(err, -1)
 			}
-			pipelineEnv = placeholderEnv
-			continue
+			if err := finishStep(stepRecord, model.StatusSuccess, nil, 0); err != nil {
+				return stepOutcome{err: err}
+			}
+			return stepOutcome{status: model.StatusSuccess, env: placeholderEnv}
 		}
 
-		exitCode, err := s.executeCommands(taskCtx, execStep, workspace, commands, stepEnv, logFn, maskFn, preHook, postHook)
+		exitCode, err := s.executeCommands(stepCtx, execStep, workspace, commands, stepEnv, logFn, markFn, maskFn, preHook, postHook)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				pipelineStatus = model.StatusKilled
-				failureMessage = "pipeline canceled"
-			} else {
-				pipelineStatus = model.StatusFailure
-				failureMessage = err.Error()
-			}
-			_ = s.setStepFinished(ctx, stepRecord.ID, statusFromPipeline(pipelineStatus), time.Now().Unix(), err, exitCode)
-			break
+			return fail(err, exitCode)
 		}
 
-		postEnvValues, err := s.evaluateStepEnvCommands(taskCtx, workspace, postStepEnv, stepEnv, logFn)
+		postEnvValues, err := s.evaluateStepEnvCommands(stepCtx, workspace, postStepEnv, stepEnv, logFn)
 		if err != nil {
-			pipelineStatus = model.StatusFailure
-			failureMessage = err.Error()
-			_ = s.setStepFinished(ctx, stepRecord.ID, statusFromPipeline(pipelineStatus), time.Now().Unix(), err, -1)
-			break
-		}
-		for key, value := range postEnvValues {
-			stepEnv[key] = value
-			placeholderEnv[key] = value
+			return fail(err, -1)
 		}
+		applyStepEnv(stepEnv, placeholderEnv, postEnvValues, logFn)
 
+		envMu.Lock()
+		if outputs := stepOutputValues(execStep.Env, postEnvValues, stepSecrets, maskFn); outputs != nil {
+			stepOutputs[execStep.Name] = outputs
+			if err := s.saveStepOutputs(ctx, pipelineRecord.ID, stepRecord.ID, outputs, stepOutputs); err != nil {
+				log.Warn().Err(err).Int64("pipeline_id", pipelineRecord.ID).Int64("step_id", stepRecord.ID).Msg("failed to persist step outputs")
+			}
+		}
 		if strings.TrimSpace(pipelineRecord.Commit) == "" && workspace != "" {
 			if commit, err := resolveWorkspaceCommit(taskCtx, workspace); err == nil && commit != "" {
 				if err := s.updatePipelineCommit(ctx, pipelineRecord.ID, commit); err != nil {
@@ -1472,29 +2025,104 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 				updateCommitEnv(envMap)
 				updateCommitEnv(stepEnv)
 				updateCommitEnv(placeholderEnv)
-				updateCommitEnv(pipelineEnv)
 			}
 		}
+		envMu.Unlock()
+
+		if err := collectArtifacts(); err != nil {
+			return fail(err, -1)
+		}
+
+		if err := finishStep(stepRecord, model.StatusSuccess, nil, 0); err != nil {
+			return stepOutcome{err: err}
+		}
+		return stepOutcome{status: model.StatusSuccess, env: placeholderEnv}
+	}
+
+	skipStep := func(execStep pipelineTaskStep, reason string) error {
+		stepRecord, ok := stepMap[execStep.PID]
+		if !ok || stepRecord.State == model.StatusSuccess || stepRecord.State == model.StatusSkipped {
+			return nil
+		}
+		if err := s.appendLogLine(ctx, stepRecord.ID, reason); err != nil {
+			return err
+		}
+		return finishStep(stepRecord, model.StatusSkipped, nil, -1)
+	}
+
+	// runStepIgnoringFailure applies ignore_failure: a failed step keeps its failure state,
+	// is marked as a soft failure and hands the env it inherited on as if it had succeeded.
+	// Failures caused by the pipeline deadline or a cancel are never ignored.
+	runStepIgnoringFailure := func(execStep pipelineTaskStep, inheritedEnv map[string]string) stepOutcome {
+		outcome := runStep(execStep, inheritedEnv)
+		if !execStep.IgnoreFailure || outcome.err != nil || outcome.status != model.StatusFailure || taskCtx.Err() != nil {
+			return outcome
+		}
+		if stepRecord, ok := stepMap[execStep.PID]; ok {
+			if err := s.store.UpdateStep(ctx, stepRecord.ID, map[string]any{"failure": model.FailureIgnore}); err != nil {
+				return stepOutcome{err: err}
+			}
+			stepRecord.Failure = model.FailureIgnore
+			_ = s.appendLogLine(ctx, stepRecord.ID, fmt.Sprintf("步骤失败已忽略（ignore_failure）：%s", outcome.message))
+		}
+		return stepOutcome{status: model.StatusSuccess, env: inheritedEnv}
+	}
 
-		if err := s.setStepFinished(ctx, stepRecord.ID, model.StatusSuccess, time.Now().Unix(), nil, 0); err != nil {
+	outcome := s.runWorkflows(ctx, taskCtx, payload, runStepIgnoringFailure, skipStep)
+	if outcome.err != nil {
+		if errors.Is(outcome.err, ErrIllegalTransition) && s.pipelineFinalised(ctx, payload.PipelineID) {
+			// steps of a pipeline cancelled mid-run were already killed with it
+			log.Info().Err(outcome.err).Str("task_id", task.ID).Msg("pipeline finalised elsewhere")
+			return nil
+		}
+		return outcome.err
+	}
+	if outcome.status == model.StatusBlocked {
+		if err := s.markPipelineBlocked(ctx, pipelineRecord.ID, outcome.message); err != nil && !errors.Is(err, ErrIllegalTransition) {
 			return err
 		}
+		return nil
+	}
+	pipelineStatus := outcome.status
+	failureMessage := outcome.message
+	if pipelineStatus == model.StatusFailure {
+		if step := firstHardFailedStep(stepRecords); step != nil {
+			failureMessage = fmt.Sprintf("步骤 %s 失败：%s", step.Name, failureMessage)
+		}
+	}
 
-		pipelineEnv = placeholderEnv
+	// steps that never started after a timeout are finalised like a cancel
+	pendingStatus := statusFromPipeline(pipelineStatus)
+	if outcome.timedOut {
+		pendingStatus = model.StatusKilled
+	}
+	if pipelineStatus == model.StatusSuccess && cache != nil && len(payload.Steps) > 0 {
+		// cache progress goes to the log of the last step
+		if last, ok := stepMap[payload.Steps[len(payload.Steps)-1].PID]; ok {
+			s.saveWorkspaceCache(cache, workspace, func(message string) error {
+				return s.appendLogLine(ctx, last.ID, message)
+			})
+		}
 	}
 
 	finished := time.Now().Unix()
 	for _, step := range stepRecords {
 		if step.State == model.StatusPending {
-			_ = s.setStepFinished(ctx, step.ID, statusFromPipeline(pipelineStatus), finished, nil, 0)
+			_ = s.setStepFinished(ctx, step.ID, pendingStatus, finished, nil, 0)
 		}
 	}
 
 	if err := s.markPipelineFinished(ctx, payload.PipelineID, pipelineStatus, finished, failureMessage, task.ID); err != nil {
+		if errors.Is(err, ErrIllegalTransition) {
+			// a cancel already finalised the pipeline and dropped its task
+			log.Info().Err(err).Str("task_id", task.ID).Msg("pipeline finalised elsewhere")
+			return nil
+		}
 		return err
 	}
 
 	if pipelineStatus == model.StatusSuccess {
+		s.recordProvenance(ctx, repo, payload.PipelineID, payload, stepRecords)
 		log.Info().
 			Str("task_id", task.ID).
 			Int64("pipeline_id", payload.PipelineID).
@@ -1514,36 +2142,18 @@ func (s *Service) handleTask(ctx context.Context, task *model.Task) error {
 }
 
 func (s *Service) markPipelineRunning(ctx context.Context, pipelineID int64, started int64) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("id = ?", pipelineID).
-			Updates(map[string]any{
-				"status":  model.StatusRunning,
-				"started": started,
-				"updated": started,
-			}).Error; err != nil {
-			return err
-		}
-		return tx.WithContext(ctx).
-			Model(&model.Workflow{}).
-			Where("pipeline_id = ?", pipelineID).
-			Updates(map[string]any{
-				"state":   model.StatusRunning,
-				"started": started,
-			}).Error
-	})
+	before := s.pipelineStatusBefore(ctx, pipelineID)
+	if err := s.store.MarkPipelineRunning(ctx, pipelineID, started); err != nil {
+		return err
+	}
+	s.publishPipelineStatus(ctx, pipelineID, before, model.StatusRunning)
+	s.observePipeline(ctx, pipelineID, metrics.ResultStarted)
+	s.reportCommitStatus(ctx, pipelineID, model.StatusRunning)
+	return nil
 }
 
 func (s *Service) fetchPipelineSteps(ctx context.Context, pipelineID int64) ([]model.Step, map[int]*model.Step, error) {
-	var steps []model.Step
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("pipeline_id = ?", pipelineID).
-			Order("pid ASC").
-			Find(&steps).Error
-	})
+	steps, err := s.store.ListPipelineSteps(ctx, pipelineID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1555,31 +2165,25 @@ func (s *Service) fetchPipelineSteps(ctx context.Context, pipelineID int64) ([]m
 }
 
 func (s *Service) fetchRepo(ctx context.Context, repoID int64) (*model.Repo, error) {
-	var repo model.Repo
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&repo, repoID).Error
-	})
-	if err != nil {
-		return nil, err
-	}
-	return &repo, nil
+	return s.store.GetRepo(ctx, repoID)
+}
+
+// repoVariables returns the variables configured for every pipeline of repoID.
+func (s *Service) repoVariables(ctx context.Context, repoID int64) ([]*model.RepoVariable, error) {
+	return s.store.ListRepoVariables(ctx, repoID)
 }
 
 func (s *Service) fetchPipeline(ctx context.Context, pipelineID int64) (*model.Pipeline, error) {
-	var pipeline model.Pipeline
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&pipeline, pipelineID).Error
-	})
-	if err != nil {
-		return nil, err
-	}
-	return &pipeline, nil
+	return s.store.GetPipeline(ctx, pipelineID)
 }
 
 func (s *Service) prepareWorkspace(ctx context.Context, repo *model.Repo, pipelineID int64, workspaceRoot string, env []string, logFn func(string) error) (string, string, error) {
 	if repo == nil {
 		return "", "", fmt.Errorf("仓库信息缺失，无法执行构建")
 	}
+	if err := s.checkWorkspaceQuota(ctx, logFn); err != nil {
+		return "", "", err
+	}
 
 	rootDir := sanitizeWorkspaceRoot(workspaceRoot)
 	if err := os.MkdirAll(rootDir, 0o755); err != nil {
@@ -1601,14 +2205,16 @@ func (s *Service) prepareWorkspace(ctx context.Context, repo *model.Repo, pipeli
 	return workspace, rootDir, nil
 }
 
-func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, workspace string, commands []string, stepEnv map[string]string, logFn func(string) error, maskFn func(string) string, preCommand func(string) error, postCommand func(string) error) (int, error) {
+// executeCommands runs the commands of a step in order. markFn, when set, receives a start
+// marker before and an end marker after each command so their timings can be shown.
+func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, workspace string, commands []string, stepEnv map[string]string, logFn func(string) error, markFn func(model.LogCommandMarker) error, maskFn func(string) string, preCommand func(string) error, postCommand func(string) error) (int, error) {
 	if maskFn == nil {
 		maskFn = func(s string) string { return s }
 	}
 	if strings.TrimSpace(workspace) == "" {
 		return -1, fmt.Errorf("workspace not prepared")
 	}
-	runner, err := s.dockerRunner()
+	runner, err := s.stepRunner(step)
 	if err != nil {
 		return -1, err
 	}
@@ -1619,17 +2225,35 @@ func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, wo
 		}
 		return logFn(maskFn(message))
 	}
-	cfgTemplate := dockerruntime.ContainerConfig{
-		Image:      step.Image,
-		Entrypoint: []string{},
-		Env:        envSlice,
-		WorkingDir: "/workspace",
-		Volumes:    map[string]struct{}{"/workspace": {}},
-		Binds:      []string{fmt.Sprintf("%s:/workspace", workspace)},
-		Privileged: step.Privileged,
+	shell := []string{"/bin/sh", "-c"}
+	cfgTemplate := pipelineruntime.Config{
+		Image:        step.Image,
+		Entrypoint:   []string{},
+		Env:          envSlice,
+		WorkingDir:   "/workspace",
+		Volumes:      map[string]struct{}{"/workspace": {}},
+		Binds:        []string{fmt.Sprintf("%s:/workspace", workspace)},
+		Privileged:   step.Privileged,
+		Network:      step.Network,
+		PullPolicy:   pipelineruntime.PullPolicy(step.Pull),
+		RegistryAuth: step.RegistryAuth,
+		Labels:       step.Containers.labels(),
+		Tracker:      step.Containers,
+		Resources:    step.Limits.runtime(),
+	}
+	if step.Runtime == spec.StepRuntimeHost {
+		// the same shell runShellCommand uses; there is no container filesystem to map
+		shell = []string{"bash", "-lc"}
+		if _, err := exec.LookPath("bash"); err != nil {
+			shell = []string{"sh", "-lc"}
+		}
+		cfgTemplate = pipelineruntime.Config{
+			Env:        envSlice,
+			WorkingDir: workspace,
+		}
 	}
 	for _, volume := range step.Volumes {
-		if strings.TrimSpace(volume) != "" {
+		if strings.TrimSpace(volume) != "" && step.Runtime != spec.StepRuntimeHost {
 			cfgTemplate.Binds = append(cfgTemplate.Binds, volume)
 		}
 	}
@@ -1650,7 +2274,18 @@ func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, wo
 		}
 		cfg := cfgTemplate
 		cfg.Name = commandContainerName(step, stepEnv, idx)
-		cfg.Cmd = []string{"/bin/sh", "-c", cmd}
+		cfg.Cmd = append(append([]string{}, shell...), cmd)
+		started := time.Now()
+		if markFn != nil {
+			if err := markFn(model.LogCommandMarker{
+				Marker:  model.LogCommandStart,
+				Index:   idx,
+				Command: maskFn(displayCmd),
+				Started: started.UnixMilli(),
+			}); err != nil {
+				return -1, err
+			}
+		}
 		exitCode, runErr := runner.Run(ctx, cfg, func(line string) error {
 			if logFn == nil {
 				return nil
@@ -1658,8 +2293,23 @@ func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, wo
 			return logFn(maskFn(line))
 		})
 		lastExitCode = exitCode
+		if markFn != nil {
+			if err := markFn(model.LogCommandMarker{
+				Marker:     model.LogCommandEnd,
+				Index:      idx,
+				Started:    started.UnixMilli(),
+				ExitCode:   &exitCode,
+				DurationMs: time.Since(started).Milliseconds(),
+			}); err != nil && runErr == nil {
+				return lastExitCode, err
+			}
+		}
 		if runErr != nil {
-			return lastExitCode, runErr
+			return lastExitCode, stepRunError(step, runErr, maskedLog)
+		}
+		if cfgTemplate.PullPolicy == pipelineruntime.PullAlways {
+			// pulled for the first command; the others run the same image
+			cfgTemplate.PullPolicy = pipelineruntime.PullIfNotPresent
 		}
 		if postCommand != nil {
 			if err := postCommand(cmd); err != nil {
@@ -1670,41 +2320,14 @@ func (s *Service) executeCommands(ctx context.Context, step pipelineTaskStep, wo
 	return lastExitCode, nil
 }
 
-func (s *Service) appendLogLine(ctx context.Context, stepID int64, line *int, content string) error {
-	if line == nil {
-		dummy := 1
-		line = &dummy
-	}
-	entry := model.LogEntry{
-		StepID:  stepID,
-		Time:    time.Now().Unix(),
-		Line:    *line,
-		Data:    []byte(content + "\n"),
-		Created: time.Now().Unix(),
-		Type:    model.LogEntryStdout,
-	}
-	if err := s.db.GetDB().WithContext(ctx).Create(&entry).Error; err != nil {
-		return err
-	}
-	*line++
-	return nil
-}
-
 func (s *Service) setStepRunning(ctx context.Context, stepID int64, started int64) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("id = ?", stepID).
-			Updates(map[string]any{
-				"state":   model.StatusRunning,
-				"started": started,
-			}).Error
+	return s.transitionStepWithEvent(ctx, stepID, model.StatusRunning, map[string]any{
+		"started": started,
 	})
 }
 
 func (s *Service) setStepFinished(ctx context.Context, stepID int64, status model.StatusValue, finished int64, errCause error, exitCode int) error {
 	update := map[string]any{
-		"state":    status,
 		"finished": finished,
 	}
 	if errCause != nil {
@@ -1715,51 +2338,23 @@ func (s *Service) setStepFinished(ctx context.Context, stepID int64, status mode
 		update["error"] = ""
 		update["failure"] = ""
 	}
+	update["failure_reason"] = classifyStepFailure(status, errCause, exitCode)
 	if exitCode >= 0 {
 		update["exit_code"] = exitCode
 	}
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("id = ?", stepID).
-			Updates(update).Error
-	})
+	return s.transitionStepWithEvent(ctx, stepID, status, update)
 }
 
 func (s *Service) markPipelineFinished(ctx context.Context, pipelineID int64, status model.StatusValue, finished int64, message string, taskID string) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		update := map[string]any{
-			"status":   status,
-			"finished": finished,
-			"updated":  finished,
-		}
-		if strings.TrimSpace(message) != "" {
-			update["message"] = message
-		}
-		if err := tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("id = ?", pipelineID).
-			Updates(update).Error; err != nil {
-			return err
-		}
-
-		if err := tx.WithContext(ctx).
-			Model(&model.Workflow{}).
-			Where("pipeline_id = ?", pipelineID).
-			Updates(map[string]any{
-				"state":    status,
-				"finished": finished,
-			}).Error; err != nil {
-			return err
-		}
-
-		if taskID != "" {
-			if err := tx.WithContext(ctx).Delete(&model.Task{}, "id = ?", taskID).Error; err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+	before := s.pipelineStatusBefore(ctx, pipelineID)
+	if err := s.store.MarkPipelineFinished(ctx, pipelineID, status, finished, message, taskID); err != nil {
+		return err
+	}
+	s.publishPipelineStatus(ctx, pipelineID, before, status)
+	s.observePipeline(ctx, pipelineID, pipelineMetricResult(status))
+	s.publishNotification(pipelineID, status)
+	s.reportCommitStatus(ctx, pipelineID, status)
+	return nil
 }
 
 func readCommandOutput(reader *bufio.Reader) (string, error) {
@@ -1793,10 +2388,9 @@ func runShellCommandCapture(ctx context.Context, dir, command string, env []stri
 	}
 	cmd := exec.CommandContext(ctx, shell, "-lc", command)
 	cmd.Dir = dir
-	if len(env) > 0 {
-		cmd.Env = env
-	} else {
-		cmd.Env = os.Environ()
+	cmd.Env = env
+	if len(env) == 0 {
+		cmd.Env = defaultHostEnvList()
 	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -1816,10 +2410,9 @@ func runShellCommand(ctx context.Context, dir, command string, env []string, log
 func runCommandWithLogging(ctx context.Context, dir, name string, args []string, env []string, logFn func(string) error) error {
 	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = dir
-	if len(env) > 0 {
-		cmd.Env = env
-	} else {
-		cmd.Env = os.Environ()
+	cmd.Env = env
+	if len(env) == 0 {
+		cmd.Env = defaultHostEnvList()
 	}
 
 	stdout, err := cmd.StdoutPipe()
@@ -1863,7 +2456,7 @@ func runCommandWithLogging(ctx context.Context, dir, name string, args []string,
 }
 
 func (s *Service) buildBaseEnv(ctx *pipelineEnvContext) map[string]string {
-	env := envMapFromOS()
+	env := s.hostEnvMap()
 	for _, provider := range defaultEnvProviders {
 		env = mergeEnv(env, provider(ctx))
 	}
@@ -1932,6 +2525,7 @@ func providePipelineEnv(ctx *pipelineEnvContext) map[string]string {
 	}
 	runName := firstNonEmpty(ctx.payload.RunName, ctx.pipeline.Title)
 	branch := firstNonEmpty(ctx.payload.Branch, ctx.pipeline.Branch)
+	ref := firstNonEmpty(ctx.payload.Ref, ctx.pipeline.Ref, "refs/heads/"+branch)
 	env := map[string]string{
 		"CI":                 "true",
 		"CI_PIPELINE_ID":     fmt.Sprintf("%d", ctx.pipeline.ID),
@@ -1940,6 +2534,11 @@ func providePipelineEnv(ctx *pipelineEnvContext) map[string]string {
 		"CI_PIPELINE_AUTHOR": ctx.pipeline.Author,
 		"CI_PIPELINE_BRANCH": branch,
 		"CI_COMMIT_BRANCH":   branch,
+		"CI_COMMIT_REF":      ref,
+		"CI_COMMIT_REF_NAME": refName(ref),
+	}
+	if tag := tagFromRef(ref); tag != "" {
+		env["CI_COMMIT_TAG"] = tag
 	}
 	commit := strings.TrimSpace(ctx.pipeline.Commit)
 	env["CI_COMMIT_SHA"] = commit
@@ -1999,6 +2598,11 @@ type resolvedSecretBinding struct {
 	SanitizedAlias string
 	Type           string
 	Values         map[string]string
+	// CertificateID, CertificateVersion and CertificateUpdated describe the certificate the
+	// alias resolved to; CertificateID is 0 for secrets.
+	CertificateID      int64
+	CertificateVersion int
+	CertificateUpdated int64
 }
 
 func applySecretPlaceholders(commands []string, bindings map[string]resolvedSecretBinding) []string {
@@ -2024,17 +2628,34 @@ func applySecretPlaceholders(commands []string, bindings map[string]resolvedSecr
 	return result
 }
 
-func buildSecretMasker(bindings map[string]resolvedSecretBinding) func(string) string {
-	if len(bindings) == 0 {
-		return maskSensitiveValues
+// buildSecretMasker hides the values of bindings and the extra secret values, such as secret
+// repository variables, in log messages. Multi-line values, like private keys, are also hidden
+// line by line, as logs are written a line at a time.
+func buildSecretMasker(bindings map[string]resolvedSecretBinding, extra ...string) func(string) string {
+	var values []string
+	add := func(value string) {
+		if strings.TrimSpace(value) == "" {
+			return
+		}
+		values = append(values, value)
+		if !strings.Contains(value, "\n") {
+			return
+		}
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			// PEM armor lines are no secret and would mask every key in the log
+			if len(line) < minMaskedLineLength || strings.HasPrefix(line, "-----") {
+				continue
+			}
+			values = append(values, line)
+		}
+	}
+	for _, value := range extra {
+		add(value)
 	}
-	values := make([]string, 0)
 	for _, binding := range bindings {
 		for _, value := range binding.Values {
-			if strings.TrimSpace(value) == "" {
-				continue
-			}
-			values = append(values, value)
+			add(value)
 		}
 	}
 	if len(values) == 0 {
@@ -2049,6 +2670,9 @@ func buildSecretMasker(bindings map[string]resolvedSecretBinding) func(string) s
 	}
 }
 
+// minMaskedLineLength is the shortest line of a multi-line secret hidden on its own.
+const minMaskedLineLength = 8
+
 func maskSensitiveValues(message string) string {
 	lines := strings.Split(message, "\n")
 	for i, line := range lines {
@@ -2195,7 +2819,7 @@ func sanitizeWorkspaceRoot(root string) string {
 }
 
 func buildPipelinePluginConfig(step spec.StepSpec) (*pipelinePluginConfig, error) {
-	if step.Settings == nil && len(step.Volumes) == 0 && !step.Privileged {
+	if step.Plugin == "" && step.Settings == nil && len(step.Volumes) == 0 && !step.Privileged {
 		return nil, nil
 	}
 	settings, err := normalizePluginSettings(step.Settings)
@@ -2378,6 +3002,32 @@ func prepareStepEnv(definitions map[string]string, secrets map[string]resolvedSe
 	return pre, post
 }
 
+// applyStepEnv merges step env definitions into the step environment. Values apply in this
+// order, later ones winning: provider env, trigger variables, certificate env, workspace env,
+// env inherited from earlier steps, then the step's own env. Protected reserved names
+// (spec.IsProtectedEnv) always keep the system value; other reserved names may be overridden
+// and the override is noted in the step log.
+func applyStepEnv(stepEnv, placeholderEnv, values map[string]string, logFn func(string) error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if spec.IsProtectedEnv(key) {
+			if logFn != nil {
+				_ = logFn(fmt.Sprintf("[警告] 步骤 env %s 为系统保留变量，不允许覆盖，已保留系统值", key))
+			}
+			continue
+		}
+		if _, exists := stepEnv[key]; exists && spec.IsReservedEnv(key) && logFn != nil {
+			_ = logFn(fmt.Sprintf("[提示] 步骤 env 覆盖了系统变量 %s", key))
+		}
+		stepEnv[key] = values[key]
+		placeholderEnv[key] = values[key]
+	}
+}
+
 func (s *Service) evaluateStepEnvCommands(ctx context.Context, workspace string, definitions map[string]string, baseEnv map[string]string, logFn func(string) error) (map[string]string, error) {
 	if len(definitions) == 0 {
 		return nil, nil
@@ -2463,18 +3113,36 @@ func (s *Service) runPluginStep(ctx context.Context, step pipelineTaskStep, step
 		}
 	}
 	cfg := dockerruntime.ContainerConfig{
-		Name:       pluginContainerName(step, stepEnv),
-		Image:      step.Image,
-		Env:        envMapToSlice(pluginContainerEnv(stepEnv)),
-		WorkingDir: "/workspace",
-		Volumes:    map[string]struct{}{"/workspace": {}},
-		Binds:      binds,
-		Privileged: pluginCfg.Privileged,
+		Name:         pluginContainerName(step, stepEnv),
+		Image:        step.Image,
+		Env:          envMapToSlice(pluginContainerEnv(stepEnv)),
+		WorkingDir:   "/workspace",
+		Volumes:      map[string]struct{}{"/workspace": {}},
+		Binds:        binds,
+		Privileged:   pluginCfg.Privileged,
+		Network:      step.Network,
+		PullPolicy:   pipelineruntime.PullPolicy(step.Pull),
+		RegistryAuth: step.RegistryAuth,
+		Labels:       step.Containers.labels(),
+		Tracker:      step.Containers,
+		Resources:    step.Limits.runtime(),
 	}
 	if len(step.Commands) > 0 {
 		cfg.Cmd = append([]string{}, step.Commands...)
 	}
-	return runner.Run(ctx, cfg, logFn)
+	exitCode, err := runner.Run(ctx, cfg, logFn)
+	if err != nil {
+		return exitCode, stepRunError(step, err, logFn)
+	}
+	return exitCode, nil
+}
+
+// stepRunner returns the runtime the commands of step run in.
+func (s *Service) stepRunner(step pipelineTaskStep) (pipelineruntime.Runner, error) {
+	if step.Runtime == spec.StepRuntimeHost {
+		return hostruntime.NewRuntime(), nil
+	}
+	return s.dockerRunner()
 }
 
 func (s *Service) dockerRunner() (*dockerruntime.Runtime, error) {
@@ -2567,17 +3235,19 @@ func (s *Service) processApprovalStep(ctx context.Context, pipelineRecord *model
 	}
 
 	now := time.Now().Unix()
-	if approval.RequestedAt == 0 {
+	requested := approval.RequestedAt == 0
+	if requested {
 		approval.RequestedAt = now
 		approval.RequestedBy = pipelineRecord.Author
 		if approval.Timeout > 0 {
 			approval.ExpiresAt = approval.RequestedAt + approval.Timeout
 		}
+		approval.NotifiedAt = now
 	}
 	if approvalExpired(approval, now) {
 		approval.State = model.StepApprovalStateExpired
 		approval.FinalizedAt = now
-		err := errors.New("审批已超时")
+		err := errApprovalExpired
 		if err := s.setStepFinished(ctx, stepRecord.ID, model.StatusFailure, now, err, -1); err != nil {
 			return approvalResultExpired, err
 		}
@@ -2592,6 +3262,7 @@ func (s *Service) processApprovalStep(ctx context.Context, pipelineRecord *model
 	if stepRecord.Started == 0 {
 		stepRecord.Started = now
 	}
+	previous := stepRecord.State
 	stepRecord.State = model.StatusBlocked
 	if err := s.updateStepApprovalData(ctx, stepRecord, approval, map[string]any{
 		"state":   model.StatusBlocked,
@@ -2599,6 +3270,13 @@ func (s *Service) processApprovalStep(ctx context.Context, pipelineRecord *model
 	}); err != nil {
 		return approvalResultWait, err
 	}
+	if previous != model.StatusBlocked {
+		s.publishStepEvent(ctx, model.StepEventStatusChanged, stepRecord, previous, model.StatusBlocked)
+	}
+	if requested {
+		s.publishStepEvent(ctx, model.ApprovalEventRequested, stepRecord, previous, model.StatusBlocked)
+		s.publishApprovalNotification(pipelineRecord.ID, stepRecord.ID, model.NotificationEventApproval)
+	}
 	if logFn != nil {
 		_ = logFn("等待审批: " + firstNonEmpty(approval.Message, stepRecord.Name))
 	}
@@ -2622,19 +3300,7 @@ func approvalExpired(approval *model.StepApproval, now int64) bool {
 }
 
 func (s *Service) findPipelineTask(ctx context.Context, pipelineID int64) (*model.Task, error) {
-	var task model.Task
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Where("pipeline_id = ?", pipelineID).
-			Take(&task).Error
-	})
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	return &task, nil
+	return s.store.FindPipelineTask(ctx, pipelineID)
 }
 
 func (s *Service) resumePipelineAfterApproval(ctx context.Context, pipelineID int64) error {
@@ -2645,20 +3311,11 @@ func (s *Service) resumePipelineAfterApproval(ctx context.Context, pipelineID in
 	if task == nil {
 		return fmt.Errorf("未找到流水线任务，无法继续执行")
 	}
-	return s.queue.Enqueue(ctx, task)
+	return s.EnqueueTask(ctx, task)
 }
 
 func (s *Service) getStepByID(ctx context.Context, stepID int64) (*model.Step, error) {
-	var step model.Step
-	if err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&step, stepID).Error
-	}); err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &step, nil
+	return s.store.GetStep(ctx, stepID)
 }
 
 func upsertApprovalDecision(decisions []model.StepApprovalDecision, decision model.StepApprovalDecision) []model.StepApprovalDecision {
@@ -2690,25 +3347,6 @@ func containsIgnoreCase(items []string, target string) bool {
 	return false
 }
 
-func allApproversApproved(approvers []string, decisions []model.StepApprovalDecision) bool {
-	if len(approvers) == 0 {
-		return true
-	}
-	approved := make(map[string]struct{})
-	for _, decision := range decisions {
-		if strings.ToLower(strings.TrimSpace(decision.Action)) != "approve" {
-			continue
-		}
-		approved[strings.ToLower(strings.TrimSpace(decision.User))] = struct{}{}
-	}
-	for _, approver := range approvers {
-		if _, ok := approved[strings.ToLower(strings.TrimSpace(approver))]; !ok {
-			return false
-		}
-	}
-	return true
-}
-
 func (s *Service) updateStepApprovalData(ctx context.Context, step *model.Step, approval *model.StepApproval, extra map[string]any) error {
 	updates := map[string]any{
 		"approval": approval,
@@ -2716,12 +3354,13 @@ func (s *Service) updateStepApprovalData(ctx context.Context, step *model.Step,
 	for key, value := range extra {
 		updates[key] = value
 	}
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("id = ?", step.ID).
-			Updates(updates).Error
-	}); err != nil {
+	if state, ok := updates["state"].(model.StatusValue); ok {
+		delete(updates, "state")
+		if err := s.store.TransitionStep(ctx, step.ID, state, updates); err != nil {
+			return err
+		}
+		updates["state"] = state
+	} else if err := s.store.UpdateStep(ctx, step.ID, updates); err != nil {
 		return err
 	}
 	step.Approval = approval
@@ -2741,28 +3380,13 @@ func (s *Service) updateStepApprovalData(ctx context.Context, step *model.Step,
 }
 
 func (s *Service) markPipelineBlocked(ctx context.Context, pipelineID int64, message string) error {
-	now := time.Now().Unix()
-	updates := map[string]any{
-		"status":  model.StatusBlocked,
-		"updated": now,
-	}
-	if strings.TrimSpace(message) != "" {
-		updates["message"] = message
+	before := s.pipelineStatusBefore(ctx, pipelineID)
+	if err := s.store.MarkPipelineBlocked(ctx, pipelineID, message, time.Now().Unix()); err != nil {
+		return err
 	}
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("id = ?", pipelineID).
-			Updates(updates).Error; err != nil {
-			return err
-		}
-		return tx.WithContext(ctx).
-			Model(&model.Workflow{}).
-			Where("pipeline_id = ?", pipelineID).
-			Updates(map[string]any{
-				"state": model.StatusBlocked,
-			}).Error
-	})
+	s.publishPipelineStatus(ctx, pipelineID, before, model.StatusBlocked)
+	s.publishNotification(pipelineID, model.StatusBlocked)
+	return nil
 }
 
 func defaultPipelineSettings() *model.RepoPipelineConfig {
@@ -2770,9 +3394,11 @@ func defaultPipelineSettings() *model.RepoPipelineConfig {
 		CleanupEnabled:   false,
 		RetentionDays:    7,
 		MaxRecords:       10,
+		LogRetentionDays: 0,
 		Dockerfile:       "",
 		DisallowParallel: false,
 		CronSchedules:    []string{},
+		ConfigSource:     model.PipelineConfigSourceDB,
 	}
 }
 
@@ -2783,6 +3409,9 @@ func normalizePipelineConfig(cfg *model.RepoPipelineConfig) *model.RepoPipelineC
 	if cfg.CronSchedules == nil {
 		cfg.CronSchedules = []string{}
 	}
+	if cfg.ConfigSource == "" {
+		cfg.ConfigSource = model.PipelineConfigSourceDB
+	}
 	if len(cfg.CronSchedules) == 0 && cfg.LegacyCronEnabled {
 		if legacy := strings.TrimSpace(cfg.LegacyCronSpec); legacy != "" {
 			cfg.CronSchedules = []string{legacy}
@@ -2792,20 +3421,8 @@ func normalizePipelineConfig(cfg *model.RepoPipelineConfig) *model.RepoPipelineC
 }
 
 func (s *Service) reloadCronSchedules(ctx context.Context) error {
-	type cronRecord struct {
-		RepoID            int64    `gorm:"column:repo_id"`
-		CronSchedules     []string `gorm:"column:cron_schedules;serializer:json"`
-		LegacyCronEnabled bool     `gorm:"column:cron_enabled"`
-		LegacyCronSpec    string   `gorm:"column:cron_spec"`
-	}
-
-	var records []cronRecord
-	if err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.RepoPipelineConfig{}).
-			Select("repo_id", "cron_schedules", "cron_enabled", "cron_spec").
-			Find(&records).Error
-	}); err != nil {
+	records, err := s.store.ListPipelineConfigs(ctx, "repo_id", "cron_schedules", "cron_enabled", "cron_spec")
+	if err != nil {
 		return err
 	}
 
@@ -2845,9 +3462,11 @@ func (s *Service) refreshCronEntries(repoID int64, schedules []string) {
 		return
 	}
 
-	if ids, ok := s.cronEntries[repoID]; ok {
-		for _, id := range ids {
-			s.scheduler.Remove(id)
+	if entries, ok := s.cronEntries[repoID]; ok {
+		for _, entry := range entries {
+			if entry.err == nil {
+				s.scheduler.Remove(entry.id)
+			}
 		}
 		delete(s.cronEntries, repoID)
 	}
@@ -2864,9 +3483,10 @@ func (s *Service) refreshCronEntries(repoID int64, schedules []string) {
 		})
 		if err != nil {
 			log.Warn().Err(err).Int64("repo_id", repoID).Str("cron_expression", specCopy).Msg("skipping invalid cron expression")
+			s.cronEntries[repoID] = append(s.cronEntries[repoID], cronEntry{expression: specCopy, err: err})
 			continue
 		}
-		s.cronEntries[repoID] = append(s.cronEntries[repoID], entryID)
+		s.cronEntries[repoID] = append(s.cronEntries[repoID], cronEntry{expression: specCopy, id: entryID})
 		log.Debug().Int64("repo_id", repoID).Str("cron_expression", specCopy).Msg("registered cron pipeline schedule")
 	}
 }
@@ -2889,20 +3509,26 @@ func (s *Service) runScheduledPipeline(repoID int64, expression string) {
 		return
 	}
 
+	if _, err := s.fireCronPipeline(ctx, repo, expression, firstNonEmpty(repo.Owner, "cron")); err != nil {
+		log.Error().Err(err).Int64("repo_id", repoID).Str("cron_expression", expression).Msg("failed to trigger cron pipeline")
+	}
+}
+
+// fireCronPipeline starts the pipeline of a cron schedule and records when it fired.
+func (s *Service) fireCronPipeline(ctx context.Context, repo *model.Repo, expression, author string) (*model.Pipeline, error) {
 	cfg, err := s.EnsurePipelineConfig(ctx, repo)
 	if err != nil {
-		log.Error().Err(err).Int64("repo_id", repoID).Str("cron_expression", expression).Msg("failed to load pipeline configuration for cron pipeline")
-		return
+		return nil, fmt.Errorf("load pipeline configuration: %w", err)
 	}
 
-	author := firstNonEmpty(repo.Owner, "cron")
 	branch := strings.TrimSpace(repo.Branch)
+	triggeredAt := time.Now().UTC()
 
 	opts := model.PipelineOptions{
 		Branch: branch,
 		Variables: map[string]string{
 			"CRON_EXPRESSION":   expression,
-			"CRON_TRIGGERED_AT": time.Now().UTC().Format(time.RFC3339),
+			"CRON_TRIGGERED_AT": triggeredAt.Format(time.RFC3339),
 			"CRON_TRIGGERED_BY": author,
 		},
 	}
@@ -2914,13 +3540,21 @@ func (s *Service) runScheduledPipeline(repoID int64, expression string) {
 	title := fmt.Sprintf("定时任务 - %s", expression)
 
 	log.Info().
-		Int64("repo_id", repoID).
+		Int64("repo_id", repo.ID).
 		Str("cron_expression", expression).
 		Msg("triggering scheduled pipeline")
 
-	if _, err := s.triggerPipelineWithEvent(ctx, repo, cfg, opts, model.EventCron, author, message, title); err != nil {
-		log.Error().Err(err).Int64("repo_id", repoID).Str("cron_expression", expression).Msg("failed to trigger cron pipeline")
+	pipeline, err := s.triggerPipelineWithEvent(ctx, repo, cfg, opts, model.EventCron, author, message, title)
+	if err != nil {
+		return nil, err
+	}
+	if pipeline.Status != model.StatusSkipped {
+		s.metrics.CronTriggered(repo.FullName)
 	}
+	if err := s.recordCronTrigger(ctx, repo.ID, expression, triggeredAt.Unix()); err != nil {
+		log.Warn().Err(err).Int64("repo_id", repo.ID).Str("cron_expression", expression).Msg("failed to record cron trigger time")
+	}
+	return pipeline, nil
 }
 
 func sanitizeCronSchedules(schedules []string) []string {
@@ -2988,17 +3622,8 @@ func (s *Service) enforcePipelineRetention(ctx context.Context, repo *model.Repo
 		return nil
 	}
 
-	var obsoleteIDs []int64
 	const retentionSelectLimit = 10000
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("repo_id = ?", repo.ID).
-			Order("created DESC").
-			Offset(maxRecords).
-			Limit(retentionSelectLimit).
-			Pluck("id", &obsoleteIDs).Error
-	})
+	obsoleteIDs, err := s.store.ListObsoletePipelineIDs(ctx, repo.ID, maxRecords, retentionSelectLimit)
 	if err != nil {
 		return err
 	}
@@ -3008,37 +3633,12 @@ func (s *Service) enforcePipelineRetention(ctx context.Context, repo *model.Repo
 		return nil
 	}
 
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		// collect step ids for logs
-		var stepIDs []int64
-		if err := tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("pipeline_id IN ?", obsoleteIDs).
-			Pluck("id", &stepIDs).Error; err != nil {
-			return err
-		}
-
-		if len(stepIDs) > 0 {
-			if err := tx.WithContext(ctx).Delete(&model.LogEntry{}, "step_id IN ?", stepIDs).Error; err != nil {
-				return err
-			}
-		}
-
-		if err := tx.WithContext(ctx).Delete(&model.Step{}, "pipeline_id IN ?", obsoleteIDs).Error; err != nil {
-			return err
-		}
-		if err := tx.WithContext(ctx).Delete(&model.Workflow{}, "pipeline_id IN ?", obsoleteIDs).Error; err != nil {
-			return err
-		}
-		if err := tx.WithContext(ctx).Delete(&model.Task{}, "pipeline_id IN ?", obsoleteIDs).Error; err != nil {
-			return err
-		}
-		return tx.WithContext(ctx).Delete(&model.Pipeline{}, "id IN ?", obsoleteIDs).Error
-	}); err != nil {
+	if err := s.store.DeletePipelines(ctx, obsoleteIDs); err != nil {
 		return err
 	}
 
 	s.cleanupObsoleteWorkspaces(repo, settings, obsoleteIDs)
+	s.removeArtifactFiles(obsoleteIDs)
 	s.cleanupExpiredWorkspaces(ctx, repo, settings)
 	return nil
 }
@@ -3135,13 +3735,8 @@ func (s *Service) cleanupExpiredWorkspaces(ctx context.Context, repo *model.Repo
 
 func (s *Service) fetchPipelineIDSet(ctx context.Context, repoID int64) map[int64]struct{} {
 	result := make(map[int64]struct{})
-	var ids []int64
-	if err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("repo_id = ?", repoID).
-			Pluck("id", &ids).Error
-	}); err != nil {
+	ids, err := s.store.ListPipelineIDs(ctx, repoID)
+	if err != nil {
 		log.Warn().Err(err).Int64("repo_id", repoID).Msg("failed to query existing pipeline ids for workspace cleanup")
 		return result
 	}
@@ -3157,6 +3752,7 @@ func resolveWorkspaceCommit(ctx context.Context, dir string) (string, error) {
 		return "", fmt.Errorf("git directory not found")
 	}
 	cmd := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD")
+	cmd.Env = defaultHostEnvList()
 	output, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -3168,12 +3764,7 @@ func (s *Service) updatePipelineCommit(ctx context.Context, pipelineID int64, co
 	if strings.TrimSpace(commit) == "" {
 		return nil
 	}
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("id = ?", pipelineID).
-			Update("commit", commit).Error
-	})
+	return s.store.UpdatePipeline(ctx, pipelineID, map[string]any{"commit": commit})
 }
 
 func addCredentialsToURL(rawURL, username, password string) (string, error) {
@@ -3190,19 +3781,66 @@ func cloneSupportsCredentials(rawURL string) bool {
 	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
 }
 
-func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, settings *model.RepoPipelineConfig, requested map[string]string) (map[string]string, string, map[string]resolvedSecretBinding) {
+// buildSecretEnv resolves the secret aliases requested by the steps. An alias resolves to a
+// repository secret first, then a global secret, then a certificate bound to the repository
+// and finally a global certificate. Without requested aliases only bound certificates are
+// exported. It also returns the clone URL carrying the first git credentials and the first
+// ssh deploy key; the key is kept out of the step environment.
+func (s *Service) buildSecretEnv(ctx context.Context, repo *model.Repo, settings *model.RepoPipelineConfig, requested map[string]string) (map[string]string, string, *model.SSHCertificate, map[string]resolvedSecretBinding) {
 	env := make(map[string]string)
 	bindings := make(map[string]resolvedSecretBinding)
 	if s.systemSvc == nil || repo == nil {
-		return env, "", bindings
+		return env, "", nil, bindings
 	}
+	ctx = s.repoScope(ctx, repo)
 
 	includeAll := len(requested) == 0
 
 	var cloneOverride string
+	var cloneKey *model.SSHCertificate
 	usedSanitized := make(map[string]struct{})
 	resolvedAliases := make(map[string]struct{})
 
+	for aliasKey, original := range requested {
+		if strings.TrimSpace(original) == "" {
+			continue
+		}
+		secret, err := s.systemSvc.ResolveSecret(ctx, repo.ID, original)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("alias", original).
+				Msg("failed to resolve secret for pipeline")
+			continue
+		}
+		if secret == nil {
+			continue
+		}
+		sanitized := sanitizeAlias(original)
+		if sanitized == "" {
+			sanitized = fmt.Sprintf("SECRET_%d", secret.ID)
+		}
+		if _, exists := usedSanitized[sanitized]; exists {
+			sanitized = fmt.Sprintf("%s_%d", sanitized, secret.ID)
+		}
+		usedSanitized[sanitized] = struct{}{}
+
+		resolved := resolvedSecretBinding{
+			Alias:          original,
+			SanitizedAlias: sanitized,
+			Type:           "secret",
+			Values:         map[string]string{},
+		}
+		for key, value := range secret.Values {
+			resolved.Values[key] = value
+			if envKey := sanitizeAlias(key); envKey != "" {
+				env[fmt.Sprintf("%s_%s", sanitized, envKey)] = value
+			}
+		}
+		bindings[aliasKey] = resolved
+		resolvedAliases[aliasKey] = struct{}{}
+	}
+
 	if settings != nil {
 		for _, binding := range settings.LegacyCertificates {
 			if binding.CertificateID == 0 {
@@ -3219,6 +3857,9 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 					continue
 				}
 			}
+			if _, ok := resolvedAliases[aliasKey]; ok {
+				continue
+			}
 
 			sanitized := sanitizeAlias(aliasOriginal)
 			if sanitized == "" {
@@ -3237,12 +3878,22 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 					Msg("failed to load certificate for pipeline")
 				continue
 			}
+			if cert == nil {
+				// deleted, or owned by another organization than the repository
+				log.Warn().
+					Int64("certificate_id", binding.CertificateID).
+					Msg("certificate bound to repository not found")
+				continue
+			}
 
 			resolved := resolvedSecretBinding{
-				Alias:          aliasOriginal,
-				SanitizedAlias: sanitized,
-				Type:           cert.Type,
-				Values:         map[string]string{},
+				Alias:              aliasOriginal,
+				SanitizedAlias:     sanitized,
+				Type:               cert.Type,
+				Values:             map[string]string{},
+				CertificateID:      cert.ID,
+				CertificateVersion: cert.Version,
+				CertificateUpdated: cert.Updated,
 			}
 
 			switch strings.ToLower(cert.Type) {
@@ -3264,7 +3915,7 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 				resolved.Values["git.token"] = gitCert.Password
 
 				if cloneOverride == "" && cloneSupportsCredentials(repo.Clone) {
-					if cloneURL, err := addCredentialsToURL(repo.Clone, gitCert.Username, gitCert.Password); err == nil {
+					if cloneURL, err := gitCredentialURL(repo.Clone, gitCert); err == nil {
 						cloneOverride = cloneURL
 					} else {
 						log.Warn().
@@ -3273,6 +3924,20 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 							Msg("failed to apply credentials to clone url")
 					}
 				}
+			case model.CertificateTypeSSH:
+				sshCert, err := cert.AsSSHCertificate()
+				if err != nil {
+					log.Warn().
+						Err(err).
+						Int64("certificate_id", binding.CertificateID).
+						Msg("invalid ssh certificate")
+					continue
+				}
+				resolved.Values["ssh.private_key"] = sshCert.PrivateKey
+				resolved.Values["ssh.passphrase"] = sshCert.Passphrase
+				if cloneKey == nil {
+					cloneKey = sshCert
+				}
 			case "docker":
 				dockerCert, err := cert.AsDockerCertificate()
 				if err != nil {
@@ -3332,10 +3997,13 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 			usedSanitized[sanitized] = struct{}{}
 
 			resolved := resolvedSecretBinding{
-				Alias:          original,
-				SanitizedAlias: sanitized,
-				Type:           cert.Type,
-				Values:         map[string]string{},
+				Alias:              original,
+				SanitizedAlias:     sanitized,
+				Type:               cert.Type,
+				Values:             map[string]string{},
+				CertificateID:      cert.ID,
+				CertificateVersion: cert.Version,
+				CertificateUpdated: cert.Updated,
 			}
 
 			switch strings.ToLower(cert.Type) {
@@ -3358,7 +4026,7 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 				resolved.Values["git.token"] = gitCert.Password
 
 				if cloneOverride == "" && cloneSupportsCredentials(repo.Clone) {
-					if cloneURL, err := addCredentialsToURL(repo.Clone, gitCert.Username, gitCert.Password); err == nil {
+					if cloneURL, err := gitCredentialURL(repo.Clone, gitCert); err == nil {
 						cloneOverride = cloneURL
 					} else {
 						log.Warn().
@@ -3368,6 +4036,21 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 							Msg("failed to apply credentials to clone url")
 					}
 				}
+			case model.CertificateTypeSSH:
+				sshCert, err := cert.AsSSHCertificate()
+				if err != nil {
+					log.Warn().
+						Err(err).
+						Int64("certificate_id", cert.ID).
+						Str("alias", original).
+						Msg("invalid global ssh certificate")
+					continue
+				}
+				resolved.Values["ssh.private_key"] = sshCert.PrivateKey
+				resolved.Values["ssh.passphrase"] = sshCert.Passphrase
+				if cloneKey == nil {
+					cloneKey = sshCert
+				}
 			case "docker":
 				dockerCert, err := cert.AsDockerCertificate()
 				if err != nil {
@@ -3400,20 +4083,65 @@ func (s *Service) buildCertificateEnv(ctx context.Context, repo *model.Repo, set
 		}
 	}
 
-	return env, cloneOverride, bindings
+	return env, cloneOverride, cloneKey, bindings
+}
+
+// runSecrets are the secrets, certificates and clone credentials a run uses.
+type runSecrets struct {
+	// Env holds the variables derived from the certificates bound in the settings.
+	Env map[string]string `json:"env"`
+	// CloneURL overrides the clone URL of the repository with one carrying credentials.
+	CloneURL string                `json:"clone_url,omitempty"`
+	CloneKey *model.SSHCertificate `json:"clone_key,omitempty"`
+	// Bindings are the resolved secrets by lower-cased alias.
+	Bindings map[string]resolvedSecretBinding `json:"bindings"`
+	// Masked lists values no binding holds that logs must hide, like the password of the
+	// repository certificate.
+	Masked []string `json:"masked,omitempty"`
+}
+
+// runSecretSource resolves the secrets of the run a store belongs to elsewhere, like the
+// server an agent runs tasks for.
+type runSecretSource interface {
+	RunSecrets(ctx context.Context) (*runSecrets, error)
+}
+
+// runSecrets resolves the secrets requested by the steps of a run of repo, through the store
+// when it is a runSecretSource.
+func (s *Service) runSecrets(ctx context.Context, repo *model.Repo, settings *model.RepoPipelineConfig, requested map[string]string) (*runSecrets, error) {
+	if source, ok := s.store.(runSecretSource); ok {
+		return source.RunSecrets(ctx)
+	}
+	env, cloneOverride, cloneKey, bindings := s.buildSecretEnv(ctx, repo, settings, requested)
+	secrets := &runSecrets{Env: env, CloneURL: cloneOverride, CloneKey: cloneKey, Bindings: bindings}
+	if cloneOverride == "" && cloneKey == nil && repo.CertificateID != 0 {
+		// imported repositories have no forge token to fall back on; they clone with their own
+		// certificate unless the pipeline settings bind one
+		authURL, key, secret, err := s.repoCloneCredentials(ctx, repo)
+		if err != nil {
+			log.Warn().Err(err).Int64("repo_id", repo.ID).Msg("failed to resolve repository clone certificate")
+			return secrets, nil
+		}
+		if authURL != strings.TrimSpace(repo.Clone) {
+			secrets.CloneURL = authURL
+		}
+		secrets.CloneKey = key
+		if secret != "" {
+			secrets.Masked = append(secrets.Masked, secret)
+		}
+	}
+	return secrets, nil
 }
 
 // CancelPipelineRun stops an in-flight pipeline and marks it as killed.
 func (s *Service) CancelPipelineRun(ctx context.Context, repoID, pipelineID int64, reason string) error {
-	var pipeline model.Pipeline
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Where("id = ? AND repo_id = ?", pipelineID, repoID).
-			Take(&pipeline).Error
-	})
+	pipeline, err := s.store.GetPipeline(ctx, pipelineID)
 	if err != nil {
 		return err
 	}
+	if pipeline.RepoID != repoID {
+		return gorm.ErrRecordNotFound
+	}
 
 	switch pipeline.Status {
 	case model.StatusSuccess, model.StatusFailure, model.StatusKilled, model.StatusError:
@@ -3423,6 +4151,8 @@ func (s *Service) CancelPipelineRun(ctx context.Context, repoID, pipelineID int6
 	if handleAny, ok := s.executions.Load(pipelineID); ok && handleAny != nil {
 		if handle, ok := handleAny.(*executionHandle); ok && handle.cancel != nil {
 			handle.cancel()
+			// a step blocked in a long container command would otherwise run to its end
+			go s.stopExecutionContainers(handle)
 		}
 	}
 
@@ -3432,47 +4162,21 @@ func (s *Service) CancelPipelineRun(ctx context.Context, repoID, pipelineID int6
 		cancelMessage = "Pipeline cancelled by user"
 	}
 
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.WithContext(ctx).
-			Model(&model.Pipeline{}).
-			Where("id = ?", pipelineID).
-			Updates(map[string]any{
-				"status":   model.StatusKilled,
-				"message":  cancelMessage,
-				"finished": now,
-				"updated":  now,
-			}).Error; err != nil {
-			return err
-		}
-
-		if err := tx.WithContext(ctx).
-			Model(&model.Workflow{}).
-			Where("pipeline_id = ? AND state IN ?", pipelineID, []model.StatusValue{model.StatusPending, model.StatusRunning}).
-			Updates(map[string]any{
-				"state":    model.StatusKilled,
-				"finished": now,
-			}).Error; err != nil {
-			return err
-		}
-
-		if err := tx.WithContext(ctx).
-			Model(&model.Step{}).
-			Where("pipeline_id = ? AND state IN ?", pipelineID, []model.StatusValue{model.StatusPending, model.StatusRunning}).
-			Updates(map[string]any{
-				"state":    model.StatusKilled,
-				"finished": now,
-				"failure":  "",
-				"error":    "",
-			}).Error; err != nil {
-			return err
+	if err := s.store.KillPipeline(ctx, pipelineID, cancelMessage, now); err != nil {
+		if errors.Is(err, ErrIllegalTransition) {
+			return fmt.Errorf("pipeline 已结束，无法取消: %w", err)
 		}
-
-		return tx.WithContext(ctx).Delete(&model.Task{}, "pipeline_id = ?", pipelineID).Error
-	}); err != nil {
 		return err
 	}
 
 	s.executions.Delete(pipelineID)
+	s.repoSlots.forget(pipeline.RepoID, pipelineID)
+	s.publishPipelineStatus(ctx, pipelineID, pipeline.Status, model.StatusKilled)
+	s.observePipeline(ctx, pipelineID, metrics.ResultCancelled)
+	s.audit.Record(ctx, model.AuditActionPipelineCancel, model.AuditResourcePipeline, strconv.FormatInt(pipelineID, 10), repoID, map[string]interface{}{
+		"number": pipeline.Number,
+		"reason": cancelMessage,
+	})
 	return nil
 }
 
@@ -3509,25 +4213,26 @@ func statusFromPipeline(status model.StatusValue) model.StatusValue {
 	}
 }
 
-func (s *Service) getPipelineStatus(ctx context.Context, pipelineID int64) (model.StatusValue, error) {
-	var pipeline model.Pipeline
-	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
-			Select("status").
-			Where("id = ?", pipelineID).
-			Take(&pipeline).Error
-	})
+// pipelineFinalised reports whether the pipeline reached a terminal status.
+func (s *Service) pipelineFinalised(ctx context.Context, pipelineID int64) bool {
+	status, err := s.getPipelineStatus(ctx, pipelineID)
 	if err != nil {
-		return "", err
+		return false
+	}
+	switch status {
+	case model.StatusSuccess, model.StatusFailure, model.StatusKilled, model.StatusError:
+		return true
 	}
-	return pipeline.Status, nil
+	return false
+}
+
+func (s *Service) getPipelineStatus(ctx context.Context, pipelineID int64) (model.StatusValue, error) {
+	return s.store.GetPipelineStatus(ctx, pipelineID)
 }
 
 func (s *Service) removeTaskRecord(ctx context.Context, taskID string) error {
 	if taskID == "" {
 		return nil
 	}
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).Delete(&model.Task{}, "id = ?", taskID).Error
-	})
+	return s.store.DeleteTask(ctx, taskID)
 }
@@ -0,0 +1,29 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func TestServiceWithoutQueue(t *testing.T) {
+	svc := NewService(nil, nil, nil)
+	ctx := context.Background()
+
+	if svc.Available() {
+		t.Errorf("service without a store and queue reports itself available")
+	}
+	if err := svc.Start(ctx); !errors.Is(err, model.ErrFeatureUnavailable) {
+		t.Errorf("Start = %v, want feature unavailable", err)
+	}
+	var unavailable *model.FeatureUnavailableError
+	err := svc.EnqueueTask(ctx, &model.Task{ID: "task-1"})
+	if !errors.As(err, &unavailable) || unavailable.Subsystem != model.CapabilityPipeline {
+		t.Errorf("EnqueueTask = %v, want the pipeline unavailable", err)
+	}
+	if info := svc.QueueInfo(ctx); !info.Paused || len(info.Pending) != 0 {
+		t.Errorf("QueueInfo = %+v, want an empty paused queue", info)
+	}
+}
@@ -0,0 +1,196 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	pipelineruntime "github.com/thepenn/devsys/service/pipeline/runtime"
+	dockerruntime "github.com/thepenn/devsys/service/pipeline/runtime/docker"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+const (
+	// defaultServiceHealthTimeout bounds the wait for a service health command when the spec
+	// sets no health_timeout.
+	defaultServiceHealthTimeout = time.Minute
+	serviceHealthInterval       = time.Second
+)
+
+// pipelineServiceConfig is a service container of a step as stored in the task payload.
+type pipelineServiceConfig struct {
+	Name  string            `json:"name"`
+	Image string            `json:"image"`
+	Env   map[string]string `json:"env,omitempty"`
+	Ports []string          `json:"ports,omitempty"`
+	// Health is a shell command run in the service until it exits 0.
+	Health        string `json:"health,omitempty"`
+	HealthTimeout int64  `json:"health_timeout,omitempty"`
+}
+
+func newPipelineServiceConfigs(services []spec.ServiceSpec) []pipelineServiceConfig {
+	if len(services) == 0 {
+		return nil
+	}
+	configs := make([]pipelineServiceConfig, 0, len(services))
+	for _, svc := range services {
+		configs = append(configs, pipelineServiceConfig{
+			Name:          svc.Name,
+			Image:         svc.Image,
+			Env:           cloneStringMap(svc.Env),
+			Ports:         append([]string{}, svc.Ports...),
+			Health:        svc.Health,
+			HealthTimeout: int64(svc.HealthTimeout / time.Second),
+		})
+	}
+	return configs
+}
+
+// serviceEnv returns <NAME>_HOST and, for services declaring ports, <NAME>_PORT for the
+// services of a step.
+func serviceEnv(services []pipelineServiceConfig) map[string]string {
+	env := make(map[string]string, len(services)*2)
+	for _, svc := range services {
+		prefix := spec.ServiceEnvPrefix(svc.Name)
+		env[prefix+"_HOST"] = svc.Name
+		if len(svc.Ports) > 0 {
+			port, _, _ := strings.Cut(svc.Ports[0], "/")
+			env[prefix+"_PORT"] = port
+		}
+	}
+	return env
+}
+
+// serviceNetwork is the docker network of a pipeline that steps with services and their
+// service containers join. It is created for the first such step and removed with the run.
+type serviceNetwork struct {
+	pipelineID int64
+
+	mu      sync.Mutex
+	runtime *dockerruntime.Runtime
+	name    string
+	id      string
+}
+
+func (n *serviceNetwork) ensure(ctx context.Context, runtime *dockerruntime.Runtime) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.id != "" {
+		return n.name, nil
+	}
+	// the random part keeps a rerun after a crash clear of a network left behind
+	name := sanitizeContainerName(generateRandomID(fmt.Sprintf("devsys-pipeline-%d", n.pipelineID)))
+	id, err := runtime.CreateNetwork(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	n.runtime, n.name, n.id = runtime, name, id
+	return name, nil
+}
+
+func (n *serviceNetwork) remove() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.id == "" {
+		return
+	}
+	if err := n.runtime.RemoveNetwork(context.Background(), n.id); err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", n.pipelineID).Str("network", n.name).Msg("failed to remove pipeline network")
+	}
+	n.id = ""
+}
+
+// startStepServices starts the services of step on the pipeline network and waits until
+// their health commands succeed. It returns the network the step containers must join and
+// a stop function removing the services, which the caller runs whatever the step outcome.
+// Service output goes to logFn prefixed with the service name.
+func (s *Service) startStepServices(ctx context.Context, step pipelineTaskStep, stepEnv map[string]string, secrets map[string]resolvedSecretBinding, network *serviceNetwork, logFn func(string) error) (string, func(), error) {
+	noop := func() {}
+	if len(step.Services) == 0 {
+		return "", noop, nil
+	}
+	runtime, err := s.dockerRunner()
+	if err != nil {
+		return "", noop, err
+	}
+	networkName, err := network.ensure(ctx, runtime)
+	if err != nil {
+		return "", noop, err
+	}
+
+	var started []*dockerruntime.ServiceContainer
+	stop := func() {
+		for i := len(started) - 1; i >= 0; i-- {
+			started[i].Stop()
+		}
+	}
+	for _, svc := range step.Services {
+		_ = logFn(fmt.Sprintf("启动服务 %s (%s)", svc.Name, svc.Image))
+		prefix := fmt.Sprintf("[%s] ", svc.Name)
+		container, err := runtime.StartService(ctx, dockerruntime.ContainerConfig{
+			Name:         serviceContainerName(step, stepEnv, svc.Name),
+			Image:        svc.Image,
+			Env:          envMapToSlice(applyEnvPlaceholdersToMap(svc.Env, stepEnv)),
+			Network:      networkName,
+			PullPolicy:   pipelineruntime.PullPolicy(step.Pull),
+			RegistryAuth: registryAuthForImage(svc.Image, secrets),
+			Labels:       step.Containers.labels(),
+			Tracker:      step.Containers,
+		}, []string{svc.Name}, func(line string) error {
+			return logFn(prefix + line)
+		})
+		if err != nil {
+			stop()
+			return "", noop, fmt.Errorf("启动服务 %s 失败: %w", svc.Name, err)
+		}
+		started = append(started, container)
+		if err := waitServiceHealthy(ctx, container, svc, logFn); err != nil {
+			stop()
+			return "", noop, err
+		}
+	}
+	return networkName, stop, nil
+}
+
+// waitServiceHealthy runs the health command of svc until it succeeds, the service exits or
+// the health timeout passes.
+func waitServiceHealthy(ctx context.Context, container *dockerruntime.ServiceContainer, svc pipelineServiceConfig, logFn func(string) error) error {
+	if strings.TrimSpace(svc.Health) == "" {
+		return nil
+	}
+	timeout := defaultServiceHealthTimeout
+	if svc.HealthTimeout > 0 {
+		timeout = time.Duration(svc.HealthTimeout) * time.Second
+	}
+	_ = logFn(fmt.Sprintf("等待服务 %s 就绪: %s", svc.Name, svc.Health))
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(serviceHealthInterval)
+	defer ticker.Stop()
+	for {
+		exitCode, err := container.Exec(waitCtx, []string{"/bin/sh", "-c", svc.Health})
+		if err == nil && exitCode == 0 {
+			_ = logFn(fmt.Sprintf("服务 %s 已就绪", svc.Name))
+			return nil
+		}
+		if running, code, inspectErr := container.Running(waitCtx); inspectErr == nil && !running {
+			return fmt.Errorf("服务 %s 已退出，退出码 %d", svc.Name, code)
+		}
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("服务 %s 在 %s 内未就绪", svc.Name, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func serviceContainerName(step pipelineTaskStep, env map[string]string, service string) string {
+	return sanitizeContainerName(fmt.Sprintf("%s-svc-%s", commandContainerName(step, env, -1), service))
+}
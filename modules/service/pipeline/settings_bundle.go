@@ -0,0 +1,359 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	cron "github.com/gdgvda/cron"
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// PipelineBundleFormat is the bundle format written by ExportPipelineBundle.
+const PipelineBundleFormat = 1
+
+// PipelineBundle is the pipeline setup of a repository in a form that can be applied to
+// another one: config content, settings including cron schedules, and variables. Fields are
+// tagged for JSON and YAML, and YAML decoding accepts both. Empty content and nil settings
+// leave those of the target repository as they are.
+type PipelineBundle struct {
+	Format    int                      `json:"format"              yaml:"format"`
+	Source    string                   `json:"source,omitempty"    yaml:"source,omitempty"`
+	Content   string                   `json:"content"             yaml:"content"`
+	Settings  *PipelineBundleSettings  `json:"settings,omitempty"  yaml:"settings,omitempty"`
+	Variables []PipelineBundleVariable `json:"variables,omitempty" yaml:"variables,omitempty"`
+}
+
+// PipelineBundleSettings are the repository pipeline settings of a bundle.
+type PipelineBundleSettings struct {
+	ConfigSource       string   `json:"config_source,omitempty" yaml:"config_source,omitempty"`
+	ConfigFile         string   `json:"config_file,omitempty"   yaml:"config_file,omitempty"`
+	CleanupEnabled     bool     `json:"cleanup_enabled"         yaml:"cleanup_enabled"`
+	RetentionDays      int      `json:"retention_days"          yaml:"retention_days"`
+	MaxRecords         int      `json:"max_records"             yaml:"max_records"`
+	Dockerfile         string   `json:"dockerfile,omitempty"    yaml:"dockerfile,omitempty"`
+	DisallowParallel   bool     `json:"disallow_parallel"       yaml:"disallow_parallel"`
+	CronSchedules      []string `json:"cron_schedules"          yaml:"cron_schedules"`
+	StepCPU            string   `json:"step_cpu,omitempty"      yaml:"step_cpu,omitempty"`
+	StepMemory         string   `json:"step_memory,omitempty"   yaml:"step_memory,omitempty"`
+	ReportCommitStatus bool     `json:"report_commit_status,omitempty" yaml:"report_commit_status,omitempty"`
+	LogRetentionDays   int      `json:"log_retention_days,omitempty" yaml:"log_retention_days,omitempty"`
+	PublicStatus       bool     `json:"public_status,omitempty" yaml:"public_status,omitempty"`
+	PublicMessages     bool     `json:"public_messages,omitempty" yaml:"public_messages,omitempty"`
+}
+
+// PipelineBundleVariable is a repository variable of a bundle. Exported bundles omit the
+// values of secret variables.
+type PipelineBundleVariable struct {
+	Key    string `json:"key"             yaml:"key"`
+	Value  string `json:"value,omitempty" yaml:"value,omitempty"`
+	Secret bool   `json:"secret"          yaml:"secret"`
+}
+
+const (
+	BundleChangeCreate = "create"
+	BundleChangeUpdate = "update"
+	// BundleChangeSkip is a bundle entry left out, like a secret variable without a value
+	// the repository does not have yet.
+	BundleChangeSkip = "skip"
+)
+
+// PipelineBundleChange is one difference between a bundle and the repository it is applied to.
+type PipelineBundleChange struct {
+	Field   string `json:"field"`
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+}
+
+// PipelineBundleResult lists what applying a bundle changes, or would change for a dry run.
+type PipelineBundleResult struct {
+	DryRun  bool                   `json:"dry_run"`
+	Changes []PipelineBundleChange `json:"changes"`
+}
+
+// ExportPipelineBundle returns the pipeline setup of a repository. The values of secret
+// variables are only included with includeSecrets, for copies that never leave the server.
+func (s *Service) ExportPipelineBundle(ctx context.Context, repo *model.Repo, includeSecrets bool) (*PipelineBundle, error) {
+	if repo == nil {
+		return nil, errors.New("repository is required")
+	}
+	cfg, err := s.GetPipelineSettings(ctx, repo.ID)
+	if err != nil {
+		return nil, err
+	}
+	variables, err := s.repoVariables(ctx, repo.ID)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &PipelineBundle{
+		Format:  PipelineBundleFormat,
+		Source:  repo.FullName,
+		Content: cfg.Content,
+		Settings: &PipelineBundleSettings{
+			ConfigSource:       cfg.ConfigSource,
+			ConfigFile:         cfg.ConfigFile,
+			CleanupEnabled:     cfg.CleanupEnabled,
+			RetentionDays:      cfg.RetentionDays,
+			MaxRecords:         cfg.MaxRecords,
+			Dockerfile:         cfg.Dockerfile,
+			DisallowParallel:   cfg.DisallowParallel,
+			CronSchedules:      sanitizeCronSchedules(cfg.CronSchedules),
+			StepCPU:            cfg.StepCPU,
+			StepMemory:         cfg.StepMemory,
+			ReportCommitStatus: cfg.ReportCommitStatus,
+			LogRetentionDays:   cfg.LogRetentionDays,
+			PublicStatus:       cfg.PublicStatus,
+			PublicMessages:     cfg.PublicMessages,
+		},
+	}
+	for _, variable := range variables {
+		item := PipelineBundleVariable{Key: variable.Key, Value: variable.Value, Secret: variable.Secret}
+		if variable.Secret && !includeSecrets {
+			item.Value = ""
+		}
+		bundle.Variables = append(bundle.Variables, item)
+	}
+	return bundle, nil
+}
+
+// ImportPipelineBundle applies bundle to repoID in a single transaction: the content is saved
+// as a revision by author, the settings replace the current ones and the variables are set,
+// leaving variables the bundle does not name alone. A secret variable without a value keeps
+// the stored value and is skipped when there is none. Validation problems are returned
+// together as a *PipelineConfigError with one diagnostic per field. With dryRun nothing is
+// saved and the result lists what would change.
+func (s *Service) ImportPipelineBundle(ctx context.Context, repoID int64, bundle *PipelineBundle, author string, dryRun bool) (*PipelineBundleResult, error) {
+	if bundle == nil {
+		return nil, fmt.Errorf("导入内容为空")
+	}
+	current, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validatePipelineBundle(ctx, repoID, current, bundle); err != nil {
+		return nil, err
+	}
+	variables, err := s.repoVariables(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+
+	configSource, configFile := current.ConfigSource, current.ConfigFile
+	if bundle.Settings != nil {
+		// already validated above
+		configSource, configFile, _ = s.normalizeConfigSource(bundle.Settings.ConfigSource, bundle.Settings.ConfigFile)
+	}
+	result := &PipelineBundleResult{
+		DryRun:  dryRun,
+		Changes: diffPipelineBundle(current, configSource, configFile, variables, bundle),
+	}
+	if dryRun || len(result.Changes) == 0 {
+		return result, nil
+	}
+
+	change := pipelineConfigChange{
+		now: time.Now().Unix(),
+		edit: func(cfg *model.RepoPipelineConfig) {
+			if strings.TrimSpace(bundle.Content) != "" {
+				cfg.Content = bundle.Content
+			}
+			settings := bundle.Settings
+			if settings == nil {
+				return
+			}
+			schedules := sanitizeCronSchedules(settings.CronSchedules)
+			cfg.ConfigSource = configSource
+			cfg.ConfigFile = configFile
+			cfg.CleanupEnabled = settings.CleanupEnabled
+			cfg.RetentionDays = settings.RetentionDays
+			cfg.MaxRecords = settings.MaxRecords
+			cfg.Dockerfile = settings.Dockerfile
+			cfg.DisallowParallel = settings.DisallowParallel
+			cfg.ReportCommitStatus = settings.ReportCommitStatus
+			cfg.LogRetentionDays = settings.LogRetentionDays
+			cfg.PublicStatus = settings.PublicStatus
+			cfg.PublicMessages = settings.PublicMessages
+			// already validated
+			cfg.StepCPU, cfg.StepMemory, _ = s.normalizeStepResources(settings.StepCPU, settings.StepMemory)
+			cfg.CronSchedules = schedules
+			cfg.LegacyCronEnabled = len(schedules) > 0
+			cfg.LegacyCronSpec = ""
+			if len(schedules) > 0 {
+				cfg.LegacyCronSpec = schedules[0]
+			}
+		},
+		variables: bundle.Variables,
+		activate: func(cfg *model.RepoPipelineConfig) bool {
+			return strings.TrimSpace(cfg.Content) != ""
+		},
+	}
+	if strings.TrimSpace(bundle.Content) != "" {
+		change.revision = &model.RepoPipelineConfigRevision{Author: strings.TrimSpace(author), Message: "导入流水线配置包"}
+		if bundle.Source != "" {
+			change.revision.Message = "从 " + bundle.Source + " 导入流水线配置包"
+		}
+	}
+	saved, repo, err := s.store.SavePipelineConfig(ctx, repoID, change)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(saved.Content) != "" && !repo.IsActive && s.webhooks != nil {
+		if err := s.webhooks.RegisterWebhook(ctx, repo.UserID, repoID); err != nil {
+			if resetErr := s.setRepoActive(ctx, repoID, false); resetErr != nil {
+				log.Warn().Err(resetErr).Int64("repo_id", repoID).Msg("failed to revert repository activation")
+			}
+			return nil, fmt.Errorf("注册仓库 Webhook 失败: %w", err)
+		}
+	}
+
+	normalized := normalizePipelineConfig(saved)
+	s.refreshCronEntries(repoID, normalized.CronSchedules)
+	fields := make([]string, 0, len(result.Changes))
+	for _, change := range result.Changes {
+		if change.Action != BundleChangeSkip {
+			fields = append(fields, change.Field)
+		}
+	}
+	s.audit.Record(ctx, model.AuditActionPipelineImport, model.AuditResourceConfig, strconv.FormatInt(repoID, 10), repoID, map[string]interface{}{
+		"source":        bundle.Source,
+		"config_sha256": configSHA256(normalized.Content),
+		"version":       normalized.Version,
+		"fields":        fields,
+	})
+	return result, nil
+}
+
+// validatePipelineBundle collects every problem of bundle as diagnostics whose path names the
+// offending field: content paths are prefixed with "content".
+func (s *Service) validatePipelineBundle(ctx context.Context, repoID int64, current *model.RepoPipelineConfig, bundle *PipelineBundle) error {
+	result := &spec.LintResult{}
+	if bundle.Format > PipelineBundleFormat {
+		result.Add("format", 0, spec.SeverityError, fmt.Sprintf("不支持的配置包格式版本 %d", bundle.Format))
+	}
+	if strings.TrimSpace(bundle.Content) != "" {
+		lint, err := s.lintPipelineConfig(ctx, repoID, current, bundle.Content)
+		if err != nil {
+			return err
+		}
+		for _, d := range lint.Diagnostics {
+			if d.Severity != spec.SeverityError {
+				continue
+			}
+			d.Path = strings.TrimSuffix("content."+d.Path, ".")
+			result.Diagnostics = append(result.Diagnostics, d)
+		}
+	}
+	if settings := bundle.Settings; settings != nil {
+		if _, _, err := s.normalizeConfigSource(settings.ConfigSource, settings.ConfigFile); err != nil {
+			result.Add("settings.config_source", 0, spec.SeverityError, err.Error())
+		}
+		if settings.RetentionDays < 0 {
+			result.Add("settings.retention_days", 0, spec.SeverityError, "保留天数不能为负数")
+		}
+		if settings.LogRetentionDays < 0 {
+			result.Add("settings.log_retention_days", 0, spec.SeverityError, "日志保留天数不能为负数")
+		}
+		if settings.MaxRecords <= 0 {
+			result.Add("settings.max_records", 0, spec.SeverityError, "最大保留记录数必须大于 0")
+		}
+		if _, _, err := s.normalizeStepResources(settings.StepCPU, settings.StepMemory); err != nil {
+			result.Add("settings.step_resources", 0, spec.SeverityError, err.Error())
+		}
+		for idx, expression := range settings.CronSchedules {
+			if _, err := cron.New().Add(strings.TrimSpace(expression), func() {}); err != nil {
+				result.Add(fmt.Sprintf("settings.cron_schedules[%d]", idx), 0, spec.SeverityError,
+					fmt.Sprintf("无效的 cron 表达式 %q: %v", expression, err))
+			}
+		}
+	}
+	seen := make(map[string]struct{}, len(bundle.Variables))
+	for idx, variable := range bundle.Variables {
+		path := fmt.Sprintf("variables[%d].key", idx)
+		key := strings.TrimSpace(variable.Key)
+		switch {
+		case !envTemplateKeyPattern.MatchString(key):
+			result.Add(path, 0, spec.SeverityError, fmt.Sprintf("变量名 %q 只能包含字母、数字和下划线，且不能以数字开头", variable.Key))
+		case spec.IsReservedEnv(key):
+			result.Add(path, 0, spec.SeverityError, fmt.Sprintf("变量名 %s 与系统保留变量冲突", key))
+		default:
+			if _, dup := seen[key]; dup {
+				result.Add(path, 0, spec.SeverityError, fmt.Sprintf("变量 %s 重复", key))
+			}
+			seen[key] = struct{}{}
+		}
+	}
+	if result.HasErrors() {
+		return &PipelineConfigError{Diagnostics: result.Diagnostics}
+	}
+	return nil
+}
+
+// diffPipelineBundle lists the fields of bundle that differ from the repository state.
+func diffPipelineBundle(current *model.RepoPipelineConfig, configSource, configFile string, variables []*model.RepoVariable, bundle *PipelineBundle) []PipelineBundleChange {
+	changes := []PipelineBundleChange{}
+	update := func(field string, from, to interface{}) {
+		if reflect.DeepEqual(from, to) {
+			return
+		}
+		changes = append(changes, PipelineBundleChange{Field: field, Action: BundleChangeUpdate, Message: fmt.Sprintf("%v -> %v", from, to)})
+	}
+
+	if strings.TrimSpace(bundle.Content) != "" && current.Content != bundle.Content {
+		changes = append(changes, PipelineBundleChange{
+			Field:   "content",
+			Action:  BundleChangeUpdate,
+			Message: fmt.Sprintf("sha256 %s -> %s", shortHash(configSHA256(current.Content)), shortHash(configSHA256(bundle.Content))),
+		})
+	}
+	if settings := bundle.Settings; settings != nil {
+		update("settings.config_source", current.ConfigSource, configSource)
+		update("settings.config_file", current.ConfigFile, configFile)
+		update("settings.cleanup_enabled", current.CleanupEnabled, settings.CleanupEnabled)
+		update("settings.retention_days", current.RetentionDays, settings.RetentionDays)
+		update("settings.max_records", current.MaxRecords, settings.MaxRecords)
+		update("settings.disallow_parallel", current.DisallowParallel, settings.DisallowParallel)
+		update("settings.report_commit_status", current.ReportCommitStatus, settings.ReportCommitStatus)
+		update("settings.log_retention_days", current.LogRetentionDays, settings.LogRetentionDays)
+		update("settings.public_status", current.PublicStatus, settings.PublicStatus)
+		update("settings.public_messages", current.PublicMessages, settings.PublicMessages)
+		update("settings.step_cpu", current.StepCPU, strings.TrimSpace(settings.StepCPU))
+		update("settings.step_memory", current.StepMemory, strings.TrimSpace(settings.StepMemory))
+		if current.Dockerfile != settings.Dockerfile {
+			changes = append(changes, PipelineBundleChange{Field: "settings.dockerfile", Action: BundleChangeUpdate})
+		}
+		update("settings.cron_schedules", sanitizeCronSchedules(current.CronSchedules), sanitizeCronSchedules(settings.CronSchedules))
+	}
+
+	existing := make(map[string]*model.RepoVariable, len(variables))
+	for _, variable := range variables {
+		existing[variable.Key] = variable
+	}
+	for _, variable := range bundle.Variables {
+		key := strings.TrimSpace(variable.Key)
+		field := "variables." + key
+		stored, ok := existing[key]
+		switch {
+		case !ok && variable.Secret && variable.Value == "":
+			changes = append(changes, PipelineBundleChange{Field: field, Action: BundleChangeSkip, Message: "密钥变量未包含值，需要手动设置"})
+		case !ok:
+			changes = append(changes, PipelineBundleChange{Field: field, Action: BundleChangeCreate})
+		case stored.Secret != variable.Secret || ((variable.Value != "" || !variable.Secret) && stored.Value != variable.Value):
+			changes = append(changes, PipelineBundleChange{Field: field, Action: BundleChangeUpdate})
+		}
+	}
+	return changes
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+const bundleTestConfig = `name: app
+steps:
+  build:
+    image: golang:1.22
+    commands:
+      - go build ./...
+`
+
+// newBundleService returns a service over a database holding repositories 1 and 2.
+func newBundleService(t *testing.T) (*Service, *gorm.DB) {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.RepoPipelineConfig{}, &model.RepoPipelineConfigRevision{}, &model.RepoVariable{})
+	mustCreate(t, db.GetDB(), &model.Repo{ID: 1, ForgeRemoteID: "1", Owner: "team", Name: "app", FullName: "team/app", IsActive: true})
+	mustCreate(t, db.GetDB(), &model.Repo{ID: 2, ForgeRemoteID: "2", Owner: "team", Name: "copy", FullName: "team/copy", IsActive: true})
+	return NewService(db, nil, nil), db.GetDB()
+}
+
+// configureBundleSource gives repository 1 a config, non-default settings and variables.
+func configureBundleSource(t *testing.T, svc *Service) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := svc.UpsertPipelineConfig(ctx, 1, bundleTestConfig, "alice", ""); err != nil {
+		t.Fatalf("UpsertPipelineConfig: %v", err)
+	}
+	settings := model.RepoPipelineConfig{
+		CleanupEnabled:     true,
+		RetentionDays:      14,
+		MaxRecords:         50,
+		DisallowParallel:   true,
+		CronSchedules:      []string{"0 2 * * *", "30 14 * * 1-5"},
+		Dockerfile:         "FROM alpine\nRUN echo hi\n",
+		StepCPU:            "500m",
+		StepMemory:         "512Mi",
+		ReportCommitStatus: true,
+		LogRetentionDays:   30,
+		PublicStatus:       true,
+	}
+	if _, err := svc.UpsertPipelineSettings(ctx, 1, settings); err != nil {
+		t.Fatalf("UpsertPipelineSettings: %v", err)
+	}
+}
+
+func TestPipelineConfigExportRoundTrip(t *testing.T) {
+	svc, _ := newBundleService(t)
+	configureBundleSource(t, svc)
+	ctx := context.Background()
+
+	exported, err := svc.ExportPipelineConfig(ctx, 1)
+	if err != nil {
+		t.Fatalf("ExportPipelineConfig: %v", err)
+	}
+	if !strings.HasPrefix(exported, bundleTestConfig) || !strings.Contains(exported, "\n"+settingsFooterMarker+"\n# cleanup_enabled: true\n") {
+		t.Fatalf("export =\n%s\nwant the config followed by the commented settings", exported)
+	}
+	parsed, err := ParsePipelineConfigExport(exported)
+	if err != nil {
+		t.Fatalf("ParsePipelineConfigExport: %v", err)
+	}
+	if parsed.Content != bundleTestConfig || parsed.Settings == nil {
+		t.Fatalf("parsed = %q with settings %+v, want the config and its settings", parsed.Content, parsed.Settings)
+	}
+	if _, err := svc.ImportPipelineConfig(ctx, 2, parsed, "bob"); err != nil {
+		t.Fatalf("ImportPipelineConfig: %v", err)
+	}
+
+	again, err := svc.ExportPipelineConfig(ctx, 2)
+	if err != nil {
+		t.Fatalf("ExportPipelineConfig after import: %v", err)
+	}
+	if again != exported {
+		t.Fatalf("export after import =\n%s\nwant\n%s", again, exported)
+	}
+}
+
+func TestParsePipelineConfigExport(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		content string
+		want    *model.RepoPipelineConfig
+	}{
+		{
+			name:    "config without footer",
+			data:    bundleTestConfig,
+			content: bundleTestConfig,
+		},
+		{
+			name: "unknown keys",
+			data: bundleTestConfig + "\n" + settingsFooterMarker + `
+# retention_days: 7
+# max_records: 20
+# added_in_a_later_release: true
+# cron_schedules:
+#   - 0 3 * * *
+# mounts:
+#   - name: cache
+#     path: /cache
+# notifications:
+#   slack: {channel: builds}
+`,
+			content: bundleTestConfig,
+			want:    &model.RepoPipelineConfig{RetentionDays: 7, MaxRecords: 20, CronSchedules: []string{"0 3 * * *"}},
+		},
+		{
+			name:    "windows line endings and blank comment lines",
+			data:    strings.ReplaceAll(bundleTestConfig+"\n"+settingsFooterMarker+"\n# dockerfile: |\n#   FROM alpine\n#\n#   RUN true\n# max_records: 5\n", "\n", "\r\n"),
+			content: bundleTestConfig,
+			want:    &model.RepoPipelineConfig{Dockerfile: "FROM alpine\n\nRUN true\n", MaxRecords: 5},
+		},
+		{
+			name:    "footer only",
+			data:    settingsFooterMarker + "\n# max_records: 5\n",
+			content: "",
+			want:    &model.RepoPipelineConfig{MaxRecords: 5},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := ParsePipelineConfigExport(tc.data)
+			if err != nil {
+				t.Fatalf("ParsePipelineConfigExport: %v", err)
+			}
+			if parsed.Content != tc.content {
+				t.Errorf("content = %q, want %q", parsed.Content, tc.content)
+			}
+			if !reflect.DeepEqual(parsed.Settings, tc.want) {
+				t.Errorf("settings = %+v, want %+v", parsed.Settings, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePipelineConfigExportRejectsTrailingContent(t *testing.T) {
+	data := bundleTestConfig + settingsFooterMarker + "\n# max_records: 5\nsteps: {}\n"
+	if _, err := ParsePipelineConfigExport(data); err == nil {
+		t.Fatalf("ParsePipelineConfigExport accepted content after the settings footer")
+	}
+}
+
+func TestPipelineBundleRoundTrip(t *testing.T) {
+	svc, db := newBundleService(t)
+	configureBundleSource(t, svc)
+	ctx := context.Background()
+	mustCreate(t, db, &model.RepoVariable{RepoID: 1, Key: "REGION", Value: "eu-west-1"})
+	mustCreate(t, db, &model.RepoVariable{RepoID: 1, Key: "TOKEN", Value: "s3cret", Secret: true})
+
+	exported, err := svc.ExportPipelineBundle(ctx, &model.Repo{ID: 1, FullName: "team/app"}, true)
+	if err != nil {
+		t.Fatalf("ExportPipelineBundle: %v", err)
+	}
+	result, err := svc.ImportPipelineBundle(ctx, 2, exported, "bob", false)
+	if err != nil {
+		t.Fatalf("ImportPipelineBundle: %v", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Fatalf("import reported no changes")
+	}
+	again, err := svc.ExportPipelineBundle(ctx, &model.Repo{ID: 2, FullName: "team/copy"}, true)
+	if err != nil {
+		t.Fatalf("ExportPipelineBundle after import: %v", err)
+	}
+	again.Source = exported.Source
+	if !reflect.DeepEqual(again, exported) {
+		t.Fatalf("export after import = %+v\nwant %+v", again, exported)
+	}
+
+	// importing the same bundle again changes nothing
+	result, err = svc.ImportPipelineBundle(ctx, 2, exported, "bob", true)
+	if err != nil {
+		t.Fatalf("ImportPipelineBundle again: %v", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("second import changes %+v, want none", result.Changes)
+	}
+}
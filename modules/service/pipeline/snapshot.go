@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// savePipelineSnapshot records what the pipeline was triggered with. The task payload is
+// dropped when the run finishes, so this is what remains to explain a run afterwards. A
+// failure only loses the snapshot and does not fail the trigger.
+func (s *Service) savePipelineSnapshot(ctx context.Context, repo *model.Repo, cfg *model.RepoPipelineConfig, pipeline *model.Pipeline, content string, fromRepo bool) {
+	snapshot := &model.PipelineSnapshot{
+		PipelineID:    pipeline.ID,
+		Spec:          normalizeSnapshotSpec(content),
+		Branch:        pipeline.Branch,
+		Ref:           pipeline.Ref,
+		Commit:        pipeline.Commit,
+		ConfigSource:  model.PipelineConfigSourceDB,
+		ConfigVersion: pipeline.ConfigVersion,
+		ConfigHash:    pipeline.ConfigHash,
+		Created:       time.Now().Unix(),
+	}
+	if fromRepo {
+		snapshot.ConfigSource = model.PipelineConfigSourceRepo
+		snapshot.ConfigFile = pipelineConfigFile(repo, cfg)
+	}
+
+	variables := map[string]string{}
+	repoVariables, err := s.repoVariables(ctx, repo.ID)
+	if err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipeline.ID).Msg("failed to load repository variables for pipeline snapshot")
+	}
+	for _, variable := range repoVariables {
+		if variable.Secret || spec.IsProtectedEnv(variable.Key) {
+			continue
+		}
+		variables[variable.Key] = variable.Value
+	}
+	for key, value := range pipeline.AdditionalVariables {
+		if strings.TrimSpace(key) == "" || spec.IsProtectedEnv(key) {
+			continue
+		}
+		variables[key] = value
+	}
+	for key := range variables {
+		if shouldMaskKey(key) {
+			variables[key] = "***"
+		}
+	}
+	snapshot.Variables = variables
+
+	if err := s.store.SavePipelineSnapshot(ctx, snapshot); err != nil {
+		log.Warn().Err(err).Int64("pipeline_id", pipeline.ID).Msg("failed to save pipeline snapshot")
+	}
+}
+
+// normalizeSnapshotSpec re-encodes the definition with consistent formatting and masks
+// scalar values under secret-looking keys, such as passwords in env maps.
+func normalizeSnapshotSpec(content string) string {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &root); err != nil {
+		// the definition parsed before the trigger got here; keep it as it was
+		return content
+	}
+	maskSnapshotNode(&root)
+	data, err := yaml.Marshal(&root)
+	if err != nil {
+		return content
+	}
+	return string(data)
+}
+
+func maskSnapshotNode(node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind == yaml.ScalarNode && shouldMaskKey(key.Value) && value.Value != "" {
+				value.Value = "***"
+				value.Tag = "!!str"
+				value.Style = 0
+				continue
+			}
+			maskSnapshotNode(value)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		maskSnapshotNode(child)
+	}
+}
+
+// GetPipelineSnapshot returns the trigger snapshot of a pipeline of the repository, nil when
+// the pipeline has none, like runs triggered before snapshots were recorded.
+func (s *Service) GetPipelineSnapshot(ctx context.Context, repoID, pipelineID int64) (*model.PipelineSnapshot, error) {
+	snapshot, err := s.store.GetPipelineSnapshot(ctx, repoID, pipelineID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
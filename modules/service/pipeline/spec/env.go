@@ -0,0 +1,82 @@
+package spec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// reservedEnvPrefixes are the name prefixes populated by the runner. Step env and trigger
+// variables using them shadow system values and are reported by Warnings.
+var reservedEnvPrefixes = []string{"CI_", "REPO_", "WORKSPACE", "PLUGIN_"}
+
+// protectedEnv lists the reserved names the runner never lets a step override: workspace
+// handling, commit detection and placeholder resolution depend on them.
+var protectedEnv = map[string]struct{}{
+	"WORKSPACE":       {},
+	"CI_WORKSPACE":    {},
+	"REPO_CLONE_PATH": {},
+	"CI_PIPELINE_ID":  {},
+}
+
+// IsReservedEnv reports whether name falls under a reserved prefix.
+func IsReservedEnv(name string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	for _, prefix := range reservedEnvPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProtectedEnv reports whether name is a reserved variable that cannot be overridden.
+func IsProtectedEnv(name string) bool {
+	_, ok := protectedEnv[strings.ToUpper(strings.TrimSpace(name))]
+	return ok
+}
+
+// Warnings lists the step env entries that shadow reserved variables.
+func (p *PipelineSpec) Warnings() []string {
+	if p == nil {
+		return nil
+	}
+	var warnings []string
+	for idx, step := range p.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step-%d", idx+1)
+		}
+		for _, key := range sortedReservedKeys(step.Env) {
+			warnings = append(warnings, reservedEnvWarning(fmt.Sprintf("步骤 %s 的 env", name), key))
+		}
+	}
+	return warnings
+}
+
+// VariableWarnings lists the trigger variables that shadow reserved variables.
+func VariableWarnings(variables map[string]string) []string {
+	var warnings []string
+	for _, key := range sortedReservedKeys(variables) {
+		warnings = append(warnings, reservedEnvWarning("触发变量", key))
+	}
+	return warnings
+}
+
+func reservedEnvWarning(source, key string) string {
+	if IsProtectedEnv(key) {
+		return fmt.Sprintf("%s %s 与系统保留变量重名，执行时将保留系统值", source, key)
+	}
+	return fmt.Sprintf("%s %s 覆盖了系统保留变量，可能影响流水线行为", source, key)
+}
+
+func sortedReservedKeys(env map[string]string) []string {
+	var keys []string
+	for key := range env {
+		if IsReservedEnv(key) {
+			keys = append(keys, strings.TrimSpace(key))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,90 @@
+package spec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReservedEnv(t *testing.T) {
+	for name, want := range map[string]bool{
+		"CI_COMMIT_SHA":  true,
+		"ci_pipeline_id": true,
+		"REPO_NAME":      true,
+		"WORKSPACE":      true,
+		"WORKSPACE_DIR":  true,
+		"PLUGIN_REPO":    true,
+		"GOFLAGS":        false,
+		"MY_CI_FLAG":     false,
+	} {
+		if got := IsReservedEnv(name); got != want {
+			t.Errorf("IsReservedEnv(%s) = %v, want %v", name, got, want)
+		}
+	}
+	for name, want := range map[string]bool{
+		"WORKSPACE":       true,
+		"CI_WORKSPACE":    true,
+		"REPO_CLONE_PATH": true,
+		"ci_pipeline_id":  true,
+		"CI_COMMIT_SHA":   false,
+	} {
+		if got := IsProtectedEnv(name); got != want {
+			t.Errorf("IsProtectedEnv(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestWarningsReportShadowedEnv(t *testing.T) {
+	parsed, err := Parse(`name: app
+steps:
+  build:
+    image: alpine
+    env:
+      WORKSPACE: /tmp
+      CI_COMMIT_SHA: abc
+      GOFLAGS: -mod=mod
+    commands:
+      - true
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	warnings := parsed.Warnings()
+	if len(warnings) != 2 {
+		t.Fatalf("warnings = %q, want CI_COMMIT_SHA and WORKSPACE", warnings)
+	}
+	if !strings.Contains(warnings[0], "CI_COMMIT_SHA") || !strings.Contains(warnings[0], "可能影响") {
+		t.Errorf("warning %q does not say the override applies", warnings[0])
+	}
+	if !strings.Contains(warnings[1], "WORKSPACE") || !strings.Contains(warnings[1], "保留系统值") {
+		t.Errorf("warning %q does not say the system value is kept", warnings[1])
+	}
+
+	variables := VariableWarnings(map[string]string{"CI_PIPELINE_ID": "123", "TARGET": "prod"})
+	if len(variables) != 1 || !strings.Contains(variables[0], "CI_PIPELINE_ID") {
+		t.Errorf("variable warnings = %q, want CI_PIPELINE_ID", variables)
+	}
+}
+
+func TestLintWarnsOnShadowedEnv(t *testing.T) {
+	result := Lint(`name: app
+steps:
+  build:
+    image: alpine
+    env:
+      REPO_CLONE_PATH: /src
+    commands:
+      - true
+`)
+	if result.HasErrors() {
+		t.Fatalf("diagnostics = %+v, want warnings only", result.Diagnostics)
+	}
+	for _, d := range result.Diagnostics {
+		if d.Severity == SeverityWarning && strings.Contains(d.Message, "REPO_CLONE_PATH") {
+			if d.Line != 6 {
+				t.Errorf("warning on line %d, want 6", d.Line)
+			}
+			return
+		}
+	}
+	t.Errorf("diagnostics = %+v, want a warning for REPO_CLONE_PATH", result.Diagnostics)
+}
@@ -0,0 +1,176 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a single validation finding. Path uses dotted step names, e.g.
+// "steps.build.image"; Line is 1-based and 0 when the location is unknown.
+type Diagnostic struct {
+	Path     string   `json:"path"`
+	Line     int      `json:"line"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// LintResult carries the diagnostics of a config and, when it parses, the spec itself.
+type LintResult struct {
+	Spec        *PipelineSpec
+	Diagnostics []Diagnostic
+	stepLines   map[string]int
+}
+
+// knownStepKeys are the step keys understood by Parse; anything else is silently ignored at
+// run time and therefore reported.
+var knownStepKeys = map[string]struct{}{
+	"name": {}, "image": {}, "commands": {}, "secrets": {}, "env": {}, "settings": {},
+	"volumes": {}, "privileged": {}, "when": {}, "depends_on": {}, "timeout": {}, "deploy": {}, "artifacts": {},
+	"runtime": {}, "certificate": {}, "certificates": {}, "services": {}, "pull": {}, "build": {}, "resources": {},
+	"ignore_failure": {}, "always_run": {}, "plugin": {},
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// HasErrors reports whether any diagnostic has error severity.
+func (r *LintResult) HasErrors() bool {
+	for _, d := range r.Diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// StepLine returns the line of the named step, or 0 when unknown.
+func (r *LintResult) StepLine(name string) int {
+	return r.stepLines[name]
+}
+
+// Add appends a diagnostic.
+func (r *LintResult) Add(path string, line int, severity Severity, message string) {
+	r.Diagnostics = append(r.Diagnostics, Diagnostic{Path: path, Line: line, Severity: severity, Message: message})
+}
+
+// Lint parses content and runs the structural and semantic checks that need no server state.
+func Lint(content string) *LintResult {
+	result := &LintResult{stepLines: map[string]int{}}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &root); err != nil {
+		line := 0
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		result.Add("", line, SeverityError, fmt.Sprintf("解析流水线 YAML 失败: %v", err))
+		return result
+	}
+	if len(root.Content) > 0 && root.Content[0].Kind == yaml.MappingNode {
+		lintSteps(result, "steps", mappingValue(root.Content[0], "steps"))
+		lintWorkflows(result, mappingValue(root.Content[0], "workflows"))
+	}
+
+	spec, err := Parse(content)
+	if err != nil {
+		result.Add("", 0, SeverityError, err.Error())
+		return result
+	}
+	result.Spec = spec
+
+	for _, step := range spec.Steps {
+		if step.Approval != nil && step.Approval.Strategy == "all" && len(step.Approval.Approvers) == 0 {
+			result.Add("steps."+step.Name+".settings.approvers", result.StepLine(step.Name), SeverityError,
+				fmt.Sprintf("审批步骤 %s 使用 all 策略时必须指定 approvers", step.Name))
+		}
+	}
+	return result
+}
+
+func lintWorkflows(result *LintResult, workflows *yaml.Node) {
+	if workflows == nil || workflows.Kind != yaml.SequenceNode {
+		return
+	}
+	for idx, item := range workflows.Content {
+		path := fmt.Sprintf("workflows[%d]", idx)
+		if nameNode := mappingValue(item, "name"); nameNode != nil {
+			if name := strings.TrimSpace(nameNode.Value); name != "" {
+				path = "workflows." + name
+			}
+		}
+		lintSteps(result, path+".steps", mappingValue(item, "steps"))
+	}
+}
+
+func lintSteps(result *LintResult, prefix string, steps *yaml.Node) {
+	if steps == nil {
+		return
+	}
+	switch steps.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(steps.Content); i += 2 {
+			name := strings.TrimSpace(steps.Content[i].Value)
+			result.stepLines[name] = steps.Content[i].Line
+			lintStep(result, prefix+"."+name, steps.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for idx, item := range steps.Content {
+			path := fmt.Sprintf("%s[%d]", prefix, idx)
+			if nameNode := mappingValue(item, "name"); nameNode != nil {
+				if name := strings.TrimSpace(nameNode.Value); name != "" {
+					result.stepLines[name] = item.Line
+					path = prefix + "." + name
+				}
+			}
+			lintStep(result, path, item)
+		}
+	}
+}
+
+func lintStep(result *LintResult, path string, step *yaml.Node) {
+	if step == nil || step.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(step.Content); i += 2 {
+		keyNode := step.Content[i]
+		key := strings.ToLower(strings.TrimSpace(keyNode.Value))
+		if _, ok := knownStepKeys[key]; !ok {
+			result.Add(path+"."+keyNode.Value, keyNode.Line, SeverityWarning, fmt.Sprintf("未知的步骤字段 %s，将被忽略", keyNode.Value))
+			continue
+		}
+		if key == "env" && step.Content[i+1].Kind == yaml.MappingNode {
+			lintStepEnv(result, path, step.Content[i+1])
+		}
+	}
+}
+
+func lintStepEnv(result *LintResult, path string, env *yaml.Node) {
+	for i := 0; i+1 < len(env.Content); i += 2 {
+		key := strings.TrimSpace(env.Content[i].Value)
+		if IsReservedEnv(key) {
+			result.Add(path+".env."+key, env.Content[i].Line, SeverityWarning, reservedEnvWarning("步骤 env", key))
+		}
+	}
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(strings.TrimSpace(node.Content[i].Value), key) {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
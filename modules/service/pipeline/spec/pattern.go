@@ -0,0 +1,145 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexPatternPrefixes mark a condition value as a regular expression instead of a glob.
+var regexPatternPrefixes = []string{"~", "regex:"}
+
+// Pattern matches branch and tag names in step conditions. Globs follow path.Match, where
+// * and ? stay within a path segment, plus ** matching across segments; values starting with
+// ~ or regex: are regular expressions matched anywhere unless anchored.
+type Pattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// CompilePattern compiles a condition value.
+func CompilePattern(raw string) (*Pattern, error) {
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return nil, fmt.Errorf("匹配模式为空")
+	}
+	for _, prefix := range regexPatternPrefixes {
+		if expr, ok := strings.CutPrefix(value, prefix); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("正则表达式 %q 无效: %w", expr, err)
+			}
+			return &Pattern{raw: value, re: re}, nil
+		}
+	}
+	expr, err := globToRegexp(strings.TrimRight(value, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("通配模式 %q 无效: %w", value, err)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("通配模式 %q 无效: %w", value, err)
+	}
+	return &Pattern{raw: value, re: re}, nil
+}
+
+// Match reports whether name matches. Empty names never match; trailing slashes of globs
+// and names are ignored.
+func (p *Pattern) Match(name string) bool {
+	name = strings.TrimSpace(name)
+	if p == nil || name == "" {
+		return false
+	}
+	if !p.isRegex() {
+		name = strings.TrimRight(name, "/")
+	}
+	return p.re.MatchString(name)
+}
+
+// String returns the pattern as written in the spec.
+func (p *Pattern) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.raw
+}
+
+func (p *Pattern) isRegex() bool {
+	return isRegexValue(p.raw)
+}
+
+func isRegexValue(raw string) bool {
+	for _, prefix := range regexPatternPrefixes {
+		if strings.HasPrefix(raw, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAny reports whether name matches one of patterns. Invalid patterns match nothing;
+// Parse rejects them, so they only reach here from hand-built conditions.
+func MatchAny(patterns []string, name string) bool {
+	for _, raw := range patterns {
+		pattern, err := CompilePattern(raw)
+		if err != nil {
+			continue
+		}
+		if pattern.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp translates a glob into an anchored regular expression.
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				// "**/" also matches no segment at all, so release/**/rc matches release/rc
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("字符类缺少 ]")
+			}
+			class := glob[i+1 : i+1+end]
+			if class == "" || class == "^" || class == "!" {
+				return "", fmt.Errorf("字符类为空")
+			}
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[")
+			b.WriteString(class)
+			b.WriteString("]")
+			i += end + 1
+		case '\\':
+			if i+1 >= len(glob) {
+				return "", fmt.Errorf("转义符位于末尾")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
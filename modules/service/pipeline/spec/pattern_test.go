@@ -0,0 +1,72 @@
+package spec
+
+import "testing"
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"main", "main", true},
+		{" main ", "main", true},
+		{"main", "mainline", false},
+		{"release/*", "release/1.2", true},
+		{"release/*", "release/1.2/hotfix", false},
+		{"release/*", "release", false},
+		{"release/**", "release/1.2/hotfix", true},
+		{"release/**/rc", "release/rc", true},
+		{"release/**/rc", "release/1.2/rc", true},
+		{"feature-?", "feature-a", true},
+		{"feature-?", "feature-ab", false},
+		{"v[0-9].*", "v1.4", true},
+		{"v[!0-9].*", "v1.4", false},
+		{`literal\*`, "literal*", true},
+		{`literal\*`, "literally", false},
+		// trailing slashes of globs and names are ignored
+		{"release/", "release", true},
+		{"release", "release/", true},
+		{"release/*/", "release/1.2/", true},
+		// empty names never match, not even a match-all pattern
+		{"*", "", false},
+		{"**", "  ", false},
+		{"~.*", "", false},
+		// regular expressions match anywhere unless anchored
+		{`~^hotfix-\d+$`, "hotfix-12", true},
+		{`~^hotfix-\d+$`, "hotfix-12a", false},
+		{"regex:feature/.*", "team/feature/login", true},
+		{"regex:^feature/.*", "team/feature/login", false},
+		// the slash is part of a regular expression
+		{"~^release/$", "release/", true},
+	}
+	for _, tt := range tests {
+		pattern, err := CompilePattern(tt.pattern)
+		if err != nil {
+			t.Errorf("CompilePattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := pattern.Match(tt.name); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePatternRejectsInvalid(t *testing.T) {
+	for _, raw := range []string{"", "  ", "release/[", "release/[]", `trailing\`, "~(unclosed", "regex:[z-a]"} {
+		if _, err := CompilePattern(raw); err == nil {
+			t.Errorf("CompilePattern(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"~(unclosed", "main", "release/*"}
+	for name, want := range map[string]bool{"main": true, "release/2.0": true, "develop": false, "": false} {
+		if got := MatchAny(patterns, name); got != want {
+			t.Errorf("MatchAny(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if MatchAny(nil, "main") {
+		t.Errorf("MatchAny without patterns matched")
+	}
+}
@@ -0,0 +1,123 @@
+package spec
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Resources limits the container of a step. CPU is a number of cores such as "2" or "0.5",
+// or millicores like "500m"; Memory a size such as "512m" or "4g". Empty values leave the
+// limit to the repository default.
+type Resources struct {
+	CPU    string
+	Memory string
+}
+
+// memoryUnits are the suffixes accepted by ParseMemory, in bytes. Both docker (4g) and
+// kubernetes (4Gi) spellings are binary units.
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"ki": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"mi": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"gi": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+	"ti": 1 << 40,
+}
+
+// ParseCPU returns the CPU limit in billionths of a core, 0 for an empty value.
+func ParseCPU(raw string) (int64, error) {
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return 0, nil
+	}
+	scale := 1.0
+	if millis, ok := strings.CutSuffix(value, "m"); ok {
+		value, scale = millis, 1e-3
+	}
+	cores, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(cores) || math.IsInf(cores, 0) {
+		return 0, fmt.Errorf("CPU 限制 %q 无效", raw)
+	}
+	nano := int64(math.Round(cores * scale * 1e9))
+	if nano < 1e7 {
+		return 0, fmt.Errorf("CPU 限制 %q 过小，至少为 0.01 核", raw)
+	}
+	return nano, nil
+}
+
+// ParseMemory returns the memory limit in bytes, 0 for an empty value.
+func ParseMemory(raw string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	if value == "" {
+		return 0, nil
+	}
+	end := len(value)
+	for end > 0 && (value[end-1] < '0' || value[end-1] > '9') && value[end-1] != '.' {
+		end--
+	}
+	unit, ok := memoryUnits[strings.TrimSpace(value[end:])]
+	if !ok {
+		return 0, fmt.Errorf("内存限制 %q 的单位无效", raw)
+	}
+	amount, err := strconv.ParseFloat(strings.TrimSpace(value[:end]), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, fmt.Errorf("内存限制 %q 无效", raw)
+	}
+	bytes := amount * float64(unit)
+	// docker refuses memory limits below 6MB
+	if bytes < 6<<20 {
+		return 0, fmt.Errorf("内存限制 %q 过小，至少为 6m", raw)
+	}
+	if bytes > math.MaxInt64 {
+		return 0, fmt.Errorf("内存限制 %q 过大", raw)
+	}
+	return int64(bytes), nil
+}
+
+// parseResources reads `resources: {cpu, memory}`; numbers are accepted for both.
+func parseResources(raw map[string]any) (*Resources, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	resources := &Resources{}
+	for key, value := range raw {
+		var text string
+		switch v := value.(type) {
+		case nil:
+		case string:
+			text = strings.TrimSpace(v)
+		case int, int64, float64:
+			text = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s 必须是字符串或数字", key)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "cpu", "cpus":
+			if _, err := ParseCPU(text); err != nil {
+				return nil, err
+			}
+			resources.CPU = text
+		case "memory", "mem":
+			if _, err := ParseMemory(text); err != nil {
+				return nil, err
+			}
+			resources.Memory = text
+		default:
+			return nil, fmt.Errorf("不支持的资源 %q，仅支持 cpu 与 memory", key)
+		}
+	}
+	if resources.CPU == "" && resources.Memory == "" {
+		return nil, nil
+	}
+	return resources, nil
+}
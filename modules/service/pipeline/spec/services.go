@@ -0,0 +1,147 @@
+package spec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceSpec is a container started next to a step, such as a database for integration
+// tests. The step reaches it by Name, which is also exported as <NAME>_HOST.
+type ServiceSpec struct {
+	Name  string
+	Image string
+	Env   map[string]string
+	// Ports are the container ports the service listens on, like "5432/tcp". The first one
+	// is exported as <NAME>_PORT; nothing is published on the agent.
+	Ports []string
+	// Health is a shell command run inside the service until it succeeds before the step
+	// commands start; empty starts them right away.
+	Health string
+	// HealthTimeout bounds the wait for Health; 0 uses the server default.
+	HealthTimeout time.Duration
+}
+
+// parseServices reads `services:` either as a sequence of mappings with a name or as a
+// mapping keyed by service name.
+func parseServices(node *yaml.Node) ([]ServiceSpec, error) {
+	if node == nil || node.Kind == 0 {
+		return nil, nil
+	}
+	type decodedService struct {
+		Name          string            `yaml:"name"`
+		Image         string            `yaml:"image"`
+		Env           map[string]string `yaml:"env"`
+		Ports         any               `yaml:"ports"`
+		Health        string            `yaml:"health"`
+		HealthTimeout any               `yaml:"health_timeout"`
+	}
+	var decoded []decodedService
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if err := node.Decode(&decoded); err != nil {
+			return nil, err
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			var item decodedService
+			if err := node.Content[i+1].Decode(&item); err != nil {
+				return nil, fmt.Errorf("服务 %q: %w", node.Content[i].Value, err)
+			}
+			item.Name = node.Content[i].Value
+			decoded = append(decoded, item)
+		}
+	default:
+		return nil, fmt.Errorf("services 必须为 mapping 或 sequence 结构")
+	}
+
+	services := make([]ServiceSpec, 0, len(decoded))
+	seen := make(map[string]struct{}, len(decoded))
+	for _, item := range decoded {
+		name := strings.ToLower(strings.TrimSpace(item.Name))
+		if name == "" {
+			return nil, fmt.Errorf("服务缺少 name 字段")
+		}
+		if !validServiceName(name) {
+			return nil, fmt.Errorf("服务名称 %q 无效，仅支持小写字母、数字和 -，且必须以字母开头", item.Name)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("服务 %q 重复定义", name)
+		}
+		seen[name] = struct{}{}
+		image := strings.TrimSpace(item.Image)
+		if image == "" {
+			return nil, fmt.Errorf("服务 %q 缺少镜像定义", name)
+		}
+		ports, err := parseServicePorts(item.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("服务 %q 的 ports 无效: %w", name, err)
+		}
+		healthTimeout, err := parseTimeout(item.HealthTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("服务 %q 的 health_timeout 无效: %w", name, err)
+		}
+		services = append(services, ServiceSpec{
+			Name:          name,
+			Image:         image,
+			Env:           sanitizeEnvMap(item.Env),
+			Ports:         ports,
+			Health:        strings.TrimSpace(item.Health),
+			HealthTimeout: healthTimeout,
+		})
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	return services, nil
+}
+
+// validServiceName reports whether name can be used as a hostname on the step network.
+func validServiceName(name string) bool {
+	if len(name) > 63 || name[0] < 'a' || name[0] > 'z' || strings.HasSuffix(name, "-") {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseServicePorts accepts ports like 5432, "6379" or "53/udp" and returns them as
+// "<port>/<protocol>".
+func parseServicePorts(value any) ([]string, error) {
+	raw, err := parseStringSlice(value)
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]string, 0, len(raw))
+	for _, item := range raw {
+		port, protocol, found := strings.Cut(strings.ToLower(item), "/")
+		if !found {
+			protocol = "tcp"
+		}
+		if protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("端口 %q 的协议仅支持 tcp 或 udp", item)
+		}
+		number, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil || number <= 0 || number > 65535 {
+			return nil, fmt.Errorf("端口 %q 无效", item)
+		}
+		ports = append(ports, fmt.Sprintf("%d/%s", number, protocol))
+	}
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	return ports, nil
+}
+
+// ServiceEnvPrefix returns the prefix of the variables describing a service, e.g. POSTGRES
+// for postgres and REDIS_CACHE for redis-cache.
+func ServiceEnvPrefix(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -2,8 +2,11 @@ package spec
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,7 +15,32 @@ import (
 type PipelineSpec struct {
 	Name      string
 	Workspace string
-	Steps     []StepSpec
+	Clone     *CloneSpec
+	Timeout   time.Duration
+	// Cache lists container paths kept between runs of the repository. Paths are absolute;
+	// those under WorkspacePath are restored into the workspace, others are mounted.
+	Cache []string
+	// Steps lists the steps of all workflows in declaration order.
+	Steps []StepSpec
+	// Workflows holds at least one workflow; a spec with top-level steps has a single one
+	// named after the spec, or DefaultWorkflowName.
+	Workflows []WorkflowSpec
+	// When decides whether a trigger creates a run; nil always does.
+	When *PipelineConditions
+}
+
+// WorkspacePath is where steps see the workspace.
+const WorkspacePath = "/workspace"
+
+// CloneSpec enables the built-in clone phase executed before the first step.
+type CloneSpec struct {
+	LFS bool
+	// Depth limits the fetched history; 0 clones the full history.
+	Depth int
+	// Submodules initialises submodules recursively after checkout.
+	Submodules bool
+	// FetchTags fetches all tags when true and none when false; nil keeps the git default.
+	FetchTags *bool
 }
 
 // StepSpec describes a single build step.
@@ -28,13 +56,101 @@ type StepSpec struct {
 	Kind       StepKind
 	Approval   *ApprovalSpec
 	Conditions *StepConditions
+	DependsOn  []string
+	Timeout    time.Duration
+	Deploy     *DeployTarget
+	// Artifacts lists workspace-relative glob patterns collected after the step succeeds.
+	Artifacts []string
+	// Runtime runs the commands in a container, the default, or directly on the agent.
+	Runtime StepRuntime
+	// Services are started before the commands and removed when the step finishes.
+	Services []ServiceSpec
+	// Pull decides when the step and service images are pulled; empty pulls missing images.
+	Pull PullPolicy
+	// Build makes the step a built-in image build run through the docker API.
+	Build *BuildSpec
+	// Resources limit the step containers; nil uses the repository default.
+	Resources *Resources
+	// Plugin names a registered plugin definition, which provides the image and the schema
+	// Settings are checked against.
+	Plugin string
+	// IgnoreFailure records a failure of the step on the step only; the pipeline carries on
+	// and can still succeed.
+	IgnoreFailure bool
+	// AlwaysRun runs the step even after an earlier step of its workflow failed, for cleanup
+	// and notification steps.
+	AlwaysRun bool
+}
+
+// BuildSpec builds an image from a Dockerfile in the workspace. Tags may use environment
+// placeholders such as ${CI_COMMIT_SHA}; the first tag is the image reported as step output.
+type BuildSpec struct {
+	// Dockerfile and Context are workspace-relative; they default to "Dockerfile" and ".".
+	Dockerfile string
+	Context    string
+	Tags       []string
+	Args       map[string]string
+	// Target is the stage of a multi-stage Dockerfile to build.
+	Target string
+	// Push pushes every tag after the build, logging in with a docker certificate.
+	Push bool
+}
+
+// DeployTarget marks a step as deploying into a kubernetes namespace. Steps sharing a
+// target never run concurrently, across repositories included. With a manifest the step is
+// a built-in deploy step: the server applies the manifest itself instead of running commands.
+type DeployTarget struct {
+	// Cluster is the name or id of a kubernetes certificate.
+	Cluster   string
+	Namespace string
+	// Manifest is an inline manifest; ManifestFile a workspace-relative path to one.
+	Manifest     string
+	ManifestFile string
+	// SetImage changes the image of one container of an existing workload instead of
+	// applying a manifest.
+	SetImage *DeployImage
+	// WaitReady waits for the applied workloads to finish their rollout.
+	WaitReady bool
+}
+
+// DeployImage names the container whose image a deploy step replaces. Image may use
+// environment placeholders such as ${CI_COMMIT_SHA}.
+type DeployImage struct {
+	Kind      string
+	Name      string
+	Container string
+	Image     string
+}
+
+// Builtin reports whether the step is applied by the server rather than by commands.
+func (t *DeployTarget) Builtin() bool {
+	return t != nil && (t.Manifest != "" || t.ManifestFile != "" || t.SetImage != nil)
 }
 
 type StepKind string
 
+type StepRuntime string
+
+const (
+	StepRuntimeDocker StepRuntime = "docker"
+	// StepRuntimeHost runs commands with the shell of the agent, in the workspace directory.
+	StepRuntimeHost StepRuntime = "host"
+)
+
+// PullPolicy decides when the image of a step is pulled.
+type PullPolicy string
+
+const (
+	PullIfNotPresent PullPolicy = "if-not-present"
+	PullAlways       PullPolicy = "always"
+	PullNever        PullPolicy = "never"
+)
+
 const (
 	StepKindCommands StepKind = "commands"
 	StepKindApproval StepKind = "approval"
+	StepKindDeploy   StepKind = "deploy"
+	StepKindBuild    StepKind = "build"
 )
 
 type ApprovalSpec struct {
@@ -44,8 +160,15 @@ type ApprovalSpec struct {
 	Strategy  string
 }
 
+// StepConditions restrict a step to branches and tags matching one of their patterns, globs
+// like release/* or regular expressions like ~^hotfix-\d+$.
 type StepConditions struct {
 	Branches []string
+	// Tags are patterns of the tags the step runs for; see Pattern.
+	Tags []string
+	// Paths are patterns of repository paths, like web/**; the step only runs when one of
+	// the files changed since the last successful run of the branch matches.
+	Paths []string
 }
 
 // Parse parses a pipeline YAML definition and returns a PipelineSpec.
@@ -76,22 +199,149 @@ func Parse(yamlContent string) (*PipelineSpec, error) {
 			spec.Name = strings.TrimSpace(value.Value)
 		case "workspace":
 			spec.Workspace = strings.TrimSpace(value.Value)
+		case "clone":
+			clone, err := parseClone(value)
+			if err != nil {
+				return nil, err
+			}
+			spec.Clone = clone
+		case "timeout":
+			var raw any
+			if err := value.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("解析 timeout 失败: %w", err)
+			}
+			timeout, err := parseTimeout(raw)
+			if err != nil {
+				return nil, fmt.Errorf("timeout: %w", err)
+			}
+			spec.Timeout = timeout
+		case "cache":
+			paths, err := parseCache(value)
+			if err != nil {
+				return nil, err
+			}
+			spec.Cache = paths
 		case "steps":
 			steps, err := parseSteps(value)
 			if err != nil {
 				return nil, err
 			}
 			spec.Steps = steps
+		case "workflows":
+			workflows, err := parseWorkflows(value)
+			if err != nil {
+				return nil, err
+			}
+			spec.Workflows = workflows
+		case "when":
+			when, err := parsePipelineConditions(value)
+			if err != nil {
+				return nil, err
+			}
+			spec.When = when
 		}
 	}
 
+	if len(spec.Workflows) > 0 {
+		if len(spec.Steps) > 0 {
+			return nil, fmt.Errorf("steps 与 workflows 不能同时定义")
+		}
+		if err := validateWorkflows(spec.Workflows); err != nil {
+			return nil, err
+		}
+		for _, workflow := range spec.Workflows {
+			spec.Steps = append(spec.Steps, workflow.Steps...)
+		}
+		return spec, nil
+	}
+
 	if len(spec.Steps) == 0 {
 		return nil, fmt.Errorf("流水线未定义任何步骤")
 	}
+	if err := validateStepDependencies(spec.Steps); err != nil {
+		return nil, err
+	}
+	name := spec.Name
+	if name == "" {
+		name = DefaultWorkflowName
+	}
+	spec.Workflows = []WorkflowSpec{{Name: name, Steps: spec.Steps}}
 
 	return spec, nil
 }
 
+func parseClone(node *yaml.Node) (*CloneSpec, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// `clone: true` enables the clone phase with default options.
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return nil, fmt.Errorf("clone 必须为布尔值或 mapping 结构")
+		}
+		if !enabled {
+			return nil, nil
+		}
+		return &CloneSpec{}, nil
+	case yaml.MappingNode:
+		var decoded struct {
+			LFS        bool  `yaml:"lfs"`
+			Depth      int   `yaml:"depth"`
+			Submodules bool  `yaml:"submodules"`
+			FetchTags  *bool `yaml:"fetch_tags"`
+		}
+		if err := node.Decode(&decoded); err != nil {
+			return nil, fmt.Errorf("解析 clone 配置失败: %w", err)
+		}
+		if decoded.Depth < 0 {
+			return nil, fmt.Errorf("clone.depth 不能为负数")
+		}
+		return &CloneSpec{
+			LFS:        decoded.LFS,
+			Depth:      decoded.Depth,
+			Submodules: decoded.Submodules,
+			FetchTags:  decoded.FetchTags,
+		}, nil
+	default:
+		return nil, fmt.Errorf("clone 必须为布尔值或 mapping 结构")
+	}
+}
+
+// parseCache accepts a list of paths, or a mapping with a `paths` list. Relative paths are
+// relative to the workspace.
+func parseCache(node *yaml.Node) ([]string, error) {
+	var raw any
+	if err := node.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("解析 cache 配置失败: %w", err)
+	}
+	if mapping, ok := raw.(map[string]any); ok {
+		raw = mapping["paths"]
+	}
+	entries, err := parseStringSlice(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cache 必须为路径列表")
+	}
+	paths := make([]string, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		cleaned := path.Clean(entry)
+		if !path.IsAbs(cleaned) {
+			if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+				return nil, fmt.Errorf("cache 路径 %s 超出工作目录", entry)
+			}
+			cleaned = path.Join(WorkspacePath, cleaned)
+		}
+		if cleaned == "/" || cleaned == WorkspacePath {
+			return nil, fmt.Errorf("cache 路径 %s 无效，请指定具体目录", entry)
+		}
+		if _, ok := seen[cleaned]; ok {
+			continue
+		}
+		seen[cleaned] = struct{}{}
+		paths = append(paths, cleaned)
+	}
+	return paths, nil
+}
+
 func parseSteps(node *yaml.Node) ([]StepSpec, error) {
 	switch node.Kind {
 	case yaml.MappingNode:
@@ -116,6 +366,7 @@ func parseMappingSteps(node *yaml.Node) ([]StepSpec, error) {
 
 		var decoded struct {
 			Image      string            `yaml:"image"`
+			Plugin     string            `yaml:"plugin"`
 			Commands   []string          `yaml:"commands"`
 			Secrets    []string          `yaml:"secrets"`
 			Env        map[string]string `yaml:"env"`
@@ -123,6 +374,18 @@ func parseMappingSteps(node *yaml.Node) ([]StepSpec, error) {
 			Volumes    []string          `yaml:"volumes"`
 			Privileged bool              `yaml:"privileged"`
 			When       map[string]any    `yaml:"when"`
+			DependsOn  any               `yaml:"depends_on"`
+			Timeout    any               `yaml:"timeout"`
+			Deploy     map[string]any    `yaml:"deploy"`
+			Artifacts  any               `yaml:"artifacts"`
+			Runtime    string            `yaml:"runtime"`
+			Services   yaml.Node         `yaml:"services"`
+			Pull       string            `yaml:"pull"`
+			Build      map[string]any    `yaml:"build"`
+			Resources  map[string]any    `yaml:"resources"`
+			// execution modifiers
+			IgnoreFailure bool `yaml:"ignore_failure"`
+			AlwaysRun     bool `yaml:"always_run"`
 			// allow singular/plural spellings
 			Certificate  yaml.Node `yaml:"certificate"`
 			Certificates yaml.Node `yaml:"certificates"`
@@ -144,19 +407,88 @@ func parseMappingSteps(node *yaml.Node) ([]StepSpec, error) {
 		if err != nil {
 			return nil, fmt.Errorf("解析步骤 %q 的 when 条件失败: %w", stepName, err)
 		}
+		dependsOn, err := parseStringSlice(decoded.DependsOn)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 depends_on 失败: %w", stepName, err)
+		}
+		timeout, err := parseTimeout(decoded.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 timeout 失败: %w", stepName, err)
+		}
+		deploy, err := parseDeployTarget(decoded.Deploy)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 deploy 失败: %w", stepName, err)
+		}
+		artifacts, err := parseArtifactPatterns(decoded.Artifacts)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 artifacts 失败: %w", stepName, err)
+		}
+		services, err := parseServices(&decoded.Services)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 services 失败: %w", stepName, err)
+		}
+		pull, err := parsePullPolicy(decoded.Pull)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 pull 失败: %w", stepName, err)
+		}
+		build, err := parseBuildSpec(decoded.Build)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 build 失败: %w", stepName, err)
+		}
+		resources, err := parseResources(decoded.Resources)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 resources 失败: %w", stepName, err)
+		}
 
 		image := strings.TrimSpace(decoded.Image)
+		plugin := strings.TrimSpace(decoded.Plugin)
 		kind := StepKindCommands
+		runtime := StepRuntimeDocker
 		if approvalSpec != nil {
 			kind = StepKindApproval
+		} else if build != nil {
+			kind = StepKindBuild
+			if image != "" || len(decoded.Commands) > 0 || decoded.Settings != nil || deploy != nil {
+				return nil, fmt.Errorf("步骤 %q 是内置构建步骤，不能同时定义 image、commands、settings 或 deploy", stepName)
+			}
+		} else if deploy.Builtin() {
+			kind = StepKindDeploy
+			if image != "" || len(decoded.Commands) > 0 || decoded.Settings != nil {
+				return nil, fmt.Errorf("步骤 %q 是内置部署步骤，不能同时定义 image、commands 或 settings", stepName)
+			}
 		} else {
-			if image == "" {
-				return nil, fmt.Errorf("步骤 %q 缺少镜像定义", stepName)
+			runtime, err = parseStepRuntime(stepName, decoded.Runtime, decoded.Settings, decoded.Volumes, decoded.Privileged)
+			if err != nil {
+				return nil, err
 			}
-			if len(decoded.Commands) == 0 && decoded.Settings == nil && len(decoded.Volumes) == 0 && !decoded.Privileged {
-				return nil, fmt.Errorf("步骤 %q 未提供 commands", stepName)
+			if plugin != "" {
+				if err := checkPluginStep(stepName, image, decoded.Commands, runtime); err != nil {
+					return nil, err
+				}
+			} else {
+				if image == "" && runtime != StepRuntimeHost {
+					return nil, fmt.Errorf("步骤 %q 缺少镜像定义", stepName)
+				}
+				if len(decoded.Commands) == 0 && decoded.Settings == nil && len(decoded.Volumes) == 0 && !decoded.Privileged {
+					return nil, fmt.Errorf("步骤 %q 未提供 commands", stepName)
+				}
 			}
 		}
+		if plugin != "" && kind != StepKindCommands {
+			return nil, fmt.Errorf("步骤 %q 引用了插件，不能同时是审批、构建或内置部署步骤", stepName)
+		}
+		if len(services) > 0 && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 services，仅 docker 运行时的命令步骤支持", stepName)
+		}
+		if pull != "" && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 pull，仅 docker 运行时的命令步骤支持", stepName)
+		}
+		if resources != nil && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 resources，仅 docker 运行时的命令步骤支持", stepName)
+		}
+		if decoded.AlwaysRun && kind == StepKindApproval {
+			return nil, fmt.Errorf("步骤 %q 是审批步骤，不支持 always_run", stepName)
+		}
 
 		stepSettings := decoded.Settings
 		if approvalSpec != nil {
@@ -175,6 +507,19 @@ func parseMappingSteps(node *yaml.Node) ([]StepSpec, error) {
 			Kind:       kind,
 			Approval:   approvalSpec,
 			Conditions: conditions,
+			DependsOn:  dependsOn,
+			Timeout:    timeout,
+			Deploy:     deploy,
+			Artifacts:  artifacts,
+			Runtime:    runtime,
+			Services:   services,
+			Pull:       pull,
+			Build:      build,
+			Resources:  resources,
+			Plugin:     plugin,
+
+			IgnoreFailure: decoded.IgnoreFailure,
+			AlwaysRun:     decoded.AlwaysRun,
 		})
 	}
 
@@ -191,6 +536,7 @@ func parseSequenceSteps(node *yaml.Node) ([]StepSpec, error) {
 		var decoded struct {
 			Name         string            `yaml:"name"`
 			Image        string            `yaml:"image"`
+			Plugin       string            `yaml:"plugin"`
 			Commands     []string          `yaml:"commands"`
 			Secrets      []string          `yaml:"secrets"`
 			Env          map[string]string `yaml:"env"`
@@ -198,8 +544,20 @@ func parseSequenceSteps(node *yaml.Node) ([]StepSpec, error) {
 			Volumes      []string          `yaml:"volumes"`
 			Privileged   bool              `yaml:"privileged"`
 			When         map[string]any    `yaml:"when"`
+			DependsOn    any               `yaml:"depends_on"`
+			Timeout      any               `yaml:"timeout"`
+			Deploy       map[string]any    `yaml:"deploy"`
+			Artifacts    any               `yaml:"artifacts"`
+			Runtime      string            `yaml:"runtime"`
+			Services     yaml.Node         `yaml:"services"`
+			Pull         string            `yaml:"pull"`
+			Build        map[string]any    `yaml:"build"`
+			Resources    map[string]any    `yaml:"resources"`
 			Certificate  yaml.Node         `yaml:"certificate"`
 			Certificates yaml.Node         `yaml:"certificates"`
+			// execution modifiers
+			IgnoreFailure bool `yaml:"ignore_failure"`
+			AlwaysRun     bool `yaml:"always_run"`
 		}
 		if err := item.Decode(&decoded); err != nil {
 			return nil, fmt.Errorf("解析 steps 条目失败: %w", err)
@@ -222,19 +580,88 @@ func parseSequenceSteps(node *yaml.Node) ([]StepSpec, error) {
 		if err != nil {
 			return nil, fmt.Errorf("解析步骤 %q 的 when 条件失败: %w", name, err)
 		}
+		dependsOn, err := parseStringSlice(decoded.DependsOn)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 depends_on 失败: %w", name, err)
+		}
+		timeout, err := parseTimeout(decoded.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 timeout 失败: %w", name, err)
+		}
+		deploy, err := parseDeployTarget(decoded.Deploy)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 deploy 失败: %w", name, err)
+		}
+		artifacts, err := parseArtifactPatterns(decoded.Artifacts)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 artifacts 失败: %w", name, err)
+		}
+		services, err := parseServices(&decoded.Services)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 services 失败: %w", name, err)
+		}
+		pull, err := parsePullPolicy(decoded.Pull)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 pull 失败: %w", name, err)
+		}
+		build, err := parseBuildSpec(decoded.Build)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 build 失败: %w", name, err)
+		}
+		resources, err := parseResources(decoded.Resources)
+		if err != nil {
+			return nil, fmt.Errorf("解析步骤 %q 的 resources 失败: %w", name, err)
+		}
 
 		image := strings.TrimSpace(decoded.Image)
+		plugin := strings.TrimSpace(decoded.Plugin)
 		kind := StepKindCommands
+		runtime := StepRuntimeDocker
 		if approvalSpec != nil {
 			kind = StepKindApproval
+		} else if build != nil {
+			kind = StepKindBuild
+			if image != "" || len(decoded.Commands) > 0 || decoded.Settings != nil || deploy != nil {
+				return nil, fmt.Errorf("步骤 %q 是内置构建步骤，不能同时定义 image、commands、settings 或 deploy", name)
+			}
+		} else if deploy.Builtin() {
+			kind = StepKindDeploy
+			if image != "" || len(decoded.Commands) > 0 || decoded.Settings != nil {
+				return nil, fmt.Errorf("步骤 %q 是内置部署步骤，不能同时定义 image、commands 或 settings", name)
+			}
 		} else {
-			if image == "" {
-				return nil, fmt.Errorf("步骤 %q 缺少镜像定义", name)
+			runtime, err = parseStepRuntime(name, decoded.Runtime, decoded.Settings, decoded.Volumes, decoded.Privileged)
+			if err != nil {
+				return nil, err
 			}
-			if len(decoded.Commands) == 0 && decoded.Settings == nil && len(decoded.Volumes) == 0 && !decoded.Privileged {
-				return nil, fmt.Errorf("步骤 %q 未提供 commands", name)
+			if plugin != "" {
+				if err := checkPluginStep(name, image, decoded.Commands, runtime); err != nil {
+					return nil, err
+				}
+			} else {
+				if image == "" && runtime != StepRuntimeHost {
+					return nil, fmt.Errorf("步骤 %q 缺少镜像定义", name)
+				}
+				if len(decoded.Commands) == 0 && decoded.Settings == nil && len(decoded.Volumes) == 0 && !decoded.Privileged {
+					return nil, fmt.Errorf("步骤 %q 未提供 commands", name)
+				}
 			}
 		}
+		if plugin != "" && kind != StepKindCommands {
+			return nil, fmt.Errorf("步骤 %q 引用了插件，不能同时是审批、构建或内置部署步骤", name)
+		}
+		if len(services) > 0 && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 services，仅 docker 运行时的命令步骤支持", name)
+		}
+		if pull != "" && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 pull，仅 docker 运行时的命令步骤支持", name)
+		}
+		if resources != nil && (kind != StepKindCommands || runtime == StepRuntimeHost) {
+			return nil, fmt.Errorf("步骤 %q 定义了 resources，仅 docker 运行时的命令步骤支持", name)
+		}
+		if decoded.AlwaysRun && kind == StepKindApproval {
+			return nil, fmt.Errorf("步骤 %q 是审批步骤，不支持 always_run", name)
+		}
 
 		stepSettings := decoded.Settings
 		if approvalSpec != nil {
@@ -253,12 +680,342 @@ func parseSequenceSteps(node *yaml.Node) ([]StepSpec, error) {
 			Kind:       kind,
 			Approval:   approvalSpec,
 			Conditions: conditions,
+			DependsOn:  dependsOn,
+			Timeout:    timeout,
+			Deploy:     deploy,
+			Artifacts:  artifacts,
+			Runtime:    runtime,
+			Services:   services,
+			Pull:       pull,
+			Build:      build,
+			Resources:  resources,
+			Plugin:     plugin,
+
+			IgnoreFailure: decoded.IgnoreFailure,
+			AlwaysRun:     decoded.AlwaysRun,
 		})
 	}
 
 	return steps, nil
 }
 
+// checkPluginStep rejects what a step referencing a plugin cannot define: the image comes
+// from the plugin definition and the plugin runs instead of commands, in a container.
+func checkPluginStep(name, image string, commands []string, runtime StepRuntime) error {
+	switch {
+	case image != "":
+		return fmt.Errorf("步骤 %q 引用了插件，不能同时定义 image", name)
+	case len(commands) > 0:
+		return fmt.Errorf("步骤 %q 引用了插件，不能同时定义 commands", name)
+	case runtime == StepRuntimeHost:
+		return fmt.Errorf("步骤 %q 引用了插件，不支持 host 运行时", name)
+	}
+	return nil
+}
+
+// parseStepRuntime defaults to docker. Host steps run on the agent, so container options
+// are rejected rather than silently ignored.
+func parseStepRuntime(name, raw string, settings map[string]any, volumes []string, privileged bool) (StepRuntime, error) {
+	runtime := StepRuntime(strings.ToLower(strings.TrimSpace(raw)))
+	switch runtime {
+	case "", StepRuntimeDocker:
+		return StepRuntimeDocker, nil
+	case StepRuntimeHost:
+	default:
+		return "", fmt.Errorf("步骤 %q 的 runtime %q 无效，仅支持 docker 或 host", name, raw)
+	}
+	switch {
+	case privileged:
+		return "", fmt.Errorf("步骤 %q 使用 host 运行时，不支持 privileged", name)
+	case len(sanitizeVolumes(volumes)) > 0:
+		return "", fmt.Errorf("步骤 %q 使用 host 运行时，不支持 volumes", name)
+	case settings != nil:
+		return "", fmt.Errorf("步骤 %q 使用 host 运行时，不支持插件 settings", name)
+	}
+	return StepRuntimeHost, nil
+}
+
+// parsePullPolicy accepts always, if-not-present and never, also spelled like the
+// kubernetes policies (IfNotPresent); empty keeps the default.
+func parsePullPolicy(raw string) (PullPolicy, error) {
+	normalized := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(raw)))
+	switch normalized {
+	case "":
+		return "", nil
+	case "always":
+		return PullAlways, nil
+	case "ifnotpresent", "missing":
+		return PullIfNotPresent, nil
+	case "never":
+		return PullNever, nil
+	default:
+		return "", fmt.Errorf("拉取策略 %q 无效，仅支持 always、if-not-present 或 never", raw)
+	}
+}
+
+// parseDeployTarget reads `deploy: {cluster, namespace, manifest | manifest_file, wait_ready}`;
+// the namespace defaults to "default".
+func parseDeployTarget(raw map[string]any) (*DeployTarget, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	target := &DeployTarget{
+		Cluster:   strings.TrimSpace(fmt.Sprint(raw["cluster"])),
+		Namespace: "default",
+	}
+	if raw["cluster"] == nil || target.Cluster == "" {
+		return nil, fmt.Errorf("cluster 不能为空")
+	}
+	if ns, ok := raw["namespace"]; ok && ns != nil {
+		if value := strings.TrimSpace(fmt.Sprint(ns)); value != "" {
+			target.Namespace = value
+		}
+	}
+	if manifest, ok := raw["manifest"].(string); ok {
+		target.Manifest = strings.TrimSpace(manifest)
+	} else if raw["manifest"] != nil {
+		return nil, fmt.Errorf("manifest 必须是字符串")
+	}
+	if file, ok := raw["manifest_file"].(string); ok {
+		file = strings.TrimPrefix(path.Clean(filepath.ToSlash(strings.TrimSpace(file))), "./")
+		if path.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+			return nil, fmt.Errorf("manifest_file %q 必须是工作目录内的相对路径", raw["manifest_file"])
+		}
+		target.ManifestFile = file
+	} else if raw["manifest_file"] != nil {
+		return nil, fmt.Errorf("manifest_file 必须是字符串")
+	}
+	if target.Manifest != "" && target.ManifestFile != "" {
+		return nil, fmt.Errorf("manifest 与 manifest_file 只能设置一个")
+	}
+	if raw["set_image"] != nil {
+		setImage, ok := raw["set_image"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("set_image 必须是对象")
+		}
+		if target.Manifest != "" || target.ManifestFile != "" {
+			return nil, fmt.Errorf("set_image 不能与 manifest 或 manifest_file 同时设置")
+		}
+		image, err := parseDeployImage(setImage)
+		if err != nil {
+			return nil, err
+		}
+		target.SetImage = image
+	}
+	if wait, ok := raw["wait_ready"]; ok && wait != nil {
+		value, ok := wait.(bool)
+		if !ok {
+			return nil, fmt.Errorf("wait_ready 必须是布尔值")
+		}
+		target.WaitReady = value
+	}
+	if target.WaitReady && !target.Builtin() {
+		return nil, fmt.Errorf("wait_ready 仅适用于设置了 manifest、manifest_file 或 set_image 的部署步骤")
+	}
+	return target, nil
+}
+
+func parseDeployImage(raw map[string]any) (*DeployImage, error) {
+	field := func(key string) (string, error) {
+		value, ok := raw[key]
+		if !ok || value == nil {
+			return "", nil
+		}
+		text, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("set_image.%s 必须是字符串", key)
+		}
+		return strings.TrimSpace(text), nil
+	}
+	image := &DeployImage{}
+	var err error
+	if image.Kind, err = field("kind"); err != nil {
+		return nil, err
+	}
+	if image.Kind == "" {
+		image.Kind = "deployment"
+	}
+	switch strings.ToLower(image.Kind) {
+	case "deployment", "statefulset", "daemonset":
+	default:
+		return nil, fmt.Errorf("set_image.kind 仅支持 deployment、statefulset 或 daemonset")
+	}
+	if image.Name, err = field("name"); err != nil {
+		return nil, err
+	}
+	if image.Container, err = field("container"); err != nil {
+		return nil, err
+	}
+	if image.Image, err = field("image"); err != nil {
+		return nil, err
+	}
+	if image.Name == "" || image.Container == "" || image.Image == "" {
+		return nil, fmt.Errorf("set_image 需要设置 name、container 与 image")
+	}
+	return image, nil
+}
+
+// parseBuildSpec reads `build: {dockerfile, context, tags, args, target, push}`. Only tags is
+// required; dockerfile and context must stay inside the workspace.
+func parseBuildSpec(raw map[string]any) (*BuildSpec, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	field := func(key string) (string, error) {
+		value, ok := raw[key]
+		if !ok || value == nil {
+			return "", nil
+		}
+		text, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("%s 必须是字符串", key)
+		}
+		return strings.TrimSpace(text), nil
+	}
+	workspacePath := func(key, fallback string) (string, error) {
+		value, err := field(key)
+		if err != nil {
+			return "", err
+		}
+		if value == "" {
+			return fallback, nil
+		}
+		cleaned := strings.TrimPrefix(path.Clean(filepath.ToSlash(value)), "./")
+		if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return "", fmt.Errorf("%s %q 必须是工作目录内的相对路径", key, value)
+		}
+		return cleaned, nil
+	}
+
+	build := &BuildSpec{}
+	var err error
+	if build.Dockerfile, err = workspacePath("dockerfile", "Dockerfile"); err != nil {
+		return nil, err
+	}
+	if build.Context, err = workspacePath("context", "."); err != nil {
+		return nil, err
+	}
+	if build.Target, err = field("target"); err != nil {
+		return nil, err
+	}
+	if build.Tags, err = parseStringSlice(raw["tags"]); err != nil {
+		return nil, fmt.Errorf("tags: %w", err)
+	}
+	if len(build.Tags) == 0 {
+		return nil, fmt.Errorf("tags 至少需要一个镜像标签")
+	}
+	if args := raw["args"]; args != nil {
+		values, ok := args.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("args 必须是键值对象")
+		}
+		build.Args = make(map[string]string, len(values))
+		for key, value := range values {
+			if key = strings.TrimSpace(key); key == "" {
+				continue
+			}
+			if value == nil {
+				build.Args[key] = ""
+				continue
+			}
+			build.Args[key] = fmt.Sprint(value)
+		}
+	}
+	if push, ok := raw["push"]; ok && push != nil {
+		value, ok := push.(bool)
+		if !ok {
+			return nil, fmt.Errorf("push 必须是布尔值")
+		}
+		build.Push = value
+	}
+	return build, nil
+}
+
+// parseArtifactPatterns reads `artifacts:` as one pattern or a list. Patterns are slash
+// separated, relative to the workspace, and may use `**` to match any number of directories.
+func parseArtifactPatterns(value any) ([]string, error) {
+	patterns, err := parseStringSlice(value)
+	if err != nil {
+		return nil, err
+	}
+	for i, pattern := range patterns {
+		pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "./")
+		if path.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return nil, fmt.Errorf("%q 必须是工作目录内的相对路径", patterns[i])
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q 不是有效的通配符: %w", patterns[i], err)
+		}
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// validateStepDependencies rejects unknown depends_on references and dependency cycles.
+func validateStepDependencies(steps []StepSpec) error {
+	hasDependencies := false
+	for _, step := range steps {
+		if len(step.DependsOn) > 0 {
+			hasDependencies = true
+			break
+		}
+	}
+	if !hasDependencies {
+		return nil
+	}
+
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if _, exists := index[step.Name]; exists {
+			return fmt.Errorf("使用 depends_on 时步骤名称必须唯一，%q 重复", step.Name)
+		}
+		index[step.Name] = i
+	}
+	for _, step := range steps {
+		for _, dep := range step.DependsOn {
+			if dep == step.Name {
+				return fmt.Errorf("步骤 %q 不能依赖自身", step.Name)
+			}
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("步骤 %q 依赖了不存在的步骤 %q", step.Name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(steps))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("步骤依赖存在循环: %s", strings.Join(append(path, steps[i].Name), " -> "))
+		case visited:
+			return nil
+		}
+		marks[i] = visiting
+		path = append(path, steps[i].Name)
+		for _, dep := range steps[i].DependsOn {
+			if err := visit(index[dep], path); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		return nil
+	}
+	for i := range steps {
+		if marks[i] == unvisited {
+			if err := visit(i, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func parseStepConditions(raw map[string]any) (*StepConditions, error) {
 	if len(raw) == 0 {
 		return nil, nil
@@ -267,22 +1024,62 @@ func parseStepConditions(raw map[string]any) (*StepConditions, error) {
 	for key, value := range raw {
 		switch strings.ToLower(strings.TrimSpace(key)) {
 		case "branch", "branches":
-			branches, err := normalizeConditionValues(value)
+			branches, err := normalizeConditionValues("when.branch", value)
 			if err != nil {
 				return nil, err
 			}
+			if err := validatePatterns("when.branch", branches); err != nil {
+				return nil, err
+			}
 			if len(branches) > 0 {
 				conditions.Branches = branches
 			}
+		case "tag", "tags":
+			tags, err := normalizeConditionValues("when.tag", value)
+			if err != nil {
+				return nil, err
+			}
+			if err := validatePatterns("when.tag", tags); err != nil {
+				return nil, err
+			}
+			if len(tags) > 0 {
+				conditions.Tags = tags
+			}
+		case "path", "paths":
+			paths, err := normalizeConditionValues("when.paths", value)
+			if err != nil {
+				return nil, err
+			}
+			for i, path := range paths {
+				// a directory stands for everything below it
+				if strings.HasSuffix(path, "/") && !isRegexValue(path) {
+					paths[i] = path + "**"
+				}
+			}
+			if err := validatePatterns("when.paths", paths); err != nil {
+				return nil, err
+			}
+			if len(paths) > 0 {
+				conditions.Paths = paths
+			}
 		}
 	}
-	if len(conditions.Branches) == 0 {
+	if len(conditions.Branches) == 0 && len(conditions.Tags) == 0 && len(conditions.Paths) == 0 {
 		return nil, nil
 	}
 	return &conditions, nil
 }
 
-func normalizeConditionValues(value any) ([]string, error) {
+func validatePatterns(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := CompilePattern(pattern); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+func normalizeConditionValues(field string, value any) ([]string, error) {
 	switch v := value.(type) {
 	case nil:
 		return nil, nil
@@ -307,7 +1104,7 @@ func normalizeConditionValues(value any) ([]string, error) {
 		for _, item := range v {
 			str, ok := item.(string)
 			if !ok {
-				return nil, fmt.Errorf("when.branch 数组仅支持字符串")
+				return nil, fmt.Errorf("%s 数组仅支持字符串", field)
 			}
 			if trimmed := strings.TrimSpace(str); trimmed != "" {
 				out = append(out, trimmed)
@@ -318,7 +1115,7 @@ func normalizeConditionValues(value any) ([]string, error) {
 		}
 		return out, nil
 	default:
-		return nil, fmt.Errorf("when.branch 必须为字符串或字符串数组")
+		return nil, fmt.Errorf("%s 必须为字符串或字符串数组", field)
 	}
 }
 
@@ -491,6 +1288,41 @@ func parseStringSlice(value any) ([]string, error) {
 	}
 }
 
+// parseTimeout accepts Go duration strings such as "10m" or "1h30m", or plain seconds.
+func parseTimeout(value any) (time.Duration, error) {
+	var timeout time.Duration
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		timeout = time.Duration(v) * time.Second
+	case int64:
+		timeout = time.Duration(v) * time.Second
+	case float64:
+		timeout = time.Duration(v * float64(time.Second))
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if trimmed == "" {
+			return 0, nil
+		}
+		if seconds, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			timeout = time.Duration(seconds) * time.Second
+			break
+		}
+		parsed, err := time.ParseDuration(trimmed)
+		if err != nil {
+			return 0, fmt.Errorf("无效的时长 %q", trimmed)
+		}
+		timeout = parsed
+	default:
+		return 0, fmt.Errorf("unsupported type %T", value)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("时长不能为负数")
+	}
+	return timeout, nil
+}
+
 func parseDurationSeconds(value any) (int64, error) {
 	switch v := value.(type) {
 	case nil:
@@ -0,0 +1,186 @@
+package spec
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	parsed, err := Parse(`name: app
+timeout: 1h
+steps:
+  build:
+    image: golang:1.22
+    timeout: 10m
+    commands:
+      - go build ./...
+  test:
+    image: golang:1.22
+    timeout: 90
+    commands:
+      - go test ./...
+  lint:
+    image: golang:1.22
+    commands:
+      - go vet ./...
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if parsed.Timeout != time.Hour {
+		t.Errorf("pipeline timeout = %s, want 1h", parsed.Timeout)
+	}
+	want := map[string]time.Duration{"build": 10 * time.Minute, "test": 90 * time.Second, "lint": 0}
+	for _, step := range parsed.Steps {
+		if step.Timeout != want[step.Name] {
+			t.Errorf("step %s timeout = %s, want %s", step.Name, step.Timeout, want[step.Name])
+		}
+	}
+}
+
+func TestParseRejectsInvalidTimeouts(t *testing.T) {
+	for _, timeout := range []string{"soon", "-5m"} {
+		_, err := Parse(`name: app
+steps:
+  build:
+    image: alpine
+    timeout: ` + timeout + `
+    commands:
+      - true
+`)
+		if err == nil {
+			t.Errorf("timeout %q was accepted", timeout)
+		}
+	}
+}
+
+func TestParseArtifacts(t *testing.T) {
+	parsed, err := Parse(`name: app
+steps:
+  build:
+    image: golang:1.22
+    artifacts:
+      - ./dist/
+      - reports/**/*.xml
+    commands:
+      - go build ./...
+  package:
+    image: alpine
+    artifacts: app.tar.gz
+    commands:
+      - tar czf app.tar.gz dist
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := map[string]string{"build": "dist,reports/**/*.xml", "package": "app.tar.gz"}
+	for _, step := range parsed.Steps {
+		if got := strings.Join(step.Artifacts, ","); got != want[step.Name] {
+			t.Errorf("step %s artifacts = %s, want %s", step.Name, got, want[step.Name])
+		}
+	}
+}
+
+func TestParseRejectsArtifactsOutsideWorkspace(t *testing.T) {
+	for _, pattern := range []string{"/etc/passwd", "../secrets", "dist/../../up", "[unclosed"} {
+		_, err := Parse(`name: app
+steps:
+  build:
+    image: alpine
+    artifacts:
+      - "` + pattern + `"
+    commands:
+      - true
+`)
+		if err == nil {
+			t.Errorf("artifact pattern %q was accepted", pattern)
+		}
+	}
+}
+
+func TestParseCloneOptions(t *testing.T) {
+	parsed, err := Parse(`name: app
+clone:
+  depth: 1
+  submodules: true
+  fetch_tags: false
+steps:
+  build:
+    image: alpine
+    commands:
+      - true
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	clone := parsed.Clone
+	if clone == nil || clone.Depth != 1 || !clone.Submodules || clone.LFS || clone.FetchTags == nil || *clone.FetchTags {
+		t.Fatalf("clone = %+v, want depth 1 with submodules and without tags", clone)
+	}
+
+	parsed, err = Parse(`name: app
+clone: true
+steps:
+  build:
+    image: alpine
+    commands:
+      - true
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if parsed.Clone == nil || parsed.Clone.FetchTags != nil || parsed.Clone.Depth != 0 {
+		t.Errorf("clone: true = %+v, want a full clone with the git tag default", parsed.Clone)
+	}
+
+	_, err = Parse(`name: app
+clone:
+  depth: -1
+steps:
+  build:
+    image: alpine
+    commands:
+      - true
+`)
+	if err == nil {
+		t.Errorf("negative clone depth was accepted")
+	}
+}
+
+func TestParseBranchPatterns(t *testing.T) {
+	parsed, err := Parse(`name: app
+steps:
+  deploy:
+    image: alpine
+    when:
+      branch: [ "release/*", "~^hotfix-\\d+$" ]
+      tag: v*
+    commands:
+      - true
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	conditions := parsed.Steps[0].Conditions
+	if conditions == nil || strings.Join(conditions.Branches, ",") != `release/*,~^hotfix-\d+$` || strings.Join(conditions.Tags, ",") != "v*" {
+		t.Fatalf("conditions = %+v, want the patterns as written", conditions)
+	}
+}
+
+func TestParseRejectsInvalidBranchPatterns(t *testing.T) {
+	for _, when := range []string{`branch: "~^hotfix-(\\d+$"`, `branch: "regex:[z-a]"`, `tag: "v[1"`} {
+		_, err := Parse(`name: app
+steps:
+  deploy:
+    image: alpine
+    when:
+      ` + when + `
+    commands:
+      - true
+`)
+		if err == nil {
+			t.Errorf("condition %s was accepted", when)
+		}
+	}
+}
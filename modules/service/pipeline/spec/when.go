@@ -0,0 +1,93 @@
+package spec
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// PipelineConditions decide whether a trigger creates a run at all. Triggers that do not
+// match are recorded as skipped pipelines without steps.
+type PipelineConditions struct {
+	// Branches are patterns of the branches runs are created for; see Pattern. Tag
+	// pipelines are not filtered by branch.
+	Branches []string
+	// Events lists the events runs are created for; empty allows every event.
+	Events []model.WebhookEvent
+	// SkipIfNoChanges skips branch runs whose head is the commit of the last pipeline of
+	// the branch.
+	SkipIfNoChanges bool
+}
+
+// AllowsEvent reports whether runs are created for event.
+func (c *PipelineConditions) AllowsEvent(event model.WebhookEvent) bool {
+	if c == nil || len(c.Events) == 0 {
+		return true
+	}
+	for _, allowed := range c.Events {
+		if allowed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsBranch reports whether runs are created for branch.
+func (c *PipelineConditions) AllowsBranch(branch string) bool {
+	if c == nil || len(c.Branches) == 0 {
+		return true
+	}
+	return MatchAny(c.Branches, branch)
+}
+
+// parsePipelineConditions reads the top-level `when: {branches, events, skip_if_no_changes}`.
+func parsePipelineConditions(node *yaml.Node) (*PipelineConditions, error) {
+	var raw map[string]any
+	if err := node.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("解析 when 失败: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var conditions PipelineConditions
+	for key, value := range raw {
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "branch", "branches":
+			branches, err := normalizeConditionValues("when.branch", value)
+			if err != nil {
+				return nil, err
+			}
+			if err := validatePatterns("when.branch", branches); err != nil {
+				return nil, err
+			}
+			conditions.Branches = branches
+		case "event", "events":
+			events, err := normalizeConditionValues("when.event", value)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range events {
+				event := model.WebhookEvent(strings.ToLower(item))
+				if err := event.Validate(); err != nil {
+					return nil, fmt.Errorf("when.event: 不支持的事件 %q", item)
+				}
+				conditions.Events = append(conditions.Events, event)
+			}
+		case "skip_if_no_changes":
+			enabled, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("when.skip_if_no_changes 必须是布尔值")
+			}
+			conditions.SkipIfNoChanges = enabled
+		default:
+			return nil, fmt.Errorf("不支持的 when 条件 %q，仅支持 branches、events 与 skip_if_no_changes", key)
+		}
+	}
+	if len(conditions.Branches) == 0 && len(conditions.Events) == 0 && !conditions.SkipIfNoChanges {
+		return nil, nil
+	}
+	return &conditions, nil
+}
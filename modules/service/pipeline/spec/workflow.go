@@ -0,0 +1,159 @@
+package spec
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultWorkflowName names the implicit workflow of a spec that lists its steps at the top
+// level and has no name.
+const DefaultWorkflowName = "default"
+
+// WorkflowSpec is a named group of steps. A workflow starts once all the workflows it
+// depends on succeeded; its steps may only depend on steps of the same workflow.
+type WorkflowSpec struct {
+	Name      string
+	DependsOn []string
+	Steps     []StepSpec
+}
+
+// parseWorkflows reads `workflows:` as a sequence of mappings with a name, steps and an
+// optional depends_on.
+func parseWorkflows(node *yaml.Node) ([]WorkflowSpec, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("workflows 必须为 sequence 结构")
+	}
+	workflows := make([]WorkflowSpec, 0, len(node.Content))
+	for idx, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("workflows[%d] 必须为 mapping 结构", idx)
+		}
+		var workflow WorkflowSpec
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			key := strings.ToLower(strings.TrimSpace(item.Content[i].Value))
+			value := item.Content[i+1]
+			switch key {
+			case "name":
+				workflow.Name = strings.TrimSpace(value.Value)
+			case "depends_on":
+				var raw any
+				if err := value.Decode(&raw); err != nil {
+					return nil, fmt.Errorf("解析 workflows[%d] 的 depends_on 失败: %w", idx, err)
+				}
+				dependsOn, err := parseStringSlice(raw)
+				if err != nil {
+					return nil, fmt.Errorf("解析 workflows[%d] 的 depends_on 失败: %w", idx, err)
+				}
+				workflow.DependsOn = dependsOn
+			case "steps":
+				steps, err := parseSteps(value)
+				if err != nil {
+					return nil, fmt.Errorf("workflows[%d]: %w", idx, err)
+				}
+				workflow.Steps = steps
+			default:
+				return nil, fmt.Errorf("workflows[%d] 包含未知字段 %s", idx, item.Content[i].Value)
+			}
+		}
+		if workflow.Name == "" {
+			return nil, fmt.Errorf("workflows[%d] 缺少 name", idx)
+		}
+		if len(workflow.Steps) == 0 {
+			return nil, fmt.Errorf("workflow %q 未定义任何步骤", workflow.Name)
+		}
+		workflows = append(workflows, workflow)
+	}
+	if len(workflows) == 0 {
+		return nil, fmt.Errorf("workflows 不能为空")
+	}
+	return workflows, nil
+}
+
+// validateWorkflows checks the steps of every workflow and the dependencies between
+// workflows. Step names must be unique across workflows so that step outputs stay
+// addressable by name.
+func validateWorkflows(workflows []WorkflowSpec) error {
+	index := make(map[string]int, len(workflows))
+	stepWorkflow := make(map[string]string)
+	for i, workflow := range workflows {
+		if _, exists := index[workflow.Name]; exists {
+			return fmt.Errorf("workflow 名称必须唯一，%q 重复", workflow.Name)
+		}
+		index[workflow.Name] = i
+		if err := validateStepDependencies(workflow.Steps); err != nil {
+			return fmt.Errorf("workflow %q: %w", workflow.Name, err)
+		}
+		if len(workflows) == 1 {
+			continue
+		}
+		for _, step := range workflow.Steps {
+			if owner, exists := stepWorkflow[step.Name]; exists {
+				return fmt.Errorf("步骤名称在所有 workflow 中必须唯一，%q 同时出现在 %q 和 %q", step.Name, owner, workflow.Name)
+			}
+			stepWorkflow[step.Name] = workflow.Name
+		}
+	}
+	for _, workflow := range workflows {
+		for _, dep := range workflow.DependsOn {
+			if dep == workflow.Name {
+				return fmt.Errorf("workflow %q 不能依赖自身", workflow.Name)
+			}
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("workflow %q 依赖了不存在的 workflow %q", workflow.Name, dep)
+			}
+		}
+	}
+	if _, err := WorkflowOrder(workflows); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WorkflowOrder returns the indexes of workflows in an order where every workflow follows
+// the ones it depends on, keeping the declared order otherwise. Unknown dependencies are
+// ignored; a cycle is an error.
+func WorkflowOrder(workflows []WorkflowSpec) ([]int, error) {
+	index := make(map[string]int, len(workflows))
+	for i, workflow := range workflows {
+		index[workflow.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(workflows))
+	order := make([]int, 0, len(workflows))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("workflow 依赖存在循环: %s", strings.Join(append(path, workflows[i].Name), " -> "))
+		case visited:
+			return nil
+		}
+		marks[i] = visiting
+		path = append(path, workflows[i].Name)
+		for _, dep := range workflows[i].DependsOn {
+			depIdx, ok := index[dep]
+			if !ok {
+				continue
+			}
+			if err := visit(depIdx, path); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		order = append(order, i)
+		return nil
+	}
+	for i := range workflows {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,207 @@
+// Package starter detects a repository's stack from its top-level files and renders a
+// matching starter pipeline configuration.
+package starter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Stack string
+
+const (
+	StackGo      Stack = "go"
+	StackNode    Stack = "node"
+	StackMaven   Stack = "maven"
+	StackDocker  Stack = "docker"
+	StackGeneric Stack = "generic"
+)
+
+// ManifestFiles maps each stack to the manifest whose content is needed for rendering.
+var ManifestFiles = map[Stack]string{
+	StackGo:   "go.mod",
+	StackNode: "package.json",
+}
+
+// Values carries repository specific values substituted into a template.
+type Values struct {
+	Name       string
+	Branch     string
+	Module     string
+	Image      string
+	Dockerfile bool
+}
+
+var goModulePattern = regexp.MustCompile(`(?m)^\s*module\s+"?([^"\s]+)"?`)
+
+// Detect returns the stack for a list of top-level file names. Directories may carry a trailing slash.
+func Detect(files []string) Stack {
+	present := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		present[strings.ToLower(strings.TrimSpace(file))] = struct{}{}
+	}
+	has := func(name string) bool {
+		_, ok := present[name]
+		return ok
+	}
+	switch {
+	case has("go.mod"):
+		return StackGo
+	case has("package.json"):
+		return StackNode
+	case has("pom.xml"):
+		return StackMaven
+	case has("dockerfile"):
+		return StackDocker
+	default:
+		return StackGeneric
+	}
+}
+
+// HasDockerfile reports whether a Dockerfile is present among the top-level files.
+func HasDockerfile(files []string) bool {
+	for _, file := range files {
+		if strings.EqualFold(strings.TrimSpace(file), "Dockerfile") {
+			return true
+		}
+	}
+	return false
+}
+
+// ModuleName extracts the module or package name from the stack manifest content.
+func ModuleName(stack Stack, manifest []byte) string {
+	switch stack {
+	case StackGo:
+		if match := goModulePattern.FindSubmatch(manifest); len(match) == 2 {
+			return string(match[1])
+		}
+	case StackNode:
+		var pkg struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(manifest, &pkg); err == nil {
+			return strings.TrimSpace(pkg.Name)
+		}
+	}
+	return ""
+}
+
+// Render renders the starter template for the stack. Unknown stacks use the generic template.
+func Render(stack Stack, values Values) (string, error) {
+	source, ok := templates[stack]
+	if !ok {
+		source = templates[StackGeneric]
+	}
+	if strings.TrimSpace(values.Branch) == "" {
+		values.Branch = "main"
+	}
+	if strings.TrimSpace(values.Name) == "" {
+		values.Name = "pipeline"
+	}
+	if strings.TrimSpace(values.Image) == "" {
+		values.Image = strings.ToLower(values.Name)
+	}
+	tpl, err := template.New(string(stack)).Funcs(template.FuncMap{"yaml": yamlScalar}).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("解析模板失败: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, values); err != nil {
+		return "", fmt.Errorf("渲染模板失败: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// yamlScalar renders a value as a YAML scalar, quoting it when it would not read back as the
+// same string, e.g. a scoped npm package name starting with "@".
+func yamlScalar(value string) (string, error) {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+const dockerStep = `{{ if .Dockerfile }}
+  docker-build:
+    image: docker:cli
+    volumes:
+      - /var/run/docker.sock:/var/run/docker.sock
+    commands:
+      - docker build -t {{ .Image }}:${CI_COMMIT_SHA} .
+    when:
+      branch: {{ yaml .Branch }}
+{{ end }}`
+
+var templates = map[Stack]string{
+	StackGo: `name: {{ yaml .Name }}
+# 内置克隆阶段会在第一个步骤前将仓库检出到工作区
+clone: true
+steps:
+  test:
+    image: golang:1.22
+    commands:
+      - go vet ./...
+      - go test ./...
+  build:
+    image: golang:1.22
+    commands:
+      # 输出所有 main 包{{ if .Module }}（模块 {{ .Module }}）{{ end }}的二进制到 bin/
+      - go build -o bin/ ./...
+` + dockerStep,
+
+	StackNode: `name: {{ if .Module }}{{ yaml .Module }}{{ else }}{{ yaml .Name }}{{ end }}
+# 内置克隆阶段会在第一个步骤前将仓库检出到工作区
+clone: true
+steps:
+  install:
+    image: node:20
+    commands:
+      - npm ci
+  test:
+    image: node:20
+    commands:
+      - npm test --if-present
+  build:
+    image: node:20
+    commands:
+      - npm run build --if-present
+` + dockerStep,
+
+	StackMaven: `name: {{ yaml .Name }}
+# 内置克隆阶段会在第一个步骤前将仓库检出到工作区
+clone: true
+steps:
+  package:
+    image: maven:3.9-eclipse-temurin-17
+    commands:
+      - mvn -B package
+` + dockerStep,
+
+	StackDocker: `name: {{ yaml .Name }}
+# 内置克隆阶段会在第一个步骤前将仓库检出到工作区
+clone: true
+steps:` + dockerStep,
+
+	StackGeneric: `name: {{ yaml .Name }}
+# 未识别出项目类型，以下为通用 shell 模板，请按需修改
+# clone: true 会在第一个步骤前将仓库检出到工作区
+clone: true
+steps:
+  build:
+    # 执行步骤所用的镜像
+    image: alpine:3.19
+    commands:
+      # 每条命令在工作区目录中依次执行，任意命令失败即终止流水线
+      - echo "building {{ .Name }} on {{ .Branch }}"
+    # 仅在指定分支执行，删除 when 则所有分支都会执行
+    when:
+      branch: {{ yaml .Branch }}
+`,
+}
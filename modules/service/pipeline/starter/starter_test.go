@@ -0,0 +1,194 @@
+package starter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// listTree returns the top-level entries of a fixture tree the way the forge listing does,
+// with directories carrying a trailing slash.
+func listTree(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read %s: %v", dir, err)
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		files = append(files, name)
+	}
+	return files
+}
+
+func TestStarterFromFixtureTree(t *testing.T) {
+	cases := []struct {
+		name       string
+		dir        string
+		stack      Stack
+		module     string
+		pipeline   string
+		steps      []string
+		dockerfile bool
+	}{
+		{
+			name:       "go with dockerfile",
+			dir:        filepath.Join("testdata", "go"),
+			stack:      StackGo,
+			module:     "github.com/acme/billing",
+			pipeline:   "billing",
+			steps:      []string{"test", "build", "docker-build"},
+			dockerfile: true,
+		},
+		{
+			name:     "node",
+			dir:      filepath.Join("testdata", "node"),
+			stack:    StackNode,
+			module:   "@acme/storefront",
+			pipeline: "@acme/storefront",
+			steps:    []string{"install", "test", "build"},
+		},
+		{
+			name:     "maven",
+			dir:      filepath.Join("testdata", "maven"),
+			stack:    StackMaven,
+			pipeline: "ledger",
+			steps:    []string{"package"},
+		},
+		{
+			name:       "dockerfile only, upper case",
+			dir:        filepath.Join("testdata", "docker"),
+			stack:      StackDocker,
+			pipeline:   "site",
+			steps:      []string{"docker-build"},
+			dockerfile: true,
+		},
+		{
+			name:     "go wins over package.json",
+			dir:      filepath.Join("testdata", "polyglot"),
+			stack:    StackGo,
+			module:   "example.com/polyglot",
+			pipeline: "polyglot",
+			steps:    []string{"test", "build"},
+		},
+		{
+			name:     "unrecognised files",
+			dir:      filepath.Join("testdata", "generic"),
+			stack:    StackGeneric,
+			pipeline: "scripts",
+			steps:    []string{"build"},
+		},
+		{
+			name:     "empty repository",
+			stack:    StackGeneric,
+			pipeline: "empty",
+			steps:    []string{"build"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tc.dir
+			if dir == "" {
+				dir = t.TempDir()
+			}
+			files := listTree(t, dir)
+
+			stack := Detect(files)
+			if stack != tc.stack {
+				t.Fatalf("Detect(%v) = %q, want %q", files, stack, tc.stack)
+			}
+			var module string
+			if manifest, ok := ManifestFiles[stack]; ok {
+				content, err := os.ReadFile(filepath.Join(dir, manifest))
+				if err != nil {
+					t.Fatalf("read manifest: %v", err)
+				}
+				module = ModuleName(stack, content)
+			}
+			if module != tc.module {
+				t.Fatalf("module = %q, want %q", module, tc.module)
+			}
+			if HasDockerfile(files) != tc.dockerfile {
+				t.Fatalf("HasDockerfile(%v) = %v, want %v", files, !tc.dockerfile, tc.dockerfile)
+			}
+
+			content, err := Render(stack, Values{
+				Name:       tc.pipeline,
+				Branch:     "release",
+				Module:     module,
+				Dockerfile: HasDockerfile(files),
+			})
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			parsed, err := spec.Parse(content)
+			if err != nil {
+				t.Fatalf("Parse rendered config: %v\n%s", err, content)
+			}
+			if parsed.Name != tc.pipeline {
+				t.Fatalf("pipeline name = %q, want %q", parsed.Name, tc.pipeline)
+			}
+			if parsed.Clone == nil {
+				t.Fatalf("rendered config does not clone the repository:\n%s", content)
+			}
+			var steps []string
+			for _, step := range parsed.Steps {
+				steps = append(steps, step.Name)
+				if step.Name == "docker-build" || stack == StackGeneric {
+					if step.Conditions == nil || !reflect.DeepEqual(step.Conditions.Branches, []string{"release"}) {
+						t.Fatalf("step %s conditions = %+v, want the release branch", step.Name, step.Conditions)
+					}
+				}
+			}
+			if !reflect.DeepEqual(steps, tc.steps) {
+				t.Fatalf("steps = %v, want %v\n%s", steps, tc.steps, content)
+			}
+		})
+	}
+}
+
+func TestRenderUnknownStackUsesGenericTemplate(t *testing.T) {
+	values := Values{Name: "tools", Branch: "develop"}
+	generic, err := Render(StackGeneric, values)
+	if err != nil {
+		t.Fatalf("Render generic: %v", err)
+	}
+	unknown, err := Render(Stack("rust"), values)
+	if err != nil {
+		t.Fatalf("Render unknown: %v", err)
+	}
+	if unknown != generic {
+		t.Fatalf("unknown stack rendered\n%s\nwant the generic template\n%s", unknown, generic)
+	}
+	if !strings.Contains(generic, "# ") || !strings.Contains(generic, `echo "building tools on develop"`) {
+		t.Fatalf("generic template lacks its comments or values:\n%s", generic)
+	}
+}
+
+func TestRenderDefaults(t *testing.T) {
+	content, err := Render(StackDocker, Values{Name: "Web", Dockerfile: true})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	for _, want := range []string{"name: Web\n", "docker build -t web:${CI_COMMIT_SHA} .", "branch: main\n"} {
+		if !strings.Contains(content, want) {
+			t.Fatalf("rendered config lacks %q:\n%s", want, content)
+		}
+	}
+
+	content, err = Render(StackGeneric, Values{})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if parsed, err := spec.Parse(content); err != nil || parsed.Name != "pipeline" {
+		t.Fatalf("Parse = %+v, %v, want the default name", parsed, err)
+	}
+}
@@ -0,0 +1 @@
+public class App {}
@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	// errTimedOut marks the failure of a step that ran past its own or the pipeline deadline.
+	errTimedOut = errors.New("timed out")
+	// errApprovalExpired fails an approval step nobody decided on before its timeout.
+	errApprovalExpired = errors.New(approvalExpiredMessage)
+)
+
+// classifyStepFailure tells why a step finished with status. Rejected approvals are recorded
+// where the approver decides; steps that did not fail have no reason.
+func classifyStepFailure(status model.StatusValue, cause error, exitCode int) model.StepFailureReason {
+	switch {
+	case status == model.StatusKilled || errors.Is(cause, context.Canceled):
+		return model.StepFailureCanceled
+	case status != model.StatusFailure && status != model.StatusError:
+		return ""
+	case errors.Is(cause, errTimedOut), errors.Is(cause, errApprovalExpired), errors.Is(cause, context.DeadlineExceeded):
+		return model.StepFailureTimeout
+	case exitCode > 0:
+		return model.StepFailureCommand
+	case cause != nil:
+		return model.StepFailureInfrastructure
+	default:
+		return ""
+	}
+}
+
+// firstHardFailedStep returns the step whose failure failed the pipeline first, leaving out
+// steps with ignore_failure set and those killed by a cancel.
+func firstHardFailedStep(steps []model.Step) *model.Step {
+	var first *model.Step
+	for i := range steps {
+		step := &steps[i]
+		if step.State != model.StatusFailure && step.State != model.StatusError {
+			continue
+		}
+		if step.Failure == model.FailureIgnore {
+			continue
+		}
+		if first == nil || step.Finished < first.Finished || (step.Finished == first.Finished && step.PID < first.PID) {
+			first = step
+		}
+	}
+	return first
+}
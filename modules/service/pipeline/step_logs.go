@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrStepNotFound is returned when a step does not belong to the pipeline run of the repository.
+var ErrStepNotFound = errors.New("步骤不存在")
+
+const (
+	defaultStepLogPageSize = 500
+	maxStepLogPageSize     = 5000
+	// stepLogStreamBatch is how many lines StreamStepLog reads at a time.
+	stepLogStreamBatch = 1000
+)
+
+// StepLogPage is a window of the log lines of a step.
+type StepLogPage struct {
+	Entries []model.LogEntry
+	Offset  int
+	Total   int64
+}
+
+// ListStepLog returns up to limit log lines of a step starting at the offset-th line.
+func (s *Service) ListStepLog(ctx context.Context, repoID, pipelineID, stepID int64, offset, limit int) (*StepLogPage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = defaultStepLogPageSize
+	} else if limit > maxStepLogPageSize {
+		limit = maxStepLogPageSize
+	}
+
+	if err := s.store.FindRunStep(ctx, repoID, pipelineID, stepID); err != nil {
+		return nil, err
+	}
+	entries, total, err := s.store.ListStepLog(ctx, stepID, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []model.LogEntry{}
+	}
+	return &StepLogPage{Entries: entries, Offset: offset, Total: total}, nil
+}
+
+// StreamStepLog writes the whole log of a step but its command markers to w, reading it in
+// batches so large logs are never held in memory.
+func (s *Service) StreamStepLog(ctx context.Context, repoID, pipelineID, stepID int64, w io.Writer) error {
+	if err := s.store.FindRunStep(ctx, repoID, pipelineID, stepID); err != nil {
+		return err
+	}
+
+	afterLine, afterID := -1, int64(0)
+	for {
+		entries, err := s.store.ListStepLogAfter(ctx, stepID, afterLine, afterID, stepLogStreamBatch)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if _, ok := model.ParseLogCommandMarker(&entry); ok {
+				// command markers only structure the log view
+				continue
+			}
+			if _, err := w.Write(entry.Data); err != nil {
+				return err
+			}
+		}
+		if len(entries) < stepLogStreamBatch {
+			return nil
+		}
+		last := entries[len(entries)-1]
+		afterLine, afterID = last.Line, last.ID
+	}
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const (
+	// stepStatisticWindow is the number of recent successful durations a baseline covers.
+	stepStatisticWindow = 50
+	// stepBaselineMinSamples is the number of samples a baseline needs before it is reported.
+	stepBaselineMinSamples = 3
+)
+
+// StepDurationBaseline is the usual duration of a step, in seconds.
+type StepDurationBaseline struct {
+	StepName string `json:"step_name"`
+	Count    int64  `json:"count"`
+	P50      int64  `json:"p50"`
+	P90      int64  `json:"p90"`
+	Updated  int64  `json:"updated"`
+}
+
+// DurationRatio compares duration with the median, e.g. 4 for a step that took four times
+// as long as usual. It is 0 when the median is 0.
+func (b *StepDurationBaseline) DurationRatio(duration int64) float64 {
+	if b == nil || b.P50 <= 0 {
+		return 0
+	}
+	return float64(duration) / float64(b.P50)
+}
+
+// recordStepDuration adds the duration of a successful step to the baseline of its name.
+// Baselines are keyed by name, so a renamed step starts a fresh one. Approval steps wait on
+// people rather than work and are left out.
+func (s *Service) recordStepDuration(ctx context.Context, repoID int64, step *model.Step) {
+	if step.State != model.StatusSuccess || step.Type == model.StepTypeApproval {
+		return
+	}
+	if step.Started <= 0 || step.Finished < step.Started {
+		return
+	}
+	duration := step.Finished - step.Started
+	err := s.store.UpdateStepStatistic(ctx, repoID, step.Name, func(stat *model.StepStatistic) {
+		addStepDurationSample(stat, duration, stepStatisticWindow)
+		stat.Updated = time.Now().Unix()
+	})
+	if err != nil {
+		log.Warn().Err(err).Int64("step_id", step.ID).Str("step", step.Name).Msg("failed to update step duration baseline")
+	}
+}
+
+// addStepDurationSample appends duration to the rolling window of stat, dropping the oldest
+// samples beyond window, and refreshes the percentiles.
+func addStepDurationSample(stat *model.StepStatistic, duration int64, window int) {
+	stat.Samples = append(stat.Samples, duration)
+	if len(stat.Samples) > window {
+		stat.Samples = append([]int64(nil), stat.Samples[len(stat.Samples)-window:]...)
+	}
+	stat.Count++
+
+	sorted := append([]int64(nil), stat.Samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stat.P50 = percentile(sorted, 50)
+	stat.P90 = percentile(sorted, 90)
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// StepDurationBaselines returns the baselines of repoID with enough samples, keyed by step
+// name.
+func (s *Service) StepDurationBaselines(ctx context.Context, repoID int64) (map[string]*StepDurationBaseline, error) {
+	stats, err := s.store.ListStepStatistics(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	baselines := make(map[string]*StepDurationBaseline, len(stats))
+	for _, stat := range stats {
+		if len(stat.Samples) < stepBaselineMinSamples {
+			continue
+		}
+		baselines[stat.StepName] = &StepDurationBaseline{
+			StepName: stat.StepName,
+			Count:    stat.Count,
+			P50:      stat.P50,
+			P90:      stat.P90,
+			Updated:  stat.Updated,
+		}
+	}
+	return baselines, nil
+}
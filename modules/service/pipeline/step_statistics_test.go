@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// percentileTolerance is how far a baseline may be from the exact percentile of the window,
+// in seconds. Nearest-rank percentiles of the distributions below land on a sample, so one
+// sample spacing is allowed.
+const percentileTolerance = 2
+
+func absDiff(a, b int64) int64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestStepDurationPercentilesOfKnownDistribution(t *testing.T) {
+	const window = 50
+	// every run of window consecutive samples holds 2, 4, ..., 100 once, so once the window
+	// is full it always has a median of 50 and a p90 of 90, whatever is evicted
+	values := make([]int64, window)
+	for i := range values {
+		values[i] = int64(2 * (i + 1))
+	}
+	rng := rand.New(rand.NewSource(2265))
+	rng.Shuffle(len(values), func(i, j int) { values[i], values[j] = values[j], values[i] })
+
+	var stat model.StepStatistic
+	for i := 0; i < 4*window; i++ {
+		addStepDurationSample(&stat, values[i%window], window)
+		if i+1 < window {
+			continue
+		}
+		if len(stat.Samples) != window {
+			t.Fatalf("sample %d: window holds %d samples, want %d", i+1, len(stat.Samples), window)
+		}
+		if absDiff(stat.P50, 50) > percentileTolerance || absDiff(stat.P90, 90) > percentileTolerance {
+			t.Fatalf("sample %d: p50 %d p90 %d, want 50 and 90 within %ds", i+1, stat.P50, stat.P90, percentileTolerance)
+		}
+	}
+	if stat.Count != 4*window {
+		t.Fatalf("count = %d, want every sample counted", stat.Count)
+	}
+}
+
+func TestStepDurationPercentilesTrackWindow(t *testing.T) {
+	const window = 50
+	rng := rand.New(rand.NewSource(42))
+	var stat model.StepStatistic
+	var all []int64
+	for i := 0; i < 500; i++ {
+		// long-tailed durations around a minute
+		duration := int64(rng.ExpFloat64()*60) + 1
+		all = append(all, duration)
+		addStepDurationSample(&stat, duration, window)
+
+		recent := all[max(0, len(all)-window):]
+		sorted := append([]int64(nil), recent...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		for _, check := range []struct {
+			p   int
+			got int64
+		}{{50, stat.P50}, {90, stat.P90}} {
+			// the exact percentile lies between the samples around its rank
+			pos := float64(check.p) / 100 * float64(len(sorted)-1)
+			low, high := sorted[int(pos)], sorted[min(int(pos)+1, len(sorted)-1)]
+			if check.got < low-percentileTolerance || check.got > high+percentileTolerance {
+				t.Fatalf("sample %d: p%d = %d, want between %d and %d", i+1, check.p, check.got, low, high)
+			}
+		}
+	}
+}
+
+func TestStepDurationWindowEviction(t *testing.T) {
+	const window = 50
+	var stat model.StepStatistic
+	for i := 0; i < window; i++ {
+		addStepDurationSample(&stat, 10, window)
+	}
+	if stat.P50 != 10 || stat.P90 != 10 {
+		t.Fatalf("full window of 10s: p50 %d p90 %d", stat.P50, stat.P90)
+	}
+	// the step slows down to 100s; each sample evicts one of the old 10s
+	for slow := 1; slow <= window; slow++ {
+		addStepDurationSample(&stat, 100, window)
+		fast := window - slow
+		oldest := int64(100)
+		if fast > 0 {
+			oldest = 10
+		}
+		if len(stat.Samples) != window || stat.Samples[0] != oldest || stat.Samples[window-1] != 100 {
+			t.Fatalf("after %d slow samples: window %v", slow, stat.Samples)
+		}
+		// nearest rank: p50 is sample 25 and p90 sample 45 of the sorted window
+		wantP50, wantP90 := int64(10), int64(10)
+		if fast < 25 {
+			wantP50 = 100
+		}
+		if fast < 45 {
+			wantP90 = 100
+		}
+		if stat.P50 != wantP50 || stat.P90 != wantP90 {
+			t.Fatalf("after %d slow samples: p50 %d p90 %d, want %d and %d", slow, stat.P50, stat.P90, wantP50, wantP90)
+		}
+	}
+}
+
+func TestRecordStepDuration(t *testing.T) {
+	db := storetest.Open(t, &model.StepStatistic{})
+	svc := NewService(db, nil, nil)
+	ctx := context.Background()
+
+	finish := func(name string, state model.StatusValue, kind model.StepType, duration int64) {
+		svc.recordStepDuration(ctx, 1, &model.Step{Name: name, State: state, Type: kind, Started: 1000, Finished: 1000 + duration})
+	}
+	for _, duration := range []int64{30, 40, 50} {
+		finish("build", model.StatusSuccess, "", duration)
+	}
+	finish("build", model.StatusFailure, "", 500)
+	finish("build", model.StatusSkipped, "", 0)
+	finish("deploy", model.StatusSuccess, model.StepTypeApproval, 3600)
+	// renamed step starts a baseline of its own
+	finish("compile", model.StatusSuccess, "", 90)
+
+	baselines, err := svc.StepDurationBaselines(ctx, 1)
+	if err != nil {
+		t.Fatalf("StepDurationBaselines: %v", err)
+	}
+	build := baselines["build"]
+	if build == nil || build.Count != 3 || build.P50 != 40 || build.P90 != 50 {
+		t.Fatalf("build baseline = %+v, want 3 successful samples with p50 40 and p90 50", build)
+	}
+	if got := build.DurationRatio(160); got != 4 {
+		t.Fatalf("ratio of 160s = %v, want 4", got)
+	}
+	if _, ok := baselines["deploy"]; ok {
+		t.Fatalf("approval step has a baseline")
+	}
+	if _, ok := baselines["compile"]; ok {
+		t.Fatalf("renamed step reports a baseline from a single sample")
+	}
+	stats, err := svc.store.ListStepStatistics(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("stored %d statistics, want build and compile only", len(stats))
+	}
+}
@@ -0,0 +1,867 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/model"
+)
+
+// pipelineStore is the persistence used by pipeline orchestration. Keeping it behind an
+// interface lets handleTask run against a fake that injects failures at any step.
+type pipelineStore interface {
+	// CreatePipelineGraph numbers the pipeline when needed and inserts it with its workflows,
+	// steps and tasks in one transaction.
+	CreatePipelineGraph(ctx context.Context, pipeline *model.Pipeline, workflows []*model.Workflow, steps []*model.Step, tasks []*model.Task) error
+	GetRepo(ctx context.Context, repoID int64) (*model.Repo, error)
+	GetPipeline(ctx context.Context, pipelineID int64) (*model.Pipeline, error)
+	GetPipelineStatus(ctx context.Context, pipelineID int64) (model.StatusValue, error)
+	// LastSuccessfulCommit returns the commit of the newest successful pipeline of branch
+	// created before beforeID with a commit other than exclude, or "" when there is none.
+	LastSuccessfulCommit(ctx context.Context, repoID int64, branch string, beforeID int64, exclude string) (string, error)
+	// LastPipelineCommit returns the commit of the newest pipeline of branch that has one,
+	// whatever its status, or "" when there is none.
+	LastPipelineCommit(ctx context.Context, repoID int64, branch string) (string, error)
+	// UpdatePipeline writes non-status columns; status changes go through the Mark methods,
+	// which fail with ErrIllegalTransition when the pipeline cannot enter the new status.
+	UpdatePipeline(ctx context.Context, pipelineID int64, updates map[string]any) error
+	MarkPipelineRunning(ctx context.Context, pipelineID int64, started int64) error
+	MarkPipelineBlocked(ctx context.Context, pipelineID int64, message string, updated int64) error
+	// MarkPipelineFinished finalises the pipeline and the workflows still unfinished and
+	// removes taskID when set.
+	MarkPipelineFinished(ctx context.Context, pipelineID int64, status model.StatusValue, finished int64, message string, taskID string) error
+	// ResetPipeline moves a running pipeline, its workflows and its running steps back to
+	// pending so the pipeline can be executed again.
+	ResetPipeline(ctx context.Context, pipelineID int64, updated int64) error
+	// KillPipeline marks the pipeline killed, stops unfinished workflows and steps and drops its tasks.
+	KillPipeline(ctx context.Context, pipelineID int64, message string, finished int64) error
+
+	ListPipelineWorkflows(ctx context.Context, pipelineID int64) ([]model.Workflow, error)
+	// TransitionWorkflow moves a workflow to status to with updates, or fails with
+	// ErrIllegalTransition.
+	TransitionWorkflow(ctx context.Context, workflowID int64, to model.StatusValue, updates map[string]any) error
+	ListPipelineSteps(ctx context.Context, pipelineID int64) ([]model.Step, error)
+	GetStep(ctx context.Context, stepID int64) (*model.Step, error)
+	// TransitionStep moves a step to status to with updates, or fails with ErrIllegalTransition.
+	TransitionStep(ctx context.Context, stepID int64, to model.StatusValue, updates map[string]any) error
+	// UpdateStep writes non-state columns such as the approval record.
+	UpdateStep(ctx context.Context, stepID int64, updates map[string]any) error
+	AppendLog(ctx context.Context, entry *model.LogEntry) error
+	// MaxLogLine returns the highest line logged for a step, 0 when it has none.
+	MaxLogLine(ctx context.Context, stepID int64) (int, error)
+
+	// ReplaceStepArtifacts swaps the artifact records of a step for artifacts.
+	ReplaceStepArtifacts(ctx context.Context, stepID int64, artifacts []*model.Artifact) error
+
+	// SavePipelineProvenance stores the provenance of a pipeline, replacing an earlier one.
+	SavePipelineProvenance(ctx context.Context, record *model.PipelineProvenance) error
+
+	// SavePipelineSnapshot stores the trigger snapshot of a pipeline.
+	SavePipelineSnapshot(ctx context.Context, snapshot *model.PipelineSnapshot) error
+
+	// UpdateStepStatistic applies update to the duration statistic of stepName in repoID
+	// under a row lock, creating the statistic when the step has none yet.
+	UpdateStepStatistic(ctx context.Context, repoID int64, stepName string, update func(*model.StepStatistic)) error
+
+	FindPipelineTask(ctx context.Context, pipelineID int64) (*model.Task, error)
+	// ListRecoverableTasks returns the tasks of pending and running pipelines, oldest first.
+	ListRecoverableTasks(ctx context.Context) ([]*model.Task, error)
+	UpdateTaskData(ctx context.Context, taskID string, data []byte) error
+	DeleteTask(ctx context.Context, taskID string) error
+
+	ListPipelineIDs(ctx context.Context, repoID int64) ([]int64, error)
+	// ListObsoletePipelineIDs returns the ids of a repository's pipelines beyond the newest keep.
+	ListObsoletePipelineIDs(ctx context.Context, repoID int64, keep, limit int) ([]int64, error)
+	// DeletePipelines removes the pipelines with their logs, steps, workflows, tasks,
+	// artifact records and provenance.
+	DeletePipelines(ctx context.Context, pipelineIDs []int64) error
+	// DeleteRepository removes a repository with its pipelines and every record scoped to it
+	// in one transaction and returns the ids of the removed pipelines.
+	DeleteRepository(ctx context.Context, repoID int64) ([]int64, error)
+
+	// TryAcquireNamespaceLock inserts lock unless its target is taken, in which case the
+	// current holder is returned.
+	TryAcquireNamespaceLock(ctx context.Context, lock *model.NamespaceLock) (holder *model.NamespaceLock, acquired bool, err error)
+	ListNamespaceLocks(ctx context.Context) ([]*model.NamespaceLock, error)
+	// DeleteNamespaceLock removes a lock; stepID > 0 only removes it while that step holds it.
+	DeleteNamespaceLock(ctx context.Context, lockID, stepID int64) (bool, error)
+
+	// ListPipelines returns a page of the pipelines of repoID matching filter, newest first,
+	// and how many match.
+	ListPipelines(ctx context.Context, repoID int64, filter model.PipelineFilter, offset, limit int) ([]*model.Pipeline, int64, error)
+	// ListUnfinishedPipelineIDs returns the ids of the pipelines of repoID that did not finish.
+	ListUnfinishedPipelineIDs(ctx context.Context, repoID int64) ([]int64, error)
+	// PipelineNumbers maps pipeline ids to their run numbers.
+	PipelineNumbers(ctx context.Context, pipelineIDs []int64) (map[int64]int64, error)
+	// GetPipelineRunDetail loads a pipeline of repoID with its workflows, steps and the last
+	// tail log lines of every step.
+	GetPipelineRunDetail(ctx context.Context, repoID, pipelineID int64, tail int) (*PipelineRunDetail, error)
+	// ListPipelinesSteps returns the steps of every pipeline in pipelineIDs.
+	ListPipelinesSteps(ctx context.Context, pipelineIDs []int64) ([]*model.Step, error)
+	// PreviousBuildStep returns the last successful run of the build step stepName in a
+	// pipeline of repoID before pipelineID.
+	PreviousBuildStep(ctx context.Context, repoID, pipelineID int64, stepName string) (*model.Step, error)
+	// FindRunStep returns ErrStepNotFound unless stepID is a step of pipelineID in repoID.
+	FindRunStep(ctx context.Context, repoID, pipelineID, stepID int64) error
+	// ListStepLog returns limit log lines of a step from the offset-th and how many it has.
+	ListStepLog(ctx context.Context, stepID int64, offset, limit int) ([]model.LogEntry, int64, error)
+	// ListStepLogAfter returns up to limit log lines of a step that follow line afterLine and
+	// entry afterID.
+	ListStepLogAfter(ctx context.Context, stepID int64, afterLine int, afterID int64, limit int) ([]model.LogEntry, error)
+	// PurgeLogs deletes up to limit log lines created before cutoff of the runs of repoID
+	// that finished before it, marking every step that lost lines as purged after days. It
+	// returns how many lines matched and how many were deleted.
+	PurgeLogs(ctx context.Context, repoID, cutoff int64, days, limit int) (int, int64, error)
+	// CollectPipelineStats fills stats with the aggregates of the pipelines of repoID in the
+	// window, branch and step stats describes.
+	CollectPipelineStats(ctx context.Context, repoID int64, stats *PipelineStats) error
+	ListStepStatistics(ctx context.Context, repoID int64) ([]*model.StepStatistic, error)
+	ListArtifacts(ctx context.Context, repoID, pipelineID int64) ([]*model.Artifact, error)
+	GetArtifact(ctx context.Context, repoID, pipelineID, artifactID int64) (*model.Artifact, error)
+	GetPipelineProvenance(ctx context.Context, repoID, pipelineID int64) (*model.PipelineProvenance, error)
+	GetPipelineSnapshot(ctx context.Context, repoID, pipelineID int64) (*model.PipelineSnapshot, error)
+
+	// GetPipelineConfig returns the stored pipeline config of a repository.
+	GetPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error)
+	// GetPublicPipelineConfig returns the pipeline config of a repository with a public status.
+	GetPublicPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error)
+	// ListPipelineConfigs returns the pipeline configs of every repository by repository,
+	// limited to columns when given.
+	ListPipelineConfigs(ctx context.Context, columns ...string) ([]*model.RepoPipelineConfig, error)
+	// SavePipelineConfig applies change to the pipeline config of a repository in one
+	// transaction and returns the saved config with the repository as it was before.
+	SavePipelineConfig(ctx context.Context, repoID int64, change pipelineConfigChange) (*model.RepoPipelineConfig, *model.Repo, error)
+	// UpdateCronTriggers replaces the cron trigger times of a repository with what triggered
+	// returns for its config; repositories without a config are left alone.
+	UpdateCronTriggers(ctx context.Context, repoID int64, triggered func(cfg *model.RepoPipelineConfig) map[string]int64) error
+	// ListConfigRevisions returns limit revisions of the config of repoID from the offset-th,
+	// newest first, and how many there are.
+	ListConfigRevisions(ctx context.Context, repoID int64, offset, limit int) ([]model.RepoPipelineConfigRevision, int64, error)
+	GetConfigRevision(ctx context.Context, repoID, revisionID int64) (*model.RepoPipelineConfigRevision, error)
+	SetRepoActive(ctx context.Context, repoID int64, active bool) error
+	// ListWorkspaceRepos returns every repository with the config columns workspace cleanup needs.
+	ListWorkspaceRepos(ctx context.Context) ([]*model.Repo, []*model.RepoPipelineConfig, error)
+	ListRepos(ctx context.Context, repoIDs []int64) ([]*model.Repo, error)
+	ListRepoVariables(ctx context.Context, repoID int64) ([]*model.RepoVariable, error)
+	ListKubernetesTargets(ctx context.Context, clusterID int64) ([]*model.KubernetesTarget, error)
+
+	// ListEnvTemplates lists the templates of scope and repoID by key.
+	ListEnvTemplates(ctx context.Context, scope model.EnvTemplateScope, repoID int64) ([]*model.EnvTemplate, error)
+	// ListRunEnvTemplates lists the global templates and those of repoID.
+	ListRunEnvTemplates(ctx context.Context, repoID int64) ([]*model.EnvTemplate, error)
+	// SaveEnvTemplate creates or updates a template; a nil value keeps the stored one and
+	// fails with gorm.ErrRecordNotFound for a new template.
+	SaveEnvTemplate(ctx context.Context, scope model.EnvTemplateScope, repoID int64, key string, value *string, masked bool) (*model.EnvTemplate, error)
+	DeleteEnvTemplate(ctx context.Context, scope model.EnvTemplateScope, repoID int64, key string) error
+
+	ListPlugins(ctx context.Context) ([]*model.PluginDefinition, error)
+	// ListPluginsByName returns the plugins named in names.
+	ListPluginsByName(ctx context.Context, names []string) ([]*model.PluginDefinition, error)
+	GetPlugin(ctx context.Context, id int64) (*model.PluginDefinition, error)
+	// CreatePlugin inserts plugin unless another plugin has its name.
+	CreatePlugin(ctx context.Context, plugin *model.PluginDefinition) error
+	// UpdatePlugin loads a plugin, applies update and saves it unless another plugin has
+	// the new name.
+	UpdatePlugin(ctx context.Context, id int64, update func(plugin *model.PluginDefinition) error) (*model.PluginDefinition, error)
+	DeletePlugin(ctx context.Context, id int64) error
+
+	// ListBlockedApprovalSteps returns the approval steps waiting for a decision.
+	ListBlockedApprovalSteps(ctx context.Context) ([]*model.Step, error)
+	// ChangeStep loads a step, of pipelineID when it is not 0, and applies the change decide
+	// returns for it in one transaction. A nil change leaves the step alone.
+	ChangeStep(ctx context.Context, pipelineID, stepID int64, decide func(step *model.Step) (*stepChange, error)) error
+	// ListVisibleApproverGroups returns the global groups of the organizations in the scope
+	// of ctx and the groups of repoID, global ones first.
+	ListVisibleApproverGroups(ctx context.Context, repoID int64) ([]*model.ApproverGroup, error)
+	// ListApproverGroups, GetApproverGroup, UpdateApproverGroup and DeleteApproverGroup
+	// only see groups of the organizations in the scope of ctx.
+	ListApproverGroups(ctx context.Context, repoID int64) ([]*model.ApproverGroup, error)
+	GetApproverGroup(ctx context.Context, id int64) (*model.ApproverGroup, error)
+	// CreateApproverGroup assigns the group to the organization of its repository, or to
+	// its OrgID resolved in the scope of ctx, and inserts it unless the name is taken.
+	CreateApproverGroup(ctx context.Context, group *model.ApproverGroup) error
+	UpdateApproverGroup(ctx context.Context, id int64, update func(group *model.ApproverGroup) error) (*model.ApproverGroup, error)
+	DeleteApproverGroup(ctx context.Context, id int64) error
+
+	ListNotificationTargets(ctx context.Context, repoID int64) ([]*model.NotificationTarget, error)
+	GetNotificationTarget(ctx context.Context, repoID, id int64) (*model.NotificationTarget, error)
+	CreateNotificationTarget(ctx context.Context, target *model.NotificationTarget) error
+	UpdateNotificationTarget(ctx context.Context, repoID, id int64, update func(target *model.NotificationTarget) error) (*model.NotificationTarget, error)
+	DeleteNotificationTarget(ctx context.Context, repoID, id int64) error
+	CreateNotificationAttempt(ctx context.Context, attempt *model.NotificationAttempt) error
+	ListNotificationAttempts(ctx context.Context, repoID int64, limit int) ([]*model.NotificationAttempt, error)
+
+	// UpsertAgent records agent under its name, updating an agent registered before with
+	// that name, and loads the stored record into agent.
+	UpsertAgent(ctx context.Context, agent *model.Agent) error
+	GetAgent(ctx context.Context, agentID int64) (*model.Agent, error)
+	// TouchAgent records when an agent was last seen and the task it runs.
+	TouchAgent(ctx context.Context, agentID int64, seen int64, taskID string, pipelineID int64) error
+	ListAgents(ctx context.Context) ([]*model.Agent, error)
+}
+
+// pipelineConfigChange is a write of the pipeline config of a repository. The config holds
+// the defaults when the repository has none yet.
+type pipelineConfigChange struct {
+	now  int64
+	edit func(cfg *model.RepoPipelineConfig)
+	// revision, when set, records the content edit left as a new revision if it changed.
+	revision *model.RepoPipelineConfigRevision
+	// variables are imported with the config.
+	variables []PipelineBundleVariable
+	// activate reports whether the saved config activates the repository.
+	activate func(cfg *model.RepoPipelineConfig) bool
+}
+
+// stepChange is what ChangeStep writes to a step.
+type stepChange struct {
+	// state moves the step with a guarded transition when set.
+	state   model.StatusValue
+	updates map[string]any
+	// resume moves the pipeline of the step back to running with these updates.
+	resume map[string]any
+}
+
+type gormPipelineStore struct {
+	db *store.DB
+}
+
+func newGormPipelineStore(db *store.DB) *gormPipelineStore {
+	return &gormPipelineStore{db: db}
+}
+
+// pipelineNumberAttempts bounds how often CreatePipelineGraph numbers a pipeline again after a
+// concurrent insert took its number.
+const pipelineNumberAttempts = 5
+
+// errPipelineNumberTaken reports an insert rejected by the unique index on (repo_id, number).
+var errPipelineNumberTaken = errors.New("pipeline number taken")
+
+// CreatePipelineGraph locks the repository row to number the pipeline after the highest
+// number of the repository. Databases that ignore SELECT ... FOR UPDATE, such as SQLite, let
+// two inserts pick the same number; the unique index on (repo_id, number) rejects the second,
+// which is numbered again in a new transaction.
+func (st *gormPipelineStore) CreatePipelineGraph(ctx context.Context, pipeline *model.Pipeline, workflows []*model.Workflow, steps []*model.Step, tasks []*model.Task) error {
+	assign := pipeline.Number == 0
+	for attempt := 1; ; attempt++ {
+		err := st.createPipelineGraph(ctx, pipeline, workflows, steps, tasks)
+		if !assign || !errors.Is(err, errPipelineNumberTaken) || attempt == pipelineNumberAttempts {
+			return err
+		}
+		pipeline.ID = 0
+		pipeline.Number = 0
+	}
+}
+
+func (st *gormPipelineStore) createPipelineGraph(ctx context.Context, pipeline *model.Pipeline, workflows []*model.Workflow, steps []*model.Step, tasks []*model.Task) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if pipeline.Number == 0 {
+			if err := tx.WithContext(ctx).
+				Table("repos").
+				Select("id").
+				Where("id = ?", pipeline.RepoID).
+				Clauses(clause.Locking{Strength: "UPDATE"}).
+				Take(&struct{ ID int64 }{}).Error; err != nil {
+				return err
+			}
+
+			var nextNumber int64
+			if err := tx.WithContext(ctx).
+				Model(&model.Pipeline{}).
+				Where("repo_id = ?", pipeline.RepoID).
+				Select("COALESCE(MAX(number), 0)").
+				Scan(&nextNumber).Error; err != nil {
+				return err
+			}
+			pipeline.Number = nextNumber + 1
+		}
+
+		if err := tx.WithContext(ctx).Create(pipeline).Error; err != nil {
+			if store.IsDuplicateKey(err) {
+				return fmt.Errorf("%w: #%d: %w", errPipelineNumberTaken, pipeline.Number, err)
+			}
+			return err
+		}
+
+		if len(workflows) > 0 {
+			for _, wf := range workflows {
+				wf.PipelineID = pipeline.ID
+			}
+			if err := tx.WithContext(ctx).Create(&workflows).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(steps) > 0 {
+			for _, step := range steps {
+				step.PipelineID = pipeline.ID
+			}
+			if err := tx.WithContext(ctx).Create(&steps).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(tasks) > 0 {
+			for _, task := range tasks {
+				task.PipelineID = pipeline.ID
+				task.RepoID = pipeline.RepoID
+				if strings.TrimSpace(task.Name) == "" {
+					task.Name = fmt.Sprintf("pipeline-%d", pipeline.Number)
+				}
+			}
+			if err := tx.WithContext(ctx).Create(&tasks).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (st *gormPipelineStore) GetRepo(ctx context.Context, repoID int64) (*model.Repo, error) {
+	var repo model.Repo
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).First(&repo, repoID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+func (st *gormPipelineStore) GetPipeline(ctx context.Context, pipelineID int64) (*model.Pipeline, error) {
+	var pipeline model.Pipeline
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).First(&pipeline, pipelineID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+func (st *gormPipelineStore) GetPipelineStatus(ctx context.Context, pipelineID int64) (model.StatusValue, error) {
+	var pipeline model.Pipeline
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Select("status").
+			Where("id = ?", pipelineID).
+			Take(&pipeline).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return pipeline.Status, nil
+}
+
+func (st *gormPipelineStore) LastSuccessfulCommit(ctx context.Context, repoID int64, branch string, beforeID int64, exclude string) (string, error) {
+	var pipelines []model.Pipeline
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Select("commit").
+			Where("repo_id = ? AND branch = ? AND status = ? AND id < ?", repoID, branch, model.StatusSuccess, beforeID).
+			// commit is a keyword in some dialects, so the column is quoted by clause
+			Where(clause.Neq{Column: clause.Column{Name: "commit"}, Value: exclude}).
+			Where(clause.Neq{Column: clause.Column{Name: "commit"}, Value: ""}).
+			Order("id DESC").
+			Limit(1).
+			Find(&pipelines).Error
+	})
+	if err != nil || len(pipelines) == 0 {
+		return "", err
+	}
+	return pipelines[0].Commit, nil
+}
+
+func (st *gormPipelineStore) LastPipelineCommit(ctx context.Context, repoID int64, branch string) (string, error) {
+	var pipelines []model.Pipeline
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Select("commit").
+			Where("repo_id = ? AND branch = ?", repoID, branch).
+			Where(clause.Neq{Column: clause.Column{Name: "commit"}, Value: ""}).
+			Order("id DESC").
+			Limit(1).
+			Find(&pipelines).Error
+	})
+	if err != nil || len(pipelines) == 0 {
+		return "", err
+	}
+	return pipelines[0].Commit, nil
+}
+
+func (st *gormPipelineStore) UpdatePipeline(ctx context.Context, pipelineID int64, updates map[string]any) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("id = ?", pipelineID).
+			Updates(updates).Error
+	})
+}
+
+// transitionPipeline moves a pipeline and its workflows to status to and runs mutate in the
+// same transaction. It fails with ErrIllegalTransition when the pipeline cannot enter to.
+func (st *gormPipelineStore) transitionPipeline(ctx context.Context, pipelineID int64, to model.StatusValue, updates, workflowUpdates map[string]any, mutate func(tx *gorm.DB) error) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionPipelineTx(ctx, tx, pipelineID, to, updates, workflowUpdates); err != nil {
+			return err
+		}
+		if mutate == nil {
+			return nil
+		}
+		return mutate(tx)
+	})
+}
+
+func (st *gormPipelineStore) MarkPipelineRunning(ctx context.Context, pipelineID int64, started int64) error {
+	return st.transitionPipeline(ctx, pipelineID, model.StatusRunning, map[string]any{
+		"started": started,
+		"updated": started,
+	}, nil, nil)
+}
+
+func (st *gormPipelineStore) MarkPipelineBlocked(ctx context.Context, pipelineID int64, message string, updated int64) error {
+	updates := map[string]any{
+		"updated": updated,
+	}
+	if strings.TrimSpace(message) != "" {
+		updates["message"] = message
+	}
+	return st.transitionPipeline(ctx, pipelineID, model.StatusBlocked, updates, nil, nil)
+}
+
+func (st *gormPipelineStore) MarkPipelineFinished(ctx context.Context, pipelineID int64, status model.StatusValue, finished int64, message string, taskID string) error {
+	update := map[string]any{
+		"finished": finished,
+		"updated":  finished,
+	}
+	if strings.TrimSpace(message) != "" {
+		update["message"] = message
+	}
+	return st.transitionPipeline(ctx, pipelineID, status, update, map[string]any{
+		"finished": finished,
+	}, func(tx *gorm.DB) error {
+		if taskID == "" {
+			return nil
+		}
+		return tx.WithContext(ctx).Delete(&model.Task{}, "id = ?", taskID).Error
+	})
+}
+
+func (st *gormPipelineStore) ResetPipeline(ctx context.Context, pipelineID int64, updated int64) error {
+	return st.transitionPipeline(ctx, pipelineID, model.StatusPending, map[string]any{
+		"updated": updated,
+	}, map[string]any{}, func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Step{}).
+			Where("pipeline_id = ? AND state IN ?", pipelineID, stepTransitions[model.StatusPending]).
+			Updates(map[string]any{
+				"state":   model.StatusPending,
+				"started": 0,
+			}).Error
+	})
+}
+
+func (st *gormPipelineStore) KillPipeline(ctx context.Context, pipelineID int64, message string, finished int64) error {
+	return st.transitionPipeline(ctx, pipelineID, model.StatusKilled, map[string]any{
+		"message":  message,
+		"finished": finished,
+		"updated":  finished,
+	}, map[string]any{
+		"finished": finished,
+	}, func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).
+			Model(&model.Step{}).
+			Where("pipeline_id = ? AND state IN ?", pipelineID, stepTransitions[model.StatusKilled]).
+			Updates(map[string]any{
+				"state":    model.StatusKilled,
+				"finished": finished,
+				"failure":  "",
+				"error":    "",
+			}).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Delete(&model.Task{}, "pipeline_id = ?", pipelineID).Error
+	})
+}
+
+func (st *gormPipelineStore) ListPipelineWorkflows(ctx context.Context, pipelineID int64) ([]model.Workflow, error) {
+	var workflows []model.Workflow
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("pipeline_id = ?", pipelineID).
+			Order("pid ASC").
+			Find(&workflows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return workflows, nil
+}
+
+func (st *gormPipelineStore) TransitionWorkflow(ctx context.Context, workflowID int64, to model.StatusValue, updates map[string]any) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return transitionRecord(ctx, tx, workflowStatusEntity, workflowID, to, updates)
+	})
+}
+
+func (st *gormPipelineStore) ListPipelineSteps(ctx context.Context, pipelineID int64) ([]model.Step, error) {
+	var steps []model.Step
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Step{}).
+			Where("pipeline_id = ?", pipelineID).
+			Order("pid ASC").
+			Find(&steps).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func (st *gormPipelineStore) GetStep(ctx context.Context, stepID int64) (*model.Step, error) {
+	var step model.Step
+	if err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).First(&step, stepID).Error
+	}); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &step, nil
+}
+
+func (st *gormPipelineStore) TransitionStep(ctx context.Context, stepID int64, to model.StatusValue, updates map[string]any) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return transitionRecord(ctx, tx, stepStatusEntity, stepID, to, updates)
+	})
+}
+
+func (st *gormPipelineStore) UpdateStep(ctx context.Context, stepID int64, updates map[string]any) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Step{}).
+			Where("id = ?", stepID).
+			Updates(updates).Error
+	})
+}
+
+func (st *gormPipelineStore) AppendLog(ctx context.Context, entry *model.LogEntry) error {
+	return st.db.GetDB().WithContext(ctx).Create(entry).Error
+}
+
+func (st *gormPipelineStore) MaxLogLine(ctx context.Context, stepID int64) (int, error) {
+	var line int
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.LogEntry{}).
+			Where("step_id = ?", stepID).
+			Select("COALESCE(MAX(line), 0)").
+			Scan(&line).Error
+	})
+	return line, err
+}
+
+func (st *gormPipelineStore) ReplaceStepArtifacts(ctx context.Context, stepID int64, artifacts []*model.Artifact) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).Delete(&model.Artifact{}, "step_id = ?", stepID).Error; err != nil {
+			return err
+		}
+		if len(artifacts) == 0 {
+			return nil
+		}
+		return tx.WithContext(ctx).Create(&artifacts).Error
+	})
+}
+
+func (st *gormPipelineStore) SavePipelineProvenance(ctx context.Context, record *model.PipelineProvenance) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "pipeline_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"key_id", "document", "signature", "created"}),
+			}).
+			Create(record).Error
+	})
+}
+
+func (st *gormPipelineStore) SavePipelineSnapshot(ctx context.Context, snapshot *model.PipelineSnapshot) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Create(snapshot).Error
+	})
+}
+
+func (st *gormPipelineStore) UpdateStepStatistic(ctx context.Context, repoID int64, stepName string, update func(*model.StepStatistic)) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		var stat model.StepStatistic
+		err := tx.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("repo_id = ? AND step_name = ?", repoID, stepName).
+			Take(&stat).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			stat = model.StepStatistic{RepoID: repoID, StepName: stepName}
+			update(&stat)
+			// a concurrent first finish of the same step keeps whichever sample lands last
+			return tx.WithContext(ctx).
+				Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "repo_id"}, {Name: "step_name"}},
+					DoUpdates: clause.AssignmentColumns([]string{"count", "p50", "p90", "samples", "updated"}),
+				}).
+				Create(&stat).Error
+		}
+		if err != nil {
+			return err
+		}
+		update(&stat)
+		// struct updates keep the json serializer for samples
+		return tx.WithContext(ctx).
+			Model(&stat).
+			Select("count", "p50", "p90", "samples", "updated").
+			Updates(&stat).Error
+	})
+}
+
+func (st *gormPipelineStore) FindPipelineTask(ctx context.Context, pipelineID int64) (*model.Task, error) {
+	var task model.Task
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("pipeline_id = ?", pipelineID).
+			Take(&task).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (st *gormPipelineStore) ListRecoverableTasks(ctx context.Context) ([]*model.Task, error) {
+	var tasks []*model.Task
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN pipelines ON pipelines.id = tasks.pipeline_id").
+			Where("pipelines.status IN ?", []model.StatusValue{model.StatusPending, model.StatusRunning}).
+			Order("tasks.pipeline_id ASC").
+			Find(&tasks).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (st *gormPipelineStore) UpdateTaskData(ctx context.Context, taskID string, data []byte) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Task{}).
+			Where("id = ?", taskID).
+			Update("data", data).Error
+	})
+}
+
+func (st *gormPipelineStore) DeleteTask(ctx context.Context, taskID string) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Delete(&model.Task{}, "id = ?", taskID).Error
+	})
+}
+
+func (st *gormPipelineStore) ListPipelineIDs(ctx context.Context, repoID int64) ([]int64, error) {
+	var ids []int64
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("repo_id = ?", repoID).
+			Pluck("id", &ids).Error
+	})
+	return ids, err
+}
+
+func (st *gormPipelineStore) ListObsoletePipelineIDs(ctx context.Context, repoID int64, keep, limit int) ([]int64, error) {
+	var ids []int64
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("repo_id = ?", repoID).
+			Order("created DESC").
+			Offset(keep).
+			Limit(limit).
+			Pluck("id", &ids).Error
+	})
+	return ids, err
+}
+
+func (st *gormPipelineStore) DeletePipelines(ctx context.Context, pipelineIDs []int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return deletePipelinesTx(ctx, tx, pipelineIDs)
+	})
+}
+
+func deletePipelinesTx(ctx context.Context, tx *gorm.DB, pipelineIDs []int64) error {
+	// collect step ids for logs
+	var stepIDs []int64
+	if err := tx.WithContext(ctx).
+		Model(&model.Step{}).
+		Where("pipeline_id IN ?", pipelineIDs).
+		Pluck("id", &stepIDs).Error; err != nil {
+		return err
+	}
+
+	if len(stepIDs) > 0 {
+		if err := tx.WithContext(ctx).Delete(&model.LogEntry{}, "step_id IN ?", stepIDs).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := tx.WithContext(ctx).Delete(&model.Step{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.Workflow{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.Task{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.Artifact{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.PipelineProvenance{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.PipelineSnapshot{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.WithContext(ctx).Delete(&model.NotificationAttempt{}, "pipeline_id IN ?", pipelineIDs).Error; err != nil {
+		return err
+	}
+	return tx.WithContext(ctx).Delete(&model.Pipeline{}, "id IN ?", pipelineIDs).Error
+}
+
+func (st *gormPipelineStore) DeleteRepository(ctx context.Context, repoID int64) ([]int64, error) {
+	var pipelineIDs []int64
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("repo_id = ?", repoID).
+			Pluck("id", &pipelineIDs).Error; err != nil {
+			return err
+		}
+		if len(pipelineIDs) > 0 {
+			if err := deletePipelinesTx(ctx, tx, pipelineIDs); err != nil {
+				return err
+			}
+		}
+
+		// repo_id 0 marks global secrets and approver groups, so the id is never 0 here
+		scoped := []any{
+			&model.Task{},
+			&model.RepoPipelineConfig{},
+			&model.RepoPipelineConfigRevision{},
+			&model.RepoVariable{},
+			&model.RepoMember{},
+			&model.Secret{},
+			&model.ApproverGroup{},
+			&model.NotificationTarget{},
+			&model.NotificationAttempt{},
+			&model.StepStatistic{},
+			&model.KubernetesTarget{},
+			&model.NamespaceLock{},
+			&model.Redirection{},
+		}
+		for _, record := range scoped {
+			if err := tx.WithContext(ctx).Where("repo_id = ?", repoID).Delete(record).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.WithContext(ctx).
+			Where("scope = ? AND repo_id = ?", model.EnvTemplateScopeRepo, repoID).
+			Delete(&model.EnvTemplate{}).Error; err != nil {
+			return err
+		}
+
+		result := tx.WithContext(ctx).Delete(&model.Repo{}, "id = ?", repoID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pipelineIDs, nil
+}
+
+func (st *gormPipelineStore) TryAcquireNamespaceLock(ctx context.Context, lock *model.NamespaceLock) (*model.NamespaceLock, bool, error) {
+	var (
+		holder   model.NamespaceLock
+		acquired bool
+	)
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(lock)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			acquired = true
+			return nil
+		}
+		return tx.WithContext(ctx).
+			Where("cluster = ? AND namespace = ?", lock.Cluster, lock.Namespace).
+			Take(&holder).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// released between the insert and the lookup; the caller retries
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if acquired {
+		return lock, true, nil
+	}
+	return &holder, false, nil
+}
+
+func (st *gormPipelineStore) ListNamespaceLocks(ctx context.Context) ([]*model.NamespaceLock, error) {
+	var locks []*model.NamespaceLock
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Order("acquired ASC").
+			Find(&locks).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+func (st *gormPipelineStore) DeleteNamespaceLock(ctx context.Context, lockID, stepID int64) (bool, error) {
+	var deleted bool
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Where("id = ?", lockID)
+		if stepID > 0 {
+			query = query.Where("step_id = ?", stepID)
+		}
+		result := query.Delete(&model.NamespaceLock{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected > 0
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (st *gormPipelineStore) UpsertAgent(ctx context.Context, agent *model.Agent) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"labels", "version", "last_seen", "task_id", "pipeline_id"}),
+		}).Create(agent).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Where("name = ?", agent.Name).Take(agent).Error
+	})
+}
+
+func (st *gormPipelineStore) GetAgent(ctx context.Context, agentID int64) (*model.Agent, error) {
+	var agent model.Agent
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("id = ?", agentID).Take(&agent).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &agent, nil
+}
+
+func (st *gormPipelineStore) TouchAgent(ctx context.Context, agentID int64, seen int64, taskID string, pipelineID int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Model(&model.Agent{}).Where("id = ?", agentID).Updates(map[string]interface{}{
+			"last_seen":   seen,
+			"task_id":     taskID,
+			"pipeline_id": pipelineID,
+		}).Error
+	})
+}
+
+func (st *gormPipelineStore) ListAgents(ctx context.Context) ([]*model.Agent, error) {
+	var agents []*model.Agent
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Order("name ASC").Find(&agents).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
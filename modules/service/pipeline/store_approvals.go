@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+func (st *gormPipelineStore) ListBlockedApprovalSteps(ctx context.Context) ([]*model.Step, error) {
+	var steps []*model.Step
+	err := st.db.View(func(tx *gorm.DB) error {
+		// the approval state lives in a JSON column, so callers check expiry after loading
+		return tx.WithContext(ctx).
+			Where("type = ? AND state = ?", model.StepTypeApproval, model.StatusBlocked).
+			Find(&steps).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func (st *gormPipelineStore) ChangeStep(ctx context.Context, pipelineID, stepID int64, decide func(step *model.Step) (*stepChange, error)) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Where("id = ?", stepID)
+		if pipelineID != 0 {
+			query = query.Where("pipeline_id = ?", pipelineID)
+		}
+		var step model.Step
+		if err := query.Take(&step).Error; err != nil {
+			return err
+		}
+		change, err := decide(&step)
+		if err != nil || change == nil {
+			return err
+		}
+		if change.state != "" {
+			// the guarded transition only matches a step still in a state that may enter it
+			err = transitionRecord(ctx, tx, stepStatusEntity, step.ID, change.state, change.updates)
+		} else {
+			err = tx.WithContext(ctx).
+				Model(&model.Step{}).
+				Where("id = ?", step.ID).
+				Updates(change.updates).Error
+		}
+		if err != nil || change.resume == nil {
+			return err
+		}
+		return transitionPipelineTx(ctx, tx, step.PipelineID, model.StatusRunning, change.resume, nil)
+	})
+}
+
+func (st *gormPipelineStore) ListVisibleApproverGroups(ctx context.Context, repoID int64) ([]*model.ApproverGroup, error) {
+	scope := tenancy.FromContext(ctx)
+	var groups []*model.ApproverGroup
+	err := st.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Where("repo_id IN ?", []int64{0, repoID})
+		if !scope.All {
+			query = query.Where("repo_id <> 0 OR org_id IN ?", scope.OrgIDs)
+		}
+		return query.Order("repo_id ASC").Find(&groups).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (st *gormPipelineStore) ListApproverGroups(ctx context.Context, repoID int64) ([]*model.ApproverGroup, error) {
+	var groups []*model.ApproverGroup
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").
+			Where("repo_id = ?", repoID).
+			Order("name ASC").
+			Find(&groups).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (st *gormPipelineStore) GetApproverGroup(ctx context.Context, id int64) (*model.ApproverGroup, error) {
+	var group model.ApproverGroup
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").First(&group, id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (st *gormPipelineStore) CreateApproverGroup(ctx context.Context, group *model.ApproverGroup) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if group.RepoID != 0 {
+			var repo model.Repo
+			if err := tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").
+				Select("id", "org_id").
+				First(&repo, group.RepoID).Error; err != nil {
+				return err
+			}
+			group.OrgID = repo.OrgID
+		} else {
+			orgID, err := tenancy.ResolveOrg(ctx, tx, group.OrgID)
+			if err != nil {
+				return err
+			}
+			group.OrgID = orgID
+		}
+		if err := ensureApproverGroupNameFree(ctx, tx, group.OrgID, group.RepoID, group.Name, 0); err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Create(group).Error
+	})
+}
+
+func (st *gormPipelineStore) UpdateApproverGroup(ctx context.Context, id int64, update func(group *model.ApproverGroup) error) (*model.ApproverGroup, error) {
+	var group model.ApproverGroup
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").First(&group, id).Error; err != nil {
+			return err
+		}
+		if err := update(&group); err != nil {
+			return err
+		}
+		if err := ensureApproverGroupNameFree(ctx, tx, group.OrgID, group.RepoID, group.Name, group.ID); err != nil {
+			return err
+		}
+		// struct updates keep the json serializer for members
+		return tx.WithContext(ctx).
+			Model(&group).
+			Select("name", "members", "updated").
+			Updates(&group).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (st *gormPipelineStore) DeleteApproverGroup(ctx context.Context, id int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		result := tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").Delete(&model.ApproverGroup{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func ensureApproverGroupNameFree(ctx context.Context, tx *gorm.DB, orgID, repoID int64, name string, excludeID int64) error {
+	var count int64
+	query := tx.WithContext(ctx).Model(&model.ApproverGroup{})
+	if repoID == 0 {
+		// global groups are unique per organization
+		query = query.Where("org_id = ?", orgID)
+	}
+	if err := query.
+		Where("repo_id = ? AND LOWER(name) = ? AND id <> ?", repoID, strings.ToLower(name), excludeID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrApproverGroupExists, name)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (st *gormPipelineStore) GetPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
+	var cfg model.RepoPipelineConfig
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Take(&cfg).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (st *gormPipelineStore) GetPublicPipelineConfig(ctx context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
+	var cfg model.RepoPipelineConfig
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ? AND public_status = ?", repoID, true).
+			Take(&cfg).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (st *gormPipelineStore) ListPipelineConfigs(ctx context.Context, columns ...string) ([]*model.RepoPipelineConfig, error) {
+	var configs []*model.RepoPipelineConfig
+	err := st.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Order("repo_id ASC")
+		if len(columns) > 0 {
+			query = query.Select(columns)
+		}
+		return query.Find(&configs).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func (st *gormPipelineStore) SavePipelineConfig(ctx context.Context, repoID int64, change pipelineConfigChange) (*model.RepoPipelineConfig, *model.Repo, error) {
+	var (
+		saved *model.RepoPipelineConfig
+		repo  model.Repo
+	)
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		if change.activate != nil {
+			if err := tx.WithContext(ctx).
+				Select("id", "user_id", "active").
+				Take(&repo, repoID).Error; err != nil {
+				return err
+			}
+		}
+
+		var cfg model.RepoPipelineConfig
+		err := tx.WithContext(ctx).Where("repo_id = ?", repoID).Take(&cfg).Error
+		created := errors.Is(err, gorm.ErrRecordNotFound)
+		switch {
+		case created:
+			cfg = *defaultPipelineSettings()
+			cfg.RepoID = repoID
+			cfg.Created = change.now
+		case err != nil:
+			return err
+		}
+
+		previous := cfg.Content
+		cfg.Updated = change.now
+		change.edit(&cfg)
+		if change.revision != nil {
+			if cfg.Version, err = recordConfigRevision(ctx, tx, &cfg, previous, *change.revision, change.now); err != nil {
+				return err
+			}
+		}
+		if created {
+			err = tx.WithContext(ctx).Create(&cfg).Error
+		} else {
+			err = tx.WithContext(ctx).Save(&cfg).Error
+		}
+		if err != nil {
+			return err
+		}
+		saved = &cfg
+
+		if err := applyBundleVariables(ctx, tx, repoID, change.variables, change.now); err != nil {
+			return err
+		}
+		if change.activate == nil || !change.activate(&cfg) {
+			return nil
+		}
+		return tx.WithContext(ctx).
+			Model(&model.Repo{}).
+			Where("id = ?", repoID).
+			Update("active", true).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return saved, &repo, nil
+}
+
+// recordConfigRevision saves the content of cfg as the next revision when it differs from
+// previous and returns the version cfg is at afterwards. Content saved before revisions were
+// recorded is added first, so the first edit after the upgrade can still be reverted.
+func recordConfigRevision(ctx context.Context, tx *gorm.DB, cfg *model.RepoPipelineConfig, previous string, revision model.RepoPipelineConfigRevision, now int64) (int, error) {
+	if cfg.Content == previous {
+		return cfg.Version, nil
+	}
+	var latest int
+	if err := tx.WithContext(ctx).
+		Model(&model.RepoPipelineConfigRevision{}).
+		Where("repo_id = ?", cfg.RepoID).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&latest).Error; err != nil {
+		return 0, err
+	}
+	if latest == 0 && strings.TrimSpace(previous) != "" {
+		latest = 1
+		if err := tx.WithContext(ctx).Create(&model.RepoPipelineConfigRevision{
+			RepoID:      cfg.RepoID,
+			Version:     latest,
+			Content:     previous,
+			ContentHash: configSHA256(previous),
+			Message:     "启用版本记录前的配置",
+			Created:     now,
+		}).Error; err != nil {
+			return 0, err
+		}
+	}
+	revision.ID = 0
+	revision.RepoID = cfg.RepoID
+	revision.Version = latest + 1
+	revision.Content = cfg.Content
+	revision.ContentHash = configSHA256(cfg.Content)
+	revision.Created = now
+	if err := tx.WithContext(ctx).Create(&revision).Error; err != nil {
+		return 0, err
+	}
+	return revision.Version, nil
+}
+
+// applyBundleVariables sets the bundle variables of repoID within tx.
+func applyBundleVariables(ctx context.Context, tx *gorm.DB, repoID int64, variables []PipelineBundleVariable, now int64) error {
+	var existing []*model.RepoVariable
+	if err := tx.WithContext(ctx).Where("repo_id = ?", repoID).Find(&existing).Error; err != nil {
+		return err
+	}
+	stored := make(map[string]*model.RepoVariable, len(existing))
+	for _, variable := range existing {
+		stored[variable.Key] = variable
+	}
+	for _, item := range variables {
+		key := strings.TrimSpace(item.Key)
+		variable, ok := stored[key]
+		if !ok {
+			if item.Secret && item.Value == "" {
+				continue
+			}
+			variable = &model.RepoVariable{RepoID: repoID, Key: key, Value: item.Value, Secret: item.Secret, Created: now, Updated: now}
+			if err := tx.WithContext(ctx).Create(variable).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		updates := map[string]any{"secret": item.Secret, "updated": now}
+		if item.Value != "" || !item.Secret {
+			updates["value"] = item.Value
+		}
+		if err := tx.WithContext(ctx).Model(&model.RepoVariable{}).Where("id = ?", variable.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *gormPipelineStore) UpdateCronTriggers(ctx context.Context, repoID int64, triggered func(cfg *model.RepoPipelineConfig) map[string]int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		var cfg model.RepoPipelineConfig
+		err := tx.WithContext(ctx).Where("repo_id = ?", repoID).Take(&cfg).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).
+			Model(&model.RepoPipelineConfig{}).
+			Where("id = ?", cfg.ID).
+			Select("cron_last_triggered").
+			Updates(&model.RepoPipelineConfig{CronLastTriggered: triggered(&cfg)}).Error
+	})
+}
+
+func (st *gormPipelineStore) ListConfigRevisions(ctx context.Context, repoID int64, offset, limit int) ([]model.RepoPipelineConfigRevision, int64, error) {
+	var (
+		revisions []model.RepoPipelineConfigRevision
+		total     int64
+	)
+	err := st.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Model(&model.RepoPipelineConfigRevision{}).Where("repo_id = ?", repoID)
+		if err := query.Count(&total).Error; err != nil {
+			return err
+		}
+		return query.Order("version DESC").
+			Offset(offset).
+			Limit(limit).
+			Find(&revisions).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return revisions, total, nil
+}
+
+func (st *gormPipelineStore) GetConfigRevision(ctx context.Context, repoID, revisionID int64) (*model.RepoPipelineConfigRevision, error) {
+	var revision model.RepoPipelineConfigRevision
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("id = ? AND repo_id = ?", revisionID, repoID).
+			Take(&revision).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+func (st *gormPipelineStore) SetRepoActive(ctx context.Context, repoID int64, active bool) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Repo{}).
+			Where("id = ?", repoID).
+			Update("active", active).Error
+	})
+}
+
+func (st *gormPipelineStore) ListWorkspaceRepos(ctx context.Context) ([]*model.Repo, []*model.RepoPipelineConfig, error) {
+	var (
+		repos   []*model.Repo
+		configs []*model.RepoPipelineConfig
+	)
+	err := st.db.View(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).Select("id", "name", "full_name").Find(&repos).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Select("repo_id", "content", "retention_days").Find(&configs).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return repos, configs, nil
+}
+
+func (st *gormPipelineStore) ListRepos(ctx context.Context, repoIDs []int64) ([]*model.Repo, error) {
+	var repos []*model.Repo
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("id IN ?", repoIDs).Order("full_name ASC").Find(&repos).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+func (st *gormPipelineStore) ListRepoVariables(ctx context.Context, repoID int64) ([]*model.RepoVariable, error) {
+	var variables []*model.RepoVariable
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("repo_id = ?", repoID).Order("var_key ASC").Find(&variables).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+func (st *gormPipelineStore) ListKubernetesTargets(ctx context.Context, clusterID int64) ([]*model.KubernetesTarget, error) {
+	var targets []*model.KubernetesTarget
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("cluster_id = ?", clusterID).Find(&targets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+func (st *gormPipelineStore) ListEnvTemplates(ctx context.Context, scope model.EnvTemplateScope, repoID int64) ([]*model.EnvTemplate, error) {
+	var templates []*model.EnvTemplate
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("scope = ? AND repo_id = ?", scope, repoID).
+			Order("env_key ASC").
+			Find(&templates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func (st *gormPipelineStore) ListRunEnvTemplates(ctx context.Context, repoID int64) ([]*model.EnvTemplate, error) {
+	var templates []*model.EnvTemplate
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("scope = ? OR (scope = ? AND repo_id = ?)", model.EnvTemplateScopeGlobal, model.EnvTemplateScopeRepo, repoID).
+			Find(&templates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func (st *gormPipelineStore) SaveEnvTemplate(ctx context.Context, scope model.EnvTemplateScope, repoID int64, key string, value *string, masked bool) (*model.EnvTemplate, error) {
+	var template model.EnvTemplate
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().Unix()
+		err := tx.WithContext(ctx).
+			Where("scope = ? AND repo_id = ? AND env_key = ?", scope, repoID, key).
+			Take(&template).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if value == nil {
+				return err
+			}
+			template = model.EnvTemplate{Scope: scope, RepoID: repoID, Key: key, Value: *value, Masked: masked, Created: now, Updated: now}
+			return tx.WithContext(ctx).Create(&template).Error
+		case err != nil:
+			return err
+		}
+		updates := map[string]any{"masked": masked, "updated": now}
+		if value != nil {
+			updates["value"] = *value
+			template.Value = *value
+		}
+		template.Masked = masked
+		template.Updated = now
+		return tx.WithContext(ctx).Model(&template).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (st *gormPipelineStore) DeleteEnvTemplate(ctx context.Context, scope model.EnvTemplateScope, repoID int64, key string) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).
+			Where("scope = ? AND repo_id = ? AND env_key = ?", scope, repoID, key).
+			Delete(&model.EnvTemplate{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func (st *gormPipelineStore) ListPlugins(ctx context.Context) ([]*model.PluginDefinition, error) {
+	var plugins []*model.PluginDefinition
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Order("name ASC").Find(&plugins).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plugins, nil
+}
+
+func (st *gormPipelineStore) ListPluginsByName(ctx context.Context, names []string) ([]*model.PluginDefinition, error) {
+	var plugins []*model.PluginDefinition
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("name IN ?", names).Find(&plugins).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plugins, nil
+}
+
+func (st *gormPipelineStore) GetPlugin(ctx context.Context, id int64) (*model.PluginDefinition, error) {
+	var plugin model.PluginDefinition
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).First(&plugin, id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &plugin, nil
+}
+
+func (st *gormPipelineStore) CreatePlugin(ctx context.Context, plugin *model.PluginDefinition) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		if err := ensurePluginNameFree(ctx, tx, plugin.Name, 0); err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Create(plugin).Error
+	})
+}
+
+func (st *gormPipelineStore) UpdatePlugin(ctx context.Context, id int64, update func(plugin *model.PluginDefinition) error) (*model.PluginDefinition, error) {
+	var plugin model.PluginDefinition
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).First(&plugin, id).Error; err != nil {
+			return err
+		}
+		if err := update(&plugin); err != nil {
+			return err
+		}
+		if err := ensurePluginNameFree(ctx, tx, plugin.Name, plugin.ID); err != nil {
+			return err
+		}
+		// struct updates keep the json serializer for settings
+		return tx.WithContext(ctx).
+			Model(&plugin).
+			Select("name", "version", "image", "description", "settings", "updated").
+			Updates(&plugin).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &plugin, nil
+}
+
+func (st *gormPipelineStore) DeletePlugin(ctx context.Context, id int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Delete(&model.PluginDefinition{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func ensurePluginNameFree(ctx context.Context, tx *gorm.DB, name string, excludeID int64) error {
+	var count int64
+	if err := tx.WithContext(ctx).
+		Model(&model.PluginDefinition{}).
+		Where("name = ? AND id <> ?", name, excludeID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrPluginExists, name)
+	}
+	return nil
+}
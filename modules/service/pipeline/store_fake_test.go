@@ -0,0 +1,492 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// fakeStore keeps the records a pipeline run touches in memory. Methods the tests do not
+// reach are left to the embedded nil interface and panic, so a new dependency of the
+// orchestration shows up as a failing test rather than a silent no-op.
+type fakeStore struct {
+	pipelineStore
+
+	mu        sync.Mutex
+	repos     map[int64]*model.Repo
+	configs   map[int64]*model.RepoPipelineConfig
+	pipelines map[int64]*model.Pipeline
+	workflows map[int64]*model.Workflow
+	steps     map[int64]*model.Step
+	tasks     map[string]*model.Task
+	logs      []model.LogEntry
+	nextID    int64
+	// failures makes the named method fail with the error.
+	failures map[string]error
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		repos:     make(map[int64]*model.Repo),
+		configs:   make(map[int64]*model.RepoPipelineConfig),
+		pipelines: make(map[int64]*model.Pipeline),
+		workflows: make(map[int64]*model.Workflow),
+		steps:     make(map[int64]*model.Step),
+		tasks:     make(map[string]*model.Task),
+		failures:  make(map[string]error),
+	}
+}
+
+// failWith makes method fail with err from now on.
+func (f *fakeStore) failWith(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = err
+}
+
+func (f *fakeStore) failure(method string) error {
+	return f.failures[method]
+}
+
+func (f *fakeStore) pipeline(id int64) model.Pipeline {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.pipelines[id]
+}
+
+func (f *fakeStore) step(id int64) model.Step {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.steps[id]
+}
+
+func (f *fakeStore) hasTask(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.tasks[id]
+	return ok
+}
+
+// logText joins the log lines of a step.
+func (f *fakeStore) logText(stepID int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for _, entry := range f.logs {
+		if entry.StepID == stepID {
+			lines = append(lines, string(entry.Data))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// applyUpdates sets the fields of record whose gorm column is a key of updates.
+func applyUpdates(record any, updates map[string]any) {
+	value := reflect.ValueOf(record).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		column := ""
+		for _, part := range strings.Split(value.Type().Field(i).Tag.Get("gorm"), ";") {
+			if name, ok := strings.CutPrefix(part, "column:"); ok {
+				column = name
+			}
+		}
+		update, ok := updates[column]
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		if update == nil {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		field.Set(reflect.ValueOf(update).Convert(field.Type()))
+	}
+}
+
+// transition moves a record in state current to to, as transitionRecord does.
+func (f *fakeStore) transition(entity statusEntity, id int64, current *model.StatusValue, to model.StatusValue, record any, updates map[string]any) error {
+	if !slices.Contains(entity.sources(to), *current) {
+		return &IllegalTransitionError{Entity: entity.name, ID: id, From: *current, To: to}
+	}
+	applyUpdates(record, updates)
+	*current = to
+	return nil
+}
+
+func (f *fakeStore) GetRepo(_ context.Context, repoID int64) (*model.Repo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	repo, ok := f.repos[repoID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *repo
+	return &copied, nil
+}
+
+func (f *fakeStore) GetPipeline(_ context.Context, pipelineID int64) (*model.Pipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pipeline, ok := f.pipelines[pipelineID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *pipeline
+	return &copied, nil
+}
+
+func (f *fakeStore) GetPipelineStatus(_ context.Context, pipelineID int64) (model.StatusValue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pipeline, ok := f.pipelines[pipelineID]
+	if !ok {
+		return "", gorm.ErrRecordNotFound
+	}
+	return pipeline.Status, nil
+}
+
+func (f *fakeStore) PipelineNumbers(_ context.Context, pipelineIDs []int64) (map[int64]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	numbers := make(map[int64]int64, len(pipelineIDs))
+	for _, id := range pipelineIDs {
+		if pipeline, ok := f.pipelines[id]; ok {
+			numbers[id] = pipeline.Number
+		}
+	}
+	return numbers, nil
+}
+
+func (f *fakeStore) GetPipelineConfig(_ context.Context, repoID int64) (*model.RepoPipelineConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cfg, ok := f.configs[repoID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *cfg
+	return &copied, nil
+}
+
+func (f *fakeStore) UpdatePipeline(_ context.Context, pipelineID int64, updates map[string]any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	applyUpdates(f.pipelines[pipelineID], updates)
+	return nil
+}
+
+func (f *fakeStore) markPipeline(pipelineID int64, to model.StatusValue, updates map[string]any) error {
+	pipeline := f.pipelines[pipelineID]
+	return f.transition(pipelineStatusEntity, pipelineID, &pipeline.Status, to, pipeline, updates)
+}
+
+func (f *fakeStore) MarkPipelineRunning(_ context.Context, pipelineID int64, started int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("MarkPipelineRunning"); err != nil {
+		return err
+	}
+	return f.markPipeline(pipelineID, model.StatusRunning, map[string]any{"started": started})
+}
+
+func (f *fakeStore) MarkPipelineBlocked(_ context.Context, pipelineID int64, message string, updated int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.markPipeline(pipelineID, model.StatusBlocked, map[string]any{"message": message, "updated": updated})
+}
+
+func (f *fakeStore) MarkPipelineFinished(_ context.Context, pipelineID int64, status model.StatusValue, finished int64, message string, taskID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.markPipeline(pipelineID, status, map[string]any{"finished": finished}); err != nil {
+		return err
+	}
+	for _, workflow := range f.workflows {
+		if workflow.PipelineID == pipelineID && workflow.Running() {
+			workflow.State = status
+			workflow.Finished = finished
+		}
+	}
+	if taskID != "" {
+		delete(f.tasks, taskID)
+	}
+	return nil
+}
+
+func (f *fakeStore) KillPipeline(_ context.Context, pipelineID int64, message string, finished int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.markPipeline(pipelineID, model.StatusKilled, map[string]any{"finished": finished}); err != nil {
+		return err
+	}
+	for _, workflow := range f.workflows {
+		if workflow.PipelineID == pipelineID && workflow.Running() {
+			workflow.State = model.StatusKilled
+			workflow.Finished = finished
+		}
+	}
+	for _, step := range f.steps {
+		if step.PipelineID == pipelineID && (step.Running() || step.State == model.StatusBlocked) {
+			step.State = model.StatusKilled
+			step.Finished = finished
+		}
+	}
+	for id, task := range f.tasks {
+		if task.PipelineID == pipelineID {
+			delete(f.tasks, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) ResetPipeline(_ context.Context, pipelineID int64, updated int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.markPipeline(pipelineID, model.StatusPending, map[string]any{"updated": updated}); err != nil {
+		return err
+	}
+	for _, workflow := range f.workflows {
+		if workflow.PipelineID == pipelineID && slices.Contains(workflowTransitions[model.StatusPending], workflow.State) {
+			workflow.State = model.StatusPending
+		}
+	}
+	for _, step := range f.steps {
+		if step.PipelineID == pipelineID && slices.Contains(stepTransitions[model.StatusPending], step.State) {
+			step.State = model.StatusPending
+			step.Started = 0
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) ListPipelineWorkflows(_ context.Context, pipelineID int64) ([]model.Workflow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var workflows []model.Workflow
+	for _, workflow := range f.workflows {
+		if workflow.PipelineID == pipelineID {
+			workflows = append(workflows, *workflow)
+		}
+	}
+	slices.SortFunc(workflows, func(a, b model.Workflow) int { return a.PID - b.PID })
+	return workflows, nil
+}
+
+func (f *fakeStore) TransitionWorkflow(_ context.Context, workflowID int64, to model.StatusValue, updates map[string]any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	workflow := f.workflows[workflowID]
+	return f.transition(workflowStatusEntity, workflowID, &workflow.State, to, workflow, updates)
+}
+
+func (f *fakeStore) ListPipelineSteps(_ context.Context, pipelineID int64) ([]model.Step, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var steps []model.Step
+	for _, step := range f.steps {
+		if step.PipelineID == pipelineID {
+			steps = append(steps, *step)
+		}
+	}
+	slices.SortFunc(steps, func(a, b model.Step) int { return a.PID - b.PID })
+	return steps, nil
+}
+
+func (f *fakeStore) GetStep(_ context.Context, stepID int64) (*model.Step, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	step, ok := f.steps[stepID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *step
+	return &copied, nil
+}
+
+func (f *fakeStore) TransitionStep(_ context.Context, stepID int64, to model.StatusValue, updates map[string]any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("TransitionStep"); err != nil {
+		return err
+	}
+	step := f.steps[stepID]
+	return f.transition(stepStatusEntity, stepID, &step.State, to, step, updates)
+}
+
+func (f *fakeStore) UpdateStep(_ context.Context, stepID int64, updates map[string]any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	applyUpdates(f.steps[stepID], updates)
+	return nil
+}
+
+func (f *fakeStore) AppendLog(_ context.Context, entry *model.LogEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("AppendLog"); err != nil {
+		return err
+	}
+	f.nextID++
+	entry.ID = f.nextID
+	f.logs = append(f.logs, *entry)
+	return nil
+}
+
+func (f *fakeStore) MaxLogLine(_ context.Context, stepID int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	maxLine := 0
+	for _, entry := range f.logs {
+		if entry.StepID == stepID && entry.Line > maxLine {
+			maxLine = entry.Line
+		}
+	}
+	return maxLine, nil
+}
+
+func (f *fakeStore) UpdateStepStatistic(_ context.Context, _ int64, _ string, update func(*model.StepStatistic)) error {
+	update(&model.StepStatistic{})
+	return nil
+}
+
+func (f *fakeStore) SavePipelineProvenance(context.Context, *model.PipelineProvenance) error {
+	return nil
+}
+
+func (f *fakeStore) FindPipelineTask(_ context.Context, pipelineID int64) (*model.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, task := range f.tasks {
+		if task.PipelineID == pipelineID {
+			copied := *task
+			return &copied, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (f *fakeStore) ListRecoverableTasks(context.Context) ([]*model.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tasks []*model.Task
+	for _, task := range f.tasks {
+		if pipeline, ok := f.pipelines[task.PipelineID]; ok &&
+			(pipeline.Status == model.StatusPending || pipeline.Status == model.StatusRunning) {
+			copied := *task
+			tasks = append(tasks, &copied)
+		}
+	}
+	slices.SortFunc(tasks, func(a, b *model.Task) int {
+		return int(a.PipelineID - b.PipelineID)
+	})
+	return tasks, nil
+}
+
+func (f *fakeStore) DeleteTask(_ context.Context, taskID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tasks, taskID)
+	return nil
+}
+
+func (f *fakeStore) ListPipelineConfigs(context.Context, ...string) ([]*model.RepoPipelineConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	configs := make([]*model.RepoPipelineConfig, 0, len(f.configs))
+	for _, cfg := range f.configs {
+		copied := *cfg
+		configs = append(configs, &copied)
+	}
+	slices.SortFunc(configs, func(a, b *model.RepoPipelineConfig) int {
+		return int(a.RepoID - b.RepoID)
+	})
+	return configs, nil
+}
+
+// PurgeLogs selects the lines the gorm store does: older than cutoff, of steps of finished
+// runs of repoID that ended before cutoff, skipping purge markers.
+func (f *fakeStore) PurgeLogs(_ context.Context, repoID, cutoff int64, days, limit int) (int, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("PurgeLogs"); err != nil {
+		return 0, 0, err
+	}
+	expired := func(entry model.LogEntry) bool {
+		if entry.Created >= cutoff || entry.Line == logPurgedLine {
+			return false
+		}
+		step, ok := f.steps[entry.StepID]
+		if !ok {
+			return false
+		}
+		pipeline, ok := f.pipelines[step.PipelineID]
+		return ok && pipeline.RepoID == repoID && pipeline.Finished < cutoff &&
+			slices.Contains(logRetentionStatuses, pipeline.Status)
+	}
+	kept := f.logs[:0]
+	var purged []int64
+	matched := 0
+	for _, entry := range f.logs {
+		if matched < limit && expired(entry) {
+			matched++
+			if !slices.Contains(purged, entry.StepID) {
+				purged = append(purged, entry.StepID)
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	f.logs = kept
+	now := time.Now().Unix()
+	for _, stepID := range purged {
+		if slices.ContainsFunc(f.logs, func(entry model.LogEntry) bool {
+			return entry.StepID == stepID && entry.Line == logPurgedLine
+		}) {
+			continue
+		}
+		f.nextID++
+		f.logs = append(f.logs, model.LogEntry{
+			ID: f.nextID, StepID: stepID, Time: now, Line: logPurgedLine, Created: now,
+			Data: []byte(fmt.Sprintf(logPurgedMarker, days, days)), Type: model.LogEntryMetadata,
+		})
+	}
+	return matched, int64(matched), nil
+}
+
+func (f *fakeStore) ListRunEnvTemplates(context.Context, int64) ([]*model.EnvTemplate, error) {
+	return nil, nil
+}
+
+func (f *fakeStore) ListRepoVariables(context.Context, int64) ([]*model.RepoVariable, error) {
+	return nil, nil
+}
+
+func (f *fakeStore) ListNotificationTargets(context.Context, int64) ([]*model.NotificationTarget, error) {
+	return nil, nil
+}
+
+func (f *fakeStore) ListVisibleApproverGroups(context.Context, int64) ([]*model.ApproverGroup, error) {
+	return nil, nil
+}
+
+// String lists the records for test failure messages.
+func (f *fakeStore) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var b strings.Builder
+	for _, pipeline := range f.pipelines {
+		fmt.Fprintf(&b, "pipeline %d: %s %q\n", pipeline.ID, pipeline.Status, pipeline.Message)
+	}
+	for _, step := range f.steps {
+		fmt.Fprintf(&b, "step %d %s: %s %q\n", step.ID, step.Name, step.State, step.Error)
+	}
+	return b.String()
+}
@@ -0,0 +1,48 @@
+//go:build mysql
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/model"
+)
+
+// TestCreatePipelineGraphNumbersConcurrentRunsMySQL runs the concurrent numbering check
+// against the MySQL database in DEVSYS_TEST_MYSQL_DSN, where the repository row lock is real:
+//
+//	DEVSYS_TEST_MYSQL_DSN='root:secret@tcp(127.0.0.1:3306)/devsys_test?parseTime=true' \
+//		go test -tags mysql -run MySQL ./service/pipeline/
+func TestCreatePipelineGraphNumbersConcurrentRunsMySQL(t *testing.T) {
+	dsn := os.Getenv("DEVSYS_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("DEVSYS_TEST_MYSQL_DSN not set")
+	}
+	db, err := store.Connect(dsn, concurrentRuns+10, false)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	conn := db.GetDB()
+	if err := conn.AutoMigrate(&model.Repo{}, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.Task{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	// a repository of its own keeps runs against a shared database apart
+	name := fmt.Sprintf("numbering-%d", time.Now().UnixNano())
+	repo := &model.Repo{ForgeRemoteID: model.ForgeRemoteID("manual-" + name), Owner: "team", Name: name, FullName: "team/" + name, Hash: name}
+	if err := conn.Create(repo).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Where("pipeline_id IN (?)", conn.Model(&model.Pipeline{}).Select("id").Where("repo_id = ?", repo.ID)).Delete(&model.Workflow{})
+		conn.Where("repo_id = ?", repo.ID).Delete(&model.Pipeline{})
+		conn.Delete(repo)
+	})
+
+	checkConcurrentPipelineNumbers(t, db, repo.ID)
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (st *gormPipelineStore) ListNotificationTargets(ctx context.Context, repoID int64) ([]*model.NotificationTarget, error) {
+	var targets []*model.NotificationTarget
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Order("id ASC").
+			Find(&targets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+func (st *gormPipelineStore) GetNotificationTarget(ctx context.Context, repoID, id int64) (*model.NotificationTarget, error) {
+	var target model.NotificationTarget
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("repo_id = ?", repoID).First(&target, id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+func (st *gormPipelineStore) CreateNotificationTarget(ctx context.Context, target *model.NotificationTarget) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Create(target).Error
+	})
+}
+
+func (st *gormPipelineStore) UpdateNotificationTarget(ctx context.Context, repoID, id int64, update func(target *model.NotificationTarget) error) (*model.NotificationTarget, error) {
+	var target model.NotificationTarget
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).Where("repo_id = ?", repoID).First(&target, id).Error; err != nil {
+			return err
+		}
+		if err := update(&target); err != nil {
+			return err
+		}
+		// struct updates keep the json serializer for events
+		return tx.WithContext(ctx).
+			Model(&target).
+			Select("name", "type", "url", "secret", "events", "enabled", "updated").
+			Updates(&target).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+func (st *gormPipelineStore) DeleteNotificationTarget(ctx context.Context, repoID, id int64) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("repo_id = ?", repoID).Delete(&model.NotificationTarget{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func (st *gormPipelineStore) CreateNotificationAttempt(ctx context.Context, attempt *model.NotificationAttempt) error {
+	return st.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Create(attempt).Error
+	})
+}
+
+func (st *gormPipelineStore) ListNotificationAttempts(ctx context.Context, repoID int64, limit int) ([]*model.NotificationAttempt, error) {
+	var attempts []*model.NotificationAttempt
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Order("id DESC").
+			Limit(limit).
+			Find(&attempts).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
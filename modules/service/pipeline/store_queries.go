@@ -0,0 +1,641 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+func (st *gormPipelineStore) ListPipelines(ctx context.Context, repoID int64, filter model.PipelineFilter, offset, limit int) ([]*model.Pipeline, int64, error) {
+	var (
+		pipelines []*model.Pipeline
+		total     int64
+	)
+	err := st.db.View(func(tx *gorm.DB) error {
+		query := filterPipelines(tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("repo_id = ?", repoID), filter)
+		if err := query.Count(&total).Error; err != nil {
+			return err
+		}
+		return query.
+			Order("created DESC, id DESC").
+			Offset(offset).
+			Limit(limit).
+			Find(&pipelines).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return pipelines, total, nil
+}
+
+// filterPipelines adds the conditions of filter to query.
+func filterPipelines(query *gorm.DB, filter model.PipelineFilter) *gorm.DB {
+	if len(filter.Statuses) > 0 {
+		query = query.Where("status IN ?", filter.Statuses)
+	}
+	if branch := strings.TrimSpace(filter.Branch); branch != "" {
+		query = query.Where("branch = ?", branch)
+	}
+	if len(filter.Events) > 0 {
+		query = query.Where("event IN ?", filter.Events)
+	}
+	if author := strings.TrimSpace(filter.Author); author != "" {
+		query = query.Where("author = ?", author)
+	}
+	if filter.After > 0 {
+		query = query.Where("created >= ?", filter.After)
+	}
+	if filter.Before > 0 {
+		query = query.Where("created <= ?", filter.Before)
+	}
+	if search := strings.TrimSpace(filter.Search); search != "" {
+		escaped := likeEscaper.Replace(search)
+		query = query.Where("(message LIKE ? OR `commit` LIKE ?)", "%"+escaped+"%", escaped+"%")
+	}
+	return query
+}
+
+// likeEscaper escapes the LIKE wildcards of user input.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (st *gormPipelineStore) ListUnfinishedPipelineIDs(ctx context.Context, repoID int64) ([]int64, error) {
+	var ids []int64
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Pipeline{}).
+			Where("repo_id = ? AND status IN ?", repoID, unfinishedPipelineStatuses).
+			Pluck("id", &ids).Error
+	})
+	return ids, err
+}
+
+func (st *gormPipelineStore) PipelineNumbers(ctx context.Context, pipelineIDs []int64) (map[int64]int64, error) {
+	var rows []model.Pipeline
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Select("id", "number").Where("id IN ?", pipelineIDs).Find(&rows).Error
+	})
+	numbers := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		numbers[row.ID] = row.Number
+	}
+	return numbers, err
+}
+
+func (st *gormPipelineStore) GetPipelineRunDetail(ctx context.Context, repoID, pipelineID int64, tail int) (*PipelineRunDetail, error) {
+	detail := &PipelineRunDetail{
+		Workflows: []*model.Workflow{},
+		Steps:     []*model.Step{},
+		Logs:      map[int64][]model.LogEntry{},
+		LogTotals: map[int64]int64{},
+	}
+	err := st.db.View(func(tx *gorm.DB) error {
+		var pipeline model.Pipeline
+		if err := tx.WithContext(ctx).
+			Where("id = ? AND repo_id = ?", pipelineID, repoID).
+			Take(&pipeline).Error; err != nil {
+			return err
+		}
+		detail.Pipeline = &pipeline
+
+		var workflows []*model.Workflow
+		if err := tx.WithContext(ctx).
+			Where("pipeline_id = ?", pipelineID).
+			Order("pid ASC").
+			Find(&workflows).Error; err != nil {
+			return err
+		}
+		detail.Workflows = workflows
+
+		var steps []*model.Step
+		if err := tx.WithContext(ctx).
+			Where("pipeline_id = ?", pipelineID).
+			Order("pid ASC").
+			Find(&steps).Error; err != nil {
+			return err
+		}
+		detail.Steps = steps
+		nestWorkflowSteps(workflows, steps)
+
+		if len(steps) == 0 {
+			return nil
+		}
+
+		stepIDs := make([]int64, 0, len(steps))
+		for _, step := range steps {
+			stepIDs = append(stepIDs, step.ID)
+		}
+
+		return loadLogTails(ctx, tx, stepIDs, tail, detail)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// loadLogTails fills detail with the last tail lines of each step and the line count of
+// every step.
+func loadLogTails(ctx context.Context, tx *gorm.DB, stepIDs []int64, tail int, detail *PipelineRunDetail) error {
+	var counts []struct {
+		StepID int64
+		Total  int64
+	}
+	if err := tx.WithContext(ctx).
+		Model(&model.LogEntry{}).
+		Select("step_id, COUNT(*) AS total").
+		Where("step_id IN ?", stepIDs).
+		Group("step_id").
+		Scan(&counts).Error; err != nil {
+		return err
+	}
+
+	var whole []int64
+	for _, count := range counts {
+		detail.LogTotals[count.StepID] = count.Total
+		if count.Total <= int64(tail) {
+			whole = append(whole, count.StepID)
+			continue
+		}
+		var entries []model.LogEntry
+		if err := tx.WithContext(ctx).
+			Where("step_id = ?", count.StepID).
+			Order("line DESC, id DESC").
+			Limit(tail).
+			Find(&entries).Error; err != nil {
+			return err
+		}
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		detail.Logs[count.StepID] = entries
+	}
+	if len(whole) == 0 {
+		return nil
+	}
+
+	var logs []model.LogEntry
+	if err := tx.WithContext(ctx).
+		Where("step_id IN ?", whole).
+		Order("step_id ASC, line ASC, created ASC, id ASC").
+		Find(&logs).Error; err != nil {
+		return err
+	}
+	for _, entry := range logs {
+		detail.Logs[entry.StepID] = append(detail.Logs[entry.StepID], entry)
+	}
+	return nil
+}
+
+func (st *gormPipelineStore) ListPipelinesSteps(ctx context.Context, pipelineIDs []int64) ([]*model.Step, error) {
+	var steps []*model.Step
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("pipeline_id IN ?", pipelineIDs).Find(&steps).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func (st *gormPipelineStore) PreviousBuildStep(ctx context.Context, repoID, pipelineID int64, stepName string) (*model.Step, error) {
+	var step model.Step
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Select("steps.*").
+			Joins("JOIN pipelines ON pipelines.id = steps.pipeline_id").
+			Where("pipelines.repo_id = ? AND steps.pipeline_id < ? AND steps.name = ? AND steps.type = ? AND steps.state = ?",
+				repoID, pipelineID, stepName, model.StepTypeBuild, model.StatusSuccess).
+			Order("steps.id DESC").
+			Take(&step).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &step, nil
+}
+
+func (st *gormPipelineStore) FindRunStep(ctx context.Context, repoID, pipelineID, stepID int64) error {
+	return st.db.View(func(tx *gorm.DB) error {
+		return findRunStep(ctx, tx, repoID, pipelineID, stepID)
+	})
+}
+
+func (st *gormPipelineStore) ListStepLog(ctx context.Context, stepID int64, offset, limit int) ([]model.LogEntry, int64, error) {
+	var (
+		entries []model.LogEntry
+		total   int64
+	)
+	err := st.db.View(func(tx *gorm.DB) error {
+		query := tx.WithContext(ctx).Model(&model.LogEntry{}).Where("step_id = ?", stepID)
+		if err := query.Count(&total).Error; err != nil {
+			return err
+		}
+		return query.
+			Order("line ASC, id ASC").
+			Offset(offset).
+			Limit(limit).
+			Find(&entries).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+func (st *gormPipelineStore) ListStepLogAfter(ctx context.Context, stepID int64, afterLine int, afterID int64, limit int) ([]model.LogEntry, error) {
+	var entries []model.LogEntry
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("step_id = ? AND (line > ? OR (line = ? AND id > ?))", stepID, afterLine, afterLine, afterID).
+			Order("line ASC, id ASC").
+			Limit(limit).
+			Find(&entries).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// findRunStep returns ErrStepNotFound unless stepID is a step of pipelineID in repoID.
+func findRunStep(ctx context.Context, tx *gorm.DB, repoID, pipelineID, stepID int64) error {
+	var count int64
+	if err := tx.WithContext(ctx).
+		Model(&model.Step{}).
+		Joins("JOIN pipelines ON pipelines.id = steps.pipeline_id").
+		Where("steps.id = ? AND steps.pipeline_id = ? AND pipelines.repo_id = ?", stepID, pipelineID, repoID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrStepNotFound
+	}
+	return nil
+}
+
+func (st *gormPipelineStore) PurgeLogs(ctx context.Context, repoID, cutoff int64, days, limit int) (int, int64, error) {
+	var batch []struct {
+		ID     int64
+		StepID int64
+	}
+	if err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Table("log_entries").
+			Select("log_entries.id, log_entries.step_id").
+			Joins("JOIN steps ON steps.id = log_entries.step_id").
+			Joins("JOIN pipelines ON pipelines.id = steps.pipeline_id").
+			Where("pipelines.repo_id = ? AND pipelines.status IN ? AND pipelines.finished < ?", repoID, logRetentionStatuses, cutoff).
+			Where("log_entries.created < ? AND log_entries.line <> ?", cutoff, logPurgedLine).
+			Limit(limit).
+			Scan(&batch).Error
+	}); err != nil {
+		return 0, 0, err
+	}
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	ids := make([]int64, 0, len(batch))
+	var stepIDs []int64
+	seen := make(map[int64]struct{})
+	for _, row := range batch {
+		ids = append(ids, row.ID)
+		if _, ok := seen[row.StepID]; !ok {
+			seen[row.StepID] = struct{}{}
+			stepIDs = append(stepIDs, row.StepID)
+		}
+	}
+	var deleted int64
+	err := st.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("id IN ?", ids).Delete(&model.LogEntry{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return markLogsPurged(ctx, tx, stepIDs, days)
+	})
+	if err != nil {
+		return len(batch), 0, err
+	}
+	return len(batch), deleted, nil
+}
+
+// markLogsPurged adds the purge marker to the steps that do not have it yet.
+func markLogsPurged(ctx context.Context, tx *gorm.DB, stepIDs []int64, days int) error {
+	var marked []int64
+	if err := tx.WithContext(ctx).
+		Model(&model.LogEntry{}).
+		Where("step_id IN ? AND line = ?", stepIDs, logPurgedLine).
+		Pluck("step_id", &marked).Error; err != nil {
+		return err
+	}
+	done := make(map[int64]struct{}, len(marked))
+	for _, id := range marked {
+		done[id] = struct{}{}
+	}
+	now := time.Now().Unix()
+	var markers []*model.LogEntry
+	for _, id := range stepIDs {
+		if _, ok := done[id]; ok {
+			continue
+		}
+		markers = append(markers, &model.LogEntry{
+			StepID:  id,
+			Time:    now,
+			Line:    logPurgedLine,
+			Data:    []byte(fmt.Sprintf(logPurgedMarker, days, days)),
+			Created: now,
+			Type:    model.LogEntryMetadata,
+		})
+	}
+	if len(markers) == 0 {
+		return nil
+	}
+	return tx.WithContext(ctx).Create(&markers).Error
+}
+
+func (st *gormPipelineStore) CollectPipelineStats(ctx context.Context, repoID int64, stats *PipelineStats) error {
+	return st.db.View(func(tx *gorm.DB) error {
+		tx = tx.WithContext(ctx)
+		scope := pipelineStatsScope(repoID, stats.Since, stats.Until, stats.Branch)
+		if err := collectStepStats(tx, scope, stats.Step, stats); err != nil {
+			return err
+		}
+		if err := collectGroupStats(tx, scope, stats.Step, stats); err != nil {
+			return err
+		}
+		return collectDailyStats(tx, scope, stats.Step, stats)
+	})
+}
+
+// pipelineStatsScope restricts a query joined on pipelines p to the window.
+func pipelineStatsScope(repoID, since, until int64, branch string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Where("p.repo_id = ? AND p.created >= ? AND p.created < ?", repoID, since, until)
+		if branch != "" {
+			db = db.Where("p.branch = ?", branch)
+		}
+		return db
+	}
+}
+
+// outcomeSource returns the table and the status column outcomes are counted on: the
+// pipelines themselves, or the runs of step joined with their pipelines.
+func outcomeSource(tx *gorm.DB, step string) (*gorm.DB, string) {
+	if step == "" {
+		return tx.Table("pipelines AS p"), "p.status"
+	}
+	return tx.Table("steps AS s").
+		Joins("JOIN pipelines AS p ON p.id = s.pipeline_id").
+		Where("s.name = ?", step), "s.state"
+}
+
+func outcomeColumns(column string) string {
+	return "SUM(CASE WHEN " + column + " = ? THEN 1 ELSE 0 END) AS success, " +
+		"SUM(CASE WHEN " + column + " IN ? THEN 1 ELSE 0 END) AS failure"
+}
+
+func collectStepStats(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, step string, stats *PipelineStats) error {
+	var rows []struct {
+		StepName    string
+		Total       int64
+		Success     int64
+		Failure     int64
+		AvgDuration float64
+		Samples     int64
+	}
+	query := tx.Table("steps AS s").
+		Joins("JOIN pipelines AS p ON p.id = s.pipeline_id").
+		Scopes(scope).
+		Where("s.type <> ?", model.StepTypeApproval).
+		Where("s.state IN ?", append([]model.StatusValue{model.StatusSuccess}, failedStatuses...))
+	if step != "" {
+		query = query.Where("s.name = ?", step)
+	}
+	err := query.Select("s.name AS step_name, COUNT(*) AS total, "+outcomeColumns("s.state")+", "+
+		"COALESCE(AVG(CASE WHEN s.state = ? AND s.started > 0 AND s.finished >= s.started THEN s.finished - s.started END), 0) AS avg_duration, "+
+		"SUM(CASE WHEN s.state = ? AND s.started > 0 AND s.finished >= s.started THEN 1 ELSE 0 END) AS samples",
+		model.StatusSuccess, failedStatuses, model.StatusSuccess, model.StatusSuccess).
+		Group("s.name").
+		Order("total DESC, step_name ASC").
+		Limit(maxPipelineStatsSteps + 1).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	if len(rows) > maxPipelineStatsSteps {
+		rows = rows[:maxPipelineStatsSteps]
+		stats.Truncated = true
+	}
+
+	byName := make(map[string]*StepStats, len(rows))
+	for _, row := range rows {
+		item := &StepStats{
+			StepName:    row.StepName,
+			Total:       row.Total,
+			Success:     row.Success,
+			Failure:     row.Failure,
+			AvgDuration: row.AvgDuration,
+		}
+		if finished := row.Success + row.Failure; finished > 0 {
+			item.SuccessRate = float64(row.Success) / float64(finished)
+		}
+		if item.P50Duration, err = stepDurationAt(tx, scope, row.StepName, row.Samples, 50); err != nil {
+			return err
+		}
+		if item.P90Duration, err = stepDurationAt(tx, scope, row.StepName, row.Samples, 90); err != nil {
+			return err
+		}
+		byName[row.StepName] = item
+		stats.Steps = append(stats.Steps, item)
+	}
+	if len(byName) == 0 {
+		return nil
+	}
+	return collectFailureStreaks(tx, scope, byName)
+}
+
+// stepDurationAt returns the nearest-rank percentile p of the successful durations of a step,
+// reading a single row.
+func stepDurationAt(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, name string, samples int64, p int64) (int64, error) {
+	if samples <= 0 {
+		return 0, nil
+	}
+	rank := (p*samples + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	var durations []int64
+	err := tx.Table("steps AS s").
+		Joins("JOIN pipelines AS p ON p.id = s.pipeline_id").
+		Scopes(scope).
+		Where("s.name = ? AND s.type <> ? AND s.state = ? AND s.started > 0 AND s.finished >= s.started",
+			name, model.StepTypeApproval, model.StatusSuccess).
+		Order("s.finished - s.started ASC").
+		Offset(int(rank-1)).
+		Limit(1).
+		Pluck("s.finished - s.started", &durations).Error
+	if err != nil || len(durations) == 0 {
+		return 0, err
+	}
+	return durations[0], nil
+}
+
+// collectFailureStreaks walks the outcomes of the reported steps in run order. Rows are
+// streamed, so only one counter pair per step is held.
+func collectFailureStreaks(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, byName map[string]*StepStats) error {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	rows, err := tx.Table("steps AS s").
+		Joins("JOIN pipelines AS p ON p.id = s.pipeline_id").
+		Scopes(scope).
+		Where("s.name IN ? AND s.type <> ?", names, model.StepTypeApproval).
+		Where("s.state IN ?", append([]model.StatusValue{model.StatusSuccess}, failedStatuses...)).
+		Order("p.number ASC, s.id ASC").
+		Select("s.name, s.state").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var state model.StatusValue
+		if err := rows.Scan(&name, &state); err != nil {
+			return err
+		}
+		item := byName[name]
+		if item == nil {
+			continue
+		}
+		if state == model.StatusSuccess {
+			item.CurrentFailureStreak = 0
+			continue
+		}
+		item.CurrentFailureStreak++
+		if item.CurrentFailureStreak > item.LongestFailureStreak {
+			item.LongestFailureStreak = item.CurrentFailureStreak
+		}
+	}
+	return rows.Err()
+}
+
+func collectGroupStats(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, step string, stats *PipelineStats) error {
+	source, column := outcomeSource(tx, step)
+	var groups []*PipelineStatsGroup
+	err := source.Scopes(scope).
+		Select("p.branch AS branch, p.event AS event, COUNT(*) AS total, "+outcomeColumns(column),
+			model.StatusSuccess, failedStatuses).
+		Group("p.branch, p.event").
+		Order("total DESC, branch ASC, event ASC").
+		Limit(maxPipelineStatsGroups + 1).
+		Scan(&groups).Error
+	if err != nil {
+		return err
+	}
+	if len(groups) > maxPipelineStatsGroups {
+		groups = groups[:maxPipelineStatsGroups]
+		stats.Truncated = true
+	}
+	stats.Groups = append(stats.Groups, groups...)
+	return nil
+}
+
+// collectDailyStats counts outcomes per UTC day; days without finished runs are left out.
+func collectDailyStats(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB, step string, stats *PipelineStats) error {
+	source, column := outcomeSource(tx, step)
+	var days []*PipelineStatsDay
+	err := source.Scopes(scope).
+		Select("FLOOR(p.created / ?) * ? AS day, "+outcomeColumns(column),
+			secondsPerDay, secondsPerDay, model.StatusSuccess, failedStatuses).
+		Group("day").
+		Having("success + failure > 0").
+		Order("day ASC").
+		Scan(&days).Error
+	if err != nil {
+		return err
+	}
+	stats.Daily = append(stats.Daily, days...)
+	return nil
+}
+
+func (st *gormPipelineStore) ListStepStatistics(ctx context.Context, repoID int64) ([]*model.StepStatistic, error) {
+	var stats []*model.StepStatistic
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Order("step_name ASC").
+			Find(&stats).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (st *gormPipelineStore) ListArtifacts(ctx context.Context, repoID, pipelineID int64) ([]*model.Artifact, error) {
+	var artifacts []*model.Artifact
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN pipelines ON pipelines.id = artifacts.pipeline_id").
+			Where("artifacts.pipeline_id = ? AND pipelines.repo_id = ?", pipelineID, repoID).
+			Order("artifacts.step_id ASC, artifacts.path ASC").
+			Find(&artifacts).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+func (st *gormPipelineStore) GetArtifact(ctx context.Context, repoID, pipelineID, artifactID int64) (*model.Artifact, error) {
+	var artifact model.Artifact
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN pipelines ON pipelines.id = artifacts.pipeline_id").
+			Where("artifacts.id = ? AND artifacts.pipeline_id = ? AND pipelines.repo_id = ?", artifactID, pipelineID, repoID).
+			Take(&artifact).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+func (st *gormPipelineStore) GetPipelineProvenance(ctx context.Context, repoID, pipelineID int64) (*model.PipelineProvenance, error) {
+	var record model.PipelineProvenance
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN pipelines ON pipelines.id = pipeline_provenances.pipeline_id").
+			Where("pipeline_provenances.pipeline_id = ? AND pipelines.repo_id = ?", pipelineID, repoID).
+			Take(&record).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (st *gormPipelineStore) GetPipelineSnapshot(ctx context.Context, repoID, pipelineID int64) (*model.PipelineSnapshot, error) {
+	var snapshot model.PipelineSnapshot
+	err := st.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN pipelines ON pipelines.id = pipeline_snapshots.pipeline_id").
+			Where("pipeline_snapshots.pipeline_id = ? AND pipelines.repo_id = ?", pipelineID, repoID).
+			Take(&snapshot).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// concurrentRuns is how many pipelines of one repository are created at the same time.
+const concurrentRuns = 50
+
+// checkConcurrentPipelineNumbers creates concurrentRuns pipelines of repoID in parallel and
+// checks they are numbered 1 to concurrentRuns, each number once.
+func checkConcurrentPipelineNumbers(t *testing.T, db *store.DB, repoID int64) {
+	t.Helper()
+	st := newGormPipelineStore(db)
+
+	numbers := make([]int64, concurrentRuns)
+	errs := make([]error, concurrentRuns)
+	var wg sync.WaitGroup
+	for i := range concurrentRuns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pipeline := &model.Pipeline{RepoID: repoID, Status: model.StatusPending, Branch: "main"}
+			workflow := &model.Workflow{PID: 1, Name: "build", State: model.StatusPending}
+			errs[i] = st.CreatePipelineGraph(context.Background(), pipeline, []*model.Workflow{workflow}, nil, nil)
+			numbers[i] = pipeline.Number
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+	slices.Sort(numbers)
+	for i, number := range numbers {
+		if number != int64(i+1) {
+			t.Fatalf("numbers = %v, want 1 to %d without duplicates or gaps", numbers, concurrentRuns)
+		}
+	}
+	var stored []int64
+	if err := db.GetDB().Model(&model.Pipeline{}).Where("repo_id = ?", repoID).Order("number").Pluck("number", &stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored, numbers) {
+		t.Errorf("stored numbers = %v, want %v", stored, numbers)
+	}
+}
+
+func TestCreatePipelineGraphNumbersConcurrentRuns(t *testing.T) {
+	db := storetest.Open(t, &model.Repo{}, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.Task{})
+	if err := db.GetDB().Create(&model.Repo{ID: 1, ForgeRemoteID: "manual-1", Owner: "team", Name: "app", FullName: "team/app"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	checkConcurrentPipelineNumbers(t, db, 1)
+}
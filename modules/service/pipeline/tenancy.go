@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+// WithTenancy scopes certificate and approver group resolution of pipelines to the
+// organization of their repository.
+func WithTenancy(enabled bool) Option {
+	return func(s *Service) {
+		s.tenancy = enabled
+	}
+}
+
+// repoScope restricts ctx to the organization of repo whoever the caller is, so a pipeline
+// never resolves another organization's certificate or group, even when names collide.
+func (s *Service) repoScope(ctx context.Context, repo *model.Repo) context.Context {
+	if !s.tenancy || repo == nil {
+		return ctx
+	}
+	return tenancy.WithScope(ctx, tenancy.Orgs(repo.OrgID))
+}
+
+// repoScopeByID is repoScope for callers that only know the repository id. A missing
+// repository sees no organization.
+func (s *Service) repoScopeByID(ctx context.Context, repoID int64) (context.Context, error) {
+	if !s.tenancy {
+		return ctx, nil
+	}
+	repo, err := s.fetchRepo(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return tenancy.WithScope(ctx, tenancy.Orgs()), nil
+	}
+	return s.repoScope(ctx, repo), nil
+}
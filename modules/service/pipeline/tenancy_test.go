@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+	systemsvc "github.com/thepenn/devsys/service/system"
+)
+
+// newTenantService returns a multi-tenant service whose organizations payments (1) and
+// logistics (2) both own a docker certificate named "registry", repositories 1 and 2 of those
+// organizations and repository 3 of organization 3, which has none. The certificate ids are
+// returned by organization.
+func newTenantService(t *testing.T) (*Service, map[int64]int64) {
+	t.Helper()
+	db := storetest.Open(t, &model.ServerConfig{}, &model.Organization{}, &model.Certificate{}, &model.Secret{},
+		&model.Repo{}, &model.RepoPipelineConfig{})
+	system, err := systemsvc.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]int64)
+	for id, name := range map[int64]string{1: "payments", 2: "logistics", 3: "empty"} {
+		mustCreate(t, db.GetDB(), &model.Organization{ID: id, Name: name})
+		mustCreate(t, db.GetDB(), &model.Repo{ID: id, OrgID: id, ForgeRemoteID: model.ForgeRemoteID(name), Owner: name, Name: "app", FullName: name + "/app"})
+		if id == 3 {
+			continue
+		}
+		cert, err := system.CreateCertificate(tenancy.WithScope(context.Background(), tenancy.Orgs(id)), &model.Certificate{
+			Name:   "registry",
+			Type:   "docker",
+			Config: map[string]interface{}{"username": name, "password": name + "-password", "repo": "registry.example/" + name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = cert.ID
+	}
+	return NewService(db, nil, nil, WithSystemService(system), WithTenancy(true)), ids
+}
+
+func TestSecretAliasResolvesWithinRepoOrganization(t *testing.T) {
+	svc, ids := newTenantService(t)
+
+	for _, org := range []struct {
+		id   int64
+		name string
+	}{{1, "payments"}, {2, "logistics"}} {
+		repo := &model.Repo{ID: org.id, OrgID: org.id}
+		env, _, _, bindings := svc.buildSecretEnv(context.Background(), repo, nil, map[string]string{"registry": "registry"})
+		binding, ok := bindings["registry"]
+		if !ok || binding.CertificateID != ids[org.id] {
+			t.Fatalf("repo of %s resolved %+v, want certificate %d", org.name, binding, ids[org.id])
+		}
+		if env["REGISTRY_USERNAME"] != org.name || env["REGISTRY_PASSWORD"] != org.name+"-password" {
+			t.Fatalf("repo of %s got env %v, want the credentials of its own certificate", org.name, env)
+		}
+	}
+
+	// the caller's scope does not matter: a run resolves in the organization of its repository
+	admin := tenancy.WithScope(context.Background(), tenancy.Unrestricted())
+	_, _, _, bindings := svc.buildSecretEnv(admin, &model.Repo{ID: 2, OrgID: 2}, nil, map[string]string{"registry": "registry"})
+	if bindings["registry"].CertificateID != ids[2] {
+		t.Errorf("unrestricted caller resolved %+v for logistics, want certificate %d", bindings["registry"], ids[2])
+	}
+
+	env, _, _, bindings := svc.buildSecretEnv(context.Background(), &model.Repo{ID: 3, OrgID: 3}, nil, map[string]string{"registry": "registry"})
+	if len(bindings) != 0 || len(env) != 0 {
+		t.Errorf("repo of an organization without the certificate resolved %v %v", bindings, env)
+	}
+}
+
+func TestSecretBindingToAnotherOrganization(t *testing.T) {
+	svc, ids := newTenantService(t)
+	// a binding of payments pointing at the certificate of logistics, as an id guessed or
+	// kept from before the repository moved
+	settings := &model.RepoPipelineConfig{
+		RepoID:             1,
+		LegacyCertificates: []model.PipelineCertificateBinding{{Alias: "shipping", CertificateID: ids[2]}},
+	}
+	env, _, _, bindings := svc.buildSecretEnv(context.Background(), &model.Repo{ID: 1, OrgID: 1}, settings, map[string]string{"shipping": "shipping"})
+	if len(bindings) != 0 {
+		t.Fatalf("binding across organizations resolved %+v", bindings)
+	}
+	for key, value := range env {
+		if strings.Contains(value, "logistics") {
+			t.Fatalf("env %s carries the logistics credentials", key)
+		}
+	}
+}
+
+func TestLintSecretAliasWithinRepoOrganization(t *testing.T) {
+	svc, _ := newTenantService(t)
+	content := `name: app
+steps:
+  push:
+    image: docker:27
+    secrets: [registry]
+    commands:
+      - docker push registry.example/app
+`
+	for _, tc := range []struct {
+		repoID int64
+		valid  bool
+	}{{1, true}, {2, true}, {3, false}} {
+		result, err := svc.lintPipelineConfig(context.Background(), tc.repoID, nil, content)
+		if err != nil {
+			t.Fatalf("lint for repo %d: %v", tc.repoID, err)
+		}
+		if result.HasErrors() == tc.valid {
+			t.Errorf("lint for repo %d = %+v, want valid %v", tc.repoID, result.Diagnostics, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// ErrIllegalTransition reports a status write whose record is no longer in a state the new
+// status may be entered from, e.g. a re-delivered task trying to run a cancelled pipeline.
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// IllegalTransitionError describes a rejected status write. It matches ErrIllegalTransition.
+type IllegalTransitionError struct {
+	Entity string
+	ID     int64
+	From   model.StatusValue
+	To     model.StatusValue
+}
+
+func (e *IllegalTransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("%s: %s %d -> %s", ErrIllegalTransition, e.Entity, e.ID, e.To)
+	}
+	return fmt.Sprintf("%s: %s %d %s -> %s", ErrIllegalTransition, e.Entity, e.ID, e.From, e.To)
+}
+
+func (e *IllegalTransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// statusTransitions maps a target status to the states it may be entered from.
+type statusTransitions map[model.StatusValue][]model.StatusValue
+
+var (
+	pipelineTransitions = statusTransitions{
+		// running → running lets a task re-delivered after a restart pick up its pipeline.
+		model.StatusRunning: {model.StatusCreated, model.StatusPending, model.StatusBlocked, model.StatusRunning},
+		// running → pending requeues a pipeline whose execution died with the server.
+		model.StatusPending: {model.StatusRunning},
+		model.StatusBlocked: {model.StatusRunning},
+		model.StatusSuccess: {model.StatusRunning},
+		model.StatusFailure: {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusKilled:  {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusError:   {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+	}
+
+	// workflowTransitions follow the pipeline ones; a workflow behind a failed dependency is
+	// skipped without starting.
+	workflowTransitions = statusTransitions{
+		model.StatusRunning: {model.StatusCreated, model.StatusPending, model.StatusBlocked, model.StatusRunning},
+		model.StatusPending: {model.StatusRunning},
+		model.StatusBlocked: {model.StatusRunning},
+		model.StatusSuccess: {model.StatusRunning},
+		model.StatusFailure: {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusKilled:  {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusSkipped: {model.StatusCreated, model.StatusPending},
+		model.StatusError:   {model.StatusCreated, model.StatusPending, model.StatusRunning, model.StatusBlocked},
+	}
+
+	stepTransitions = statusTransitions{
+		model.StatusPending: {model.StatusRunning},
+		model.StatusRunning: {model.StatusPending, model.StatusBlocked, model.StatusRunning},
+		model.StatusBlocked: {model.StatusPending, model.StatusRunning},
+		// pending steps are finalised with the pipeline result when they never started
+		model.StatusSuccess: {model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusFailure: {model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusKilled:  {model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusSkipped: {model.StatusPending, model.StatusRunning, model.StatusBlocked},
+		model.StatusError:   {model.StatusPending, model.StatusRunning, model.StatusBlocked},
+	}
+)
+
+// statusEntity describes how the status of one table is stored and may change.
+type statusEntity struct {
+	name        string
+	column      string
+	newModel    func() any
+	transitions statusTransitions
+}
+
+var (
+	pipelineStatusEntity = statusEntity{
+		name:        "pipeline",
+		column:      "status",
+		newModel:    func() any { return &model.Pipeline{} },
+		transitions: pipelineTransitions,
+	}
+	workflowStatusEntity = statusEntity{
+		name:        "workflow",
+		column:      "state",
+		newModel:    func() any { return &model.Workflow{} },
+		transitions: workflowTransitions,
+	}
+	stepStatusEntity = statusEntity{
+		name:        "step",
+		column:      "state",
+		newModel:    func() any { return &model.Step{} },
+		transitions: stepTransitions,
+	}
+)
+
+// sources returns the states to may be entered from; unknown targets have none.
+func (e statusEntity) sources(to model.StatusValue) []model.StatusValue {
+	return e.transitions[to]
+}
+
+// transitionRecord moves one record to status to with a guarded UPDATE that only matches
+// the legal source states, applying updates in the same statement. It returns an
+// IllegalTransitionError when the record is in any other state.
+func transitionRecord(ctx context.Context, tx *gorm.DB, entity statusEntity, id int64, to model.StatusValue, updates map[string]any) error {
+	from := entity.sources(to)
+	if len(from) == 0 {
+		return &IllegalTransitionError{Entity: entity.name, ID: id, To: to}
+	}
+	values := make(map[string]any, len(updates)+1)
+	for key, value := range updates {
+		values[key] = value
+	}
+	values[entity.column] = to
+
+	result := tx.WithContext(ctx).
+		Model(entity.newModel()).
+		Where("id = ? AND "+entity.column+" IN ?", id, from).
+		Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	// some drivers report zero rows when the values did not change, so look at the
+	// current state before rejecting the write
+	var current []model.StatusValue
+	if err := tx.WithContext(ctx).
+		Model(entity.newModel()).
+		Where("id = ?", id).
+		Pluck(entity.column, &current).Error; err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	if containsStatus(from, current[0]) {
+		return nil
+	}
+	return &IllegalTransitionError{Entity: entity.name, ID: id, From: current[0], To: to}
+}
+
+// transitionPipelineTx moves a pipeline to status to inside tx. With non-nil workflowUpdates
+// its workflows follow; workflows already in a state that cannot enter to are left alone.
+// Workflows of a running pipeline are otherwise moved one by one as they execute.
+func transitionPipelineTx(ctx context.Context, tx *gorm.DB, pipelineID int64, to model.StatusValue, updates, workflowUpdates map[string]any) error {
+	if err := transitionRecord(ctx, tx, pipelineStatusEntity, pipelineID, to, updates); err != nil {
+		return err
+	}
+	if workflowUpdates == nil {
+		return nil
+	}
+	values := make(map[string]any, len(workflowUpdates)+1)
+	for key, value := range workflowUpdates {
+		values[key] = value
+	}
+	values["state"] = to
+	return tx.WithContext(ctx).
+		Model(&model.Workflow{}).
+		Where("pipeline_id = ? AND state IN ?", pipelineID, workflowTransitions[to]).
+		Updates(values).Error
+}
+
+func containsStatus(items []model.StatusValue, target model.StatusValue) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/model"
+)
+
+// newTransitionStore returns a store over a database holding pipelines of repository 1 in
+// the given states, with ids from 1.
+func newTransitionStore(t *testing.T, states ...model.StatusValue) *gormPipelineStore {
+	t.Helper()
+	db := storetest.Open(t, &model.Repo{}, &model.Pipeline{}, &model.Workflow{}, &model.Step{}, &model.Task{}, &model.ApproverGroup{})
+	mustCreate(t, db.GetDB(), &model.Repo{ID: 1, ForgeRemoteID: "manual-1", Owner: "team", Name: "app", FullName: "team/app"})
+	for i, state := range states {
+		id := int64(i + 1)
+		mustCreate(t, db.GetDB(), &model.Pipeline{ID: id, RepoID: 1, Number: id, Status: state})
+		mustCreate(t, db.GetDB(), &model.Workflow{ID: id, PipelineID: id, PID: 1, Name: "build", State: state})
+	}
+	return newGormPipelineStore(db)
+}
+
+func pipelineStatus(t *testing.T, st *gormPipelineStore, id int64) model.StatusValue {
+	t.Helper()
+	status, err := st.GetPipelineStatus(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestTransitionRejectsRedeliveredTask(t *testing.T) {
+	ctx := context.Background()
+	for _, finished := range []model.StatusValue{model.StatusSuccess, model.StatusFailure, model.StatusKilled} {
+		st := newTransitionStore(t, finished)
+
+		err := st.MarkPipelineRunning(ctx, 1, 100)
+		var illegal *IllegalTransitionError
+		if !errors.As(err, &illegal) || illegal.From != finished || illegal.To != model.StatusRunning {
+			t.Errorf("running a %s pipeline = %v, want an illegal transition from %s", finished, err, finished)
+		}
+		if err := st.MarkPipelineFinished(ctx, 1, model.StatusFailure, 100, "late", ""); finished != model.StatusFailure && !errors.Is(err, ErrIllegalTransition) {
+			t.Errorf("finishing a %s pipeline again = %v, want an illegal transition", finished, err)
+		}
+		if got := pipelineStatus(t, st, 1); got != finished {
+			t.Errorf("pipeline = %s after the late writes, want %s", got, finished)
+		}
+	}
+}
+
+func TestApprovalCannotResumeCancelledPipeline(t *testing.T) {
+	st := newTransitionStore(t, model.StatusKilled)
+	db := st.db.GetDB()
+	// the decision races the cancel: the step still waits while the pipeline is killed
+	mustCreate(t, db, &model.Step{
+		ID: 1, PipelineID: 1, PID: 2, PPID: 1, Name: "release", Type: model.StepTypeApproval, State: model.StatusBlocked,
+		Approval: &model.StepApproval{State: model.StepApprovalStatePending, Approvers: []string{"alice"}},
+	})
+	mustCreate(t, db, &model.Task{ID: "task-1", PipelineID: 1, RepoID: 1})
+	svc := NewService(st.db, nil, nil)
+
+	_, err := svc.SubmitStepApproval(context.Background(), 1, 1, 1, "alice", "approve", "")
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("approving a step of a cancelled pipeline = %v, want an illegal transition", err)
+	}
+	if got := pipelineStatus(t, st, 1); got != model.StatusKilled {
+		t.Errorf("pipeline = %s, want it to stay killed", got)
+	}
+	step, err := st.GetStep(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step.State != model.StatusBlocked || step.Approval.State != model.StepApprovalStatePending {
+		t.Errorf("step = %s approval %s, want the decision rolled back", step.State, step.Approval.State)
+	}
+}
+
+// TestTransitionInterleavings applies random interleavings of the writes a run, a
+// re-delivered task, a cancel, an approval and a requeue make, and checks that every status
+// the store persists is entered from a legal state.
+func TestTransitionInterleavings(t *testing.T) {
+	ctx := context.Background()
+	writes := []struct {
+		name  string
+		apply func(st *gormPipelineStore, id, now int64) error
+	}{
+		{"run", func(st *gormPipelineStore, id, now int64) error { return st.MarkPipelineRunning(ctx, id, now) }},
+		{"block", func(st *gormPipelineStore, id, now int64) error {
+			return st.MarkPipelineBlocked(ctx, id, "approval", now)
+		}},
+		{"succeed", func(st *gormPipelineStore, id, now int64) error {
+			return st.MarkPipelineFinished(ctx, id, model.StatusSuccess, now, "", "")
+		}},
+		{"fail", func(st *gormPipelineStore, id, now int64) error {
+			return st.MarkPipelineFinished(ctx, id, model.StatusFailure, now, "boom", "")
+		}},
+		{"cancel", func(st *gormPipelineStore, id, now int64) error { return st.KillPipeline(ctx, id, "cancelled", now) }},
+		{"requeue", func(st *gormPipelineStore, id, now int64) error { return st.ResetPipeline(ctx, id, now) }},
+	}
+
+	const pipelines = 8
+	states := make([]model.StatusValue, pipelines)
+	for i := range states {
+		states[i] = model.StatusPending
+	}
+	st := newTransitionStore(t, states...)
+	rng := rand.New(rand.NewSource(2260))
+	history := make(map[int64][]string, pipelines)
+	for step := int64(1); step <= 400; step++ {
+		id := int64(rng.Intn(pipelines) + 1)
+		write := writes[rng.Intn(len(writes))]
+		before := pipelineStatus(t, st, id)
+
+		err := write.apply(st, id, step)
+		after := pipelineStatus(t, st, id)
+		history[id] = append(history[id], fmt.Sprintf("%s:%s", write.name, after))
+		switch {
+		case errors.Is(err, ErrIllegalTransition):
+			if after != before {
+				t.Fatalf("pipeline %d moved %s -> %s on a rejected %s\n%v", id, before, after, write.name, history[id])
+			}
+		case err != nil:
+			t.Fatalf("%s pipeline %d: %v", write.name, id, err)
+		default:
+			if !containsStatus(pipelineTransitions[after], before) {
+				t.Fatalf("pipeline %d persisted %s -> %s on %s\n%v", id, before, after, write.name, history[id])
+			}
+		}
+	}
+}
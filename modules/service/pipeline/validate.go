@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cron "github.com/gdgvda/cron"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// PipelineConfigError rejects a config whose validation produced errors.
+type PipelineConfigError struct {
+	Diagnostics []spec.Diagnostic
+}
+
+func (e *PipelineConfigError) Error() string {
+	for _, d := range e.Diagnostics {
+		if d.Severity != spec.SeverityError {
+			continue
+		}
+		if d.Line > 0 {
+			return fmt.Sprintf("流水线配置无效（第 %d 行）: %s", d.Line, d.Message)
+		}
+		return "流水线配置无效: " + d.Message
+	}
+	return "流水线配置无效"
+}
+
+// ValidatePipelineConfig checks content against the spec and the repository state: secret
+// references must resolve to a secret, a repository binding or a global certificate, plugin
+// steps must match a registered plugin, and the stored cron schedules must parse.
+func (s *Service) ValidatePipelineConfig(ctx context.Context, repoID int64, content string) ([]spec.Diagnostic, error) {
+	settings, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.lintPipelineConfig(ctx, repoID, settings, content)
+	if err != nil {
+		return nil, err
+	}
+	for idx, expression := range settings.CronSchedules {
+		if _, err := cron.New().Add(expression, func() {}); err != nil {
+			result.Add(fmt.Sprintf("settings.cron_schedules[%d]", idx), 0, spec.SeverityError,
+				fmt.Sprintf("无效的 cron 表达式 %q: %v", expression, err))
+		}
+	}
+	return result.Diagnostics, nil
+}
+
+// lintPipelineConfig runs spec.Lint plus the checks that need repository settings.
+func (s *Service) lintPipelineConfig(ctx context.Context, repoID int64, settings *model.RepoPipelineConfig, content string) (*spec.LintResult, error) {
+	result := spec.Lint(content)
+	if result.Spec == nil {
+		return result, nil
+	}
+
+	ctx, err := s.repoScopeByID(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := make(map[string]struct{})
+	if settings != nil {
+		for _, binding := range settings.LegacyCertificates {
+			if binding.CertificateID == 0 {
+				continue
+			}
+			alias := strings.TrimSpace(binding.Alias)
+			if alias == "" {
+				alias = fmt.Sprintf("cert_%d", binding.CertificateID)
+			}
+			bound[strings.ToLower(alias)] = struct{}{}
+		}
+	}
+
+	checked := make(map[string]bool)
+	for _, step := range result.Spec.Steps {
+		for _, alias := range step.Secrets {
+			key := strings.ToLower(strings.TrimSpace(alias))
+			if key == "" {
+				continue
+			}
+			if _, ok := bound[key]; ok {
+				continue
+			}
+			if s.systemSvc == nil {
+				// secrets and global certificates cannot be resolved without the system service
+				continue
+			}
+			found, ok := checked[key]
+			if !ok {
+				secret, err := s.systemSvc.FindSecret(ctx, repoID, alias)
+				if err != nil {
+					return nil, err
+				}
+				found = secret != nil
+				if !found {
+					cert, err := s.systemSvc.GetCertificateByName(ctx, alias)
+					if err != nil {
+						return nil, err
+					}
+					found = cert != nil
+				}
+				checked[key] = found
+			}
+			if !found {
+				result.Add("steps."+step.Name+".secrets", result.StepLine(step.Name), spec.SeverityError,
+					fmt.Sprintf("步骤 %s 引用的凭证 %s 既不是密钥，也未绑定到仓库或作为全局凭证存在", step.Name, alias))
+			}
+		}
+	}
+	if err := s.lintPluginSteps(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// validatePipelineContent rejects content with error diagnostics. Empty content is allowed so
+// that a repository can be activated before it has a config.
+func (s *Service) validatePipelineContent(ctx context.Context, repoID int64, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	settings, err := s.GetPipelineSettings(ctx, repoID)
+	if err != nil {
+		return err
+	}
+	result, err := s.lintPipelineConfig(ctx, repoID, settings, content)
+	if err != nil {
+		return err
+	}
+	if result.HasErrors() {
+		return &PipelineConfigError{Diagnostics: result.Diagnostics}
+	}
+	return nil
+}
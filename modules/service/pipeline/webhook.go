@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+var (
+	ErrRepoInactive          = errors.New("仓库未启用流水线")
+	ErrPipelineConfigMissing = errors.New("仓库未配置流水线")
+	ErrBranchNotAllowed      = errors.New("分支不匹配流水线配置")
+)
+
+// TriggerWebhookPipeline starts a pipeline for a forge webhook once the repository,
+// its pipeline configuration and the pushed branch are eligible. The returned pipeline
+// has been persisted and its task enqueued.
+func (s *Service) TriggerWebhookPipeline(ctx context.Context, repo *model.Repo, event model.WebhookEvent, author, message string, opts model.PipelineOptions) (*model.Pipeline, error) {
+	if repo == nil {
+		return nil, fmt.Errorf("repository is required")
+	}
+	if !repo.IsActive {
+		return nil, ErrRepoInactive
+	}
+	if err := event.Validate(); err != nil {
+		return nil, err
+	}
+
+	cfg, err := s.GetPipelineConfig(ctx, repo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := normalizePipelineRef(opts.Ref)
+	branch := strings.TrimSpace(firstNonEmpty(branchFromRef(ref), opts.Branch, repo.Branch))
+	tag := tagFromRef(ref)
+	content, snapshot, err := s.resolvePipelineContent(ctx, repo, cfg, ref, branch, opts.Commit)
+	if err != nil {
+		return nil, err
+	}
+	specDef, err := spec.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	if !specAllowsRef(specDef, branch, tag) {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotAllowed, firstNonEmpty(tag, branch))
+	}
+	opts.Branch = branch
+
+	title := fmt.Sprintf("%s - %s", event, firstNonEmpty(tag, branch))
+	if strings.TrimSpace(message) == "" {
+		message = defaultPipelineMessage(event, author)
+	}
+	return s.triggerPipelineWithContent(ctx, repo, cfg, content, snapshot, opts, event, author, message, title)
+}
+
+// specAllowsRef reports whether at least one step would run on the branch, or on the tag
+// for tag pipelines.
+func specAllowsRef(def *spec.PipelineSpec, branch, tag string) bool {
+	if def == nil {
+		return false
+	}
+	for _, step := range def.Steps {
+		if step.Conditions == nil {
+			return true
+		}
+		if newPipelineStepConditions(step.Conditions).allowsRef(branch, tag) {
+			return true
+		}
+	}
+	return false
+}
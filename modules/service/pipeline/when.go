@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+// skipCIMarkers in the commit message of a webhook run skip the run.
+var skipCIMarkers = []string{"[skip ci]", "[ci skip]"}
+
+// BranchHeadReader looks up the commit a branch points at on the forge with the token of a user.
+type BranchHeadReader interface {
+	BranchHead(ctx context.Context, userID, repoID int64, branch string) (string, error)
+}
+
+// WithBranchHeadReader lets `skip_if_no_changes` find the branch head of triggers that do
+// not carry a commit, such as cron and manual runs.
+func WithBranchHeadReader(reader BranchHeadReader) Option {
+	return func(s *Service) {
+		s.branchHeads = reader
+	}
+}
+
+// pipelineSkipReason returns why a trigger of def creates no run, or "" when it runs.
+// message is the commit message for webhook events. The head commit found for
+// `skip_if_no_changes` is stored on pipeline.
+func (s *Service) pipelineSkipReason(ctx context.Context, repo *model.Repo, def *spec.PipelineSpec, pipeline *model.Pipeline, message string) string {
+	event := pipeline.Event
+	if event != model.EventManual && event != model.EventCron {
+		lower := strings.ToLower(message)
+		for _, marker := range skipCIMarkers {
+			if strings.Contains(lower, marker) {
+				return fmt.Sprintf("提交信息包含 %s", marker)
+			}
+		}
+	}
+
+	when := def.When
+	if when == nil {
+		return ""
+	}
+	if !when.AllowsEvent(event) {
+		return fmt.Sprintf("事件 %s 不在流水线 when.events 中", event)
+	}
+	isTag := tagFromRef(pipeline.Ref) != ""
+	if !isTag && !when.AllowsBranch(pipeline.Branch) {
+		return fmt.Sprintf("分支 %s 不匹配流水线 when.branches", pipeline.Branch)
+	}
+	if !when.SkipIfNoChanges || isTag {
+		return ""
+	}
+
+	head := pipeline.Commit
+	if head == "" && s.branchHeads != nil {
+		var err error
+		head, err = s.branchHeads.BranchHead(ctx, repo.UserID, repo.ID, pipeline.Branch)
+		if err != nil {
+			// without the head the run goes ahead rather than silently missing changes
+			log.Warn().Err(err).Int64("repo_id", repo.ID).Str("branch", pipeline.Branch).Msg("failed to read branch head for skip_if_no_changes")
+			return ""
+		}
+	}
+	if head == "" {
+		return ""
+	}
+	previous, err := s.store.LastPipelineCommit(ctx, repo.ID, pipeline.Branch)
+	if err != nil {
+		log.Warn().Err(err).Int64("repo_id", repo.ID).Str("branch", pipeline.Branch).Msg("failed to look up last pipeline commit")
+		return ""
+	}
+	pipeline.Commit = head
+	if previous != head {
+		return ""
+	}
+	return fmt.Sprintf("分支 %s 自上次构建（%s）以来没有新提交", pipeline.Branch, shortCommit(head))
+}
+
+// recordSkippedPipeline stores a trigger that creates no run as a finished pipeline without
+// steps, so the reason shows up in the run history.
+func (s *Service) recordSkippedPipeline(ctx context.Context, repo *model.Repo, pipeline *model.Pipeline, reason string) (*model.Pipeline, error) {
+	now := time.Now().Unix()
+	pipeline.Status = model.StatusSkipped
+	pipeline.Message = "已跳过：" + reason
+	pipeline.Finished = now
+	pipeline.Updated = now
+	if err := s.CreatePipeline(ctx, pipeline, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	log.Info().
+		Int64("repo_id", repo.ID).
+		Int64("pipeline_id", pipeline.ID).
+		Str("event", string(pipeline.Event)).
+		Str("reason", reason).
+		Msg("pipeline trigger skipped")
+	s.audit.RecordAs(ctx, firstNonEmpty(audit.ActorFromContext(ctx), pipeline.Author), model.AuditActionPipelineTrigger, model.AuditResourcePipeline, strconv.FormatInt(pipeline.ID, 10), repo.ID, map[string]interface{}{
+		"number":  pipeline.Number,
+		"event":   string(pipeline.Event),
+		"branch":  pipeline.Branch,
+		"ref":     pipeline.Ref,
+		"commit":  pipeline.Commit,
+		"skipped": reason,
+	})
+	return pipeline, nil
+}
@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// pipelineTaskWorkflow is a workflow of a queued run; its steps carry its PID as PPID.
+type pipelineTaskWorkflow struct {
+	PID       int      `json:"pid"`
+	Name      string   `json:"name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// taskWorkflows returns the workflows of the run in execution order. Payloads queued before
+// workflows were recorded run all their steps as the single workflow 1.
+func (p pipelineTaskPayload) taskWorkflows() []pipelineTaskWorkflow {
+	if len(p.Workflows) > 0 {
+		return p.Workflows
+	}
+	return []pipelineTaskWorkflow{{PID: 1, Name: p.RunName}}
+}
+
+// workflowSteps returns the steps of the workflow with pid.
+func (p pipelineTaskPayload) workflowSteps(pid int) []pipelineTaskStep {
+	if len(p.Workflows) == 0 {
+		return p.Steps
+	}
+	steps := make([]pipelineTaskStep, 0, len(p.Steps))
+	for _, step := range p.Steps {
+		if step.PPID == pid {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// runWorkflows executes the workflows of payload one after another in dependency order and
+// moves each workflow record through its own states. The steps of a workflow behind one that
+// did not succeed are skipped; a cancellation, timeout or pending approval stops the run.
+// Workflows finished by an earlier execution of the run are not started again.
+func (s *Service) runWorkflows(ctx, taskCtx context.Context, payload pipelineTaskPayload, run stepRunner, skip stepSkipper) stepOutcome {
+	records, err := s.store.ListPipelineWorkflows(ctx, payload.PipelineID)
+	if err != nil {
+		return stepOutcome{err: err}
+	}
+	recordMap := make(map[int]*model.Workflow, len(records))
+	for i := range records {
+		recordMap[records[i].PID] = &records[i]
+	}
+	transition := func(record *model.Workflow, to model.StatusValue, updates map[string]any) error {
+		if record == nil {
+			return nil
+		}
+		if err := s.store.TransitionWorkflow(ctx, record.ID, to, updates); err != nil {
+			return err
+		}
+		record.State = to
+		return nil
+	}
+
+	succeeded := make(map[string]bool)
+	result := stepOutcome{status: model.StatusSuccess}
+	for _, workflow := range payload.taskWorkflows() {
+		record := recordMap[workflow.PID]
+		steps := payload.workflowSteps(workflow.PID)
+		if record != nil {
+			switch record.State {
+			case model.StatusSuccess:
+				succeeded[workflow.Name] = true
+				continue
+			case model.StatusFailure:
+				result = mergeStepOutcome(result, stepOutcome{status: model.StatusFailure, message: record.Error})
+				continue
+			case model.StatusSkipped:
+				continue
+			}
+		}
+
+		failedDep := ""
+		for _, dep := range workflow.DependsOn {
+			if !succeeded[dep] {
+				failedDep = dep
+				break
+			}
+		}
+		if failedDep != "" {
+			reason := fmt.Sprintf("依赖的 workflow %s 未成功，已跳过", failedDep)
+			for _, step := range steps {
+				if err := skip(step, reason); err != nil {
+					return mergeStepOutcome(result, stepOutcome{err: err})
+				}
+			}
+			if err := transition(record, model.StatusSkipped, map[string]any{
+				"finished": time.Now().Unix(),
+				"error":    reason,
+			}); err != nil {
+				return mergeStepOutcome(result, stepOutcome{err: err})
+			}
+			continue
+		}
+
+		if taskCtx.Err() != nil {
+			return mergeStepOutcome(result, interruptedStepOutcome(taskCtx))
+		}
+		if err := transition(record, model.StatusRunning, map[string]any{
+			"started": time.Now().Unix(),
+		}); err != nil {
+			return mergeStepOutcome(result, stepOutcome{err: err})
+		}
+
+		var outcome stepOutcome
+		if hasStepDependencies(steps) {
+			outcome = s.runStepGraph(taskCtx, steps, run, skip)
+		} else {
+			outcome = runStepSequence(taskCtx, steps, run)
+		}
+		if outcome.err != nil {
+			return mergeStepOutcome(result, outcome)
+		}
+		if outcome.status == model.StatusBlocked {
+			if err := transition(record, model.StatusBlocked, nil); err != nil {
+				return mergeStepOutcome(result, stepOutcome{err: err})
+			}
+			return mergeStepOutcome(result, outcome)
+		}
+
+		status := statusFromPipeline(outcome.status)
+		if err := transition(record, status, map[string]any{
+			"finished": time.Now().Unix(),
+			"error":    outcome.message,
+		}); err != nil {
+			return mergeStepOutcome(result, stepOutcome{err: err})
+		}
+		result = mergeStepOutcome(result, outcome)
+		if status == model.StatusSuccess {
+			succeeded[workflow.Name] = true
+		}
+		if status == model.StatusKilled || outcome.timedOut {
+			return result
+		}
+	}
+	return result
+}
@@ -0,0 +1,319 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+const (
+	// workspaceCacheDirName holds the caches of all repositories under a workspace root.
+	workspaceCacheDirName = ".cache"
+	// defaultWorkspaceCacheLimit bounds the caches under one workspace root.
+	defaultWorkspaceCacheLimit int64 = 2 << 30
+)
+
+// WithWorkspaceCacheLimit bounds the total size of the workspace caches under a workspace
+// root; the least recently used repository caches are evicted beyond it. 0 keeps the default.
+func WithWorkspaceCacheLimit(limit int64) Option {
+	return func(s *Service) {
+		if limit > 0 {
+			s.workspaceCacheLimit = limit
+		}
+	}
+}
+
+// workspaceCache is the cache of one repository. Paths under the workspace are copied in
+// before the first step and back after a successful run; other paths are bind mounted from
+// the cache, so steps update them in place.
+type workspaceCache struct {
+	root  string
+	dir   string
+	paths []string
+}
+
+// openWorkspaceCache returns the cache of repoID under workspaceRoot, or nil when the spec
+// caches nothing.
+func openWorkspaceCache(workspaceRoot string, repoID int64, paths []string) *workspaceCache {
+	if len(paths) == 0 {
+		return nil
+	}
+	root := filepath.Join(workspaceRoot, workspaceCacheDirName)
+	return &workspaceCache{
+		root:  root,
+		dir:   filepath.Join(root, strconv.FormatInt(repoID, 10)),
+		paths: paths,
+	}
+}
+
+// entryName maps a container path to a directory name unique per path.
+func (c *workspaceCache) entryName(containerPath string) string {
+	sum := sha256.Sum256([]byte(containerPath))
+	return sanitizeDirName(strings.Trim(containerPath, "/")) + "-" + hex.EncodeToString(sum[:4])
+}
+
+func workspaceRelPath(containerPath string) (string, bool) {
+	rel := strings.TrimPrefix(containerPath, spec.WorkspacePath+"/")
+	if rel == containerPath {
+		return "", false
+	}
+	return filepath.FromSlash(rel), true
+}
+
+// binds returns the bind mounts of the cached paths outside the workspace.
+func (c *workspaceCache) binds() []string {
+	if c == nil {
+		return nil
+	}
+	var binds []string
+	for _, containerPath := range c.paths {
+		if _, ok := workspaceRelPath(containerPath); ok {
+			continue
+		}
+		hostDir := filepath.Join(c.dir, "mounts", c.entryName(containerPath))
+		if err := os.MkdirAll(hostDir, 0o755); err != nil {
+			log.Warn().Err(err).Str("path", containerPath).Msg("failed to prepare workspace cache mount")
+			continue
+		}
+		binds = append(binds, fmt.Sprintf("%s:%s", hostDir, containerPath))
+	}
+	return binds
+}
+
+// restore copies the cached workspace paths into workspace. Misses and copy failures are
+// logged and never fail the pipeline.
+func (c *workspaceCache) restore(workspace string, logFn func(string) error) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	// the directory mtime orders caches for eviction
+	_ = os.MkdirAll(c.dir, 0o755)
+	_ = os.Chtimes(c.dir, now, now)
+
+	for _, containerPath := range c.paths {
+		rel, ok := workspaceRelPath(containerPath)
+		if !ok {
+			_ = logFn(fmt.Sprintf("缓存目录已挂载: %s", containerPath))
+			continue
+		}
+		src := filepath.Join(c.dir, "files", c.entryName(containerPath))
+		if _, err := os.Stat(src); err != nil {
+			_ = logFn(fmt.Sprintf("缓存未命中: %s", containerPath))
+			continue
+		}
+		dst := filepath.Join(workspace, rel)
+		if err := os.RemoveAll(dst); err != nil {
+			_ = logFn(fmt.Sprintf("恢复缓存 %s 失败: %v", containerPath, err))
+			continue
+		}
+		size, err := copyTree(src, dst)
+		if err != nil {
+			_ = logFn(fmt.Sprintf("恢复缓存 %s 失败: %v", containerPath, err))
+			_ = os.RemoveAll(dst)
+			continue
+		}
+		_ = logFn(fmt.Sprintf("已恢复缓存 %s（%d 字节）", containerPath, size))
+	}
+}
+
+// saveWorkspaceCache replaces the cached workspace paths with their state in workspace and
+// evicts older caches beyond the size limit. Failures are logged only.
+func (s *Service) saveWorkspaceCache(c *workspaceCache, workspace string, logFn func(string) error) {
+	if c == nil || workspace == "" {
+		return
+	}
+	s.workspaceCacheMu.Lock()
+	defer s.workspaceCacheMu.Unlock()
+
+	staging := filepath.Join(c.dir, fmt.Sprintf("files.tmp-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(staging)
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		_ = logFn(fmt.Sprintf("保存缓存失败: %v", err))
+		return
+	}
+
+	var total int64
+	saved := 0
+	for _, containerPath := range c.paths {
+		rel, ok := workspaceRelPath(containerPath)
+		if !ok {
+			continue
+		}
+		src := filepath.Join(workspace, rel)
+		if _, err := os.Stat(src); err != nil {
+			_ = logFn(fmt.Sprintf("缓存路径不存在，跳过: %s", containerPath))
+			continue
+		}
+		size, err := copyTree(src, filepath.Join(staging, c.entryName(containerPath)))
+		if err != nil {
+			_ = logFn(fmt.Sprintf("保存缓存 %s 失败: %v", containerPath, err))
+			return
+		}
+		total += size
+		saved++
+	}
+	if saved == 0 {
+		return
+	}
+	limit := s.workspaceCacheLimit
+	if limit <= 0 {
+		limit = defaultWorkspaceCacheLimit
+	}
+	if total > limit {
+		_ = logFn(fmt.Sprintf("缓存大小 %d 字节超过上限 %d 字节，未保存", total, limit))
+		return
+	}
+
+	files := filepath.Join(c.dir, "files")
+	if err := os.RemoveAll(files); err != nil {
+		_ = logFn(fmt.Sprintf("保存缓存失败: %v", err))
+		return
+	}
+	if err := os.Rename(staging, files); err != nil {
+		_ = logFn(fmt.Sprintf("保存缓存失败: %v", err))
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.dir, now, now)
+	_ = logFn(fmt.Sprintf("已保存 %d 个缓存路径（%d 字节）", saved, total))
+
+	if evicted := evictWorkspaceCaches(c.root, c.dir, limit); len(evicted) > 0 {
+		log.Info().Strs("caches", evicted).Msg("evicted workspace caches")
+	}
+}
+
+// evictWorkspaceCaches removes the least recently used repository caches under root until
+// the total fits limit. keep is never evicted.
+func evictWorkspaceCaches(root, keep string, limit int64) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	type cacheDir struct {
+		path    string
+		size    int64
+		touched time.Time
+	}
+	var dirs []cacheDir
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		size := treeSize(dir)
+		total += size
+		if dir != keep {
+			dirs = append(dirs, cacheDir{path: dir, size: size, touched: info.ModTime()})
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].touched.Before(dirs[j].touched) })
+
+	var evicted []string
+	for _, dir := range dirs {
+		if total <= limit {
+			break
+		}
+		if err := os.RemoveAll(dir.path); err != nil {
+			log.Warn().Err(err).Str("cache", dir.path).Msg("failed to evict workspace cache")
+			continue
+		}
+		total -= dir.size
+		evicted = append(evicted, dir.path)
+	}
+	return evicted
+}
+
+// copyTree copies src, a file or a directory, to dst and returns the bytes copied. Symlinks
+// are recreated rather than followed.
+func copyTree(src, dst string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(src, func(current string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(src, current)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(current)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			size, err := copyFileMode(current, target, info.Mode().Perm())
+			total += size
+			return err
+		}
+		// sockets, devices and pipes are not cached
+		return nil
+	})
+	return total, err
+}
+
+func copyFileMode(src, dst string, mode fs.FileMode) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0o600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// treeSize sums the sizes of the regular files below dir.
+func treeSize(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,200 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+)
+
+// workspaceUsageTTL is how long a workspace scan is reused; walking every workspace is
+// expensive.
+const workspaceUsageTTL = time.Minute
+
+// ErrWorkspaceQuotaExceeded fails a pipeline before its clone while the workspaces use more
+// than the hard limit.
+var ErrWorkspaceQuotaExceeded = errors.New("workspace quota exceeded")
+
+// WithWorkspaceQuota sets the disk quota of the build workspaces in bytes. Beyond soft, a
+// pipeline about to clone first removes the expired workspaces of every repository; beyond
+// hard, it fails instead of cloning. 0 disables a limit.
+func WithWorkspaceQuota(soft, hard int64) Option {
+	return func(s *Service) {
+		s.workspaceSoftLimit = max(soft, 0)
+		s.workspaceHardLimit = max(hard, 0)
+	}
+}
+
+// WorkspaceUsage reports the disk usage below the workspace roots of all repositories. The
+// last scan is reused for a minute unless refresh is set.
+func (s *Service) WorkspaceUsage(ctx context.Context, refresh bool) (*model.WorkspaceUsage, error) {
+	s.workspaceUsageMu.Lock()
+	defer s.workspaceUsageMu.Unlock()
+	if !refresh && s.workspaceUsage != nil && time.Since(time.Unix(s.workspaceUsage.ScannedAt, 0)) < workspaceUsageTTL {
+		return s.workspaceUsage, nil
+	}
+	usage, err := s.scanWorkspaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.workspaceUsage = usage
+	return usage, nil
+}
+
+// scanWorkspaces walks every workspace root and sums the directories below it.
+func (s *Service) scanWorkspaces(ctx context.Context) (*model.WorkspaceUsage, error) {
+	repos, configs, err := s.workspaceRepos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roots := map[string]struct{}{sanitizeWorkspaceRoot(""): {}}
+	dirRepos := make(map[string][]string)
+	for _, repo := range repos {
+		for _, root := range workspaceRootCandidates(configs[repo.ID]) {
+			roots[root] = struct{}{}
+		}
+		dirName := sanitizeDirName(repo.Name)
+		if dirName == "" {
+			dirName = fmt.Sprintf("repo-%d", repo.ID)
+		}
+		dirRepos[dirName] = append(dirRepos[dirName], repo.FullName)
+	}
+
+	usage := &model.WorkspaceUsage{
+		SoftLimit: s.workspaceSoftLimit,
+		HardLimit: s.workspaceHardLimit,
+		ScannedAt: time.Now().Unix(),
+		Roots:     make([]string, 0, len(roots)),
+		Entries:   []model.WorkspaceUsageEntry{},
+	}
+	for root := range roots {
+		usage.Roots = append(usage.Roots, root)
+	}
+	sort.Strings(usage.Roots)
+	for _, root := range usage.Roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Debug().Err(err).Str("path", root).Msg("skip workspace root in usage scan")
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			size, modified := treeUsage(filepath.Join(root, entry.Name()))
+			usage.Total += size
+			usage.Entries = append(usage.Entries, model.WorkspaceUsageEntry{
+				Root:     root,
+				Dir:      entry.Name(),
+				Repos:    dirRepos[entry.Name()],
+				Size:     size,
+				Modified: modified,
+			})
+		}
+	}
+	sort.SliceStable(usage.Entries, func(i, j int) bool {
+		return usage.Entries[i].Size > usage.Entries[j].Size
+	})
+	return usage, nil
+}
+
+// workspaceRepos loads every repository with its pipeline config, keyed by repository ID.
+func (s *Service) workspaceRepos(ctx context.Context) ([]*model.Repo, map[int64]*model.RepoPipelineConfig, error) {
+	repos, configs, err := s.store.ListWorkspaceRepos(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byRepo := make(map[int64]*model.RepoPipelineConfig, len(configs))
+	for _, cfg := range configs {
+		byRepo[cfg.RepoID] = cfg
+	}
+	return repos, byRepo, nil
+}
+
+// checkWorkspaceQuota runs before a workspace is prepared. Over the soft limit (or the hard
+// one without a soft limit) it removes the expired workspaces of every repository, at most
+// once per scan period; still over the hard limit it returns ErrWorkspaceQuotaExceeded. A
+// failed scan lets the pipeline go ahead.
+func (s *Service) checkWorkspaceQuota(ctx context.Context, logFn func(string) error) error {
+	threshold := s.workspaceSoftLimit
+	if threshold <= 0 {
+		threshold = s.workspaceHardLimit
+	}
+	if threshold <= 0 {
+		return nil
+	}
+	usage, err := s.WorkspaceUsage(ctx, false)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to scan workspace usage")
+		return nil
+	}
+	if usage.Total > threshold {
+		usage, err = s.reclaimWorkspaces(ctx, usage, threshold, logFn)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to scan workspace usage")
+			return nil
+		}
+	}
+	if s.workspaceHardLimit > 0 && usage.Total > s.workspaceHardLimit {
+		return fmt.Errorf("%w: 工作目录已占用 %s，超过上限 %s", ErrWorkspaceQuotaExceeded,
+			formatByteSize(usage.Total), formatByteSize(s.workspaceHardLimit))
+	}
+	return nil
+}
+
+// reclaimWorkspaces removes the expired workspaces of every repository and rescans. Pipelines
+// preparing at the same time wait for one cleanup instead of each running their own.
+func (s *Service) reclaimWorkspaces(ctx context.Context, usage *model.WorkspaceUsage, threshold int64, logFn func(string) error) (*model.WorkspaceUsage, error) {
+	s.workspaceQuotaMu.Lock()
+	defer s.workspaceQuotaMu.Unlock()
+	if time.Since(s.workspaceReclaimed) < workspaceUsageTTL {
+		// a cleanup just ran; its rescan is the current usage
+		return s.WorkspaceUsage(ctx, false)
+	}
+	if logFn != nil {
+		_ = logFn(fmt.Sprintf("工作目录已占用 %s，超过 %s，开始清理过期工作目录",
+			formatByteSize(usage.Total), formatByteSize(threshold)))
+	}
+	repos, configs, err := s.workspaceRepos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if cfg := configs[repo.ID]; cfg != nil {
+			s.cleanupExpiredWorkspaces(ctx, repo, cfg)
+		}
+	}
+	s.workspaceReclaimed = time.Now()
+	return s.WorkspaceUsage(ctx, true)
+}
+
+// treeUsage sums the sizes of the regular files below dir and returns the latest
+// modification time found, in unix seconds.
+func treeUsage(dir string) (int64, int64) {
+	var total, modified int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			total += info.Size()
+		}
+		modified = max(modified, info.ModTime().Unix())
+		return nil
+	})
+	return total, modified
+}
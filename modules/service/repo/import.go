@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	// ErrImportInvalid is returned for an import request that cannot be registered, e.g. an
+	// unsupported clone URL or a remote that cannot be reached.
+	ErrImportInvalid = errors.New("invalid repository import")
+	// ErrRepoExists is returned when a repository of the same full name is registered already.
+	ErrRepoExists = errors.New("repository already exists")
+	// ErrCertificateForbidden is returned when the caller may not clone with the certificate of
+	// an import request.
+	ErrCertificateForbidden = errors.New("certificate not permitted")
+)
+
+// Import registers a repository by clone URL for userID, an administrator when admin is set.
+// The remote is checked with `git ls-remote` using the certificate of the request, which the
+// pipelines clone with later. The repository is active right away; as no forge sends its
+// events, pipelines are triggered manually or by cron.
+func (s *Service) Import(ctx context.Context, userID int64, admin bool, req model.RepoImport) (*model.Repo, error) {
+	if s.pipelines == nil {
+		return nil, errPipelinesUnavailable
+	}
+	cloneURL := strings.TrimSpace(req.CloneURL)
+	httpClone, err := parseImportURL(cloneURL)
+	if err != nil {
+		return nil, err
+	}
+	owner, name, err := importName(req.Name, cloneURL)
+	if err != nil {
+		return nil, err
+	}
+	fullName := owner + "/" + name
+	existing, err := s.FindByFullName(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRepoExists, fullName)
+	}
+
+	repo := &model.Repo{
+		ForgeRemoteID:                model.ForgeRemoteID(model.ManualRemoteIDPrefix + generateRepoHash()),
+		UserID:                       userID,
+		Owner:                        owner,
+		Name:                         name,
+		FullName:                     fullName,
+		Branch:                       strings.TrimSpace(req.Branch),
+		Visibility:                   model.VisibilityPrivate,
+		IsSCMPrivate:                 true,
+		PREnabled:                    true,
+		IsActive:                     true,
+		AllowPull:                    true,
+		AllowDeploy:                  true,
+		Trusted:                      model.TrustedConfiguration{},
+		RequireApproval:              model.RequireApprovalForks,
+		CancelPreviousPipelineEvents: []model.WebhookEvent{},
+		NetrcTrustedPlugins:          []string{},
+		CertificateID:                req.CertificateID,
+		Hash:                         generateRepoHash(),
+	}
+	if httpClone != nil {
+		repo.Clone = cloneURL
+		repo.ForgeURL = strings.TrimSuffix(httpClone.String(), ".git")
+	} else {
+		repo.CloneSSH = cloneURL
+	}
+	err = s.db.View(func(tx *gorm.DB) error {
+		if req.CertificateID != 0 && !admin {
+			if err := checkImportCertificate(ctx, tx, req.CertificateID); err != nil {
+				return err
+			}
+		}
+		orgID, err := repoOrgID(ctx, tx, owner)
+		if err != nil {
+			return err
+		}
+		// the organization named like the owner may be outside the caller's scope
+		if repo.OrgID, err = tenancy.ResolveOrg(ctx, tx, orgID); errors.Is(err, tenancy.ErrOrganizationNotFound) {
+			repo.OrgID, err = tenancy.ResolveOrg(ctx, tx, 0)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	branches, head, err := s.pipelines.ListRemoteBranches(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImportInvalid, err)
+	}
+	switch {
+	case repo.Branch == "" && head != "":
+		repo.Branch = head
+	case repo.Branch == "":
+		// an empty remote has no HEAD yet
+		repo.Branch = "main"
+	case len(branches) > 0 && !slices.Contains(branches, repo.Branch):
+		return nil, fmt.Errorf("%w: 分支 %s 在远程仓库中不存在", ErrImportInvalid, repo.Branch)
+	}
+
+	if err := s.Create(ctx, repo); err != nil {
+		return nil, err
+	}
+	s.audit.Record(ctx, model.AuditActionRepoImport, model.AuditResourceRepo, strconv.FormatInt(repo.ID, 10), repo.ID, map[string]interface{}{
+		"repo":           repo.FullName,
+		"clone_url":      cloneURL,
+		"certificate_id": repo.CertificateID,
+	})
+	return repo, nil
+}
+
+// checkImportCertificate fails unless a caller who is not an administrator may clone with
+// certificate id. Certificates have no owner, so only those of an organization in the scope of
+// the caller qualify; outside multi-tenancy, where callers are not scoped, only administrators
+// bind certificates.
+func checkImportCertificate(ctx context.Context, tx *gorm.DB, id int64) error {
+	scope := tenancy.FromContext(ctx)
+	if scope.All {
+		return fmt.Errorf("%w: 只有管理员可以使用凭证 %d", ErrCertificateForbidden, id)
+	}
+	var cert model.Certificate
+	err := tx.WithContext(ctx).Select("id", "org_id").Where("id = ?", id).Take(&cert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !scope.Allows(cert.OrgID)) {
+		return fmt.Errorf("%w: 凭证 %d 不属于当前组织", ErrCertificateForbidden, id)
+	}
+	return err
+}
+
+// FindManualByFullName fetches the imported repository listed under fullName, if any.
+func (s *Service) FindManualByFullName(ctx context.Context, fullName string) (*model.Repo, error) {
+	var repo model.Repo
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("forge_id = 0 AND full_name = ?", fullName).Take(&repo).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// parseImportURL checks cloneURL and returns it parsed when it is an http(s) URL; nil means an
+// ssh URL. Credentials belong in the certificate, not in the URL.
+func parseImportURL(cloneURL string) (*url.URL, error) {
+	if cloneURL == "" {
+		return nil, fmt.Errorf("%w: 克隆地址不能为空", ErrImportInvalid)
+	}
+	if strings.HasPrefix(cloneURL, "git@") {
+		return nil, nil
+	}
+	parsed, err := url.Parse(cloneURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: 无效的克隆地址 %s", ErrImportInvalid, cloneURL)
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		if parsed.User != nil {
+			return nil, fmt.Errorf("%w: 克隆地址不能包含凭据，请绑定凭证", ErrImportInvalid)
+		}
+		return parsed, nil
+	case "ssh":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: 不支持的克隆地址协议 %s", ErrImportInvalid, parsed.Scheme)
+	}
+}
+
+// importName returns the owner and name of an imported repository: those of name when given,
+// otherwise those of the clone URL path. The owner keeps every segment but the last, as
+// forges with nested groups have.
+func importName(name, cloneURL string) (string, string, error) {
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if name == "" {
+		repoPath := cloneURL
+		if parsed, err := url.Parse(cloneURL); err == nil && parsed.Host != "" {
+			repoPath = parsed.Path
+		} else if _, after, ok := strings.Cut(cloneURL, ":"); ok {
+			// scp-like git@host:owner/name.git
+			repoPath = after
+		}
+		name = strings.Trim(strings.TrimSuffix(repoPath, ".git"), "/")
+	}
+	owner, repoName := path.Split(name)
+	owner = strings.Trim(owner, "/")
+	if owner == "" || repoName == "" {
+		return "", "", fmt.Errorf("%w: 仓库名称需为 owner/name 格式", ErrImportInvalid)
+	}
+	return owner, repoName, nil
+}
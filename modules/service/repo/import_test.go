@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+// fakePipelines answers ls-remote with a fixed remote and records the repositories checked.
+type fakePipelines struct {
+	checked []*model.Repo
+}
+
+func (f *fakePipelines) ListRemoteBranches(_ context.Context, repo *model.Repo) ([]string, string, error) {
+	f.checked = append(f.checked, repo)
+	return []string{"main"}, "main", nil
+}
+
+func (f *fakePipelines) CancelRepositoryPipelines(context.Context, int64, string) error { return nil }
+
+func (f *fakePipelines) DeactivateRepository(context.Context, *model.Repo) error { return nil }
+
+func (f *fakePipelines) PurgeRepository(context.Context, *model.Repo) error { return nil }
+
+func TestImportCertificatePermission(t *testing.T) {
+	db := storetest.Open(t, &model.Repo{}, &model.Organization{}, &model.Certificate{})
+	for _, org := range []*model.Organization{{Name: "team-a"}, {Name: "team-b"}} {
+		if err := db.GetDB().Create(org).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert := &model.Certificate{Name: "forge", Type: "git", OrgID: 1, Config: map[string]interface{}{"host": "git.example.com"}}
+	if err := db.GetDB().Create(cert).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		admin   bool
+		certID  int64
+		wantErr error
+	}{
+		{name: "admin", ctx: context.Background(), admin: true, certID: cert.ID},
+		{name: "unscoped user", ctx: context.Background(), certID: cert.ID, wantErr: ErrCertificateForbidden},
+		{name: "user of the certificate org", ctx: tenancy.WithScope(context.Background(), tenancy.Orgs(1)), certID: cert.ID},
+		{name: "user of another org", ctx: tenancy.WithScope(context.Background(), tenancy.Orgs(2)), certID: cert.ID, wantErr: ErrCertificateForbidden},
+		{name: "unknown certificate", ctx: tenancy.WithScope(context.Background(), tenancy.Orgs(1)), certID: 42, wantErr: ErrCertificateForbidden},
+		{name: "no certificate", ctx: context.Background()},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipelines := &fakePipelines{}
+			svc := New(db)
+			svc.SetPipelineController(pipelines)
+			req := model.RepoImport{
+				CloneURL:      fmt.Sprintf("https://git.example.com/team/app%d.git", i),
+				CertificateID: tt.certID,
+			}
+			repo, err := svc.Import(tt.ctx, 7, tt.admin, req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Import() error = %v, want %v", err, tt.wantErr)
+				}
+				if len(pipelines.checked) != 0 {
+					t.Fatalf("remote was contacted with a forbidden certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Import(): %v", err)
+			}
+			if repo.CertificateID != tt.certID || repo.Branch != "main" {
+				t.Errorf("Import() = certificate %d branch %q, want %d main", repo.CertificateID, repo.Branch, tt.certID)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
+)
+
+var errPipelinesUnavailable = model.NewFeatureUnavailableError(model.CapabilityPipeline, "pipeline service not configured")
+
+// PipelineController is the pipeline side of importing, deactivating and deleting a
+// repository.
+type PipelineController interface {
+	// ListRemoteBranches runs `git ls-remote` against the clone URL of the repository with its
+	// bound certificate and returns the branches with the one HEAD points at.
+	ListRemoteBranches(ctx context.Context, repo *model.Repo) ([]string, string, error)
+	// CancelRepositoryPipelines cancels every unfinished pipeline of the repository.
+	CancelRepositoryPipelines(ctx context.Context, repoID int64, reason string) error
+	// DeactivateRepository stops new pipelines by clearing active, the cron entries and the
+	// forge webhook.
+	DeactivateRepository(ctx context.Context, repo *model.Repo) error
+	// PurgeRepository deletes the repository with all its records and files.
+	PurgeRepository(ctx context.Context, repo *model.Repo) error
+}
+
+// Option configures the repository service.
+type Option func(*Service)
+
+// WithAudit records deactivations and deletions.
+func WithAudit(auditSvc *audit.Service) Option {
+	return func(s *Service) {
+		s.audit = auditSvc
+	}
+}
+
+// SetPipelineController wires the pipeline service, which is built after this one.
+func (s *Service) SetPipelineController(controller PipelineController) {
+	s.pipelines = controller
+}
+
+// Deactivate cancels the unfinished pipelines of repo and stops new ones from being
+// triggered. Records and configuration are kept, so saving the pipeline config again
+// reactivates the repository.
+func (s *Service) Deactivate(ctx context.Context, repo *model.Repo) error {
+	if s.pipelines == nil {
+		return errPipelinesUnavailable
+	}
+	if err := s.pipelines.CancelRepositoryPipelines(ctx, repo.ID, "仓库已停用"); err != nil {
+		return err
+	}
+	if err := s.pipelines.DeactivateRepository(ctx, repo); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, model.AuditActionRepoDeactivate, model.AuditResourceRepo, strconv.FormatInt(repo.ID, 10), repo.ID, map[string]interface{}{
+		"repo": repo.FullName,
+	})
+	return nil
+}
+
+// Delete cancels the unfinished pipelines of repo and removes it with its pipelines, logs,
+// configuration and workspaces. A webhook that cannot be removed, e.g. because the project
+// was archived on the forge, does not block the deletion.
+func (s *Service) Delete(ctx context.Context, repo *model.Repo) error {
+	if s.pipelines == nil {
+		return errPipelinesUnavailable
+	}
+	if err := s.pipelines.CancelRepositoryPipelines(ctx, repo.ID, "仓库已删除"); err != nil {
+		return err
+	}
+	if err := s.pipelines.DeactivateRepository(ctx, repo); err != nil {
+		log.Warn().Err(err).Int64("repo_id", repo.ID).Msg("failed to deactivate repository before deletion")
+	}
+	if err := s.pipelines.PurgeRepository(ctx, repo); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, model.AuditActionRepoDelete, model.AuditResourceRepo, strconv.FormatInt(repo.ID, 10), repo.ID, map[string]interface{}{
+		"repo": repo.FullName,
+	})
+	return nil
+}
@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	ErrMemberInvalid = errors.New("仓库成员配置无效")
+	ErrUserNotFound  = errors.New("用户不存在")
+)
+
+// Role returns the role of user on repo: owner for the syncing user and administrators,
+// otherwise the member role. It is empty for users without access.
+func (s *Service) Role(ctx context.Context, repo *model.Repo, user *model.User) (model.RepoRole, error) {
+	if repo == nil || user == nil {
+		return "", nil
+	}
+	if repo.UserID == user.ID || user.Admin {
+		return model.RepoRoleOwner, nil
+	}
+	var member model.RepoMember
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("repo_id = ? AND user_id = ?", repo.ID, user.ID).Take(&member).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// ListMembers lists the members of a repository by login. The owner is not a member.
+func (s *Service) ListMembers(ctx context.Context, repoID int64) ([]model.RepoMemberInfo, error) {
+	var members []model.RepoMemberInfo
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Table("repo_members").
+			Select("repo_members.user_id AS user_id, users.login AS login, users.avatar AS avatar, "+
+				"repo_members.role AS role, repo_members.created AS created, repo_members.updated AS updated").
+			Joins("JOIN users ON users.id = repo_members.user_id").
+			Where("repo_members.repo_id = ?", repoID).
+			Order("users.login ASC").
+			Scan(&members).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SetMember grants login role on a repository, replacing an existing role. The user must
+// have logged in once.
+func (s *Service) SetMember(ctx context.Context, repoID int64, login string, role model.RepoRole) (*model.RepoMember, error) {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, fmt.Errorf("%w: 用户名不能为空", ErrMemberInvalid)
+	}
+	if !role.Valid() {
+		return nil, fmt.Errorf("%w: 未知角色 %s", ErrMemberInvalid, role)
+	}
+	var result *model.RepoMember
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var repo model.Repo
+		if err := tx.WithContext(ctx).Select("id", "user_id").First(&repo, repoID).Error; err != nil {
+			return err
+		}
+		var user model.User
+		err := tx.WithContext(ctx).Where("login = ?", login).Take(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, login)
+		}
+		if err != nil {
+			return err
+		}
+		if user.ID == repo.UserID {
+			return fmt.Errorf("%w: 仓库所有者无需添加为成员", ErrMemberInvalid)
+		}
+
+		now := time.Now().Unix()
+		var member model.RepoMember
+		err = tx.WithContext(ctx).Where("repo_id = ? AND user_id = ?", repoID, user.ID).Take(&member).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			member = model.RepoMember{RepoID: repoID, UserID: user.ID, Role: role, Created: now, Updated: now}
+			if err := tx.WithContext(ctx).Create(&member).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			member.Role = role
+			member.Updated = now
+			if err := tx.WithContext(ctx).Model(&member).Updates(map[string]any{"role": role, "updated": now}).Error; err != nil {
+				return err
+			}
+		}
+		result = &member
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RemoveMember revokes the membership of userID.
+func (s *Service) RemoveMember(ctx context.Context, repoID, userID int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("repo_id = ? AND user_id = ?", repoID, userID).Delete(&model.RepoMember{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
@@ -12,15 +12,23 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/internal/tenancy"
 	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
 )
 
 type Service struct {
-	db *store.DB
+	db        *store.DB
+	audit     *audit.Service
+	pipelines PipelineController
 }
 
-func New(db *store.DB) *Service {
-	return &Service{db: db}
+func New(db *store.DB, opts ...Option) *Service {
+	s := &Service{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Create registers a repository.
@@ -69,6 +77,34 @@ func (s *Service) FindByFullName(ctx context.Context, owner, name string) (*mode
 	return &repo, nil
 }
 
+// FindByForgeRemoteID fetches a repository by forge type and the forge's remote id.
+func (s *Service) FindByForgeRemoteID(ctx context.Context, forgeType model.ForgeType, remoteID model.ForgeRemoteID) (*model.Repo, error) {
+	var repo model.Repo
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Joins("JOIN forges ON forges.id = repos.forge_id").
+			Where("forges.type = ? AND repos.forge_remote_id = ?", forgeType, remoteID).
+			Take(&repo).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// SetWebhookID records the forge webhook id registered for a repository; an empty id clears it.
+func (s *Service) SetWebhookID(ctx context.Context, repoID int64, hookID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.Repo{}).
+			Where("id = ?", repoID).
+			Update("webhook_id", hookID).Error
+	})
+}
+
 // ListByUser returns repositories the user has access to.
 func (s *Service) ListByUser(ctx context.Context, userID int64) ([]*model.Repo, error) {
 	repos, _, err := s.ListByUserPaged(ctx, userID, model.ListOptions{Page: 1, PerPage: 1000}, "", nil)
@@ -87,7 +123,10 @@ func (s *Service) ListByUserPaged(ctx context.Context, userID int64, opts model.
 		perPage = 100
 	}
 
-	query := s.db.GetDB().WithContext(ctx).Model(&model.Repo{}).Where("user_id = ?", userID)
+	query := s.db.GetDB().WithContext(ctx).
+		Model(&model.Repo{}).
+		Where("user_id = ? OR id IN (?)", userID,
+			s.db.GetDB().Model(&model.RepoMember{}).Select("repo_id").Where("user_id = ?", userID))
 	if strings.TrimSpace(search) != "" {
 		like := "%" + strings.TrimSpace(search) + "%"
 		query = query.Where("full_name LIKE ? OR name LIKE ?", like, like)
@@ -124,93 +163,166 @@ type GitRepository struct {
 	ConfigPath    string
 }
 
-// SyncGitRepositories upserts repositories reported by an external forge.
+// SyncGitRepositories upserts repositories reported by an external forge into report.
 // When activate is true the repositories are marked as active; otherwise the
 // activation status is preserved (new repositories default to inactive).
-func (s *Service) SyncGitRepositories(ctx context.Context, forgeID, userID int64, repositories []GitRepository, activate bool) error {
+// Each repository is saved in its own transaction: a failing one is recorded in the report
+// and the remaining ones are still processed.
+func (s *Service) SyncGitRepositories(ctx context.Context, forgeID, userID int64, repositories []GitRepository, activate bool, report *SyncReport) error {
+	for _, repository := range repositories {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if repository.RemoteID == "" {
+			continue
+		}
+		// an imported repository keeps its name; syncing would turn it into the forge one
+		manual, err := s.FindManualByFullName(ctx, repository.FullName)
+		if err != nil {
+			report.Discovered++
+			report.Fail(repository.FullName, err)
+			continue
+		}
+		if manual != nil {
+			report.Skip(repository.FullName, SyncSkipManualRepo)
+			continue
+		}
+		report.Discovered++
+		var created bool
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			created, err = syncGitRepository(ctx, tx, forgeID, userID, repository, activate)
+			return err
+		})
+		switch {
+		case err != nil:
+			report.Fail(repository.FullName, err)
+		case created:
+			report.Created++
+		default:
+			report.Updated++
+		}
+	}
+	return nil
+}
+
+// syncGitRepository upserts one forge repository and reports whether it was created.
+func syncGitRepository(ctx context.Context, tx *gorm.DB, forgeID, userID int64, repository GitRepository, activate bool) (bool, error) {
+	remoteID := model.ForgeRemoteID(repository.RemoteID)
+	trusted := model.TrustedConfiguration{}
+
+	var existing model.Repo
+	err := tx.WithContext(ctx).Where("forge_id = ? AND forge_remote_id = ?", forgeID, remoteID).Take(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tx.WithContext(ctx).
+			Where("forge_id = ? AND owner = ? AND name = ?", forgeID, repository.Owner, repository.Name).
+			Take(&existing).Error
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	if existing.ID == 0 || existing.OrgID == 0 {
+		orgID, err := repoOrgID(ctx, tx, repository.Owner)
+		if err != nil {
+			return false, err
+		}
+		existing.OrgID = orgID
+	}
+
+	if existing.ID == 0 {
+		newRepo := &model.Repo{
+			ForgeID:                      forgeID,
+			ForgeRemoteID:                remoteID,
+			UserID:                       userID,
+			OrgID:                        existing.OrgID,
+			Owner:                        repository.Owner,
+			Name:                         repository.Name,
+			FullName:                     repository.FullName,
+			Avatar:                       repository.AvatarURL,
+			ForgeURL:                     repository.WebURL,
+			Clone:                        repository.HTTPCloneURL,
+			CloneSSH:                     repository.SSHCloneURL,
+			Branch:                       repository.DefaultBranch,
+			Visibility:                   repository.Visibility,
+			IsSCMPrivate:                 repository.IsPrivate,
+			PREnabled:                    true,
+			Timeout:                      0,
+			IsActive:                     activate,
+			AllowPull:                    true,
+			AllowDeploy:                  true,
+			Config:                       repository.ConfigPath,
+			Trusted:                      trusted,
+			RequireApproval:              model.RequireApprovalForks,
+			CancelPreviousPipelineEvents: []model.WebhookEvent{},
+			NetrcTrustedPlugins:          []string{},
+			Hash:                         generateRepoHash(),
+		}
+		return true, tx.WithContext(ctx).Create(newRepo).Error
+	}
+
+	existing.UserID = userID
+	existing.ForgeRemoteID = remoteID
+	existing.Owner = repository.Owner
+	existing.Name = repository.Name
+	existing.FullName = repository.FullName
+	existing.Avatar = repository.AvatarURL
+	existing.ForgeURL = repository.WebURL
+	existing.Clone = repository.HTTPCloneURL
+	existing.CloneSSH = repository.SSHCloneURL
+	existing.Branch = repository.DefaultBranch
+	existing.Visibility = repository.Visibility
+	existing.IsSCMPrivate = repository.IsPrivate
+	existing.PREnabled = true
+	existing.Timeout = 0
+	if activate {
+		existing.IsActive = true
+	}
+	existing.AllowPull = true
+	existing.AllowDeploy = true
+	existing.Config = repository.ConfigPath
+	existing.Trusted = trusted
+	existing.RequireApproval = model.RequireApprovalForks
+	existing.CancelPreviousPipelineEvents = []model.WebhookEvent{}
+	existing.NetrcTrustedPlugins = []string{}
+	existing.ConfigExtensionEndpoint = ""
+
+	return false, tx.WithContext(ctx).Save(&existing).Error
+}
+
+// repoOrgID returns the organization a repository of owner belongs to: the organization named
+// like the owner, otherwise the default organization.
+func repoOrgID(ctx context.Context, tx *gorm.DB, owner string) (int64, error) {
+	var org model.Organization
+	err := tx.WithContext(ctx).Where("LOWER(name) = ?", strings.ToLower(strings.TrimSpace(owner))).Take(&org).Error
+	if err == nil {
+		return org.ID, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	return tenancy.DefaultOrgID(ctx, tx)
+}
+
+// SetOrganization moves a repository to orgID. Its pipelines resolve certificates and
+// approver groups of that organization from then on. Both the repository and orgID must be in
+// the organization scope of ctx.
+func (s *Service) SetOrganization(ctx context.Context, repoID, orgID int64) error {
 	return s.db.Transaction(func(tx *gorm.DB) error {
-		for _, repository := range repositories {
-			if repository.RemoteID == "" {
-				continue
-			}
-
-			remoteID := model.ForgeRemoteID(repository.RemoteID)
-			trusted := model.TrustedConfiguration{}
-
-			var existing model.Repo
-			err := tx.WithContext(ctx).Where("forge_id = ? AND forge_remote_id = ?", forgeID, remoteID).Take(&existing).Error
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				err = tx.WithContext(ctx).
-					Where("forge_id = ? AND owner = ? AND name = ?", forgeID, repository.Owner, repository.Name).
-					Take(&existing).Error
-			}
-			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-				return err
-			}
-
-			if existing.ID == 0 {
-				newRepo := &model.Repo{
-					ForgeID:                      forgeID,
-					ForgeRemoteID:                remoteID,
-					UserID:                       userID,
-					OrgID:                        0,
-					Owner:                        repository.Owner,
-					Name:                         repository.Name,
-					FullName:                     repository.FullName,
-					Avatar:                       repository.AvatarURL,
-					ForgeURL:                     repository.WebURL,
-					Clone:                        repository.HTTPCloneURL,
-					CloneSSH:                     repository.SSHCloneURL,
-					Branch:                       repository.DefaultBranch,
-					Visibility:                   repository.Visibility,
-					IsSCMPrivate:                 repository.IsPrivate,
-					PREnabled:                    true,
-					Timeout:                      0,
-					IsActive:                     activate,
-					AllowPull:                    true,
-					AllowDeploy:                  true,
-					Config:                       repository.ConfigPath,
-					Trusted:                      trusted,
-					RequireApproval:              model.RequireApprovalForks,
-					CancelPreviousPipelineEvents: []model.WebhookEvent{},
-					NetrcTrustedPlugins:          []string{},
-					Hash:                         generateRepoHash(),
-				}
-				if err := tx.WithContext(ctx).Create(newRepo).Error; err != nil {
-					return err
-				}
-				continue
-			}
-
-			existing.UserID = userID
-			existing.ForgeRemoteID = remoteID
-			existing.Owner = repository.Owner
-			existing.Name = repository.Name
-			existing.FullName = repository.FullName
-			existing.Avatar = repository.AvatarURL
-			existing.ForgeURL = repository.WebURL
-			existing.Clone = repository.HTTPCloneURL
-			existing.CloneSSH = repository.SSHCloneURL
-			existing.Branch = repository.DefaultBranch
-			existing.Visibility = repository.Visibility
-			existing.IsSCMPrivate = repository.IsPrivate
-			existing.PREnabled = true
-			existing.Timeout = 0
-			if activate {
-				existing.IsActive = true
-			}
-			existing.AllowPull = true
-			existing.AllowDeploy = true
-			existing.Config = repository.ConfigPath
-			existing.Trusted = trusted
-			existing.RequireApproval = model.RequireApprovalForks
-			existing.CancelPreviousPipelineEvents = []model.WebhookEvent{}
-			existing.NetrcTrustedPlugins = []string{}
-			existing.ConfigExtensionEndpoint = ""
-
-			if err := tx.WithContext(ctx).Save(&existing).Error; err != nil {
-				return err
-			}
+		if orgID == 0 {
+			return tenancy.ErrOrganizationNotFound
+		}
+		if _, err := tenancy.ResolveOrg(ctx, tx, orgID); err != nil {
+			return err
+		}
+		result := tenancy.Filter(ctx, tx.WithContext(ctx).Model(&model.Repo{}), "org_id").
+			Where("id = ?", repoID).
+			Update("org_id", orgID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
 		}
 		return nil
 	})
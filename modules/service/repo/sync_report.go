@@ -0,0 +1,92 @@
+package repo
+
+const (
+	SyncSkipOrgFilter       = "org_filter"
+	SyncSkipForkExcluded    = "fork_excluded"
+	SyncSkipArchived        = "archived"
+	SyncSkipConversionError = "conversion_error"
+	// SyncSkipManualRepo is a forge repository named like an imported one.
+	SyncSkipManualRepo = "manual_repo"
+)
+
+// maxSyncReportEntries bounds the skip and error lists of a report; counters keep counting.
+const maxSyncReportEntries = 50
+
+// SyncReport is the outcome of synchronizing the repositories of one provider. A failing
+// repository is recorded in Errors and does not stop the others.
+type SyncReport struct {
+	Provider   string           `json:"provider"`
+	Discovered int              `json:"discovered"`
+	Created    int              `json:"created"`
+	Updated    int              `json:"updated"`
+	Skipped    int              `json:"skipped"`
+	Failed     int              `json:"failed"`
+	Skips      []SyncSkipEntry  `json:"skips,omitempty"`
+	Errors     []SyncErrorEntry `json:"errors,omitempty"`
+	// Complete is false when listing the provider stopped early, so repositories missing from
+	// the report may still exist. Decisions about repositories absent from a sync, such as
+	// deactivating them, must only be taken on complete reports.
+	Complete bool `json:"complete"`
+	// Truncated is true when Skips or Errors hit the entry limit.
+	Truncated bool `json:"truncated,omitempty"`
+	// RateLimited is true when the rate limit of the provider stopped listing; RetryAt is
+	// when it accepts requests again in unix seconds, 0 when it did not say.
+	RateLimited bool  `json:"rate_limited,omitempty"`
+	RetryAt     int64 `json:"retry_at,omitempty"`
+}
+
+// SyncSkipEntry is a repository the provider listed but the sync left out.
+type SyncSkipEntry struct {
+	Repo   string `json:"repo"`
+	Reason string `json:"reason"`
+}
+
+// SyncErrorEntry is a repository, or a listing page when Repo is empty, that failed to sync.
+type SyncErrorEntry struct {
+	Repo  string `json:"repo,omitempty"`
+	Error string `json:"error"`
+}
+
+// NewSyncReport starts a report for provider; it is complete until a listing failure is
+// recorded.
+func NewSyncReport(provider string) *SyncReport {
+	return &SyncReport{Provider: provider, Complete: true}
+}
+
+// Skip records a listed repository that is not synchronized.
+func (r *SyncReport) Skip(repo, reason string) {
+	r.Discovered++
+	r.Skipped++
+	if len(r.Skips) >= maxSyncReportEntries {
+		r.Truncated = true
+		return
+	}
+	r.Skips = append(r.Skips, SyncSkipEntry{Repo: repo, Reason: reason})
+}
+
+// Fail records a repository that could not be synchronized.
+func (r *SyncReport) Fail(repo string, err error) {
+	r.Failed++
+	r.addError(repo, err)
+}
+
+// ListingFailed records that listing stopped early and marks the report incomplete.
+func (r *SyncReport) ListingFailed(err error) {
+	r.Complete = false
+	r.addError("", err)
+}
+
+// ListingRateLimited records that the rate limit of the provider stopped listing early.
+func (r *SyncReport) ListingRateLimited(err error, retryAt int64) {
+	r.ListingFailed(err)
+	r.RateLimited = true
+	r.RetryAt = retryAt
+}
+
+func (r *SyncReport) addError(repo string, err error) {
+	if len(r.Errors) >= maxSyncReportEntries {
+		r.Truncated = true
+		return
+	}
+	r.Errors = append(r.Errors, SyncErrorEntry{Repo: repo, Error: err.Error()})
+}
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/pipeline/spec"
+)
+
+var ErrVariableInvalid = errors.New("仓库变量配置无效")
+
+var variableKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ListVariables lists the variables of a repository by key, values included. Callers
+// returning them from the API must redact secret values.
+func (s *Service) ListVariables(ctx context.Context, repoID int64) ([]*model.RepoVariable, error) {
+	var variables []*model.RepoVariable
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Where("repo_id = ?", repoID).Order("var_key ASC").Find(&variables).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// SetVariable creates or updates the variable key of a repository. A nil value keeps the
+// stored one, so a secret can be toggled without sending it again.
+func (s *Service) SetVariable(ctx context.Context, repoID int64, key string, value *string, secret bool) (*model.RepoVariable, error) {
+	key = strings.TrimSpace(key)
+	if !variableKeyPattern.MatchString(key) {
+		return nil, fmt.Errorf("%w: 变量名只能包含字母、数字和下划线，且不能以数字开头", ErrVariableInvalid)
+	}
+	if spec.IsReservedEnv(key) {
+		return nil, fmt.Errorf("%w: %s 与系统保留变量冲突", ErrVariableInvalid, key)
+	}
+
+	var result *model.RepoVariable
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().Unix()
+		var variable model.RepoVariable
+		err := tx.WithContext(ctx).Where("repo_id = ? AND var_key = ?", repoID, key).Take(&variable).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if value == nil {
+				return fmt.Errorf("%w: 新变量必须提供值", ErrVariableInvalid)
+			}
+			variable = model.RepoVariable{RepoID: repoID, Key: key, Value: *value, Secret: secret, Created: now, Updated: now}
+			if err := tx.WithContext(ctx).Create(&variable).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			updates := map[string]any{"secret": secret, "updated": now}
+			if value != nil {
+				updates["value"] = *value
+				variable.Value = *value
+			}
+			variable.Secret = secret
+			variable.Updated = now
+			if err := tx.WithContext(ctx).Model(&variable).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		result = &variable
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteVariable removes the variable key of a repository.
+func (s *Service) DeleteVariable(ctx context.Context, repoID int64, key string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("repo_id = ? AND var_key = ?", repoID, strings.TrimSpace(key)).Delete(&model.RepoVariable{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
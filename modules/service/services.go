@@ -2,11 +2,17 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/thepenn/devsys/internal/cache"
 	"github.com/thepenn/devsys/internal/config"
+	"github.com/thepenn/devsys/internal/metrics"
+	"github.com/thepenn/devsys/internal/proxy"
 	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/model"
+	"github.com/thepenn/devsys/service/audit"
 	"github.com/thepenn/devsys/service/auth"
 	k8s "github.com/thepenn/devsys/service/k8s"
 	pipelineService "github.com/thepenn/devsys/service/pipeline"
@@ -24,16 +30,59 @@ type Services struct {
 	Auth     *auth.Service
 	System   *systemService.Service
 	K8s      *k8s.Service
+	// Audit records user actions; its flusher runs between App start and close.
+	Audit *audit.Service
+	// Proxy routes outbound HTTP traffic; Kubernetes clients keep their kubeconfig settings.
+	Proxy *proxy.Rules
+	// Metrics collects application metrics exposed on /metrics.
+	Metrics *metrics.Registry
+	// Cache is the shared cache store, e.g. for the request counts of rate limits.
+	Cache cache.Store
+
+	cfg *config.Config
 }
 
-func NewServices(db *store.DB, q *queue.PipelineQueue, cache *cache.Cache, cfg *config.Config) (*Services, error) {
+func NewServices(db *store.DB, q *queue.PipelineQueue, cache cache.Store, cfg *config.Config, registry *metrics.Registry) (*Services, error) {
+	stepCeiling, err := pipelineService.ParseStepResources(cfg.Pipeline.StepResources.MaxCPU, cfg.Pipeline.StepResources.MaxMemory)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline step resource ceiling: %w", err)
+	}
 	pipelineOpts := []pipelineService.Option{
 		pipelineService.WithWorkerCount(cfg.Pipeline.WorkerCount),
+		pipelineService.WithMaxParallelSteps(cfg.Pipeline.MaxParallelSteps),
+		pipelineService.WithNamespaceLockTimeout(cfg.Pipeline.NamespaceLockTimeout),
+		pipelineService.WithApprovalSweepInterval(cfg.Pipeline.ApprovalSweepInterval),
+		pipelineService.WithApprovalReminderRatio(cfg.Pipeline.ApprovalReminderRatio),
+		pipelineService.WithShutdownGracePeriod(cfg.Pipeline.ShutdownGracePeriod),
+		pipelineService.WithStepResourceCeiling(stepCeiling),
 		pipelineService.WithCacheTTL(3 * time.Minute),
+		pipelineService.WithWorkspaceCacheLimit(cfg.Pipeline.CacheMaxSize),
+		pipelineService.WithWorkspaceQuota(cfg.Pipeline.WorkspaceSoftLimit, cfg.Pipeline.WorkspaceHardLimit),
+		pipelineService.WithArtifacts(cfg.Pipeline.Artifacts.Root, pipelineService.ArtifactLimits{
+			MaxFiles:     cfg.Pipeline.Artifacts.MaxFiles,
+			MaxFileSize:  cfg.Pipeline.Artifacts.MaxFileSize,
+			MaxTotalSize: cfg.Pipeline.Artifacts.MaxTotalSize,
+		}),
+		pipelineService.WithLogLimits(pipelineService.LogLimits{
+			MaxLines:  cfg.Pipeline.Logs.MaxLines,
+			TailLines: cfg.Pipeline.Logs.TailLines,
+		}),
+		pipelineService.WithLogRetentionInterval(cfg.Pipeline.Logs.RetentionInterval),
+		pipelineService.WithHostEnv(cfg.Pipeline.InheritHostEnv, cfg.Pipeline.HostEnv),
+	}
+
+	proxyRules, err := proxy.New(cfg.Server.Proxy.URL, cfg.Server.Proxy.NoProxy)
+	if err != nil {
+		return nil, err
 	}
 
-	userSvc := userService.New(db)
-	repoSvc := repoService.New(db)
+	auditSvc := audit.New(db,
+		audit.WithBufferSize(cfg.Server.Audit.BufferSize),
+		audit.WithRetention(cfg.Server.Audit.Retention, cfg.Server.Audit.CleanupInterval),
+	)
+
+	userSvc := userService.New(db, userService.WithTenancy(cfg.Server.Tenancy.Enabled, cfg.Server.Tenancy.SuperAdmins))
+	repoSvc := repoService.New(db, repoService.WithAudit(auditSvc))
 
 	systemSvc, err := systemService.New(db)
 	if err != nil {
@@ -44,13 +93,55 @@ func NewServices(db *store.DB, q *queue.PipelineQueue, cache *cache.Cache, cfg *
 		return nil, err
 	}
 
-	pipelineOpts = append(pipelineOpts, pipelineService.WithSystemService(systemSvc))
-	pipelineSvc := pipelineService.NewService(db, q, cache, pipelineOpts...)
-	authSvc, err := auth.New(cfg, db, userSvc, repoSvc)
+	authSvc, err := auth.New(cfg, db, userSvc, repoSvc, proxyRules)
 	if err != nil {
 		return nil, err
 	}
-	k8sSvc := k8s.New(systemSvc)
+	if err := authSvc.UseSessionKeyStore(context.Background(), systemSvc); err != nil {
+		return nil, err
+	}
+	authSvc.UseAudit(auditSvc)
+	authSvc.UseCache(cache)
+
+	pipelineOpts = append(pipelineOpts,
+		pipelineService.WithSystemService(systemSvc),
+		pipelineService.WithWebhookRegistrar(authSvc),
+		pipelineService.WithRepositoryContentReader(authSvc),
+		pipelineService.WithForgeStatusReporter(authSvc),
+		pipelineService.WithBranchHeadReader(authSvc),
+		pipelineService.WithNotifications(cfg.Server.PublicURL, proxyRules),
+		pipelineService.WithMetrics(registry),
+		pipelineService.WithTenancy(cfg.Server.Tenancy.Enabled),
+		pipelineService.WithAudit(auditSvc),
+		pipelineService.WithAgentToken(cfg.Pipeline.AgentToken),
+	)
+	if provenance := cfg.Pipeline.Provenance; strings.TrimSpace(provenance.Key) != "" {
+		signer, err := pipelineService.NewProvenanceSigner(provenance.Key, provenance.KeyID, provenance.VerifyKeys)
+		if err != nil {
+			return nil, err
+		}
+		builderID := provenance.BuilderID
+		if strings.TrimSpace(builderID) == "" {
+			builderID = cfg.Server.PublicURL
+		}
+		pipelineOpts = append(pipelineOpts, pipelineService.WithProvenance(signer, builderID))
+	}
+	k8sSvc := k8s.New(systemSvc, registry,
+		k8s.WithStore(db),
+		k8s.WithDriftCheckInterval(cfg.Pipeline.DriftCheckInterval),
+		k8s.WithAudit(auditSvc),
+		k8s.WithExecRecording(cfg.Server.ExecRecording.Dir, cfg.Server.ExecRecording.InlineMaxSize),
+	)
+	pipelineOpts = append(pipelineOpts, pipelineService.WithK8sService(k8sSvc))
+	pipelineSvc := pipelineService.NewService(db, q, cache, pipelineOpts...)
+	k8sSvc.SetDriftNotifier(pipelineSvc)
+	repoSvc.SetPipelineController(pipelineSvc)
+	if q != nil {
+		registry.RegisterQueue(func() (int, int) {
+			stats := q.Stats()
+			return stats.Pending, stats.InFlight
+		})
+	}
 
 	return &Services{
 		User:     userSvc,
@@ -59,5 +150,29 @@ func NewServices(db *store.DB, q *queue.PipelineQueue, cache *cache.Cache, cfg *
 		Auth:     authSvc,
 		System:   systemSvc,
 		K8s:      k8sSvc,
+		Audit:    auditSvc,
+		Proxy:    proxyRules,
+		Metrics:  registry,
+		Cache:    cache,
+		cfg:      cfg,
 	}, nil
 }
+
+// Capabilities reports which optional subsystems are usable with the current wiring and configuration.
+func (s *Services) Capabilities() model.Capabilities {
+	features := map[model.Capability]bool{}
+	if s == nil {
+		return model.NewCapabilities(features)
+	}
+	features[model.CapabilityPipeline] = s.Pipeline != nil && s.Pipeline.Available()
+	features[model.CapabilityKubernetes] = s.K8s != nil && s.System != nil
+	if s.cfg != nil {
+		git := s.cfg.Git
+		features[model.CapabilityGitHub] = git.GitHub.Enabled && git.GitHub.ClientID != ""
+		features[model.CapabilityGitLab] = git.GitLab.Enabled && git.GitLab.ClientID != ""
+		features[model.CapabilityGitee] = git.Gitee.Enabled && git.Gitee.ClientID != ""
+		features[model.CapabilityGitea] = git.Gitea.Enabled && git.Gitea.ClientID != ""
+		features[model.CapabilityOIDC] = git.OIDC.Enabled && git.OIDC.ClientID != ""
+	}
+	return model.NewCapabilities(features)
+}
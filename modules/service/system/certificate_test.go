@@ -0,0 +1,121 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/store/storetest"
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+// newOrgCertificates returns a service over a database holding organizations payments (1)
+// and logistics (2), each with a docker certificate named "registry", and the ids of the
+// certificates by organization.
+func newOrgCertificates(t *testing.T) (*Service, map[int64]int64) {
+	t.Helper()
+	db := storetest.Open(t, &model.ServerConfig{}, &model.Organization{}, &model.Certificate{})
+	for _, org := range []*model.Organization{{ID: 1, Name: "payments"}, {ID: 2, Name: "logistics"}} {
+		if err := db.GetDB().Create(org).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]int64)
+	for _, org := range []struct {
+		id   int64
+		name string
+	}{{1, "payments"}, {2, "logistics"}} {
+		ctx := tenancy.WithScope(context.Background(), tenancy.Orgs(org.id))
+		cert, err := svc.CreateCertificate(ctx, &model.Certificate{
+			Name:   "registry",
+			Type:   "docker",
+			Config: map[string]interface{}{"username": org.name, "repo": "registry.example/" + org.name},
+		})
+		if err != nil {
+			t.Fatalf("CreateCertificate for %s: %v", org.name, err)
+		}
+		if cert.OrgID != org.id {
+			t.Fatalf("certificate of %s belongs to org %d", org.name, cert.OrgID)
+		}
+		ids[org.id] = cert.ID
+	}
+	return svc, ids
+}
+
+func TestCertificateNameCollisionAcrossOrgs(t *testing.T) {
+	svc, ids := newOrgCertificates(t)
+
+	for _, orgID := range []int64{1, 2} {
+		ctx := tenancy.WithScope(context.Background(), tenancy.Orgs(orgID))
+		cert, err := svc.GetCertificateByName(ctx, " REGISTRY ")
+		if err != nil {
+			t.Fatalf("GetCertificateByName in org %d: %v", orgID, err)
+		}
+		if cert == nil || cert.ID != ids[orgID] {
+			t.Fatalf("GetCertificateByName in org %d = %+v, want certificate %d", orgID, cert, ids[orgID])
+		}
+		withSecrets, err := svc.GetCertificateWithSecretsByName(ctx, "registry")
+		if err != nil || withSecrets == nil || withSecrets.ID != ids[orgID] {
+			t.Fatalf("GetCertificateWithSecretsByName in org %d = %+v, %v", orgID, withSecrets, err)
+		}
+	}
+
+	// an organization without the name sees nothing, however many others have it
+	outsider := tenancy.WithScope(context.Background(), tenancy.Orgs(3))
+	if cert, err := svc.GetCertificateByName(outsider, "registry"); err != nil || cert != nil {
+		t.Fatalf("GetCertificateByName outside both orgs = %+v, %v, want nothing", cert, err)
+	}
+	// unrestricted internal callers get the oldest match
+	if cert, err := svc.GetCertificateByName(context.Background(), "registry"); err != nil || cert == nil || cert.ID != ids[1] {
+		t.Fatalf("unrestricted GetCertificateByName = %+v, %v, want certificate %d", cert, err, ids[1])
+	}
+}
+
+func TestCertificateAccessAcrossOrgsReadsAsMissing(t *testing.T) {
+	svc, ids := newOrgCertificates(t)
+	payments := tenancy.WithScope(context.Background(), tenancy.Orgs(1))
+	other := ids[2]
+
+	if cert, err := svc.GetCertificate(payments, other); err != nil || cert != nil {
+		t.Errorf("GetCertificate of another org = %+v, %v, want nothing", cert, err)
+	}
+	if cert, err := svc.GetCertificateWithSecrets(payments, other); err != nil || cert != nil {
+		t.Errorf("GetCertificateWithSecrets of another org = %+v, %v, want nothing", cert, err)
+	}
+	name := "stolen"
+	if cert, err := svc.UpdateCertificate(payments, other, model.CertificatePatch{Name: &name}); err != nil || cert != nil {
+		t.Errorf("UpdateCertificate of another org = %+v, %v, want nothing", cert, err)
+	}
+	if err := svc.DeleteCertificate(payments, other); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("DeleteCertificate of another org = %v, want not found", err)
+	}
+	list, total, err := svc.ListCertificates(payments, model.ListOptions{All: true}, model.CertificateFilter{})
+	if err != nil {
+		t.Fatalf("ListCertificates: %v", err)
+	}
+	if total != 1 || len(list) != 1 || list[0].ID != ids[1] {
+		t.Errorf("ListCertificates = %d %+v, want only the payments certificate", total, list)
+	}
+
+	// moving a certificate into an organization outside the scope is refused the same way
+	orgID := int64(2)
+	if _, err := svc.UpdateCertificate(payments, ids[1], model.CertificatePatch{OrgID: &orgID}); !errors.Is(err, tenancy.ErrOrganizationNotFound) {
+		t.Errorf("UpdateCertificate into another org = %v, want ErrOrganizationNotFound", err)
+	}
+	if _, err := svc.CreateCertificate(payments, &model.Certificate{Name: "x", Type: "docker", OrgID: 2}); !errors.Is(err, tenancy.ErrOrganizationNotFound) {
+		t.Errorf("CreateCertificate in another org = %v, want ErrOrganizationNotFound", err)
+	}
+
+	// the certificate of the other organization is untouched
+	logistics := tenancy.WithScope(context.Background(), tenancy.Orgs(2))
+	if cert, err := svc.GetCertificate(logistics, other); err != nil || cert == nil || cert.Name != "registry" || cert.Version != 0 {
+		t.Errorf("certificate of logistics = %+v, %v, want it unchanged", cert, err)
+	}
+}
@@ -0,0 +1,259 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	ErrSecretExists  = errors.New("密钥名称已存在")
+	ErrSecretInvalid = errors.New("密钥配置无效")
+)
+
+// ListSecrets lists the secrets owned by repoID; 0 lists global secrets. Values stay encrypted.
+func (s *Service) ListSecrets(ctx context.Context, repoID int64) ([]*model.Secret, error) {
+	var secrets []*model.Secret
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id = ?", repoID).
+			Order("name ASC").
+			Find(&secrets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GetSecret returns the secret with encrypted values, or nil when it does not exist.
+func (s *Service) GetSecret(ctx context.Context, id int64) (*model.Secret, error) {
+	var secret model.Secret
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).First(&secret, id).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// FindSecret looks name up (case-insensitive) among the secrets of repoID first and the
+// global secrets second. Values stay encrypted; nil means neither scope defines the name.
+func (s *Service) FindSecret(ctx context.Context, repoID int64, name string) (*model.Secret, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, nil
+	}
+	var secrets []*model.Secret
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("repo_id IN ? AND LOWER(name) = ?", []int64{0, repoID}, strings.ToLower(name)).
+			Order("repo_id DESC").
+			Limit(1).
+			Find(&secrets).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	return secrets[0], nil
+}
+
+// ResolveSecret is FindSecret with decrypted values.
+func (s *Service) ResolveSecret(ctx context.Context, repoID int64, name string) (*model.Secret, error) {
+	secret, err := s.FindSecret(ctx, repoID, name)
+	if err != nil || secret == nil {
+		return secret, err
+	}
+	values := make(map[string]string, len(secret.Values))
+	for key, cipher := range secret.Values {
+		plain, err := s.decryptSecretValue(ctx, cipher)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt secret %s.%s: %w", secret.Name, key, err)
+		}
+		values[key] = plain
+	}
+	secret.Values = values
+	return secret, nil
+}
+
+// CreateSecret encrypts the values and persists a new secret.
+func (s *Service) CreateSecret(ctx context.Context, secret *model.Secret) (*model.Secret, error) {
+	if secret == nil {
+		return nil, fmt.Errorf("secret is nil")
+	}
+	name, err := normalizeSecretName(secret.Name)
+	if err != nil {
+		return nil, err
+	}
+	secret.Name = name
+	if secret.RepoID < 0 {
+		secret.RepoID = 0
+	}
+	if len(secret.Values) == 0 {
+		return nil, fmt.Errorf("%w: 至少需要一个键值", ErrSecretInvalid)
+	}
+
+	encrypted := make(map[string]string, len(secret.Values))
+	for key, value := range secret.Values {
+		key, err = normalizeSecretKey(key)
+		if err != nil {
+			return nil, err
+		}
+		value = strings.TrimSpace(value)
+		if value == "" || value == model.DefaultSecretMask {
+			return nil, fmt.Errorf("%w: %s 的值不能为空", ErrSecretInvalid, key)
+		}
+		cipher, err := s.encryptSecretValue(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt %s: %w", key, err)
+		}
+		encrypted[key] = cipher
+	}
+	secret.Values = encrypted
+
+	now := time.Now().Unix()
+	secret.ID = 0
+	secret.Created = now
+	secret.Updated = now
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureSecretNameFree(ctx, tx, secret.RepoID, secret.Name, 0); err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Create(secret).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// UpdateSecret renames a secret and merges patch.Values into it. Returns nil when the
+// secret does not exist.
+func (s *Service) UpdateSecret(ctx context.Context, id int64, patch model.SecretPatch) (*model.Secret, error) {
+	var updated *model.Secret
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var secret model.Secret
+		if err := tx.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&secret, id).Error; err != nil {
+			return err
+		}
+
+		if patch.Name != nil {
+			name, err := normalizeSecretName(*patch.Name)
+			if err != nil {
+				return err
+			}
+			if err := ensureSecretNameFree(ctx, tx, secret.RepoID, name, secret.ID); err != nil {
+				return err
+			}
+			secret.Name = name
+		}
+
+		if secret.Values == nil {
+			secret.Values = map[string]string{}
+		}
+		for key, value := range patch.Values {
+			key, err := normalizeSecretKey(key)
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				delete(secret.Values, key)
+				continue
+			}
+			trimmed := strings.TrimSpace(*value)
+			if trimmed == "" || trimmed == model.DefaultSecretMask {
+				continue
+			}
+			cipher, err := s.encryptSecretValue(ctx, trimmed)
+			if err != nil {
+				return fmt.Errorf("encrypt %s: %w", key, err)
+			}
+			secret.Values[key] = cipher
+		}
+		if len(secret.Values) == 0 {
+			return fmt.Errorf("%w: 至少需要一个键值", ErrSecretInvalid)
+		}
+
+		secret.Updated = time.Now().Unix()
+		if err := tx.WithContext(ctx).Save(&secret).Error; err != nil {
+			return err
+		}
+		updated = &secret
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteSecret removes a secret by id.
+func (s *Service) DeleteSecret(ctx context.Context, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Delete(&model.Secret{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func ensureSecretNameFree(ctx context.Context, tx *gorm.DB, repoID int64, name string, excludeID int64) error {
+	var count int64
+	if err := tx.WithContext(ctx).
+		Model(&model.Secret{}).
+		Where("repo_id = ? AND LOWER(name) = ? AND id <> ?", repoID, strings.ToLower(name), excludeID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrSecretExists, name)
+	}
+	return nil
+}
+
+// normalizeSecretName keeps names usable as `${name.key}` placeholders.
+func normalizeSecretName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: 名称不能为空", ErrSecretInvalid)
+	}
+	if strings.ContainsAny(name, " \t.{}$") {
+		return "", fmt.Errorf("%w: 名称不能包含空白、点、花括号或 $", ErrSecretInvalid)
+	}
+	return name, nil
+}
+
+func normalizeSecretKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("%w: 键不能为空", ErrSecretInvalid)
+	}
+	if strings.ContainsAny(key, " \t{}$") {
+		return "", fmt.Errorf("%w: 键 %s 不能包含空白、花括号或 $", ErrSecretInvalid, key)
+	}
+	return key, nil
+}
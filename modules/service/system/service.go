@@ -17,6 +17,7 @@ import (
 	"gorm.io/gorm/clause"
 
 	"github.com/thepenn/devsys/internal/store"
+	"github.com/thepenn/devsys/internal/tenancy"
 	"github.com/thepenn/devsys/model"
 )
 
@@ -35,6 +36,9 @@ type Service struct {
 	mu         sync.RWMutex
 	publicKey  string
 	privateKey *rsa.PrivateKey
+
+	hookMu            sync.RWMutex
+	certificateChange []func(id int64)
 }
 
 func New(db *store.DB) (*Service, error) {
@@ -237,7 +241,8 @@ func parseRSAPrivateKey(privatePEM string) (*rsa.PrivateKey, error) {
 	}
 }
 
-// ListCertificates returns certificates matching the provided filters.
+// ListCertificates returns certificates matching the provided filters within the organization
+// scope of ctx.
 func (s *Service) ListCertificates(ctx context.Context, opts model.ListOptions, filter model.CertificateFilter) ([]*model.Certificate, int64, error) {
 	var (
 		page    = opts.Page
@@ -264,7 +269,10 @@ func (s *Service) ListCertificates(ctx context.Context, opts model.ListOptions,
 	)
 
 	err := s.db.View(func(tx *gorm.DB) error {
-		query := tx.WithContext(ctx).Model(&model.Certificate{})
+		query := tenancy.Filter(ctx, tx.WithContext(ctx).Model(&model.Certificate{}), "org_id")
+		if filter.OrgID != 0 {
+			query = query.Where("org_id = ?", filter.OrgID)
+		}
 
 		if t := strings.TrimSpace(filter.Type); t != "" {
 			query = query.Where("type = ?", t)
@@ -290,11 +298,12 @@ func (s *Service) ListCertificates(ctx context.Context, opts model.ListOptions,
 	return certificates, total, nil
 }
 
-// GetCertificate fetches a certificate by id.
+// GetCertificate fetches a certificate by id. Certificates outside the organization scope of
+// ctx are reported as missing.
 func (s *Service) GetCertificate(ctx context.Context, id int64) (*model.Certificate, error) {
 	var cert model.Certificate
 	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).First(&cert, id).Error
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").First(&cert, id).Error
 	})
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, nil
@@ -320,7 +329,8 @@ func (s *Service) GetCertificateWithSecrets(ctx context.Context, id int64) (*mod
 	return clone, nil
 }
 
-// GetCertificateByName fetches a certificate by name (case-insensitive).
+// GetCertificateByName fetches a certificate by name (case-insensitive) within the organization
+// scope of ctx, so equally named certificates of other organizations never match.
 func (s *Service) GetCertificateByName(ctx context.Context, name string) (*model.Certificate, error) {
 	name = strings.TrimSpace(name)
 	if name == "" {
@@ -329,8 +339,9 @@ func (s *Service) GetCertificateByName(ctx context.Context, name string) (*model
 
 	var cert model.Certificate
 	err := s.db.View(func(tx *gorm.DB) error {
-		return tx.WithContext(ctx).
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").
 			Where("LOWER(name) = ?", strings.ToLower(name)).
+			Order("id ASC").
 			Take(&cert).Error
 	})
 	if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -357,7 +368,8 @@ func (s *Service) GetCertificateWithSecretsByName(ctx context.Context, name stri
 	return clone, nil
 }
 
-// CreateCertificate persists a new certificate record after validating sensitive fields.
+// CreateCertificate persists a new certificate record after validating sensitive fields. An
+// unset OrgID assigns the certificate to the first organization of the caller.
 func (s *Service) CreateCertificate(ctx context.Context, cert *model.Certificate) (*model.Certificate, error) {
 	if cert == nil {
 		return nil, fmt.Errorf("certificate is nil")
@@ -375,6 +387,11 @@ func (s *Service) CreateCertificate(ctx context.Context, cert *model.Certificate
 	if cert.Type == "" {
 		return nil, fmt.Errorf("certificate type is required")
 	}
+	if cert.Type == model.CertificateTypeSSH {
+		if err := validateSSHConfig(cert.Config); err != nil {
+			return nil, err
+		}
+	}
 
 	sanitizedConfig, err := s.normalizeConfigForStorage(ctx, cert.Config, false)
 	if err != nil {
@@ -387,6 +404,11 @@ func (s *Service) CreateCertificate(ctx context.Context, cert *model.Certificate
 	cert.Updated = now
 
 	err = s.db.Transaction(func(tx *gorm.DB) error {
+		orgID, err := tenancy.ResolveOrg(ctx, tx, cert.OrgID)
+		if err != nil {
+			return err
+		}
+		cert.OrgID = orgID
 		return tx.WithContext(ctx).Create(cert).Error
 	})
 	if err != nil {
@@ -401,7 +423,7 @@ func (s *Service) UpdateCertificate(ctx context.Context, id int64, patch model.C
 
 	err := s.db.Transaction(func(tx *gorm.DB) error {
 		var cert model.Certificate
-		if err := tx.WithContext(ctx).
+		if err := tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").
 			Clauses(clause.Locking{Strength: "UPDATE"}).
 			First(&cert, id).Error; err != nil {
 			return err
@@ -428,8 +450,25 @@ func (s *Service) UpdateCertificate(ctx context.Context, id int64, patch model.C
 			}
 			cert.MergeConfig(sanitized)
 		}
+		if cert.Type == model.CertificateTypeSSH && (patch.Type != nil || patch.Config != nil) {
+			plain, err := s.decryptSensitiveConfig(ctx, cert.Config)
+			if err != nil {
+				return err
+			}
+			if err := validateSSHConfig(plain); err != nil {
+				return err
+			}
+		}
+		if patch.OrgID != nil {
+			orgID, err := tenancy.ResolveOrg(ctx, tx, *patch.OrgID)
+			if err != nil {
+				return err
+			}
+			cert.OrgID = orgID
+		}
 
 		cert.Updated = time.Now().Unix()
+		cert.Version++
 
 		if err := tx.WithContext(ctx).Save(&cert).Error; err != nil {
 			return err
@@ -443,13 +482,14 @@ func (s *Service) UpdateCertificate(ctx context.Context, id int64, patch model.C
 	if err != nil {
 		return nil, err
 	}
+	s.notifyCertificateChange(updated.ID)
 	return updated, nil
 }
 
 // DeleteCertificate removes a certificate by id.
 func (s *Service) DeleteCertificate(ctx context.Context, id int64) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		result := tx.WithContext(ctx).Delete(&model.Certificate{}, id)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tenancy.Filter(ctx, tx.WithContext(ctx), "org_id").Delete(&model.Certificate{}, id)
 		if result.Error != nil {
 			return result.Error
 		}
@@ -458,6 +498,31 @@ func (s *Service) DeleteCertificate(ctx context.Context, id int64) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	s.notifyCertificateChange(id)
+	return nil
+}
+
+// OnCertificateChange registers fn to be called after a certificate is updated or deleted,
+// so consumers can drop anything they derived from the old contents.
+func (s *Service) OnCertificateChange(fn func(id int64)) {
+	if fn == nil {
+		return
+	}
+	s.hookMu.Lock()
+	s.certificateChange = append(s.certificateChange, fn)
+	s.hookMu.Unlock()
+}
+
+func (s *Service) notifyCertificateChange(id int64) {
+	s.hookMu.RLock()
+	hooks := append([]func(int64){}, s.certificateChange...)
+	s.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn(id)
+	}
 }
 
 func (s *Service) decryptSensitiveConfig(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
@@ -0,0 +1,63 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/thepenn/devsys/model"
+)
+
+const sessionKeysConfigKey = "auth.session_keys"
+
+// LoadSessionKeys returns the persisted session keys, or nil when they were never rotated.
+func (s *Service) LoadSessionKeys(ctx context.Context) (*model.SessionKeys, error) {
+	var row model.ServerConfig
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Where("`key` = ?", sessionKeysConfigKey).
+			Take(&row).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := s.decryptSecretValue(ctx, row.Value)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt session keys: %w", err)
+	}
+	var keys model.SessionKeys
+	if err := json.Unmarshal([]byte(plain), &keys); err != nil {
+		return nil, fmt.Errorf("decode session keys: %w", err)
+	}
+	return &keys, nil
+}
+
+// SaveSessionKeys encrypts and persists the session keys.
+func (s *Service) SaveSessionKeys(ctx context.Context, keys *model.SessionKeys) error {
+	if keys == nil {
+		return fmt.Errorf("session keys are nil")
+	}
+	raw, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	cipher, err := s.encryptSecretValue(ctx, string(raw))
+	if err != nil {
+		return fmt.Errorf("encrypt session keys: %w", err)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "key"}},
+				DoUpdates: clause.AssignmentColumns([]string{"value"}),
+			}).
+			Create(&model.ServerConfig{Key: sessionKeysConfigKey, Value: cipher}).Error
+	})
+}
@@ -0,0 +1,58 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrCertificateInvalid is returned for certificate configs that cannot be used.
+var ErrCertificateInvalid = errors.New("certificate config is invalid")
+
+// validateSSHConfig checks the plain config of an ssh certificate: the private key must parse,
+// with the passphrase when it is encrypted, and known_hosts must hold at least one host key,
+// as clones never trust unknown hosts. An empty passphrase is dropped.
+func validateSSHConfig(config map[string]interface{}) error {
+	privateKey, _ := config["private_key"].(string)
+	passphrase, _ := config["passphrase"].(string)
+	knownHosts, _ := config["known_hosts"].(string)
+	if strings.TrimSpace(passphrase) == "" {
+		delete(config, "passphrase")
+	}
+	if strings.TrimSpace(privateKey) == "" {
+		return fmt.Errorf("%w: private_key is required", ErrCertificateInvalid)
+	}
+	if _, err := ssh.ParseRawPrivateKey([]byte(privateKey)); err != nil {
+		var missing *ssh.PassphraseMissingError
+		if !errors.As(err, &missing) {
+			return fmt.Errorf("%w: private_key: %v", ErrCertificateInvalid, err)
+		}
+		if strings.TrimSpace(passphrase) == "" {
+			return fmt.Errorf("%w: passphrase is required for the encrypted private_key", ErrCertificateInvalid)
+		}
+		if _, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase)); err != nil {
+			return fmt.Errorf("%w: private_key cannot be decrypted: %v", ErrCertificateInvalid, err)
+		}
+	}
+
+	hosts := 0
+	rest := []byte(knownHosts)
+	for len(rest) > 0 {
+		var err error
+		_, _, _, _, rest, err = ssh.ParseKnownHosts(rest)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: known_hosts: %v", ErrCertificateInvalid, err)
+		}
+		hosts++
+	}
+	if hosts == 0 {
+		return fmt.Errorf("%w: known_hosts is required", ErrCertificateInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/thepenn/devsys/internal/tenancy"
+	"github.com/thepenn/devsys/model"
+)
+
+var (
+	ErrOrganizationExists  = errors.New("组织名称已存在")
+	ErrOrganizationInvalid = errors.New("组织配置无效")
+	ErrOrganizationInUse   = errors.New("组织仍有凭证、审批组或仓库")
+)
+
+// Option configures the user service.
+type Option func(*Service)
+
+// WithTenancy enables organization scoping. Logins in superAdmins bypass it.
+func WithTenancy(enabled bool, superAdmins []string) Option {
+	return func(s *Service) {
+		s.tenancy = enabled
+		s.superAdmins = make(map[string]struct{}, len(superAdmins))
+		for _, login := range superAdmins {
+			if login = strings.ToLower(strings.TrimSpace(login)); login != "" {
+				s.superAdmins[login] = struct{}{}
+			}
+		}
+	}
+}
+
+// TenancyEnabled reports whether callers are scoped by organization.
+func (s *Service) TenancyEnabled() bool {
+	return s.tenancy
+}
+
+// IsSuperAdmin reports whether user bypasses organization scoping.
+func (s *Service) IsSuperAdmin(user *model.User) bool {
+	if user == nil {
+		return false
+	}
+	_, ok := s.superAdmins[strings.ToLower(user.Login)]
+	return ok
+}
+
+// Scope returns the organizations user may see. It is unrestricted when multi-tenancy is
+// disabled or user is a super-admin.
+func (s *Service) Scope(ctx context.Context, user *model.User) (tenancy.Scope, error) {
+	if !s.tenancy || s.IsSuperAdmin(user) {
+		return tenancy.Unrestricted(), nil
+	}
+	if user == nil {
+		return tenancy.Orgs(), nil
+	}
+	var ids []int64
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Model(&model.OrgMember{}).
+			Where("user_id = ?", user.ID).
+			Order("org_id ASC").
+			Pluck("org_id", &ids).Error
+	})
+	if err != nil {
+		return tenancy.Scope{}, err
+	}
+	return tenancy.Orgs(ids...), nil
+}
+
+// ListOrganizations lists the organizations visible to ctx.
+func (s *Service) ListOrganizations(ctx context.Context) ([]*model.Organization, error) {
+	var orgs []*model.Organization
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "id").Order("name ASC").Find(&orgs).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// GetOrganization returns the organization, or nil when it is missing or outside the scope
+// of ctx.
+func (s *Service) GetOrganization(ctx context.Context, id int64) (*model.Organization, error) {
+	var org model.Organization
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tenancy.Filter(ctx, tx.WithContext(ctx), "id").First(&org, id).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// CreateOrganization persists a new organization. Naming it after a forge organization maps
+// the forge members into it at their next login.
+func (s *Service) CreateOrganization(ctx context.Context, name string) (*model.Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: 名称不能为空", ErrOrganizationInvalid)
+	}
+	now := time.Now().Unix()
+	org := &model.Organization{Name: name, Created: now, Updated: now}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.WithContext(ctx).
+			Model(&model.Organization{}).
+			Where("LOWER(name) = ?", strings.ToLower(name)).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: %s", ErrOrganizationExists, name)
+		}
+		return tx.WithContext(ctx).Create(org).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// DeleteOrganization removes an organization and its memberships. Organizations that still
+// own certificates, approver groups or repositories, and the default organization, are kept.
+func (s *Service) DeleteOrganization(ctx context.Context, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var org model.Organization
+		if err := tenancy.Filter(ctx, tx.WithContext(ctx), "id").First(&org, id).Error; err != nil {
+			return err
+		}
+		if org.Name == model.DefaultOrganizationName {
+			return fmt.Errorf("%w: 默认组织不能删除", ErrOrganizationInUse)
+		}
+		for _, owned := range []interface{}{&model.Certificate{}, &model.ApproverGroup{}, &model.Repo{}} {
+			var count int64
+			if err := tx.WithContext(ctx).Model(owned).Where("org_id = ?", id).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrOrganizationInUse
+			}
+		}
+		if err := tx.WithContext(ctx).Where("org_id = ?", id).Delete(&model.OrgMember{}).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Delete(&org).Error
+	})
+}
+
+// ListOrgMembers lists the members of an organization visible to ctx.
+func (s *Service) ListOrgMembers(ctx context.Context, orgID int64) ([]model.OrgMemberInfo, error) {
+	if !tenancy.FromContext(ctx).Allows(orgID) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var members []model.OrgMemberInfo
+	err := s.db.View(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).
+			Table("org_members").
+			Select("org_members.user_id AS user_id, users.login AS login, org_members.source AS source").
+			Joins("JOIN users ON users.id = org_members.user_id").
+			Where("org_members.org_id = ?", orgID).
+			Order("users.login ASC").
+			Scan(&members).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// AddOrgMember assigns login to an organization manually. Manual memberships survive forge
+// membership changes.
+func (s *Service) AddOrgMember(ctx context.Context, orgID int64, login string) error {
+	if !tenancy.FromContext(ctx).Allows(orgID) {
+		return gorm.ErrRecordNotFound
+	}
+	user, err := s.FindByLogin(ctx, strings.TrimSpace(login))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w: 用户 %s 不存在", ErrOrganizationInvalid, login)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.WithContext(ctx).First(&model.Organization{}, orgID).Error; err != nil {
+			return err
+		}
+		var member model.OrgMember
+		err := tx.WithContext(ctx).Where("org_id = ? AND user_id = ?", orgID, user.ID).Take(&member).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return tx.WithContext(ctx).Create(&model.OrgMember{
+				OrgID:   orgID,
+				UserID:  user.ID,
+				Source:  model.OrgMemberSourceManual,
+				Created: time.Now().Unix(),
+			}).Error
+		case err != nil:
+			return err
+		default:
+			return tx.WithContext(ctx).Model(&member).Update("source", model.OrgMemberSourceManual).Error
+		}
+	})
+}
+
+// RemoveOrgMember removes a membership of any source. A forge membership comes back at the
+// next login while the user still belongs to the forge organization.
+func (s *Service) RemoveOrgMember(ctx context.Context, orgID, userID int64) error {
+	if !tenancy.FromContext(ctx).Allows(orgID) {
+		return gorm.ErrRecordNotFound
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.WithContext(ctx).Where("org_id = ? AND user_id = ?", orgID, userID).Delete(&model.OrgMember{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// syncForgeOrgMembers replaces the forge memberships of userID with the organizations named
+// like forgeOrgs. Forge organizations without a counterpart are ignored; manual memberships
+// are kept.
+func syncForgeOrgMembers(ctx context.Context, tx *gorm.DB, userID int64, forgeOrgs []string) error {
+	names := make([]string, 0, len(forgeOrgs))
+	for _, name := range forgeOrgs {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	var orgIDs []int64
+	if len(names) > 0 {
+		if err := tx.WithContext(ctx).
+			Model(&model.Organization{}).
+			Where("LOWER(name) IN ?", names).
+			Pluck("id", &orgIDs).Error; err != nil {
+			return err
+		}
+	}
+
+	stale := tx.WithContext(ctx).Where("user_id = ? AND source = ?", userID, model.OrgMemberSourceForge)
+	if len(orgIDs) > 0 {
+		stale = stale.Where("org_id NOT IN ?", orgIDs)
+	}
+	if err := stale.Delete(&model.OrgMember{}).Error; err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, orgID := range orgIDs {
+		var count int64
+		if err := tx.WithContext(ctx).
+			Model(&model.OrgMember{}).
+			Where("org_id = ? AND user_id = ?", orgID, userID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := tx.WithContext(ctx).Create(&model.OrgMember{
+			OrgID:   orgID,
+			UserID:  userID,
+			Source:  model.OrgMemberSourceForge,
+			Created: now,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
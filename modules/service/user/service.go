@@ -18,10 +18,17 @@ import (
 // Service encapsulates user related business logic.
 type Service struct {
 	db *store.DB
+
+	tenancy     bool
+	superAdmins map[string]struct{}
 }
 
-func New(db *store.DB) *Service {
-	return &Service{db: db}
+func New(db *store.DB, opts ...Option) *Service {
+	s := &Service{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Create persists a new user record.
@@ -68,6 +75,17 @@ func (s *Service) Update(ctx context.Context, user *model.User) error {
 	})
 }
 
+// UpdateSyncStatus stores the notice of the last repository sync of a user; an empty notice
+// clears it.
+func (s *Service) UpdateSyncStatus(ctx context.Context, userID int64, notice string, retryAt int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.WithContext(ctx).Model(&model.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"sync_notice":   notice,
+			"sync_retry_at": retryAt,
+		}).Error
+	})
+}
+
 // List returns all users.
 func (s *Service) List(ctx context.Context) ([]*model.User, error) {
 	var users []*model.User
@@ -85,6 +103,8 @@ type GitUser struct {
 	Email    string
 	Avatar   string
 	IsAdmin  bool
+	// Orgs lists the forge organizations of the user; nil leaves forge memberships unchanged.
+	Orgs []string
 }
 
 func (s *Service) UpsertGitUser(ctx context.Context, forgeID int64, info GitUser, token *oauth2.Token) (*model.User, error) {
@@ -156,6 +176,11 @@ func (s *Service) UpsertGitUser(ctx context.Context, forgeID int64, info GitUser
 			return nil
 		}
 	})
+	if err == nil && info.Orgs != nil {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			return syncForgeOrgMembers(ctx, tx, result.ID, info.Orgs)
+		})
+	}
 	if err != nil {
 		return nil, err
 	}